@@ -14,10 +14,33 @@
 
 package api
 
-import "github.com/matrix-org/gomatrixserverlib"
+import (
+	"encoding/json"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
 
 // ExtraPublicRoomsProvider provides a way to inject extra published rooms into /publicRooms requests.
 type ExtraPublicRoomsProvider interface {
 	// Rooms returns the extra rooms. This is called on-demand by clients, so cache appropriately.
 	Rooms() []gomatrixserverlib.PublicRoom
 }
+
+// DelayedEvent is an event which is sent into the room by the client API once its delay
+// has passed (MSC4140).
+type DelayedEvent struct {
+	DelayID  string
+	UserID   string
+	RoomID   string
+	Type     string
+	StateKey *string
+	Content  json.RawMessage
+	// The delay in milliseconds, counted from RunningSince
+	DelayMS      int64
+	RunningSince gomatrixserverlib.Timestamp
+}
+
+// SendTS is when the event is due to be sent.
+func (e *DelayedEvent) SendTS() gomatrixserverlib.Timestamp {
+	return e.RunningSince + gomatrixserverlib.Timestamp(e.DelayMS)
+}
@@ -19,6 +19,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/api"
 	"github.com/matrix-org/dendrite/clientapi/producers"
 	"github.com/matrix-org/dendrite/clientapi/routing"
+	"github.com/matrix-org/dendrite/clientapi/storage"
 	federationAPI "github.com/matrix-org/dendrite/federationapi/api"
 	"github.com/matrix-org/dendrite/internal/transactions"
 	keyserverAPI "github.com/matrix-org/dendrite/keyserver/api"
@@ -27,6 +28,7 @@ import (
 	"github.com/matrix-org/dendrite/setup/jetstream"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
 )
 
 // AddPublicRoutes sets up and registers HTTP handlers for the ClientAPI component.
@@ -56,6 +58,16 @@ func AddPublicRoutes(
 		ServerName:             cfg.Matrix.ServerName,
 	}
 
+	var delayedEvents *routing.DelayedEvents
+	if cfg.DelayedEvents.Enabled {
+		db, err := storage.NewClientAPIDatasource(base, &cfg.Database)
+		if err != nil {
+			logrus.WithError(err).Panicf("failed to connect to client api db")
+		}
+		delayedEvents = routing.NewDelayedEvents(db, cfg, rsAPI)
+		go delayedEvents.Run(base.ProcessContext.Context())
+	}
+
 	routing.Setup(
 		base.PublicClientAPIMux,
 		base.PublicWellKnownAPIMux,
@@ -65,5 +77,6 @@ func AddPublicRoutes(
 		userAPI, userDirectoryProvider, federation,
 		syncProducer, transactionsCache, fsAPI, keyAPI,
 		extRoomsProvider, mscCfg, natsClient,
+		delayedEvents,
 	)
 }
@@ -98,6 +98,12 @@ func UnknownToken(msg string) *MatrixError {
 	return &MatrixError{"M_UNKNOWN_TOKEN", msg}
 }
 
+// UnknownPos is an error when the client supplies a sliding sync position which
+// the server no longer knows about, e.g. because the connection expired.
+func UnknownPos(msg string) *MatrixError {
+	return &MatrixError{"M_UNKNOWN_POS", msg}
+}
+
 // WeakPassword is an error which is returned when the client tries to register
 // using a weak password. http://matrix.org/docs/spec/client_server/r0.2.0.html#password-based
 func WeakPassword(msg string) *MatrixError {
@@ -205,6 +211,30 @@ func LimitExceeded(msg string, retryAfterMS int64) *LimitExceededError {
 	}
 }
 
+// MaxDelayExceeded is an error when the client schedules a delayed event
+// further in the future than the server allows.
+func MaxDelayExceeded(msg string) *MatrixError {
+	return &MatrixError{"M_MAX_DELAY_EXCEEDED", msg}
+}
+
+// NotYetUploaded is an error when the client requests media whose content
+// has not been uploaded yet.
+func NotYetUploaded(msg string) *MatrixError {
+	return &MatrixError{"M_NOT_YET_UPLOADED", msg}
+}
+
+// CannotOverwriteMedia is an error when the client tries to upload content
+// for media which already has content.
+func CannotOverwriteMedia(msg string) *MatrixError {
+	return &MatrixError{"M_CANNOT_OVERWRITE_MEDIA", msg}
+}
+
+// QuotaExceeded is an error when the client uploads media which would take
+// the user over their storage quota.
+func QuotaExceeded(msg string) *MatrixError {
+	return &MatrixError{"M_QUOTA_EXCEEDED", msg}
+}
+
 // NotTrusted is an error which is returned when the client asks the server to
 // proxy a request (e.g. 3PID association) to a server that isn't trusted
 func NotTrusted(serverName string) *MatrixError {
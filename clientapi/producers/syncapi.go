@@ -148,6 +148,7 @@ func (p *SyncAPIProducer) SendTyping(
 
 func (p *SyncAPIProducer) SendPresence( // 发送出席消息（比如进入某个房间）
 	ctx context.Context, userID string, presence types.Presence, statusMsg *string,
+	lastActiveAgo int64, privacy types.PresencePrivacy,
 ) error {
 	m := nats.NewMsg(p.TopicPresenceEvent)
 	m.Header.Set(jetstream.UserID, userID)
@@ -155,8 +156,10 @@ func (p *SyncAPIProducer) SendPresence( // 发送出席消息（比如进入某
 	if statusMsg != nil {
 		m.Header.Set("status_msg", *statusMsg)
 	}
+	m.Header.Set("privacy", privacy.String())
 
-	m.Header.Set("last_active_ts", strconv.Itoa(int(gomatrixserverlib.AsTimestamp(time.Now()))))
+	lastActiveTS := gomatrixserverlib.AsTimestamp(time.Now().Add(-(time.Duration(lastActiveAgo) * time.Millisecond)))
+	m.Header.Set("last_active_ts", strconv.Itoa(int(lastActiveTS)))
 
 	_, err := p.JetStream.PublishMsg(m, nats.Context(ctx))
 	return err
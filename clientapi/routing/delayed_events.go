@@ -0,0 +1,383 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/api"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/storage"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// delayedEventsDelayParam is the query parameter of /send and /state holding the delay in milliseconds
+	delayedEventsDelayParam = "org.matrix.msc4140.delay"
+	// How long the scheduler waits at most before it looks for due events again, so that
+	// events scheduled by other client API instances are sent in time too
+	delayedEventsMaxWait = time.Minute
+	// How many due events are sent at once
+	delayedEventsBatchSize = 100
+	// How long a scheduler may take to send an event before others may send it again
+	delayedEventsClaimDuration = time.Minute
+	delayIDLength              = 24
+)
+
+type delayedEventResponse struct {
+	DelayID string `json:"delay_id"`
+}
+
+type delayedEventInfo struct {
+	DelayID      string                      `json:"delay_id"`
+	RoomID       string                      `json:"room_id"`
+	Type         string                      `json:"type"`
+	StateKey     *string                     `json:"state_key,omitempty"`
+	Delay        int64                       `json:"delay"`
+	RunningSince gomatrixserverlib.Timestamp `json:"running_since"`
+	Content      json.RawMessage             `json:"content"`
+}
+
+type delayedEventsResponse struct {
+	DelayedEvents []delayedEventInfo `json:"delayed_events"`
+}
+
+type updateDelayedEventRequest struct {
+	Action string `json:"action"`
+}
+
+// DelayedEvents keeps the events which clients sent with a delay and sends them into
+// their rooms once the delay has passed (MSC4140).
+type DelayedEvents struct {
+	db    storage.Database
+	cfg   *config.ClientAPI
+	rsAPI roomserverAPI.ClientRoomserverAPI
+	wake  chan struct{}
+}
+
+func NewDelayedEvents(db storage.Database, cfg *config.ClientAPI, rsAPI roomserverAPI.ClientRoomserverAPI) *DelayedEvents {
+	return &DelayedEvents{
+		db:    db,
+		cfg:   cfg,
+		rsAPI: rsAPI,
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// Run sends the delayed events when they are due until the context is done. The events
+// are kept in the database, so events which became due while the server was down are
+// sent as soon as it runs again.
+func (d *DelayedEvents) Run(ctx context.Context) {
+	for {
+		d.sendDueEvents(ctx)
+
+		wait := delayedEventsMaxWait
+		next, err := d.db.NextDelayedEventTS(ctx)
+		if err != nil {
+			logrus.WithError(err).Error("Failed to get the next delayed event")
+		} else if next != 0 {
+			if untilNext := time.Until(next.Time()); untilNext < wait {
+				wait = untilNext
+			}
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-d.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// notify wakes up the scheduler, i.e. because an event was scheduled which may be
+// due before the one it is waiting for.
+func (d *DelayedEvents) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *DelayedEvents) sendDueEvents(ctx context.Context) {
+	for {
+		events, err := d.db.GetDueDelayedEvents(ctx, gomatrixserverlib.AsTimestamp(time.Now()), delayedEventsBatchSize)
+		if err != nil {
+			logrus.WithError(err).Error("Failed to get due delayed events")
+			return
+		}
+		for _, ev := range events {
+			if resErr := d.send(ctx, ev); resErr != nil {
+				logrus.WithFields(logrus.Fields{
+					"delay_id": ev.DelayID,
+					"room_id":  ev.RoomID,
+					"user_id":  ev.UserID,
+					"code":     resErr.Code,
+					"retry":    isTemporarySendError(resErr),
+				}).Warnf("Failed to send delayed event: %v", resErr.JSON)
+			}
+		}
+		if len(events) < delayedEventsBatchSize {
+			return
+		}
+	}
+}
+
+// send builds the delayed event and submits it to the roomserver. The delayed event is
+// claimed first, so that only one of several client API instances running the scheduler
+// sends it. It is removed once it was sent, or when it can't be sent any more, i.e.
+// because the user left the room in the meantime. After temporary errors the claim is
+// left to run out, so that the event is sent again then.
+func (d *DelayedEvents) send(ctx context.Context, ev *api.DelayedEvent) *util.JSONResponse {
+	now := time.Now()
+	claimed, err := d.db.ClaimDelayedEvent(
+		ctx, ev.DelayID,
+		gomatrixserverlib.AsTimestamp(now), gomatrixserverlib.AsTimestamp(now.Add(delayedEventsClaimDuration)),
+	)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("failed to claim delayed event")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if !claimed {
+		return &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("The delayed event is already being sent, was sent or was cancelled"),
+		}
+	}
+
+	resErr := d.submit(ctx, ev)
+	if isTemporarySendError(resErr) {
+		return resErr
+	}
+	if _, err = d.db.DeleteDelayedEvent(ctx, ev.DelayID); err != nil {
+		util.GetLogger(ctx).WithError(err).WithField("delay_id", ev.DelayID).Error("failed to remove delayed event")
+	}
+	return resErr
+}
+
+// isTemporarySendError returns whether sending the delayed event failed for a reason
+// which may go away, so that it is worth sending the event again later.
+func isTemporarySendError(resErr *util.JSONResponse) bool {
+	return resErr != nil && resErr.Code >= http.StatusInternalServerError
+}
+
+// submit builds the delayed event and submits it to the roomserver
+func (d *DelayedEvents) submit(ctx context.Context, ev *api.DelayedEvent) *util.JSONResponse {
+	var content map[string]interface{}
+	if err := json.Unmarshal(ev.Content, &content); err != nil {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The content of the delayed event is not valid JSON: " + err.Error()),
+		}
+	}
+	verReq := roomserverAPI.QueryRoomVersionForRoomRequest{RoomID: ev.RoomID}
+	verRes := roomserverAPI.QueryRoomVersionForRoomResponse{}
+	if err := d.rsAPI.QueryRoomVersionForRoom(ctx, &verReq, &verRes); err != nil {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.UnsupportedRoomVersion(err.Error()),
+		}
+	}
+	device := &userapi.Device{UserID: ev.UserID}
+	e, resErr := generateSendEvent(ctx, content, device, ev.RoomID, ev.Type, ev.StateKey, d.cfg, d.rsAPI, time.Now())
+	if resErr != nil {
+		return resErr
+	}
+	if err := roomserverAPI.SendEvents(
+		ctx, d.rsAPI,
+		roomserverAPI.KindNew,
+		[]*gomatrixserverlib.HeaderedEvent{
+			e.Headered(verRes.RoomVersion),
+		},
+		d.cfg.Matrix.ServerName,
+		d.cfg.Matrix.ServerName,
+		nil,
+		false,
+	); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("SendEvents failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	util.GetLogger(ctx).WithFields(logrus.Fields{
+		"delay_id": ev.DelayID,
+		"event_id": e.EventID(),
+		"room_id":  ev.RoomID,
+	}).Info("Sent delayed event to roomserver")
+	return nil
+}
+
+// schedule stores an event from /send or /state which is sent once the delay has passed
+func (d *DelayedEvents) schedule(
+	req *http.Request, device *userapi.Device,
+	roomID, eventType string, stateKey *string,
+	content map[string]interface{}, delayParam string,
+) util.JSONResponse {
+	ctx := req.Context()
+	delay, err := strconv.ParseInt(delayParam, 10, 64)
+	if err != nil || delay < 0 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("The delay must be a non-negative number of milliseconds"),
+		}
+	}
+	if maxDelay := d.cfg.DelayedEvents.MaxDelay.Milliseconds(); delay > maxDelay {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MaxDelayExceeded(fmt.Sprintf("The delay may not be longer than %d milliseconds", maxDelay)),
+		}
+	}
+	if d.cfg.DelayedEvents.MaxPerUser > 0 {
+		count, err := d.db.CountDelayedEvents(ctx, device.UserID)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("failed to count delayed events")
+			return jsonerror.InternalServerError()
+		}
+		if count >= d.cfg.DelayedEvents.MaxPerUser {
+			return util.JSONResponse{
+				Code: http.StatusTooManyRequests,
+				JSON: jsonerror.LimitExceeded(fmt.Sprintf("You may not have more than %d delayed events", d.cfg.DelayedEvents.MaxPerUser), 0),
+			}
+		}
+	}
+
+	// Build the event once now, so that the client learns right away if it isn't
+	// allowed to send it. It is built again when it is due.
+	if _, resErr := generateSendEvent(ctx, content, device, roomID, eventType, stateKey, d.cfg, d.rsAPI, time.Now()); resErr != nil {
+		return *resErr
+	}
+	contentJSON, err := json.Marshal(content)
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	ev := &api.DelayedEvent{
+		DelayID:      util.RandomString(delayIDLength),
+		UserID:       device.UserID,
+		RoomID:       roomID,
+		Type:         eventType,
+		StateKey:     stateKey,
+		Content:      contentJSON,
+		DelayMS:      delay,
+		RunningSince: gomatrixserverlib.AsTimestamp(time.Now()),
+	}
+	if err = d.db.StoreDelayedEvent(ctx, ev); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("failed to store delayed event")
+		return jsonerror.InternalServerError()
+	}
+	d.notify()
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: delayedEventResponse{DelayID: ev.DelayID},
+	}
+}
+
+// GetDelayedEvents implements GET /unstable/org.matrix.msc4140/delayed_events
+// Lists the delayed events of the user which weren't sent yet, the first due first.
+func GetDelayedEvents(req *http.Request, device *userapi.Device, delayedEvents *DelayedEvents) util.JSONResponse {
+	events, err := delayedEvents.db.GetDelayedEventsForUser(req.Context(), device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("failed to get delayed events")
+		return jsonerror.InternalServerError()
+	}
+	res := delayedEventsResponse{
+		DelayedEvents: make([]delayedEventInfo, 0, len(events)),
+	}
+	for _, ev := range events {
+		res.DelayedEvents = append(res.DelayedEvents, delayedEventInfo{
+			DelayID:      ev.DelayID,
+			RoomID:       ev.RoomID,
+			Type:         ev.Type,
+			StateKey:     ev.StateKey,
+			Delay:        ev.DelayMS,
+			RunningSince: ev.RunningSince,
+			Content:      ev.Content,
+		})
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// UpdateDelayedEvent implements POST /unstable/org.matrix.msc4140/delayed_events/{delayID}
+// The action "cancel" drops the event, "restart" counts its delay from now again and
+// "send" sends it right away.
+func UpdateDelayedEvent(req *http.Request, device *userapi.Device, delayedEvents *DelayedEvents, delayID string) util.JSONResponse {
+	ctx := req.Context()
+	var r updateDelayedEventRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	ev, err := delayedEvents.db.GetDelayedEvent(ctx, delayID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("failed to get delayed event")
+		return jsonerror.InternalServerError()
+	}
+	notFound := util.JSONResponse{
+		Code: http.StatusNotFound,
+		JSON: jsonerror.NotFound("Unknown delayed event"),
+	}
+	// Other users' delayed events are reported as unknown, so that their IDs can't be probed
+	if ev == nil || ev.UserID != device.UserID {
+		return notFound
+	}
+
+	switch r.Action {
+	case "cancel":
+		deleted, err := delayedEvents.db.DeleteDelayedEvent(ctx, delayID)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("failed to cancel delayed event")
+			return jsonerror.InternalServerError()
+		}
+		if !deleted {
+			return notFound
+		}
+	case "restart":
+		restarted, err := delayedEvents.db.RestartDelayedEvent(ctx, delayID, gomatrixserverlib.AsTimestamp(time.Now()))
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("failed to restart delayed event")
+			return jsonerror.InternalServerError()
+		}
+		if !restarted {
+			return notFound
+		}
+	case "send":
+		if resErr := delayedEvents.send(ctx, ev); resErr != nil {
+			return *resErr
+		}
+	default:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("The action must be one of 'cancel', 'restart' or 'send'"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
@@ -36,6 +36,10 @@ import (
 type presenceReq struct {
 	Presence  string  `json:"presence"`
 	StatusMsg *string `json:"status_msg,omitempty"`
+	// UNSPEC: how long ago the user was last active on the client. Online
+	// users who have been inactive for longer than the idle timeout become
+	// unavailable.
+	LastActiveAgo int64 `json:"last_active_ago,omitempty"`
 }
 
 func SetPresence(
@@ -43,6 +47,7 @@ func SetPresence(
 	cfg *config.ClientAPI,
 	device *api.Device,
 	producer *producers.SyncAPIProducer,
+	userAPI api.ClientUserAPI,
 	userID string,
 ) util.JSONResponse {
 	if !cfg.Matrix.Presence.EnableOutbound {
@@ -70,7 +75,28 @@ func SetPresence(
 			JSON: jsonerror.Unknown(fmt.Sprintf("Unknown presence '%s'.", presence.Presence)),
 		}
 	}
-	err := producer.SendPresence(req.Context(), userID, presenceStatus, presence.StatusMsg)
+	if presence.LastActiveAgo < 0 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("last_active_ago must not be negative"),
+		}
+	}
+	idle := time.Duration(presence.LastActiveAgo) * time.Millisecond
+	if presenceStatus == types.PresenceOnline && idle >= cfg.Matrix.Presence.IdleTimeout {
+		presenceStatus = types.PresenceUnavailable
+	}
+
+	var accountData api.QueryAccountDataResponse
+	if err := userAPI.QueryAccountData(req.Context(), &api.QueryAccountDataRequest{
+		UserID:   userID,
+		DataType: types.PresencePrivacyAccountDataType,
+	}, &accountData); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryAccountData failed")
+		return jsonerror.InternalServerError()
+	}
+	privacy := types.PresencePrivacyFromAccountData(accountData.GlobalAccountData[types.PresencePrivacyAccountDataType])
+
+	err := producer.SendPresence(req.Context(), userID, presenceStatus, presence.StatusMsg, presence.LastActiveAgo, privacy)
 	if err != nil {
 		log.WithError(err).Errorf("failed to update presence")
 		return util.JSONResponse{
@@ -94,6 +120,7 @@ func GetPresence(
 ) util.JSONResponse {
 	msg := nats.NewMsg(presenceTopic)
 	msg.Header.Set(jetstream.UserID, userID)
+	msg.Header.Set("viewer", device.UserID)
 
 	presence, err := natsClient.RequestMsg(msg, time.Second*10)
 	if err != nil {
@@ -104,7 +131,6 @@ func GetPresence(
 		}
 	}
 
-	statusMsg := presence.Header.Get("status_msg")
 	e := presence.Header.Get("error")
 	if e != "" {
 		log.Errorf("received error msg from nats: %s", e)
@@ -115,6 +141,15 @@ func GetPresence(
 			},
 		}
 	}
+	// Users whose presence we may not see only have a presence of offline
+	if _, ok := presence.Header["last_active_ts"]; !ok {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: types.PresenceClientResponse{
+				Presence: presence.Header.Get("presence"),
+			},
+		}
+	}
 	lastActive, err := strconv.Atoi(presence.Header.Get("last_active_ts"))
 	if err != nil {
 		return util.JSONResponse{
@@ -125,13 +160,17 @@ func GetPresence(
 
 	p := types.PresenceInternal{LastActiveTS: gomatrixserverlib.Timestamp(lastActive)}
 	currentlyActive := p.CurrentlyActive()
+	res := types.PresenceClientResponse{
+		CurrentlyActive: &currentlyActive,
+		LastActiveAgo:   p.LastActiveAgo(),
+		Presence:        presence.Header.Get("presence"),
+	}
+	if _, ok := presence.Header["status_msg"]; ok {
+		statusMsg := presence.Header.Get("status_msg")
+		res.StatusMsg = &statusMsg
+	}
 	return util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: types.PresenceClientResponse{
-			CurrentlyActive: &currentlyActive,
-			LastActiveAgo:   p.LastActiveAgo(),
-			Presence:        presence.Header.Get("presence"),
-			StatusMsg:       &statusMsg,
-		},
+		JSON: res,
 	}
 }
@@ -61,6 +61,7 @@ func Setup(
 	keyAPI keyserverAPI.ClientKeyAPI,
 	extRoomsProvider api.ExtraPublicRoomsProvider,
 	mscCfg *config.MSCs, natsClient *nats.Conn,
+	delayedEvents *DelayedEvents,
 ) {
 	prometheus.MustRegister(amtRegUsers, sendEventDuration)
 
@@ -73,6 +74,9 @@ func Setup(
 	for _, msc := range cfg.MSCs.MSCs {
 		unstableFeatures["org.matrix."+msc] = true
 	}
+	if delayedEvents != nil {
+		unstableFeatures["org.matrix.msc4140"] = true
+	}
 
 	if cfg.Matrix.WellKnownClientName != "" {
 		logrus.Infof("Setting m.homeserver base_url as %s at /.well-known/matrix/client", cfg.Matrix.WellKnownClientName)
@@ -256,6 +260,26 @@ func Setup(
 
 	unstableMux := publicAPIMux.PathPrefix("/unstable").Subrouter()
 
+	if delayedEvents != nil {
+		unstableMux.Handle("/org.matrix.msc4140/delayed_events",
+			httputil.MakeAuthAPI("get_delayed_events", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+				return GetDelayedEvents(req, device, delayedEvents)
+			}),
+		).Methods(http.MethodGet, http.MethodOptions)
+		unstableMux.Handle("/org.matrix.msc4140/delayed_events/{delayID}",
+			httputil.MakeAuthAPI("update_delayed_event", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+				if r := rateLimits.Limit(req, device); r != nil {
+					return *r
+				}
+				vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+				if err != nil {
+					return util.ErrorResponse(err)
+				}
+				return UpdateDelayedEvent(req, device, delayedEvents, vars["delayID"])
+			}),
+		).Methods(http.MethodPost, http.MethodOptions)
+	}
+
 	v3mux.Handle("/createRoom",
 		httputil.MakeAuthAPI("createRoom", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			return CreateRoom(req, device, cfg, userAPI, rsAPI, asAPI)
@@ -381,7 +405,7 @@ func Setup(
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return SendEvent(req, device, vars["roomID"], vars["eventType"], nil, nil, cfg, rsAPI, nil)
+			return SendEvent(req, device, vars["roomID"], vars["eventType"], nil, nil, cfg, rsAPI, nil, delayedEvents)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 	v3mux.Handle("/rooms/{roomID}/send/{eventType}/{txnID}", // API
@@ -392,7 +416,7 @@ func Setup(
 			}
 			txnID := vars["txnID"]
 			return SendEvent(req, device, vars["roomID"], vars["eventType"], &txnID,
-				nil, cfg, rsAPI, transactionsCache)
+				nil, cfg, rsAPI, transactionsCache, delayedEvents)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 	v3mux.Handle("/rooms/{roomID}/event/{eventID}",
@@ -449,7 +473,7 @@ func Setup(
 			}
 			emptyString := ""
 			eventType := strings.TrimSuffix(vars["eventType"], "/")
-			return SendEvent(req, device, vars["roomID"], eventType, nil, &emptyString, cfg, rsAPI, nil)
+			return SendEvent(req, device, vars["roomID"], eventType, nil, &emptyString, cfg, rsAPI, nil, delayedEvents)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 
@@ -460,7 +484,7 @@ func Setup(
 				return util.ErrorResponse(err)
 			}
 			stateKey := vars["stateKey"]
-			return SendEvent(req, device, vars["roomID"], vars["eventType"], nil, &stateKey, cfg, rsAPI, nil)
+			return SendEvent(req, device, vars["roomID"], vars["eventType"], nil, &stateKey, cfg, rsAPI, nil, delayedEvents)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 
@@ -1417,7 +1441,7 @@ func Setup(
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return SetPresence(req, cfg, device, syncProducer, vars["userId"])
+			return SetPresence(req, cfg, device, syncProducer, userAPI, vars["userId"])
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 	v3mux.Handle("/presence/{userId}/status",
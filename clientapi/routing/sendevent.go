@@ -69,6 +69,8 @@ var sendEventDuration = prometheus.NewHistogramVec(
 //	/rooms/{roomID}/send/{eventType}
 //	/rooms/{roomID}/send/{eventType}/{txnID}
 //	/rooms/{roomID}/state/{eventType}/{stateKey}
+//
+// delayedEvents is nil if delayed events are disabled.
 func SendEvent(
 	req *http.Request,
 	device *userapi.Device,
@@ -76,6 +78,7 @@ func SendEvent(
 	cfg *config.ClientAPI,
 	rsAPI api.ClientRoomserverAPI,
 	txnCache *transactions.Cache,
+	delayedEvents *DelayedEvents,
 ) util.JSONResponse {
 
 	if os.Getenv("CHAT_SERVER_MODE") == "chain" {
@@ -124,6 +127,20 @@ func SendEvent(
 		return *resErr
 	}
 
+	if delayParam := req.URL.Query().Get(delayedEventsDelayParam); delayParam != "" {
+		if delayedEvents == nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.Unknown("Delayed events are not enabled on this server"),
+			}
+		}
+		res := delayedEvents.schedule(req, device, roomID, eventType, stateKey, r, delayParam)
+		if txnID != nil && res.Code == http.StatusOK {
+			txnCache.AddTransaction(device.AccessToken, *txnID, &res)
+		}
+		return res
+	}
+
 	if stateKey != nil {
 		// If the existing/new state content are equal, return the existing event_id, making the request idempotent.
 		if resp := stateEqual(req.Context(), rsAPI, eventType, *stateKey, roomID, r); resp != nil {
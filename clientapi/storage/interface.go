@@ -0,0 +1,51 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+
+	"github.com/matrix-org/dendrite/clientapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type Database interface {
+	DelayedEvents
+}
+
+type DelayedEvents interface {
+	StoreDelayedEvent(ctx context.Context, ev *api.DelayedEvent) error
+	// GetDelayedEvent returns nil if there is no delayed event with the ID.
+	GetDelayedEvent(ctx context.Context, delayID string) (*api.DelayedEvent, error)
+	// GetDelayedEventsForUser returns the delayed events of the user, the first due first.
+	GetDelayedEventsForUser(ctx context.Context, userID string) ([]*api.DelayedEvent, error)
+	CountDelayedEvents(ctx context.Context, userID string) (int64, error)
+	// RestartDelayedEvent counts the delay of the event from runningSince again. Returns false
+	// if there is no delayed event with the ID.
+	RestartDelayedEvent(ctx context.Context, delayID string, runningSince gomatrixserverlib.Timestamp) (bool, error)
+	// ClaimDelayedEvent marks the delayed event as being sent until the time, so that no other
+	// scheduler sends it meanwhile. Returns false if there is no delayed event with the ID or
+	// it is already being sent.
+	ClaimDelayedEvent(ctx context.Context, delayID string, now, until gomatrixserverlib.Timestamp) (bool, error)
+	// DeleteDelayedEvent returns false if there is no delayed event with the ID, i.e. because
+	// it was already sent or cancelled.
+	DeleteDelayedEvent(ctx context.Context, delayID string) (bool, error)
+	// GetDueDelayedEvents returns up to limit delayed events which are due at the time and
+	// aren't being sent, the first due first.
+	GetDueDelayedEvents(ctx context.Context, now gomatrixserverlib.Timestamp, limit int) ([]*api.DelayedEvent, error)
+	// NextDelayedEventTS returns when the next delayed event is due, or 0 if there are none.
+	// Events which are being sent are due again when their claim runs out.
+	NextDelayedEventTS(ctx context.Context) (gomatrixserverlib.Timestamp, error)
+}
@@ -0,0 +1,88 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/clientapi/api"
+	"github.com/matrix-org/dendrite/clientapi/storage/tables"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type Database struct {
+	DB            *sql.DB
+	Writer        sqlutil.Writer
+	DelayedEvents tables.DelayedEvents
+}
+
+func (d Database) StoreDelayedEvent(ctx context.Context, ev *api.DelayedEvent) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.DelayedEvents.InsertDelayedEvent(ctx, txn, ev)
+	})
+}
+
+func (d Database) GetDelayedEvent(ctx context.Context, delayID string) (*api.DelayedEvent, error) {
+	ev, err := d.DelayedEvents.SelectDelayedEvent(ctx, nil, delayID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return ev, err
+}
+
+func (d Database) GetDelayedEventsForUser(ctx context.Context, userID string) ([]*api.DelayedEvent, error) {
+	return d.DelayedEvents.SelectDelayedEventsForUser(ctx, nil, userID)
+}
+
+func (d Database) CountDelayedEvents(ctx context.Context, userID string) (int64, error) {
+	return d.DelayedEvents.CountDelayedEventsForUser(ctx, nil, userID)
+}
+
+func (d Database) RestartDelayedEvent(ctx context.Context, delayID string, runningSince gomatrixserverlib.Timestamp) (restarted bool, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		count, err := d.DelayedEvents.UpdateDelayedEventRunningSince(ctx, txn, delayID, runningSince)
+		restarted = count > 0
+		return err
+	})
+	return
+}
+
+func (d Database) ClaimDelayedEvent(ctx context.Context, delayID string, now, until gomatrixserverlib.Timestamp) (claimed bool, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		count, err := d.DelayedEvents.ClaimDelayedEvent(ctx, txn, delayID, now, until)
+		claimed = count > 0
+		return err
+	})
+	return
+}
+
+func (d Database) DeleteDelayedEvent(ctx context.Context, delayID string) (deleted bool, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		count, err := d.DelayedEvents.DeleteDelayedEvent(ctx, txn, delayID)
+		deleted = count > 0
+		return err
+	})
+	return
+}
+
+func (d Database) GetDueDelayedEvents(ctx context.Context, now gomatrixserverlib.Timestamp, limit int) ([]*api.DelayedEvent, error) {
+	return d.DelayedEvents.SelectDueDelayedEvents(ctx, nil, now, limit)
+}
+
+func (d Database) NextDelayedEventTS(ctx context.Context) (gomatrixserverlib.Timestamp, error) {
+	return d.DelayedEvents.SelectNextDelayedEventTS(ctx, nil)
+}
@@ -0,0 +1,223 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/clientapi/api"
+	"github.com/matrix-org/dendrite/clientapi/storage/tables"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const delayedEventsSchema = `
+-- The clientapi_delayed_events table holds the events which are sent once their delay has passed.
+CREATE TABLE IF NOT EXISTS clientapi_delayed_events (
+    delay_id TEXT NOT NULL PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    room_id TEXT NOT NULL,
+    event_type TEXT NOT NULL,
+    -- NULL for message events
+    state_key TEXT,
+    content TEXT NOT NULL,
+    delay_ms BIGINT NOT NULL,
+    -- When the delay started, in milliseconds
+    running_since BIGINT NOT NULL,
+    -- When the event is due, running_since + delay_ms
+    send_ts BIGINT NOT NULL,
+    -- Until when a scheduler is sending the event, in milliseconds
+    claimed_until BIGINT NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS clientapi_delayed_events_user_id_idx ON clientapi_delayed_events(user_id);
+CREATE INDEX IF NOT EXISTS clientapi_delayed_events_send_ts_idx ON clientapi_delayed_events(send_ts);
+`
+
+const insertDelayedEventSQL = "" +
+	"INSERT INTO clientapi_delayed_events (delay_id, user_id, room_id, event_type, state_key, content, delay_ms, running_since, send_ts)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)"
+
+const selectDelayedEventSQL = "" +
+	"SELECT delay_id, user_id, room_id, event_type, state_key, content, delay_ms, running_since" +
+	" FROM clientapi_delayed_events WHERE delay_id = $1"
+
+const selectDelayedEventsForUserSQL = "" +
+	"SELECT delay_id, user_id, room_id, event_type, state_key, content, delay_ms, running_since" +
+	" FROM clientapi_delayed_events WHERE user_id = $1 ORDER BY send_ts ASC"
+
+const countDelayedEventsForUserSQL = "" +
+	"SELECT COUNT(*) FROM clientapi_delayed_events WHERE user_id = $1"
+
+const updateDelayedEventRunningSinceSQL = "" +
+	"UPDATE clientapi_delayed_events SET running_since = $1, send_ts = $1 + delay_ms WHERE delay_id = $2"
+
+const claimDelayedEventSQL = "" +
+	"UPDATE clientapi_delayed_events SET claimed_until = $1 WHERE delay_id = $2 AND claimed_until <= $3"
+
+const deleteDelayedEventSQL = "" +
+	"DELETE FROM clientapi_delayed_events WHERE delay_id = $1"
+
+const selectDueDelayedEventsSQL = "" +
+	"SELECT delay_id, user_id, room_id, event_type, state_key, content, delay_ms, running_since" +
+	" FROM clientapi_delayed_events WHERE send_ts <= $1 AND claimed_until <= $1 ORDER BY send_ts ASC LIMIT $2"
+
+// Events which are being sent are due again once their claim runs out
+const selectNextDelayedEventTSSQL = "" +
+	"SELECT COALESCE(MIN(CASE WHEN claimed_until > send_ts THEN claimed_until ELSE send_ts END), 0)" +
+	" FROM clientapi_delayed_events"
+
+type delayedEventsStatements struct {
+	insertDelayedEventStmt             *sql.Stmt
+	selectDelayedEventStmt             *sql.Stmt
+	selectDelayedEventsForUserStmt     *sql.Stmt
+	countDelayedEventsForUserStmt      *sql.Stmt
+	updateDelayedEventRunningSinceStmt *sql.Stmt
+	claimDelayedEventStmt              *sql.Stmt
+	deleteDelayedEventStmt             *sql.Stmt
+	selectDueDelayedEventsStmt         *sql.Stmt
+	selectNextDelayedEventTSStmt       *sql.Stmt
+}
+
+func NewSQLiteDelayedEventsTable(db *sql.DB) (tables.DelayedEvents, error) {
+	s := &delayedEventsStatements{}
+	_, err := db.Exec(delayedEventsSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.insertDelayedEventStmt, insertDelayedEventSQL},
+		{&s.selectDelayedEventStmt, selectDelayedEventSQL},
+		{&s.selectDelayedEventsForUserStmt, selectDelayedEventsForUserSQL},
+		{&s.countDelayedEventsForUserStmt, countDelayedEventsForUserSQL},
+		{&s.updateDelayedEventRunningSinceStmt, updateDelayedEventRunningSinceSQL},
+		{&s.claimDelayedEventStmt, claimDelayedEventSQL},
+		{&s.deleteDelayedEventStmt, deleteDelayedEventSQL},
+		{&s.selectDueDelayedEventsStmt, selectDueDelayedEventsSQL},
+		{&s.selectNextDelayedEventTSStmt, selectNextDelayedEventTSSQL},
+	}.Prepare(db)
+}
+
+func (s *delayedEventsStatements) InsertDelayedEvent(
+	ctx context.Context, txn *sql.Tx, ev *api.DelayedEvent,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.insertDelayedEventStmt).ExecContext(
+		ctx, ev.DelayID, ev.UserID, ev.RoomID, ev.Type, ev.StateKey, string(ev.Content),
+		ev.DelayMS, ev.RunningSince, ev.SendTS(),
+	)
+	return err
+}
+
+func (s *delayedEventsStatements) SelectDelayedEvent(
+	ctx context.Context, txn *sql.Tx, delayID string,
+) (*api.DelayedEvent, error) {
+	return scanDelayedEvent(sqlutil.TxStmtContext(ctx, txn, s.selectDelayedEventStmt).QueryRowContext(ctx, delayID))
+}
+
+func (s *delayedEventsStatements) SelectDelayedEventsForUser(
+	ctx context.Context, txn *sql.Tx, userID string,
+) ([]*api.DelayedEvent, error) {
+	rows, err := sqlutil.TxStmtContext(ctx, txn, s.selectDelayedEventsForUserStmt).QueryContext(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectDelayedEventsForUser: rows.close() failed")
+	return rowsToDelayedEvents(rows)
+}
+
+func (s *delayedEventsStatements) CountDelayedEventsForUser(
+	ctx context.Context, txn *sql.Tx, userID string,
+) (count int64, err error) {
+	err = sqlutil.TxStmtContext(ctx, txn, s.countDelayedEventsForUserStmt).QueryRowContext(ctx, userID).Scan(&count)
+	return
+}
+
+func (s *delayedEventsStatements) UpdateDelayedEventRunningSince(
+	ctx context.Context, txn *sql.Tx, delayID string, runningSince gomatrixserverlib.Timestamp,
+) (int64, error) {
+	res, err := sqlutil.TxStmtContext(ctx, txn, s.updateDelayedEventRunningSinceStmt).ExecContext(ctx, runningSince, delayID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *delayedEventsStatements) ClaimDelayedEvent(
+	ctx context.Context, txn *sql.Tx, delayID string, now, until gomatrixserverlib.Timestamp,
+) (int64, error) {
+	res, err := sqlutil.TxStmtContext(ctx, txn, s.claimDelayedEventStmt).ExecContext(ctx, until, delayID, now)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *delayedEventsStatements) DeleteDelayedEvent(
+	ctx context.Context, txn *sql.Tx, delayID string,
+) (int64, error) {
+	res, err := sqlutil.TxStmtContext(ctx, txn, s.deleteDelayedEventStmt).ExecContext(ctx, delayID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *delayedEventsStatements) SelectDueDelayedEvents(
+	ctx context.Context, txn *sql.Tx, now gomatrixserverlib.Timestamp, limit int,
+) ([]*api.DelayedEvent, error) {
+	rows, err := sqlutil.TxStmtContext(ctx, txn, s.selectDueDelayedEventsStmt).QueryContext(ctx, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectDueDelayedEvents: rows.close() failed")
+	return rowsToDelayedEvents(rows)
+}
+
+func (s *delayedEventsStatements) SelectNextDelayedEventTS(
+	ctx context.Context, txn *sql.Tx,
+) (ts gomatrixserverlib.Timestamp, err error) {
+	err = sqlutil.TxStmtContext(ctx, txn, s.selectNextDelayedEventTSStmt).QueryRowContext(ctx).Scan(&ts)
+	return
+}
+
+func scanDelayedEvent(row interface{ Scan(...interface{}) error }) (*api.DelayedEvent, error) {
+	ev := &api.DelayedEvent{}
+	var stateKey sql.NullString
+	var content string
+	if err := row.Scan(
+		&ev.DelayID, &ev.UserID, &ev.RoomID, &ev.Type, &stateKey, &content, &ev.DelayMS, &ev.RunningSince,
+	); err != nil {
+		return nil, err
+	}
+	if stateKey.Valid {
+		ev.StateKey = &stateKey.String
+	}
+	ev.Content = []byte(content)
+	return ev, nil
+}
+
+func rowsToDelayedEvents(rows *sql.Rows) ([]*api.DelayedEvent, error) {
+	var events []*api.DelayedEvent
+	for rows.Next() {
+		ev, err := scanDelayedEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, ev)
+	}
+	return events, rows.Err()
+}
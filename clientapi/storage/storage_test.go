@@ -0,0 +1,233 @@
+package storage_test
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/api"
+	"github.com/matrix-org/dendrite/clientapi/storage"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+)
+
+func mustCreateDatabase(t *testing.T, dbType test.DBType) (storage.Database, func()) {
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
+	db, err := storage.NewClientAPIDatasource(nil, &config.DatabaseOptions{
+		ConnectionString: config.DataSource(connStr),
+	})
+	if err != nil {
+		t.Fatalf("NewClientAPIDatasource returned %s", err)
+	}
+	return db, close
+}
+
+func TestDelayedEvents(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateDatabase(t, dbType)
+		defer close()
+		ctx := context.Background()
+
+		stateKey := ""
+		first := &api.DelayedEvent{
+			DelayID:      "first",
+			UserID:       "@alice:localhost",
+			RoomID:       "!room:localhost",
+			Type:         "m.room.message",
+			Content:      json.RawMessage(`{"body":"hello","msgtype":"m.text"}`),
+			DelayMS:      1000,
+			RunningSince: 1000,
+		}
+		second := &api.DelayedEvent{
+			DelayID:      "second",
+			UserID:       "@alice:localhost",
+			RoomID:       "!room:localhost",
+			Type:         "m.room.topic",
+			StateKey:     &stateKey,
+			Content:      json.RawMessage(`{"topic":"later"}`),
+			DelayMS:      5000,
+			RunningSince: 1000,
+		}
+		other := &api.DelayedEvent{
+			DelayID:      "other",
+			UserID:       "@bob:localhost",
+			RoomID:       "!room:localhost",
+			Type:         "m.room.message",
+			Content:      json.RawMessage(`{"body":"bye","msgtype":"m.text"}`),
+			DelayMS:      3000,
+			RunningSince: 1000,
+		}
+		for _, ev := range []*api.DelayedEvent{second, first, other} {
+			if err := db.StoreDelayedEvent(ctx, ev); err != nil {
+				t.Fatalf("unable to store delayed event: %v", err)
+			}
+		}
+
+		t.Run("can query delayed events", func(t *testing.T) {
+			got, err := db.GetDelayedEvent(ctx, second.DelayID)
+			if err != nil {
+				t.Fatalf("unable to get delayed event: %v", err)
+			}
+			if !reflect.DeepEqual(got, second) {
+				t.Fatalf("expected delayed event %+v, got %+v", second, got)
+			}
+			got, err = db.GetDelayedEvent(ctx, "unknown")
+			if err != nil {
+				t.Fatalf("unable to get delayed event: %v", err)
+			}
+			if got != nil {
+				t.Fatalf("expected no delayed event, got %+v", got)
+			}
+
+			events, err := db.GetDelayedEventsForUser(ctx, first.UserID)
+			if err != nil {
+				t.Fatalf("unable to get delayed events: %v", err)
+			}
+			if !reflect.DeepEqual(events, []*api.DelayedEvent{first, second}) {
+				t.Fatalf("expected delayed events of %s in the order they are due, got %+v", first.UserID, events)
+			}
+			count, err := db.CountDelayedEvents(ctx, first.UserID)
+			if err != nil {
+				t.Fatalf("unable to count delayed events: %v", err)
+			}
+			if count != 2 {
+				t.Fatalf("expected 2 delayed events, got %d", count)
+			}
+		})
+
+		t.Run("can get due delayed events", func(t *testing.T) {
+			next, err := db.NextDelayedEventTS(ctx)
+			if err != nil {
+				t.Fatalf("unable to get next delayed event: %v", err)
+			}
+			if next != first.SendTS() {
+				t.Fatalf("expected next delayed event at %d, got %d", first.SendTS(), next)
+			}
+			due, err := db.GetDueDelayedEvents(ctx, other.SendTS(), 10)
+			if err != nil {
+				t.Fatalf("unable to get due delayed events: %v", err)
+			}
+			if !reflect.DeepEqual(due, []*api.DelayedEvent{first, other}) {
+				t.Fatalf("expected first and other to be due, got %+v", due)
+			}
+			due, err = db.GetDueDelayedEvents(ctx, other.SendTS(), 1)
+			if err != nil {
+				t.Fatalf("unable to get due delayed events: %v", err)
+			}
+			if !reflect.DeepEqual(due, []*api.DelayedEvent{first}) {
+				t.Fatalf("expected only first to be returned, got %+v", due)
+			}
+		})
+
+		t.Run("can restart delayed events", func(t *testing.T) {
+			restarted, err := db.RestartDelayedEvent(ctx, first.DelayID, 10000)
+			if err != nil {
+				t.Fatalf("unable to restart delayed event: %v", err)
+			}
+			if !restarted {
+				t.Fatalf("expected delayed event to be restarted")
+			}
+			got, err := db.GetDelayedEvent(ctx, first.DelayID)
+			if err != nil {
+				t.Fatalf("unable to get delayed event: %v", err)
+			}
+			if got.RunningSince != 10000 || got.SendTS() != 11000 {
+				t.Fatalf("expected delayed event to be due at 11000, got %d", got.SendTS())
+			}
+			next, err := db.NextDelayedEventTS(ctx)
+			if err != nil {
+				t.Fatalf("unable to get next delayed event: %v", err)
+			}
+			if next != other.SendTS() {
+				t.Fatalf("expected next delayed event at %d, got %d", other.SendTS(), next)
+			}
+			restarted, err = db.RestartDelayedEvent(ctx, "unknown", 10000)
+			if err != nil {
+				t.Fatalf("unable to restart delayed event: %v", err)
+			}
+			if restarted {
+				t.Fatalf("expected unknown delayed event not to be restarted")
+			}
+		})
+
+		t.Run("can claim delayed events", func(t *testing.T) {
+			claimed, err := db.ClaimDelayedEvent(ctx, other.DelayID, other.SendTS(), 8000)
+			if err != nil {
+				t.Fatalf("unable to claim delayed event: %v", err)
+			}
+			if !claimed {
+				t.Fatalf("expected delayed event to be claimed")
+			}
+			claimed, err = db.ClaimDelayedEvent(ctx, other.DelayID, 5000, 9000)
+			if err != nil {
+				t.Fatalf("unable to claim delayed event: %v", err)
+			}
+			if claimed {
+				t.Fatalf("expected delayed event not to be claimed twice")
+			}
+			due, err := db.GetDueDelayedEvents(ctx, 7000, 10)
+			if err != nil {
+				t.Fatalf("unable to get due delayed events: %v", err)
+			}
+			if !reflect.DeepEqual(due, []*api.DelayedEvent{second}) {
+				t.Fatalf("expected claimed delayed event not to be due, got %+v", due)
+			}
+			claimed, err = db.ClaimDelayedEvent(ctx, second.DelayID, 7000, 9000)
+			if err != nil {
+				t.Fatalf("unable to claim delayed event: %v", err)
+			}
+			if !claimed {
+				t.Fatalf("expected delayed event to be claimed")
+			}
+			next, err := db.NextDelayedEventTS(ctx)
+			if err != nil {
+				t.Fatalf("unable to get next delayed event: %v", err)
+			}
+			if next != 8000 {
+				t.Fatalf("expected next delayed event when its claim runs out at 8000, got %d", next)
+			}
+			// The scheduler which claimed the event didn't send it in time
+			claimed, err = db.ClaimDelayedEvent(ctx, other.DelayID, 8000, 12000)
+			if err != nil {
+				t.Fatalf("unable to claim delayed event: %v", err)
+			}
+			if !claimed {
+				t.Fatalf("expected delayed event to be claimed again after the claim ran out")
+			}
+			claimed, err = db.ClaimDelayedEvent(ctx, "unknown", 8000, 12000)
+			if err != nil {
+				t.Fatalf("unable to claim delayed event: %v", err)
+			}
+			if claimed {
+				t.Fatalf("expected unknown delayed event not to be claimed")
+			}
+		})
+
+		t.Run("can delete delayed events", func(t *testing.T) {
+			for _, ev := range []*api.DelayedEvent{first, second, other} {
+				deleted, err := db.DeleteDelayedEvent(ctx, ev.DelayID)
+				if err != nil {
+					t.Fatalf("unable to delete delayed event: %v", err)
+				}
+				if !deleted {
+					t.Fatalf("expected delayed event %s to be deleted", ev.DelayID)
+				}
+			}
+			deleted, err := db.DeleteDelayedEvent(ctx, first.DelayID)
+			if err != nil {
+				t.Fatalf("unable to delete delayed event: %v", err)
+			}
+			if deleted {
+				t.Fatalf("expected delayed event to be deleted only once")
+			}
+			next, err := db.NextDelayedEventTS(ctx)
+			if err != nil {
+				t.Fatalf("unable to get next delayed event: %v", err)
+			}
+			if next != 0 {
+				t.Fatalf("expected no next delayed event, got %d", next)
+			}
+		})
+	})
+}
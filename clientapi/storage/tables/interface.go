@@ -0,0 +1,41 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tables
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/clientapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type DelayedEvents interface {
+	InsertDelayedEvent(ctx context.Context, txn *sql.Tx, ev *api.DelayedEvent) error
+	// SelectDelayedEvent returns sql.ErrNoRows if there is no delayed event with the ID.
+	SelectDelayedEvent(ctx context.Context, txn *sql.Tx, delayID string) (*api.DelayedEvent, error)
+	SelectDelayedEventsForUser(ctx context.Context, txn *sql.Tx, userID string) ([]*api.DelayedEvent, error)
+	CountDelayedEventsForUser(ctx context.Context, txn *sql.Tx, userID string) (int64, error)
+	// UpdateDelayedEventRunningSince returns the number of updated delayed events.
+	UpdateDelayedEventRunningSince(ctx context.Context, txn *sql.Tx, delayID string, runningSince gomatrixserverlib.Timestamp) (int64, error)
+	// ClaimDelayedEvent marks the delayed event as being sent until the time, unless another
+	// claim is still running at now. Returns the number of claimed delayed events.
+	ClaimDelayedEvent(ctx context.Context, txn *sql.Tx, delayID string, now, until gomatrixserverlib.Timestamp) (int64, error)
+	// DeleteDelayedEvent returns the number of deleted delayed events.
+	DeleteDelayedEvent(ctx context.Context, txn *sql.Tx, delayID string) (int64, error)
+	SelectDueDelayedEvents(ctx context.Context, txn *sql.Tx, now gomatrixserverlib.Timestamp, limit int) ([]*api.DelayedEvent, error)
+	// SelectNextDelayedEventTS returns 0 if there are no delayed events.
+	SelectNextDelayedEventTS(ctx context.Context, txn *sql.Tx) (gomatrixserverlib.Timestamp, error)
+}
@@ -25,6 +25,7 @@ func main() {
 	}
 	if *dbURI != "" {
 		cfg.AppServiceAPI.Database.ConnectionString = config.DataSource(*dbURI)
+		cfg.ClientAPI.Database.ConnectionString = config.DataSource(*dbURI)
 		cfg.FederationAPI.Database.ConnectionString = config.DataSource(*dbURI)
 		cfg.KeyServer.Database.ConnectionString = config.DataSource(*dbURI)
 		cfg.MSCs.Database.ConnectionString = config.DataSource(*dbURI)
@@ -76,6 +77,7 @@ func main() {
 			Width:        640,
 			Height:       480,
 			ResizeMethod: "scale",
+			Animated:     true,
 		},
 	}
 
@@ -93,10 +95,8 @@ func main() {
 		cfg.ClientAPI.RegistrationDisabled = false
 		cfg.ClientAPI.OpenRegistrationWithoutVerificationEnabled = true
 		cfg.ClientAPI.RegistrationSharedSecret = "complement"
-		cfg.Global.Presence = config.PresenceOptions{
-			EnableInbound:  true,
-			EnableOutbound: true,
-		}
+		cfg.Global.Presence.EnableInbound = true
+		cfg.Global.Presence.EnableOutbound = true
 	}
 
 	j, err := yaml.Marshal(cfg)
@@ -0,0 +1,107 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/matrix-org/dendrite/mediaapi/filestore"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/setup"
+	"github.com/matrix-org/dendrite/setup/base"
+	"github.com/sirupsen/logrus"
+)
+
+const usage = `Usage: %s
+
+Compares the media metadata in the database with the files in the configured
+media storage and reports:
+
+  - orphan files, which are stored but no media refers to
+  - missing files, which media refers to but which are not stored
+  - files whose stored reference count is wrong
+  - keys in the storage which are not media files or thumbnails
+
+With -fix, reference counts are recounted and orphan files are removed. Missing
+files can't be restored. Uploads running at the same time can show up as orphans,
+so prefer running the check with -fix while the media API is stopped.
+
+Example:
+
+	%s --config dendrite.yaml
+	%s --config dendrite.yaml -fix
+
+Arguments:
+
+`
+
+var fix = flag.Bool("fix", false, "Repair reference counts and remove orphan files")
+
+func main() {
+	name := os.Args[0]
+	flag.Usage = func() {
+		_, _ = fmt.Fprintf(os.Stderr, usage, name, name, name)
+		flag.PrintDefaults()
+	}
+	cfg := setup.ParseFlags(true)
+
+	b := base.NewBaseDendrite(cfg, "")
+	defer b.Close() // nolint: errcheck
+
+	db, err := storage.NewMediaAPIDatasource(b, &cfg.MediaAPI.Database)
+	if err != nil {
+		logrus.WithError(err).Fatalf("Failed to connect to the media database")
+	}
+	store, err := filestore.New(&cfg.MediaAPI)
+	if err != nil {
+		logrus.WithError(err).Fatalf("Failed to set up the media storage")
+	}
+
+	ctx := context.Background()
+	report, err := fileutils.CheckConsistency(ctx, db, store)
+	if err != nil {
+		logrus.WithError(err).Fatalf("Consistency check failed")
+	}
+	for _, hash := range report.OrphanFiles {
+		fmt.Printf("orphan file: %s\n", hash)
+	}
+	for _, hash := range report.MissingFiles {
+		fmt.Printf("missing file: %s\n", hash)
+	}
+	for _, mismatch := range report.RefCountMismatches {
+		fmt.Printf("wrong reference count: %s (stored %d, actual %d)\n", mismatch.Base64Hash, mismatch.Stored, mismatch.Actual)
+	}
+	for _, key := range report.UnknownKeys {
+		fmt.Printf("unknown key: %s\n", key)
+	}
+	logrus.WithFields(logrus.Fields{
+		"orphan_files":   len(report.OrphanFiles),
+		"missing_files":  len(report.MissingFiles),
+		"wrong_refcount": len(report.RefCountMismatches),
+		"unknown_keys":   len(report.UnknownKeys),
+	}).Info("Media consistency check finished")
+
+	if report.Consistent() || !*fix {
+		return
+	}
+	if err = fileutils.RepairConsistency(ctx, db, store, report, logrus.NewEntry(logrus.StandardLogger())); err != nil {
+		logrus.WithError(err).Fatalf("Repair failed")
+	}
+	logrus.Info("Media repair finished")
+}
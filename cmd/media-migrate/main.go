@@ -0,0 +1,135 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/matrix-org/dendrite/mediaapi/filestore"
+	"github.com/matrix-org/dendrite/setup"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/sirupsen/logrus"
+)
+
+const usage = `Usage: %s
+
+Copies media files and thumbnails between media storage backends. Both backends
+are configured in the media_api.storage section of the config file, only the
+backend name is taken from the arguments. Files which already exist in the
+destination with the same size are skipped, so the migration can be resumed.
+
+Switch media_api.storage.backend to the destination once the migration is done.
+
+Example:
+
+	# copy local media to S3
+	%s --config dendrite.yaml -from filesystem -to s3
+	# list what would be copied
+	%s --config dendrite.yaml -from filesystem -to s3 -dry-run
+
+Arguments:
+
+`
+
+var (
+	from   = flag.String("from", config.MediaStorageFileSystem, "The backend to copy media from (filesystem or s3)")
+	to     = flag.String("to", config.MediaStorageS3, "The backend to copy media to (filesystem or s3)")
+	dryRun = flag.Bool("dry-run", false, "Only list the files which would be copied")
+)
+
+func main() {
+	name := os.Args[0]
+	flag.Usage = func() {
+		_, _ = fmt.Fprintf(os.Stderr, usage, name, name, name)
+		flag.PrintDefaults()
+	}
+	cfg := setup.ParseFlags(true)
+
+	if *from == *to {
+		logrus.Fatalf("Source and destination backends must differ")
+	}
+	src, err := newStore(&cfg.MediaAPI, *from)
+	if err != nil {
+		logrus.WithError(err).Fatalf("Failed to set up the source storage")
+	}
+	dst, err := newStore(&cfg.MediaAPI, *to)
+	if err != nil {
+		logrus.WithError(err).Fatalf("Failed to set up the destination storage")
+	}
+
+	ctx := context.Background()
+	var copied, skipped, bytes int64
+	err = src.Walk(ctx, "", func(key string, size int64) error {
+		dstSize, err := dst.Stat(ctx, key)
+		switch {
+		case err == nil && dstSize == size:
+			skipped++
+			return nil
+		case err != nil && !errors.Is(err, filestore.ErrNotFound):
+			return fmt.Errorf("dst.Stat(%s): %w", key, err)
+		}
+		if *dryRun {
+			fmt.Println(key)
+		} else if err = copyObject(ctx, src, dst, key, size); err != nil {
+			return err
+		}
+		copied++
+		bytes += size
+		return nil
+	})
+	if err != nil {
+		logrus.WithError(err).Fatalf("Migration failed after copying %d files", copied)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"copied":  copied,
+		"skipped": skipped,
+		"bytes":   bytes,
+		"dry_run": *dryRun,
+	}).Info("Media migration finished")
+}
+
+// newStore creates the store for the given backend, using the settings from the media API config
+func newStore(cfg *config.MediaAPI, backend string) (filestore.Store, error) {
+	c := *cfg
+	c.Storage.Backend = backend
+	switch backend {
+	case config.MediaStorageFileSystem:
+	case config.MediaStorageS3:
+		if c.Storage.S3.Endpoint == "" || c.Storage.S3.Bucket == "" {
+			return nil, fmt.Errorf("media_api.storage.s3 must be configured")
+		}
+	default:
+		return nil, fmt.Errorf("unknown backend %q", backend)
+	}
+	return filestore.New(&c)
+}
+
+func copyObject(ctx context.Context, src, dst filestore.Store, key string, size int64) error {
+	r, err := src.Open(ctx, key)
+	if err != nil {
+		return fmt.Errorf("src.Open(%s): %w", key, err)
+	}
+	defer r.Close() // nolint: errcheck
+	if err = dst.Put(ctx, key, r, size); err != nil {
+		return fmt.Errorf("dst.Put(%s): %w", key, err)
+	}
+	logrus.WithField("key", key).Debug("Copied media file")
+	return nil
+}
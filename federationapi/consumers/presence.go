@@ -18,6 +18,7 @@ import (
 	"context"
 	"encoding/json"
 	"strconv"
+	"sync"
 
 	"github.com/matrix-org/dendrite/federationapi/queue"
 	"github.com/matrix-org/dendrite/federationapi/storage"
@@ -41,6 +42,14 @@ type OutputPresenceConsumer struct {
 	ServerName              gomatrixserverlib.ServerName
 	topic                   string
 	outboundPresenceEnabled bool
+
+	hiddenMu sync.Mutex
+	// The local users whose presence isn't sent to other servers any more
+	// and who were reported offline to them. This is only kept in memory: after
+	// a restart, and on every instance sharing the durable consumer, the next
+	// update of each of these users sends another offline EDU. That is harmless,
+	// as other servers already have them offline, and cheaper than storing it.
+	hidden map[string]bool
 }
 
 // NewOutputPresenceConsumer creates a new OutputPresenceConsumer. Call Start() to begin consuming events.
@@ -60,6 +69,7 @@ func NewOutputPresenceConsumer(
 		durable:                 cfg.Matrix.JetStream.Durable("FederationAPIPresenceConsumer"),
 		topic:                   cfg.Matrix.JetStream.Prefixed(jetstream.OutputPresenceEvent),
 		outboundPresenceEnabled: cfg.Matrix.Presence.EnableOutbound,
+		hidden:                  make(map[string]bool),
 	}
 }
 
@@ -88,7 +98,24 @@ func (t *OutputPresenceConsumer) onMessage(ctx context.Context, msg *nats.Msg) b
 		return true
 	}
 
-	presence := msg.Header.Get("presence")
+	presence, ok := types.PresenceFromString(msg.Header.Get("presence"))
+	if !ok {
+		return true
+	}
+
+	// Presence limited to contacts only ever reaches local users, as the
+	// address book only holds local users. Other servers are told once that
+	// the user went offline, so that they don't keep the last presence they
+	// were sent. See hidden for when this is repeated.
+	privacy, _ := types.PresencePrivacyFromString(msg.Header.Get("privacy"))
+	hidden := privacy != types.PresencePrivacyEveryone
+	if hidden {
+		if t.isHidden(userID) {
+			return true
+		}
+		presence = types.PresenceOffline
+		delete(msg.Header, "status_msg")
+	}
 
 	ts, err := strconv.Atoi(msg.Header.Get("last_active_ts"))
 	if err != nil {
@@ -117,7 +144,7 @@ func (t *OutputPresenceConsumer) onMessage(ctx context.Context, msg *nats.Msg) b
 			{
 				CurrentlyActive: p.CurrentlyActive(),
 				LastActiveAgo:   p.LastActiveAgo(),
-				Presence:        presence,
+				Presence:        presence.FederationString(),
 				StatusMsg:       statusMsg,
 				UserID:          userID,
 			},
@@ -138,6 +165,23 @@ func (t *OutputPresenceConsumer) onMessage(ctx context.Context, msg *nats.Msg) b
 		log.WithError(err).Error("failed to send EDU")
 		return false
 	}
+	t.setHidden(userID, hidden)
 
 	return true
 }
+
+func (t *OutputPresenceConsumer) isHidden(userID string) bool {
+	t.hiddenMu.Lock()
+	defer t.hiddenMu.Unlock()
+	return t.hidden[userID]
+}
+
+func (t *OutputPresenceConsumer) setHidden(userID string, hidden bool) {
+	t.hiddenMu.Lock()
+	defer t.hiddenMu.Unlock()
+	if hidden {
+		t.hidden[userID] = true
+	} else {
+		delete(t.hidden, userID)
+	}
+}
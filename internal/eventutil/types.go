@@ -53,6 +53,12 @@ type NotificationData struct {
 	// UnreadNotificationCount is the total number of unread
 	// notifications.
 	UnreadNotificationCount int `json:"unread_notification_count"`
+
+	// EventID is set if the data was sent because the user was
+	// notified about the event, and Highlight if the notification
+	// was highlighted.
+	EventID   string `json:"event_id,omitempty"`
+	Highlight bool   `json:"highlight,omitempty"`
 }
 
 // ProfileResponse is a struct containing all known user profile data
@@ -0,0 +1,124 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fulltext splits text and search terms into the tokens kept in the
+// full-text search index. The databases only ever see tokens separated by
+// spaces, so that PostgreSQL and SQLite find the same events.
+package fulltext
+
+import (
+	"strings"
+	"unicode"
+)
+
+// maxTokenLength is the number of characters after which a word is cut off,
+// so that pasted blobs don't bloat the index.
+const maxTokenLength = 64
+
+// Phrase is a list of tokens which must appear next to each other in the given order.
+type Phrase []string
+
+// isIdeograph reports whether the character belongs to a script which doesn't
+// separate words by spaces. Every such character is a token of its own, so that
+// any part of a sentence can be found with a phrase.
+func isIdeograph(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana)
+}
+
+// isWordChar reports whether the character is part of a word.
+func isWordChar(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
+}
+
+// Tokenize splits text into lower case words, and ideographs into single characters.
+func Tokenize(text string) []string {
+	var tokens []string
+	var word []rune
+	flush := func() {
+		if len(word) > 0 {
+			if len(word) > maxTokenLength {
+				word = word[:maxTokenLength]
+			}
+			tokens = append(tokens, string(word))
+			word = word[:0]
+		}
+	}
+	for _, r := range text {
+		switch {
+		case isIdeograph(r):
+			flush()
+			tokens = append(tokens, string(r))
+		case isWordChar(r):
+			word = append(word, unicode.ToLower(r))
+		default:
+			flush()
+		}
+	}
+	flush()
+	return tokens
+}
+
+// Document returns the text as it is stored in the index.
+func Document(text string) string {
+	return strings.Join(Tokenize(text), " ")
+}
+
+// ParseQuery splits a search term into phrases, all of which must be found in
+// an event for it to match. Every part of the term between spaces is a phrase,
+// i.e. "e-mail" matches "e mail" but not "mail e", as is text in double quotes.
+func ParseQuery(query string) []Phrase {
+	var phrases []Phrase
+	add := func(part string) {
+		if tokens := Tokenize(part); len(tokens) > 0 {
+			phrases = append(phrases, tokens)
+		}
+	}
+	for i, part := range strings.Split(query, `"`) {
+		if i%2 == 1 {
+			add(part)
+			continue
+		}
+		for _, field := range strings.Fields(part) {
+			add(field)
+		}
+	}
+	return phrases
+}
+
+// Highlights returns the words clients should highlight in the matching events.
+// Consecutive ideographs of a phrase are highlighted together.
+func Highlights(phrases []Phrase) []string {
+	var highlights []string
+	seen := map[string]bool{}
+	add := func(word string) {
+		if word != "" && !seen[word] {
+			seen[word] = true
+			highlights = append(highlights, word)
+		}
+	}
+	for _, phrase := range phrases {
+		var ideographs strings.Builder
+		for _, token := range phrase {
+			if r := []rune(token); len(r) == 1 && isIdeograph(r[0]) {
+				ideographs.WriteString(token)
+				continue
+			}
+			add(ideographs.String())
+			ideographs.Reset()
+			add(token)
+		}
+		add(ideographs.String())
+	}
+	return highlights
+}
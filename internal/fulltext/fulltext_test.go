@@ -0,0 +1,52 @@
+package fulltext
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{text: "Hello, World!", want: []string{"hello", "world"}},
+		{text: "e-mail me at 10:30", want: []string{"e", "mail", "me", "at", "10", "30"}},
+		{text: "今天天气很好", want: []string{"今", "天", "天", "气", "很", "好"}},
+		{text: "买了iPhone手机", want: []string{"买", "了", "iphone", "手", "机"}},
+		{text: "Ünïcödé café", want: []string{"ünïcödé", "café"}},
+		{text: "  ...  ", want: nil},
+	}
+	for _, tt := range tests {
+		if got := Tokenize(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Tokenize(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []Phrase
+	}{
+		{query: "hello world", want: []Phrase{{"hello"}, {"world"}}},
+		{query: `"hello world" again`, want: []Phrase{{"hello", "world"}, {"again"}}},
+		{query: "e-mail", want: []Phrase{{"e", "mail"}}},
+		{query: "天气 好", want: []Phrase{{"天", "气"}, {"好"}}},
+		{query: `"unterminated quote`, want: []Phrase{{"unterminated", "quote"}}},
+		{query: "!!", want: nil},
+	}
+	for _, tt := range tests {
+		if got := ParseQuery(tt.query); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseQuery(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestHighlights(t *testing.T) {
+	got := Highlights(ParseQuery(`Hello "天气 hello" iPhone手机`))
+	want := []string{"hello", "天气", "iphone", "手机"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Highlights() = %q, want %q", got, want)
+	}
+}
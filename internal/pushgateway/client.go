@@ -5,6 +5,7 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
@@ -60,8 +61,39 @@ func (h *httpClient) Notify(ctx context.Context, url string, req *NotifyRequest,
 	var errorBody struct {
 		Message string `json:"message"`
 	}
+	herr := &HTTPError{StatusCode: hresp.StatusCode, URL: url}
 	if err := json.NewDecoder(hresp.Body).Decode(&errorBody); err == nil {
-		return fmt.Errorf("push gateway: %d from %s: %s", hresp.StatusCode, url, errorBody.Message)
+		herr.Message = errorBody.Message
 	}
-	return fmt.Errorf("push gateway: %d from %s", hresp.StatusCode, url)
+	return herr
+}
+
+// HTTPError is returned by the HTTP client when the gateway responds with
+// a status other than 200.
+type HTTPError struct {
+	StatusCode int
+	URL        string
+	Message    string
+}
+
+func (e *HTTPError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("push gateway: %d from %s: %s", e.StatusCode, e.URL, e.Message)
+	}
+	return fmt.Sprintf("push gateway: %d from %s", e.StatusCode, e.URL)
+}
+
+// IsPermanent returns true if the error means that sending the same request
+// again won't succeed, i.e. because the gateway doesn't know the app or
+// considers the request malformed.
+func IsPermanent(err error) bool {
+	var herr *HTTPError
+	if !errors.As(err, &herr) {
+		return false
+	}
+	switch herr.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return herr.StatusCode >= 400 && herr.StatusCode < 500
 }
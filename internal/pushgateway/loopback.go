@@ -0,0 +1,90 @@
+package pushgateway
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// Loopback is a push gateway which records the notifications it receives
+// instead of forwarding them, for integration tests. It can be used as a
+// Client directly, or served over HTTP so that pushers can point their
+// URL at it.
+type Loopback struct {
+	mu            sync.Mutex
+	notifications []Notification
+	rejected      map[string]bool
+}
+
+// NewLoopback creates a loopback push gateway with no recorded notifications.
+func NewLoopback() *Loopback {
+	return &Loopback{rejected: map[string]bool{}}
+}
+
+// Reject makes the gateway reject the push key from now on, like a gateway
+// does for apps which were uninstalled.
+func (l *Loopback) Reject(pushKey string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rejected[pushKey] = true
+}
+
+// Notifications returns the notifications received so far, oldest first.
+func (l *Loopback) Notifications() []Notification {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	notifications := make([]Notification, len(l.notifications))
+	copy(notifications, l.notifications)
+	return notifications
+}
+
+// Reset forgets the received notifications and rejected push keys.
+func (l *Loopback) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.notifications = nil
+	l.rejected = map[string]bool{}
+}
+
+// Notify records the notification, regardless of the URL.
+func (l *Loopback) Notify(ctx context.Context, url string, req *NotifyRequest, resp *NotifyResponse) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.notifications = append(l.notifications, req.Notification)
+	resp.Rejected = []string{}
+	for _, d := range req.Notification.Devices {
+		if l.rejected[d.PushKey] {
+			resp.Rejected = append(resp.Rejected, d.PushKey)
+		}
+	}
+	return nil
+}
+
+// ServeHTTP implements the notify endpoint of the push gateway API for
+// POST requests. GET returns the recorded notifications and DELETE
+// resets the gateway.
+func (l *Loopback) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodPost:
+		var req NotifyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
+			return
+		}
+		var resp NotifyResponse
+		_ = l.Notify(r.Context(), r.URL.String(), &req, &resp)
+		_ = json.NewEncoder(w).Encode(resp)
+	case http.MethodGet:
+		_ = json.NewEncoder(w).Encode(map[string][]Notification{
+			"notifications": l.Notifications(),
+		})
+	case http.MethodDelete:
+		l.Reset()
+		_, _ = w.Write([]byte("{}"))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,140 @@
+package pushgateway
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func testRequest(pushKeys ...string) *NotifyRequest {
+	req := &NotifyRequest{
+		Notification: Notification{
+			EventID: "$event:localhost",
+			RoomID:  "!room:localhost",
+		},
+	}
+	for _, pushKey := range pushKeys {
+		req.Notification.Devices = append(req.Notification.Devices, &Device{
+			AppID:   "com.example.app",
+			PushKey: pushKey,
+			Data:    map[string]interface{}{},
+		})
+	}
+	return req
+}
+
+func TestRetryingClient(t *testing.T) {
+	opts := RetryOptions{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond,
+	}
+	tests := []struct {
+		name         string
+		statusCodes  []int
+		wantRequests int32
+		wantErr      bool
+	}{
+		{name: "success", statusCodes: []int{http.StatusOK}, wantRequests: 1},
+		{name: "temporary failures are retried", statusCodes: []int{http.StatusBadGateway, http.StatusTooManyRequests, http.StatusOK}, wantRequests: 3},
+		{name: "gives up after max attempts", statusCodes: []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway, http.StatusOK}, wantRequests: 3, wantErr: true},
+		{name: "permanent failures are not retried", statusCodes: []int{http.StatusBadRequest, http.StatusOK}, wantRequests: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt32(&requests, 1)
+				w.WriteHeader(tt.statusCodes[n-1])
+				_, _ = w.Write([]byte(`{"rejected":[]}`))
+			}))
+			defer srv.Close()
+
+			client := NewRetryingClient(NewHTTPClient(false), opts)
+			err := client.Notify(context.Background(), srv.URL, testRequest("pushkey"), &NotifyResponse{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if requests != tt.wantRequests {
+				t.Fatalf("expected %d requests, got %d", tt.wantRequests, requests)
+			}
+		})
+	}
+}
+
+func TestRetryingClientMetrics(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"rejected":["gone"]}`))
+	}))
+	defer srv.Close()
+
+	counter := func(appID, outcome string) float64 {
+		return testutil.ToFloat64(notificationsCount.WithLabelValues(appID, outcome))
+	}
+	delivered, rejected, other := counter("com.example.app", "delivered"), counter("com.example.app", "rejected"), counter(otherAppID, "delivered")
+	req := testRequest("gone", "present")
+	req.Notification.Devices = append(req.Notification.Devices, &Device{AppID: "org.unknown.app", PushKey: "unknown"})
+	client := NewRetryingClient(NewHTTPClient(false), RetryOptions{MetricsAppIDs: []string{"com.example.app"}})
+	if err := client.Notify(context.Background(), srv.URL, req, &NotifyResponse{}); err != nil {
+		t.Fatalf("failed to notify: %v", err)
+	}
+	if got := counter("com.example.app", "delivered") - delivered; got != 1 {
+		t.Errorf("expected 1 delivered notification for the configured app ID, got %v", got)
+	}
+	if got := counter("com.example.app", "rejected") - rejected; got != 1 {
+		t.Errorf("expected 1 rejected notification for the configured app ID, got %v", got)
+	}
+	if got := counter(otherAppID, "delivered") - other; got != 1 {
+		t.Errorf("expected 1 delivered notification for other app IDs, got %v", got)
+	}
+}
+
+func TestIsPermanent(t *testing.T) {
+	for statusCode, want := range map[int]bool{
+		http.StatusBadRequest:          true,
+		http.StatusNotFound:            true,
+		http.StatusRequestTimeout:      false,
+		http.StatusTooManyRequests:     false,
+		http.StatusInternalServerError: false,
+	} {
+		if got := IsPermanent(&HTTPError{StatusCode: statusCode}); got != want {
+			t.Errorf("IsPermanent(%d) = %v, want %v", statusCode, got, want)
+		}
+	}
+	if IsPermanent(context.DeadlineExceeded) {
+		t.Errorf("expected other errors not to be permanent")
+	}
+}
+
+func TestLoopback(t *testing.T) {
+	loopback := NewLoopback()
+	loopback.Reject("gone")
+	srv := httptest.NewServer(loopback)
+	defer srv.Close()
+
+	var res NotifyResponse
+	if err := NewHTTPClient(false).Notify(context.Background(), srv.URL, testRequest("gone", "present"), &res); err != nil {
+		t.Fatalf("failed to notify loopback gateway: %v", err)
+	}
+	if !reflect.DeepEqual(res.Rejected, []string{"gone"}) {
+		t.Fatalf("expected push key to be rejected, got %v", res.Rejected)
+	}
+	notifications := loopback.Notifications()
+	if len(notifications) != 1 {
+		t.Fatalf("expected 1 recorded notification, got %d", len(notifications))
+	}
+	if notifications[0].EventID != "$event:localhost" || len(notifications[0].Devices) != 2 {
+		t.Fatalf("unexpected notification recorded: %+v", notifications[0])
+	}
+
+	loopback.Reset()
+	if len(loopback.Notifications()) != 0 {
+		t.Fatalf("expected no notifications after reset")
+	}
+}
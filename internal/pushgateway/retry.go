@@ -0,0 +1,110 @@
+package pushgateway
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var notificationsCount = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "pushgateway",
+		Name:      "notifications_total",
+		Help:      "Number of notifications per app ID and outcome: delivered, rejected, retried or failed",
+	},
+	// Pushers are registered by clients, so only the configured app IDs are used as
+	// labels and URLs aren't at all: the number of series would be unbounded.
+	[]string{"app_id", "outcome"},
+)
+
+// otherAppID is the app_id label of notifications for app IDs which aren't
+// counted separately.
+const otherAppID = "other"
+
+func init() {
+	prometheus.MustRegister(notificationsCount)
+}
+
+// RetryOptions configure how often and how fast failed requests are sent again.
+type RetryOptions struct {
+	// MaxAttempts is the number of times a request is sent at most.
+	MaxAttempts int
+	// InitialBackoff is the time to wait after the first failure. It is
+	// doubled after every further failure, up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// MetricsAppIDs are the app IDs whose notifications are counted
+	// separately, the others are counted together.
+	MetricsAppIDs []string
+}
+
+type retryingClient struct {
+	client Client
+	opts   RetryOptions
+	appIDs map[string]bool
+}
+
+// NewRetryingClient wraps a client so that requests which failed
+// temporarily are sent again with exponential backoff. Errors for which
+// IsPermanent is true are returned right away. It also counts the
+// outcome of every notification.
+func NewRetryingClient(client Client, opts RetryOptions) Client {
+	if opts.MaxAttempts < 1 {
+		opts.MaxAttempts = 1
+	}
+	appIDs := make(map[string]bool, len(opts.MetricsAppIDs))
+	for _, appID := range opts.MetricsAppIDs {
+		appIDs[appID] = true
+	}
+	return &retryingClient{client: client, opts: opts, appIDs: appIDs}
+}
+
+func (c *retryingClient) Notify(ctx context.Context, url string, req *NotifyRequest, resp *NotifyResponse) error {
+	backoff := c.opts.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := c.client.Notify(ctx, url, req, resp)
+		if err == nil {
+			c.countNotifications(req.Notification.Devices, resp.Rejected, "delivered")
+			return nil
+		}
+		if IsPermanent(err) || attempt >= c.opts.MaxAttempts {
+			c.countNotifications(req.Notification.Devices, nil, "failed")
+			return err
+		}
+		c.countNotifications(req.Notification.Devices, nil, "retried")
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			c.countNotifications(req.Notification.Devices, nil, "failed")
+			return err
+		case <-timer.C:
+		}
+		if backoff *= 2; backoff > c.opts.MaxBackoff {
+			backoff = c.opts.MaxBackoff
+		}
+	}
+}
+
+// countNotifications counts one notification per device. Devices whose
+// push key was rejected count as rejected, the others with the outcome.
+func (c *retryingClient) countNotifications(devices []*Device, rejected []string, outcome string) {
+	isRejected := make(map[string]bool, len(rejected))
+	for _, pushKey := range rejected {
+		isRejected[pushKey] = true
+	}
+	for _, d := range devices {
+		appID := otherAppID
+		if c.appIDs[d.AppID] {
+			appID = d.AppID
+		}
+		if isRejected[d.PushKey] {
+			notificationsCount.WithLabelValues(appID, "rejected").Inc()
+		} else {
+			notificationsCount.WithLabelValues(appID, outcome).Inc()
+		}
+	}
+}
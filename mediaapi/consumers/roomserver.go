@@ -0,0 +1,140 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/setup/process"
+)
+
+// OutputRoomEventConsumer consumes events that originated in the room server,
+// recording which media the events refer to so that the media of a room can be found.
+type OutputRoomEventConsumer struct {
+	ctx       context.Context
+	jetstream nats.JetStreamContext
+	durable   string
+	topic     string
+	db        storage.Database
+}
+
+// NewOutputRoomEventConsumer creates a new OutputRoomEventConsumer. Call Start() to begin consuming from room servers.
+func NewOutputRoomEventConsumer(
+	process *process.ProcessContext,
+	cfg *config.MediaAPI,
+	js nats.JetStreamContext,
+	db storage.Database,
+) *OutputRoomEventConsumer {
+	return &OutputRoomEventConsumer{
+		ctx:       process.Context(),
+		jetstream: js,
+		db:        db,
+		durable:   cfg.Matrix.JetStream.Durable("MediaAPIRoomServerConsumer"),
+		topic:     cfg.Matrix.JetStream.Prefixed(jetstream.OutputRoomEvent),
+	}
+}
+
+// Start consuming from room servers
+func (s *OutputRoomEventConsumer) Start() error {
+	return jetstream.JetStreamConsumer(
+		s.ctx, s.jetstream, s.topic, s.durable, s.onMessage,
+		nats.DeliverAll(), nats.ManualAck(),
+	)
+}
+
+func (s *OutputRoomEventConsumer) onMessage(ctx context.Context, msg *nats.Msg) bool {
+	var output api.OutputEvent
+	if err := json.Unmarshal(msg.Data, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("roomserver output log: message parse failure")
+		return true
+	}
+	if output.Type != api.OutputTypeNewRoomEvent {
+		return true
+	}
+
+	ev := output.NewRoomEvent.Event
+	media := mediaInContent(ev.Content())
+	if len(media) == 0 {
+		return true
+	}
+	if err := s.db.StoreRoomMedia(ctx, ev.RoomID(), media); err != nil {
+		log.WithError(err).WithField("event_id", ev.EventID()).Error("Failed to store media referred to by event")
+		// Retry later
+		return false
+	}
+	return true
+}
+
+// mediaInContent returns the media referred to by mxc URIs anywhere in the event content,
+// i.e. url and info.thumbnail_url of m.room.message or url of m.room.avatar. Only MediaID
+// and Origin are set.
+func mediaInContent(content []byte) []*types.MediaMetadata {
+	var parsed interface{}
+	if err := json.Unmarshal(content, &parsed); err != nil {
+		return nil
+	}
+	var media []*types.MediaMetadata
+	seen := map[string]bool{}
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for _, value := range v {
+				walk(value)
+			}
+		case []interface{}:
+			for _, value := range v {
+				walk(value)
+			}
+		case string:
+			if seen[v] {
+				return
+			}
+			seen[v] = true
+			if m := parseMXC(v); m != nil {
+				media = append(media, m)
+			}
+		}
+	}
+	walk(parsed)
+	return media
+}
+
+// parseMXC returns nil if uri is not of the form mxc://<server-name>/<media-id>
+func parseMXC(uri string) *types.MediaMetadata {
+	if !strings.HasPrefix(uri, "mxc://") {
+		return nil
+	}
+	parts := strings.Split(strings.TrimPrefix(uri, "mxc://"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil
+	}
+	return &types.MediaMetadata{
+		MediaID: types.MediaID(parts[1]),
+		Origin:  gomatrixserverlib.ServerName(parts[0]),
+	}
+}
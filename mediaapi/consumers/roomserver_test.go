@@ -0,0 +1,29 @@
+package consumers
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestMediaInContent(t *testing.T) {
+	content := []byte(`{
+		"msgtype": "m.image",
+		"body": "mxc://not/a/media/uri",
+		"url": "mxc://example.org/abcdef",
+		"info": {"thumbnail_url": "mxc://remote.org/thumb", "w": 32},
+		"other": ["mxc://example.org/abcdef", "https://example.org/abcdef", "mxc://example.org/"]
+	}`)
+	media := mediaInContent(content)
+	var got []string
+	for _, m := range media {
+		got = append(got, string(m.Origin)+"/"+string(m.MediaID))
+	}
+	sort.Strings(got)
+	want := []string{"example.org/abcdef", "remote.org/thumb"}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("expected media %v, got %v", want, got)
+	}
+	if media = mediaInContent([]byte(`not json`)); media != nil {
+		t.Fatalf("expected no media for invalid content, got %v", media)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package filestore contains the backends media files and thumbnails are stored in.
+// Files are addressed by keys derived from the base64 hash of the media, see MediaKey
+// and ThumbnailKey, so every backend uses the same layout.
+package filestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// ErrNotFound is returned when there is no object with the requested key
+var ErrNotFound = errors.New("filestore: object not found")
+
+// Store is a backend for media files
+type Store interface {
+	// Put stores the content read from r under key, replacing any existing object.
+	// size is the number of bytes to be read from r.
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Open opens the object for reading. Returns ErrNotFound if there is no such object.
+	Open(ctx context.Context, key string) (io.ReadSeekCloser, error)
+	// Stat returns the size of the object in bytes. Returns ErrNotFound if there is no such object.
+	Stat(ctx context.Context, key string) (int64, error)
+	// Delete removes the object. Removing an object which does not exist is not an error.
+	Delete(ctx context.Context, key string) error
+	// Walk calls fn for every object whose key starts with prefix. Walking stops at the first error.
+	Walk(ctx context.Context, prefix string, fn func(key string, size int64) error) error
+}
+
+// New creates the store configured for the media API
+func New(cfg *config.MediaAPI) (Store, error) {
+	switch cfg.Storage.Backend {
+	case config.MediaStorageFileSystem, "":
+		return NewFileSystem(cfg.AbsBasePath), nil
+	case config.MediaStorageS3:
+		return NewS3(&cfg.Storage.S3)
+	default:
+		return nil, fmt.Errorf("unknown media storage backend %q", cfg.Storage.Backend)
+	}
+}
+
+// thumbnailTemplate is the name template for thumbnails
+const thumbnailTemplate = "thumbnail-%vx%v-%v"
+
+// MediaDir returns the common key prefix of the media file and its thumbnails.
+// 3 levels are used for more manageable browsing and the remainder of the hash as the last level.
+// For example, if Base64Hash is 'qwerty', the prefix will be 'q/w/erty'.
+func MediaDir(base64Hash types.Base64Hash) (string, error) {
+	if len(base64Hash) < 3 {
+		return "", fmt.Errorf("invalid key (Base64Hash too short - min 3 characters): %q", base64Hash)
+	}
+	if len(base64Hash) > 255 {
+		return "", fmt.Errorf("invalid key (Base64Hash too long - max 255 characters): %q", base64Hash)
+	}
+	// URL-safe base64 never contains these, but the hash may come from the database or a remote server
+	if strings.ContainsAny(string(base64Hash), "/\\.") {
+		return "", fmt.Errorf("invalid key (Base64Hash contains path characters): %q", base64Hash)
+	}
+	return string(base64Hash[0:1]) + "/" + string(base64Hash[1:2]) + "/" + string(base64Hash[2:]), nil
+}
+
+// MediaKey returns the key of the media file with the given hash, i.e. 'q/w/erty/file'.
+func MediaKey(base64Hash types.Base64Hash) (string, error) {
+	dir, err := MediaDir(base64Hash)
+	if err != nil {
+		return "", err
+	}
+	return dir + "/file", nil
+}
+
+// ThumbnailKey returns the key of a thumbnail of the media file with the given hash,
+// i.e. 'q/w/erty/thumbnail-32x32-crop', or 'q/w/erty/thumbnail-32x32-crop-animated'
+// for an animated thumbnail.
+func ThumbnailKey(base64Hash types.Base64Hash, size types.ThumbnailSize) (string, error) {
+	dir, err := MediaDir(base64Hash)
+	if err != nil {
+		return "", err
+	}
+	key := dir + "/" + fmt.Sprintf(thumbnailTemplate, size.Width, size.Height, size.ResizeMethod)
+	if size.Animated {
+		key += "-animated"
+	}
+	return key, nil
+}
+
+// ParseKey returns the hash of the media a key belongs to, and whether the key is the media
+// file itself rather than one of its thumbnails. It is the inverse of MediaKey and ThumbnailKey.
+func ParseKey(key string) (base64Hash types.Base64Hash, isMediaFile bool, err error) {
+	parts := strings.Split(key, "/")
+	if len(parts) != 4 || len(parts[0]) != 1 || len(parts[1]) != 1 || parts[2] == "" {
+		return "", false, fmt.Errorf("invalid key (not a media file or thumbnail): %q", key)
+	}
+	switch {
+	case parts[3] == "file":
+		isMediaFile = true
+	case strings.HasPrefix(parts[3], "thumbnail-"):
+	default:
+		return "", false, fmt.Errorf("invalid key (not a media file or thumbnail): %q", key)
+	}
+	base64Hash = types.Base64Hash(parts[0] + parts[1] + parts[2])
+	if _, err = MediaDir(base64Hash); err != nil {
+		return "", false, err
+	}
+	return base64Hash, isMediaFile, nil
+}
+
+// DeleteMedia removes the media file with the given hash together with all its thumbnails
+func DeleteMedia(ctx context.Context, store Store, base64Hash types.Base64Hash) error {
+	dir, err := MediaDir(base64Hash)
+	if err != nil {
+		return err
+	}
+	var keys []string
+	if err = store.Walk(ctx, dir+"/", func(key string, _ int64) error {
+		keys = append(keys, key)
+		return nil
+	}); err != nil {
+		return fmt.Errorf("store.Walk: %w", err)
+	}
+	for _, key := range keys {
+		if err = store.Delete(ctx, key); err != nil {
+			return fmt.Errorf("store.Delete: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package filestore
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestKeys(t *testing.T) {
+	key, err := MediaKey("qwerty")
+	if err != nil {
+		t.Fatalf("MediaKey returned error: %v", err)
+	}
+	if key != "q/w/erty/file" {
+		t.Fatalf("unexpected media key %q", key)
+	}
+	key, err = ThumbnailKey("qwerty", types.ThumbnailSize{Width: 32, Height: 24, ResizeMethod: types.Crop})
+	if err != nil {
+		t.Fatalf("ThumbnailKey returned error: %v", err)
+	}
+	if key != "q/w/erty/thumbnail-32x24-crop" {
+		t.Fatalf("unexpected thumbnail key %q", key)
+	}
+	key, err = ThumbnailKey("qwerty", types.ThumbnailSize{Width: 32, Height: 24, ResizeMethod: types.Crop, Animated: true})
+	if err != nil {
+		t.Fatalf("ThumbnailKey returned error: %v", err)
+	}
+	if key != "q/w/erty/thumbnail-32x24-crop-animated" {
+		t.Fatalf("unexpected animated thumbnail key %q", key)
+	}
+	hash, isMediaFile, err := ParseKey("q/w/erty/file")
+	if err != nil || hash != "qwerty" || !isMediaFile {
+		t.Fatalf("unexpected result parsing media key: %q %v %v", hash, isMediaFile, err)
+	}
+	hash, isMediaFile, err = ParseKey("q/w/erty/thumbnail-32x24-crop")
+	if err != nil || hash != "qwerty" || isMediaFile {
+		t.Fatalf("unexpected result parsing thumbnail key: %q %v %v", hash, isMediaFile, err)
+	}
+	hash, isMediaFile, err = ParseKey("q/w/erty/thumbnail-32x24-crop-animated")
+	if err != nil || hash != "qwerty" || isMediaFile {
+		t.Fatalf("unexpected result parsing animated thumbnail key: %q %v %v", hash, isMediaFile, err)
+	}
+	for _, key := range []string{"", "q/w/erty", "q/w/erty/other", "qw/e/rty/file", "q/w/../file", "q/w/erty/file/file"} {
+		if _, _, err = ParseKey(key); err == nil {
+			t.Fatalf("expected error for key %q", key)
+		}
+	}
+	for _, hash := range []types.Base64Hash{"", "ab", "ab/../../etc", "..abc", types.Base64Hash(strings.Repeat("a", 256))} {
+		if _, err = MediaKey(hash); err == nil {
+			t.Fatalf("expected error for hash %q", hash)
+		}
+	}
+}
+
+func TestFileSystem(t *testing.T) {
+	testStore(t, NewFileSystem(config.Path(t.TempDir())))
+}
+
+func TestS3(t *testing.T) {
+	srv := httptest.NewServer(newFakeS3("media"))
+	defer srv.Close()
+	store, err := NewS3(&config.S3Storage{
+		Endpoint:       srv.URL,
+		Region:         "us-east-1",
+		Bucket:         "media",
+		Prefix:         "dendrite/",
+		ForcePathStyle: true,
+	})
+	if err != nil {
+		t.Fatalf("NewS3 returned error: %v", err)
+	}
+	testStore(t, store)
+}
+
+// testStore checks the behaviour all backends must have in common
+func testStore(t *testing.T, store Store) {
+	ctx := context.Background()
+	content := []byte("0123456789")
+	mediaKey, _ := MediaKey("abcdef")
+	thumbKey, _ := ThumbnailKey("abcdef", types.ThumbnailSize{Width: 32, Height: 32, ResizeMethod: types.Scale})
+	otherKey, _ := MediaKey("abzzzz")
+
+	if _, err := store.Stat(ctx, mediaKey); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for missing object, got %v", err)
+	}
+	if _, err := store.Open(ctx, mediaKey); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for missing object, got %v", err)
+	}
+
+	for _, key := range []string{mediaKey, thumbKey, otherKey} {
+		if err := store.Put(ctx, key, bytes.NewReader(content), int64(len(content))); err != nil {
+			t.Fatalf("Put(%s) returned error: %v", key, err)
+		}
+	}
+
+	size, err := store.Stat(ctx, mediaKey)
+	if err != nil {
+		t.Fatalf("Stat returned error: %v", err)
+	}
+	if size != int64(len(content)) {
+		t.Fatalf("expected size %d, got %d", len(content), size)
+	}
+
+	file, err := store.Open(ctx, mediaKey)
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	if _, err = file.Seek(4, io.SeekStart); err != nil {
+		t.Fatalf("Seek returned error: %v", err)
+	}
+	got, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatalf("ReadAll returned error: %v", err)
+	}
+	_ = file.Close()
+	if string(got) != "456789" {
+		t.Fatalf("expected content after seek %q, got %q", "456789", got)
+	}
+
+	walk := func(prefix string) []string {
+		var keys []string
+		if err = store.Walk(ctx, prefix, func(key string, size int64) error {
+			keys = append(keys, key)
+			return nil
+		}); err != nil {
+			t.Fatalf("Walk returned error: %v", err)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	if keys := walk("a/b/cdef/"); len(keys) != 2 || keys[0] != mediaKey || keys[1] != thumbKey {
+		t.Fatalf("unexpected keys under prefix: %v", keys)
+	}
+	if keys := walk(""); len(keys) != 3 {
+		t.Fatalf("expected 3 keys in total, got %v", keys)
+	}
+	if keys := walk("x/"); len(keys) != 0 {
+		t.Fatalf("expected no keys under unused prefix, got %v", keys)
+	}
+
+	if err = DeleteMedia(ctx, store, "abcdef"); err != nil {
+		t.Fatalf("DeleteMedia returned error: %v", err)
+	}
+	if keys := walk(""); len(keys) != 1 || keys[0] != otherKey {
+		t.Fatalf("expected only %s to be left, got %v", otherKey, keys)
+	}
+	if err = store.Delete(ctx, mediaKey); err != nil {
+		t.Fatalf("deleting a missing object returned error: %v", err)
+	}
+}
+
+// fakeS3 is a minimal in-memory stand-in for an S3 server like MinIO. It supports the
+// requests made by the store with path style bucket lookup and anonymous credentials.
+type fakeS3 struct {
+	bucket  string
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{bucket: bucket, objects: map[string][]byte{}}
+}
+
+type fakeS3Object struct {
+	Key          string
+	Size         int64
+	LastModified string
+	ETag         string
+}
+
+type fakeS3List struct {
+	XMLName     xml.Name `xml:"ListBucketResult"`
+	Name        string
+	Prefix      string
+	KeyCount    int
+	MaxKeys     int
+	IsTruncated bool
+	Contents    []fakeS3Object
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := strings.TrimPrefix(req.URL.Path, "/"+s.bucket)
+	if path == "" || path == "/" {
+		s.list(w, req)
+		return
+	}
+	key := strings.TrimPrefix(path, "/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch req.Method {
+	case http.MethodPut:
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.objects[key] = body
+		w.Header().Set("ETag", `"etag"`)
+	case http.MethodGet, http.MethodHead:
+		body, ok := s.objects[key]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			if req.Method == http.MethodGet {
+				_, _ = w.Write([]byte(`<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`))
+			}
+			return
+		}
+		w.Header().Set("ETag", `"etag"`)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, req, "", time.Unix(1600000000, 0), bytes.NewReader(body))
+	case http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *fakeS3) list(w http.ResponseWriter, req *http.Request) {
+	prefix := req.URL.Query().Get("prefix")
+	res := fakeS3List{Name: s.bucket, Prefix: prefix, MaxKeys: 1000}
+	s.mu.Lock()
+	for key, body := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			res.Contents = append(res.Contents, fakeS3Object{
+				Key:          key,
+				Size:         int64(len(body)),
+				LastModified: time.Unix(1600000000, 0).UTC().Format("2006-01-02T15:04:05.000Z"),
+				ETag:         `"etag"`,
+			})
+		}
+	}
+	s.mu.Unlock()
+	res.KeyCount = len(res.Contents)
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(res)
+}
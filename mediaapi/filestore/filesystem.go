@@ -0,0 +1,177 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// tmpDir is the directory under the base path used for temporary files. It is not part of the store.
+const tmpDir = "tmp"
+
+type fileSystem struct {
+	root string
+}
+
+// NewFileSystem creates a store which keeps files in a directory tree under absBasePath
+func NewFileSystem(absBasePath config.Path) Store {
+	return &fileSystem{root: filepath.Clean(string(absBasePath))}
+}
+
+// path converts the key to a file path, making sure it doesn't escape the root
+func (f *fileSystem) path(key string) (string, error) {
+	filePath := filepath.Join(f.root, filepath.FromSlash(key))
+	if !strings.HasPrefix(filePath, f.root+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid key (not within base path %v): %q", f.root, key)
+	}
+	return filePath, nil
+}
+
+func (f *fileSystem) Put(ctx context.Context, key string, r io.Reader, size int64) (err error) {
+	filePath, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Join(f.root, tmpDir), 0770); err != nil {
+		return fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	// Write to a temporary file first, so that readers never see a partially written file
+	tmpFile, err := os.CreateTemp(filepath.Join(f.root, tmpDir), "put-")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmpFile.Name()) // nolint: errcheck
+		}
+	}()
+
+	written, err := io.Copy(tmpFile, r)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	if size >= 0 && written != size {
+		return fmt.Errorf("wrote %d bytes, expected %d", written, size)
+	}
+
+	if err = os.MkdirAll(filepath.Dir(filePath), 0770); err != nil {
+		return fmt.Errorf("failed to make directory: %w", err)
+	}
+	if err = os.Rename(tmpFile.Name(), filePath); err != nil {
+		return fmt.Errorf("failed to move file: %w", err)
+	}
+	return nil
+}
+
+func (f *fileSystem) Open(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+	filePath, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (f *fileSystem) Stat(ctx context.Context, key string) (int64, error) {
+	filePath, err := f.path(key)
+	if err != nil {
+		return 0, err
+	}
+	stat, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+func (f *fileSystem) Delete(ctx context.Context, key string) error {
+	filePath, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// Clean up the directories which became empty, removing a non-empty directory fails
+	for dir := filepath.Dir(filePath); dir != f.root && strings.HasPrefix(dir, f.root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (f *fileSystem) Walk(ctx context.Context, prefix string, fn func(key string, size int64) error) error {
+	// Only walk the subtree which can contain matching keys
+	start := f.root
+	if dir := path.Dir(prefix); dir != "." {
+		var err error
+		if start, err = f.path(dir); err != nil {
+			return err
+		}
+	}
+	if _, err := os.Stat(start); os.IsNotExist(err) {
+		// Nothing stored under the prefix
+		return nil
+	}
+	return filepath.WalkDir(start, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(f.root, filePath)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if d.IsDir() {
+			if key == tmpDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return fn(key, info.Size())
+	})
+}
@@ -0,0 +1,221 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileutils
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+
+	"github.com/matrix-org/dendrite/mediaapi/filestore"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	log "github.com/sirupsen/logrus"
+)
+
+// hashLocks serialise storing and deleting files with the same hash within this process
+var hashLocks [256]sync.Mutex
+
+// lockHash locks the files with the given hash and returns the function to unlock them
+func lockHash(hash types.Base64Hash) func() {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(hash))
+	l := &hashLocks[h.Sum32()%uint32(len(hashLocks))]
+	l.Lock()
+	return l.Unlock
+}
+
+// DeleteMedia removes the media and its thumbnails. This is the only way media should be deleted.
+// Files are deduplicated by hash, so the metadata is removed first and the file and its thumbnails
+// are only removed from the store once no other media refers to them. If removing the file fails,
+// it is left behind as an orphan for CheckConsistency to find. The lock of the hash is held
+// throughout, so media stored with StoreFileAndMetadata at the same time either takes its reference
+// before the file is found to be unreferenced or stores the file again afterwards.
+// Returns nil metadata if there is no such media.
+func DeleteMedia(
+	ctx context.Context,
+	db storage.Database,
+	store filestore.Store,
+	mediaID types.MediaID,
+	mediaOrigin gomatrixserverlib.ServerName,
+	logger *log.Entry,
+) (*types.MediaMetadata, error) {
+	mediaMetadata, err := db.GetMediaMetadata(ctx, mediaID, mediaOrigin)
+	if err != nil {
+		return nil, fmt.Errorf("db.GetMediaMetadata: %w", err)
+	}
+	if mediaMetadata == nil {
+		return nil, nil
+	}
+	// The hash of the media never changes, so it is safe to lock it before deleting the metadata
+	unlock := lockHash(mediaMetadata.Base64Hash)
+	defer unlock()
+
+	mediaMetadata, unreferenced, err := db.DeleteMediaMetadata(ctx, mediaID, mediaOrigin)
+	if err != nil {
+		return nil, fmt.Errorf("db.DeleteMediaMetadata: %w", err)
+	}
+	if mediaMetadata == nil {
+		return nil, nil
+	}
+	logger = logger.WithFields(log.Fields{
+		"MediaID":    mediaID,
+		"Origin":     mediaOrigin,
+		"Base64Hash": mediaMetadata.Base64Hash,
+	})
+	if !unreferenced {
+		logger.Debug("Deleted media, the file is still referenced by other media")
+		return mediaMetadata, nil
+	}
+	if err = filestore.DeleteMedia(ctx, store, mediaMetadata.Base64Hash); err != nil {
+		logger.WithError(err).Warn("Deleted media but failed to remove the file, it is left as an orphan")
+		return mediaMetadata, nil
+	}
+	logger.Debug("Deleted media and its file")
+	return mediaMetadata, nil
+}
+
+// RefCountMismatch is a file whose stored reference count differs from the number of media referring to it
+type RefCountMismatch struct {
+	Base64Hash types.Base64Hash
+	Stored     int64
+	Actual     int64
+}
+
+// ConsistencyReport lists the differences between the media metadata and the files in the store
+type ConsistencyReport struct {
+	// Files in the store which no media refers to
+	OrphanFiles []types.Base64Hash
+	// Files which media refers to but which are missing from the store
+	MissingFiles []types.Base64Hash
+	// Files whose reference count is wrong
+	RefCountMismatches []RefCountMismatch
+	// Keys in the store which do not belong to any media file or thumbnail
+	UnknownKeys []string
+}
+
+// Consistent returns true if nothing was found
+func (r *ConsistencyReport) Consistent() bool {
+	return len(r.OrphanFiles) == 0 && len(r.MissingFiles) == 0 &&
+		len(r.RefCountMismatches) == 0 && len(r.UnknownKeys) == 0
+}
+
+// CheckConsistency compares the media metadata and reference counts in the database with the
+// files in the store. Uploads and deletions running at the same time may show up as orphans
+// or missing files, so the check should be repeated before acting on its results.
+func CheckConsistency(ctx context.Context, db storage.Database, store filestore.Store) (*ConsistencyReport, error) {
+	refCounts, err := db.GetBlobRefCounts(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("db.GetBlobRefCounts: %w", err)
+	}
+	hashCounts, err := db.GetMediaHashCounts(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("db.GetMediaHashCounts: %w", err)
+	}
+
+	report := &ConsistencyReport{}
+	stored := map[types.Base64Hash]bool{}
+	if err = store.Walk(ctx, "", func(key string, _ int64) error {
+		hash, isMediaFile, perr := filestore.ParseKey(key)
+		if perr != nil {
+			report.UnknownKeys = append(report.UnknownKeys, key)
+			return nil
+		}
+		// Thumbnails without their media file are orphans too
+		stored[hash] = stored[hash] || isMediaFile
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("store.Walk: %w", err)
+	}
+
+	for hash := range stored {
+		if hashCounts[hash] == 0 {
+			report.OrphanFiles = append(report.OrphanFiles, hash)
+		}
+	}
+	for hash, count := range hashCounts {
+		if !stored[hash] {
+			report.MissingFiles = append(report.MissingFiles, hash)
+		}
+		if refCounts[hash] != count {
+			report.RefCountMismatches = append(report.RefCountMismatches, RefCountMismatch{
+				Base64Hash: hash, Stored: refCounts[hash], Actual: count,
+			})
+		}
+	}
+	for hash, count := range refCounts {
+		if _, ok := hashCounts[hash]; !ok {
+			report.RefCountMismatches = append(report.RefCountMismatches, RefCountMismatch{
+				Base64Hash: hash, Stored: count,
+			})
+		}
+	}
+
+	sort.Slice(report.OrphanFiles, func(i, j int) bool { return report.OrphanFiles[i] < report.OrphanFiles[j] })
+	sort.Slice(report.MissingFiles, func(i, j int) bool { return report.MissingFiles[i] < report.MissingFiles[j] })
+	sort.Slice(report.RefCountMismatches, func(i, j int) bool {
+		return report.RefCountMismatches[i].Base64Hash < report.RefCountMismatches[j].Base64Hash
+	})
+	sort.Strings(report.UnknownKeys)
+	return report, nil
+}
+
+// RepairConsistency fixes what CheckConsistency found where possible: reference counts are
+// recounted and orphan files are removed from the store, after making sure again that no media
+// refers to them. Missing files can't be restored and unknown keys are left alone.
+// Storing and deleting media is blocked while orphan files are removed.
+func RepairConsistency(ctx context.Context, db storage.Database, store filestore.Store, report *ConsistencyReport, logger *log.Entry) error {
+	if len(report.RefCountMismatches) > 0 {
+		if err := db.RepairBlobRefCounts(ctx); err != nil {
+			return fmt.Errorf("db.RepairBlobRefCounts: %w", err)
+		}
+		logger.WithField("count", len(report.RefCountMismatches)).Info("Repaired reference counts")
+	}
+	if len(report.OrphanFiles) == 0 {
+		return nil
+	}
+	for i := range hashLocks {
+		hashLocks[i].Lock()
+	}
+	defer func() {
+		for i := range hashLocks {
+			hashLocks[i].Unlock()
+		}
+	}()
+	hashCounts, err := db.GetMediaHashCounts(ctx)
+	if err != nil {
+		return fmt.Errorf("db.GetMediaHashCounts: %w", err)
+	}
+	var failed int
+	for _, hash := range report.OrphanFiles {
+		if hashCounts[hash] > 0 {
+			// Media was stored for the file since the check
+			continue
+		}
+		if err = filestore.DeleteMedia(ctx, store, hash); err != nil {
+			logger.WithError(err).WithField("Base64Hash", hash).Error("Failed to remove orphan file")
+			failed++
+			continue
+		}
+		logger.WithField("Base64Hash", hash).Info("Removed orphan file")
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to remove %d orphan files", failed)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package fileutils
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/dendrite/mediaapi/filestore"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test/testrig"
+	log "github.com/sirupsen/logrus"
+)
+
+func mustPut(t *testing.T, store filestore.Store, key string) {
+	if err := store.Put(context.Background(), key, strings.NewReader("test"), 4); err != nil {
+		t.Fatalf("unable to store %s: %v", key, err)
+	}
+}
+
+func storeMedia(t *testing.T, db storage.Database, store filestore.Store, mediaID types.MediaID, hash types.Base64Hash) {
+	key, err := filestore.MediaKey(hash)
+	if err != nil {
+		t.Fatalf("MediaKey returned error: %v", err)
+	}
+	mustPut(t, store, key)
+	if err = db.StoreMediaMetadata(context.Background(), &types.MediaMetadata{
+		MediaID:       mediaID,
+		Origin:        "localhost",
+		ContentType:   "text/plain",
+		FileSizeBytes: 4,
+		UploadName:    "test",
+		Base64Hash:    hash,
+		UserID:        "@alice:localhost",
+	}); err != nil {
+		t.Fatalf("unable to store media metadata: %v", err)
+	}
+}
+
+func TestDeleteMedia(t *testing.T) {
+	ctx := context.Background()
+	db := testrig.CreateMediaAPIDatabase(t)
+	store := filestore.NewFileSystem(config.Path(t.TempDir()))
+	logger := log.New().WithField("mediaapi", "test")
+	storeMedia(t, db, store, "first", "sharedhash")
+	storeMedia(t, db, store, "second", "sharedhash")
+	key, _ := filestore.MediaKey("sharedhash")
+
+	deleted, err := DeleteMedia(ctx, db, store, "first", "localhost", logger)
+	if err != nil || deleted == nil {
+		t.Fatalf("expected media to be deleted, got %+v (%v)", deleted, err)
+	}
+	if _, err = store.Stat(ctx, key); err != nil {
+		t.Fatalf("file still referenced by other media was removed: %v", err)
+	}
+	if deleted, err = DeleteMedia(ctx, db, store, "second", "localhost", logger); err != nil || deleted == nil {
+		t.Fatalf("expected media to be deleted, got %+v (%v)", deleted, err)
+	}
+	if _, err = store.Stat(ctx, key); err != filestore.ErrNotFound {
+		t.Fatalf("expected unreferenced file to be removed, got %v", err)
+	}
+	if deleted, err = DeleteMedia(ctx, db, store, "second", "localhost", logger); err != nil || deleted != nil {
+		t.Fatalf("expected nothing to delete, got %+v (%v)", deleted, err)
+	}
+}
+
+func TestStoreFileAndMetadataWhileDeleting(t *testing.T) {
+	ctx := context.Background()
+	db := testrig.CreateMediaAPIDatabase(t)
+	store := filestore.NewFileSystem(config.Path(t.TempDir()))
+	logger := log.New().WithField("mediaapi", "test")
+	storeMedia(t, db, store, "media0", "sharedhash")
+
+	// Each round deletes the only media referring to the file while new media is stored for it
+	for i := 1; i <= 20; i++ {
+		tmpDir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(tmpDir, "content"), []byte("test"), 0600); err != nil {
+			t.Fatalf("unable to write temporary file: %v", err)
+		}
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func(mediaID types.MediaID) {
+			defer wg.Done()
+			if _, err := DeleteMedia(ctx, db, store, mediaID, "localhost", logger); err != nil {
+				t.Errorf("DeleteMedia returned error: %v", err)
+			}
+		}(types.MediaID(fmt.Sprintf("media%d", i-1)))
+		go func(mediaID types.MediaID) {
+			defer wg.Done()
+			if _, _, err := StoreFileAndMetadata(ctx, store, db, types.Path(tmpDir), &types.MediaMetadata{
+				MediaID:       mediaID,
+				Origin:        "localhost",
+				FileSizeBytes: 4,
+				Base64Hash:    "sharedhash",
+			}, logger); err != nil {
+				t.Errorf("StoreFileAndMetadata returned error: %v", err)
+			}
+		}(types.MediaID(fmt.Sprintf("media%d", i)))
+		wg.Wait()
+	}
+
+	report, err := CheckConsistency(ctx, db, store)
+	if err != nil {
+		t.Fatalf("CheckConsistency returned error: %v", err)
+	}
+	if !report.Consistent() {
+		t.Fatalf("expected media and files to be consistent, got %+v", report)
+	}
+}
+
+func TestCheckConsistency(t *testing.T) {
+	ctx := context.Background()
+	db := testrig.CreateMediaAPIDatabase(t)
+	store := filestore.NewFileSystem(config.Path(t.TempDir()))
+	logger := log.New().WithField("mediaapi", "test")
+	storeMedia(t, db, store, "ok", "okhash")
+	storeMedia(t, db, store, "missing", "missinghash")
+	missingKey, _ := filestore.MediaKey("missinghash")
+	if err := store.Delete(ctx, missingKey); err != nil {
+		t.Fatalf("unable to delete %s: %v", missingKey, err)
+	}
+	orphanKey, _ := filestore.MediaKey("orphanhash")
+	mustPut(t, store, orphanKey)
+	thumbnailKey, _ := filestore.ThumbnailKey("orphanthumb", types.ThumbnailSize{Width: 32, Height: 32, ResizeMethod: types.Crop})
+	mustPut(t, store, thumbnailKey)
+	mustPut(t, store, "junk")
+
+	report, err := CheckConsistency(ctx, db, store)
+	if err != nil {
+		t.Fatalf("CheckConsistency returned error: %v", err)
+	}
+	want := &ConsistencyReport{
+		OrphanFiles:  []types.Base64Hash{"orphanhash", "orphanthumb"},
+		MissingFiles: []types.Base64Hash{"missinghash"},
+		UnknownKeys:  []string{"junk"},
+	}
+	if !reflect.DeepEqual(want, report) {
+		t.Fatalf("expected report %+v, got %+v", want, report)
+	}
+
+	if err = RepairConsistency(ctx, db, store, report, logger); err != nil {
+		t.Fatalf("RepairConsistency returned error: %v", err)
+	}
+	if report, err = CheckConsistency(ctx, db, store); err != nil {
+		t.Fatalf("CheckConsistency returned error: %v", err)
+	}
+	want.OrphanFiles = nil
+	if !reflect.DeepEqual(want, report) {
+		t.Fatalf("expected report %+v after repair, got %+v", want, report)
+	}
+}
@@ -23,78 +23,77 @@ import (
 	"io"
 	"os"
 	"path/filepath"
-	"strings"
 
+	"github.com/matrix-org/dendrite/mediaapi/filestore"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/util"
 	log "github.com/sirupsen/logrus"
 )
 
-// GetPathFromBase64Hash evaluates the path to a media file from its Base64Hash
-// 3 subdirectories are created for more manageable browsing and use the remainder as the file name.
-// For example, if Base64Hash is 'qwerty', the path will be 'q/w/erty/file'.
-func GetPathFromBase64Hash(base64Hash types.Base64Hash, absBasePath config.Path) (string, error) {
-	if len(base64Hash) < 3 {
-		return "", fmt.Errorf("invalid filePath (Base64Hash too short - min 3 characters): %q", base64Hash)
-	}
-	if len(base64Hash) > 255 {
-		return "", fmt.Errorf("invalid filePath (Base64Hash too long - max 255 characters): %q", base64Hash)
-	}
-
-	filePath, err := filepath.Abs(filepath.Join(
-		string(absBasePath),
-		string(base64Hash[0:1]),
-		string(base64Hash[1:2]),
-		string(base64Hash[2:]),
-		"file",
-	))
-	if err != nil {
-		return "", fmt.Errorf("unable to construct filePath: %w", err)
-	}
-
-	// check if the absolute absBasePath is a prefix of the absolute filePath
-	// if so, no directory escape has occurred and the filePath is valid
-	// Note: absBasePath is already absolute
-	if !strings.HasPrefix(filePath, string(absBasePath)) {
-		return "", fmt.Errorf("invalid filePath (not within absBasePath %v): %v", absBasePath, filePath)
-	}
-
-	return filePath, nil
-}
-
-// MoveFileWithHashCheck checks for hash collisions when moving a temporary file to its final path based on metadata
-// The final path is based on the hash of the file.
-// If the final path exists and the file size matches, the file does not need to be moved.
-// In error cases where the file is not a duplicate, the caller may decide to remove the final path.
-// Returns the final path of the file, whether it is a duplicate and an error.
-func MoveFileWithHashCheck(tmpDir types.Path, mediaMetadata *types.MediaMetadata, absBasePath config.Path, logger *log.Entry) (types.Path, bool, error) {
+// StoreFileWithHashCheck checks for hash collisions when storing a temporary file in the media store
+// The key of the stored file is based on the hash of the file.
+// If a file with the same key and size is already stored, the file does not need to be stored again.
+// In error cases where the file is not a duplicate, the caller may decide to remove the stored file.
+// Returns the key of the stored file, whether it is a duplicate and an error.
+func StoreFileWithHashCheck(ctx context.Context, store filestore.Store, tmpDir types.Path, mediaMetadata *types.MediaMetadata, logger *log.Entry) (string, bool, error) {
 	// Note: in all error and success cases, we need to remove the temporary directory
 	defer RemoveDir(tmpDir, logger)
 	duplicate := false
-	finalPath, err := GetPathFromBase64Hash(mediaMetadata.Base64Hash, absBasePath)
+	key, err := filestore.MediaKey(mediaMetadata.Base64Hash)
 	if err != nil {
-		return "", duplicate, fmt.Errorf("failed to get file path from metadata: %w", err)
+		return "", duplicate, fmt.Errorf("failed to get key from metadata: %w", err)
 	}
 
-	var stat os.FileInfo
-	// Note: The double-negative is intentional as os.IsExist(err) != !os.IsNotExist(err).
-	// The functions are error checkers to be used in different cases.
-	if stat, err = os.Stat(finalPath); !os.IsNotExist(err) {
+	size, err := store.Stat(ctx, key)
+	switch {
+	case err == nil:
 		duplicate = true
-		if stat.Size() == int64(mediaMetadata.FileSizeBytes) {
-			return types.Path(finalPath), duplicate, nil
+		if size == int64(mediaMetadata.FileSizeBytes) {
+			return key, duplicate, nil
 		}
-		return "", duplicate, fmt.Errorf("downloaded file with hash collision but different file size (%v)", finalPath)
+		return "", duplicate, fmt.Errorf("downloaded file with hash collision but different file size (%v)", key)
+	case err != filestore.ErrNotFound:
+		return "", duplicate, fmt.Errorf("store.Stat: %w", err)
 	}
-	err = moveFile(
-		types.Path(filepath.Join(string(tmpDir), "content")),
-		types.Path(finalPath),
-	)
+
+	file, err := os.Open(filepath.Join(string(tmpDir), "content"))
 	if err != nil {
-		return "", duplicate, fmt.Errorf("failed to move file to final destination (%v): %w", finalPath, err)
+		return "", duplicate, fmt.Errorf("failed to open temporary file: %w", err)
+	}
+	defer file.Close() // nolint: errcheck
+	if err = store.Put(ctx, key, file, int64(mediaMetadata.FileSizeBytes)); err != nil {
+		return "", duplicate, fmt.Errorf("failed to store file (%v): %w", key, err)
 	}
-	return types.Path(finalPath), duplicate, nil
+	return key, duplicate, nil
+}
+
+// StoreFileAndMetadata stores the temporary file like StoreFileWithHashCheck and then the metadata
+// of the media, which takes a reference to the file. Both happen while holding the lock of the hash,
+// so DeleteMedia can't remove a file after it was found to be stored already but before the new
+// media refers to it. If the metadata can't be stored, the file is removed again unless it is a duplicate.
+// Returns the key of the stored file, whether it is a duplicate and an error.
+func StoreFileAndMetadata(ctx context.Context, store filestore.Store, db storage.Database, tmpDir types.Path, mediaMetadata *types.MediaMetadata, logger *log.Entry) (string, bool, error) {
+	unlock := lockHash(mediaMetadata.Base64Hash)
+	defer unlock()
+
+	key, duplicate, err := StoreFileWithHashCheck(ctx, store, tmpDir, mediaMetadata, logger)
+	if err != nil {
+		return "", duplicate, err
+	}
+	if err = db.StoreMediaMetadata(ctx, mediaMetadata); err != nil {
+		// If the file is a duplicate (has the same hash as an existing file) then
+		// there is valid metadata in the database for that file. As such we only
+		// remove the file if it is not a duplicate.
+		if !duplicate {
+			if rerr := store.Delete(ctx, key); rerr != nil {
+				logger.WithError(rerr).WithField("dst", key).Warn("Failed to remove stored file")
+			}
+		}
+		return "", duplicate, fmt.Errorf("db.StoreMediaMetadata: %w", err)
+	}
+	return key, duplicate, nil
 }
 
 // RemoveDir removes a directory and logs a warning in case of errors
@@ -146,21 +145,6 @@ func WriteTempFile(
 	return
 }
 
-// moveFile attempts to move the file src to dst
-func moveFile(src types.Path, dst types.Path) error {
-	dstDir := filepath.Dir(string(dst))
-
-	err := os.MkdirAll(dstDir, 0770)
-	if err != nil {
-		return fmt.Errorf("failed to make directory: %w", err)
-	}
-	err = os.Rename(string(src), string(dst))
-	if err != nil {
-		return fmt.Errorf("failed to move directory: %w", err)
-	}
-	return nil
-}
-
 func createTempFileWriter(absBasePath config.Path) (*bufio.Writer, *os.File, types.Path, error) {
 	tmpDir, err := createTempDir(absBasePath)
 	if err != nil {
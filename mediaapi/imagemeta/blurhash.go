@@ -0,0 +1,145 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imagemeta
+
+import (
+	"image"
+	"math"
+	"strings"
+)
+
+// blurhashSamples is the maximum number of pixels sampled along each side of the
+// image. The blurhash only retains the lowest frequencies, so there is no need to
+// look at every pixel of large images.
+const blurhashSamples = 64
+
+const base83Characters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// Blurhash encodes the image as displayed with the given EXIF orientation into a
+// blurhash with the given number of components along each axis, each between 1 and 9.
+// See https://github.com/woltapp/blurhash/blob/master/Algorithm.md
+func Blurhash(img image.Image, orientation, xComponents, yComponents int) string {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	displayWidth, displayHeight := width, height
+	if swapsAxes(orientation) {
+		displayWidth, displayHeight = height, width
+	}
+	samplesX, samplesY := displayWidth, displayHeight
+	if samplesX > blurhashSamples {
+		samplesX = blurhashSamples
+	}
+	if samplesY > blurhashSamples {
+		samplesY = blurhashSamples
+	}
+
+	// convert the sampled pixels to linear RGB once
+	pixels := make([][3]float64, samplesX*samplesY)
+	for sy := 0; sy < samplesY; sy++ {
+		for sx := 0; sx < samplesX; sx++ {
+			x, y := orient(
+				orientation,
+				(2*sx+1)*displayWidth/(2*samplesX), (2*sy+1)*displayHeight/(2*samplesY),
+				width, height,
+			)
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			pixels[sy*samplesX+sx] = [3]float64{
+				sRGBToLinear(r >> 8), sRGBToLinear(g >> 8), sRGBToLinear(b >> 8),
+			}
+		}
+	}
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			var factor [3]float64
+			for sy := 0; sy < samplesY; sy++ {
+				for sx := 0; sx < samplesX; sx++ {
+					basis := math.Cos(math.Pi*float64(i*sx)/float64(samplesX)) *
+						math.Cos(math.Pi*float64(j*sy)/float64(samplesY))
+					for c, v := range pixels[sy*samplesX+sx] {
+						factor[c] += basis * v
+					}
+				}
+			}
+			scale := normalisation / float64(samplesX*samplesY)
+			for c := range factor {
+				factor[c] *= scale
+			}
+			factors = append(factors, factor)
+		}
+	}
+
+	var hash strings.Builder
+	writeBase83(&hash, (xComponents-1)+(yComponents-1)*9, 1)
+
+	maximumValue := 1.0
+	if ac := factors[1:]; len(ac) > 0 {
+		actualMaximum := 0.0
+		for _, factor := range ac {
+			for _, v := range factor {
+				actualMaximum = math.Max(actualMaximum, math.Abs(v))
+			}
+		}
+		quantisedMaximum := int(math.Max(0, math.Min(82, math.Floor(actualMaximum*166-0.5))))
+		maximumValue = float64(quantisedMaximum+1) / 166
+		writeBase83(&hash, quantisedMaximum, 1)
+	} else {
+		writeBase83(&hash, 0, 1)
+	}
+
+	dc := factors[0]
+	writeBase83(&hash, linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4)
+	for _, factor := range factors[1:] {
+		value := 0
+		for _, v := range factor {
+			quantised := int(math.Max(0, math.Min(18, math.Floor(signPow(v/maximumValue, 0.5)*9+9.5))))
+			value = value*19 + quantised
+		}
+		writeBase83(&hash, value, 2)
+	}
+	return hash.String()
+}
+
+func writeBase83(hash *strings.Builder, value, length int) {
+	for i := 1; i <= length; i++ {
+		digit := value / int(math.Pow(83, float64(length-i))) % 83
+		hash.WriteByte(base83Characters[digit])
+	}
+}
+
+func sRGBToLinear(value uint32) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
@@ -0,0 +1,224 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imagemeta
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// JPEG markers, see https://www.w3.org/Graphics/JPEG/itu-t81.pdf
+const (
+	markerSOI   = 0xD8 // start of image
+	markerEOI   = 0xD9 // end of image
+	markerSOS   = 0xDA // start of scan, followed by the image data
+	markerRST0  = 0xD0
+	markerRST7  = 0xD7
+	markerTEM   = 0x01
+	markerAPP1  = 0xE1 // EXIF and XMP
+	markerAPP13 = 0xED // Photoshop and IPTC
+)
+
+// exifTagOrientation is the EXIF tag holding the orientation of the image
+const exifTagOrientation = 0x0112
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	xmpHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+)
+
+// ErrNotJPEG is returned if the data does not start with a JPEG marker.
+var ErrNotJPEG = errors.New("not a JPEG image")
+
+// IsJPEG returns whether the data starts like a JPEG image.
+func IsJPEG(header []byte) bool {
+	return len(header) >= 2 && header[0] == 0xFF && header[1] == markerSOI
+}
+
+// ReadOrientation returns the EXIF orientation of a JPEG image, or 1 if it has none.
+func ReadOrientation(r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	if err := readSOI(br); err != nil {
+		return 0, err
+	}
+	for {
+		marker, data, err := nextSegment(br)
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case marker == markerSOS || marker == markerEOI:
+			return 1, nil
+		case marker == markerAPP1 && bytes.HasPrefix(data, exifHeader):
+			return parseOrientation(data[len(exifHeader):]), nil
+		}
+	}
+}
+
+// StripMetadata copies a JPEG image from r to w without its EXIF, XMP and IPTC metadata,
+// which may contain the location the photo was taken at, the camera serial number and
+// the like. The EXIF orientation is kept, as the image would be displayed wrongly without it.
+func StripMetadata(r io.Reader, w io.Writer) error {
+	br := bufio.NewReader(r)
+	if err := readSOI(br); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte{0xFF, markerSOI}); err != nil {
+		return err
+	}
+	for {
+		marker, data, err := nextSegment(br)
+		if err != nil {
+			return err
+		}
+		switch {
+		case marker == markerAPP1 && bytes.HasPrefix(data, exifHeader):
+			if orientation := parseOrientation(data[len(exifHeader):]); orientation != 1 {
+				data = orientationEXIF(orientation)
+			} else {
+				continue
+			}
+		case marker == markerAPP1 && bytes.HasPrefix(data, xmpHeader), marker == markerAPP13:
+			continue
+		}
+
+		if err = writeSegment(w, marker, data); err != nil {
+			return err
+		}
+		if marker == markerSOS {
+			// the image data is copied as it is
+			_, err = io.Copy(w, br)
+			return err
+		}
+		if marker == markerEOI {
+			return nil
+		}
+	}
+}
+
+func readSOI(r *bufio.Reader) error {
+	header, err := r.Peek(2)
+	if err != nil || !IsJPEG(header) {
+		return ErrNotJPEG
+	}
+	_, err = r.Discard(2)
+	return err
+}
+
+// nextSegment reads the next marker and its payload. The payload is nil for markers without one.
+func nextSegment(r *bufio.Reader) (byte, []byte, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	if b != 0xFF {
+		return 0, nil, fmt.Errorf("expected a marker, got %#x", b)
+	}
+	marker := byte(0xFF)
+	// markers may be preceded by any number of fill bytes
+	for marker == 0xFF {
+		if marker, err = r.ReadByte(); err != nil {
+			return 0, nil, err
+		}
+	}
+	if marker == markerEOI || marker == markerTEM || (marker >= markerRST0 && marker <= markerRST7) {
+		return marker, nil, nil
+	}
+
+	var length uint16
+	if err = binary.Read(r, binary.BigEndian, &length); err != nil {
+		return 0, nil, err
+	}
+	if length < 2 {
+		return 0, nil, fmt.Errorf("invalid length %d of segment %#x", length, marker)
+	}
+	data := make([]byte, length-2)
+	if _, err = io.ReadFull(r, data); err != nil {
+		return 0, nil, err
+	}
+	return marker, data, nil
+}
+
+func writeSegment(w io.Writer, marker byte, data []byte) error {
+	if data == nil {
+		_, err := w.Write([]byte{0xFF, marker})
+		return err
+	}
+	header := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(header[2:], uint16(len(data)+2))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// parseOrientation reads the orientation from the first IFD of EXIF data in TIFF format.
+// Returns 1, meaning no transformation, if the data is malformed.
+func parseOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	offset := uint64(order.Uint32(tiff[4:8]))
+	if offset+2 > uint64(len(tiff)) {
+		return 1
+	}
+	count := uint64(order.Uint16(tiff[offset:]))
+	for i := uint64(0); i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > uint64(len(tiff)) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) != exifTagOrientation {
+			continue
+		}
+		// the value is a SHORT stored in the first bytes of the value field
+		if order.Uint16(tiff[entry+2:]) != 3 {
+			return 1
+		}
+		if orientation := int(order.Uint16(tiff[entry+8:])); orientation >= 1 && orientation <= 8 {
+			return orientation
+		}
+		return 1
+	}
+	return 1
+}
+
+// orientationEXIF returns the payload of an APP1 segment with EXIF data holding only the orientation.
+func orientationEXIF(orientation int) []byte {
+	data := bytes.NewBuffer(append([]byte{}, exifHeader...))
+	// big endian TIFF header, the first IFD follows immediately
+	data.Write([]byte{'M', 'M', 0, 42, 0, 0, 0, 8})
+	// one entry: the orientation as a single SHORT
+	_ = binary.Write(data, binary.BigEndian, []uint16{1, exifTagOrientation, 3})
+	_ = binary.Write(data, binary.BigEndian, []uint32{1})
+	_ = binary.Write(data, binary.BigEndian, []uint16{uint16(orientation), 0})
+	// no further IFDs
+	_ = binary.Write(data, binary.BigEndian, []uint32{0})
+	return data.Bytes()
+}
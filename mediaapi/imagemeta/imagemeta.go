@@ -0,0 +1,119 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package imagemeta extracts information about uploaded images, such as their
+// size and a blurhash placeholder, and removes private metadata from them.
+package imagemeta
+
+import (
+	"fmt"
+	"image"
+	"io"
+
+	// Imported for gif codec
+	_ "image/gif"
+	// Imported for jpeg codec
+	_ "image/jpeg"
+	// Imported for png codec
+	_ "image/png"
+
+	// Imported for webp codec
+	_ "golang.org/x/image/webp"
+
+	"github.com/matrix-org/dendrite/mediaapi/types"
+)
+
+// The number of blurhash components along the longer and shorter side of the image
+const (
+	blurhashComponentsLong  = 4
+	blurhashComponentsShort = 3
+)
+
+// Extract reads the size and EXIF orientation of the image and computes its blurhash.
+// Images with more than maxPixels pixels are not decoded and get no blurhash, 0 means
+// there is no limit. Returns nil if the file is not an image in a supported format.
+func Extract(r io.ReadSeeker, maxPixels int64) (*types.ImageMetadata, error) {
+	cfg, format, err := image.DecodeConfig(r)
+	if err != nil {
+		if err == image.ErrFormat {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("image.DecodeConfig: %w", err)
+	}
+
+	orientation := 1
+	if format == "jpeg" {
+		if _, err = r.Seek(0, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("r.Seek: %w", err)
+		}
+		if orientation, err = ReadOrientation(r); err != nil {
+			return nil, fmt.Errorf("ReadOrientation: %w", err)
+		}
+	}
+
+	meta := &types.ImageMetadata{
+		Width:       cfg.Width,
+		Height:      cfg.Height,
+		Orientation: orientation,
+	}
+	if swapsAxes(orientation) {
+		meta.Width, meta.Height = cfg.Height, cfg.Width
+	}
+	if maxPixels > 0 && int64(cfg.Width)*int64(cfg.Height) > maxPixels {
+		return meta, nil
+	}
+
+	if _, err = r.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("r.Seek: %w", err)
+	}
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return nil, fmt.Errorf("image.Decode: %w", err)
+	}
+	xComponents, yComponents := blurhashComponentsLong, blurhashComponentsShort
+	if meta.Height > meta.Width {
+		xComponents, yComponents = yComponents, xComponents
+	}
+	meta.Blurhash = Blurhash(img, orientation, xComponents, yComponents)
+	return meta, nil
+}
+
+// swapsAxes returns whether width and height of an image with the given EXIF
+// orientation are swapped when it is displayed.
+func swapsAxes(orientation int) bool {
+	return orientation >= 5 && orientation <= 8
+}
+
+// orient maps the coordinates of a pixel as displayed to its coordinates in the
+// stored image of the given size and EXIF orientation.
+func orient(orientation, x, y, width, height int) (int, int) {
+	switch orientation {
+	case 2: // mirrored horizontally
+		return width - 1 - x, y
+	case 3: // rotated by 180°
+		return width - 1 - x, height - 1 - y
+	case 4: // mirrored vertically
+		return x, height - 1 - y
+	case 5: // transposed
+		return y, x
+	case 6: // rotated by 90° counter-clockwise, so displayed rotated clockwise
+		return y, height - 1 - x
+	case 7: // transversed
+		return width - 1 - y, height - 1 - x
+	case 8: // rotated by 90° clockwise, so displayed rotated counter-clockwise
+		return width - 1 - y, x
+	default:
+		return x, y
+	}
+}
@@ -0,0 +1,147 @@
+package imagemeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func gradient(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 255 / width), G: uint8(y * 255 / height), B: 128, A: 255})
+		}
+	}
+	return img
+}
+
+// withEXIF inserts an APP1 segment with the orientation, a GPS IFD pointer and some
+// private data after the start of the JPEG image.
+func withEXIF(t *testing.T, img []byte, orientation uint16) []byte {
+	var tiff bytes.Buffer
+	tiff.WriteString("II*\x00")
+	for _, v := range []interface{}{
+		uint32(8), // offset of the first IFD
+		uint16(2), // number of entries
+		uint16(exifTagOrientation), uint16(3), uint32(1), orientation, uint16(0),
+		uint16(0x8825), uint16(4), uint32(1), uint32(38), // GPS IFD
+		uint32(0), // no further IFDs
+	} {
+		if err := binary.Write(&tiff, binary.LittleEndian, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tiff.WriteString("secret location")
+	app1 := append(append([]byte{}, exifHeader...), tiff.Bytes()...)
+	xmp := append(append([]byte{}, xmpHeader...), "<x:xmpmeta>secret author</x:xmpmeta>"...)
+
+	var out bytes.Buffer
+	out.Write(img[:2])
+	if err := writeSegment(&out, markerAPP1, app1); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSegment(&out, markerAPP1, xmp); err != nil {
+		t.Fatal(err)
+	}
+	out.Write(img[2:])
+	return out.Bytes()
+}
+
+func TestBlurhash(t *testing.T) {
+	black := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	for i := 3; i < len(black.Pix); i += 4 {
+		black.Pix[i] = 255
+	}
+	if got, want := Blurhash(black, 1, 4, 3), "L00000fQfQfQfQfQfQfQfQfQfQfQ"; got != want {
+		t.Errorf("Blurhash(black) = %q, want %q", got, want)
+	}
+
+	// an image stored rotated with orientation 6 must result in the same hash as the upright image
+	upright := gradient(8, 4)
+	stored := image.NewRGBA(image.Rect(0, 0, 4, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 4; x++ {
+			stored.Set(x, y, upright.At(7-y, x))
+		}
+	}
+	want := Blurhash(upright, 1, 4, 3)
+	if got := Blurhash(stored, 6, 4, 3); got != want {
+		t.Errorf("Blurhash(stored, 6) = %q, want %q", got, want)
+	}
+	if got := Blurhash(stored, 1, 4, 3); got == want {
+		t.Errorf("Blurhash(stored, 1) = %q, want a different hash", got)
+	}
+}
+
+func TestExtract(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, gradient(8, 4)); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := Extract(bytes.NewReader(buf.Bytes()), 0)
+	if err != nil {
+		t.Fatalf("Extract returned error: %v", err)
+	}
+	if meta.Width != 8 || meta.Height != 4 || meta.Orientation != 1 || len(meta.Blurhash) != 28 {
+		t.Errorf("Extract = %+v, want 8x4 with orientation 1 and a 4x3 blurhash", meta)
+	}
+
+	if meta, err = Extract(bytes.NewReader(buf.Bytes()), 16); err != nil || meta.Blurhash != "" {
+		t.Errorf("Extract with pixel limit = %+v, %v, want no blurhash", meta, err)
+	}
+
+	if meta, err = Extract(strings.NewReader("not an image"), 0); err != nil || meta != nil {
+		t.Errorf("Extract(text) = %+v, %v, want nil, nil", meta, err)
+	}
+}
+
+func TestStripMetadata(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, gradient(8, 4), nil); err != nil {
+		t.Fatal(err)
+	}
+	plain := buf.Bytes()
+
+	for _, orientation := range []uint16{1, 6} {
+		img := withEXIF(t, plain, orientation)
+		if got, err := ReadOrientation(bytes.NewReader(img)); err != nil || got != int(orientation) {
+			t.Errorf("ReadOrientation = %d, %v, want %d", got, err, orientation)
+		}
+
+		var stripped bytes.Buffer
+		if err := StripMetadata(bytes.NewReader(img), &stripped); err != nil {
+			t.Fatalf("StripMetadata returned error: %v", err)
+		}
+		if bytes.Contains(stripped.Bytes(), []byte("secret")) {
+			t.Errorf("stripped image still contains metadata")
+		}
+		if got, err := ReadOrientation(bytes.NewReader(stripped.Bytes())); err != nil || got != int(orientation) {
+			t.Errorf("ReadOrientation(stripped) = %d, %v, want %d", got, err, orientation)
+		}
+		if orientation == 1 && !bytes.Equal(stripped.Bytes(), plain) {
+			t.Errorf("stripped image differs from the image without metadata")
+		}
+
+		meta, err := Extract(bytes.NewReader(stripped.Bytes()), 0)
+		if err != nil {
+			t.Fatalf("Extract(stripped) returned error: %v", err)
+		}
+		wantWidth, wantHeight := 8, 4
+		if orientation == 6 {
+			wantWidth, wantHeight = 4, 8
+		}
+		if meta.Width != wantWidth || meta.Height != wantHeight || meta.Orientation != int(orientation) {
+			t.Errorf("Extract(stripped) = %+v, want %dx%d with orientation %d", meta, wantWidth, wantHeight, orientation)
+		}
+	}
+
+	if err := StripMetadata(strings.NewReader("not an image"), &bytes.Buffer{}); err != ErrNotJPEG {
+		t.Errorf("StripMetadata(text) = %v, want %v", err, ErrNotJPEG)
+	}
+}
@@ -15,6 +15,8 @@
 package mediaapi
 
 import (
+	"github.com/matrix-org/dendrite/mediaapi/consumers"
+	"github.com/matrix-org/dendrite/mediaapi/filestore"
 	"github.com/matrix-org/dendrite/mediaapi/routing"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/setup/base"
@@ -37,7 +39,18 @@ func AddPublicRoutes(
 		logrus.WithError(err).Panicf("failed to connect to media db")
 	}
 
+	mediaStore, err := filestore.New(cfg)
+	if err != nil {
+		logrus.WithError(err).Panicf("failed to set up media storage")
+	}
+
+	js, _ := base.NATS.Prepare(base.ProcessContext, &cfg.Matrix.JetStream)
+	roomConsumer := consumers.NewOutputRoomEventConsumer(base.ProcessContext, cfg, js, mediaDB)
+	if err = roomConsumer.Start(); err != nil {
+		logrus.WithError(err).Panicf("failed to start room server consumer")
+	}
+
 	routing.Setup(
-		base.PublicMediaAPIMux, cfg, rateCfg, mediaDB, userAPI, client,
+		base.PublicMediaAPIMux, base.DendriteAdminMux, cfg, rateCfg, mediaDB, mediaStore, userAPI, client,
 	)
 }
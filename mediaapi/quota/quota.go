@@ -0,0 +1,161 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package quota limits the total size of the media each user uploads.
+package quota
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/new_feature"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// ErrExceeded is returned when storing a file would take the uploader over their quota.
+var ErrExceeded = errors.New("storage quota exceeded")
+
+// pledgeLevelCacheTime is how long the pledge level of a user is cached, so that
+// uploads don't query the chain every time.
+const pledgeLevelCacheTime = 5 * time.Minute
+
+// PledgeLevelFunc returns the pledge level of a local user.
+type PledgeLevelFunc func(localpart string) (int64, error)
+
+// ChainPledgeLevel looks the pledge level of a user up on chain. Users who can't be
+// found have level 0.
+func ChainPledgeLevel(localpart string) (int64, error) {
+	return new_feature.QueryPledgeLevelByLocal(localpart)
+}
+
+// Checker compares the media stored by users with their quota. Two uploads of the
+// same user which are checked at the same time may take them over their quota
+// together, the next upload is rejected then. A nil *Checker accepts all files.
+type Checker struct {
+	cfg          *config.MediaQuotas
+	db           storage.Database
+	pledgeLevel  PledgeLevelFunc
+	pledgeLevels sync.Map // localpart -> *cachedPledgeLevel
+}
+
+type cachedPledgeLevel struct {
+	level   int64
+	expires time.Time
+}
+
+// NewChecker returns a Checker for the configuration, or nil if quotas are disabled.
+// In chain mode the pledge levels of users are looked up on chain.
+func NewChecker(cfg *config.MediaAPI, db storage.Database) *Checker {
+	if !cfg.Quotas.Enabled {
+		return nil
+	}
+	var pledgeLevel PledgeLevelFunc
+	if cfg.Matrix != nil && cfg.Matrix.Mode == "chain" {
+		pledgeLevel = ChainPledgeLevel
+	}
+	return NewCheckerWithPledgeLevel(&cfg.Quotas, db, pledgeLevel)
+}
+
+// NewCheckerWithPledgeLevel returns a Checker using the given pledge levels. The pledge
+// level multipliers are ignored if pledgeLevel is nil.
+func NewCheckerWithPledgeLevel(cfg *config.MediaQuotas, db storage.Database, pledgeLevel PledgeLevelFunc) *Checker {
+	return &Checker{
+		cfg:         cfg,
+		db:          db,
+		pledgeLevel: pledgeLevel,
+	}
+}
+
+// Quota returns the quota of the user in bytes, 0 meaning unlimited. Returns an error
+// if the pledge level of the user can't be looked up.
+func (c *Checker) Quota(userID types.MatrixUserID) (int64, error) {
+	if c == nil {
+		return 0, nil
+	}
+	if quota, ok := c.cfg.Users[string(userID)]; ok {
+		return int64(quota), nil
+	}
+	quota := int64(c.cfg.DefaultBytes)
+	if c.pledgeLevel == nil {
+		return quota, nil
+	}
+	localpart, _, err := gomatrixserverlib.SplitID('@', string(userID))
+	if err != nil {
+		return quota, nil
+	}
+	level, err := c.getPledgeLevel(localpart)
+	if err != nil {
+		return 0, fmt.Errorf("c.pledgeLevel: %w", err)
+	}
+	if multiplier, ok := c.cfg.PledgeLevelMultipliers[level]; ok {
+		quota = int64(float64(quota) * multiplier)
+	}
+	return quota, nil
+}
+
+// getPledgeLevel returns the pledge level of the user, which is cached for a while.
+// Failed lookups are not cached.
+func (c *Checker) getPledgeLevel(localpart string) (int64, error) {
+	if cached, ok := c.pledgeLevels.Load(localpart); ok {
+		if p := cached.(*cachedPledgeLevel); time.Now().Before(p.expires) {
+			return p.level, nil
+		}
+	}
+	level, err := c.pledgeLevel(localpart)
+	if err != nil {
+		return 0, err
+	}
+	c.pledgeLevels.Store(localpart, &cachedPledgeLevel{
+		level:   level,
+		expires: time.Now().Add(pledgeLevelCacheTime),
+	})
+	return level, nil
+}
+
+// Usage returns the bytes stored by the user and their quota, 0 meaning unlimited.
+func (c *Checker) Usage(ctx context.Context, userID types.MatrixUserID) (used, quota int64, err error) {
+	if c == nil {
+		return 0, 0, nil
+	}
+	used, err = c.db.GetUserUsage(ctx, userID)
+	if err != nil {
+		return 0, 0, fmt.Errorf("c.db.GetUserUsage: %w", err)
+	}
+	quota, err = c.Quota(userID)
+	if err != nil {
+		return 0, 0, err
+	}
+	return used, quota, nil
+}
+
+// Check returns ErrExceeded if storing size more bytes takes the user over their quota.
+func (c *Checker) Check(ctx context.Context, userID types.MatrixUserID, size types.FileSizeBytes) error {
+	if c == nil || userID == "" {
+		return nil
+	}
+	used, quota, err := c.Usage(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if quota > 0 && used+int64(size) > quota {
+		return ErrExceeded
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test/testrig"
+)
+
+func TestQuota(t *testing.T) {
+	cfg := &config.MediaQuotas{
+		Enabled:      true,
+		DefaultBytes: 100,
+		Users: map[string]config.FileSizeBytes{
+			"@admin:localhost":    0,
+			"@uploader:localhost": 1000,
+			"@pledged2:localhost": 10,
+		},
+		PledgeLevelMultipliers: map[int64]float64{1: 1.5, 2: 10},
+	}
+	pledgeLevels := map[string]int64{"pledged1": 1, "pledged2": 2, "pledged3": 3}
+	pledgeLevel := func(localpart string) (int64, error) {
+		return pledgeLevels[localpart], nil
+	}
+
+	tests := []struct {
+		userID types.MatrixUserID
+		chain  bool
+		want   int64
+	}{
+		{userID: "@alice:localhost", want: 100},
+		{userID: "@pledged1:localhost", want: 100},
+		{userID: "@admin:localhost", want: 0},
+		{userID: "@uploader:localhost", want: 1000},
+		{userID: "@alice:localhost", chain: true, want: 100},
+		{userID: "@pledged1:localhost", chain: true, want: 150},
+		{userID: "@pledged3:localhost", chain: true, want: 100},
+		{userID: "@pledged2:localhost", chain: true, want: 10},
+		{userID: "@uploader:localhost", chain: true, want: 1000},
+	}
+	for _, tt := range tests {
+		c := NewCheckerWithPledgeLevel(cfg, nil, nil)
+		if tt.chain {
+			c = NewCheckerWithPledgeLevel(cfg, nil, pledgeLevel)
+		}
+		if got, err := c.Quota(tt.userID); err != nil || got != tt.want {
+			t.Errorf("Quota(%s) with chain %v = %d, %v, want %d", tt.userID, tt.chain, got, err, tt.want)
+		}
+	}
+
+	var disabled *Checker
+	if got, err := disabled.Quota("@alice:localhost"); err != nil || got != 0 {
+		t.Errorf("expected no quota without a checker, got %d, %v", got, err)
+	}
+}
+
+func TestQuotaPledgeLevelLookup(t *testing.T) {
+	cfg := &config.MediaQuotas{
+		Enabled:                true,
+		DefaultBytes:           100,
+		PledgeLevelMultipliers: map[int64]float64{1: 2},
+	}
+	var lookups int
+	var lookupErr error
+	c := NewCheckerWithPledgeLevel(cfg, nil, func(localpart string) (int64, error) {
+		lookups++
+		return 1, lookupErr
+	})
+
+	lookupErr = errors.New("chain unreachable")
+	if got, err := c.Quota("@alice:localhost"); err == nil {
+		t.Errorf("expected a failed lookup to be an error, got quota %d", got)
+	}
+	lookupErr = nil
+	for i := 0; i < 2; i++ {
+		if got, err := c.Quota("@alice:localhost"); err != nil || got != 200 {
+			t.Errorf("Quota() = %d, %v, want 200", got, err)
+		}
+	}
+	if lookups != 2 {
+		t.Errorf("expected the failed lookup not to be cached and the successful one to be cached, got %d lookups", lookups)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+	db := testrig.CreateMediaAPIDatabase(t)
+	err := db.StoreMediaMetadata(ctx, &types.MediaMetadata{
+		MediaID:       "stored",
+		Origin:        "localhost",
+		FileSizeBytes: 60,
+		Base64Hash:    "c3RvcmVk",
+		UserID:        "@alice:localhost",
+	})
+	if err != nil {
+		t.Fatalf("unable to store media metadata: %v", err)
+	}
+
+	c := NewCheckerWithPledgeLevel(&config.MediaQuotas{
+		Enabled:      true,
+		DefaultBytes: 100,
+		Users:        map[string]config.FileSizeBytes{"@admin:localhost": 0},
+	}, db, nil)
+	tests := []struct {
+		userID types.MatrixUserID
+		size   types.FileSizeBytes
+		want   error
+	}{
+		{userID: "@alice:localhost", size: 40, want: nil},
+		{userID: "@alice:localhost", size: 41, want: ErrExceeded},
+		{userID: "@bob:localhost", size: 100, want: nil},
+		{userID: "@bob:localhost", size: 101, want: ErrExceeded},
+		{userID: "@admin:localhost", size: 1 << 40, want: nil},
+		{userID: "", size: 1 << 40, want: nil},
+	}
+	for _, tt := range tests {
+		if got := c.Check(ctx, tt.userID, tt.size); got != tt.want {
+			t.Errorf("Check(%s, %d) = %v, want %v", tt.userID, tt.size, got, tt.want)
+		}
+	}
+
+	used, quota, err := c.Usage(ctx, "@alice:localhost")
+	if err != nil || used != 60 || quota != 100 {
+		t.Errorf("Usage() = %d, %d, %v, want 60, 100, nil", used, quota, err)
+	}
+}
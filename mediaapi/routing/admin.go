@@ -0,0 +1,319 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/mediaapi/filestore"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// The actions recorded in the media audit log
+const (
+	auditListUserMedia    = "list_user_media"
+	auditQuarantineMedia  = "quarantine_media"
+	auditQuarantineRoom   = "quarantine_room_media"
+	auditPurgeRemoteMedia = "purge_remote_media"
+	auditDeleteUserMedia  = "delete_user_media"
+)
+
+const (
+	defaultAuditLogLimit = 100
+	maxAuditLogLimit     = 1000
+	// The number of remote media loaded at once when purging
+	purgeRemoteMediaBatchSize = 500
+)
+
+type adminMediaInfo struct {
+	MediaID     types.MediaID                `json:"media_id"`
+	Origin      gomatrixserverlib.ServerName `json:"media_origin"`
+	ContentType types.ContentType            `json:"content_type"`
+	Size        types.FileSizeBytes          `json:"size"`
+	CreatedTS   gomatrixserverlib.Timestamp  `json:"created_ts"`
+	UploadName  types.Filename               `json:"upload_name"`
+	Quarantined bool                         `json:"quarantined"`
+}
+
+type adminListUserMediaResponse struct {
+	Media     []adminMediaInfo    `json:"media"`
+	TotalSize types.FileSizeBytes `json:"total_size"`
+}
+
+type adminAffectedResponse struct {
+	Affected int64 `json:"affected"`
+}
+
+// adminDeleteResponse lists the mxc URIs of the media which could not be deleted, the
+// deletion is partial if any failed.
+type adminDeleteResponse struct {
+	Affected int64    `json:"affected"`
+	Failed   []string `json:"failed"`
+}
+
+type adminAuditEntry struct {
+	UserID    types.MatrixUserID          `json:"user_id"`
+	Action    string                      `json:"action"`
+	Target    string                      `json:"target"`
+	Affected  int64                       `json:"affected"`
+	Timestamp gomatrixserverlib.Timestamp `json:"ts"`
+}
+
+type adminAuditLogResponse struct {
+	Entries []adminAuditEntry `json:"entries"`
+}
+
+func adminForbidden(device *userapi.Device) *util.JSONResponse {
+	if device.AccountType == userapi.AccountTypeAdmin {
+		return nil
+	}
+	return &util.JSONResponse{
+		Code: http.StatusForbidden,
+		JSON: jsonerror.Forbidden("This API can only be used by admin users."),
+	}
+}
+
+// recordAudit stores the action in the media audit log. The action has already been
+// taken, so a failure is only logged.
+func recordAudit(ctx context.Context, db storage.Database, device *userapi.Device, action, target string, affected int64) {
+	entry := &types.MediaAuditEntry{
+		UserID:    types.MatrixUserID(device.UserID),
+		Action:    action,
+		Target:    target,
+		Affected:  affected,
+		Timestamp: gomatrixserverlib.AsTimestamp(time.Now()),
+	}
+	if err := db.StoreMediaAuditEntry(ctx, entry); err != nil {
+		util.GetLogger(ctx).WithError(err).WithFields(log.Fields{
+			"action": action,
+			"target": target,
+		}).Error("Failed to record media admin action in the audit log")
+	}
+}
+
+// AdminListUserMedia implements GET /_dendrite/admin/listUserMedia/{userID}
+// Lists the media uploaded by the user with their sizes, oldest first.
+func AdminListUserMedia(req *http.Request, device *userapi.Device, db storage.Database, userID string) util.JSONResponse {
+	if resErr := adminForbidden(device); resErr != nil {
+		return *resErr
+	}
+	ctx := req.Context()
+	media, err := db.GetUserMedia(ctx, types.MatrixUserID(userID))
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("db.GetUserMedia failed")
+		return jsonerror.InternalServerError()
+	}
+	res := adminListUserMediaResponse{Media: []adminMediaInfo{}}
+	for _, m := range media {
+		res.Media = append(res.Media, adminMediaInfo{
+			MediaID:     m.MediaID,
+			Origin:      m.Origin,
+			ContentType: m.ContentType,
+			Size:        m.FileSizeBytes,
+			CreatedTS:   m.CreationTimestamp,
+			UploadName:  m.UploadName,
+			Quarantined: m.Quarantined,
+		})
+		res.TotalSize += m.FileSizeBytes
+	}
+	recordAudit(ctx, db, device, auditListUserMedia, userID, int64(len(media)))
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// AdminQuarantineMedia implements POST /_dendrite/admin/quarantineMedia/{serverName}/{mediaId}
+// Quarantined media can't be downloaded, the file is kept. Remote media which has not been
+// fetched yet can be quarantined too.
+func AdminQuarantineMedia(
+	req *http.Request, device *userapi.Device, db storage.Database,
+	serverName gomatrixserverlib.ServerName, mediaID types.MediaID,
+) util.JSONResponse {
+	if resErr := adminForbidden(device); resErr != nil {
+		return *resErr
+	}
+	if serverName == "" || !mediaIDRegex.MatchString(string(mediaID)) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Expecting a server name and media ID."),
+		}
+	}
+	ctx := req.Context()
+	quarantined, err := db.QuarantineMedia(ctx, mediaID, serverName, types.MatrixUserID(device.UserID))
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("db.QuarantineMedia failed")
+		return jsonerror.InternalServerError()
+	}
+	var affected int64
+	if quarantined {
+		affected = 1
+	}
+	recordAudit(ctx, db, device, auditQuarantineMedia, fmt.Sprintf("mxc://%s/%s", serverName, mediaID), affected)
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: adminAffectedResponse{Affected: affected},
+	}
+}
+
+// AdminQuarantineRoomMedia implements POST /_dendrite/admin/quarantineRoomMedia/{roomID}
+// Quarantines all media referred to by events in the room. Only events received after the
+// media API started recording room media are taken into account.
+func AdminQuarantineRoomMedia(req *http.Request, device *userapi.Device, db storage.Database, roomID string) util.JSONResponse {
+	if resErr := adminForbidden(device); resErr != nil {
+		return *resErr
+	}
+	ctx := req.Context()
+	affected, err := db.QuarantineRoomMedia(ctx, roomID, types.MatrixUserID(device.UserID))
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("db.QuarantineRoomMedia failed")
+		return jsonerror.InternalServerError()
+	}
+	recordAudit(ctx, db, device, auditQuarantineRoom, roomID, affected)
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: adminAffectedResponse{Affected: affected},
+	}
+}
+
+// AdminPurgeRemoteMedia implements POST /_dendrite/admin/purgeRemoteMedia?before_ts=<ms>
+// Deletes the remote media cached before the timestamp. It is fetched again when requested.
+// Media which fails to be deleted is skipped and listed in the response, the request can be
+// repeated to retry it.
+func AdminPurgeRemoteMedia(
+	req *http.Request, cfg *config.MediaAPI, device *userapi.Device, db storage.Database, store filestore.Store,
+) util.JSONResponse {
+	if resErr := adminForbidden(device); resErr != nil {
+		return *resErr
+	}
+	beforeTS, err := strconv.ParseInt(req.URL.Query().Get("before_ts"), 10, 64)
+	if err != nil || beforeTS <= 0 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("before_ts must be a timestamp in milliseconds."),
+		}
+	}
+	ctx := req.Context()
+	logger := util.GetLogger(ctx)
+	res := adminDeleteResponse{Failed: []string{}}
+	for {
+		// Deleted media drops out of the query, so only the media which failed is skipped
+		var media []*types.MediaMetadata
+		media, err = db.GetRemoteMediaMetadataCreatedBefore(
+			ctx, cfg.Matrix.ServerName, gomatrixserverlib.Timestamp(beforeTS), purgeRemoteMediaBatchSize, len(res.Failed),
+		)
+		if err != nil {
+			logger.WithError(err).Error("db.GetRemoteMediaMetadataCreatedBefore failed")
+			break
+		}
+		deleteMedia(ctx, db, store, media, &res, logger)
+		if len(media) < purgeRemoteMediaBatchSize {
+			break
+		}
+	}
+	recordAudit(ctx, db, device, auditPurgeRemoteMedia, strconv.FormatInt(beforeTS, 10), res.Affected)
+	if err != nil {
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// AdminDeleteUserMedia implements POST /_dendrite/admin/deleteUserMedia/{userID}
+// Deletes all media uploaded by the user. Media which fails to be deleted is skipped and
+// listed in the response.
+func AdminDeleteUserMedia(
+	req *http.Request, device *userapi.Device, db storage.Database, store filestore.Store, userID string,
+) util.JSONResponse {
+	if resErr := adminForbidden(device); resErr != nil {
+		return *resErr
+	}
+	ctx := req.Context()
+	logger := util.GetLogger(ctx)
+	media, err := db.GetMediaMetadataForUser(ctx, types.MatrixUserID(userID))
+	if err != nil {
+		logger.WithError(err).Error("db.GetMediaMetadataForUser failed")
+		return jsonerror.InternalServerError()
+	}
+	res := adminDeleteResponse{Failed: []string{}}
+	deleteMedia(ctx, db, store, media, &res, logger)
+	recordAudit(ctx, db, device, auditDeleteUserMedia, userID, res.Affected)
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// deleteMedia deletes the media and its files, carrying on past failures. The deleted media
+// is counted in res and the mxc URIs of the media which failed are added to it.
+func deleteMedia(
+	ctx context.Context, db storage.Database, store filestore.Store,
+	media []*types.MediaMetadata, res *adminDeleteResponse, logger *log.Entry,
+) {
+	for _, m := range media {
+		if _, err := fileutils.DeleteMedia(ctx, db, store, m.MediaID, m.Origin, logger); err != nil {
+			logger.WithError(err).WithFields(log.Fields{
+				"media_id": m.MediaID,
+				"origin":   m.Origin,
+			}).Error("fileutils.DeleteMedia failed")
+			res.Failed = append(res.Failed, fmt.Sprintf("mxc://%s/%s", m.Origin, m.MediaID))
+			continue
+		}
+		res.Affected++
+	}
+}
+
+// AdminMediaAuditLog implements GET /_dendrite/admin/mediaAuditLog?limit=<n>
+// Returns the latest actions admins took on media, newest first.
+func AdminMediaAuditLog(req *http.Request, device *userapi.Device, db storage.Database) util.JSONResponse {
+	if resErr := adminForbidden(device); resErr != nil {
+		return *resErr
+	}
+	limit := defaultAuditLogLimit
+	if l, err := strconv.Atoi(req.URL.Query().Get("limit")); err == nil && l > 0 {
+		limit = l
+	}
+	if limit > maxAuditLogLimit {
+		limit = maxAuditLogLimit
+	}
+	ctx := req.Context()
+	entries, err := db.GetMediaAuditLog(ctx, limit)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("db.GetMediaAuditLog failed")
+		return jsonerror.InternalServerError()
+	}
+	res := adminAuditLogResponse{Entries: []adminAuditEntry{}}
+	for _, e := range entries {
+		res.Entries = append(res.Entries, adminAuditEntry(*e))
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
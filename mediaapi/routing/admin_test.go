@@ -0,0 +1,112 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/mediaapi/filestore"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test/testrig"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestAdminMedia(t *testing.T) {
+	db := testrig.CreateMediaAPIDatabase(t)
+	store := filestore.NewFileSystem(config.Path(t.TempDir()))
+	cfg := &config.MediaAPI{Matrix: &config.Global{ServerName: "localhost"}}
+	ctx := context.Background()
+	for _, m := range []*types.MediaMetadata{
+		{MediaID: "first", Origin: "localhost", ContentType: "text/plain", FileSizeBytes: 4, UploadName: "a", Base64Hash: "firsthash", UserID: "@alice:localhost"},
+		{MediaID: "second", Origin: "localhost", ContentType: "text/plain", FileSizeBytes: 4, UploadName: "b", Base64Hash: "secondhash", UserID: "@alice:localhost"},
+		{MediaID: "remote", Origin: "remote", ContentType: "text/plain", FileSizeBytes: 4, UploadName: "c", Base64Hash: "remotehash", UserID: "@bob:remote"},
+	} {
+		key, _ := filestore.MediaKey(m.Base64Hash)
+		if err := store.Put(ctx, key, strings.NewReader("test"), 4); err != nil {
+			t.Fatalf("unable to store file: %v", err)
+		}
+		if err := db.StoreMediaMetadata(ctx, m); err != nil {
+			t.Fatalf("unable to store media metadata: %v", err)
+		}
+	}
+	admin := &userapi.Device{UserID: "@admin:localhost", AccountType: userapi.AccountTypeAdmin}
+	user := &userapi.Device{UserID: "@alice:localhost", AccountType: userapi.AccountTypeUser}
+	req := httptest.NewRequest(http.MethodPost, "/admin", nil)
+
+	if res := AdminListUserMedia(req, user, db, "@alice:localhost"); res.Code != http.StatusForbidden {
+		t.Fatalf("expected non-admin to be forbidden, got %d", res.Code)
+	}
+
+	res := AdminListUserMedia(req, admin, db, "@alice:localhost")
+	list, ok := res.JSON.(adminListUserMediaResponse)
+	if res.Code != http.StatusOK || !ok || len(list.Media) != 2 || list.TotalSize != 8 {
+		t.Fatalf("unexpected list response %d %+v", res.Code, res.JSON)
+	}
+
+	if res = AdminQuarantineMedia(req, admin, db, "localhost", "first"); res.Code != http.StatusOK {
+		t.Fatalf("unexpected quarantine response %d %+v", res.Code, res.JSON)
+	}
+	res = AdminListUserMedia(req, admin, db, "@alice:localhost")
+	for _, m := range res.JSON.(adminListUserMediaResponse).Media {
+		if m.Quarantined != (m.MediaID == "first") {
+			t.Fatalf("expected only the first media to be quarantined, got %+v", m)
+		}
+	}
+	dReq := &downloadRequest{
+		MediaMetadata: &types.MediaMetadata{MediaID: "first", Origin: "localhost"},
+		Logger:        log.New().WithField("mediaapi", "test"),
+	}
+	w := httptest.NewRecorder()
+	metadata, err := dReq.doDownload(ctx, w, httptest.NewRequest(http.MethodGet, "/download/localhost/first", nil), cfg, db, store, nil, nil, nil, nil, nil)
+	if err != nil || metadata != nil {
+		t.Fatalf("expected quarantined media not to be served, got %+v (%v)", metadata, err)
+	}
+	key, _ := filestore.MediaKey("firsthash")
+	if _, err = store.Stat(ctx, key); err != nil {
+		t.Fatalf("expected quarantined file to be kept: %v", err)
+	}
+
+	if err = db.StoreRoomMedia(ctx, "!room:localhost", []*types.MediaMetadata{
+		{MediaID: "first", Origin: "localhost"},
+		{MediaID: "remote", Origin: "remote"},
+	}); err != nil {
+		t.Fatalf("unable to store room media: %v", err)
+	}
+	res = AdminQuarantineRoomMedia(req, admin, db, "!room:localhost")
+	if affected := res.JSON.(adminAffectedResponse).Affected; affected != 1 {
+		t.Fatalf("expected 1 newly quarantined media in the room, got %d", affected)
+	}
+
+	purgeReq := httptest.NewRequest(http.MethodPost, "/admin/purgeRemoteMedia?before_ts=99999999999999", nil)
+	res = AdminPurgeRemoteMedia(purgeReq, cfg, admin, db, store)
+	if purged := res.JSON.(adminDeleteResponse); res.Code != http.StatusOK || purged.Affected != 1 || len(purged.Failed) != 0 {
+		t.Fatalf("expected 1 purged remote media, got %d %+v", res.Code, res.JSON)
+	}
+	if m, _ := db.GetMediaMetadata(ctx, "first", "localhost"); m == nil {
+		t.Fatalf("purging remote media deleted local media")
+	}
+
+	res = AdminDeleteUserMedia(req, admin, db, store, "@alice:localhost")
+	if deleted := res.JSON.(adminDeleteResponse); res.Code != http.StatusOK || deleted.Affected != 2 || len(deleted.Failed) != 0 {
+		t.Fatalf("expected 2 deleted media, got %d %+v", res.Code, res.JSON)
+	}
+	if _, err = store.Stat(ctx, key); err != filestore.ErrNotFound {
+		t.Fatalf("expected deleted file to be removed, got %v", err)
+	}
+
+	res = AdminMediaAuditLog(httptest.NewRequest(http.MethodGet, "/admin/mediaAuditLog", nil), admin, db)
+	entries := res.JSON.(adminAuditLogResponse).Entries
+	wantActions := []string{auditDeleteUserMedia, auditPurgeRemoteMedia, auditQuarantineRoom, auditListUserMedia, auditQuarantineMedia, auditListUserMedia}
+	if len(entries) != len(wantActions) {
+		t.Fatalf("expected %d audit entries, got %+v", len(wantActions), entries)
+	}
+	for i, action := range wantActions {
+		if entries[i].Action != action || entries[i].UserID != "@admin:localhost" {
+			t.Fatalf("unexpected audit entry %d: %+v", i, entries[i])
+		}
+	}
+}
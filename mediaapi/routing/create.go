@@ -0,0 +1,326 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/mediaapi/filestore"
+	"github.com/matrix-org/dendrite/mediaapi/quota"
+	"github.com/matrix-org/dendrite/mediaapi/scanner"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// How often downloads waiting for a pending upload check the database, in case the
+// content was uploaded through another media API instance
+const pendingUploadPollInterval = time.Second
+
+// How often reservations whose content was never uploaded are removed
+const pendingUploadsExpiryInterval = 10 * time.Minute
+
+// errNotYetUploaded is returned when a download timed out waiting for the content of a reserved media ID
+var errNotYetUploaded = errors.New("media has not been uploaded yet")
+
+// createResponse defines the format of the JSON response
+// https://github.com/matrix-org/matrix-spec-proposals/pull/2246
+type createResponse struct {
+	ContentURI      string                      `json:"content_uri"`
+	UnusedExpiresAt gomatrixserverlib.Timestamp `json:"unused_expires_at"`
+}
+
+// uploadPendingResponse defines the format of the JSON response to PUT /upload, which is empty in the spec
+type uploadPendingResponse struct {
+	// NOTSPEC: the info object for the event referring to the image
+	Info *mediaInfo `json:"info,omitempty"`
+}
+
+// CreateMedia implements POST /create
+// A media ID is reserved for the user, so that events referring to it can be sent before the
+// content is uploaded with PUT /upload/{serverName}/{mediaId}. Downloads of the media wait for
+// the content. Reservations expire if the content is not uploaded in time.
+func CreateMedia(req *http.Request, cfg *config.MediaAPI, dev *userapi.Device, db storage.Database) util.JSONResponse {
+	ctx := req.Context()
+	logger := util.GetLogger(ctx).WithField("Origin", cfg.Matrix.ServerName)
+	now := time.Now()
+
+	if cfg.PendingUploads.MaxPerUser > 0 {
+		count, err := db.CountPendingUploads(ctx, types.MatrixUserID(dev.UserID), gomatrixserverlib.AsTimestamp(now))
+		if err != nil {
+			logger.WithError(err).Error("Failed to count pending uploads")
+			return jsonerror.InternalServerError()
+		}
+		if count >= cfg.PendingUploads.MaxPerUser {
+			return util.JSONResponse{
+				Code: http.StatusTooManyRequests,
+				JSON: jsonerror.LimitExceeded(fmt.Sprintf("You may not have more than %d pending uploads", cfg.PendingUploads.MaxPerUser), 0),
+			}
+		}
+	}
+
+	r := &uploadRequest{
+		MediaMetadata: &types.MediaMetadata{
+			Origin: cfg.Matrix.ServerName,
+		},
+		Logger: logger,
+	}
+	mediaID, err := r.generateMediaID(ctx, db)
+	if err != nil {
+		logger.WithError(err).Error("Failed to generate media ID for pending upload")
+		return jsonerror.InternalServerError()
+	}
+	pending := &types.PendingUpload{
+		MediaID:           mediaID,
+		Origin:            cfg.Matrix.ServerName,
+		UserID:            types.MatrixUserID(dev.UserID),
+		CreationTimestamp: gomatrixserverlib.AsTimestamp(now),
+		ExpiresTimestamp:  gomatrixserverlib.AsTimestamp(now.Add(cfg.PendingUploads.ExpireAfter)),
+	}
+	if err = db.StorePendingUpload(ctx, pending); err != nil {
+		logger.WithError(err).Error("Failed to store pending upload")
+		return jsonerror.InternalServerError()
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: createResponse{
+			ContentURI:      fmt.Sprintf("mxc://%s/%s", cfg.Matrix.ServerName, mediaID),
+			UnusedExpiresAt: pending.ExpiresTimestamp,
+		},
+	}
+}
+
+// UploadPending implements PUT /upload/{serverName}/{mediaId}
+// The content is stored the same way as for POST /upload, but under the media ID reserved with /create.
+func UploadPending(
+	req *http.Request,
+	cfg *config.MediaAPI,
+	dev *userapi.Device,
+	db storage.Database,
+	store filestore.Store,
+	checker *scanner.Checker,
+	quotas *quota.Checker,
+	activePendingUploads *types.ActivePendingUploads,
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+	serverName gomatrixserverlib.ServerName,
+	mediaID types.MediaID,
+) util.JSONResponse {
+	ctx := req.Context()
+	logger := util.GetLogger(ctx).WithFields(log.Fields{
+		"Origin":  serverName,
+		"MediaID": mediaID,
+	})
+
+	if serverName != cfg.Matrix.ServerName {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Media was not created on this server"),
+		}
+	}
+
+	// Only one upload of the content may run at a time, otherwise concurrent requests
+	// could all find the media ID without content and store theirs.
+	if !claimPendingUpload(activePendingUploads, mediaID) {
+		return util.JSONResponse{
+			Code: http.StatusConflict,
+			JSON: jsonerror.CannotOverwriteMedia("Media content is already being uploaded"),
+		}
+	}
+	defer releasePendingUpload(activePendingUploads, mediaID)
+
+	existing, err := db.GetMediaMetadata(ctx, mediaID, serverName)
+	if err != nil {
+		logger.WithError(err).Error("Failed to query media metadata")
+		return jsonerror.InternalServerError()
+	}
+	if existing != nil {
+		return util.JSONResponse{
+			Code: http.StatusConflict,
+			JSON: jsonerror.CannotOverwriteMedia("Media already has content"),
+		}
+	}
+
+	pending, err := db.GetPendingUpload(ctx, mediaID, serverName)
+	if err != nil {
+		logger.WithError(err).Error("Failed to query pending upload")
+		return jsonerror.InternalServerError()
+	}
+	if pending == nil || pending.ExpiresTimestamp <= gomatrixserverlib.AsTimestamp(time.Now()) {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Unknown or expired media ID"),
+		}
+	}
+	if pending.UserID != types.MatrixUserID(dev.UserID) {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Media was created by another user"),
+		}
+	}
+
+	r, resErr := parseAndValidateRequest(req, cfg, dev)
+	if resErr != nil {
+		return *resErr
+	}
+	r.MediaMetadata.MediaID = mediaID
+	r.Logger = r.Logger.WithField("media_id", mediaID)
+	if resErr = r.doUpload(ctx, req.Body, cfg, db, store, checker, quotas, activeThumbnailGeneration); resErr != nil {
+		return *resErr
+	}
+
+	if err = db.DeletePendingUpload(ctx, mediaID, serverName); err != nil {
+		// Not fatal, the content is stored and the reservation expires eventually
+		logger.WithError(err).Warn("Failed to remove pending upload")
+	}
+	notifyPendingUploaded(activePendingUploads, mediaID)
+
+	res := uploadPendingResponse{}
+	if r.ImageMetadata != nil {
+		res.Info = newMediaInfo(r.MediaMetadata, r.ImageMetadata)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// waitForPendingUpload waits for the content of a media ID reserved with /create.
+// Returns nil metadata if the media ID is not reserved, and errNotYetUploaded if the content
+// did not arrive within the timeout requested by the client.
+func (r *downloadRequest) waitForPendingUpload(
+	ctx context.Context,
+	req *http.Request,
+	cfg *config.MediaAPI,
+	db storage.Database,
+	activePendingUploads *types.ActivePendingUploads,
+) (*types.MediaMetadata, error) {
+	mediaID, origin := r.MediaMetadata.MediaID, r.MediaMetadata.Origin
+	pending, err := db.GetPendingUpload(ctx, mediaID, origin)
+	if err != nil {
+		return nil, fmt.Errorf("db.GetPendingUpload: %w", err)
+	}
+	if pending == nil || pending.ExpiresTimestamp <= gomatrixserverlib.AsTimestamp(time.Now()) {
+		return nil, nil
+	}
+
+	timeout := cfg.PendingUploads.MaxDownloadWait
+	if timeoutMS, perr := strconv.ParseInt(req.URL.Query().Get("timeout_ms"), 10, 64); perr == nil && timeoutMS >= 0 {
+		if requested := time.Duration(timeoutMS) * time.Millisecond; requested < timeout {
+			timeout = requested
+		}
+	}
+	r.Logger.WithField("timeout", timeout).Debug("Waiting for pending upload")
+
+	activePendingUploads.Lock()
+	uploaded, ok := activePendingUploads.MediaIDToUploaded[mediaID]
+	if !ok {
+		uploaded = make(chan struct{})
+		activePendingUploads.MediaIDToUploaded[mediaID] = uploaded
+	}
+	activePendingUploads.Unlock()
+	defer func() {
+		// Don't keep the channel around if nobody uploads the content. Other waiters
+		// still notice the upload when polling.
+		activePendingUploads.Lock()
+		if activePendingUploads.MediaIDToUploaded[mediaID] == uploaded {
+			delete(activePendingUploads.MediaIDToUploaded, mediaID)
+		}
+		activePendingUploads.Unlock()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	ticker := time.NewTicker(pendingUploadPollInterval)
+	defer ticker.Stop()
+	wait := uploaded
+	for {
+		// The content may have been uploaded before the channel was set up, so check first
+		mediaMetadata, err := db.GetMediaMetadata(ctx, mediaID, origin)
+		if err != nil {
+			return nil, fmt.Errorf("db.GetMediaMetadata: %w", err)
+		}
+		if mediaMetadata != nil {
+			return mediaMetadata, nil
+		}
+		select {
+		case <-wait:
+			// Closed channels are always ready, fall back to polling
+			wait = nil
+		case <-ticker.C:
+		case <-timer.C:
+			return nil, errNotYetUploaded
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// claimPendingUpload marks the content of the media ID as being uploaded. Returns false if
+// another request is uploading it already.
+func claimPendingUpload(activePendingUploads *types.ActivePendingUploads, mediaID types.MediaID) bool {
+	activePendingUploads.Lock()
+	defer activePendingUploads.Unlock()
+	if activePendingUploads.Uploading[mediaID] {
+		return false
+	}
+	if activePendingUploads.Uploading == nil {
+		activePendingUploads.Uploading = map[types.MediaID]bool{}
+	}
+	activePendingUploads.Uploading[mediaID] = true
+	return true
+}
+
+func releasePendingUpload(activePendingUploads *types.ActivePendingUploads, mediaID types.MediaID) {
+	activePendingUploads.Lock()
+	defer activePendingUploads.Unlock()
+	delete(activePendingUploads.Uploading, mediaID)
+}
+
+// notifyPendingUploaded wakes up the downloads waiting for the content of the media ID
+func notifyPendingUploaded(activePendingUploads *types.ActivePendingUploads, mediaID types.MediaID) {
+	activePendingUploads.Lock()
+	defer activePendingUploads.Unlock()
+	if uploaded, ok := activePendingUploads.MediaIDToUploaded[mediaID]; ok {
+		close(uploaded)
+		delete(activePendingUploads.MediaIDToUploaded, mediaID)
+	}
+}
+
+// expirePendingUploads periodically removes the reservations whose content was never uploaded
+func expirePendingUploads(db storage.Database) {
+	ticker := time.NewTicker(pendingUploadsExpiryInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		count, err := db.DeleteExpiredPendingUploads(context.Background(), gomatrixserverlib.AsTimestamp(time.Now()))
+		if err != nil {
+			log.WithError(err).Error("Failed to remove expired pending uploads")
+			continue
+		}
+		if count > 0 {
+			log.WithField("count", count).Info("Removed expired pending uploads")
+		}
+	}
+}
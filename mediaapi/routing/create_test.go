@@ -0,0 +1,110 @@
+package routing
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test/testrig"
+	"github.com/matrix-org/gomatrixserverlib"
+	log "github.com/sirupsen/logrus"
+)
+
+func Test_downloadRequest_waitForPendingUpload(t *testing.T) {
+	db := testrig.CreateMediaAPIDatabase(t)
+	cfg := &config.MediaAPI{}
+	cfg.PendingUploads.MaxDownloadWait = 5 * time.Second
+	ctx := context.Background()
+	now := gomatrixserverlib.AsTimestamp(time.Now())
+	for _, pending := range []*types.PendingUpload{
+		{MediaID: "pending", Origin: "localhost", UserID: "@alice:localhost", CreationTimestamp: now, ExpiresTimestamp: now + 60000},
+		{MediaID: "uploaded", Origin: "localhost", UserID: "@alice:localhost", CreationTimestamp: now, ExpiresTimestamp: now + 60000},
+		{MediaID: "expired", Origin: "localhost", UserID: "@alice:localhost", CreationTimestamp: now - 2000, ExpiresTimestamp: now - 1000},
+	} {
+		if err := db.StorePendingUpload(ctx, pending); err != nil {
+			t.Fatalf("unable to store pending upload: %v", err)
+		}
+	}
+	activePendingUploads := &types.ActivePendingUploads{
+		MediaIDToUploaded: map[types.MediaID]chan struct{}{},
+	}
+
+	wait := func(mediaID types.MediaID, target string) (*types.MediaMetadata, error) {
+		r := &downloadRequest{
+			MediaMetadata: &types.MediaMetadata{MediaID: mediaID, Origin: "localhost"},
+			Logger:        log.New().WithField("mediaapi", "test"),
+		}
+		req := httptest.NewRequest("GET", target, nil)
+		return r.waitForPendingUpload(ctx, req, cfg, db, activePendingUploads)
+	}
+
+	t.Run("unknown media ID", func(t *testing.T) {
+		metadata, err := wait("unknown", "/download/localhost/unknown")
+		if err != nil || metadata != nil {
+			t.Fatalf("expected no metadata and no error, got %+v (%v)", metadata, err)
+		}
+	})
+
+	t.Run("expired media ID", func(t *testing.T) {
+		metadata, err := wait("expired", "/download/localhost/expired")
+		if err != nil || metadata != nil {
+			t.Fatalf("expected no metadata and no error, got %+v (%v)", metadata, err)
+		}
+	})
+
+	t.Run("times out", func(t *testing.T) {
+		start := time.Now()
+		_, err := wait("pending", "/download/localhost/pending?timeout_ms=50")
+		if err != errNotYetUploaded {
+			t.Fatalf("expected errNotYetUploaded, got %v", err)
+		}
+		if time.Since(start) > time.Second {
+			t.Fatalf("requested timeout was not honoured")
+		}
+	})
+
+	t.Run("content is uploaded while waiting", func(t *testing.T) {
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			if err := db.StoreMediaMetadata(ctx, &types.MediaMetadata{
+				MediaID:       "uploaded",
+				Origin:        "localhost",
+				ContentType:   "text/plain",
+				FileSizeBytes: 4,
+				UploadName:    "test",
+				Base64Hash:    "abcdefgh",
+				UserID:        "@alice:localhost",
+			}); err != nil {
+				t.Errorf("unable to store media metadata: %v", err)
+			}
+			notifyPendingUploaded(activePendingUploads, "uploaded")
+		}()
+		metadata, err := wait("uploaded", "/download/localhost/uploaded")
+		if err != nil {
+			t.Fatalf("waitForPendingUpload returned error: %v", err)
+		}
+		if metadata == nil || metadata.Base64Hash != "abcdefgh" {
+			t.Fatalf("expected uploaded metadata, got %+v", metadata)
+		}
+	})
+}
+
+func Test_claimPendingUpload(t *testing.T) {
+	activePendingUploads := &types.ActivePendingUploads{}
+	if !claimPendingUpload(activePendingUploads, "media") {
+		t.Fatalf("expected first upload to claim the media ID")
+	}
+	if claimPendingUpload(activePendingUploads, "media") {
+		t.Fatalf("expected concurrent upload not to claim the media ID")
+	}
+	if !claimPendingUpload(activePendingUploads, "other") {
+		t.Fatalf("expected upload of another media ID to claim it")
+	}
+	releasePendingUpload(activePendingUploads, "media")
+	if !claimPendingUpload(activePendingUploads, "media") {
+		t.Fatalf("expected media ID to be claimable again once released")
+	}
+}
@@ -22,8 +22,6 @@ import (
 	"mime"
 	"net/http"
 	"net/url"
-	"os"
-	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -31,7 +29,9 @@ import (
 	"unicode"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/mediaapi/filestore"
 	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/scanner"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/thumbnailer"
 	"github.com/matrix-org/dendrite/mediaapi/types"
@@ -75,8 +75,11 @@ func Download(
 	mediaID types.MediaID,
 	cfg *config.MediaAPI,
 	db storage.Database,
+	store filestore.Store,
+	checker *scanner.Checker,
 	client *gomatrixserverlib.Client,
 	activeRemoteRequests *types.ActiveRemoteRequests,
+	activePendingUploads *types.ActivePendingUploads,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	isThumbnailRequest bool,
 	customFilename string,
@@ -107,11 +110,13 @@ func Download(
 			Width:        width,
 			Height:       height,
 			ResizeMethod: strings.ToLower(req.FormValue("method")),
+			Animated:     strings.ToLower(req.FormValue("animated")) == "true",
 		}
 		dReq.Logger.WithFields(log.Fields{
 			"RequestedWidth":        dReq.ThumbnailSize.Width,
 			"RequestedHeight":       dReq.ThumbnailSize.Height,
 			"RequestedResizeMethod": dReq.ThumbnailSize.ResizeMethod,
+			"RequestedAnimated":     dReq.ThumbnailSize.Animated,
 		})
 	}
 
@@ -122,9 +127,16 @@ func Download(
 	}
 
 	metadata, err := dReq.doDownload(
-		req.Context(), w, cfg, db, client,
-		activeRemoteRequests, activeThumbnailGeneration,
+		req.Context(), w, req, cfg, db, store, checker, client,
+		activeRemoteRequests, activePendingUploads, activeThumbnailGeneration,
 	)
+	if err == errNotYetUploaded {
+		dReq.jsonErrorResponse(w, util.JSONResponse{
+			Code: http.StatusGatewayTimeout,
+			JSON: jsonerror.NotYetUploaded("Media has not been uploaded yet"),
+		})
+		return
+	}
 	if err != nil {
 		// TODO: Handle the fact we might have started writing the response
 		dReq.jsonErrorResponse(w, util.JSONResponse{
@@ -203,12 +215,26 @@ func (r *downloadRequest) Validate() *util.JSONResponse {
 func (r *downloadRequest) doDownload(
 	ctx context.Context,
 	w http.ResponseWriter,
+	req *http.Request,
 	cfg *config.MediaAPI,
 	db storage.Database,
+	store filestore.Store,
+	checker *scanner.Checker,
 	client *gomatrixserverlib.Client,
 	activeRemoteRequests *types.ActiveRemoteRequests,
+	activePendingUploads *types.ActivePendingUploads,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 ) (*types.MediaMetadata, error) {
+	// quarantined media is not served to anyone, whether it is stored or not
+	quarantined, err := db.IsMediaQuarantined(ctx, r.MediaMetadata.MediaID, r.MediaMetadata.Origin)
+	if err != nil {
+		return nil, fmt.Errorf("db.IsMediaQuarantined: %w", err)
+	}
+	if quarantined {
+		r.Logger.Info("Refusing to serve quarantined media")
+		return nil, nil
+	}
+
 	// check if we have a record of the media in our database
 	mediaMetadata, err := db.GetMediaMetadata(
 		ctx, r.MediaMetadata.MediaID, r.MediaMetadata.Origin,
@@ -219,66 +245,91 @@ func (r *downloadRequest) doDownload(
 	if mediaMetadata == nil {
 		if r.MediaMetadata.Origin == cfg.Matrix.ServerName {
 			// If we do not have a record and the origin is local, the file is not found
-			return nil, nil
-		}
-		// If we do not have a record and the origin is remote, we need to fetch it and respond with that file
-		resErr := r.getRemoteFile(
-			ctx, client, cfg, db, activeRemoteRequests, activeThumbnailGeneration,
-		)
-		if resErr != nil {
-			return nil, resErr
+			// unless the media ID was reserved with /create and the content is yet to come
+			mediaMetadata, err = r.waitForPendingUpload(ctx, req, cfg, db, activePendingUploads)
+			if err != nil || mediaMetadata == nil {
+				return nil, err
+			}
+			r.MediaMetadata = mediaMetadata
+		} else {
+			// If we do not have a record and the origin is remote, we need to fetch it and respond with that file
+			resErr := r.getRemoteFile(
+				ctx, client, cfg, db, store, checker, activeRemoteRequests, activeThumbnailGeneration,
+			)
+			if resErr != nil {
+				return nil, resErr
+			}
 		}
 	} else {
 		// If we have a record, we can respond from the local file
 		r.MediaMetadata = mediaMetadata
 	}
+
+	// media stored before content scanning was enabled is scanned when it is first served
+	if r.MediaMetadata.Base64Hash != "" {
+		if err = checker.CheckStored(ctx, r.MediaMetadata.Base64Hash, store, r.Logger); err != nil {
+			if err == scanner.ErrRejected {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("checker.CheckStored: %w", err)
+		}
+	}
 	return r.respondFromLocalFile(
-		ctx, w, cfg.AbsBasePath, activeThumbnailGeneration,
+		ctx, w, req, store, activeThumbnailGeneration,
 		cfg.MaxThumbnailGenerators, db,
-		cfg.DynamicThumbnails, cfg.ThumbnailSizes,
+		cfg.DynamicThumbnails, cfg.ThumbnailSizes, &cfg.ExternalThumbnailers,
 	)
 }
 
-// respondFromLocalFile reads a file from local storage and writes it to the http.ResponseWriter
+// respondFromLocalFile reads a file from the media store and writes it to the http.ResponseWriter
+// Range, If-Range, If-None-Match and If-Modified-Since requests are honoured. Stored media never
+// changes, so the ETag is derived from the file hash and responses may be cached indefinitely.
 // If no file was found then returns nil, nil
 func (r *downloadRequest) respondFromLocalFile(
 	ctx context.Context,
 	w http.ResponseWriter,
-	absBasePath config.Path,
+	req *http.Request,
+	store filestore.Store,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 	db storage.Database,
 	dynamicThumbnails bool,
 	thumbnailSizes []config.ThumbnailSize,
+	externalThumbnailers *config.ExternalThumbnailers,
 ) (*types.MediaMetadata, error) {
-	filePath, err := fileutils.GetPathFromBase64Hash(r.MediaMetadata.Base64Hash, absBasePath)
-	if err != nil {
-		return nil, fmt.Errorf("fileutils.GetPathFromBase64Hash: %w", err)
-	}
-	file, err := os.Open(filePath)
-	defer file.Close() // nolint: errcheck, staticcheck, megacheck
+	fileKey, err := filestore.MediaKey(r.MediaMetadata.Base64Hash)
 	if err != nil {
-		return nil, fmt.Errorf("os.Open: %w", err)
+		return nil, fmt.Errorf("filestore.MediaKey: %w", err)
 	}
-	stat, err := file.Stat()
+	size, err := store.Stat(ctx, fileKey)
 	if err != nil {
-		return nil, fmt.Errorf("file.Stat: %w", err)
+		return nil, fmt.Errorf("store.Stat: %w", err)
 	}
 
-	if r.MediaMetadata.FileSizeBytes > 0 && int64(r.MediaMetadata.FileSizeBytes) != stat.Size() {
+	if r.MediaMetadata.FileSizeBytes > 0 && int64(r.MediaMetadata.FileSizeBytes) != size {
 		r.Logger.WithFields(log.Fields{
 			"fileSizeDatabase": r.MediaMetadata.FileSizeBytes,
-			"fileSizeDisk":     stat.Size(),
+			"fileSizeDisk":     size,
 		}).Warn("File size in database and on-disk differ.")
 		return nil, errors.New("file size in database and on-disk differ")
 	}
 
-	var responseFile *os.File
+	file, err := store.Open(ctx, fileKey)
+	if err != nil {
+		return nil, fmt.Errorf("store.Open: %w", err)
+	}
+	defer file.Close() // nolint: errcheck
+
+	var responseFile io.ReadSeeker
 	var responseMetadata *types.MediaMetadata
+	etag := string(r.MediaMetadata.Base64Hash)
 	if r.IsThumbnailRequest {
+		if !thumbnailer.MayBeAnimated(r.MediaMetadata.ContentType) {
+			r.ThumbnailSize.Animated = false
+		}
 		thumbFile, thumbMetadata, resErr := r.getThumbnailFile(
-			ctx, types.Path(filePath), activeThumbnailGeneration, maxThumbnailGenerators,
-			db, dynamicThumbnails, thumbnailSizes,
+			ctx, store, activeThumbnailGeneration, maxThumbnailGenerators,
+			db, dynamicThumbnails, thumbnailSizes, externalThumbnailers,
 		)
 		if thumbFile != nil {
 			defer thumbFile.Close() // nolint: errcheck
@@ -299,6 +350,14 @@ func (r *downloadRequest) respondFromLocalFile(
 			r.Logger.Trace("Responding with thumbnail")
 			responseFile = thumbFile
 			responseMetadata = thumbMetadata.MediaMetadata
+			// Thumbnails are derived from the original file, so they can't change either
+			etag = fmt.Sprintf("%s-%dx%d-%s", etag,
+				thumbMetadata.ThumbnailSize.Width, thumbMetadata.ThumbnailSize.Height,
+				thumbMetadata.ThumbnailSize.ResizeMethod,
+			)
+			if thumbMetadata.ThumbnailSize.Animated {
+				etag += "-animated"
+			}
 		}
 	} else {
 		r.Logger.WithFields(log.Fields{
@@ -314,8 +373,10 @@ func (r *downloadRequest) respondFromLocalFile(
 		}
 	}
 
+	// Content-Length is set by http.ServeContent, depending on the requested range
 	w.Header().Set("Content-Type", string(responseMetadata.ContentType))
-	w.Header().Set("Content-Length", strconv.FormatInt(int64(responseMetadata.FileSizeBytes), 10))
+	w.Header().Set("ETag", `"`+etag+`"`)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
 	contentSecurityPolicy := "default-src 'none';" +
 		" script-src 'none';" +
 		" plugin-types application/pdf;" +
@@ -323,9 +384,7 @@ func (r *downloadRequest) respondFromLocalFile(
 		" object-src 'self';"
 	w.Header().Set("Content-Security-Policy", contentSecurityPolicy)
 
-	if _, err := io.Copy(w, responseFile); err != nil {
-		return nil, fmt.Errorf("io.Copy: %w", err)
-	}
+	http.ServeContent(w, req, "", r.MediaMetadata.CreationTimestamp.Time(), responseFile)
 	return responseMetadata, nil
 }
 
@@ -394,19 +453,20 @@ func (r *downloadRequest) addDownloadFilenameToHeaders(
 // If no thumbnail was found then returns nil, nil, nil
 func (r *downloadRequest) getThumbnailFile(
 	ctx context.Context,
-	filePath types.Path,
+	store filestore.Store,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 	db storage.Database,
 	dynamicThumbnails bool,
 	thumbnailSizes []config.ThumbnailSize,
-) (*os.File, *types.ThumbnailMetadata, error) {
+	externalThumbnailers *config.ExternalThumbnailers,
+) (io.ReadSeekCloser, *types.ThumbnailMetadata, error) {
 	var thumbnail *types.ThumbnailMetadata
 	var err error
 
 	if dynamicThumbnails {
 		thumbnail, err = r.generateThumbnail(
-			ctx, filePath, r.ThumbnailSize, activeThumbnailGeneration,
+			ctx, store, r.ThumbnailSize, externalThumbnailers, activeThumbnailGeneration,
 			maxThumbnailGenerators, db,
 		)
 		if err != nil {
@@ -435,9 +495,10 @@ func (r *downloadRequest) getThumbnailFile(
 				"Width":        thumbnailSize.Width,
 				"Height":       thumbnailSize.Height,
 				"ResizeMethod": thumbnailSize.ResizeMethod,
+				"Animated":     thumbnailSize.Animated,
 			}).Debug("Pre-generating thumbnail for immediate response.")
 			thumbnail, err = r.generateThumbnail(
-				ctx, filePath, *thumbnailSize, activeThumbnailGeneration,
+				ctx, store, *thumbnailSize, externalThumbnailers, activeThumbnailGeneration,
 				maxThumbnailGenerators, db,
 			)
 			if err != nil {
@@ -452,31 +513,33 @@ func (r *downloadRequest) getThumbnailFile(
 		"Width":         thumbnail.ThumbnailSize.Width,
 		"Height":        thumbnail.ThumbnailSize.Height,
 		"ResizeMethod":  thumbnail.ThumbnailSize.ResizeMethod,
+		"Animated":      thumbnail.ThumbnailSize.Animated,
 		"FileSizeBytes": thumbnail.MediaMetadata.FileSizeBytes,
 		"ContentType":   thumbnail.MediaMetadata.ContentType,
 	})
-	thumbPath := string(thumbnailer.GetThumbnailPath(types.Path(filePath), thumbnail.ThumbnailSize))
-	thumbFile, err := os.Open(string(thumbPath))
+	thumbKey, err := filestore.ThumbnailKey(r.MediaMetadata.Base64Hash, thumbnail.ThumbnailSize)
 	if err != nil {
-		thumbFile.Close() // nolint: errcheck
-		return nil, nil, fmt.Errorf("os.Open: %w", err)
+		return nil, nil, fmt.Errorf("filestore.ThumbnailKey: %w", err)
 	}
-	thumbStat, err := thumbFile.Stat()
+	thumbSize, err := store.Stat(ctx, thumbKey)
 	if err != nil {
-		thumbFile.Close() // nolint: errcheck
-		return nil, nil, fmt.Errorf("thumbFile.Stat: %w", err)
+		return nil, nil, fmt.Errorf("store.Stat: %w", err)
 	}
-	if types.FileSizeBytes(thumbStat.Size()) != thumbnail.MediaMetadata.FileSizeBytes {
-		thumbFile.Close() // nolint: errcheck
+	if types.FileSizeBytes(thumbSize) != thumbnail.MediaMetadata.FileSizeBytes {
 		return nil, nil, errors.New("thumbnail file sizes on disk and in database differ")
 	}
+	thumbFile, err := store.Open(ctx, thumbKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("store.Open: %w", err)
+	}
 	return thumbFile, thumbnail, nil
 }
 
 func (r *downloadRequest) generateThumbnail(
 	ctx context.Context,
-	filePath types.Path,
+	store filestore.Store,
 	thumbnailSize types.ThumbnailSize,
+	externalThumbnailers *config.ExternalThumbnailers,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 	db storage.Database,
@@ -485,9 +548,10 @@ func (r *downloadRequest) generateThumbnail(
 		"Width":        thumbnailSize.Width,
 		"Height":       thumbnailSize.Height,
 		"ResizeMethod": thumbnailSize.ResizeMethod,
+		"Animated":     thumbnailSize.Animated,
 	})
 	busy, err := thumbnailer.GenerateThumbnail(
-		ctx, filePath, thumbnailSize, r.MediaMetadata,
+		ctx, store, thumbnailSize, externalThumbnailers, r.MediaMetadata,
 		activeThumbnailGeneration, maxThumbnailGenerators, db, r.Logger,
 	)
 	if err != nil {
@@ -499,11 +563,22 @@ func (r *downloadRequest) generateThumbnail(
 	var thumbnail *types.ThumbnailMetadata
 	thumbnail, err = db.GetThumbnail(
 		ctx, r.MediaMetadata.MediaID, r.MediaMetadata.Origin,
-		thumbnailSize.Width, thumbnailSize.Height, thumbnailSize.ResizeMethod,
+		thumbnailSize.Width, thumbnailSize.Height, thumbnailSize.ResizeMethod, thumbnailSize.Animated,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("db.GetThumbnail: %w", err)
 	}
+	if thumbnail == nil && thumbnailSize.Animated {
+		// the source isn't animated, so a still thumbnail was generated instead
+		thumbnailSize.Animated = false
+		thumbnail, err = db.GetThumbnail(
+			ctx, r.MediaMetadata.MediaID, r.MediaMetadata.Origin,
+			thumbnailSize.Width, thumbnailSize.Height, thumbnailSize.ResizeMethod, thumbnailSize.Animated,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("db.GetThumbnail: %w", err)
+		}
+	}
 	return thumbnail, nil
 }
 
@@ -516,6 +591,8 @@ func (r *downloadRequest) getRemoteFile(
 	client *gomatrixserverlib.Client,
 	cfg *config.MediaAPI,
 	db storage.Database,
+	store filestore.Store,
+	checker *scanner.Checker,
 	activeRemoteRequests *types.ActiveRemoteRequests,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 ) (errorResponse error) {
@@ -549,9 +626,9 @@ func (r *downloadRequest) getRemoteFile(
 		if mediaMetadata == nil {
 			// If we do not have a record, we need to fetch the remote file first and then respond from the local file
 			err := r.fetchRemoteFileAndStoreMetadata(
-				ctx, client,
+				ctx, client, store, checker,
 				cfg.AbsBasePath, cfg.MaxFileSizeBytes, db,
-				cfg.ThumbnailSizes, activeThumbnailGeneration,
+				cfg.ThumbnailSizes, &cfg.ExternalThumbnailers, activeThumbnailGeneration,
 				cfg.MaxThumbnailGenerators,
 			)
 			if err != nil {
@@ -616,44 +693,25 @@ func (r *downloadRequest) broadcastMediaMetadata(activeRemoteRequests *types.Act
 func (r *downloadRequest) fetchRemoteFileAndStoreMetadata(
 	ctx context.Context,
 	client *gomatrixserverlib.Client,
+	store filestore.Store,
+	checker *scanner.Checker,
 	absBasePath config.Path,
 	maxFileSizeBytes config.FileSizeBytes,
 	db storage.Database,
 	thumbnailSizes []config.ThumbnailSize,
+	externalThumbnailers *config.ExternalThumbnailers,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 ) error {
-	finalPath, duplicate, err := r.fetchRemoteFile(
-		ctx, client, absBasePath, maxFileSizeBytes,
-	)
-	if err != nil {
+	if _, _, err := r.fetchRemoteFile(
+		ctx, client, store, checker, absBasePath, maxFileSizeBytes, db,
+	); err != nil {
 		return err
 	}
 
-	r.Logger.WithFields(log.Fields{
-		"Base64Hash":    r.MediaMetadata.Base64Hash,
-		"UploadName":    r.MediaMetadata.UploadName,
-		"FileSizeBytes": r.MediaMetadata.FileSizeBytes,
-		"ContentType":   r.MediaMetadata.ContentType,
-	}).Debug("Storing file metadata to media repository database")
-
-	// FIXME: timeout db request
-	if err := db.StoreMediaMetadata(ctx, r.MediaMetadata); err != nil {
-		// If the file is a duplicate (has the same hash as an existing file) then
-		// there is valid metadata in the database for that file. As such we only
-		// remove the file if it is not a duplicate.
-		if !duplicate {
-			finalDir := filepath.Dir(string(finalPath))
-			fileutils.RemoveDir(types.Path(finalDir), r.Logger)
-		}
-		// NOTE: It should really not be possible to fail the uniqueness test here so
-		// there is no need to handle that separately
-		return errors.New("failed to store file metadata in DB")
-	}
-
 	go func() {
 		busy, err := thumbnailer.GenerateThumbnails(
-			context.Background(), finalPath, thumbnailSizes, r.MediaMetadata,
+			context.Background(), store, thumbnailSizes, externalThumbnailers, r.MediaMetadata,
 			activeThumbnailGeneration, maxThumbnailGenerators, db, r.Logger,
 		)
 		if err != nil {
@@ -714,9 +772,12 @@ func (r *downloadRequest) GetContentLengthAndReader(contentLengthHeader string,
 func (r *downloadRequest) fetchRemoteFile(
 	ctx context.Context,
 	client *gomatrixserverlib.Client,
+	store filestore.Store,
+	checker *scanner.Checker,
 	absBasePath config.Path,
 	maxFileSizeBytes config.FileSizeBytes,
-) (types.Path, bool, error) {
+	db storage.Database,
+) (string, bool, error) {
 	r.Logger.Debug("Fetching remote file")
 
 	// create request for remote file
@@ -783,15 +844,28 @@ func (r *downloadRequest) fetchRemoteFile(
 	r.MediaMetadata.FileSizeBytes = types.FileSizeBytes(bytesWritten)
 	r.MediaMetadata.Base64Hash = hash
 
-	// The database is the source of truth so we need to have moved the file first
-	finalPath, duplicate, err := fileutils.MoveFileWithHashCheck(tmpDir, r.MediaMetadata, absBasePath, r.Logger)
+	// Remote media is scanned before it enters the store, like uploads
+	if err = checker.CheckTempFile(ctx, hash, tmpDir, r.Logger); err != nil {
+		fileutils.RemoveDir(tmpDir, r.Logger)
+		return "", false, err
+	}
+
+	r.Logger.WithFields(log.Fields{
+		"Base64Hash":    r.MediaMetadata.Base64Hash,
+		"UploadName":    r.MediaMetadata.UploadName,
+		"FileSizeBytes": r.MediaMetadata.FileSizeBytes,
+		"ContentType":   r.MediaMetadata.ContentType,
+	}).Debug("Storing file and its metadata to media repository")
+
+	// The database is the source of truth so the file is stored first, then its metadata
+	// FIXME: timeout db request
+	finalKey, duplicate, err := fileutils.StoreFileAndMetadata(ctx, store, db, tmpDir, r.MediaMetadata, r.Logger)
 	if err != nil {
-		return "", false, fmt.Errorf("fileutils.MoveFileWithHashCheck: %w", err)
+		return "", false, fmt.Errorf("fileutils.StoreFileAndMetadata: %w", err)
 	}
 	if duplicate {
-		r.Logger.WithField("dst", finalPath).Trace("File was stored previously - discarding duplicate")
-		// Continue on to store the metadata in the database
+		r.Logger.WithField("dst", finalKey).Trace("File was stored previously - discarding duplicate")
 	}
 
-	return types.Path(finalPath), duplicate, nil
+	return finalKey, duplicate, nil
 }
@@ -0,0 +1,113 @@
+package routing
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/mediaapi/filestore"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	log "github.com/sirupsen/logrus"
+)
+
+func Test_downloadRequest_respondFromLocalFile(t *testing.T) {
+	basePath := config.Path(t.TempDir())
+	content := []byte("0123456789")
+	metadata := &types.MediaMetadata{
+		MediaID:           "testing",
+		Origin:            "localhost",
+		ContentType:       "text/plain",
+		FileSizeBytes:     types.FileSizeBytes(len(content)),
+		CreationTimestamp: 1600000000000,
+		Base64Hash:        "abcdefgh",
+	}
+	store := filestore.NewFileSystem(basePath)
+	key, err := filestore.MediaKey(metadata.Base64Hash)
+	if err != nil {
+		t.Fatalf("failed to get media key: %v", err)
+	}
+	if err = store.Put(context.Background(), key, bytes.NewReader(content), int64(len(content))); err != nil {
+		t.Fatalf("failed to store file: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "whole file",
+			wantCode: http.StatusOK,
+			wantBody: "0123456789",
+		},
+		{
+			name:     "range",
+			headers:  map[string]string{"Range": "bytes=2-5"},
+			wantCode: http.StatusPartialContent,
+			wantBody: "2345",
+		},
+		{
+			name:     "open ended range",
+			headers:  map[string]string{"Range": "bytes=7-"},
+			wantCode: http.StatusPartialContent,
+			wantBody: "789",
+		},
+		{
+			name:     "unsatisfiable range",
+			headers:  map[string]string{"Range": "bytes=20-30"},
+			wantCode: http.StatusRequestedRangeNotSatisfiable,
+		},
+		{
+			name:     "matching etag",
+			headers:  map[string]string{"If-None-Match": `"abcdefgh"`},
+			wantCode: http.StatusNotModified,
+		},
+		{
+			name:     "different etag",
+			headers:  map[string]string{"If-None-Match": `"other"`},
+			wantCode: http.StatusOK,
+			wantBody: "0123456789",
+		},
+		{
+			name:     "if-range with matching etag",
+			headers:  map[string]string{"Range": "bytes=0-1", "If-Range": `"abcdefgh"`},
+			wantCode: http.StatusPartialContent,
+			wantBody: "01",
+		},
+		{
+			name:     "if-range with stale etag",
+			headers:  map[string]string{"Range": "bytes=0-1", "If-Range": `"other"`},
+			wantCode: http.StatusOK,
+			wantBody: "0123456789",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &downloadRequest{
+				MediaMetadata: metadata,
+				Logger:        log.New().WithField("mediaapi", "test"),
+			}
+			req := httptest.NewRequest(http.MethodGet, "/download/localhost/testing", nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			if _, err := r.respondFromLocalFile(context.Background(), w, req, store, nil, 0, nil, false, nil, nil); err != nil {
+				t.Fatalf("respondFromLocalFile returned error: %v", err)
+			}
+			if w.Code != tt.wantCode {
+				t.Fatalf("expected status %d, got %d", tt.wantCode, w.Code)
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Fatalf("expected body %q, got %q", tt.wantBody, w.Body.String())
+			}
+			if got := w.Header().Get("ETag"); got != `"abcdefgh"` {
+				t.Fatalf("expected ETag %q, got %q", `"abcdefgh"`, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/mediaapi/filestore"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/imagemeta"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// mediaInfo has the same shape as the info object of m.image events, so that clients
+// can copy it into the events they send.
+// https://spec.matrix.org/v1.2/client-server-api/#mimage
+type mediaInfo struct {
+	MimeType types.ContentType   `json:"mimetype,omitempty"`
+	Size     types.FileSizeBytes `json:"size"`
+	Width    int                 `json:"w,omitempty"`
+	Height   int                 `json:"h,omitempty"`
+	// https://github.com/matrix-org/matrix-spec-proposals/pull/2448
+	Blurhash string `json:"xyz.amorgan.blurhash,omitempty"`
+	// The EXIF orientation of the stored image. w and h are the size as displayed,
+	// i.e. swapped for images which are stored rotated.
+	Orientation int `json:"orientation,omitempty"`
+}
+
+func newMediaInfo(metadata *types.MediaMetadata, image *types.ImageMetadata) *mediaInfo {
+	info := &mediaInfo{
+		MimeType: metadata.ContentType,
+		Size:     metadata.FileSizeBytes,
+	}
+	if image != nil {
+		info.Width = image.Width
+		info.Height = image.Height
+		info.Blurhash = image.Blurhash
+		info.Orientation = image.Orientation
+	}
+	return info
+}
+
+// GetMediaMetadata implements GET /metadata/{serverName}/{mediaId}
+// Responds with the size, MIME type and for images the dimensions and blurhash of the media.
+// Remote media is not fetched, so the metadata is only known once the media was downloaded
+// through this server. The image metadata of media stored before it was extracted on upload
+// is extracted on the first request.
+func GetMediaMetadata(
+	req *http.Request,
+	cfg *config.MediaAPI,
+	db storage.Database,
+	store filestore.Store,
+	origin gomatrixserverlib.ServerName,
+	mediaID types.MediaID,
+) util.JSONResponse {
+	ctx := req.Context()
+	logger := util.GetLogger(ctx).WithFields(log.Fields{
+		"Origin":  origin,
+		"MediaID": mediaID,
+	})
+	notFound := util.JSONResponse{
+		Code: http.StatusNotFound,
+		JSON: jsonerror.NotFound("File not found"),
+	}
+
+	quarantined, err := db.IsMediaQuarantined(ctx, mediaID, origin)
+	if err != nil {
+		logger.WithError(err).Error("Failed to query quarantined media")
+		return jsonerror.InternalServerError()
+	}
+	if quarantined {
+		return notFound
+	}
+	metadata, err := db.GetMediaMetadata(ctx, mediaID, origin)
+	if err != nil {
+		logger.WithError(err).Error("Failed to query media metadata")
+		return jsonerror.InternalServerError()
+	}
+	if metadata == nil {
+		return notFound
+	}
+
+	image, err := db.GetImageMetadata(ctx, metadata.Base64Hash)
+	if err != nil {
+		logger.WithError(err).Error("Failed to query image metadata")
+		return jsonerror.InternalServerError()
+	}
+	if image == nil && cfg.ImageMetadata.Enabled {
+		image = extractStoredImageMetadata(ctx, &cfg.ImageMetadata, db, store, metadata.Base64Hash, logger)
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: newMediaInfo(metadata, image),
+	}
+}
+
+// extractImageMetadata reads the size and blurhash of an image. Returns nil if the file is
+// not an image. The metadata is not essential to storing or serving the file, so failures
+// are only logged.
+func extractImageMetadata(
+	file io.ReadSeeker,
+	cfg *config.ImageMetadata,
+	hash types.Base64Hash,
+	logger *log.Entry,
+) *types.ImageMetadata {
+	image, err := imagemeta.Extract(file, cfg.MaxPixels)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to extract image metadata")
+		return nil
+	}
+	if image != nil {
+		image.Base64Hash = hash
+	}
+	return image
+}
+
+// extractTempImageMetadata extracts the image metadata of a file written by fileutils.WriteTempFile.
+func extractTempImageMetadata(
+	cfg *config.ImageMetadata,
+	tmpDir types.Path,
+	hash types.Base64Hash,
+	logger *log.Entry,
+) *types.ImageMetadata {
+	file, err := os.Open(filepath.Join(string(tmpDir), "content"))
+	if err != nil {
+		logger.WithError(err).Warn("Failed to open temporary file")
+		return nil
+	}
+	defer file.Close() // nolint: errcheck
+	return extractImageMetadata(file, cfg, hash, logger)
+}
+
+// extractStoredImageMetadata extracts and stores the image metadata of a file in the media store.
+func extractStoredImageMetadata(
+	ctx context.Context,
+	cfg *config.ImageMetadata,
+	db storage.Database,
+	store filestore.Store,
+	hash types.Base64Hash,
+	logger *log.Entry,
+) *types.ImageMetadata {
+	key, err := filestore.MediaKey(hash)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to get key of stored file")
+		return nil
+	}
+	file, err := store.Open(ctx, key)
+	if err != nil {
+		logger.WithError(err).WithField("key", key).Warn("Failed to open stored file")
+		return nil
+	}
+	defer file.Close() // nolint: errcheck
+	image := extractImageMetadata(file, cfg, hash, logger)
+	if image != nil {
+		if err = db.StoreImageMetadata(ctx, image); err != nil {
+			logger.WithError(err).Warn("Failed to store image metadata")
+		}
+	}
+	return image
+}
+
+// stripTempFileMetadata removes the EXIF, XMP and IPTC metadata from a JPEG image written by
+// fileutils.WriteTempFile. As this changes the content, the stripped image is written to a
+// new temporary file, whose hash, size and directory are returned. Other files are returned
+// unchanged.
+func stripTempFileMetadata(
+	ctx context.Context,
+	absBasePath config.Path,
+	hash types.Base64Hash,
+	size types.FileSizeBytes,
+	tmpDir types.Path,
+	logger *log.Entry,
+) (types.Base64Hash, types.FileSizeBytes, types.Path, error) {
+	file, err := os.Open(filepath.Join(string(tmpDir), "content"))
+	if err != nil {
+		return "", 0, "", err
+	}
+	defer file.Close() // nolint: errcheck
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(file, header); err != nil || !imagemeta.IsJPEG(header) {
+		return hash, size, tmpDir, nil
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return "", 0, "", err
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(imagemeta.StripMetadata(file, writer))
+	}()
+	strippedHash, strippedSize, strippedDir, err := fileutils.WriteTempFile(ctx, reader, absBasePath)
+	// unblock the goroutine if writing the temporary file failed
+	reader.Close() // nolint: errcheck
+	if err != nil {
+		return "", 0, "", err
+	}
+	fileutils.RemoveDir(tmpDir, logger)
+	return strippedHash, strippedSize, strippedDir, nil
+}
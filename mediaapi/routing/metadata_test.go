@@ -0,0 +1,85 @@
+package routing
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/mediaapi/filestore"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test/testrig"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestMediaMetadata(t *testing.T) {
+	db := testrig.CreateMediaAPIDatabase(t)
+	basePath := config.Path(t.TempDir())
+	store := filestore.NewFileSystem(basePath)
+	cfg := &config.MediaAPI{
+		Matrix:        &config.Global{ServerName: "localhost"},
+		AbsBasePath:   basePath,
+		ImageMetadata: config.ImageMetadata{Enabled: true},
+	}
+	ctx := context.Background()
+	req := httptest.NewRequest(http.MethodGet, "/metadata", nil)
+
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewGray(image.Rect(0, 0, 8, 4))); err != nil {
+		t.Fatal(err)
+	}
+	r := &uploadRequest{
+		MediaMetadata: &types.MediaMetadata{
+			MediaID:     "uploaded",
+			Origin:      "localhost",
+			ContentType: "image/png",
+		},
+		Logger: log.New().WithField("mediaapi", "test"),
+	}
+	if resErr := r.doUpload(ctx, bytes.NewReader(img.Bytes()), cfg, db, store, nil, nil, nil); resErr != nil {
+		t.Fatalf("doUpload failed: %+v", resErr)
+	}
+	if r.ImageMetadata == nil || r.ImageMetadata.Width != 8 || r.ImageMetadata.Height != 4 || r.ImageMetadata.Blurhash == "" {
+		t.Fatalf("unexpected image metadata after upload: %+v", r.ImageMetadata)
+	}
+
+	res := GetMediaMetadata(req, cfg, db, store, "localhost", "uploaded")
+	info, ok := res.JSON.(*mediaInfo)
+	if res.Code != http.StatusOK || !ok || info.Width != 8 || info.Height != 4 || info.Blurhash != r.ImageMetadata.Blurhash || info.MimeType != "image/png" {
+		t.Fatalf("unexpected metadata response %d %+v", res.Code, res.JSON)
+	}
+
+	// media stored before image metadata was extracted on upload
+	img.Reset()
+	if err := png.Encode(&img, image.NewGray(image.Rect(0, 0, 2, 6))); err != nil {
+		t.Fatal(err)
+	}
+	key, _ := filestore.MediaKey("remotehash")
+	if err := store.Put(ctx, key, bytes.NewReader(img.Bytes()), int64(img.Len())); err != nil {
+		t.Fatalf("unable to store file: %v", err)
+	}
+	if err := db.StoreMediaMetadata(ctx, &types.MediaMetadata{
+		MediaID:       "remote",
+		Origin:        "remote",
+		ContentType:   "image/png",
+		FileSizeBytes: types.FileSizeBytes(img.Len()),
+		Base64Hash:    "remotehash",
+	}); err != nil {
+		t.Fatalf("unable to store media metadata: %v", err)
+	}
+	res = GetMediaMetadata(req, cfg, db, store, "remote", "remote")
+	if info, ok = res.JSON.(*mediaInfo); res.Code != http.StatusOK || !ok || info.Width != 2 || info.Height != 6 {
+		t.Fatalf("unexpected metadata response %d %+v", res.Code, res.JSON)
+	}
+	if stored, err := db.GetImageMetadata(ctx, "remotehash"); err != nil || stored == nil {
+		t.Fatalf("expected image metadata to be stored, got %+v (%v)", stored, err)
+	}
+
+	if res = GetMediaMetadata(req, cfg, db, store, "localhost", "unknown"); res.Code != http.StatusNotFound {
+		t.Fatalf("expected unknown media not to be found, got %d", res.Code)
+	}
+}
@@ -0,0 +1,399 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/mediaapi/filestore"
+	"github.com/matrix-org/dendrite/mediaapi/scanner"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/html"
+)
+
+// The maximum number of redirects followed when fetching a page or its image
+const maxPreviewRedirects = 5
+
+// urlPreviewer fetches pages for /preview_url. Its HTTP client refuses to connect to
+// blacklisted IP addresses. The check is done on the resolved address at connection time,
+// so neither redirects nor DNS rebinding can be used to reach the internal network.
+type urlPreviewer struct {
+	cfg     *config.MediaAPI
+	client  *http.Client
+	checker *scanner.Checker
+}
+
+func newURLPreviewer(cfg *config.MediaAPI, checker *scanner.Checker) (*urlPreviewer, error) {
+	blacklist, err := parseIPRanges(cfg.URLPreviews.IPRangeBlacklist)
+	if err != nil {
+		return nil, fmt.Errorf("ip_range_blacklist: %w", err)
+	}
+	whitelist, err := parseIPRanges(cfg.URLPreviews.IPRangeWhitelist)
+	if err != nil {
+		return nil, fmt.Errorf("ip_range_whitelist: %w", err)
+	}
+
+	dialer := &net.Dialer{
+		Timeout: cfg.URLPreviews.FetchTimeout,
+		Control: func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || isIPBlocked(ip, blacklist, whitelist) {
+				return fmt.Errorf("connecting to %s is not allowed", host)
+			}
+			return nil
+		},
+	}
+
+	return &urlPreviewer{
+		cfg:     cfg,
+		checker: checker,
+		client: &http.Client{
+			Timeout: cfg.URLPreviews.FetchTimeout,
+			// No proxy: connections made through a proxy would bypass the blacklist
+			Transport: &http.Transport{
+				DialContext:         dialer.DialContext,
+				TLSHandshakeTimeout: cfg.URLPreviews.FetchTimeout,
+			},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= maxPreviewRedirects {
+					return fmt.Errorf("stopped after %d redirects", maxPreviewRedirects)
+				}
+				return nil
+			},
+		},
+	}, nil
+}
+
+func parseIPRanges(cidrs []string) ([]*net.IPNet, error) {
+	ranges := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, ipnet)
+	}
+	return ranges, nil
+}
+
+// isIPBlocked returns true if the IP is in the blacklist and not in the whitelist
+func isIPBlocked(ip net.IP, blacklist, whitelist []*net.IPNet) bool {
+	for _, ipnet := range whitelist {
+		if ipnet.Contains(ip) {
+			return false
+		}
+	}
+	for _, ipnet := range blacklist {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheBucketStart returns the start of the cache bucket the timestamp falls into.
+// Buckets shorter than a millisecond disable bucketing.
+func cacheBucketStart(ts gomatrixserverlib.Timestamp, bucket time.Duration) gomatrixserverlib.Timestamp {
+	bucketMS := gomatrixserverlib.Timestamp(bucket / time.Millisecond)
+	if bucketMS == 0 {
+		return ts
+	}
+	return ts - ts%bucketMS
+}
+
+// PreviewURL implements GET /preview_url
+// The page is fetched, its OpenGraph metadata extracted and the preview image stored in the media
+// repository. Responses are cached per URL and time bucket, so that repeated requests for the
+// same link, i.e. by every member of a room, don't hit the remote site.
+func PreviewURL(
+	req *http.Request,
+	cfg *config.MediaAPI,
+	db storage.Database,
+	store filestore.Store,
+	previewer *urlPreviewer,
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+) util.JSONResponse {
+	logger := util.GetLogger(req.Context())
+
+	rawURL := req.URL.Query().Get("url")
+	if rawURL == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("Missing url parameter"),
+		}
+	}
+	pageURL, err := url.Parse(rawURL)
+	if err != nil || (pageURL.Scheme != "http" && pageURL.Scheme != "https") || pageURL.Host == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("url must be an absolute http or https URL"),
+		}
+	}
+
+	ts := gomatrixserverlib.AsTimestamp(time.Now())
+	if tsParam := req.URL.Query().Get("ts"); tsParam != "" {
+		var parsed int64
+		if parsed, err = strconv.ParseInt(tsParam, 10, 64); err != nil || parsed < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("ts must be a timestamp in milliseconds"),
+			}
+		}
+		ts = gomatrixserverlib.Timestamp(parsed)
+	}
+	bucketTS := cacheBucketStart(ts, cfg.URLPreviews.CacheBucket)
+
+	cached, err := db.GetURLPreview(req.Context(), rawURL, bucketTS)
+	if err != nil {
+		logger.WithError(err).Error("Failed to query URL preview cache")
+		return jsonerror.InternalServerError()
+	}
+	if cached != nil {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: json.RawMessage(cached.Response),
+		}
+	}
+
+	og, err := previewer.preview(req.Context(), pageURL, db, store, activeThumbnailGeneration)
+	if err != nil {
+		logger.WithError(err).WithField("url", rawURL).Warn("Failed to generate URL preview")
+		return util.JSONResponse{
+			Code: http.StatusBadGateway,
+			JSON: jsonerror.Unknown("Failed to fetch the URL"),
+		}
+	}
+
+	response, err := json.Marshal(og)
+	if err != nil {
+		logger.WithError(err).Error("Failed to marshal URL preview")
+		return jsonerror.InternalServerError()
+	}
+	if err = db.StoreURLPreview(req.Context(), &types.URLPreview{
+		URL:             rawURL,
+		BucketTimestamp: bucketTS,
+		Response:        response,
+	}); err != nil {
+		// Not fatal, the preview is still returned
+		logger.WithError(err).Warn("Failed to cache URL preview")
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: json.RawMessage(response),
+	}
+}
+
+// preview fetches the page and builds the OpenGraph object for it.
+// If the URL points directly to an image, the image itself becomes the preview.
+func (p *urlPreviewer) preview(
+	ctx context.Context,
+	pageURL *url.URL,
+	db storage.Database,
+	store filestore.Store,
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+) (map[string]interface{}, error) {
+	resp, err := p.fetch(ctx, pageURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	og := map[string]interface{}{}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch {
+	case strings.HasPrefix(mediaType, "image/"):
+		if err = p.storeImage(ctx, resp, db, store, activeThumbnailGeneration, og); err != nil {
+			return nil, err
+		}
+		return og, nil
+	case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+	default:
+		return nil, fmt.Errorf("unsupported content type %q", mediaType)
+	}
+
+	for key, value := range parseOpenGraph(io.LimitReader(resp.Body, int64(p.cfg.URLPreviews.MaxPageSizeBytes))) {
+		og[key] = value
+	}
+	if _, ok := og["og:url"]; !ok {
+		og["og:url"] = resp.Request.URL.String()
+	}
+
+	// Replace the remote image with a copy in our media repository. Failing to do so only
+	// means there is no image in the preview.
+	imageURL, _ := og["og:image"].(string)
+	delete(og, "og:image")
+	if imageURL == "" {
+		return og, nil
+	}
+	imageRef, err := resp.Request.URL.Parse(imageURL)
+	if err != nil || (imageRef.Scheme != "http" && imageRef.Scheme != "https") {
+		return og, nil
+	}
+	imageResp, err := p.fetch(ctx, imageRef)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).WithField("url", imageRef.String()).Debug("Failed to fetch preview image")
+		return og, nil
+	}
+	defer imageResp.Body.Close() // nolint: errcheck
+	if mediaType, _, _ = mime.ParseMediaType(imageResp.Header.Get("Content-Type")); !strings.HasPrefix(mediaType, "image/") {
+		return og, nil
+	}
+	if err = p.storeImage(ctx, imageResp, db, store, activeThumbnailGeneration, og); err != nil {
+		util.GetLogger(ctx).WithError(err).WithField("url", imageRef.String()).Debug("Failed to store preview image")
+	}
+	return og, nil
+}
+
+func (p *urlPreviewer) fetch(ctx context.Context, u *url.URL) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/html, application/xhtml+xml, image/*;q=0.9, */*;q=0.1")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close() // nolint: errcheck
+		return nil, fmt.Errorf("remote responded with %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// storeImage uploads the image in the response to the media repository the same way as
+// a user upload, thumbnails included, and adds its mxc:// URI to the OpenGraph object.
+// The server fetched the image, so it is stored without a user ID: it doesn't count
+// towards the quota of the user who asked for the preview and isn't listed as theirs.
+func (p *urlPreviewer) storeImage(
+	ctx context.Context,
+	resp *http.Response,
+	db storage.Database,
+	store filestore.Store,
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+	og map[string]interface{},
+) error {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	r := &uploadRequest{
+		MediaMetadata: &types.MediaMetadata{
+			Origin:        p.cfg.Matrix.ServerName,
+			FileSizeBytes: types.FileSizeBytes(resp.ContentLength),
+			ContentType:   types.ContentType(mediaType),
+			UploadName:    types.Filename(url.PathEscape(path.Base(resp.Request.URL.Path))),
+		},
+		Logger: util.GetLogger(ctx).WithField("Origin", p.cfg.Matrix.ServerName),
+	}
+	if resErr := r.Validate(p.cfg.MaxFileSizeBytes); resErr != nil {
+		return fmt.Errorf("image rejected: %v", resErr.JSON)
+	}
+	if resErr := r.doUpload(ctx, resp.Body, p.cfg, db, store, p.checker, nil, activeThumbnailGeneration); resErr != nil {
+		return fmt.Errorf("image upload failed: %v", resErr.JSON)
+	}
+
+	r.Logger.WithFields(log.Fields{
+		"MediaID": r.MediaMetadata.MediaID,
+		"URL":     resp.Request.URL.String(),
+	}).Debug("Stored URL preview image")
+
+	og["og:image"] = fmt.Sprintf("mxc://%s/%s", p.cfg.Matrix.ServerName, r.MediaMetadata.MediaID)
+	og["og:image:type"] = string(r.MediaMetadata.ContentType)
+	og["matrix:image:size"] = r.MediaMetadata.FileSizeBytes
+	if r.ImageMetadata != nil {
+		og["og:image:width"] = r.ImageMetadata.Width
+		og["og:image:height"] = r.ImageMetadata.Height
+	}
+	return nil
+}
+
+// parseOpenGraph extracts the og:* meta properties from an HTML page. The page <title> and
+// description meta tag are used as og:title and og:description if the page has no OpenGraph data.
+// Parsing stops at the first error, i.e. when the page is truncated.
+func parseOpenGraph(page io.Reader) map[string]string {
+	og := map[string]string{}
+	var title, description string
+	inTitle := false
+
+	z := html.NewTokenizer(page)
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if _, ok := og["og:title"]; !ok && title != "" {
+				og["og:title"] = title
+			}
+			if _, ok := og["og:description"]; !ok && description != "" {
+				og["og:description"] = description
+			}
+			return og
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			switch tok.Data {
+			case "title":
+				inTitle = title == ""
+			case "meta":
+				var property, name, content string
+				for _, attr := range tok.Attr {
+					switch attr.Key {
+					case "property":
+						property = attr.Val
+					case "name":
+						name = attr.Val
+					case "content":
+						content = strings.TrimSpace(attr.Val)
+					}
+				}
+				if property == "" && strings.HasPrefix(name, "og:") {
+					// Some sites use name instead of property
+					property = name
+				}
+				if strings.HasPrefix(property, "og:") && content != "" {
+					// The first value wins, i.e. the primary og:image
+					if _, ok := og[property]; !ok {
+						og[property] = content
+					}
+				} else if strings.EqualFold(name, "description") && description == "" {
+					description = content
+				}
+			}
+		case html.TextToken:
+			if inTitle {
+				title = strings.TrimSpace(string(z.Text()))
+			}
+		case html.EndTagToken:
+			inTitle = false
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package routing
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func Test_parseOpenGraph(t *testing.T) {
+	tests := []struct {
+		name string
+		page string
+		want map[string]string
+	}{
+		{
+			name: "OpenGraph properties",
+			page: `<html><head><title>Page title</title>
+				<meta property="og:title" content="OG title">
+				<meta property="og:image" content="/first.png">
+				<meta property="og:image" content="/second.png">
+				<meta name="description" content="Page description">
+				</head><body>text</body></html>`,
+			want: map[string]string{
+				"og:title":       "OG title",
+				"og:image":       "/first.png",
+				"og:description": "Page description",
+			},
+		},
+		{
+			name: "fallback to title and description",
+			page: `<html><head><title> Page title </title><meta name="description" content="Page description"/></head></html>`,
+			want: map[string]string{
+				"og:title":       "Page title",
+				"og:description": "Page description",
+			},
+		},
+		{
+			name: "og in name attribute",
+			page: `<meta name="og:site_name" content="Example">`,
+			want: map[string]string{
+				"og:site_name": "Example",
+			},
+		},
+		{
+			name: "truncated page",
+			page: `<html><head><title>Page title</title><meta property="og:type" content="article"><meta prop`,
+			want: map[string]string{
+				"og:title": "Page title",
+				"og:type":  "article",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseOpenGraph(strings.NewReader(tt.page)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseOpenGraph() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_isIPBlocked(t *testing.T) {
+	blacklist, err := parseIPRanges(config.DefaultURLPreviewIPRangeBlacklist)
+	if err != nil {
+		t.Fatalf("failed to parse default blacklist: %v", err)
+	}
+	whitelist, err := parseIPRanges([]string{"192.168.1.0/24"})
+	if err != nil {
+		t.Fatalf("failed to parse whitelist: %v", err)
+	}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.20.0.1", true},
+		{"169.254.169.254", true},
+		{"192.168.2.1", true},
+		{"192.168.1.1", false},
+		{"::1", true},
+		{"fd00::1", true},
+		{"93.184.216.34", false},
+		{"2606:2800:220:1::1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := isIPBlocked(net.ParseIP(tt.ip), blacklist, whitelist); got != tt.want {
+				t.Errorf("isIPBlocked(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_cacheBucketStart(t *testing.T) {
+	tests := []struct {
+		name   string
+		ts     gomatrixserverlib.Timestamp
+		bucket time.Duration
+		want   gomatrixserverlib.Timestamp
+	}{
+		{"hour bucket", 3*3600000 + 1234, time.Hour, 3 * 3600000},
+		{"start of bucket", 7200000, time.Hour, 7200000},
+		{"millisecond bucket", 1234, time.Millisecond, 1234},
+		{"sub-millisecond bucket", 1234, time.Microsecond, 1234},
+		{"zero bucket", 1234, 0, 1234},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cacheBucketStart(tt.ts, tt.bucket); got != tt.want {
+				t.Errorf("cacheBucketStart(%d, %s) = %d, want %d", tt.ts, tt.bucket, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/mediaapi/quota"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+)
+
+// quotaResponse is the response to GET /quota
+type quotaResponse struct {
+	// The total size of the media uploaded by the user
+	UsedBytes int64 `json:"used_bytes"`
+	// The storage quota of the user, nil if it is unlimited
+	QuotaBytes *int64 `json:"quota_bytes"`
+}
+
+// GetQuota implements GET /quota
+// NOTSPEC: reports how much storage the user uses and how much they may use.
+func GetQuota(req *http.Request, dev *userapi.Device, db storage.Database, quotas *quota.Checker) util.JSONResponse {
+	userID := types.MatrixUserID(dev.UserID)
+	used, err := db.GetUserUsage(req.Context(), userID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to query the storage usage")
+		return jsonerror.InternalServerError()
+	}
+	quotaBytes, err := quotas.Quota(userID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to query the storage quota")
+		return jsonerror.InternalServerError()
+	}
+	res := quotaResponse{UsedBytes: used}
+	if quotaBytes > 0 {
+		res.QuotaBytes = &quotaBytes
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
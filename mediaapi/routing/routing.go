@@ -20,7 +20,11 @@ import (
 	"strings"
 
 	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/mediaapi/filestore"
+	"github.com/matrix-org/dendrite/mediaapi/quota"
+	"github.com/matrix-org/dendrite/mediaapi/scanner"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -30,12 +34,16 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
 )
 
 // configResponse is the response to GET /_matrix/media/r0/config
 // https://matrix.org/docs/spec/client_server/latest#get-matrix-media-r0-config
 type configResponse struct {
 	UploadSize *config.FileSizeBytes `json:"m.upload.size"`
+	// NOTSPEC: the storage quota of the user and how much of it is used, if quotas are enabled
+	QuotaBytes     *int64 `json:"quota_bytes,omitempty"`
+	QuotaUsedBytes *int64 `json:"quota_used_bytes,omitempty"`
 }
 
 // Setup registers the media API HTTP handlers
@@ -45,9 +53,11 @@ type configResponse struct {
 // nolint: gocyclo
 func Setup(
 	publicAPIMux *mux.Router,
+	dendriteAdminRouter *mux.Router,
 	cfg *config.MediaAPI,
 	rateLimit *config.RateLimiting,
 	db storage.Database,
+	store filestore.Store,
 	userAPI userapi.MediaUserAPI,
 	client *gomatrixserverlib.Client,
 ) {
@@ -59,16 +69,49 @@ func Setup(
 		PathToResult: map[string]*types.ThumbnailGenerationResult{},
 	}
 
+	checker, err := scanner.NewChecker(&cfg.ContentScanning, db)
+	if err != nil {
+		logrus.WithError(err).Panic("failed to configure content scanning")
+	}
+	quotas := quota.NewChecker(cfg, db)
+
 	uploadHandler := httputil.MakeAuthAPI(
 		"upload", userAPI,
 		func(req *http.Request, dev *userapi.Device) util.JSONResponse {
 			if r := rateLimits.Limit(req, dev); r != nil {
 				return *r
 			}
-			return Upload(req, cfg, dev, db, activeThumbnailGeneration)
+			return Upload(req, cfg, dev, db, store, checker, quotas, activeThumbnailGeneration)
 		},
 	)
 
+	activePendingUploads := &types.ActivePendingUploads{
+		MediaIDToUploaded: map[types.MediaID]chan struct{}{},
+		Uploading:         map[types.MediaID]bool{},
+	}
+	go expirePendingUploads(db)
+
+	createHandler := httputil.MakeAuthAPI("create", userAPI, func(req *http.Request, dev *userapi.Device) util.JSONResponse {
+		if r := rateLimits.Limit(req, dev); r != nil {
+			return *r
+		}
+		return CreateMedia(req, cfg, dev, db)
+	})
+
+	uploadPendingHandler := httputil.MakeAuthAPI("upload_pending", userAPI, func(req *http.Request, dev *userapi.Device) util.JSONResponse {
+		if r := rateLimits.Limit(req, dev); r != nil {
+			return *r
+		}
+		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+		if err != nil {
+			return util.ErrorResponse(err)
+		}
+		return UploadPending(
+			req, cfg, dev, db, store, checker, quotas, activePendingUploads, activeThumbnailGeneration,
+			gomatrixserverlib.ServerName(vars["serverName"]), types.MediaID(vars["mediaId"]),
+		)
+	})
+
 	configHandler := httputil.MakeAuthAPI("config", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 		if r := rateLimits.Limit(req, device); r != nil {
 			return *r
@@ -77,25 +120,125 @@ func Setup(
 		if cfg.MaxFileSizeBytes == 0 {
 			respondSize = nil
 		}
+		res := configResponse{UploadSize: respondSize}
+		if quotas != nil {
+			used, quotaBytes, err := quotas.Usage(req.Context(), types.MatrixUserID(device.UserID))
+			if err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("Failed to query the storage quota")
+				return jsonerror.InternalServerError()
+			}
+			res.QuotaUsedBytes = &used
+			if quotaBytes > 0 {
+				res.QuotaBytes = &quotaBytes
+			}
+		}
 		return util.JSONResponse{
 			Code: http.StatusOK,
-			JSON: configResponse{UploadSize: respondSize},
+			JSON: res,
 		}
 	})
 
+	quotaHandler := httputil.MakeAuthAPI("quota", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		if r := rateLimits.Limit(req, device); r != nil {
+			return *r
+		}
+		return GetQuota(req, device, db, quotas)
+	})
+
 	v3mux.Handle("/upload", uploadHandler).Methods(http.MethodPost, http.MethodOptions)
+	v3mux.Handle("/upload/{serverName}/{mediaId}", uploadPendingHandler).Methods(http.MethodPut, http.MethodOptions)
+	v3mux.Handle("/create", createHandler).Methods(http.MethodPost, http.MethodOptions)
 	v3mux.Handle("/config", configHandler).Methods(http.MethodGet, http.MethodOptions)
+	v3mux.Handle("/quota", quotaHandler).Methods(http.MethodGet, http.MethodOptions)
+
+	if cfg.URLPreviews.Enabled {
+		previewer, err := newURLPreviewer(cfg, checker)
+		if err != nil {
+			logrus.WithError(err).Panic("failed to configure URL previews")
+		}
+		previewHandler := httputil.MakeAuthAPI("preview_url", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.Limit(req, device); r != nil {
+				return *r
+			}
+			return PreviewURL(req, cfg, db, store, previewer, activeThumbnailGeneration)
+		})
+		v3mux.Handle("/preview_url", previewHandler).Methods(http.MethodGet, http.MethodOptions)
+	}
 
 	activeRemoteRequests := &types.ActiveRemoteRequests{
 		MXCToResult: map[string]*types.RemoteRequestResult{},
 	}
 
-	downloadHandler := makeDownloadAPI("download", cfg, rateLimits, db, client, activeRemoteRequests, activeThumbnailGeneration)
+	downloadHandler := makeDownloadAPI("download", cfg, rateLimits, db, store, checker, client, activeRemoteRequests, activePendingUploads, activeThumbnailGeneration)
 	v3mux.Handle("/download/{serverName}/{mediaId}", downloadHandler).Methods(http.MethodGet, http.MethodOptions)
 	v3mux.Handle("/download/{serverName}/{mediaId}/{downloadName}", downloadHandler).Methods(http.MethodGet, http.MethodOptions)
 
+	metadataHandler := httputil.MakeAuthAPI("metadata", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		if r := rateLimits.Limit(req, device); r != nil {
+			return *r
+		}
+		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+		if err != nil {
+			return util.ErrorResponse(err)
+		}
+		return GetMediaMetadata(req, cfg, db, store, gomatrixserverlib.ServerName(vars["serverName"]), types.MediaID(vars["mediaId"]))
+	})
+	v3mux.Handle("/metadata/{serverName}/{mediaId}", metadataHandler).Methods(http.MethodGet, http.MethodOptions)
+
 	v3mux.Handle("/thumbnail/{serverName}/{mediaId}",
-		makeDownloadAPI("thumbnail", cfg, rateLimits, db, client, activeRemoteRequests, activeThumbnailGeneration),
+		makeDownloadAPI("thumbnail", cfg, rateLimits, db, store, checker, client, activeRemoteRequests, activePendingUploads, activeThumbnailGeneration),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/listUserMedia/{userID}",
+		httputil.MakeAuthAPI("admin_list_user_media", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminListUserMedia(req, device, db, vars["userID"])
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/quarantineMedia/{serverName}/{mediaId}",
+		httputil.MakeAuthAPI("admin_quarantine_media", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminQuarantineMedia(req, device, db, gomatrixserverlib.ServerName(vars["serverName"]), types.MediaID(vars["mediaId"]))
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/quarantineRoomMedia/{roomID}",
+		httputil.MakeAuthAPI("admin_quarantine_room_media", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminQuarantineRoomMedia(req, device, db, vars["roomID"])
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/purgeRemoteMedia",
+		httputil.MakeAuthAPI("admin_purge_remote_media", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminPurgeRemoteMedia(req, cfg, device, db, store)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/deleteUserMedia/{userID}",
+		httputil.MakeAuthAPI("admin_delete_user_media", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminDeleteUserMedia(req, device, db, store, vars["userID"])
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/mediaAuditLog",
+		httputil.MakeAuthAPI("admin_media_audit_log", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminMediaAuditLog(req, device, db)
+		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 }
 
@@ -104,8 +247,11 @@ func makeDownloadAPI(
 	cfg *config.MediaAPI,
 	rateLimits *httputil.RateLimits,
 	db storage.Database,
+	store filestore.Store,
+	checker *scanner.Checker,
 	client *gomatrixserverlib.Client,
 	activeRemoteRequests *types.ActiveRemoteRequests,
+	activePendingUploads *types.ActivePendingUploads,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 ) http.HandlerFunc {
 	counterVec := promauto.NewCounterVec(
@@ -159,8 +305,11 @@ func makeDownloadAPI(
 			types.MediaID(vars["mediaId"]),
 			cfg,
 			db,
+			store,
+			checker,
 			client,
 			activeRemoteRequests,
+			activePendingUploads,
 			activeThumbnailGeneration,
 			name == "thumbnail",
 			vars["downloadName"],
@@ -22,12 +22,13 @@ import (
 	"io"
 	"net/http"
 	"net/url"
-	"os"
-	"path"
 	"strings"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/mediaapi/filestore"
 	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/quota"
+	"github.com/matrix-org/dendrite/mediaapi/scanner"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/thumbnailer"
 	"github.com/matrix-org/dendrite/mediaapi/types"
@@ -43,6 +44,8 @@ import (
 // NOTE: The members come from HTTP request metadata such as headers, query parameters or can be derived from such
 type uploadRequest struct {
 	MediaMetadata *types.MediaMetadata
+	// The size and blurhash if the file is an image, set by doUpload
+	ImageMetadata *types.ImageMetadata
 	Logger        *log.Entry
 }
 
@@ -50,28 +53,35 @@ type uploadRequest struct {
 // https://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-media-r0-upload
 type uploadResponse struct {
 	ContentURI string `json:"content_uri"`
+	// NOTSPEC: the info object for the event referring to the image
+	Info *mediaInfo `json:"info,omitempty"`
 }
 
 // Upload implements POST /upload
 // This endpoint involves uploading potentially significant amounts of data to the homeserver.
 // This implementation supports a configurable maximum file size limit in bytes. If a user tries to upload more than this, they will receive an error that their upload is too large.
+// Uploads which would take the user over their storage quota are rejected, before the body is read if its size is known.
 // Uploaded files are processed piece-wise to avoid DoS attacks which would starve the server of memory.
 // TODO: We should time out requests if they have not received any data within a configured timeout period.
-func Upload(req *http.Request, cfg *config.MediaAPI, dev *userapi.Device, db storage.Database, activeThumbnailGeneration *types.ActiveThumbnailGeneration) util.JSONResponse {
+func Upload(req *http.Request, cfg *config.MediaAPI, dev *userapi.Device, db storage.Database, store filestore.Store, checker *scanner.Checker, quotas *quota.Checker, activeThumbnailGeneration *types.ActiveThumbnailGeneration) util.JSONResponse {
 	r, resErr := parseAndValidateRequest(req, cfg, dev)
 	if resErr != nil {
 		return *resErr
 	}
 
-	if resErr = r.doUpload(req.Context(), req.Body, cfg, db, activeThumbnailGeneration); resErr != nil {
+	if resErr = r.doUpload(req.Context(), req.Body, cfg, db, store, checker, quotas, activeThumbnailGeneration); resErr != nil {
 		return *resErr
 	}
 
+	res := uploadResponse{
+		ContentURI: fmt.Sprintf("mxc://%s/%s", cfg.Matrix.ServerName, r.MediaMetadata.MediaID),
+	}
+	if r.ImageMetadata != nil {
+		res.Info = newMediaInfo(r.MediaMetadata, r.ImageMetadata)
+	}
 	return util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: uploadResponse{
-			ContentURI: fmt.Sprintf("mxc://%s/%s", cfg.Matrix.ServerName, r.MediaMetadata.MediaID),
-		},
+		JSON: res,
 	}
 }
 
@@ -129,6 +139,9 @@ func (r *uploadRequest) doUpload(
 	reqReader io.Reader,
 	cfg *config.MediaAPI,
 	db storage.Database,
+	store filestore.Store,
+	checker *scanner.Checker,
+	quotas *quota.Checker,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 ) *util.JSONResponse {
 	r.Logger.WithFields(log.Fields{
@@ -137,6 +150,14 @@ func (r *uploadRequest) doUpload(
 		"ContentType":   r.MediaMetadata.ContentType,
 	}).Info("Uploading file")
 
+	// Reject uploads which are known to exceed the quota of the uploader before reading
+	// them. Uploads of unknown size are checked once they have been written to a temp file.
+	if r.MediaMetadata.FileSizeBytes > 0 {
+		if resErr := r.checkQuota(ctx, quotas, r.MediaMetadata.FileSizeBytes); resErr != nil {
+			return resErr
+		}
+	}
+
 	// The file data is hashed and the hash is used as the MediaID. The hash is useful as a
 	// method of deduplicating files to save storage, as well as a way to conduct
 	// integrity checks on the file data in the repository.
@@ -174,6 +195,41 @@ func (r *uploadRequest) doUpload(
 		fileutils.RemoveDir(tmpDir, r.Logger) // delete temp file
 		return requestEntityTooLargeJSONResponse(cfg.MaxFileSizeBytes)
 	}
+	if r.MediaMetadata.FileSizeBytes <= 0 {
+		if resErr := r.checkQuota(ctx, quotas, bytesWritten); resErr != nil {
+			fileutils.RemoveDir(tmpDir, r.Logger)
+			return resErr
+		}
+	}
+
+	if cfg.ImageMetadata.StripEXIF {
+		strippedHash, strippedSize, strippedDir, serr := stripTempFileMetadata(ctx, cfg.AbsBasePath, hash, bytesWritten, tmpDir, r.Logger)
+		if serr != nil {
+			fileutils.RemoveDir(tmpDir, r.Logger)
+			r.Logger.WithError(serr).Warn("Failed to strip image metadata")
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.Unknown("Failed to upload"),
+			}
+		}
+		hash, bytesWritten, tmpDir = strippedHash, strippedSize, strippedDir
+	}
+
+	// Scan the file before anything refers to it. Files which were stored before are
+	// not trusted either, the scanner remembers its verdict per hash anyway.
+	if err = checker.CheckTempFile(ctx, hash, tmpDir, r.Logger); err != nil {
+		fileutils.RemoveDir(tmpDir, r.Logger)
+		if err == scanner.ErrRejected {
+			return &util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("File was rejected by the content scanner"),
+			}
+		}
+		return &util.JSONResponse{
+			Code: http.StatusServiceUnavailable,
+			JSON: jsonerror.Unknown("Unable to scan the file, try again later"),
+		}
+	}
 
 	// Look up the media by the file hash. If we already have the file but under a
 	// different media ID then we won't upload the file again - instead we'll just
@@ -190,12 +246,15 @@ func (r *uploadRequest) doUpload(
 	if existingMetadata != nil {
 		// The file already exists, delete the uploaded temporary file.
 		defer fileutils.RemoveDir(tmpDir, r.Logger)
-		// The file already exists. Make a new media ID up for it.
-		mediaID, merr := r.generateMediaID(ctx, db)
-		if merr != nil {
-			r.Logger.WithError(merr).Error("Failed to generate media ID for existing file")
-			resErr := jsonerror.InternalServerError()
-			return &resErr
+		// The file already exists. Make a new media ID up for it, unless one was reserved with /create.
+		mediaID := r.MediaMetadata.MediaID
+		if mediaID == "" {
+			var merr error
+			if mediaID, merr = r.generateMediaID(ctx, db); merr != nil {
+				r.Logger.WithError(merr).Error("Failed to generate media ID for existing file")
+				resErr := jsonerror.InternalServerError()
+				return &resErr
+			}
 		}
 
 		// Then amend the upload metadata.
@@ -203,7 +262,7 @@ func (r *uploadRequest) doUpload(
 			MediaID:           mediaID,
 			Origin:            r.MediaMetadata.Origin,
 			ContentType:       r.MediaMetadata.ContentType,
-			FileSizeBytes:     r.MediaMetadata.FileSizeBytes,
+			FileSizeBytes:     bytesWritten,
 			CreationTimestamp: r.MediaMetadata.CreationTimestamp,
 			UploadName:        r.MediaMetadata.UploadName,
 			Base64Hash:        hash,
@@ -213,12 +272,14 @@ func (r *uploadRequest) doUpload(
 		// The file doesn't exist. Update the request metadata.
 		r.MediaMetadata.FileSizeBytes = bytesWritten
 		r.MediaMetadata.Base64Hash = hash
-		r.MediaMetadata.MediaID, err = r.generateMediaID(ctx, db)
-		if err != nil {
-			fileutils.RemoveDir(tmpDir, r.Logger)
-			r.Logger.WithError(err).Error("Failed to generate media ID for new upload")
-			resErr := jsonerror.InternalServerError()
-			return &resErr
+		if r.MediaMetadata.MediaID == "" {
+			r.MediaMetadata.MediaID, err = r.generateMediaID(ctx, db)
+			if err != nil {
+				fileutils.RemoveDir(tmpDir, r.Logger)
+				r.Logger.WithError(err).Error("Failed to generate media ID for new upload")
+				resErr := jsonerror.InternalServerError()
+				return &resErr
+			}
 		}
 	}
 
@@ -230,12 +291,40 @@ func (r *uploadRequest) doUpload(
 		"ContentType":   r.MediaMetadata.ContentType,
 	}).Info("File uploaded")
 
+	if cfg.ImageMetadata.Enabled {
+		if r.ImageMetadata, err = db.GetImageMetadata(ctx, hash); err != nil {
+			r.Logger.WithError(err).Warn("Failed to query image metadata")
+		}
+		if r.ImageMetadata == nil {
+			r.ImageMetadata = extractTempImageMetadata(&cfg.ImageMetadata, tmpDir, hash, r.Logger)
+		}
+	}
+
 	return r.storeFileAndMetadata(
-		ctx, tmpDir, cfg.AbsBasePath, db, cfg.ThumbnailSizes,
+		ctx, tmpDir, store, db, cfg.ThumbnailSizes, &cfg.ExternalThumbnailers,
 		activeThumbnailGeneration, cfg.MaxThumbnailGenerators,
 	)
 }
 
+// checkQuota returns an error response if storing size more bytes takes the uploader over their quota.
+func (r *uploadRequest) checkQuota(ctx context.Context, quotas *quota.Checker, size types.FileSizeBytes) *util.JSONResponse {
+	err := quotas.Check(ctx, r.MediaMetadata.UserID, size)
+	switch err {
+	case nil:
+		return nil
+	case quota.ErrExceeded:
+		r.Logger.WithField("FileSizeBytes", size).Info("Rejecting upload exceeding the storage quota")
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.QuotaExceeded("Uploading the file would exceed your storage quota"),
+		}
+	default:
+		r.Logger.WithError(err).Error("Failed to check the storage quota")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+}
+
 func requestEntityTooLargeJSONResponse(maxFileSizeBytes config.FileSizeBytes) *util.JSONResponse {
 	return &util.JSONResponse{
 		Code: http.StatusRequestEntityTooLarge,
@@ -271,48 +360,41 @@ func (r *uploadRequest) Validate(maxFileSizeBytes config.FileSizeBytes) *util.JS
 	return nil
 }
 
-// storeFileAndMetadata moves the temporary file to its final path based on metadata and stores the metadata in the database
-// See getPathFromMediaMetadata in fileutils for details of the final path.
+// storeFileAndMetadata moves the temporary file to the media store based on metadata and stores the metadata in the database
+// See MediaKey in filestore for details of the final key.
 // The order of operations is important as it avoids metadata entering the database before the file
-// is ready, and if we fail to move the file, it never gets added to the database.
+// is ready, and if we fail to store the file, it never gets added to the database.
 // Returns a util.JSONResponse error and cleans up directories in case of error.
 func (r *uploadRequest) storeFileAndMetadata(
 	ctx context.Context,
 	tmpDir types.Path,
-	absBasePath config.Path,
+	store filestore.Store,
 	db storage.Database,
 	thumbnailSizes []config.ThumbnailSize,
+	externalThumbnailers *config.ExternalThumbnailers,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 ) *util.JSONResponse {
-	finalPath, duplicate, err := fileutils.MoveFileWithHashCheck(tmpDir, r.MediaMetadata, absBasePath, r.Logger)
-	if err != nil {
-		r.Logger.WithError(err).Error("Failed to move file.")
-		return &util.JSONResponse{
-			Code: http.StatusBadRequest,
-			JSON: jsonerror.Unknown("Failed to upload"),
+	if r.ImageMetadata != nil {
+		if err := db.StoreImageMetadata(ctx, r.ImageMetadata); err != nil {
+			r.Logger.WithError(err).Warn("Failed to store image metadata")
 		}
 	}
-	if duplicate {
-		r.Logger.WithField("dst", finalPath).Info("File was stored previously - discarding duplicate")
-	}
 
-	if err = db.StoreMediaMetadata(ctx, r.MediaMetadata); err != nil {
-		r.Logger.WithError(err).Warn("Failed to store metadata")
-		// If the file is a duplicate (has the same hash as an existing file) then
-		// there is valid metadata in the database for that file. As such we only
-		// remove the file if it is not a duplicate.
-		if !duplicate {
-			fileutils.RemoveDir(types.Path(path.Dir(string(finalPath))), r.Logger)
-		}
+	finalKey, duplicate, err := fileutils.StoreFileAndMetadata(ctx, store, db, tmpDir, r.MediaMetadata, r.Logger)
+	if err != nil {
+		r.Logger.WithError(err).Error("Failed to store file.")
 		return &util.JSONResponse{
 			Code: http.StatusBadRequest,
 			JSON: jsonerror.Unknown("Failed to upload"),
 		}
 	}
+	if duplicate {
+		r.Logger.WithField("dst", finalKey).Info("File was stored previously - discarding duplicate")
+	}
 
 	go func() {
-		file, err := os.Open(string(finalPath))
+		file, err := store.Open(context.Background(), finalKey)
 		if err != nil {
 			r.Logger.WithError(err).Error("unable to open file")
 			return
@@ -327,13 +409,13 @@ func (r *uploadRequest) storeFileAndMetadata(
 		}
 		// Check if we need to generate thumbnails
 		fileType := http.DetectContentType(buf)
-		if !strings.HasPrefix(fileType, "image") {
-			r.Logger.WithField("contentType", fileType).Debugf("uploaded file is not an image or can not be thumbnailed, not generating thumbnails")
+		if !thumbnailer.IsSupported(fileType, externalThumbnailers) {
+			r.Logger.WithField("contentType", fileType).Debugf("uploaded file can not be thumbnailed, not generating thumbnails")
 			return
 		}
 
 		busy, err := thumbnailer.GenerateThumbnails(
-			context.Background(), finalPath, thumbnailSizes, r.MediaMetadata,
+			context.Background(), store, thumbnailSizes, externalThumbnailers, r.MediaMetadata,
 			activeThumbnailGeneration, maxThumbnailGenerators, db, r.Logger,
 		)
 		if err != nil {
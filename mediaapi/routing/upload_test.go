@@ -3,13 +3,18 @@ package routing
 import (
 	"context"
 	"io"
+	"net/http"
 	"os"
 	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
 
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/mediaapi/filestore"
 	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/quota"
+	"github.com/matrix-org/dendrite/mediaapi/scanner"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -27,6 +32,9 @@ func Test_uploadRequest_doUpload(t *testing.T) {
 		reqReader                 io.Reader
 		cfg                       *config.MediaAPI
 		db                        storage.Database
+		store                     filestore.Store
+		checker                   *scanner.Checker
+		quotas                    *quota.Checker
 		activeThumbnailGeneration *types.ActiveThumbnailGeneration
 	}
 
@@ -59,6 +67,12 @@ func Test_uploadRequest_doUpload(t *testing.T) {
 	if err != nil {
 		t.Errorf("error opening mediaapi database: %v", err)
 	}
+	store := filestore.NewFileSystem(cfg.AbsBasePath)
+	quotas := quota.NewCheckerWithPledgeLevel(&config.MediaQuotas{Enabled: true, DefaultBytes: 4}, db, nil)
+	quotaExceeded := &util.JSONResponse{
+		Code: http.StatusForbidden,
+		JSON: jsonerror.QuotaExceeded("Uploading the file would exceed your storage quota"),
+	}
 
 	tests := []struct {
 		name   string
@@ -73,6 +87,7 @@ func Test_uploadRequest_doUpload(t *testing.T) {
 				reqReader: strings.NewReader("test"),
 				cfg:       cfg,
 				db:        db,
+				store:     store,
 			},
 			fields: fields{
 				Logger: logger,
@@ -90,6 +105,7 @@ func Test_uploadRequest_doUpload(t *testing.T) {
 				reqReader: strings.NewReader("testtest"),
 				cfg:       cfg,
 				db:        db,
+				store:     store,
 			},
 			fields: fields{
 				Logger: logger,
@@ -107,6 +123,7 @@ func Test_uploadRequest_doUpload(t *testing.T) {
 				reqReader: strings.NewReader("test test test"),
 				cfg:       cfg,
 				db:        db,
+				store:     store,
 			},
 			fields: fields{
 				Logger: logger,
@@ -117,6 +134,110 @@ func Test_uploadRequest_doUpload(t *testing.T) {
 			},
 			want: requestEntityTooLargeJSONResponse(maxSize),
 		},
+		{
+			name: "upload rejected by content scanner",
+			args: args{
+				ctx:       context.Background(),
+				reqReader: strings.NewReader("virus"),
+				cfg:       cfg,
+				db:        db,
+				store:     store,
+				checker: scanner.NewCheckerWithScanner(
+					scanner.NewCommand([]string{"sh", "-c", "cat >/dev/null; echo FOUND; exit 1"}), db, 0, false,
+				),
+			},
+			fields: fields{
+				Logger: logger,
+				MediaMetadata: &types.MediaMetadata{
+					MediaID:    "1340",
+					UploadName: "test virus",
+				},
+			},
+			want: &util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("File was rejected by the content scanner"),
+			},
+		},
+		{
+			name: "upload ok within quota",
+			args: args{
+				ctx:       context.Background(),
+				reqReader: strings.NewReader("quot"),
+				cfg:       cfg,
+				db:        db,
+				store:     store,
+				quotas:    quotas,
+			},
+			fields: fields{
+				Logger: logger,
+				MediaMetadata: &types.MediaMetadata{
+					MediaID:    "1341",
+					UploadName: "test quota",
+					UserID:     "@alice:localhost",
+				},
+			},
+		},
+		{
+			name: "upload of known size exceeding quota",
+			args: args{
+				ctx:       context.Background(),
+				reqReader: strings.NewReader("quota"),
+				cfg:       cfg,
+				db:        db,
+				store:     store,
+				quotas:    quotas,
+			},
+			fields: fields{
+				Logger: logger,
+				MediaMetadata: &types.MediaMetadata{
+					MediaID:       "1342",
+					UploadName:    "test quota",
+					FileSizeBytes: 5,
+					UserID:        "@bob:localhost",
+				},
+			},
+			want: quotaExceeded,
+		},
+		{
+			name: "upload of unknown size exceeding quota",
+			args: args{
+				ctx:       context.Background(),
+				reqReader: strings.NewReader("quota"),
+				cfg:       cfg,
+				db:        db,
+				store:     store,
+				quotas:    quotas,
+			},
+			fields: fields{
+				Logger: logger,
+				MediaMetadata: &types.MediaMetadata{
+					MediaID:    "1343",
+					UploadName: "test quota",
+					UserID:     "@bob:localhost",
+				},
+			},
+			want: quotaExceeded,
+		},
+		{
+			name: "upload exceeding used up quota",
+			args: args{
+				ctx:       context.Background(),
+				reqReader: strings.NewReader("q"),
+				cfg:       cfg,
+				db:        db,
+				store:     store,
+				quotas:    quotas,
+			},
+			fields: fields{
+				Logger: logger,
+				MediaMetadata: &types.MediaMetadata{
+					MediaID:    "1344",
+					UploadName: "test quota",
+					UserID:     "@alice:localhost",
+				},
+			},
+			want: quotaExceeded,
+		},
 		{
 			name: "upload ok with unlimited filesize",
 			args: args{
@@ -128,7 +249,8 @@ func Test_uploadRequest_doUpload(t *testing.T) {
 					AbsBasePath:       config.Path(testdataPath),
 					DynamicThumbnails: false,
 				},
-				db: db,
+				db:    db,
+				store: store,
 			},
 			fields: fields{
 				Logger: logger,
@@ -145,7 +267,7 @@ func Test_uploadRequest_doUpload(t *testing.T) {
 				MediaMetadata: tt.fields.MediaMetadata,
 				Logger:        tt.fields.Logger,
 			}
-			if got := r.doUpload(tt.args.ctx, tt.args.reqReader, tt.args.cfg, tt.args.db, tt.args.activeThumbnailGeneration); !reflect.DeepEqual(got, tt.want) {
+			if got := r.doUpload(tt.args.ctx, tt.args.reqReader, tt.args.cfg, tt.args.db, tt.args.store, tt.args.checker, tt.args.quotas, tt.args.activeThumbnailGeneration); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("doUpload() = %+v, want %+v", got, tt.want)
 			}
 		})
@@ -0,0 +1,118 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// clamdChunkSize is the size of the chunks the file is streamed to clamd in. It must
+// not exceed StreamMaxLength in clamd.conf.
+const clamdChunkSize = 64 * 1024
+
+type clamd struct {
+	socket string
+}
+
+// NewClamd returns a Scanner which streams files to a ClamAV daemon listening on
+// the given Unix socket.
+func NewClamd(socket string) Scanner {
+	return &clamd{socket: socket}
+}
+
+// Scan implements the INSTREAM command, see
+// https://docs.clamav.net/manual/Usage/Scanning.html#clamd
+func (c *clamd) Scan(ctx context.Context, r io.Reader) (bool, string, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", c.socket)
+	if err != nil {
+		return false, "", fmt.Errorf("dialer.DialContext: %w", err)
+	}
+	defer conn.Close() // nolint: errcheck
+	if deadline, ok := ctx.Deadline(); ok {
+		if err = conn.SetDeadline(deadline); err != nil {
+			return false, "", fmt.Errorf("conn.SetDeadline: %w", err)
+		}
+	}
+
+	if err = c.stream(conn, r); err != nil {
+		// clamd closes the connection early if the file exceeds its size limit,
+		// in which case the reply explains why
+		if reply, rerr := readReply(conn); rerr == nil && reply != "" {
+			return false, "", fmt.Errorf("clamd: %s", reply)
+		}
+		return false, "", err
+	}
+
+	reply, err := readReply(conn)
+	if err != nil {
+		return false, "", fmt.Errorf("readReply: %w", err)
+	}
+	return parseReply(reply)
+}
+
+func (c *clamd) stream(conn net.Conn, r io.Reader) error {
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return fmt.Errorf("conn.Write: %w", err)
+	}
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := r.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			if _, werr := conn.Write(buf[:4+n]); werr != nil {
+				return fmt.Errorf("conn.Write: %w", werr)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("r.Read: %w", err)
+		}
+	}
+	// a zero length chunk marks the end of the stream
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return fmt.Errorf("conn.Write: %w", err)
+	}
+	return nil
+}
+
+func readReply(conn net.Conn) (string, error) {
+	reply, err := io.ReadAll(io.LimitReader(conn, 4096))
+	if err != nil {
+		return "", err
+	}
+	return string(bytes.TrimRight(reply, "\x00\n")), nil
+}
+
+// parseReply parses replies like "stream: OK" or "stream: Eicar-Signature FOUND".
+func parseReply(reply string) (bool, string, error) {
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return true, "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return false, strings.TrimSuffix(reply, " FOUND"), nil
+	default:
+		return false, "", fmt.Errorf("clamd: %s", reply)
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// commandInfectedExitCode is the exit status of the command for infected files,
+// as used by clamscan and clamdscan.
+const commandInfectedExitCode = 1
+
+type command struct {
+	args []string
+}
+
+// NewCommand returns a Scanner which runs the given command with the file on its
+// standard input. The command must exit with status 0 if the file is clean and 1 if
+// it is infected, any other status is a failure. The output of the command is used
+// as the reason for rejecting a file.
+func NewCommand(args []string) Scanner {
+	return &command{args: args}
+}
+
+func (c *command) Scan(ctx context.Context, r io.Reader) (bool, string, error) {
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.args[0], c.args[1:]...) // nolint: gosec
+	cmd.Stdin = r
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	err := cmd.Run()
+	if err == nil {
+		return true, "", nil
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == commandInfectedExitCode && ctx.Err() == nil {
+		return false, strings.TrimSpace(output.String()), nil
+	}
+	if ctx.Err() != nil {
+		return false, "", ctx.Err()
+	}
+	return false, "", fmt.Errorf("%s: %w: %s", c.args[0], err, strings.TrimSpace(output.String()))
+}
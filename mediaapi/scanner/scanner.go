@@ -0,0 +1,177 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package scanner checks media for malware before it is stored or served.
+package scanner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/matrix-org/dendrite/mediaapi/filestore"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrRejected is returned when the content scanner found the file to be infected.
+var ErrRejected = errors.New("file was rejected by the content scanner")
+
+// Scanner scans the content of a single file.
+type Scanner interface {
+	// Scan reads the file from r and returns whether it is clean. An error
+	// means the file could not be scanned, not that it is infected.
+	Scan(ctx context.Context, r io.Reader) (clean bool, reason string, err error)
+}
+
+// New returns the Scanner for the configured backend.
+func New(cfg *config.ContentScanning) (Scanner, error) {
+	switch cfg.Backend {
+	case config.ContentScannerClamd:
+		return NewClamd(cfg.Socket), nil
+	case config.ContentScannerCommand:
+		if len(cfg.Command) == 0 {
+			return nil, errors.New("no command configured")
+		}
+		return NewCommand(cfg.Command), nil
+	default:
+		return nil, fmt.Errorf("unknown content scanner %q", cfg.Backend)
+	}
+}
+
+// Checker scans files with a Scanner, remembering the verdict per file hash so that
+// every file is only scanned once. A nil *Checker accepts all files.
+type Checker struct {
+	scanner  Scanner
+	db       storage.Database
+	timeout  time.Duration
+	failOpen bool
+}
+
+// NewChecker returns a Checker for the configuration, or nil if content scanning is disabled.
+func NewChecker(cfg *config.ContentScanning, db storage.Database) (*Checker, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	s, err := New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return NewCheckerWithScanner(s, db, cfg.Timeout, cfg.FailOpen), nil
+}
+
+// NewCheckerWithScanner returns a Checker using the given Scanner.
+func NewCheckerWithScanner(s Scanner, db storage.Database, timeout time.Duration, failOpen bool) *Checker {
+	return &Checker{
+		scanner:  s,
+		db:       db,
+		timeout:  timeout,
+		failOpen: failOpen,
+	}
+}
+
+// Check returns ErrRejected if the file with the given hash is infected. The file is
+// only opened when there is no earlier verdict on it. If the file can't be scanned, the
+// error is returned unless the checker fails open. Such failures are not remembered, so
+// the file is scanned again next time.
+func (c *Checker) Check(
+	ctx context.Context,
+	hash types.Base64Hash,
+	open func() (io.ReadCloser, error),
+	logger *log.Entry,
+) error {
+	if c == nil {
+		return nil
+	}
+	logger = logger.WithField("Base64Hash", hash)
+
+	result, err := c.db.GetScanResult(ctx, hash)
+	if err != nil {
+		return fmt.Errorf("c.db.GetScanResult: %w", err)
+	}
+	if result == nil {
+		result, err = c.scan(ctx, hash, open)
+		if err != nil {
+			if c.failOpen {
+				logger.WithError(err).Warn("Unable to scan file, accepting it anyway")
+				return nil
+			}
+			logger.WithError(err).Error("Unable to scan file")
+			return err
+		}
+		if err = c.db.StoreScanResult(ctx, result); err != nil {
+			logger.WithError(err).Warn("Failed to store scan result")
+		}
+	}
+
+	if !result.Clean {
+		logger.WithField("reason", result.Reason).Warn("File was rejected by the content scanner")
+		return ErrRejected
+	}
+	return nil
+}
+
+func (c *Checker) scan(
+	ctx context.Context,
+	hash types.Base64Hash,
+	open func() (io.ReadCloser, error),
+) (*types.ScanResult, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	file, err := open()
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+	defer file.Close() // nolint: errcheck
+
+	clean, reason, err := c.scanner.Scan(ctx, file)
+	if err != nil {
+		return nil, fmt.Errorf("c.scanner.Scan: %w", err)
+	}
+	return &types.ScanResult{
+		Base64Hash:       hash,
+		Clean:            clean,
+		Reason:           reason,
+		ScannedTimestamp: gomatrixserverlib.AsTimestamp(time.Now()),
+	}, nil
+}
+
+// CheckTempFile checks a file written by fileutils.WriteTempFile before it is stored.
+func (c *Checker) CheckTempFile(ctx context.Context, hash types.Base64Hash, tmpDir types.Path, logger *log.Entry) error {
+	return c.Check(ctx, hash, func() (io.ReadCloser, error) {
+		return os.Open(filepath.Join(string(tmpDir), "content"))
+	}, logger)
+}
+
+// CheckStored checks a file in the media store.
+func (c *Checker) CheckStored(ctx context.Context, hash types.Base64Hash, store filestore.Store, logger *log.Entry) error {
+	return c.Check(ctx, hash, func() (io.ReadCloser, error) {
+		key, err := filestore.MediaKey(hash)
+		if err != nil {
+			return nil, err
+		}
+		return store.Open(ctx, key)
+	}, logger)
+}
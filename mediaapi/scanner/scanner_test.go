@@ -0,0 +1,170 @@
+package scanner
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/test/testrig"
+	log "github.com/sirupsen/logrus"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeClamd answers INSTREAM commands on a Unix socket, finding everything
+// containing the EICAR test string to be infected.
+func fakeClamd(t *testing.T) string {
+	socket := filepath.Join(t.TempDir(), "clamd.ctl")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("unable to listen on %s: %v", socket, err)
+	}
+	t.Cleanup(func() { l.Close() }) // nolint: errcheck
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close() // nolint: errcheck
+				r := bufio.NewReader(conn)
+				if cmd, err := r.ReadString(0); err != nil || cmd != "zINSTREAM\x00" {
+					conn.Write([]byte("UNKNOWN COMMAND\x00")) // nolint: errcheck
+					return
+				}
+				var data strings.Builder
+				for {
+					var size uint32
+					if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					if _, err := io.CopyN(&data, r, int64(size)); err != nil {
+						return
+					}
+				}
+				if strings.Contains(data.String(), eicar) {
+					conn.Write([]byte("stream: Eicar-Signature FOUND\x00")) // nolint: errcheck
+				} else {
+					conn.Write([]byte("stream: OK\x00")) // nolint: errcheck
+				}
+			}()
+		}
+	}()
+	return socket
+}
+
+func testScanner(t *testing.T, s Scanner) {
+	ctx := context.Background()
+	clean, reason, err := s.Scan(ctx, strings.NewReader(strings.Repeat("harmless ", clamdChunkSize)))
+	if err != nil || !clean || reason != "" {
+		t.Errorf("Scan(harmless) = %v, %q, %v, want true, \"\", nil", clean, reason, err)
+	}
+	clean, reason, err = s.Scan(ctx, strings.NewReader(eicar))
+	if err != nil || clean || !strings.Contains(reason, "Eicar-Signature") {
+		t.Errorf("Scan(eicar) = %v, %q, %v, want false, \"Eicar-Signature\", nil", clean, reason, err)
+	}
+}
+
+func TestClamd(t *testing.T) {
+	testScanner(t, NewClamd(fakeClamd(t)))
+
+	if _, _, err := NewClamd(filepath.Join(t.TempDir(), "missing.ctl")).Scan(context.Background(), strings.NewReader("")); err == nil {
+		t.Errorf("Scan with unreachable clamd succeeded")
+	}
+}
+
+func TestCommand(t *testing.T) {
+	testScanner(t, NewCommand([]string{
+		"sh", "-c", `if grep -q EICAR; then echo "stdin: Eicar-Signature FOUND"; exit 1; fi`,
+	}))
+
+	if _, _, err := NewCommand([]string{"sh", "-c", "cat >/dev/null; exit 2"}).Scan(context.Background(), strings.NewReader("")); err == nil {
+		t.Errorf("Scan with failing command succeeded")
+	}
+}
+
+type fakeScanner struct {
+	scans int
+	err   error
+}
+
+func (s *fakeScanner) Scan(ctx context.Context, r io.Reader) (bool, string, error) {
+	s.scans++
+	if s.err != nil {
+		return false, "", s.err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return false, "", err
+	}
+	if strings.Contains(string(data), eicar) {
+		return false, "Eicar-Signature", nil
+	}
+	return true, "", nil
+}
+
+func TestChecker(t *testing.T) {
+	ctx := context.Background()
+	logger := log.WithField("test", t.Name())
+	db := testrig.CreateMediaAPIDatabase(t)
+	opener := func(content string) func() (io.ReadCloser, error) {
+		return func() (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader(content)), nil
+		}
+	}
+
+	t.Run("disabled checker accepts everything", func(t *testing.T) {
+		var c *Checker
+		if err := c.Check(ctx, "infected", opener(eicar), logger); err != nil {
+			t.Errorf("Check returned error: %v", err)
+		}
+	})
+
+	t.Run("verdicts are remembered", func(t *testing.T) {
+		s := &fakeScanner{}
+		c := NewCheckerWithScanner(s, db, 0, false)
+		for i := 0; i < 2; i++ {
+			if err := c.Check(ctx, "clean", opener("harmless"), logger); err != nil {
+				t.Errorf("Check(clean) returned error: %v", err)
+			}
+			if err := c.Check(ctx, "infected", opener(eicar), logger); err != ErrRejected {
+				t.Errorf("Check(infected) = %v, want %v", err, ErrRejected)
+			}
+		}
+		if s.scans != 2 {
+			t.Errorf("got %d scans, want 2", s.scans)
+		}
+		result, err := db.GetScanResult(ctx, "infected")
+		if err != nil {
+			t.Fatalf("GetScanResult returned error: %v", err)
+		}
+		if result == nil || result.Clean || result.Reason != "Eicar-Signature" {
+			t.Errorf("GetScanResult = %+v, want rejected with reason", result)
+		}
+	})
+
+	t.Run("failures are not remembered", func(t *testing.T) {
+		s := &fakeScanner{err: errors.New("scanner down")}
+		hash := types.Base64Hash("unscanned")
+		if err := NewCheckerWithScanner(s, db, 0, false).Check(ctx, hash, opener("harmless"), logger); err == nil {
+			t.Errorf("fail-closed Check succeeded while the scanner is down")
+		}
+		if err := NewCheckerWithScanner(s, db, 0, true).Check(ctx, hash, opener("harmless"), logger); err != nil {
+			t.Errorf("fail-open Check returned error: %v", err)
+		}
+		if result, err := db.GetScanResult(ctx, hash); err != nil || result != nil {
+			t.Errorf("GetScanResult = %+v, %v, want nil, nil", result, err)
+		}
+	})
+}
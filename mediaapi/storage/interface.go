@@ -24,16 +24,64 @@ import (
 type Database interface {
 	MediaRepository
 	Thumbnails
+	PendingUploads
+	MediaAdmin
+	ImageMetadata
+	ScanResults
+	URLPreviews
 }
 
 type MediaRepository interface {
 	StoreMediaMetadata(ctx context.Context, mediaMetadata *types.MediaMetadata) error
 	GetMediaMetadata(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) (*types.MediaMetadata, error)
 	GetMediaMetadataByHash(ctx context.Context, mediaHash types.Base64Hash, mediaOrigin gomatrixserverlib.ServerName) (*types.MediaMetadata, error)
+	GetMediaMetadataForUser(ctx context.Context, userID types.MatrixUserID) ([]*types.MediaMetadata, error)
+	GetRemoteMediaMetadataCreatedBefore(ctx context.Context, localOrigin gomatrixserverlib.ServerName, ts gomatrixserverlib.Timestamp, limit, offset int) ([]*types.MediaMetadata, error)
+	GetTimedOutMediaMetadata(ctx context.Context, ts gomatrixserverlib.Timestamp) ([]*types.MediaMetadata, error)
+	DeleteMediaMetadata(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) (mediaMetadata *types.MediaMetadata, unreferenced bool, err error)
+	GetBlobRefCounts(ctx context.Context) (map[types.Base64Hash]int64, error)
+	GetMediaHashCounts(ctx context.Context) (map[types.Base64Hash]int64, error)
+	RepairBlobRefCounts(ctx context.Context) error
+	GetUserUsage(ctx context.Context, userID types.MatrixUserID) (int64, error)
 }
 
 type Thumbnails interface {
 	StoreThumbnail(ctx context.Context, thumbnailMetadata *types.ThumbnailMetadata) error
-	GetThumbnail(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, width, height int, resizeMethod string) (*types.ThumbnailMetadata, error)
+	GetThumbnail(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, width, height int, resizeMethod string, animated bool) (*types.ThumbnailMetadata, error)
 	GetThumbnails(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) ([]*types.ThumbnailMetadata, error)
 }
+
+type PendingUploads interface {
+	StorePendingUpload(ctx context.Context, pending *types.PendingUpload) error
+	GetPendingUpload(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) (*types.PendingUpload, error)
+	CountPendingUploads(ctx context.Context, userID types.MatrixUserID, now gomatrixserverlib.Timestamp) (int64, error)
+	DeletePendingUpload(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) error
+	DeleteExpiredPendingUploads(ctx context.Context, now gomatrixserverlib.Timestamp) (int64, error)
+}
+
+type MediaAdmin interface {
+	// QuarantineMedia returns false if the media was already quarantined
+	QuarantineMedia(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, userID types.MatrixUserID) (bool, error)
+	QuarantineRoomMedia(ctx context.Context, roomID string, userID types.MatrixUserID) (int64, error)
+	IsMediaQuarantined(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) (bool, error)
+	GetUserMedia(ctx context.Context, userID types.MatrixUserID) ([]*types.UserMedia, error)
+	StoreRoomMedia(ctx context.Context, roomID string, media []*types.MediaMetadata) error
+	GetRoomMedia(ctx context.Context, roomID string) ([]*types.MediaMetadata, error)
+	StoreMediaAuditEntry(ctx context.Context, entry *types.MediaAuditEntry) error
+	GetMediaAuditLog(ctx context.Context, limit int) ([]*types.MediaAuditEntry, error)
+}
+
+type ImageMetadata interface {
+	StoreImageMetadata(ctx context.Context, meta *types.ImageMetadata) error
+	GetImageMetadata(ctx context.Context, mediaHash types.Base64Hash) (*types.ImageMetadata, error)
+}
+
+type ScanResults interface {
+	StoreScanResult(ctx context.Context, result *types.ScanResult) error
+	GetScanResult(ctx context.Context, mediaHash types.Base64Hash) (*types.ScanResult, error)
+}
+
+type URLPreviews interface {
+	StoreURLPreview(ctx context.Context, preview *types.URLPreview) error
+	GetURLPreview(ctx context.Context, url string, bucketTS gomatrixserverlib.Timestamp) (*types.URLPreview, error)
+}
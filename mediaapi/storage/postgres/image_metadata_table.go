@@ -0,0 +1,93 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/storage/tables"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+)
+
+const imageMetadataSchema = `
+-- The mediaapi_image_metadata table holds the size and blurhash of image files,
+-- so that clients can show a placeholder before downloading the image.
+CREATE TABLE IF NOT EXISTS mediaapi_image_metadata (
+    -- Alternate RFC 4648 unpadded base64 encoding string representation of a SHA-256 hash sum of the file data.
+    base64hash TEXT NOT NULL PRIMARY KEY,
+    -- The size of the image as displayed, after applying the EXIF orientation.
+    width INTEGER NOT NULL,
+    height INTEGER NOT NULL,
+    -- The blurhash of the image, empty if the image was too large to decode.
+    blurhash TEXT NOT NULL,
+    -- The EXIF orientation of the stored image.
+    orientation SMALLINT NOT NULL
+);
+`
+
+const insertImageMetadataSQL = `
+INSERT INTO mediaapi_image_metadata (base64hash, width, height, blurhash, orientation) VALUES ($1, $2, $3, $4, $5)
+    ON CONFLICT (base64hash) DO NOTHING
+`
+
+const selectImageMetadataSQL = `
+SELECT width, height, blurhash, orientation FROM mediaapi_image_metadata WHERE base64hash = $1
+`
+
+type imageMetadataStatements struct {
+	insertImageMetadataStmt *sql.Stmt
+	selectImageMetadataStmt *sql.Stmt
+}
+
+func NewPostgresImageMetadataTable(db *sql.DB) (tables.ImageMetadata, error) {
+	s := &imageMetadataStatements{}
+	_, err := db.Exec(imageMetadataSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.insertImageMetadataStmt, insertImageMetadataSQL},
+		{&s.selectImageMetadataStmt, selectImageMetadataSQL},
+	}.Prepare(db)
+}
+
+func (s *imageMetadataStatements) InsertImageMetadata(
+	ctx context.Context, txn *sql.Tx, meta *types.ImageMetadata,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.insertImageMetadataStmt).ExecContext(
+		ctx, meta.Base64Hash, meta.Width, meta.Height, meta.Blurhash, meta.Orientation,
+	)
+	return err
+}
+
+func (s *imageMetadataStatements) SelectImageMetadata(
+	ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash,
+) (*types.ImageMetadata, error) {
+	meta := types.ImageMetadata{
+		Base64Hash: mediaHash,
+	}
+	err := sqlutil.TxStmtContext(ctx, txn, s.selectImageMetadataStmt).QueryRowContext(
+		ctx, meta.Base64Hash,
+	).Scan(
+		&meta.Width,
+		&meta.Height,
+		&meta.Blurhash,
+		&meta.Orientation,
+	)
+	return &meta, err
+}
@@ -20,6 +20,7 @@ import (
 	"database/sql"
 	"time"
 
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/mediaapi/storage/tables"
 	"github.com/matrix-org/dendrite/mediaapi/types"
@@ -65,10 +66,50 @@ const selectMediaByHashSQL = `
 SELECT content_type, file_size_bytes, creation_ts, upload_name, media_id, user_id FROM mediaapi_media_repository WHERE base64hash = $1 AND media_origin = $2
 `
 
+const deleteMediaSQL = `
+DELETE FROM mediaapi_media_repository WHERE media_id = $1 AND media_origin = $2
+`
+
+const selectMediaByUserSQL = `
+SELECT media_id, media_origin, content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id FROM mediaapi_media_repository WHERE user_id = $1 ORDER BY creation_ts ASC
+`
+
+const selectUserMediaWithQuarantineSQL = `
+SELECT m.media_id, m.media_origin, m.content_type, m.file_size_bytes, m.creation_ts, m.upload_name, m.base64hash, m.user_id, q.media_id IS NOT NULL
+	FROM mediaapi_media_repository m LEFT JOIN mediaapi_quarantined_media q ON q.media_id = m.media_id AND q.media_origin = m.media_origin
+	WHERE m.user_id = $1 ORDER BY m.creation_ts ASC
+`
+
+// The media is ordered by all columns of the unique index as well, so that paging with an offset
+// is stable while earlier pages are being deleted.
+const selectRemoteMediaCreatedBeforeSQL = `
+SELECT media_id, media_origin, content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id FROM mediaapi_media_repository
+	WHERE media_origin <> $1 AND creation_ts < $2
+	ORDER BY creation_ts ASC, media_id ASC, media_origin ASC LIMIT $3 OFFSET $4
+`
+
+// Selects all media referring to files which no media was stored for since $1
+const selectTimedOutMediaSQL = `
+SELECT media_id, media_origin, content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id FROM mediaapi_media_repository
+	WHERE base64hash IN (SELECT base64hash FROM mediaapi_media_repository GROUP BY base64hash HAVING MAX(creation_ts) < $1)
+	ORDER BY creation_ts ASC
+`
+
+// Note: this counts the media referring to each file, regardless of their origin
+const selectMediaHashCountsSQL = `
+SELECT base64hash, COUNT(*) FROM mediaapi_media_repository GROUP BY base64hash
+`
+
 type mediaStatements struct {
 	insertMediaStmt       *sql.Stmt
 	selectMediaStmt       *sql.Stmt
 	selectMediaByHashStmt *sql.Stmt
+	deleteMediaStmt       *sql.Stmt
+	selectHashCountsStmt  *sql.Stmt
+	selectByUserStmt      *sql.Stmt
+	selectUserMediaStmt   *sql.Stmt
+	selectRemoteStmt      *sql.Stmt
+	selectTimedOutStmt    *sql.Stmt
 }
 
 func NewPostgresMediaRepositoryTable(db *sql.DB) (tables.MediaRepository, error) {
@@ -82,6 +123,12 @@ func NewPostgresMediaRepositoryTable(db *sql.DB) (tables.MediaRepository, error)
 		{&s.insertMediaStmt, insertMediaSQL},
 		{&s.selectMediaStmt, selectMediaSQL},
 		{&s.selectMediaByHashStmt, selectMediaByHashSQL},
+		{&s.deleteMediaStmt, deleteMediaSQL},
+		{&s.selectHashCountsStmt, selectMediaHashCountsSQL},
+		{&s.selectByUserStmt, selectMediaByUserSQL},
+		{&s.selectUserMediaStmt, selectUserMediaWithQuarantineSQL},
+		{&s.selectRemoteStmt, selectRemoteMediaCreatedBeforeSQL},
+		{&s.selectTimedOutStmt, selectTimedOutMediaSQL},
 	}.Prepare(db)
 }
 
@@ -142,3 +189,112 @@ func (s *mediaStatements) SelectMediaByHash(
 	)
 	return &mediaMetadata, err
 }
+
+func (s *mediaStatements) DeleteMedia(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.deleteMediaStmt).ExecContext(ctx, mediaID, mediaOrigin)
+	return err
+}
+
+func (s *mediaStatements) SelectMediaHashCounts(
+	ctx context.Context, txn *sql.Tx,
+) (map[types.Base64Hash]int64, error) {
+	rows, err := sqlutil.TxStmtContext(ctx, txn, s.selectHashCountsStmt).QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectMediaHashCounts: rows.close() failed")
+	counts := map[types.Base64Hash]int64{}
+	for rows.Next() {
+		var hash types.Base64Hash
+		var count int64
+		if err = rows.Scan(&hash, &count); err != nil {
+			return nil, err
+		}
+		counts[hash] = count
+	}
+	return counts, rows.Err()
+}
+
+func (s *mediaStatements) SelectMediaByUser(
+	ctx context.Context, txn *sql.Tx, userID types.MatrixUserID,
+) ([]*types.MediaMetadata, error) {
+	rows, err := sqlutil.TxStmtContext(ctx, txn, s.selectByUserStmt).QueryContext(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return scanMedia(ctx, rows)
+}
+
+func (s *mediaStatements) SelectUserMediaWithQuarantine(
+	ctx context.Context, txn *sql.Tx, userID types.MatrixUserID,
+) ([]*types.UserMedia, error) {
+	rows, err := sqlutil.TxStmtContext(ctx, txn, s.selectUserMediaStmt).QueryContext(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectUserMediaWithQuarantine: rows.close() failed")
+	var media []*types.UserMedia
+	for rows.Next() {
+		m := &types.UserMedia{MediaMetadata: &types.MediaMetadata{}}
+		if err = rows.Scan(
+			&m.MediaID,
+			&m.Origin,
+			&m.ContentType,
+			&m.FileSizeBytes,
+			&m.CreationTimestamp,
+			&m.UploadName,
+			&m.Base64Hash,
+			&m.UserID,
+			&m.Quarantined,
+		); err != nil {
+			return nil, err
+		}
+		media = append(media, m)
+	}
+	return media, rows.Err()
+}
+
+func (s *mediaStatements) SelectRemoteMediaCreatedBefore(
+	ctx context.Context, txn *sql.Tx,
+	localOrigin gomatrixserverlib.ServerName, ts gomatrixserverlib.Timestamp, limit, offset int,
+) ([]*types.MediaMetadata, error) {
+	rows, err := sqlutil.TxStmtContext(ctx, txn, s.selectRemoteStmt).QueryContext(ctx, localOrigin, ts, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	return scanMedia(ctx, rows)
+}
+
+func (s *mediaStatements) SelectTimedOutMedia(
+	ctx context.Context, txn *sql.Tx, ts gomatrixserverlib.Timestamp,
+) ([]*types.MediaMetadata, error) {
+	rows, err := sqlutil.TxStmtContext(ctx, txn, s.selectTimedOutStmt).QueryContext(ctx, ts)
+	if err != nil {
+		return nil, err
+	}
+	return scanMedia(ctx, rows)
+}
+
+func scanMedia(ctx context.Context, rows *sql.Rows) ([]*types.MediaMetadata, error) {
+	defer internal.CloseAndLogIfError(ctx, rows, "scanMedia: rows.close() failed")
+	var media []*types.MediaMetadata
+	for rows.Next() {
+		mediaMetadata := &types.MediaMetadata{}
+		if err := rows.Scan(
+			&mediaMetadata.MediaID,
+			&mediaMetadata.Origin,
+			&mediaMetadata.ContentType,
+			&mediaMetadata.FileSizeBytes,
+			&mediaMetadata.CreationTimestamp,
+			&mediaMetadata.UploadName,
+			&mediaMetadata.Base64Hash,
+			&mediaMetadata.UserID,
+		); err != nil {
+			return nil, err
+		}
+		media = append(media, mediaMetadata)
+	}
+	return media, rows.Err()
+}
@@ -34,14 +34,59 @@ func NewDatabase(base *base.BaseDendrite, dbProperties *config.DatabaseOptions)
 	if err != nil {
 		return nil, err
 	}
+	blobs, err := NewPostgresBlobsTable(db)
+	if err != nil {
+		return nil, err
+	}
+	userUsage, err := NewPostgresUserUsageTable(db)
+	if err != nil {
+		return nil, err
+	}
 	thumbnails, err := NewPostgresThumbnailsTable(db)
 	if err != nil {
 		return nil, err
 	}
+	pendingUploads, err := NewPostgresPendingUploadsTable(db)
+	if err != nil {
+		return nil, err
+	}
+	quarantinedMedia, err := NewPostgresQuarantinedMediaTable(db)
+	if err != nil {
+		return nil, err
+	}
+	roomMedia, err := NewPostgresRoomMediaTable(db)
+	if err != nil {
+		return nil, err
+	}
+	mediaAudit, err := NewPostgresMediaAuditTable(db)
+	if err != nil {
+		return nil, err
+	}
+	imageMetadata, err := NewPostgresImageMetadataTable(db)
+	if err != nil {
+		return nil, err
+	}
+	scanResults, err := NewPostgresScanResultsTable(db)
+	if err != nil {
+		return nil, err
+	}
+	urlPreviews, err := NewPostgresURLPreviewsTable(db)
+	if err != nil {
+		return nil, err
+	}
 	return &shared.Database{
-		MediaRepository: mediaRepo,
-		Thumbnails:      thumbnails,
-		DB:              db,
-		Writer:          writer,
+		MediaRepository:  mediaRepo,
+		Blobs:            blobs,
+		UserUsage:        userUsage,
+		Thumbnails:       thumbnails,
+		PendingUploads:   pendingUploads,
+		QuarantinedMedia: quarantinedMedia,
+		RoomMedia:        roomMedia,
+		MediaAudit:       mediaAudit,
+		ImageMetadata:    imageMetadata,
+		ScanResults:      scanResults,
+		URLPreviews:      urlPreviews,
+		DB:               db,
+		Writer:           writer,
 	}, nil
 }
@@ -0,0 +1,146 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/storage/tables"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const pendingUploadsSchema = `
+-- The mediaapi_pending_uploads table holds media IDs reserved with /create whose content
+-- has not been uploaded yet. The row is removed once the content is uploaded.
+CREATE TABLE IF NOT EXISTS mediaapi_pending_uploads (
+    -- The reserved media ID.
+    media_id TEXT NOT NULL,
+    -- The origin of the media, always the local server.
+    media_origin TEXT NOT NULL,
+    -- The user who reserved the media ID and is allowed to upload the content.
+    user_id TEXT NOT NULL,
+    -- When the media ID was reserved in UNIX epoch ms.
+    creation_ts BIGINT NOT NULL,
+    -- When the reservation expires if no content was uploaded in UNIX epoch ms.
+    expires_ts BIGINT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS mediaapi_pending_uploads_index ON mediaapi_pending_uploads (media_id, media_origin);
+CREATE INDEX IF NOT EXISTS mediaapi_pending_uploads_user_id_idx ON mediaapi_pending_uploads (user_id);
+`
+
+const insertPendingUploadSQL = `
+INSERT INTO mediaapi_pending_uploads (media_id, media_origin, user_id, creation_ts, expires_ts)
+    VALUES ($1, $2, $3, $4, $5)
+`
+
+const selectPendingUploadSQL = `
+SELECT user_id, creation_ts, expires_ts FROM mediaapi_pending_uploads WHERE media_id = $1 AND media_origin = $2
+`
+
+const selectPendingUploadsCountSQL = `
+SELECT COUNT(*) FROM mediaapi_pending_uploads WHERE user_id = $1 AND expires_ts > $2
+`
+
+const deletePendingUploadSQL = `
+DELETE FROM mediaapi_pending_uploads WHERE media_id = $1 AND media_origin = $2
+`
+
+const deleteExpiredPendingUploadsSQL = `
+DELETE FROM mediaapi_pending_uploads WHERE expires_ts <= $1
+`
+
+type pendingUploadsStatements struct {
+	insertPendingUploadStmt         *sql.Stmt
+	selectPendingUploadStmt         *sql.Stmt
+	selectPendingUploadsCountStmt   *sql.Stmt
+	deletePendingUploadStmt         *sql.Stmt
+	deleteExpiredPendingUploadsStmt *sql.Stmt
+}
+
+func NewPostgresPendingUploadsTable(db *sql.DB) (tables.PendingUploads, error) {
+	s := &pendingUploadsStatements{}
+	_, err := db.Exec(pendingUploadsSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.insertPendingUploadStmt, insertPendingUploadSQL},
+		{&s.selectPendingUploadStmt, selectPendingUploadSQL},
+		{&s.selectPendingUploadsCountStmt, selectPendingUploadsCountSQL},
+		{&s.deletePendingUploadStmt, deletePendingUploadSQL},
+		{&s.deleteExpiredPendingUploadsStmt, deleteExpiredPendingUploadsSQL},
+	}.Prepare(db)
+}
+
+func (s *pendingUploadsStatements) InsertPendingUpload(
+	ctx context.Context, txn *sql.Tx, pending *types.PendingUpload,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.insertPendingUploadStmt).ExecContext(
+		ctx,
+		pending.MediaID,
+		pending.Origin,
+		pending.UserID,
+		pending.CreationTimestamp,
+		pending.ExpiresTimestamp,
+	)
+	return err
+}
+
+func (s *pendingUploadsStatements) SelectPendingUpload(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) (*types.PendingUpload, error) {
+	pending := types.PendingUpload{
+		MediaID: mediaID,
+		Origin:  mediaOrigin,
+	}
+	err := sqlutil.TxStmtContext(ctx, txn, s.selectPendingUploadStmt).QueryRowContext(
+		ctx, pending.MediaID, pending.Origin,
+	).Scan(
+		&pending.UserID,
+		&pending.CreationTimestamp,
+		&pending.ExpiresTimestamp,
+	)
+	return &pending, err
+}
+
+func (s *pendingUploadsStatements) SelectPendingUploadsCount(
+	ctx context.Context, txn *sql.Tx, userID types.MatrixUserID, now gomatrixserverlib.Timestamp,
+) (count int64, err error) {
+	err = sqlutil.TxStmtContext(ctx, txn, s.selectPendingUploadsCountStmt).QueryRowContext(
+		ctx, userID, now,
+	).Scan(&count)
+	return
+}
+
+func (s *pendingUploadsStatements) DeletePendingUpload(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.deletePendingUploadStmt).ExecContext(ctx, mediaID, mediaOrigin)
+	return err
+}
+
+func (s *pendingUploadsStatements) DeleteExpiredPendingUploads(
+	ctx context.Context, txn *sql.Tx, now gomatrixserverlib.Timestamp,
+) (int64, error) {
+	res, err := sqlutil.TxStmtContext(ctx, txn, s.deleteExpiredPendingUploadsStmt).ExecContext(ctx, now)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
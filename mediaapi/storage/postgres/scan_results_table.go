@@ -0,0 +1,91 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/storage/tables"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+)
+
+const scanResultsSchema = `
+-- The mediaapi_scan_results table caches the verdict of the content scanner per file,
+-- so that a file is only scanned once however many media refer to it.
+CREATE TABLE IF NOT EXISTS mediaapi_scan_results (
+    -- Alternate RFC 4648 unpadded base64 encoding string representation of a SHA-256 hash sum of the file data.
+    base64hash TEXT NOT NULL PRIMARY KEY,
+    -- Whether the file may be stored and served.
+    clean BOOLEAN NOT NULL,
+    -- Why the file was rejected, i.e. the name of the detected virus.
+    reason TEXT NOT NULL,
+    -- When the file was scanned in UNIX epoch ms.
+    scanned_ts BIGINT NOT NULL
+);
+`
+
+const upsertScanResultSQL = `
+INSERT INTO mediaapi_scan_results (base64hash, clean, reason, scanned_ts) VALUES ($1, $2, $3, $4)
+    ON CONFLICT (base64hash) DO UPDATE SET clean = $2, reason = $3, scanned_ts = $4
+`
+
+const selectScanResultSQL = `
+SELECT clean, reason, scanned_ts FROM mediaapi_scan_results WHERE base64hash = $1
+`
+
+type scanResultsStatements struct {
+	upsertScanResultStmt *sql.Stmt
+	selectScanResultStmt *sql.Stmt
+}
+
+func NewPostgresScanResultsTable(db *sql.DB) (tables.ScanResults, error) {
+	s := &scanResultsStatements{}
+	_, err := db.Exec(scanResultsSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.upsertScanResultStmt, upsertScanResultSQL},
+		{&s.selectScanResultStmt, selectScanResultSQL},
+	}.Prepare(db)
+}
+
+func (s *scanResultsStatements) UpsertScanResult(
+	ctx context.Context, txn *sql.Tx, result *types.ScanResult,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.upsertScanResultStmt).ExecContext(
+		ctx, result.Base64Hash, result.Clean, result.Reason, result.ScannedTimestamp,
+	)
+	return err
+}
+
+func (s *scanResultsStatements) SelectScanResult(
+	ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash,
+) (*types.ScanResult, error) {
+	result := types.ScanResult{
+		Base64Hash: mediaHash,
+	}
+	err := sqlutil.TxStmtContext(ctx, txn, s.selectScanResultStmt).QueryRowContext(
+		ctx, result.Base64Hash,
+	).Scan(
+		&result.Clean,
+		&result.Reason,
+		&result.ScannedTimestamp,
+	)
+	return &result, err
+}
@@ -18,6 +18,7 @@ package postgres
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"time"
 
 	"github.com/matrix-org/dendrite/internal"
@@ -48,30 +49,44 @@ CREATE TABLE IF NOT EXISTS mediaapi_thumbnail (
     -- The height of the thumbnail
     height INTEGER NOT NULL,
     -- The resize method used to generate the thumbnail. Can be crop or scale.
-    resize_method TEXT NOT NULL
+    resize_method TEXT NOT NULL,
+    -- Whether the thumbnail is animated.
+    animated BOOLEAN NOT NULL DEFAULT FALSE
 );
-CREATE UNIQUE INDEX IF NOT EXISTS mediaapi_thumbnail_index ON mediaapi_thumbnail (media_id, media_origin, width, height, resize_method);
+`
+
+// The unique index is created by the migration below, as it covers a column which
+// databases created before animated thumbnails don't have yet.
+const addThumbnailAnimatedSQL = `
+ALTER TABLE mediaapi_thumbnail ADD COLUMN IF NOT EXISTS animated BOOLEAN NOT NULL DEFAULT FALSE;
+DROP INDEX IF EXISTS mediaapi_thumbnail_index;
+CREATE UNIQUE INDEX IF NOT EXISTS mediaapi_thumbnail_index ON mediaapi_thumbnail (media_id, media_origin, width, height, resize_method, animated);
 `
 
 const insertThumbnailSQL = `
-INSERT INTO mediaapi_thumbnail (media_id, media_origin, content_type, file_size_bytes, creation_ts, width, height, resize_method)
-    VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+INSERT INTO mediaapi_thumbnail (media_id, media_origin, content_type, file_size_bytes, creation_ts, width, height, resize_method, animated)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
 `
 
 // Note: this selects one specific thumbnail
 const selectThumbnailSQL = `
-SELECT content_type, file_size_bytes, creation_ts FROM mediaapi_thumbnail WHERE media_id = $1 AND media_origin = $2 AND width = $3 AND height = $4 AND resize_method = $5
+SELECT content_type, file_size_bytes, creation_ts FROM mediaapi_thumbnail WHERE media_id = $1 AND media_origin = $2 AND width = $3 AND height = $4 AND resize_method = $5 AND animated = $6
 `
 
 // Note: this selects all thumbnails for a media_origin and media_id
 const selectThumbnailsSQL = `
-SELECT content_type, file_size_bytes, creation_ts, width, height, resize_method FROM mediaapi_thumbnail WHERE media_id = $1 AND media_origin = $2 ORDER BY creation_ts ASC
+SELECT content_type, file_size_bytes, creation_ts, width, height, resize_method, animated FROM mediaapi_thumbnail WHERE media_id = $1 AND media_origin = $2 ORDER BY creation_ts ASC
+`
+
+const deleteThumbnailsSQL = `
+DELETE FROM mediaapi_thumbnail WHERE media_id = $1 AND media_origin = $2
 `
 
 type thumbnailStatements struct {
 	insertThumbnailStmt  *sql.Stmt
 	selectThumbnailStmt  *sql.Stmt
 	selectThumbnailsStmt *sql.Stmt
+	deleteThumbnailsStmt *sql.Stmt
 }
 
 func NewPostgresThumbnailsTable(db *sql.DB) (tables.Thumbnails, error) {
@@ -81,10 +96,25 @@ func NewPostgresThumbnailsTable(db *sql.DB) (tables.Thumbnails, error) {
 		return nil, err
 	}
 
+	m := sqlutil.NewMigrator(db)
+	m.AddMigrations(sqlutil.Migration{
+		Version: "mediaapi: add animated thumbnails",
+		Up: func(ctx context.Context, txn *sql.Tx) error {
+			if _, err := txn.ExecContext(ctx, addThumbnailAnimatedSQL); err != nil {
+				return fmt.Errorf("failed to add animated thumbnails: %w", err)
+			}
+			return nil
+		},
+	})
+	if err = m.Up(context.Background()); err != nil {
+		return nil, err
+	}
+
 	return s, sqlutil.StatementList{
 		{&s.insertThumbnailStmt, insertThumbnailSQL},
 		{&s.selectThumbnailStmt, selectThumbnailSQL},
 		{&s.selectThumbnailsStmt, selectThumbnailsSQL},
+		{&s.deleteThumbnailsStmt, deleteThumbnailsSQL},
 	}.Prepare(db)
 }
 
@@ -102,6 +132,7 @@ func (s *thumbnailStatements) InsertThumbnail(
 		thumbnailMetadata.ThumbnailSize.Width,
 		thumbnailMetadata.ThumbnailSize.Height,
 		thumbnailMetadata.ThumbnailSize.ResizeMethod,
+		thumbnailMetadata.ThumbnailSize.Animated,
 	)
 	return err
 }
@@ -113,6 +144,7 @@ func (s *thumbnailStatements) SelectThumbnail(
 	mediaOrigin gomatrixserverlib.ServerName,
 	width, height int,
 	resizeMethod string,
+	animated bool,
 ) (*types.ThumbnailMetadata, error) {
 	thumbnailMetadata := types.ThumbnailMetadata{
 		MediaMetadata: &types.MediaMetadata{
@@ -123,6 +155,7 @@ func (s *thumbnailStatements) SelectThumbnail(
 			Width:        width,
 			Height:       height,
 			ResizeMethod: resizeMethod,
+			Animated:     animated,
 		},
 	}
 	err := sqlutil.TxStmtContext(ctx, txn, s.selectThumbnailStmt).QueryRowContext(
@@ -132,6 +165,7 @@ func (s *thumbnailStatements) SelectThumbnail(
 		thumbnailMetadata.ThumbnailSize.Width,
 		thumbnailMetadata.ThumbnailSize.Height,
 		thumbnailMetadata.ThumbnailSize.ResizeMethod,
+		thumbnailMetadata.ThumbnailSize.Animated,
 	).Scan(
 		&thumbnailMetadata.MediaMetadata.ContentType,
 		&thumbnailMetadata.MediaMetadata.FileSizeBytes,
@@ -166,6 +200,7 @@ func (s *thumbnailStatements) SelectThumbnails(
 			&thumbnailMetadata.ThumbnailSize.Width,
 			&thumbnailMetadata.ThumbnailSize.Height,
 			&thumbnailMetadata.ThumbnailSize.ResizeMethod,
+			&thumbnailMetadata.ThumbnailSize.Animated,
 		)
 		if err != nil {
 			return nil, err
@@ -175,3 +210,10 @@ func (s *thumbnailStatements) SelectThumbnails(
 
 	return thumbnails, rows.Err()
 }
+
+func (s *thumbnailStatements) DeleteThumbnails(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.deleteThumbnailsStmt).ExecContext(ctx, mediaID, mediaOrigin)
+	return err
+}
@@ -17,6 +17,7 @@ package shared
 import (
 	"context"
 	"database/sql"
+	"time"
 
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/mediaapi/storage/tables"
@@ -25,17 +26,115 @@ import (
 )
 
 type Database struct {
-	DB              *sql.DB
-	Writer          sqlutil.Writer
-	MediaRepository tables.MediaRepository
-	Thumbnails      tables.Thumbnails
+	DB               *sql.DB
+	Writer           sqlutil.Writer
+	MediaRepository  tables.MediaRepository
+	Blobs            tables.Blobs
+	UserUsage        tables.UserUsage
+	Thumbnails       tables.Thumbnails
+	PendingUploads   tables.PendingUploads
+	QuarantinedMedia tables.QuarantinedMedia
+	RoomMedia        tables.RoomMedia
+	MediaAudit       tables.MediaAudit
+	ImageMetadata    tables.ImageMetadata
+	ScanResults      tables.ScanResults
+	URLPreviews      tables.URLPreviews
 }
 
-// StoreMediaMetadata inserts the metadata about the uploaded media into the database.
+// StoreMediaMetadata inserts the metadata about the uploaded media into the database
+// and counts the reference to the stored file, and the file size towards the usage of the uploader.
 // Returns an error if the combination of MediaID and Origin are not unique in the table.
 func (d Database) StoreMediaMetadata(ctx context.Context, mediaMetadata *types.MediaMetadata) error {
 	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
-		return d.MediaRepository.InsertMedia(ctx, txn, mediaMetadata)
+		if err := d.MediaRepository.InsertMedia(ctx, txn, mediaMetadata); err != nil {
+			return err
+		}
+		if mediaMetadata.UserID != "" {
+			if err := d.UserUsage.AddUserUsage(ctx, txn, mediaMetadata.UserID, int64(mediaMetadata.FileSizeBytes)); err != nil {
+				return err
+			}
+		}
+		return d.Blobs.InsertBlobReference(ctx, txn, mediaMetadata.Base64Hash)
+	})
+}
+
+// GetUserUsage returns the total size of the media uploaded by the user in bytes.
+func (d Database) GetUserUsage(ctx context.Context, userID types.MatrixUserID) (int64, error) {
+	usedBytes, err := d.UserUsage.SelectUserUsage(ctx, nil, userID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return usedBytes, err
+}
+
+// GetMediaMetadataForUser returns metadata about all media uploaded by the user, oldest first.
+func (d Database) GetMediaMetadataForUser(ctx context.Context, userID types.MatrixUserID) ([]*types.MediaMetadata, error) {
+	return d.MediaRepository.SelectMediaByUser(ctx, nil, userID)
+}
+
+// GetRemoteMediaMetadataCreatedBefore returns metadata about at most limit media of other origins than
+// localOrigin stored before the timestamp, oldest first, skipping the first offset.
+func (d Database) GetRemoteMediaMetadataCreatedBefore(
+	ctx context.Context, localOrigin gomatrixserverlib.ServerName, ts gomatrixserverlib.Timestamp, limit, offset int,
+) ([]*types.MediaMetadata, error) {
+	return d.MediaRepository.SelectRemoteMediaCreatedBefore(ctx, nil, localOrigin, ts, limit, offset)
+}
+
+// GetTimedOutMediaMetadata returns metadata about all media whose file timed out, oldest first.
+// A file times out once no media was stored for it since the timestamp, a file which is still
+// being stored again keeps all media referring to it.
+func (d Database) GetTimedOutMediaMetadata(ctx context.Context, ts gomatrixserverlib.Timestamp) ([]*types.MediaMetadata, error) {
+	return d.MediaRepository.SelectTimedOutMedia(ctx, nil, ts)
+}
+
+// DeleteMediaMetadata removes the metadata of the media and its thumbnails, the reference
+// to the stored file and its size from the usage of the uploader. The file itself is not
+// touched, unreferenced is true if no other media refers to it any more and it can be
+// removed from the store.
+// Returns nil metadata if there is no metadata associated with this media.
+func (d Database) DeleteMediaMetadata(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) (mediaMetadata *types.MediaMetadata, unreferenced bool, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		mediaMetadata, err = d.MediaRepository.SelectMedia(ctx, txn, mediaID, mediaOrigin)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				mediaMetadata = nil
+				return nil
+			}
+			return err
+		}
+		if err = d.MediaRepository.DeleteMedia(ctx, txn, mediaID, mediaOrigin); err != nil {
+			return err
+		}
+		if err = d.Thumbnails.DeleteThumbnails(ctx, txn, mediaID, mediaOrigin); err != nil {
+			return err
+		}
+		if mediaMetadata.UserID != "" {
+			if err = d.UserUsage.AddUserUsage(ctx, txn, mediaMetadata.UserID, -int64(mediaMetadata.FileSizeBytes)); err != nil {
+				return err
+			}
+		}
+		var remaining int64
+		remaining, err = d.Blobs.DeleteBlobReference(ctx, txn, mediaMetadata.Base64Hash)
+		unreferenced = remaining == 0
+		return err
+	})
+	return
+}
+
+// GetBlobRefCounts returns the stored reference count of each file.
+func (d Database) GetBlobRefCounts(ctx context.Context) (map[types.Base64Hash]int64, error) {
+	return d.Blobs.SelectBlobRefCounts(ctx, nil)
+}
+
+// GetMediaHashCounts returns the number of media referring to each file, as counted from the media metadata.
+func (d Database) GetMediaHashCounts(ctx context.Context) (map[types.Base64Hash]int64, error) {
+	return d.MediaRepository.SelectMediaHashCounts(ctx, nil)
+}
+
+// RepairBlobRefCounts replaces the stored reference counts with the ones counted from the media metadata.
+func (d Database) RepairBlobRefCounts(ctx context.Context) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.Blobs.ResetBlobRefCounts(ctx, txn)
 	})
 }
 
@@ -72,8 +171,8 @@ func (d Database) StoreThumbnail(ctx context.Context, thumbnailMetadata *types.T
 // GetThumbnail returns metadata about a specific thumbnail.
 // The media could have been uploaded to this server or fetched from another server and cached here.
 // Returns nil metadata if there is no metadata associated with this thumbnail.
-func (d Database) GetThumbnail(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, width, height int, resizeMethod string) (*types.ThumbnailMetadata, error) {
-	metadata, err := d.Thumbnails.SelectThumbnail(ctx, nil, mediaID, mediaOrigin, width, height, resizeMethod)
+func (d Database) GetThumbnail(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, width, height int, resizeMethod string, animated bool) (*types.ThumbnailMetadata, error) {
+	metadata, err := d.Thumbnails.SelectThumbnail(ctx, nil, mediaID, mediaOrigin, width, height, resizeMethod, animated)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
@@ -96,3 +195,180 @@ func (d Database) GetThumbnails(ctx context.Context, mediaID types.MediaID, medi
 	}
 	return metadatas, err
 }
+
+// StorePendingUpload reserves a media ID for content to be uploaded later.
+// Returns an error if the media ID is already reserved.
+func (d Database) StorePendingUpload(ctx context.Context, pending *types.PendingUpload) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.PendingUploads.InsertPendingUpload(ctx, txn, pending)
+	})
+}
+
+// GetPendingUpload returns the reservation of the media ID, which may have expired.
+// Returns nil if the media ID is not reserved, i.e. because its content was uploaded.
+func (d Database) GetPendingUpload(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) (*types.PendingUpload, error) {
+	pending, err := d.PendingUploads.SelectPendingUpload(ctx, nil, mediaID, mediaOrigin)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return pending, nil
+}
+
+// CountPendingUploads returns the number of reservations of the user which have not expired yet.
+func (d Database) CountPendingUploads(ctx context.Context, userID types.MatrixUserID, now gomatrixserverlib.Timestamp) (int64, error) {
+	return d.PendingUploads.SelectPendingUploadsCount(ctx, nil, userID, now)
+}
+
+// DeletePendingUpload removes the reservation of the media ID once its content was uploaded.
+func (d Database) DeletePendingUpload(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.PendingUploads.DeletePendingUpload(ctx, txn, mediaID, mediaOrigin)
+	})
+}
+
+// DeleteExpiredPendingUploads removes the reservations which expired before now.
+// Returns the number of removed reservations.
+func (d Database) DeleteExpiredPendingUploads(ctx context.Context, now gomatrixserverlib.Timestamp) (count int64, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		count, err = d.PendingUploads.DeleteExpiredPendingUploads(ctx, txn, now)
+		return err
+	})
+	return
+}
+
+// QuarantineMedia hides the media from downloads, the stored file is kept.
+// Returns false if the media was already quarantined.
+func (d Database) QuarantineMedia(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, userID types.MatrixUserID) (quarantined bool, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		quarantined, err = d.QuarantinedMedia.InsertQuarantinedMedia(ctx, txn, mediaID, mediaOrigin, userID, gomatrixserverlib.AsTimestamp(time.Now()))
+		return err
+	})
+	return
+}
+
+// QuarantineRoomMedia quarantines all media referred to in the room.
+// Returns the number of media which were not quarantined before.
+func (d Database) QuarantineRoomMedia(ctx context.Context, roomID string, userID types.MatrixUserID) (count int64, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		media, err := d.RoomMedia.SelectRoomMedia(ctx, txn, roomID)
+		if err != nil {
+			return err
+		}
+		now := gomatrixserverlib.AsTimestamp(time.Now())
+		for _, m := range media {
+			quarantined, err := d.QuarantinedMedia.InsertQuarantinedMedia(ctx, txn, m.MediaID, m.Origin, userID, now)
+			if err != nil {
+				return err
+			}
+			if quarantined {
+				count++
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// IsMediaQuarantined returns true if the media was quarantined by an admin.
+func (d Database) IsMediaQuarantined(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) (bool, error) {
+	return d.QuarantinedMedia.SelectQuarantinedMedia(ctx, nil, mediaID, mediaOrigin)
+}
+
+// GetUserMedia returns the media uploaded by the user and whether each was quarantined, oldest first.
+func (d Database) GetUserMedia(ctx context.Context, userID types.MatrixUserID) ([]*types.UserMedia, error) {
+	return d.MediaRepository.SelectUserMediaWithQuarantine(ctx, nil, userID)
+}
+
+// StoreRoomMedia records that the media is referred to in the room.
+func (d Database) StoreRoomMedia(ctx context.Context, roomID string, media []*types.MediaMetadata) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		for _, m := range media {
+			if err := d.RoomMedia.InsertRoomMedia(ctx, txn, roomID, m.MediaID, m.Origin); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetRoomMedia returns the media referred to in the room, only MediaID and Origin are set.
+func (d Database) GetRoomMedia(ctx context.Context, roomID string) ([]*types.MediaMetadata, error) {
+	return d.RoomMedia.SelectRoomMedia(ctx, nil, roomID)
+}
+
+// StoreMediaAuditEntry records an action a server admin took on media.
+func (d Database) StoreMediaAuditEntry(ctx context.Context, entry *types.MediaAuditEntry) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.MediaAudit.InsertMediaAudit(ctx, txn, entry)
+	})
+}
+
+// GetMediaAuditLog returns the latest actions server admins took on media, newest first.
+func (d Database) GetMediaAuditLog(ctx context.Context, limit int) ([]*types.MediaAuditEntry, error) {
+	return d.MediaAudit.SelectMediaAudit(ctx, nil, limit)
+}
+
+// StoreImageMetadata stores the size and blurhash of an image file. Files never change,
+// so metadata stored earlier for the same file is kept.
+func (d Database) StoreImageMetadata(ctx context.Context, meta *types.ImageMetadata) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.ImageMetadata.InsertImageMetadata(ctx, txn, meta)
+	})
+}
+
+// GetImageMetadata returns the size and blurhash of an image file.
+// Returns nil if there is none, i.e. because the file is not an image.
+func (d Database) GetImageMetadata(ctx context.Context, mediaHash types.Base64Hash) (*types.ImageMetadata, error) {
+	meta, err := d.ImageMetadata.SelectImageMetadata(ctx, nil, mediaHash)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return meta, nil
+}
+
+// StoreScanResult caches the verdict of the content scanner on a file, replacing an earlier one.
+func (d Database) StoreScanResult(ctx context.Context, result *types.ScanResult) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.ScanResults.UpsertScanResult(ctx, txn, result)
+	})
+}
+
+// GetScanResult returns the cached verdict of the content scanner on a file.
+// Returns nil if the file was not scanned yet.
+func (d Database) GetScanResult(ctx context.Context, mediaHash types.Base64Hash) (*types.ScanResult, error) {
+	result, err := d.ScanResults.SelectScanResult(ctx, nil, mediaHash)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return result, nil
+}
+
+// StoreURLPreview caches a URL preview. If a preview for the same URL and time bucket
+// was stored concurrently, the existing one is kept.
+func (d Database) StoreURLPreview(ctx context.Context, preview *types.URLPreview) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.URLPreviews.InsertURLPreview(ctx, txn, preview)
+	})
+}
+
+// GetURLPreview returns the cached preview of the URL for the given time bucket.
+// Returns nil if there is no cached preview.
+func (d Database) GetURLPreview(ctx context.Context, url string, bucketTS gomatrixserverlib.Timestamp) (*types.URLPreview, error) {
+	preview, err := d.URLPreviews.SelectURLPreview(ctx, nil, url, bucketTS)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return preview, nil
+}
@@ -0,0 +1,156 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/storage/tables"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+)
+
+const blobsSchema = `
+-- The mediaapi_blobs table counts the media referring to each stored file. Files are
+-- deduplicated by hash, so the same file can be shared by many media IDs and origins.
+-- A file and its thumbnails may only be removed from the store once nothing refers to it.
+CREATE TABLE IF NOT EXISTS mediaapi_blobs (
+    -- Alternate RFC 4648 unpadded base64 encoding string representation of a SHA-256 hash sum of the file data.
+    base64hash TEXT NOT NULL PRIMARY KEY,
+    -- The number of rows in mediaapi_media_repository with this hash.
+    ref_count INTEGER NOT NULL
+);
+`
+
+const insertBlobReferenceSQL = `
+INSERT INTO mediaapi_blobs (base64hash, ref_count) VALUES ($1, 1)
+    ON CONFLICT (base64hash) DO UPDATE SET ref_count = mediaapi_blobs.ref_count + 1
+`
+
+const decrementBlobReferenceSQL = `
+UPDATE mediaapi_blobs SET ref_count = ref_count - 1 WHERE base64hash = $1
+`
+
+const selectBlobRefCountSQL = `
+SELECT ref_count FROM mediaapi_blobs WHERE base64hash = $1
+`
+
+const deleteBlobSQL = `
+DELETE FROM mediaapi_blobs WHERE base64hash = $1
+`
+
+const selectBlobRefCountsSQL = `
+SELECT base64hash, ref_count FROM mediaapi_blobs
+`
+
+// Recounts the references from the media repository, used for existing databases and repairs
+const resetBlobRefCountsSQL = `
+DELETE FROM mediaapi_blobs;
+INSERT INTO mediaapi_blobs (base64hash, ref_count)
+    SELECT base64hash, COUNT(*) FROM mediaapi_media_repository GROUP BY base64hash;
+`
+
+type blobsStatements struct {
+	insertBlobReferenceStmt    *sql.Stmt
+	decrementBlobReferenceStmt *sql.Stmt
+	selectBlobRefCountStmt     *sql.Stmt
+	deleteBlobStmt             *sql.Stmt
+	selectBlobRefCountsStmt    *sql.Stmt
+}
+
+// NewSQLiteBlobsTable creates the table. The media repository table must already exist,
+// the reference counts of existing media are populated from it.
+func NewSQLiteBlobsTable(db *sql.DB) (tables.Blobs, error) {
+	s := &blobsStatements{}
+	_, err := db.Exec(blobsSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	m := sqlutil.NewMigrator(db)
+	m.AddMigrations(sqlutil.Migration{
+		Version: "mediaapi: populate blob reference counts",
+		Up: func(ctx context.Context, txn *sql.Tx) error {
+			if _, err := txn.ExecContext(ctx, resetBlobRefCountsSQL); err != nil {
+				return fmt.Errorf("failed to populate blob reference counts: %w", err)
+			}
+			return nil
+		},
+	})
+	if err = m.Up(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.insertBlobReferenceStmt, insertBlobReferenceSQL},
+		{&s.decrementBlobReferenceStmt, decrementBlobReferenceSQL},
+		{&s.selectBlobRefCountStmt, selectBlobRefCountSQL},
+		{&s.deleteBlobStmt, deleteBlobSQL},
+		{&s.selectBlobRefCountsStmt, selectBlobRefCountsSQL},
+	}.Prepare(db)
+}
+
+func (s *blobsStatements) InsertBlobReference(
+	ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.insertBlobReferenceStmt).ExecContext(ctx, mediaHash)
+	return err
+}
+
+func (s *blobsStatements) DeleteBlobReference(
+	ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash,
+) (remaining int64, err error) {
+	if _, err = sqlutil.TxStmtContext(ctx, txn, s.decrementBlobReferenceStmt).ExecContext(ctx, mediaHash); err != nil {
+		return 0, err
+	}
+	err = sqlutil.TxStmtContext(ctx, txn, s.selectBlobRefCountStmt).QueryRowContext(ctx, mediaHash).Scan(&remaining)
+	if err == sql.ErrNoRows {
+		// Nothing was counted for the file, treat it as unreferenced
+		return 0, nil
+	}
+	if err != nil || remaining > 0 {
+		return remaining, err
+	}
+	_, err = sqlutil.TxStmtContext(ctx, txn, s.deleteBlobStmt).ExecContext(ctx, mediaHash)
+	return 0, err
+}
+
+func (s *blobsStatements) SelectBlobRefCounts(
+	ctx context.Context, txn *sql.Tx,
+) (map[types.Base64Hash]int64, error) {
+	rows, err := sqlutil.TxStmtContext(ctx, txn, s.selectBlobRefCountsStmt).QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectBlobRefCounts: rows.close() failed")
+	counts := map[types.Base64Hash]int64{}
+	for rows.Next() {
+		var hash types.Base64Hash
+		var count int64
+		if err = rows.Scan(&hash, &count); err != nil {
+			return nil, err
+		}
+		counts[hash] = count
+	}
+	return counts, rows.Err()
+}
+
+func (s *blobsStatements) ResetBlobRefCounts(ctx context.Context, txn *sql.Tx) error {
+	_, err := txn.ExecContext(ctx, resetBlobRefCountsSQL)
+	return err
+}
@@ -0,0 +1,96 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/storage/tables"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+)
+
+const mediaAuditSchema = `
+-- The mediaapi_media_audit table records the actions server admins took on media.
+CREATE TABLE IF NOT EXISTS mediaapi_media_audit (
+    audit_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    -- The admin who took the action.
+    user_id TEXT NOT NULL,
+    -- The action, e.g. quarantine_media.
+    action TEXT NOT NULL,
+    -- The user ID, room ID or mxc URI the action was taken on.
+    target TEXT NOT NULL,
+    -- The number of media affected by the action.
+    affected INTEGER NOT NULL,
+    -- When the action was taken in UNIX epoch ms.
+    audit_ts INTEGER NOT NULL
+);
+`
+
+const insertMediaAuditSQL = `
+INSERT INTO mediaapi_media_audit (user_id, action, target, affected, audit_ts) VALUES ($1, $2, $3, $4, $5)
+`
+
+const selectMediaAuditSQL = `
+SELECT user_id, action, target, affected, audit_ts FROM mediaapi_media_audit ORDER BY audit_id DESC LIMIT $1
+`
+
+type mediaAuditStatements struct {
+	insertMediaAuditStmt *sql.Stmt
+	selectMediaAuditStmt *sql.Stmt
+}
+
+func NewSQLiteMediaAuditTable(db *sql.DB) (tables.MediaAudit, error) {
+	s := &mediaAuditStatements{}
+	_, err := db.Exec(mediaAuditSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.insertMediaAuditStmt, insertMediaAuditSQL},
+		{&s.selectMediaAuditStmt, selectMediaAuditSQL},
+	}.Prepare(db)
+}
+
+func (s *mediaAuditStatements) InsertMediaAudit(
+	ctx context.Context, txn *sql.Tx, entry *types.MediaAuditEntry,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.insertMediaAuditStmt).ExecContext(
+		ctx, entry.UserID, entry.Action, entry.Target, entry.Affected, entry.Timestamp,
+	)
+	return err
+}
+
+func (s *mediaAuditStatements) SelectMediaAudit(
+	ctx context.Context, txn *sql.Tx, limit int,
+) ([]*types.MediaAuditEntry, error) {
+	rows, err := sqlutil.TxStmtContext(ctx, txn, s.selectMediaAuditStmt).QueryContext(ctx, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectMediaAudit: rows.close() failed")
+	var entries []*types.MediaAuditEntry
+	for rows.Next() {
+		entry := &types.MediaAuditEntry{}
+		if err = rows.Scan(&entry.UserID, &entry.Action, &entry.Target, &entry.Affected, &entry.Timestamp); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
@@ -33,14 +33,59 @@ func NewDatabase(base *base.BaseDendrite, dbProperties *config.DatabaseOptions)
 	if err != nil {
 		return nil, err
 	}
+	blobs, err := NewSQLiteBlobsTable(db)
+	if err != nil {
+		return nil, err
+	}
+	userUsage, err := NewSQLiteUserUsageTable(db)
+	if err != nil {
+		return nil, err
+	}
 	thumbnails, err := NewSQLiteThumbnailsTable(db)
 	if err != nil {
 		return nil, err
 	}
+	pendingUploads, err := NewSQLitePendingUploadsTable(db)
+	if err != nil {
+		return nil, err
+	}
+	quarantinedMedia, err := NewSQLiteQuarantinedMediaTable(db)
+	if err != nil {
+		return nil, err
+	}
+	roomMedia, err := NewSQLiteRoomMediaTable(db)
+	if err != nil {
+		return nil, err
+	}
+	mediaAudit, err := NewSQLiteMediaAuditTable(db)
+	if err != nil {
+		return nil, err
+	}
+	imageMetadata, err := NewSQLiteImageMetadataTable(db)
+	if err != nil {
+		return nil, err
+	}
+	scanResults, err := NewSQLiteScanResultsTable(db)
+	if err != nil {
+		return nil, err
+	}
+	urlPreviews, err := NewSQLiteURLPreviewsTable(db)
+	if err != nil {
+		return nil, err
+	}
 	return &shared.Database{
-		MediaRepository: mediaRepo,
-		Thumbnails:      thumbnails,
-		DB:              db,
-		Writer:          writer,
+		MediaRepository:  mediaRepo,
+		Blobs:            blobs,
+		UserUsage:        userUsage,
+		Thumbnails:       thumbnails,
+		PendingUploads:   pendingUploads,
+		QuarantinedMedia: quarantinedMedia,
+		RoomMedia:        roomMedia,
+		MediaAudit:       mediaAudit,
+		ImageMetadata:    imageMetadata,
+		ScanResults:      scanResults,
+		URLPreviews:      urlPreviews,
+		DB:               db,
+		Writer:           writer,
 	}, nil
 }
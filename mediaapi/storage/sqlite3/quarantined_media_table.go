@@ -0,0 +1,88 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/storage/tables"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const quarantinedMediaSchema = `
+-- The mediaapi_quarantined_media table holds the media quarantined by a server admin.
+-- Quarantined media can't be downloaded, but the file is kept. Media which has not been
+-- fetched from a remote server yet can be quarantined too.
+CREATE TABLE IF NOT EXISTS mediaapi_quarantined_media (
+    media_id TEXT NOT NULL,
+    media_origin TEXT NOT NULL,
+    -- The admin who quarantined the media.
+    quarantined_by TEXT NOT NULL,
+    -- When the media was quarantined in UNIX epoch ms.
+    quarantined_ts INTEGER NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS mediaapi_quarantined_media_index ON mediaapi_quarantined_media (media_id, media_origin);
+`
+
+const insertQuarantinedMediaSQL = `
+INSERT INTO mediaapi_quarantined_media (media_id, media_origin, quarantined_by, quarantined_ts)
+    VALUES ($1, $2, $3, $4)
+    ON CONFLICT (media_id, media_origin) DO NOTHING
+`
+
+const selectQuarantinedMediaSQL = `
+SELECT COUNT(*) FROM mediaapi_quarantined_media WHERE media_id = $1 AND media_origin = $2
+`
+
+type quarantinedMediaStatements struct {
+	insertQuarantinedMediaStmt *sql.Stmt
+	selectQuarantinedMediaStmt *sql.Stmt
+}
+
+func NewSQLiteQuarantinedMediaTable(db *sql.DB) (tables.QuarantinedMedia, error) {
+	s := &quarantinedMediaStatements{}
+	_, err := db.Exec(quarantinedMediaSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.insertQuarantinedMediaStmt, insertQuarantinedMediaSQL},
+		{&s.selectQuarantinedMediaStmt, selectQuarantinedMediaSQL},
+	}.Prepare(db)
+}
+
+func (s *quarantinedMediaStatements) InsertQuarantinedMedia(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+	userID types.MatrixUserID, ts gomatrixserverlib.Timestamp,
+) (bool, error) {
+	res, err := sqlutil.TxStmtContext(ctx, txn, s.insertQuarantinedMediaStmt).ExecContext(ctx, mediaID, mediaOrigin, userID, ts)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
+
+func (s *quarantinedMediaStatements) SelectQuarantinedMedia(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) (bool, error) {
+	var count int64
+	err := sqlutil.TxStmtContext(ctx, txn, s.selectQuarantinedMediaStmt).QueryRowContext(ctx, mediaID, mediaOrigin).Scan(&count)
+	return count > 0, err
+}
@@ -0,0 +1,90 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/storage/tables"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const roomMediaSchema = `
+-- The mediaapi_room_media table records which media is referred to by events in which room,
+-- so that all media of a room can be found. Only events received by the media API are recorded.
+CREATE TABLE IF NOT EXISTS mediaapi_room_media (
+    room_id TEXT NOT NULL,
+    media_id TEXT NOT NULL,
+    media_origin TEXT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS mediaapi_room_media_index ON mediaapi_room_media (room_id, media_id, media_origin);
+`
+
+const insertRoomMediaSQL = `
+INSERT INTO mediaapi_room_media (room_id, media_id, media_origin) VALUES ($1, $2, $3)
+    ON CONFLICT (room_id, media_id, media_origin) DO NOTHING
+`
+
+const selectRoomMediaSQL = `
+SELECT media_id, media_origin FROM mediaapi_room_media WHERE room_id = $1
+`
+
+type roomMediaStatements struct {
+	insertRoomMediaStmt *sql.Stmt
+	selectRoomMediaStmt *sql.Stmt
+}
+
+func NewSQLiteRoomMediaTable(db *sql.DB) (tables.RoomMedia, error) {
+	s := &roomMediaStatements{}
+	_, err := db.Exec(roomMediaSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.insertRoomMediaStmt, insertRoomMediaSQL},
+		{&s.selectRoomMediaStmt, selectRoomMediaSQL},
+	}.Prepare(db)
+}
+
+func (s *roomMediaStatements) InsertRoomMedia(
+	ctx context.Context, txn *sql.Tx, roomID string, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.insertRoomMediaStmt).ExecContext(ctx, roomID, mediaID, mediaOrigin)
+	return err
+}
+
+func (s *roomMediaStatements) SelectRoomMedia(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) ([]*types.MediaMetadata, error) {
+	rows, err := sqlutil.TxStmtContext(ctx, txn, s.selectRoomMediaStmt).QueryContext(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectRoomMedia: rows.close() failed")
+	var media []*types.MediaMetadata
+	for rows.Next() {
+		mediaMetadata := &types.MediaMetadata{}
+		if err = rows.Scan(&mediaMetadata.MediaID, &mediaMetadata.Origin); err != nil {
+			return nil, err
+		}
+		media = append(media, mediaMetadata)
+	}
+	return media, rows.Err()
+}
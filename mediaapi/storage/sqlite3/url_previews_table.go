@@ -0,0 +1,102 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/storage/tables"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const urlPreviewsSchema = `
+-- The mediaapi_url_previews table caches the OpenGraph data returned by /preview_url.
+-- Preview images are stored in the media repository like any other media.
+CREATE TABLE IF NOT EXISTS mediaapi_url_previews (
+    -- The URL which was previewed.
+    url TEXT NOT NULL,
+    -- Start of the time bucket the preview belongs to in UNIX epoch ms.
+    bucket_ts INTEGER NOT NULL,
+    -- The OpenGraph JSON object returned to clients.
+    response TEXT NOT NULL,
+    -- When the preview was generated in UNIX epoch ms.
+    creation_ts INTEGER NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS mediaapi_url_previews_index ON mediaapi_url_previews (url, bucket_ts);
+`
+
+const insertURLPreviewSQL = `
+INSERT INTO mediaapi_url_previews (url, bucket_ts, response, creation_ts)
+    VALUES ($1, $2, $3, $4)
+    ON CONFLICT (url, bucket_ts) DO NOTHING
+`
+
+const selectURLPreviewSQL = `
+SELECT response, creation_ts FROM mediaapi_url_previews WHERE url = $1 AND bucket_ts = $2
+`
+
+type urlPreviewsStatements struct {
+	insertURLPreviewStmt *sql.Stmt
+	selectURLPreviewStmt *sql.Stmt
+}
+
+func NewSQLiteURLPreviewsTable(db *sql.DB) (tables.URLPreviews, error) {
+	s := &urlPreviewsStatements{}
+	_, err := db.Exec(urlPreviewsSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.insertURLPreviewStmt, insertURLPreviewSQL},
+		{&s.selectURLPreviewStmt, selectURLPreviewSQL},
+	}.Prepare(db)
+}
+
+func (s *urlPreviewsStatements) InsertURLPreview(
+	ctx context.Context, txn *sql.Tx, preview *types.URLPreview,
+) error {
+	preview.CreationTimestamp = gomatrixserverlib.AsTimestamp(time.Now())
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.insertURLPreviewStmt).ExecContext(
+		ctx,
+		preview.URL,
+		preview.BucketTimestamp,
+		string(preview.Response),
+		preview.CreationTimestamp,
+	)
+	return err
+}
+
+func (s *urlPreviewsStatements) SelectURLPreview(
+	ctx context.Context, txn *sql.Tx, url string, bucketTS gomatrixserverlib.Timestamp,
+) (*types.URLPreview, error) {
+	preview := types.URLPreview{
+		URL:             url,
+		BucketTimestamp: bucketTS,
+	}
+	var response string
+	err := sqlutil.TxStmtContext(ctx, txn, s.selectURLPreviewStmt).QueryRowContext(
+		ctx, preview.URL, preview.BucketTimestamp,
+	).Scan(
+		&response,
+		&preview.CreationTimestamp,
+	)
+	preview.Response = []byte(response)
+	return &preview, err
+}
@@ -0,0 +1,100 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/storage/tables"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+)
+
+const userUsageSchema = `
+-- The mediaapi_user_usage table holds the total size of the media each local user uploaded,
+-- which is compared with their storage quota. Deduplicated files count for every upload.
+CREATE TABLE IF NOT EXISTS mediaapi_user_usage (
+    -- The Matrix user ID of the uploader.
+    user_id TEXT NOT NULL PRIMARY KEY,
+    -- The sum of file_size_bytes of the rows in mediaapi_media_repository uploaded by the user.
+    used_bytes INTEGER NOT NULL
+);
+`
+
+const addUserUsageSQL = `
+INSERT INTO mediaapi_user_usage (user_id, used_bytes) VALUES ($1, $2)
+    ON CONFLICT (user_id) DO UPDATE SET used_bytes = mediaapi_user_usage.used_bytes + $2
+`
+
+const selectUserUsageSQL = `
+SELECT used_bytes FROM mediaapi_user_usage WHERE user_id = $1
+`
+
+// Sums up the media of all uploaders, used for existing databases
+const resetUserUsageSQL = `
+DELETE FROM mediaapi_user_usage;
+INSERT INTO mediaapi_user_usage (user_id, used_bytes)
+    SELECT user_id, SUM(file_size_bytes) FROM mediaapi_media_repository WHERE user_id <> '' GROUP BY user_id;
+`
+
+type userUsageStatements struct {
+	addUserUsageStmt    *sql.Stmt
+	selectUserUsageStmt *sql.Stmt
+}
+
+// NewSQLiteUserUsageTable creates the table. The media repository table must already exist,
+// the usage of existing media is populated from it.
+func NewSQLiteUserUsageTable(db *sql.DB) (tables.UserUsage, error) {
+	s := &userUsageStatements{}
+	_, err := db.Exec(userUsageSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	m := sqlutil.NewMigrator(db)
+	m.AddMigrations(sqlutil.Migration{
+		Version: "mediaapi: populate user storage usage",
+		Up: func(ctx context.Context, txn *sql.Tx) error {
+			if _, err := txn.ExecContext(ctx, resetUserUsageSQL); err != nil {
+				return fmt.Errorf("failed to populate user storage usage: %w", err)
+			}
+			return nil
+		},
+	})
+	if err = m.Up(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.addUserUsageStmt, addUserUsageSQL},
+		{&s.selectUserUsageStmt, selectUserUsageSQL},
+	}.Prepare(db)
+}
+
+func (s *userUsageStatements) AddUserUsage(
+	ctx context.Context, txn *sql.Tx, userID types.MatrixUserID, bytes int64,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.addUserUsageStmt).ExecContext(ctx, userID, bytes)
+	return err
+}
+
+func (s *userUsageStatements) SelectUserUsage(
+	ctx context.Context, txn *sql.Tx, userID types.MatrixUserID,
+) (usedBytes int64, err error) {
+	err = sqlutil.TxStmtContext(ctx, txn, s.selectUserUsageStmt).QueryRowContext(ctx, userID).Scan(&usedBytes)
+	return
+}
@@ -4,11 +4,13 @@ import (
 	"context"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 func mustCreateDatabase(t *testing.T, dbType test.DBType) (storage.Database, func()) {
@@ -92,6 +94,20 @@ func TestThumbnailsStorage(t *testing.T) {
 						ResizeMethod: types.Scale,
 					},
 				},
+				{
+					MediaMetadata: &types.MediaMetadata{
+						MediaID:       "testing",
+						Origin:        "localhost",
+						ContentType:   "image/gif",
+						FileSizeBytes: 8,
+					},
+					ThumbnailSize: types.ThumbnailSize{
+						Width:        5,
+						Height:       5,
+						ResizeMethod: types.Crop,
+						Animated:     true,
+					},
+				},
 			}
 			for i := range thumbnails {
 				if err := db.StoreThumbnail(ctx, thumbnails[i]); err != nil {
@@ -104,6 +120,7 @@ func TestThumbnailsStorage(t *testing.T) {
 				thumbnails[0].MediaMetadata.Origin,
 				thumbnails[0].ThumbnailSize.Width, thumbnails[0].ThumbnailSize.Height,
 				thumbnails[0].ThumbnailSize.ResizeMethod,
+				thumbnails[0].ThumbnailSize.Animated,
 			)
 			if err != nil {
 				t.Fatalf("unable to query thumbnail metadata: %v", err)
@@ -114,6 +131,20 @@ func TestThumbnailsStorage(t *testing.T) {
 			if !reflect.DeepEqual(thumbnails[0].ThumbnailSize, gotMetadata.ThumbnailSize) {
 				t.Fatalf("expected metadata %+v, got %+v", thumbnails[0].MediaMetadata, gotMetadata.MediaMetadata)
 			}
+			// the animated variant of the same size is stored separately
+			gotMetadata, err = db.GetThumbnail(ctx,
+				thumbnails[2].MediaMetadata.MediaID,
+				thumbnails[2].MediaMetadata.Origin,
+				thumbnails[2].ThumbnailSize.Width, thumbnails[2].ThumbnailSize.Height,
+				thumbnails[2].ThumbnailSize.ResizeMethod,
+				thumbnails[2].ThumbnailSize.Animated,
+			)
+			if err != nil {
+				t.Fatalf("unable to query animated thumbnail metadata: %v", err)
+			}
+			if !reflect.DeepEqual(thumbnails[2].MediaMetadata, gotMetadata.MediaMetadata) {
+				t.Fatalf("expected metadata %+v, got %+v", thumbnails[2].MediaMetadata, gotMetadata.MediaMetadata)
+			}
 			// query by all thumbnails
 			gotMediadatas, err := db.GetThumbnails(ctx, thumbnails[0].MediaMetadata.MediaID, thumbnails[0].MediaMetadata.Origin)
 			if err != nil {
@@ -141,3 +172,325 @@ func TestThumbnailsStorage(t *testing.T) {
 		})
 	})
 }
+
+func TestURLPreviewsStorage(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateDatabase(t, dbType)
+		defer close()
+		ctx := context.Background()
+		t.Run("can insert URL previews & query them", func(t *testing.T) {
+			preview := &types.URLPreview{
+				URL:             "https://example.com",
+				BucketTimestamp: 3600000,
+				Response:        []byte(`{"og:title":"Example"}`),
+			}
+			if err := db.StoreURLPreview(ctx, preview); err != nil {
+				t.Fatalf("unable to store URL preview: %v", err)
+			}
+			// storing the same URL and bucket again must not fail
+			if err := db.StoreURLPreview(ctx, &types.URLPreview{
+				URL:             preview.URL,
+				BucketTimestamp: preview.BucketTimestamp,
+				Response:        []byte(`{}`),
+			}); err != nil {
+				t.Fatalf("unable to store duplicate URL preview: %v", err)
+			}
+			gotPreview, err := db.GetURLPreview(ctx, preview.URL, preview.BucketTimestamp)
+			if err != nil {
+				t.Fatalf("unable to query URL preview: %v", err)
+			}
+			if !reflect.DeepEqual(preview, gotPreview) {
+				t.Fatalf("expected preview %+v, got %+v", preview, gotPreview)
+			}
+			// a different time bucket is not cached
+			gotPreview, err = db.GetURLPreview(ctx, preview.URL, 2*preview.BucketTimestamp)
+			if err != nil {
+				t.Fatalf("unable to query URL preview: %v", err)
+			}
+			if gotPreview != nil {
+				t.Fatalf("expected no preview, got %+v", gotPreview)
+			}
+		})
+	})
+}
+
+func TestPendingUploadsStorage(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateDatabase(t, dbType)
+		defer close()
+		ctx := context.Background()
+		t.Run("can reserve media IDs, count and expire them", func(t *testing.T) {
+			pending := []*types.PendingUpload{
+				{MediaID: "first", Origin: "localhost", UserID: "@alice:localhost", CreationTimestamp: 1000, ExpiresTimestamp: 2000},
+				{MediaID: "second", Origin: "localhost", UserID: "@alice:localhost", CreationTimestamp: 1000, ExpiresTimestamp: 5000},
+				{MediaID: "third", Origin: "localhost", UserID: "@bob:localhost", CreationTimestamp: 1000, ExpiresTimestamp: 5000},
+			}
+			for _, p := range pending {
+				if err := db.StorePendingUpload(ctx, p); err != nil {
+					t.Fatalf("unable to store pending upload: %v", err)
+				}
+			}
+			// reserving the same media ID twice must fail
+			if err := db.StorePendingUpload(ctx, pending[0]); err == nil {
+				t.Fatalf("expected error storing duplicate pending upload")
+			}
+			got, err := db.GetPendingUpload(ctx, pending[1].MediaID, pending[1].Origin)
+			if err != nil {
+				t.Fatalf("unable to query pending upload: %v", err)
+			}
+			if !reflect.DeepEqual(pending[1], got) {
+				t.Fatalf("expected pending upload %+v, got %+v", pending[1], got)
+			}
+			count, err := db.CountPendingUploads(ctx, "@alice:localhost", 3000)
+			if err != nil {
+				t.Fatalf("unable to count pending uploads: %v", err)
+			}
+			if count != 1 {
+				t.Fatalf("expected 1 unexpired pending upload, got %d", count)
+			}
+			removed, err := db.DeleteExpiredPendingUploads(ctx, 3000)
+			if err != nil {
+				t.Fatalf("unable to remove expired pending uploads: %v", err)
+			}
+			if removed != 1 {
+				t.Fatalf("expected 1 removed pending upload, got %d", removed)
+			}
+			if err = db.DeletePendingUpload(ctx, pending[2].MediaID, pending[2].Origin); err != nil {
+				t.Fatalf("unable to remove pending upload: %v", err)
+			}
+			for _, p := range []*types.PendingUpload{pending[0], pending[2]} {
+				if got, err = db.GetPendingUpload(ctx, p.MediaID, p.Origin); err != nil || got != nil {
+					t.Fatalf("expected no pending upload for %s, got %+v (%v)", p.MediaID, got, err)
+				}
+			}
+		})
+	})
+}
+
+func TestBlobRefCounts(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateDatabase(t, dbType)
+		defer close()
+		ctx := context.Background()
+		t.Run("files are only unreferenced once all media using them is deleted", func(t *testing.T) {
+			media := []*types.MediaMetadata{
+				{MediaID: "first", Origin: "localhost", ContentType: "text/plain", FileSizeBytes: 4, UploadName: "a", Base64Hash: "shared", UserID: "@alice:localhost"},
+				{MediaID: "second", Origin: "remote", ContentType: "text/plain", FileSizeBytes: 4, UploadName: "b", Base64Hash: "shared", UserID: "@bob:remote"},
+				{MediaID: "third", Origin: "localhost", ContentType: "text/plain", FileSizeBytes: 5, UploadName: "c", Base64Hash: "single", UserID: "@alice:localhost"},
+			}
+			for _, m := range media {
+				if err := db.StoreMediaMetadata(ctx, m); err != nil {
+					t.Fatalf("unable to store media metadata: %v", err)
+				}
+			}
+			thumbnail := &types.ThumbnailMetadata{
+				MediaMetadata: &types.MediaMetadata{MediaID: "first", Origin: "localhost", ContentType: "image/png", FileSizeBytes: 2},
+				ThumbnailSize: types.ThumbnailSize{Width: 32, Height: 32, ResizeMethod: types.Crop},
+			}
+			if err := db.StoreThumbnail(ctx, thumbnail); err != nil {
+				t.Fatalf("unable to store thumbnail metadata: %v", err)
+			}
+
+			want := map[types.Base64Hash]int64{"shared": 2, "single": 1}
+			refCounts, err := db.GetBlobRefCounts(ctx)
+			if err != nil {
+				t.Fatalf("unable to query reference counts: %v", err)
+			}
+			if !reflect.DeepEqual(want, refCounts) {
+				t.Fatalf("expected reference counts %v, got %v", want, refCounts)
+			}
+			hashCounts, err := db.GetMediaHashCounts(ctx)
+			if err != nil {
+				t.Fatalf("unable to query hash counts: %v", err)
+			}
+			if !reflect.DeepEqual(want, hashCounts) {
+				t.Fatalf("expected hash counts %v, got %v", want, hashCounts)
+			}
+
+			forUser, err := db.GetMediaMetadataForUser(ctx, "@alice:localhost")
+			if err != nil {
+				t.Fatalf("unable to query media for user: %v", err)
+			}
+			if len(forUser) != 2 || forUser[0].MediaID != "first" || forUser[1].MediaID != "third" {
+				t.Fatalf("expected media first and third for user, got %+v", forUser)
+			}
+			remote, err := db.GetRemoteMediaMetadataCreatedBefore(ctx, "localhost", gomatrixserverlib.AsTimestamp(time.Now().Add(time.Minute)), 10, 0)
+			if err != nil {
+				t.Fatalf("unable to query remote media: %v", err)
+			}
+			if len(remote) != 1 || remote[0].MediaID != "second" {
+				t.Fatalf("expected only remote media second, got %+v", remote)
+			}
+			if remote, err = db.GetRemoteMediaMetadataCreatedBefore(ctx, "localhost", gomatrixserverlib.AsTimestamp(time.Now().Add(time.Minute)), 10, 1); err != nil || len(remote) != 0 {
+				t.Fatalf("expected no remote media past the offset, got %+v (%v)", remote, err)
+			}
+
+			for _, tc := range []struct {
+				mediaID      types.MediaID
+				origin       gomatrixserverlib.ServerName
+				unreferenced bool
+			}{
+				{"first", "localhost", false},
+				{"second", "remote", true},
+				{"third", "localhost", true},
+			} {
+				deleted, unreferenced, err := db.DeleteMediaMetadata(ctx, tc.mediaID, tc.origin)
+				if err != nil {
+					t.Fatalf("unable to delete media %s: %v", tc.mediaID, err)
+				}
+				if deleted == nil || deleted.MediaID != tc.mediaID {
+					t.Fatalf("expected deleted metadata for %s, got %+v", tc.mediaID, deleted)
+				}
+				if unreferenced != tc.unreferenced {
+					t.Fatalf("expected unreferenced %v after deleting %s, got %v", tc.unreferenced, tc.mediaID, unreferenced)
+				}
+				if got, err := db.GetMediaMetadata(ctx, tc.mediaID, tc.origin); err != nil || got != nil {
+					t.Fatalf("expected no metadata for %s, got %+v (%v)", tc.mediaID, got, err)
+				}
+			}
+			if thumbnails, err := db.GetThumbnails(ctx, "first", "localhost"); err != nil || len(thumbnails) != 0 {
+				t.Fatalf("expected thumbnails to be deleted, got %+v (%v)", thumbnails, err)
+			}
+			if refCounts, err = db.GetBlobRefCounts(ctx); err != nil || len(refCounts) != 0 {
+				t.Fatalf("expected no reference counts left, got %v (%v)", refCounts, err)
+			}
+			deleted, _, err := db.DeleteMediaMetadata(ctx, "first", "localhost")
+			if err != nil || deleted != nil {
+				t.Fatalf("expected no metadata deleting missing media, got %+v (%v)", deleted, err)
+			}
+		})
+	})
+}
+
+func TestMediaAdminStorage(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateDatabase(t, dbType)
+		defer close()
+		ctx := context.Background()
+		t.Run("can quarantine media and rooms", func(t *testing.T) {
+			quarantined, err := db.QuarantineMedia(ctx, "first", "localhost", "@admin:localhost")
+			if err != nil || !quarantined {
+				t.Fatalf("expected media to be quarantined, got %v (%v)", quarantined, err)
+			}
+			if quarantined, err = db.QuarantineMedia(ctx, "first", "localhost", "@admin:localhost"); err != nil || quarantined {
+				t.Fatalf("expected media to be quarantined already, got %v (%v)", quarantined, err)
+			}
+			media := []*types.MediaMetadata{
+				{MediaID: "first", Origin: "localhost"},
+				{MediaID: "second", Origin: "remote"},
+			}
+			if err = db.StoreRoomMedia(ctx, "!room:localhost", media); err != nil {
+				t.Fatalf("unable to store room media: %v", err)
+			}
+			// storing the same media again is not an error
+			if err = db.StoreRoomMedia(ctx, "!room:localhost", media[:1]); err != nil {
+				t.Fatalf("unable to store room media again: %v", err)
+			}
+			roomMedia, err := db.GetRoomMedia(ctx, "!room:localhost")
+			if err != nil || len(roomMedia) != 2 {
+				t.Fatalf("expected 2 room media, got %+v (%v)", roomMedia, err)
+			}
+			count, err := db.QuarantineRoomMedia(ctx, "!room:localhost", "@admin:localhost")
+			if err != nil || count != 1 {
+				t.Fatalf("expected 1 newly quarantined media, got %d (%v)", count, err)
+			}
+			for _, m := range media {
+				if quarantined, err = db.IsMediaQuarantined(ctx, m.MediaID, m.Origin); err != nil || !quarantined {
+					t.Fatalf("expected %s to be quarantined, got %v (%v)", m.MediaID, quarantined, err)
+				}
+			}
+			if quarantined, err = db.IsMediaQuarantined(ctx, "other", "localhost"); err != nil || quarantined {
+				t.Fatalf("expected other media not to be quarantined, got %v (%v)", quarantined, err)
+			}
+		})
+		t.Run("can record admin actions", func(t *testing.T) {
+			entries := []*types.MediaAuditEntry{
+				{UserID: "@admin:localhost", Action: "quarantine_media", Target: "mxc://localhost/first", Affected: 1, Timestamp: 1000},
+				{UserID: "@admin:localhost", Action: "delete_user_media", Target: "@alice:localhost", Affected: 3, Timestamp: 2000},
+			}
+			for _, e := range entries {
+				if err := db.StoreMediaAuditEntry(ctx, e); err != nil {
+					t.Fatalf("unable to store audit entry: %v", err)
+				}
+			}
+			got, err := db.GetMediaAuditLog(ctx, 1)
+			if err != nil {
+				t.Fatalf("unable to query audit log: %v", err)
+			}
+			if len(got) != 1 || !reflect.DeepEqual(entries[1], got[0]) {
+				t.Fatalf("expected latest audit entry %+v, got %+v", entries[1], got)
+			}
+		})
+	})
+}
+
+func TestUserUsageStorage(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateDatabase(t, dbType)
+		defer close()
+		ctx := context.Background()
+		t.Run("usage follows stored and deleted media", func(t *testing.T) {
+			media := []*types.MediaMetadata{
+				{MediaID: "first", Origin: "localhost", FileSizeBytes: 10, Base64Hash: "Zmlyc3Q=", UserID: "@alice:localhost"},
+				{MediaID: "second", Origin: "localhost", FileSizeBytes: 20, Base64Hash: "Zmlyc3Q=", UserID: "@alice:localhost"},
+				{MediaID: "third", Origin: "localhost", FileSizeBytes: 5, Base64Hash: "dGhpcmQ=", UserID: "@bob:localhost"},
+				{MediaID: "remote", Origin: "remote", FileSizeBytes: 100, Base64Hash: "cmVtb3Rl"},
+			}
+			for _, m := range media {
+				if err := db.StoreMediaMetadata(ctx, m); err != nil {
+					t.Fatalf("unable to store media metadata: %v", err)
+				}
+			}
+			wantUsage := func(userID types.MatrixUserID, want int64) {
+				t.Helper()
+				got, err := db.GetUserUsage(ctx, userID)
+				if err != nil {
+					t.Fatalf("unable to query usage of %s: %v", userID, err)
+				}
+				if got != want {
+					t.Fatalf("expected usage of %s to be %d, got %d", userID, want, got)
+				}
+			}
+			wantUsage("@alice:localhost", 30)
+			wantUsage("@bob:localhost", 5)
+			wantUsage("@charlie:localhost", 0)
+			if _, _, err := db.DeleteMediaMetadata(ctx, "first", "localhost"); err != nil {
+				t.Fatalf("unable to delete media metadata: %v", err)
+			}
+			wantUsage("@alice:localhost", 20)
+			wantUsage("@bob:localhost", 5)
+		})
+	})
+}
+
+func TestTimedOutMedia(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateDatabase(t, dbType)
+		defer close()
+		ctx := context.Background()
+		t.Run("files stored again since the timestamp keep all their media", func(t *testing.T) {
+			for _, m := range []*types.MediaMetadata{
+				{MediaID: "old", Origin: "localhost", Base64Hash: "b2xk"},
+				{MediaID: "reused", Origin: "localhost", Base64Hash: "cmV1c2Vk"},
+			} {
+				if err := db.StoreMediaMetadata(ctx, m); err != nil {
+					t.Fatalf("unable to store media metadata: %v", err)
+				}
+			}
+			time.Sleep(2 * time.Millisecond)
+			ts := gomatrixserverlib.AsTimestamp(time.Now())
+			time.Sleep(2 * time.Millisecond)
+			if err := db.StoreMediaMetadata(ctx, &types.MediaMetadata{MediaID: "new", Origin: "localhost", Base64Hash: "cmV1c2Vk"}); err != nil {
+				t.Fatalf("unable to store media metadata: %v", err)
+			}
+
+			media, err := db.GetTimedOutMediaMetadata(ctx, ts)
+			if err != nil {
+				t.Fatalf("unable to query timed out media: %v", err)
+			}
+			if len(media) != 1 || media[0].MediaID != "old" {
+				t.Fatalf("expected only the old media to time out, got %+v", media)
+			}
+		})
+	})
+}
@@ -29,11 +29,13 @@ type Thumbnails interface {
 		mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
 		width, height int,
 		resizeMethod string,
+		animated bool,
 	) (*types.ThumbnailMetadata, error)
 	SelectThumbnails(
 		ctx context.Context, txn *sql.Tx, mediaID types.MediaID,
 		mediaOrigin gomatrixserverlib.ServerName,
 	) ([]*types.ThumbnailMetadata, error)
+	DeleteThumbnails(ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) error
 }
 
 type MediaRepository interface {
@@ -43,4 +45,78 @@ type MediaRepository interface {
 		ctx context.Context, txn *sql.Tx,
 		mediaHash types.Base64Hash, mediaOrigin gomatrixserverlib.ServerName,
 	) (*types.MediaMetadata, error)
+	DeleteMedia(ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) error
+	// SelectMediaByUser returns the media uploaded by the user, oldest first
+	SelectMediaByUser(ctx context.Context, txn *sql.Tx, userID types.MatrixUserID) ([]*types.MediaMetadata, error)
+	// SelectUserMediaWithQuarantine returns the media uploaded by the user and whether each is quarantined, oldest first
+	SelectUserMediaWithQuarantine(ctx context.Context, txn *sql.Tx, userID types.MatrixUserID) ([]*types.UserMedia, error)
+	// SelectRemoteMediaCreatedBefore returns at most limit media of other origins than localOrigin
+	// stored before ts, oldest first, skipping the first offset.
+	SelectRemoteMediaCreatedBefore(
+		ctx context.Context, txn *sql.Tx,
+		localOrigin gomatrixserverlib.ServerName, ts gomatrixserverlib.Timestamp, limit, offset int,
+	) ([]*types.MediaMetadata, error)
+	// SelectTimedOutMedia returns the media referring to files which no media was stored for since ts, oldest first
+	SelectTimedOutMedia(ctx context.Context, txn *sql.Tx, ts gomatrixserverlib.Timestamp) ([]*types.MediaMetadata, error)
+	// SelectMediaHashCounts returns the number of media referring to each stored file
+	SelectMediaHashCounts(ctx context.Context, txn *sql.Tx) (map[types.Base64Hash]int64, error)
+}
+
+// Blobs holds the reference count of each stored file
+type Blobs interface {
+	InsertBlobReference(ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash) error
+	// DeleteBlobReference removes a reference to the file and returns the number of references left.
+	// The row is removed when no references are left.
+	DeleteBlobReference(ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash) (int64, error)
+	SelectBlobRefCounts(ctx context.Context, txn *sql.Tx) (map[types.Base64Hash]int64, error)
+	// ResetBlobRefCounts recounts the references from the media repository
+	ResetBlobRefCounts(ctx context.Context, txn *sql.Tx) error
+}
+
+// UserUsage holds the total size of the media each local user uploaded
+type UserUsage interface {
+	// AddUserUsage adds bytes to the usage of the user, which may be negative
+	AddUserUsage(ctx context.Context, txn *sql.Tx, userID types.MatrixUserID, bytes int64) error
+	SelectUserUsage(ctx context.Context, txn *sql.Tx, userID types.MatrixUserID) (int64, error)
+}
+
+type PendingUploads interface {
+	InsertPendingUpload(ctx context.Context, txn *sql.Tx, pending *types.PendingUpload) error
+	SelectPendingUpload(ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) (*types.PendingUpload, error)
+	SelectPendingUploadsCount(ctx context.Context, txn *sql.Tx, userID types.MatrixUserID, now gomatrixserverlib.Timestamp) (int64, error)
+	DeletePendingUpload(ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) error
+	DeleteExpiredPendingUploads(ctx context.Context, txn *sql.Tx, now gomatrixserverlib.Timestamp) (int64, error)
+}
+
+type QuarantinedMedia interface {
+	// InsertQuarantinedMedia returns false if the media was already quarantined
+	InsertQuarantinedMedia(ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, userID types.MatrixUserID, ts gomatrixserverlib.Timestamp) (bool, error)
+	SelectQuarantinedMedia(ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) (bool, error)
+}
+
+type RoomMedia interface {
+	InsertRoomMedia(ctx context.Context, txn *sql.Tx, roomID string, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) error
+	// SelectRoomMedia returns the media referred to in the room, only MediaID and Origin are set
+	SelectRoomMedia(ctx context.Context, txn *sql.Tx, roomID string) ([]*types.MediaMetadata, error)
+}
+
+type MediaAudit interface {
+	InsertMediaAudit(ctx context.Context, txn *sql.Tx, entry *types.MediaAuditEntry) error
+	// SelectMediaAudit returns the latest entries, newest first
+	SelectMediaAudit(ctx context.Context, txn *sql.Tx, limit int) ([]*types.MediaAuditEntry, error)
+}
+
+type ImageMetadata interface {
+	InsertImageMetadata(ctx context.Context, txn *sql.Tx, meta *types.ImageMetadata) error
+	SelectImageMetadata(ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash) (*types.ImageMetadata, error)
+}
+
+type ScanResults interface {
+	UpsertScanResult(ctx context.Context, txn *sql.Tx, result *types.ScanResult) error
+	SelectScanResult(ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash) (*types.ScanResult, error)
+}
+
+type URLPreviews interface {
+	InsertURLPreview(ctx context.Context, txn *sql.Tx, preview *types.URLPreview) error
+	SelectURLPreview(ctx context.Context, txn *sql.Tx, url string, bucketTS gomatrixserverlib.Timestamp) (*types.URLPreview, error)
 }
@@ -0,0 +1,500 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package thumbnailer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"io"
+
+	"github.com/matrix-org/dendrite/mediaapi/filestore"
+	"github.com/nfnt/resize"
+	"golang.org/x/image/webp"
+)
+
+// maxAnimationFrames is the maximum number of frames of an animated thumbnail. Longer
+// animations only get still thumbnails of their first frame.
+const maxAnimationFrames = 500
+
+// maxAnimationPixels is the maximum size of the canvas of an animation. Larger animations are
+// rejected before any frame is decoded, as the canvas and every decoded frame are kept in memory
+// while generating a thumbnail.
+const maxAnimationPixels = 16 * 1024 * 1024
+
+// animation is an animated GIF or WebP image. Its frames are only decoded and composited
+// onto the canvas while generating a thumbnail, to keep memory usage independent of the
+// number of frames.
+type animation struct {
+	width, height int
+	// The loop count as used by image/gif: 0 loops forever, -1 shows the frames once
+	loopCount int
+	frames    []animationFrame
+}
+
+type animationFrame struct {
+	// The area of the canvas covered by the frame
+	bounds image.Rectangle
+	// The frame duration in 100ths of a second
+	delay int
+	// Whether the frame is blended with the canvas, or replaces the area it covers
+	blend bool
+	// What happens to the area covered by the frame after it was shown, one of the
+	// image/gif disposal methods
+	disposal byte
+	decode   func() (image.Image, error)
+}
+
+// composite calls fn with every frame of the animation as it is displayed.
+// The image passed to fn is only valid until fn returns.
+func (a *animation) composite(fn func(img image.Image, delay int) error) error {
+	canvas := image.NewRGBA(image.Rect(0, 0, a.width, a.height))
+	var previous *image.RGBA
+	for _, frame := range a.frames {
+		img, err := frame.decode()
+		if err != nil {
+			return err
+		}
+		if frame.disposal == gif.DisposalPrevious {
+			if previous == nil {
+				previous = image.NewRGBA(canvas.Bounds())
+			}
+			copy(previous.Pix, canvas.Pix)
+		}
+		op := draw.Src
+		if frame.blend {
+			op = draw.Over
+		}
+		draw.Draw(canvas, frame.bounds, img, img.Bounds().Min, op)
+		if err = fn(canvas, frame.delay); err != nil {
+			return err
+		}
+		switch frame.disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.bounds, image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			copy(canvas.Pix, previous.Pix)
+		}
+	}
+	return nil
+}
+
+// checkAnimationSize returns an error if a canvas of the given size has too many pixels.
+func checkAnimationSize(width, height int) error {
+	if int64(width)*int64(height) > maxAnimationPixels {
+		return fmt.Errorf("animation of %dx%d pixels is too large", width, height)
+	}
+	return nil
+}
+
+// decodeGIFAnimation returns the animation of an animated GIF, or nil if it has a single frame
+// or too many frames.
+func decodeGIFAnimation(data []byte) (*animation, error) {
+	frames, err := gifFrames(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if frames < 2 || frames > maxAnimationFrames {
+		return nil, nil
+	}
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if len(g.Image) < 2 || len(g.Image) > maxAnimationFrames {
+		return nil, nil
+	}
+	anim := &animation{
+		width:     g.Config.Width,
+		height:    g.Config.Height,
+		loopCount: g.LoopCount,
+	}
+	for i := range g.Image {
+		img := g.Image[i]
+		frame := animationFrame{
+			bounds: img.Bounds(),
+			delay:  g.Delay[i],
+			blend:  true,
+			decode: func() (image.Image, error) { return img, nil },
+		}
+		if i < len(g.Disposal) {
+			frame.disposal = g.Disposal[i]
+		}
+		anim.frames = append(anim.frames, frame)
+		// some encoders don't set the logical screen size
+		anim.width = maxInt(anim.width, img.Bounds().Max.X)
+		anim.height = maxInt(anim.height, img.Bounds().Max.Y)
+	}
+	return anim, nil
+}
+
+// gifFrames counts the frames of a GIF without decoding or keeping them. It returns an error if
+// the canvas, grown to fit all frames like in decodeGIFAnimation, would be too large.
+func gifFrames(r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(br, header); err != nil || (string(header[0:6]) != "GIF87a" && string(header[0:6]) != "GIF89a") {
+		return 0, errors.New("gif: invalid header")
+	}
+	width := int(binary.LittleEndian.Uint16(header[6:]))
+	height := int(binary.LittleEndian.Uint16(header[8:]))
+	if err := checkAnimationSize(width, height); err != nil {
+		return 0, err
+	}
+	_, err := br.Discard(gifColorTableSize(header[10]))
+	var frames int
+	for err == nil {
+		var block byte
+		if block, err = br.ReadByte(); err != nil {
+			break
+		}
+		switch block {
+		case 0x21: // extension
+			if _, err = br.Discard(1); err == nil {
+				err = skipGIFSubBlocks(br)
+			}
+		case 0x2C: // image descriptor
+			desc := make([]byte, 9)
+			if _, err = io.ReadFull(br, desc); err != nil {
+				return 0, errors.New("gif: truncated image descriptor")
+			}
+			left, top := int(binary.LittleEndian.Uint16(desc[0:])), int(binary.LittleEndian.Uint16(desc[2:]))
+			w, h := int(binary.LittleEndian.Uint16(desc[4:])), int(binary.LittleEndian.Uint16(desc[6:]))
+			width, height = maxInt(width, left+w), maxInt(height, top+h)
+			if err = checkAnimationSize(width, height); err != nil {
+				return 0, err
+			}
+			frames++
+			// skip the local colour table and the LZW minimum code size before the image data
+			if _, err = br.Discard(gifColorTableSize(desc[8]) + 1); err == nil {
+				err = skipGIFSubBlocks(br)
+			}
+		case 0x3B: // trailer
+			return frames, nil
+		default:
+			return 0, fmt.Errorf("gif: unknown block type 0x%02x", block)
+		}
+	}
+	// the frames of a truncated file are counted up to where it ends
+	if err != io.EOF {
+		return 0, err
+	}
+	return frames, nil
+}
+
+// gifColorTableSize returns the size of the colour table following a block with the given flags
+func gifColorTableSize(flags byte) int {
+	if flags&0x80 == 0 {
+		return 0
+	}
+	return 3 << (flags&0x07 + 1)
+}
+
+// skipGIFSubBlocks reads past the sub-blocks starting at the current position
+func skipGIFSubBlocks(br *bufio.Reader) error {
+	for {
+		size, err := br.ReadByte()
+		if err != nil || size == 0 {
+			return err
+		}
+		if _, err = br.Discard(int(size)); err != nil {
+			return err
+		}
+	}
+}
+
+// webpFrames returns whether a WebP image has the animation flag set and counts its frames,
+// reading past the image data of the frames. It returns an error if the canvas of an animation
+// would be too large.
+func webpFrames(r io.Reader) (animated bool, frames int, err error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, 12)
+	if _, err = io.ReadFull(br, header); err != nil || string(header[0:4]) != "RIFF" || string(header[8:12]) != "WEBP" {
+		return false, 0, errors.New("webp: invalid header")
+	}
+	chunk := make([]byte, 8+10)
+	if _, err = io.ReadFull(br, chunk); err != nil || string(chunk[0:4]) != "VP8X" ||
+		binary.LittleEndian.Uint32(chunk[4:8]) < 10 || chunk[8]&0x02 == 0 {
+		// only the extended format supports animations
+		return false, 0, nil
+	}
+	if err = checkAnimationSize(int(uint24(chunk[12:]))+1, int(uint24(chunk[15:]))+1); err != nil {
+		return true, 0, err
+	}
+	skip := int64(binary.LittleEndian.Uint32(chunk[4:8])) - 10
+	for {
+		// chunks are padded to an even size
+		if _, err = io.CopyN(io.Discard, br, skip+skip&1); err != nil {
+			break
+		}
+		if _, err = io.ReadFull(br, chunk[:8]); err != nil {
+			break
+		}
+		if string(chunk[0:4]) == "ANMF" {
+			frames++
+		}
+		skip = int64(binary.LittleEndian.Uint32(chunk[4:8]))
+	}
+	// the frames of a truncated file are counted up to where it ends
+	if err != io.EOF && err != io.ErrUnexpectedEOF {
+		return true, 0, err
+	}
+	return true, frames, nil
+}
+
+// decodeWebPAnimation returns the animation of an animated WebP, or nil if it has a single frame
+// or too many frames. golang.org/x/image/webp only decodes still images, so every frame is wrapped
+// into a still WebP image of its own for decoding.
+func decodeWebPAnimation(data []byte) (*animation, error) {
+	chunks, err := webpChunks(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) == 0 || chunks[0].fourCC != "VP8X" || len(chunks[0].data) < 10 {
+		return nil, errors.New("webp: missing VP8X chunk")
+	}
+	anim := &animation{
+		width:  int(uint24(chunks[0].data[4:])) + 1,
+		height: int(uint24(chunks[0].data[7:])) + 1,
+	}
+	if err = checkAnimationSize(anim.width, anim.height); err != nil {
+		return nil, err
+	}
+	var frames int
+	for _, chunk := range chunks[1:] {
+		if chunk.fourCC == "ANMF" {
+			frames++
+		}
+	}
+	if frames < 2 || frames > maxAnimationFrames {
+		return nil, nil
+	}
+	canvas := image.Rect(0, 0, anim.width, anim.height)
+	for _, chunk := range chunks[1:] {
+		switch chunk.fourCC {
+		case "ANIM":
+			if len(chunk.data) < 6 {
+				return nil, errors.New("webp: invalid ANIM chunk")
+			}
+			// WebP counts how often the frames are shown, image/gif how often they are repeated
+			switch loops := int(binary.LittleEndian.Uint16(chunk.data[4:])); loops {
+			case 0:
+				anim.loopCount = 0
+			case 1:
+				anim.loopCount = -1
+			default:
+				anim.loopCount = loops - 1
+			}
+		case "ANMF":
+			if len(chunk.data) < 16 {
+				return nil, errors.New("webp: invalid ANMF chunk")
+			}
+			frame, err := webpFrame(chunk.data)
+			if err != nil {
+				return nil, err
+			}
+			if !frame.bounds.In(canvas) {
+				return nil, errors.New("webp: frame outside of the canvas")
+			}
+			anim.frames = append(anim.frames, frame)
+		}
+	}
+	return anim, nil
+}
+
+func webpFrame(data []byte) (animationFrame, error) {
+	x, y := 2*int(uint24(data[0:])), 2*int(uint24(data[3:]))
+	w, h := int(uint24(data[6:]))+1, int(uint24(data[9:]))+1
+	flags := data[15]
+	frame := animationFrame{
+		bounds: image.Rect(x, y, x+w, y+h),
+		delay:  int(uint24(data[12:])) / 10,
+		blend:  flags&0x02 == 0,
+	}
+	if flags&0x01 != 0 {
+		frame.disposal = gif.DisposalBackground
+	}
+
+	subChunks, err := webpSubChunks(data[16:])
+	if err != nil {
+		return frame, err
+	}
+	var alpha, bitstream *webpChunk
+	for i := range subChunks {
+		switch subChunks[i].fourCC {
+		case "ALPH":
+			alpha = &subChunks[i]
+		case "VP8 ", "VP8L":
+			bitstream = &subChunks[i]
+		}
+	}
+	if bitstream == nil {
+		return frame, errors.New("webp: frame without image data")
+	}
+
+	var still bytes.Buffer
+	if alpha != nil && bitstream.fourCC == "VP8 " {
+		// lossy frames keep their transparency in a separate chunk, which needs the extended format
+		header := make([]byte, 10)
+		header[0] = 0x10 // alpha flag
+		putUint24(header[4:], uint32(w-1))
+		putUint24(header[7:], uint32(h-1))
+		writeWebPChunk(&still, "VP8X", header)
+		writeWebPChunk(&still, alpha.fourCC, alpha.data)
+	}
+	writeWebPChunk(&still, bitstream.fourCC, bitstream.data)
+	var file bytes.Buffer
+	file.WriteString("RIFF")
+	_ = binary.Write(&file, binary.LittleEndian, uint32(4+still.Len()))
+	file.WriteString("WEBP")
+	file.Write(still.Bytes())
+	frame.decode = func() (image.Image, error) {
+		// the size of the frame was checked against the canvas, the image data must not be larger
+		cfg, err := webp.DecodeConfig(bytes.NewReader(file.Bytes()))
+		if err != nil {
+			return nil, err
+		}
+		if cfg.Width != w || cfg.Height != h {
+			return nil, fmt.Errorf("webp: frame of %dx%d pixels contains an image of %dx%d pixels", w, h, cfg.Width, cfg.Height)
+		}
+		return webp.Decode(bytes.NewReader(file.Bytes()))
+	}
+	return frame, nil
+}
+
+type webpChunk struct {
+	fourCC string
+	data   []byte
+}
+
+// webpChunks returns the chunks of a WebP file.
+func webpChunks(data []byte) ([]webpChunk, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errors.New("webp: invalid header")
+	}
+	return webpSubChunks(data[12:])
+}
+
+func webpSubChunks(data []byte) ([]webpChunk, error) {
+	var chunks []webpChunk
+	for len(data) >= 8 {
+		size := binary.LittleEndian.Uint32(data[4:8])
+		if uint64(size) > uint64(len(data)-8) {
+			return nil, fmt.Errorf("webp: truncated %q chunk", data[0:4])
+		}
+		chunks = append(chunks, webpChunk{fourCC: string(data[0:4]), data: data[8 : 8+size]})
+		// chunks are padded to an even size
+		next := 8 + int(size) + int(size&1)
+		if next > len(data) {
+			break
+		}
+		data = data[next:]
+	}
+	return chunks, nil
+}
+
+func writeWebPChunk(buf *bytes.Buffer, fourCC string, data []byte) {
+	buf.WriteString(fourCC)
+	_ = binary.Write(buf, binary.LittleEndian, uint32(len(data)))
+	buf.Write(data)
+	if len(data)%2 == 1 {
+		buf.WriteByte(0)
+	}
+}
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// writeAnimation scales the frames of an animation to fit within the provided width and height
+// and stores them as an animated GIF. See resizeImage for the meaning of crop.
+func writeAnimation(ctx context.Context, store filestore.Store, dst string, anim *animation, w, h int, crop bool) (int, int, error) {
+	// the first colour is kept for transparent pixels
+	pal := append(color.Palette{color.Transparent}, palette.Plan9[:255]...)
+	out := &gif.GIF{LoopCount: anim.loopCount}
+	err := anim.composite(func(img image.Image, delay int) error {
+		scaled := resizeImage(img, w, h, crop)
+		frame := image.NewPaletted(scaled.Bounds(), pal)
+		draw.FloydSteinberg.Draw(frame, frame.Bounds(), scaled, scaled.Bounds().Min)
+		out.Image = append(out.Image, frame)
+		out.Delay = append(out.Delay, delay)
+		// every frame covers the whole canvas, including its transparent pixels
+		out.Disposal = append(out.Disposal, gif.DisposalBackground)
+		return nil
+	})
+	if err != nil {
+		return -1, -1, err
+	}
+	var buf bytes.Buffer
+	if err = gif.EncodeAll(&buf, out); err != nil {
+		return -1, -1, err
+	}
+	if err = store.Put(ctx, dst, &buf, int64(buf.Len())); err != nil {
+		return -1, -1, err
+	}
+	return out.Image[0].Bounds().Dx(), out.Image[0].Bounds().Dy(), nil
+}
+
+// resizeImage scales an image to fit within the provided width and height
+// If the source aspect ratio is different to the target dimensions, one edge will be smaller than requested
+// If crop is set to true, the image will be scaled to fill the width and height with any excess being cropped off
+func resizeImage(img image.Image, w, h int, crop bool) image.Image {
+	if !crop {
+		return resize.Thumbnail(uint(w), uint(h), img, resize.Lanczos3)
+	}
+
+	inAR := float64(img.Bounds().Dx()) / float64(img.Bounds().Dy())
+	outAR := float64(w) / float64(h)
+
+	var scaleW, scaleH uint
+	if inAR > outAR {
+		// input has shorter AR than requested output so use requested height and calculate width to match input AR
+		scaleW = uint(float64(h) * inAR)
+		scaleH = uint(h)
+	} else {
+		// input has taller AR than requested output so use requested width and calculate height to match input AR
+		scaleW = uint(w)
+		scaleH = uint(float64(w) / inAR)
+	}
+
+	scaled := resize.Resize(scaleW, scaleH, img, resize.Lanczos3)
+
+	xoff := (scaled.Bounds().Dx() - w) / 2
+	yoff := (scaled.Bounds().Dy() - h) / 2
+
+	tr := image.Rect(0, 0, w, h)
+	target := image.NewRGBA(tr)
+	draw.Draw(target, tr, scaled, image.Pt(xoff, yoff), draw.Src)
+	return target
+}
@@ -0,0 +1,209 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/png"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/mediaapi/filestore"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func mustEncodeGIF(t *testing.T, frames int) []byte {
+	t.Helper()
+	g := &gif.GIF{LoopCount: 3}
+	for i := 0; i < frames; i++ {
+		bounds := image.Rect(0, 0, 40, 20)
+		if i > 0 {
+			// later frames only cover part of the canvas
+			bounds = image.Rect(10, 5, 30, 15)
+		}
+		img := image.NewPaletted(bounds, palette.Plan9)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				img.SetColorIndex(x, y, uint8(i*50))
+			}
+		}
+		g.Image = append(g.Image, img)
+		g.Delay = append(g.Delay, 10*(i+1))
+		g.Disposal = append(g.Disposal, gif.DisposalBackground)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatalf("failed to encode GIF: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestGIFAnimation(t *testing.T) {
+	anim, err := decodeGIFAnimation(mustEncodeGIF(t, 1))
+	if err != nil {
+		t.Fatalf("failed to decode GIF: %v", err)
+	}
+	if anim != nil {
+		t.Fatalf("expected no animation for a single frame GIF")
+	}
+
+	anim, err = decodeGIFAnimation(mustEncodeGIF(t, 3))
+	if err != nil {
+		t.Fatalf("failed to decode GIF: %v", err)
+	}
+	if anim == nil || len(anim.frames) != 3 || anim.width != 40 || anim.height != 20 {
+		t.Fatalf("unexpected animation %+v", anim)
+	}
+
+	store := filestore.NewFileSystem(config.Path(t.TempDir()))
+	for _, tc := range []struct {
+		crop          bool
+		width, height int
+	}{
+		{crop: true, width: 10, height: 10},
+		{crop: false, width: 10, height: 5},
+	} {
+		width, height, err := writeAnimation(context.Background(), store, "thumbnail", anim, 10, 10, tc.crop)
+		if err != nil {
+			t.Fatalf("failed to write animation: %v", err)
+		}
+		if width != tc.width || height != tc.height {
+			t.Fatalf("expected a %dx%d animation, got %dx%d", tc.width, tc.height, width, height)
+		}
+		file, err := store.Open(context.Background(), "thumbnail")
+		if err != nil {
+			t.Fatalf("failed to open thumbnail: %v", err)
+		}
+		g, err := gif.DecodeAll(file)
+		_ = file.Close()
+		if err != nil {
+			t.Fatalf("failed to decode thumbnail: %v", err)
+		}
+		if len(g.Image) != 3 || g.LoopCount != 3 {
+			t.Fatalf("expected 3 frames looped 3 times, got %d frames looped %d times", len(g.Image), g.LoopCount)
+		}
+		for i, delay := range g.Delay {
+			if delay != 10*(i+1) {
+				t.Fatalf("unexpected delay %d of frame %d", delay, i)
+			}
+		}
+		// the first frame was cleared after being shown, so the corners are transparent later on
+		if _, _, _, a := g.Image[1].At(0, 0).RGBA(); a != 0 {
+			t.Fatalf("expected the disposed area to be transparent")
+		}
+	}
+}
+
+func TestAnimationSize(t *testing.T) {
+	data := mustEncodeGIF(t, 3)
+	if frames, err := gifFrames(bytes.NewReader(data)); err != nil || frames != 3 {
+		t.Fatalf("expected 3 frames, got %d (%v)", frames, err)
+	}
+
+	// a huge logical screen is rejected before any frame is decoded
+	huge := append([]byte{}, data...)
+	binary.LittleEndian.PutUint16(huge[6:], 65535)
+	binary.LittleEndian.PutUint16(huge[8:], 65535)
+	if anim, err := decodeGIFAnimation(huge); err == nil {
+		t.Fatalf("expected a huge GIF to be rejected, got %+v", anim)
+	}
+
+	// so is a huge WebP canvas
+	header := make([]byte, 10)
+	header[0] = 0x02 // animation flag
+	putUint24(header[4:], 8191)
+	putUint24(header[7:], 8191)
+	var chunks bytes.Buffer
+	writeWebPChunk(&chunks, "VP8X", header)
+	var file bytes.Buffer
+	file.WriteString("RIFF")
+	_ = binary.Write(&file, binary.LittleEndian, uint32(4+chunks.Len()))
+	file.WriteString("WEBP")
+	file.Write(chunks.Bytes())
+	if animated, _, err := webpFrames(bytes.NewReader(file.Bytes())); !animated || err == nil {
+		t.Fatalf("expected a huge animated WebP to be rejected before reading its frames")
+	}
+	if anim, err := decodeWebPAnimation(file.Bytes()); err == nil {
+		t.Fatalf("expected a huge WebP to be rejected, got %+v", anim)
+	}
+}
+
+func TestReadSource(t *testing.T) {
+	ctx := context.Background()
+	store := filestore.NewFileSystem(config.Path(t.TempDir()))
+	var still bytes.Buffer
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	img.Set(1, 1, color.White)
+	if err := png.Encode(&still, img); err != nil {
+		t.Fatalf("failed to encode PNG: %v", err)
+	}
+	// the "PDF" is followed by an image, which is what the fake thumbnailer outputs
+	pdf := append([]byte("%PDF-"), still.Bytes()...)
+	for key, data := range map[string][]byte{"pdf": pdf, "gif": mustEncodeGIF(t, 2), "png": still.Bytes()} {
+		if err := store.Put(ctx, key, bytes.NewReader(data), int64(len(data))); err != nil {
+			t.Fatalf("failed to store %s: %v", key, err)
+		}
+	}
+
+	external := &config.ExternalThumbnailers{}
+	if _, _, err := readSource(ctx, store, "pdf", external); err == nil {
+		t.Fatalf("expected PDFs to be unsupported without an external thumbnailer")
+	}
+	external.PDF = []string{"tail", "-c", "+6", config.ExternalThumbnailerInput}
+	external.Timeout = time.Minute
+	data, anim, err := readSource(ctx, store, "pdf", external)
+	if err != nil {
+		t.Fatalf("failed to read PDF: %v", err)
+	}
+	if !bytes.Equal(data, still.Bytes()) || anim != nil {
+		t.Fatalf("expected the output of the external thumbnailer")
+	}
+
+	external.PDF = []string{"false", config.ExternalThumbnailerInput}
+	if _, _, err = readSource(ctx, store, "pdf", external); err == nil {
+		t.Fatalf("expected an error from a failing external thumbnailer")
+	}
+
+	if _, anim, err = readSource(ctx, store, "gif", external); err != nil || anim == nil {
+		t.Fatalf("expected an animated GIF: %v", err)
+	}
+	if _, anim, err = readSource(ctx, store, "png", external); err != nil || anim != nil {
+		t.Fatalf("expected a still PNG: %v", err)
+	}
+}
+
+func TestSelectAnimatedThumbnail(t *testing.T) {
+	thumbnail := func(animated bool) *types.ThumbnailMetadata {
+		return &types.ThumbnailMetadata{
+			MediaMetadata: &types.MediaMetadata{FileSizeBytes: 100},
+			ThumbnailSize: types.ThumbnailSize{Width: 32, Height: 32, ResizeMethod: types.Crop, Animated: animated},
+		}
+	}
+	still, animated := thumbnail(false), thumbnail(true)
+	thumbnails := []*types.ThumbnailMetadata{animated, still}
+
+	chosen, _ := SelectThumbnail(types.ThumbnailSize{Width: 32, Height: 32, ResizeMethod: types.Crop}, thumbnails, nil)
+	if chosen != still {
+		t.Fatalf("expected the still thumbnail, got %+v", chosen)
+	}
+	chosen, _ = SelectThumbnail(types.ThumbnailSize{Width: 32, Height: 32, ResizeMethod: types.Crop, Animated: true}, thumbnails, nil)
+	if chosen != animated {
+		t.Fatalf("expected the animated thumbnail, got %+v", chosen)
+	}
+
+	// an animated configured size which hasn't been generated yet beats a still thumbnail
+	sizes := []config.ThumbnailSize{{Width: 64, Height: 64, ResizeMethod: types.Crop, Animated: true}}
+	_, size := SelectThumbnail(types.ThumbnailSize{Width: 32, Height: 32, ResizeMethod: types.Crop, Animated: true}, thumbnails[1:], sizes)
+	if size == nil || !size.Animated || size.Width != 64 {
+		t.Fatalf("expected the animated configured size, got %+v", size)
+	}
+	chosen, size = SelectThumbnail(types.ThumbnailSize{Width: 32, Height: 32, ResizeMethod: types.Crop}, thumbnails[1:], sizes)
+	if chosen != still || size != nil {
+		t.Fatalf("expected the still thumbnail, got %+v %+v", chosen, size)
+	}
+}
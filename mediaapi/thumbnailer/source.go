@@ -0,0 +1,182 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package thumbnailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/dendrite/mediaapi/filestore"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// errFirstFrame stops compositing an animation after its first frame
+var errFirstFrame = errors.New("first frame")
+
+// IsSupported returns whether thumbnails can be generated for files of the given sniffed
+// content type. PDFs and videos are only supported if an external thumbnailer is configured.
+func IsSupported(contentType string, external *config.ExternalThumbnailers) bool {
+	switch {
+	case strings.HasPrefix(contentType, "image/"):
+		return true
+	case contentType == "application/pdf":
+		return len(external.PDF) > 0
+	case strings.HasPrefix(contentType, "video/"):
+		return len(external.Video) > 0
+	}
+	return false
+}
+
+// MayBeAnimated returns whether files of the given content type may be animated.
+func MayBeAnimated(contentType types.ContentType) bool {
+	return contentType == "image/gif" || contentType == "image/webp"
+}
+
+// readSource reads the source file and returns the encoded still image to generate thumbnails from.
+// PDFs and videos are converted to an image by the configured external thumbnailer. For animated
+// GIF and WebP images the animation is returned as well, unless it is too long.
+// Only images are read into memory, animations only once the size of their canvas was checked.
+func readSource(
+	ctx context.Context,
+	store filestore.Store,
+	src string,
+	external *config.ExternalThumbnailers,
+) (still []byte, anim *animation, err error) {
+	file, err := store.Open(ctx, src)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close() // nolint: errcheck
+	// http.DetectContentType considers at most the first 512 bytes
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, nil, err
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+
+	contentType := http.DetectContentType(head[:n])
+	if !IsSupported(contentType, external) {
+		return nil, nil, fmt.Errorf("can not generate thumbnails of %s files", contentType)
+	}
+	switch {
+	case contentType == "application/pdf":
+		still, err = runExternalThumbnailer(ctx, external.PDF, external.Timeout, file)
+		return still, nil, err
+	case strings.HasPrefix(contentType, "video/"):
+		still, err = runExternalThumbnailer(ctx, external.Video, external.Timeout, file)
+		return still, nil, err
+	case contentType == "image/gif":
+		frames, err := gifFrames(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := readAllFromStart(file)
+		if err != nil || frames < 2 || frames > maxAnimationFrames {
+			return data, nil, err
+		}
+		anim, err = decodeGIFAnimation(data)
+		return data, anim, err
+	case contentType == "image/webp":
+		animated, frames, err := webpFrames(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !animated {
+			break
+		}
+		if frames < 2 || frames > maxAnimationFrames {
+			return nil, nil, fmt.Errorf("unable to decode animated WebP of %d frames", frames)
+		}
+		data, err := readAllFromStart(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		if anim, err = decodeWebPAnimation(data); err != nil || anim == nil {
+			return nil, nil, fmt.Errorf("unable to decode animated WebP: %w", err)
+		}
+		// the still image is the first frame, as the image decoders don't support animated WebP
+		var buf bytes.Buffer
+		err = anim.composite(func(img image.Image, _ int) error {
+			if err := png.Encode(&buf, img); err != nil {
+				return err
+			}
+			return errFirstFrame
+		})
+		if err != errFirstFrame {
+			return nil, nil, err
+		}
+		return buf.Bytes(), anim, nil
+	}
+	still, err = readAllFromStart(file)
+	return still, nil, err
+}
+
+// readAllFromStart reads the whole file, regardless of how much of it was read before.
+func readAllFromStart(file io.ReadSeeker) ([]byte, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(file)
+}
+
+// runExternalThumbnailer runs the command of an external thumbnailer with the source file
+// and returns the image it wrote to its standard output. The source is copied to a temporary
+// file first, as the store may not keep its files on the local file system.
+func runExternalThumbnailer(ctx context.Context, command []string, timeout time.Duration, src io.Reader) ([]byte, error) {
+	tmpFile, err := os.CreateTemp("", "dendrite-thumbnail-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpFile.Name()) // nolint: errcheck
+	if _, err = io.Copy(tmpFile, src); err != nil {
+		tmpFile.Close() // nolint: errcheck
+		return nil, err
+	}
+	if err = tmpFile.Close(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	args := make([]string, len(command))
+	for i, arg := range command {
+		args[i] = strings.ReplaceAll(arg, config.ExternalThumbnailerInput, tmpFile.Name())
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err = cmd.Run(); err != nil {
+		return nil, fmt.Errorf("external thumbnailer %s failed: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	if stdout.Len() == 0 {
+		return nil, fmt.Errorf("external thumbnailer %s produced no image", args[0])
+	}
+	return stdout.Bytes(), nil
+}
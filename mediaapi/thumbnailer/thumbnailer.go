@@ -16,12 +16,10 @@ package thumbnailer
 
 import (
 	"context"
-	"fmt"
 	"math"
-	"os"
-	"path/filepath"
 	"sync"
 
+	"github.com/matrix-org/dendrite/mediaapi/filestore"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -29,29 +27,19 @@ import (
 )
 
 type thumbnailFitness struct {
-	isSmaller      int
-	aspect         float64
-	size           float64
-	methodMismatch int
-	fileSize       types.FileSizeBytes
-}
-
-// thumbnailTemplate is the filename template for thumbnails
-const thumbnailTemplate = "thumbnail-%vx%v-%v"
-
-// GetThumbnailPath returns the path to a thumbnail given the absolute src path and thumbnail size configuration
-func GetThumbnailPath(src types.Path, config types.ThumbnailSize) types.Path {
-	srcDir := filepath.Dir(string(src))
-	return types.Path(filepath.Join(
-		srcDir,
-		fmt.Sprintf(thumbnailTemplate, config.Width, config.Height, config.ResizeMethod),
-	))
+	isSmaller         int
+	animationMismatch int
+	aspect            float64
+	size              float64
+	methodMismatch    int
+	fileSize          types.FileSizeBytes
 }
 
 // SelectThumbnail compares the (potentially) available thumbnails with the desired thumbnail and returns the best match
 // The algorithm is very similar to what was implemented in Synapse
 // In order of priority unless absolute, the following metrics are compared; the image is:
 // * the same size or larger than requested
+// * animated if an animated image is desired, animated images are only returned if desired
 // * if a cropped image is desired, has an aspect ratio close to requested
 // * has a size close to requested
 // * if a cropped image is desired, prefer the same method, if scaled is desired, absolutely require scaled
@@ -67,6 +55,9 @@ func SelectThumbnail(desired types.ThumbnailSize, thumbnails []*types.ThumbnailM
 		if desired.ResizeMethod == types.Scale && thumbnail.ThumbnailSize.ResizeMethod != types.Scale {
 			continue
 		}
+		if thumbnail.ThumbnailSize.Animated && !desired.Animated {
+			continue
+		}
 		fitness := calcThumbnailFitness(thumbnail.ThumbnailSize, thumbnail.MediaMetadata, desired)
 		if isBetter := fitness.betterThan(bestFit, desired.ResizeMethod == types.Crop); isBetter {
 			bestFit = fitness
@@ -78,18 +69,38 @@ func SelectThumbnail(desired types.ThumbnailSize, thumbnails []*types.ThumbnailM
 		if desired.ResizeMethod == types.Scale && thumbnailSize.ResizeMethod != types.Scale {
 			continue
 		}
-		fitness := calcThumbnailFitness(types.ThumbnailSize(thumbnailSize), nil, desired)
-		if isBetter := fitness.betterThan(bestFit, desired.ResizeMethod == types.Crop); isBetter {
-			bestFit = fitness
-			chosenThumbnailSize = (*types.ThumbnailSize)(&thumbnailSize)
+		// the source may be animated, otherwise the animated size is generated as a still thumbnail
+		for _, size := range configuredSizes(thumbnailSize, true) {
+			if size.Animated && !desired.Animated {
+				continue
+			}
+			fitness := calcThumbnailFitness(size, nil, desired)
+			if isBetter := fitness.betterThan(bestFit, desired.ResizeMethod == types.Crop); isBetter {
+				bestFit = fitness
+				chosenSize := size
+				chosenThumbnailSize = &chosenSize
+			}
 		}
 	}
 
 	return chosenThumbnail, chosenThumbnailSize
 }
 
+// configuredSizes returns the thumbnails generated for a configured thumbnail size: a still thumbnail,
+// and an animated one if enabled and the source is (or may be) animated.
+func configuredSizes(size config.ThumbnailSize, animated bool) []types.ThumbnailSize {
+	still := types.ThumbnailSize(size)
+	still.Animated = false
+	if !size.Animated || !animated {
+		return []types.ThumbnailSize{still}
+	}
+	anim := still
+	anim.Animated = true
+	return []types.ThumbnailSize{still, anim}
+}
+
 // getActiveThumbnailGeneration checks for active thumbnail generation
-func getActiveThumbnailGeneration(dst types.Path, _ types.ThumbnailSize, activeThumbnailGeneration *types.ActiveThumbnailGeneration, maxThumbnailGenerators int, logger *log.Entry) (isActive bool, busy bool, errorReturn error) {
+func getActiveThumbnailGeneration(dst string, _ types.ThumbnailSize, activeThumbnailGeneration *types.ActiveThumbnailGeneration, maxThumbnailGenerators int, logger *log.Entry) (isActive bool, busy bool, errorReturn error) {
 	// Check if there is active thumbnail generation.
 	activeThumbnailGeneration.Lock()
 	defer activeThumbnailGeneration.Unlock()
@@ -119,7 +130,7 @@ func getActiveThumbnailGeneration(dst types.Path, _ types.ThumbnailSize, activeT
 
 // broadcastGeneration broadcasts that thumbnail generation completed and the error to all waiting goroutines
 // Note: This should only be called by the owner of the activeThumbnailGenerationResult
-func broadcastGeneration(dst types.Path, activeThumbnailGeneration *types.ActiveThumbnailGeneration, _ types.ThumbnailSize, errorReturn error, logger *log.Entry) {
+func broadcastGeneration(dst string, activeThumbnailGeneration *types.ActiveThumbnailGeneration, _ types.ThumbnailSize, errorReturn error, logger *log.Entry) {
 	activeThumbnailGeneration.Lock()
 	defer activeThumbnailGeneration.Unlock()
 	if activeThumbnailGenerationResult, ok := activeThumbnailGeneration.PathToResult[string(dst)]; ok {
@@ -133,7 +144,8 @@ func broadcastGeneration(dst types.Path, activeThumbnailGeneration *types.Active
 
 func isThumbnailExists(
 	ctx context.Context,
-	dst types.Path,
+	store filestore.Store,
+	dst string,
 	config types.ThumbnailSize,
 	mediaMetadata *types.MediaMetadata,
 	db storage.Database,
@@ -141,7 +153,7 @@ func isThumbnailExists(
 ) (bool, error) {
 	thumbnailMetadata, err := db.GetThumbnail(
 		ctx, mediaMetadata.MediaID, mediaMetadata.Origin,
-		config.Width, config.Height, config.ResizeMethod,
+		config.Width, config.Height, config.ResizeMethod, config.Animated,
 	)
 	if err != nil {
 		logger.Error("Failed to query database for thumbnail.")
@@ -150,11 +162,9 @@ func isThumbnailExists(
 	if thumbnailMetadata != nil {
 		return true, nil
 	}
-	// Note: The double-negative is intentional as os.IsExist(err) != !os.IsNotExist(err).
-	// The functions are error checkers to be used in different cases.
-	if _, err = os.Stat(string(dst)); !os.IsNotExist(err) {
-		// Thumbnail exists
-		return true, nil
+	if _, err = store.Stat(ctx, dst); err != filestore.ErrNotFound {
+		// Thumbnail exists or the store failed, either way the thumbnail can't be generated
+		return err == nil, err
 	}
 	return false, nil
 }
@@ -162,11 +172,12 @@ func isThumbnailExists(
 // init with worst values
 func newThumbnailFitness() thumbnailFitness {
 	return thumbnailFitness{
-		isSmaller:      1,
-		aspect:         math.Inf(1),
-		size:           math.Inf(1),
-		methodMismatch: 0,
-		fileSize:       types.FileSizeBytes(math.MaxInt64),
+		isSmaller:         1,
+		animationMismatch: 1,
+		aspect:            math.Inf(1),
+		size:              math.Inf(1),
+		methodMismatch:    0,
+		fileSize:          types.FileSizeBytes(math.MaxInt64),
 	}
 }
 
@@ -184,6 +195,8 @@ func calcThumbnailFitness(size types.ThumbnailSize, metadata *types.MediaMetadat
 	fitness.aspect = math.Abs(float64(dW*tH - dH*tW))
 	// compare sizes
 	fitness.size = math.Abs(float64((dW - tW) * (dH - tH)))
+	// compare animation
+	fitness.animationMismatch = boolToInt(size.Animated != desired.Animated)
 	// compare resize method
 	fitness.methodMismatch = boolToInt(size.ResizeMethod != desired.ResizeMethod)
 	if metadata != nil {
@@ -212,6 +225,13 @@ func (a thumbnailFitness) betterThan(b thumbnailFitness, desiredCrop bool) bool
 		return true
 	}
 
+	// prefer animated images only if desired animated
+	if a.animationMismatch > b.animationMismatch {
+		return false
+	} else if a.animationMismatch < b.animationMismatch {
+		return true
+	}
+
 	// prefer aspect ratios closer to desired only if desired cropped
 	// only cropped images have differing aspect ratios
 	// desired scaled only accepts scaled images
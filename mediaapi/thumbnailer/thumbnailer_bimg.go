@@ -18,10 +18,11 @@
 package thumbnailer
 
 import (
+	"bytes"
 	"context"
-	"os"
 	"time"
 
+	"github.com/matrix-org/dendrite/mediaapi/filestore"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -32,32 +33,39 @@ import (
 // GenerateThumbnails generates the configured thumbnail sizes for the source file
 func GenerateThumbnails(
 	ctx context.Context,
-	src types.Path,
+	store filestore.Store,
 	configs []config.ThumbnailSize,
+	externalThumbnailers *config.ExternalThumbnailers,
 	mediaMetadata *types.MediaMetadata,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 	db storage.Database,
 	logger *log.Entry,
 ) (busy bool, errorReturn error) {
-	buffer, err := bimg.Read(string(src))
+	src, err := filestore.MediaKey(mediaMetadata.Base64Hash)
+	if err != nil {
+		return false, err
+	}
+	buffer, anim, err := readSource(ctx, store, src, externalThumbnailers)
 	if err != nil {
 		logger.WithError(err).WithField("src", src).Error("Failed to read src file")
 		return false, err
 	}
 	img := bimg.NewImage(buffer)
 	for _, config := range configs {
-		// Note: createThumbnail does locking based on activeThumbnailGeneration
-		busy, err = createThumbnail(
-			ctx, src, img, types.ThumbnailSize(config), mediaMetadata, activeThumbnailGeneration,
-			maxThumbnailGenerators, db, logger,
-		)
-		if err != nil {
-			logger.WithError(err).WithField("src", src).Error("Failed to generate thumbnails")
-			return false, err
-		}
-		if busy {
-			return true, nil
+		for _, size := range configuredSizes(config, anim != nil) {
+			// Note: createThumbnail does locking based on activeThumbnailGeneration
+			busy, err = createThumbnail(
+				ctx, store, img, anim, size, mediaMetadata, activeThumbnailGeneration,
+				maxThumbnailGenerators, db, logger,
+			)
+			if err != nil {
+				logger.WithError(err).WithField("src", src).Error("Failed to generate thumbnails")
+				return false, err
+			}
+			if busy {
+				return true, nil
+			}
 		}
 	}
 	return false, nil
@@ -66,15 +74,20 @@ func GenerateThumbnails(
 // GenerateThumbnail generates the configured thumbnail size for the source file
 func GenerateThumbnail(
 	ctx context.Context,
-	src types.Path,
+	store filestore.Store,
 	config types.ThumbnailSize,
+	externalThumbnailers *config.ExternalThumbnailers,
 	mediaMetadata *types.MediaMetadata,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 	db storage.Database,
 	logger *log.Entry,
 ) (busy bool, errorReturn error) {
-	buffer, err := bimg.Read(string(src))
+	src, err := filestore.MediaKey(mediaMetadata.Base64Hash)
+	if err != nil {
+		return false, err
+	}
+	buffer, anim, err := readSource(ctx, store, src, externalThumbnailers)
 	if err != nil {
 		logger.WithError(err).WithFields(log.Fields{
 			"src": src,
@@ -84,7 +97,7 @@ func GenerateThumbnail(
 	img := bimg.NewImage(buffer)
 	// Note: createThumbnail does locking based on activeThumbnailGeneration
 	busy, err = createThumbnail(
-		ctx, src, img, config, mediaMetadata, activeThumbnailGeneration,
+		ctx, store, img, anim, config, mediaMetadata, activeThumbnailGeneration,
 		maxThumbnailGenerators, db, logger,
 	)
 	if err != nil {
@@ -103,8 +116,9 @@ func GenerateThumbnail(
 // Thumbnail generation is only done once for each non-existing thumbnail.
 func createThumbnail(
 	ctx context.Context,
-	src types.Path,
+	store filestore.Store,
 	img *bimg.Image,
+	anim *animation,
 	config types.ThumbnailSize,
 	mediaMetadata *types.MediaMetadata,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
@@ -112,10 +126,14 @@ func createThumbnail(
 	db storage.Database,
 	logger *log.Entry,
 ) (busy bool, errorReturn error) {
+	if anim == nil {
+		config.Animated = false
+	}
 	logger = logger.WithFields(log.Fields{
 		"Width":        config.Width,
 		"Height":       config.Height,
 		"ResizeMethod": config.ResizeMethod,
+		"Animated":     config.Animated,
 	})
 
 	// Check if request is larger than original
@@ -123,7 +141,10 @@ func createThumbnail(
 		return false, nil
 	}
 
-	dst := GetThumbnailPath(src, config)
+	dst, err := filestore.ThumbnailKey(mediaMetadata.Base64Hash, config)
+	if err != nil {
+		return false, err
+	}
 
 	// Note: getActiveThumbnailGeneration uses mutexes and conditions from activeThumbnailGeneration
 	isActive, busy, err := getActiveThumbnailGeneration(dst, config, activeThumbnailGeneration, maxThumbnailGenerators, logger)
@@ -147,13 +168,23 @@ func createThumbnail(
 		}()
 	}
 
-	exists, err := isThumbnailExists(ctx, dst, config, mediaMetadata, db, logger)
+	exists, err := isThumbnailExists(ctx, store, dst, config, mediaMetadata, db, logger)
 	if err != nil || exists {
 		return false, err
 	}
 
 	start := time.Now()
-	width, height, err := resize(dst, img, config.Width, config.Height, config.ResizeMethod == "crop", logger)
+	contentType := types.ContentType("image/jpeg")
+	var width, height int
+	if config.Animated {
+		contentType = "image/gif"
+		width, height, err = writeAnimation(ctx, store, dst, anim, config.Width, config.Height, config.ResizeMethod == "crop")
+		if err != nil {
+			logger.WithError(err).Error("Failed to encode and write animation")
+		}
+	} else {
+		width, height, err = resize(ctx, store, dst, img, config.Width, config.Height, config.ResizeMethod == "crop", logger)
+	}
 	if err != nil {
 		return false, err
 	}
@@ -163,7 +194,7 @@ func createThumbnail(
 		"processTime":  time.Now().Sub(start),
 	}).Info("Generated thumbnail")
 
-	stat, err := os.Stat(string(dst))
+	size, err := store.Stat(ctx, dst)
 	if err != nil {
 		return false, err
 	}
@@ -172,14 +203,15 @@ func createThumbnail(
 		MediaMetadata: &types.MediaMetadata{
 			MediaID: mediaMetadata.MediaID,
 			Origin:  mediaMetadata.Origin,
-			// Note: the code currently always creates a JPEG thumbnail
-			ContentType:   types.ContentType("image/jpeg"),
-			FileSizeBytes: types.FileSizeBytes(stat.Size()),
+			// Note: still thumbnails are JPEGs and animated thumbnails GIFs
+			ContentType:   contentType,
+			FileSizeBytes: types.FileSizeBytes(size),
 		},
 		ThumbnailSize: types.ThumbnailSize{
 			Width:        config.Width,
 			Height:       config.Height,
 			ResizeMethod: config.ResizeMethod,
+			Animated:     config.Animated,
 		},
 	}
 
@@ -206,7 +238,7 @@ func isLargerThanOriginal(config types.ThumbnailSize, img *bimg.Image) bool {
 // resize scales an image to fit within the provided width and height
 // If the source aspect ratio is different to the target dimensions, one edge will be smaller than requested
 // If crop is set to true, the image will be scaled to fill the width and height with any excess being cropped off
-func resize(dst types.Path, inImage *bimg.Image, w, h int, crop bool, logger *log.Entry) (int, int, error) {
+func resize(ctx context.Context, store filestore.Store, dst string, inImage *bimg.Image, w, h int, crop bool, logger *log.Entry) (int, int, error) {
 	inSize, err := inImage.Size()
 	if err != nil {
 		return -1, -1, err
@@ -240,7 +272,7 @@ func resize(dst types.Path, inImage *bimg.Image, w, h int, crop bool, logger *lo
 		return -1, -1, err
 	}
 
-	if err = bimg.Write(string(dst), newImage); err != nil {
+	if err = store.Put(ctx, dst, bytes.NewReader(newImage), int64(len(newImage))); err != nil {
 		logger.WithError(err).Error("Failed to resize image")
 		return -1, -1, err
 	}
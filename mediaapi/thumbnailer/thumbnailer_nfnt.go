@@ -18,9 +18,9 @@
 package thumbnailer
 
 import (
+	"bytes"
 	"context"
 	"image"
-	"image/draw"
 
 	// Imported for gif codec
 	_ "image/gif"
@@ -32,44 +32,50 @@ import (
 	// Imported for webp codec
 	_ "golang.org/x/image/webp"
 
-	"os"
 	"time"
 
+	"github.com/matrix-org/dendrite/mediaapi/filestore"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/matrix-org/dendrite/setup/config"
-	"github.com/nfnt/resize"
 	log "github.com/sirupsen/logrus"
 )
 
 // GenerateThumbnails generates the configured thumbnail sizes for the source file
 func GenerateThumbnails(
 	ctx context.Context,
-	src types.Path,
+	store filestore.Store,
 	configs []config.ThumbnailSize,
+	externalThumbnailers *config.ExternalThumbnailers,
 	mediaMetadata *types.MediaMetadata,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 	db storage.Database,
 	logger *log.Entry,
 ) (busy bool, errorReturn error) {
-	img, err := readFile(string(src))
+	src, err := filestore.MediaKey(mediaMetadata.Base64Hash)
+	if err != nil {
+		return false, err
+	}
+	img, anim, err := readFile(ctx, store, src, externalThumbnailers)
 	if err != nil {
 		logger.WithError(err).WithField("src", src).Error("Failed to read src file")
 		return false, err
 	}
 	for _, singleConfig := range configs {
-		// Note: createThumbnail does locking based on activeThumbnailGeneration
-		busy, err = createThumbnail(
-			ctx, src, img, types.ThumbnailSize(singleConfig), mediaMetadata,
-			activeThumbnailGeneration, maxThumbnailGenerators, db, logger,
-		)
-		if err != nil {
-			logger.WithError(err).WithField("src", src).Error("Failed to generate thumbnails")
-			return false, err
-		}
-		if busy {
-			return true, nil
+		for _, size := range configuredSizes(singleConfig, anim != nil) {
+			// Note: createThumbnail does locking based on activeThumbnailGeneration
+			busy, err = createThumbnail(
+				ctx, store, img, anim, size, mediaMetadata,
+				activeThumbnailGeneration, maxThumbnailGenerators, db, logger,
+			)
+			if err != nil {
+				logger.WithError(err).WithField("src", src).Error("Failed to generate thumbnails")
+				return false, err
+			}
+			if busy {
+				return true, nil
+			}
 		}
 	}
 	return false, nil
@@ -78,15 +84,20 @@ func GenerateThumbnails(
 // GenerateThumbnail generates the configured thumbnail size for the source file
 func GenerateThumbnail(
 	ctx context.Context,
-	src types.Path,
+	store filestore.Store,
 	config types.ThumbnailSize,
+	externalThumbnailers *config.ExternalThumbnailers,
 	mediaMetadata *types.MediaMetadata,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 	db storage.Database,
 	logger *log.Entry,
 ) (busy bool, errorReturn error) {
-	img, err := readFile(string(src))
+	src, err := filestore.MediaKey(mediaMetadata.Base64Hash)
+	if err != nil {
+		return false, err
+	}
+	img, anim, err := readFile(ctx, store, src, externalThumbnailers)
 	if err != nil {
 		logger.WithError(err).WithFields(log.Fields{
 			"src": src,
@@ -95,7 +106,7 @@ func GenerateThumbnail(
 	}
 	// Note: createThumbnail does locking based on activeThumbnailGeneration
 	busy, err = createThumbnail(
-		ctx, src, img, config, mediaMetadata, activeThumbnailGeneration,
+		ctx, store, img, anim, config, mediaMetadata, activeThumbnailGeneration,
 		maxThumbnailGenerators, db, logger,
 	)
 	if err != nil {
@@ -110,39 +121,39 @@ func GenerateThumbnail(
 	return false, nil
 }
 
-func readFile(src string) (image.Image, error) {
-	file, err := os.Open(src)
+func readFile(
+	ctx context.Context, store filestore.Store, src string, externalThumbnailers *config.ExternalThumbnailers,
+) (image.Image, *animation, error) {
+	still, anim, err := readSource(ctx, store, src, externalThumbnailers)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	defer file.Close() // nolint: errcheck
 
-	img, _, err := image.Decode(file)
+	img, _, err := image.Decode(bytes.NewReader(still))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return img, nil
+	return img, anim, nil
 }
 
-func writeFile(img image.Image, dst string) (err error) {
-	out, err := os.Create(dst)
-	if err != nil {
+func writeFile(ctx context.Context, store filestore.Store, img image.Image, dst string) error {
+	var out bytes.Buffer
+	if err := jpeg.Encode(&out, img, &jpeg.Options{
+		Quality: 85,
+	}); err != nil {
 		return err
 	}
-	defer (func() { err = out.Close() })()
-
-	return jpeg.Encode(out, img, &jpeg.Options{
-		Quality: 85,
-	})
+	return store.Put(ctx, dst, &out, int64(out.Len()))
 }
 
 // createThumbnail checks if the thumbnail exists, and if not, generates it
 // Thumbnail generation is only done once for each non-existing thumbnail.
 func createThumbnail(
 	ctx context.Context,
-	src types.Path,
+	store filestore.Store,
 	img image.Image,
+	anim *animation,
 	config types.ThumbnailSize,
 	mediaMetadata *types.MediaMetadata,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
@@ -150,10 +161,14 @@ func createThumbnail(
 	db storage.Database,
 	logger *log.Entry,
 ) (busy bool, errorReturn error) {
+	if anim == nil {
+		config.Animated = false
+	}
 	logger = logger.WithFields(log.Fields{
 		"Width":        config.Width,
 		"Height":       config.Height,
 		"ResizeMethod": config.ResizeMethod,
+		"Animated":     config.Animated,
 	})
 
 	// Check if request is larger than original
@@ -161,7 +176,10 @@ func createThumbnail(
 		return false, nil
 	}
 
-	dst := GetThumbnailPath(src, config)
+	dst, err := filestore.ThumbnailKey(mediaMetadata.Base64Hash, config)
+	if err != nil {
+		return false, err
+	}
 
 	// Note: getActiveThumbnailGeneration uses mutexes and conditions from activeThumbnailGeneration
 	isActive, busy, err := getActiveThumbnailGeneration(dst, config, activeThumbnailGeneration, maxThumbnailGenerators, logger)
@@ -185,13 +203,23 @@ func createThumbnail(
 		}()
 	}
 
-	exists, err := isThumbnailExists(ctx, dst, config, mediaMetadata, db, logger)
+	exists, err := isThumbnailExists(ctx, store, dst, config, mediaMetadata, db, logger)
 	if err != nil || exists {
 		return false, err
 	}
 
 	start := time.Now()
-	width, height, err := adjustSize(dst, img, config.Width, config.Height, config.ResizeMethod == types.Crop, logger)
+	contentType := types.ContentType("image/jpeg")
+	var width, height int
+	if config.Animated {
+		contentType = "image/gif"
+		width, height, err = writeAnimation(ctx, store, dst, anim, config.Width, config.Height, config.ResizeMethod == types.Crop)
+		if err != nil {
+			logger.WithError(err).Error("Failed to encode and write animation")
+		}
+	} else {
+		width, height, err = adjustSize(ctx, store, dst, img, config.Width, config.Height, config.ResizeMethod == types.Crop, logger)
+	}
 	if err != nil {
 		return false, err
 	}
@@ -201,7 +229,7 @@ func createThumbnail(
 		"processTime":  time.Since(start),
 	}).Info("Generated thumbnail")
 
-	stat, err := os.Stat(string(dst))
+	size, err := store.Stat(ctx, dst)
 	if err != nil {
 		return false, err
 	}
@@ -210,14 +238,15 @@ func createThumbnail(
 		MediaMetadata: &types.MediaMetadata{
 			MediaID: mediaMetadata.MediaID,
 			Origin:  mediaMetadata.Origin,
-			// Note: the code currently always creates a JPEG thumbnail
-			ContentType:   types.ContentType("image/jpeg"),
-			FileSizeBytes: types.FileSizeBytes(stat.Size()),
+			// Note: still thumbnails are JPEGs and animated thumbnails GIFs
+			ContentType:   contentType,
+			FileSizeBytes: types.FileSizeBytes(size),
 		},
 		ThumbnailSize: types.ThumbnailSize{
 			Width:        config.Width,
 			Height:       config.Height,
 			ResizeMethod: config.ResizeMethod,
+			Animated:     config.Animated,
 		},
 	}
 
@@ -236,38 +265,9 @@ func createThumbnail(
 // adjustSize scales an image to fit within the provided width and height
 // If the source aspect ratio is different to the target dimensions, one edge will be smaller than requested
 // If crop is set to true, the image will be scaled to fill the width and height with any excess being cropped off
-func adjustSize(dst types.Path, img image.Image, w, h int, crop bool, logger *log.Entry) (int, int, error) {
-	var out image.Image
-	var err error
-	if crop {
-		inAR := float64(img.Bounds().Dx()) / float64(img.Bounds().Dy())
-		outAR := float64(w) / float64(h)
-
-		var scaleW, scaleH uint
-		if inAR > outAR {
-			// input has shorter AR than requested output so use requested height and calculate width to match input AR
-			scaleW = uint(float64(h) * inAR)
-			scaleH = uint(h)
-		} else {
-			// input has taller AR than requested output so use requested width and calculate height to match input AR
-			scaleW = uint(w)
-			scaleH = uint(float64(w) / inAR)
-		}
-
-		scaled := resize.Resize(scaleW, scaleH, img, resize.Lanczos3)
-
-		xoff := (scaled.Bounds().Dx() - w) / 2
-		yoff := (scaled.Bounds().Dy() - h) / 2
-
-		tr := image.Rect(0, 0, w, h)
-		target := image.NewRGBA(tr)
-		draw.Draw(target, tr, scaled, image.Pt(xoff, yoff), draw.Src)
-		out = target
-	} else {
-		out = resize.Thumbnail(uint(w), uint(h), img, resize.Lanczos3)
-	}
-
-	if err = writeFile(out, string(dst)); err != nil {
+func adjustSize(ctx context.Context, store filestore.Store, dst string, img image.Image, w, h int, crop bool, logger *log.Entry) (int, int, error) {
+	out := resizeImage(img, w, h, crop)
+	if err := writeFile(ctx, store, out, dst); err != nil {
 		logger.WithError(err).Error("Failed to encode and write image")
 		return -1, -1, err
 	}
@@ -57,6 +57,83 @@ type MediaMetadata struct {
 	UserID            MatrixUserID
 }
 
+// URLPreview is a cached response to a preview_url request
+type URLPreview struct {
+	URL string
+	// Start of the time bucket the preview belongs to, in UNIX epoch ms
+	BucketTimestamp gomatrixserverlib.Timestamp
+	// The OpenGraph JSON object as returned to clients
+	Response []byte
+	// When the preview was generated in UNIX epoch ms
+	CreationTimestamp gomatrixserverlib.Timestamp
+}
+
+// PendingUpload is a media ID reserved with /create whose content has not been uploaded yet
+type PendingUpload struct {
+	MediaID MediaID
+	Origin  gomatrixserverlib.ServerName
+	// The user who reserved the media ID, only they may upload the content
+	UserID MatrixUserID
+	// When the media ID was reserved in UNIX epoch ms
+	CreationTimestamp gomatrixserverlib.Timestamp
+	// When the reservation expires if no content was uploaded in UNIX epoch ms
+	ExpiresTimestamp gomatrixserverlib.Timestamp
+}
+
+// ImageMetadata is information about an image file which clients use before downloading it
+type ImageMetadata struct {
+	Base64Hash Base64Hash
+	// The size of the image as it is displayed, i.e. after applying the EXIF orientation
+	Width  int
+	Height int
+	// A compact representation of a placeholder for the image, see https://blurha.sh/
+	// Empty if the image was too large to decode.
+	Blurhash string
+	// The EXIF orientation of the stored image, 1 if it has none
+	Orientation int
+}
+
+// ScanResult is the verdict of the content scanner on a file
+type ScanResult struct {
+	Base64Hash Base64Hash
+	// Whether the file may be stored and served
+	Clean bool
+	// Why the file was rejected, i.e. the name of the detected virus
+	Reason string
+	// When the file was scanned in UNIX epoch ms
+	ScannedTimestamp gomatrixserverlib.Timestamp
+}
+
+// MediaAuditEntry records an action a server admin took on media
+type MediaAuditEntry struct {
+	// The admin who took the action
+	UserID MatrixUserID
+	// The action, e.g. quarantine_media
+	Action string
+	// What the action was taken on, i.e. a user ID, room ID or mxc URI
+	Target string
+	// The number of media affected by the action
+	Affected int64
+	// When the action was taken in UNIX epoch ms
+	Timestamp gomatrixserverlib.Timestamp
+}
+
+// UserMedia is media uploaded by a user as listed to server admins
+type UserMedia struct {
+	*MediaMetadata
+	// Whether the media was quarantined by an admin
+	Quarantined bool
+}
+
+// ActivePendingUploads is a lockable map of reserved media IDs which downloads are waiting for.
+// The channel is closed once the content has been uploaded.
+type ActivePendingUploads struct {
+	sync.Mutex
+	MediaIDToUploaded map[MediaID]chan struct{}
+	// The reserved media IDs whose content is being uploaded right now
+	Uploading map[MediaID]bool
+}
+
 // RemoteRequestResult is used for broadcasting the result of a request for a remote file to routines waiting on the condition
 type RemoteRequestResult struct {
 	// Condition used for the requester to signal the result to all other routines waiting on this condition
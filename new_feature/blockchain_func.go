@@ -52,6 +52,19 @@ func QueryUserInfoByLocal(local string) InfoRes {
 	return res
 }
 
+// QueryPledgeLevelByLocal returns the pledge level of the user, 0 if the user is not on chain.
+// Unlike QueryUserInfoByLocal it returns an error if the chain can't be queried.
+func QueryPledgeLevelByLocal(local string) (int64, error) {
+	info, err := chatClient.QueryUserInfo(local)
+	if err != nil {
+		return 0, err
+	}
+	if info.Status != 0 {
+		return 0, nil
+	}
+	return info.UserInfo.PledgeLevel, nil
+}
+
 func JudgeIfPayByLocals(from, to string) bool {
 	logger.WithField("from", from).WithField("to", to).Info("JudgeIfPayByLocals")
 	isPay, err := chatClient.QueryChatSendGift(from, to)
@@ -1,13 +1,16 @@
 package media_manage
 
 import (
+	"context"
 	"fmt"
 	"freemasonry.cc/blockchain/client"
+	"freemasonry.cc/chat/mediaapi/filestore"
+	"freemasonry.cc/chat/mediaapi/fileutils"
+	"freemasonry.cc/chat/mediaapi/storage"
+	"freemasonry.cc/chat/mediaapi/types"
 	"freemasonry.cc/chat/new_feature"
-	"freemasonry.cc/chat/new_feature/new_db"
+	"github.com/matrix-org/gomatrixserverlib"
 	log "github.com/sirupsen/logrus"
-	"os"
-	"path/filepath"
 	"sync"
 	"time"
 )
@@ -26,13 +29,17 @@ type MediaManager struct {
 	MaxPanSize    uint64
 	CantAvailable bool
 	CleanInterval int64 // clean the file timeout for several days
+	DB            storage.Database
+	Store         filestore.Store
 }
 
-func NewMediaManager(cleanInterval int64) *MediaManager {
+func NewMediaManager(cleanInterval int64, db storage.Database, store filestore.Store) *MediaManager {
 	manager := &MediaManager{
 		MediaFlowMap:  make(map[string]*MediaFlowInfo, 64),
 		MaxPanSize:    GetMaxPanSize() / 2 / uint64(cleanInterval),
 		CleanInterval: cleanInterval,
+		DB:            db,
+		Store:         store,
 	}
 	go manager.Run()
 	return manager
@@ -120,31 +127,30 @@ func (m *MediaManager) GetChainInfoByAddr(addr string) float64 {
 }
 
 func (m *MediaManager) CleanTimeoutFiles() {
-	pathThis, _ := os.Getwd()
 	parseDuration, _ := time.ParseDuration(fmt.Sprintf("-%dh", m.CleanInterval*24))
-	ts := time.Now().Add(parseDuration).UnixMilli()
-	base64Hashs := new_db.GetTimeoutFilesBase64Hash(ts)
-	if len(base64Hashs) > 0 {
-		for _, base64Hash := range base64Hashs {
-			filePathTmp := filepath.Join(pathThis, "media_store", base64Hash[0:1], base64Hash[1:2], base64Hash[2:])
-			os.RemoveAll(filePathTmp)
-		}
-		new_db.DeleteMediaRepository(base64Hashs)
+	ts := gomatrixserverlib.AsTimestamp(time.Now().Add(parseDuration))
+	metas, err := m.DB.GetTimedOutMediaMetadata(context.Background(), ts)
+	if err != nil {
+		log.WithError(err).Error("DB.GetTimedOutMediaMetadata")
+		return
+	}
+	for _, meta := range metas {
+		m.deleteMedia(meta)
 	}
 }
 
 func (m *MediaManager) CleanFilesForUser(userId string, size int64) int64 { // remove some files for user to save a new file
-	pathThis, _ := os.Getwd()
-	MetaL := new_db.GetFilesBase64HashForUser(userId)
+	MetaL, err := m.DB.GetMediaMetadataForUser(context.Background(), types.MatrixUserID(userId))
+	if err != nil {
+		log.WithError(err).WithField("user_id", userId).Error("DB.GetMediaMetadataForUser")
+		return 0
+	}
 	var sum int64 = 0
 	for _, meta := range MetaL {
-		exUse := new_db.GetFilesBase64HashExUse(userId, meta.MediaId)
-		if len(exUse) == 0 {
-			filePathTmp := filepath.Join(pathThis, "media_store", meta.Base64hash[0:1], meta.Base64hash[1:2], meta.Base64hash[2:])
-			os.RemoveAll(filePathTmp)
+		if !m.deleteMedia(meta) {
+			continue
 		}
-		new_db.DeleteMediaRepositoryById(meta.MediaId)
-		sum += meta.FileSizeBytes
+		sum += int64(meta.FileSizeBytes)
 		if sum >= size {
 			break
 		}
@@ -152,6 +158,16 @@ func (m *MediaManager) CleanFilesForUser(userId string, size int64) int64 { // r
 	return sum
 }
 
+// deleteMedia deletes the media, its file is only removed once no other media uses it
+func (m *MediaManager) deleteMedia(meta *types.MediaMetadata) bool {
+	logger := log.WithField("media_id", meta.MediaID)
+	if _, err := fileutils.DeleteMedia(context.Background(), m.DB, m.Store, meta.MediaID, meta.Origin, logger); err != nil {
+		logger.WithError(err).Error("fileutils.DeleteMedia")
+		return false
+	}
+	return true
+}
+
 func (m *MediaManager) UpdateMaxPanSize() {
 	m.lock.Lock()
 	m.MaxPanSize = GetMaxPanSize() / 2 / uint64(m.CleanInterval)
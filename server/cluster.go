@@ -0,0 +1,666 @@
+package main
+
+// Clustering: topics are sharded across nodes by consistent hashing of the topic name.
+// A session may be connected to any node. Messages for topics hosted at other nodes are
+// forwarded to the owning node where they are handled by a proxy session.
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/rpc"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/daodst/chat/server/ringhash"
+	"github.com/daodst/chat/server/store/types"
+)
+
+const (
+	// Default interval between heartbeats
+	clusterDefaultHeartbeat = time.Second * 2
+	// Default number of missed heartbeats before the node is considered dead
+	clusterDefaultFailAfter = 3
+	// Number of times each node is placed on the hash ring
+	clusterRingReplicas = 20
+	// Maximum delay between attempts to reconnect to a node
+	clusterMaxReconnectDelay = time.Second * 10
+)
+
+type clusterNodeConfig struct {
+	Name string `json:"name"`
+	Addr string `json:"addr"`
+}
+
+type clusterConfig struct {
+	// List of all members of the cluster, including this one
+	Nodes []clusterNodeConfig `json:"nodes"`
+	// Name of this node, could be overridden from the command line
+	ThisName string `json:"self"`
+	// Interval between heartbeats in milliseconds
+	Heartbeat int `json:"heartbeat,omitempty"`
+	// Number of missed heartbeats before the node is considered dead and its topics are rehomed
+	FailAfter int `json:"fail_after,omitempty"`
+}
+
+// ClusterSess is the description of a session at the originating node
+type ClusterSess struct {
+	Sid        string
+	Uid        types.Uid
+	AppId      uint32
+	Tag        string
+	RemoteAddr string
+}
+
+// ClusterReq is a client message forwarded from the node the session is connected to
+// to the node which hosts the topic
+type ClusterReq struct {
+	// Name of the originating node
+	Node string
+	Sess ClusterSess
+	// Raw client message
+	Msg []byte
+	// The session at the originating node was terminated
+	Gone bool
+}
+
+// ClusterResp is a message from the topic host to a session at the originating node
+type ClusterResp struct {
+	// Session ID at the originating node
+	FromSid string
+	// Serialized server message
+	Msg []byte
+}
+
+// ClusterRoute is a message routed by hub to a topic hosted at another node, like an invite to 'me'
+type ClusterRoute struct {
+	Node   string
+	AppId  uint32
+	RcptTo string
+	// Serialized server message
+	Msg []byte
+}
+
+// ClusterPing is a heartbeat
+type ClusterPing struct {
+	Node string
+}
+
+// ClusterNode is a connection to another node of the cluster
+type ClusterNode struct {
+	lock sync.Mutex
+
+	name    string
+	address string
+
+	endpoint     *rpc.Client
+	connected    bool
+	reconnecting bool
+
+	// Count of consecutive failed heartbeats
+	failCount int
+
+	// Channel for shutting down the reconnect loop
+	done chan bool
+}
+
+// remoteSub records a subscription of a local session to a topic hosted at another node
+type remoteSub struct {
+	node     string
+	original string
+}
+
+// Cluster is the collection of nodes hosting the chat service
+type Cluster struct {
+	thisNodeName string
+	listenOn     string
+
+	// Other nodes of the cluster, indexed by name
+	nodes map[string]*ClusterNode
+
+	// Ring of live nodes, guarded by ringLock
+	ring     *ringhash.Ring
+	live     map[string]bool
+	ringLock sync.RWMutex
+
+	// Proxy sessions serving sessions connected to other nodes, indexed by node name + sid
+	proxied     map[string]*Session
+	proxiedLock sync.Mutex
+
+	// Local sessions subscribed to topics at other nodes, indexed by sid.
+	// Session.remoteSubs is also guarded by sessLock
+	remote   map[string]*Session
+	sessLock sync.Mutex
+
+	heartbeat time.Duration
+	failAfter int
+
+	listener net.Listener
+	done     chan bool
+}
+
+// clusterInit creates the cluster from the config. Returns nil if clustering is not configured.
+func clusterInit(configString json.RawMessage, self string) (*Cluster, error) {
+	if len(configString) == 0 {
+		log.Println("Cluster: running as a stand-alone server")
+		return nil, nil
+	}
+
+	var config clusterConfig
+	if err := json.Unmarshal(configString, &config); err != nil {
+		return nil, errors.New("cluster: failed to parse config: " + err.Error())
+	}
+
+	if self != "" {
+		config.ThisName = self
+	}
+
+	if len(config.Nodes) < 2 {
+		log.Println("Cluster: fewer than two nodes configured, running as a stand-alone server")
+		return nil, nil
+	}
+
+	c := &Cluster{
+		thisNodeName: config.ThisName,
+		nodes:        make(map[string]*ClusterNode),
+		live:         make(map[string]bool),
+		proxied:      make(map[string]*Session),
+		remote:       make(map[string]*Session),
+		heartbeat:    clusterDefaultHeartbeat,
+		failAfter:    clusterDefaultFailAfter,
+		done:         make(chan bool, 1)}
+
+	if config.Heartbeat > 0 {
+		c.heartbeat = time.Duration(config.Heartbeat) * time.Millisecond
+	}
+	if config.FailAfter > 0 {
+		c.failAfter = config.FailAfter
+	}
+
+	for _, nc := range config.Nodes {
+		if nc.Name == c.thisNodeName {
+			c.listenOn = nc.Addr
+			continue
+		}
+		c.nodes[nc.Name] = &ClusterNode{name: nc.Name, address: nc.Addr, done: make(chan bool, 1)}
+	}
+
+	if c.listenOn == "" {
+		return nil, errors.New("cluster: this node '" + c.thisNodeName + "' is not listed in the config")
+	}
+
+	// All nodes are assumed to be alive at startup
+	c.live[c.thisNodeName] = true
+	for name := range c.nodes {
+		c.live[name] = true
+	}
+	c.rebuildRing()
+
+	return c, nil
+}
+
+// start begins accepting connections from other nodes and connects to them
+func (c *Cluster) start() error {
+	if err := rpc.Register(c); err != nil {
+		return err
+	}
+
+	var err error
+	if c.listener, err = net.Listen("tcp", c.listenOn); err != nil {
+		return err
+	}
+	go rpc.Accept(c.listener)
+
+	for _, n := range c.nodes {
+		go n.reconnect()
+	}
+
+	go c.run()
+
+	log.Printf("Cluster: node '%s' listening on [%s], %d peers", c.thisNodeName, c.listenOn, len(c.nodes))
+	return nil
+}
+
+// shutdown stops the heartbeats, disconnects from other nodes and stops accepting connections
+func (c *Cluster) shutdown() {
+	c.done <- true
+	if c.listener != nil {
+		c.listener.Close()
+	}
+	for _, n := range c.nodes {
+		n.close()
+	}
+	log.Println("Cluster: shut down")
+}
+
+// run sends heartbeats to other nodes and rehashes the ring when nodes go up or down
+func (c *Cluster) run() {
+	ticker := time.NewTicker(c.heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if c.checkNodes() {
+				c.rehash()
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// checkNodes pings all other nodes and updates the list of live nodes.
+// Returns true if the list has changed.
+func (c *Cluster) checkNodes() bool {
+	var changed bool
+
+	// Ping nodes without holding the lock, a slow node must not block routing
+	alive := make(map[string]bool, len(c.nodes))
+	for name, n := range c.nodes {
+		alive[name] = n.ping(&ClusterPing{Node: c.thisNodeName}, c.heartbeat) == nil
+	}
+
+	c.ringLock.Lock()
+	defer c.ringLock.Unlock()
+
+	for name, n := range c.nodes {
+		if !alive[name] {
+			n.failCount++
+			if c.live[name] && n.failCount >= c.failAfter {
+				log.Printf("Cluster: node '%s' is down", name)
+				delete(c.live, name)
+				changed = true
+			}
+		} else {
+			n.failCount = 0
+			if !c.live[name] {
+				log.Printf("Cluster: node '%s' is up", name)
+				c.live[name] = true
+				changed = true
+			}
+		}
+	}
+
+	if changed {
+		c.rebuildRing()
+	}
+
+	return changed
+}
+
+// rebuildRing places live nodes on the hash ring. Must be called with ringLock held.
+func (c *Cluster) rebuildRing() {
+	names := make([]string, 0, len(c.live))
+	for name := range c.live {
+		names = append(names, name)
+	}
+	// The order must be the same at every node
+	sort.Strings(names)
+
+	c.ring = ringhash.New(clusterRingReplicas, nil)
+	c.ring.Add(names...)
+}
+
+// rehash moves topics to their new owners after the list of live nodes has changed
+func (c *Cluster) rehash() {
+	// Local topics which are now owned by other nodes are shut down
+	globals.hub.rehash <- true
+
+	// Sessions subscribed to topics at nodes which are gone are told to resubscribe
+	c.ringLock.RLock()
+	live := make(map[string]bool, len(c.live))
+	for name := range c.live {
+		live[name] = true
+	}
+	c.ringLock.RUnlock()
+
+	c.sessLock.Lock()
+	for _, sess := range c.remote {
+		for topic, rs := range sess.remoteSubs {
+			if !live[rs.node] {
+				delete(sess.remoteSubs, topic)
+				sess.QueueOut(&ServerComMessage{Pres: &MsgServerPres{Topic: rs.original, What: "term"}})
+			}
+		}
+	}
+	c.sessLock.Unlock()
+
+	log.Printf("Cluster: rehashed, %d live nodes", len(live))
+}
+
+// nodeForTopic returns the node which hosts the topic or nil if the topic is hosted locally
+func (c *Cluster) nodeForTopic(topic string) *ClusterNode {
+	c.ringLock.RLock()
+	name := c.ring.Get(topic)
+	c.ringLock.RUnlock()
+
+	if name == c.thisNodeName {
+		return nil
+	}
+	return c.nodes[name]
+}
+
+// isLocal checks if the topic is hosted by this node
+func (c *Cluster) isLocal(topic string) bool {
+	return c.nodeForTopic(topic) == nil
+}
+
+// routeToTopic forwards a topic-bound client message to the node which hosts the topic.
+// Returns false if the topic is local and the message must be handled here.
+func (c *Cluster) routeToTopic(sess *Session, msg *ClientComMessage, raw []byte, id, original, topic string) bool {
+	n := c.nodeForTopic(topic)
+	if n == nil {
+		return false
+	}
+
+	c.sessLock.Lock()
+	if sess.remoteSubs == nil {
+		sess.remoteSubs = make(map[string]remoteSub)
+	}
+	if msg.Sub != nil {
+		sess.remoteSubs[topic] = remoteSub{node: n.name, original: original}
+	} else if msg.Leave != nil {
+		delete(sess.remoteSubs, topic)
+	}
+	c.remote[sess.sid] = sess
+	c.sessLock.Unlock()
+
+	var unused bool
+	err := n.call("Cluster.Master", &ClusterReq{
+		Node: c.thisNodeName,
+		Sess: ClusterSess{
+			Sid:        sess.sid,
+			Uid:        sess.uid,
+			AppId:      sess.appid,
+			Tag:        sess.tag,
+			RemoteAddr: sess.remoteAddr},
+		Msg: raw}, &unused)
+	if err != nil {
+		log.Printf("Cluster: failed to forward message to '%s': %s", n.name, err.Error())
+		sess.QueueOut(ErrClusterUnreachable(id, original, msg.timestamp))
+	}
+
+	return true
+}
+
+// routeToNode forwards a message generated by the hub or a topic to the node hosting the recipient topic.
+// Returns false if the recipient topic is local.
+func (c *Cluster) routeToNode(msg *ServerComMessage) bool {
+	n := c.nodeForTopic(msg.rcptto)
+	if n == nil {
+		return false
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Println("Cluster: failed to serialize message: " + err.Error())
+		return true
+	}
+
+	n.callAsync("Cluster.Route", &ClusterRoute{
+		Node:   c.thisNodeName,
+		AppId:  msg.appid,
+		RcptTo: msg.rcptto,
+		Msg:    data})
+
+	return true
+}
+
+// sessionGone informs other nodes that a local session was terminated
+func (c *Cluster) sessionGone(sess *Session) {
+	c.sessLock.Lock()
+	nodes := make(map[string]bool)
+	for _, rs := range sess.remoteSubs {
+		nodes[rs.node] = true
+	}
+	sess.remoteSubs = nil
+	delete(c.remote, sess.sid)
+	c.sessLock.Unlock()
+
+	for name := range nodes {
+		if n := c.nodes[name]; n != nil {
+			n.callAsync("Cluster.Master", &ClusterReq{
+				Node: c.thisNodeName,
+				Sess: ClusterSess{Sid: sess.sid},
+				Gone: true})
+		}
+	}
+}
+
+// proxyGone terminates a proxy session: detaches it from all topics and stops the write loop
+func (c *Cluster) proxyGone(key string) {
+	c.proxiedLock.Lock()
+	sess := c.proxied[key]
+	delete(c.proxied, key)
+	c.proxiedLock.Unlock()
+
+	if sess == nil {
+		return
+	}
+
+	sess.rw.Lock()
+	subs := sess.subs
+	sess.subs = make(map[string]*Subscription)
+	sess.rw.Unlock()
+
+	// Don't hold the lock while talking to topics: a topic may be waiting for the session
+	for _, sub := range subs {
+		// sub.done is the same as topic.unreg
+		sub.done <- &sessionLeave{sess: sess, unsub: false}
+	}
+
+	// The write loop may have already exited
+	select {
+	case sess.stop <- nil:
+	default:
+	}
+}
+
+// RPC handlers. Must be exported and have the signature required by net/rpc.
+
+// Master receives a client message forwarded by another node for a topic hosted at this node.
+func (c *Cluster) Master(req *ClusterReq, unused *bool) error {
+	key := req.Node + "-" + req.Sess.Sid
+
+	if req.Gone {
+		c.proxyGone(key)
+		return nil
+	}
+
+	n := c.nodes[req.Node]
+	if n == nil {
+		return errors.New("cluster: request from unknown node '" + req.Node + "'")
+	}
+
+	c.proxiedLock.Lock()
+	sess := c.proxied[key]
+	if sess == nil {
+		sess = globals.sessionStore.Create(n, req.Sess.AppId)
+		sess.sid = req.Sess.Sid
+		sess.uid = req.Sess.Uid
+		sess.tag = req.Sess.Tag
+		sess.remoteAddr = req.Sess.RemoteAddr
+		sess.proxyKey = key
+		c.proxied[key] = sess
+
+		go sess.rpcWriteLoop(c)
+	}
+	c.proxiedLock.Unlock()
+
+	sess.dispatch(req.Msg)
+
+	return nil
+}
+
+// Proxy receives a message from a topic at another node for a session connected to this node.
+// If the session does not take the message in time, the message is dropped and an error is
+// returned, so that the other node stops proxying for the stuck session.
+func (c *Cluster) Proxy(resp *ClusterResp, unused *bool) error {
+	c.sessLock.Lock()
+	sess := c.remote[resp.FromSid]
+	c.sessLock.Unlock()
+
+	if sess == nil {
+		return errors.New("cluster: unknown session '" + resp.FromSid + "'")
+	}
+
+	select {
+	case sess.send <- resp.Msg:
+	case <-time.After(time.Second):
+		log.Printf("Cluster.Proxy: session '%s' is stuck, message dropped", resp.FromSid)
+		return errors.New("cluster: session '" + resp.FromSid + "' is stuck")
+	}
+	return nil
+}
+
+// Route receives a message for a topic hosted at this node from the hub of another node.
+func (c *Cluster) Route(req *ClusterRoute, unused *bool) error {
+	var msg ServerComMessage
+	if err := json.Unmarshal(req.Msg, &msg); err != nil {
+		return err
+	}
+	msg.appid = req.AppId
+	msg.rcptto = req.RcptTo
+
+	globals.hub.route <- &msg
+	return nil
+}
+
+// Ping is a heartbeat from another node.
+func (c *Cluster) Ping(ping *ClusterPing, unused *bool) error {
+	return nil
+}
+
+// rpcWriteLoop sends messages queued for a proxy session back to the originating node
+func (sess *Session) rpcWriteLoop(c *Cluster) {
+	var unused bool
+	for {
+		select {
+		case msg, ok := <-sess.send:
+			if !ok {
+				return
+			}
+			if err := sess.clnode.call("Cluster.Proxy",
+				&ClusterResp{FromSid: sess.sid, Msg: msg}, &unused); err != nil {
+				log.Println("sess.rpcWriteLoop: " + err.Error())
+				// The originating node or the session is gone or stuck
+				go c.proxyGone(sess.proxyKey)
+			}
+		case topic := <-sess.detach:
+			// sess.subs is also modified by dispatch() and proxyGone()
+			sess.rw.Lock()
+			delete(sess.subs, topic)
+			sess.rw.Unlock()
+		case <-sess.stop:
+			return
+		}
+	}
+}
+
+// reconnect dials the node until the connection is established or the node is closed
+func (n *ClusterNode) reconnect() {
+	n.lock.Lock()
+	if n.reconnecting {
+		n.lock.Unlock()
+		return
+	}
+	n.reconnecting = true
+	n.lock.Unlock()
+
+	delay := time.Millisecond * 100
+	for {
+		client, err := rpc.Dial("tcp", n.address)
+		if err == nil {
+			n.lock.Lock()
+			n.endpoint = client
+			n.connected = true
+			n.reconnecting = false
+			n.lock.Unlock()
+			log.Printf("Cluster: connected to '%s'", n.name)
+			return
+		}
+
+		select {
+		case <-time.After(delay):
+			if delay *= 2; delay > clusterMaxReconnectDelay {
+				delay = clusterMaxReconnectDelay
+			}
+		case <-n.done:
+			n.lock.Lock()
+			n.reconnecting = false
+			n.lock.Unlock()
+			return
+		}
+	}
+}
+
+// call makes a synchronous RPC call to the node
+func (n *ClusterNode) call(proc string, req, resp interface{}) error {
+	n.lock.Lock()
+	endpoint, connected := n.endpoint, n.connected
+	n.lock.Unlock()
+
+	if !connected {
+		return errors.New("cluster: node '" + n.name + "' not connected")
+	}
+
+	err := endpoint.Call(proc, req, resp)
+	if err == rpc.ErrShutdown {
+		n.lock.Lock()
+		n.connected = false
+		n.lock.Unlock()
+		go n.reconnect()
+	}
+	return err
+}
+
+// ping sends a heartbeat to the node and waits for the response for at most the given time
+func (n *ClusterNode) ping(req *ClusterPing, timeout time.Duration) error {
+	n.lock.Lock()
+	endpoint, connected := n.endpoint, n.connected
+	n.lock.Unlock()
+
+	if !connected {
+		return errors.New("cluster: node '" + n.name + "' not connected")
+	}
+
+	var unused bool
+	call := endpoint.Go("Cluster.Ping", req, &unused, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error == rpc.ErrShutdown {
+			n.lock.Lock()
+			n.connected = false
+			n.lock.Unlock()
+			go n.reconnect()
+		}
+		return call.Error
+	case <-time.After(timeout):
+		return errors.New("cluster: node '" + n.name + "' ping timeout")
+	}
+}
+
+// callAsync makes an RPC call to the node without waiting for the result
+func (n *ClusterNode) callAsync(proc string, req interface{}) {
+	go func() {
+		var unused bool
+		if err := n.call(proc, req, &unused); err != nil {
+			log.Printf("Cluster: %s to '%s' failed: %s", proc, n.name, err.Error())
+		}
+	}()
+}
+
+// close disconnects from the node and stops reconnecting
+func (n *ClusterNode) close() {
+	n.done <- true
+
+	n.lock.Lock()
+	if n.connected {
+		n.endpoint.Close()
+		n.connected = false
+	}
+	n.lock.Unlock()
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"net/rpc"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/daodst/chat/server/store/types"
+)
+
+// testClusterRPC records requests received by a fake peer node
+type testClusterRPC struct {
+	reqs chan *ClusterReq
+}
+
+func (r *testClusterRPC) Master(req *ClusterReq, unused *bool) error {
+	r.reqs <- req
+	return nil
+}
+
+func (r *testClusterRPC) Ping(ping *ClusterPing, unused *bool) error {
+	return nil
+}
+
+// testCluster creates the cluster as seen by node "one" with peers "two" and "three"
+func testCluster(t *testing.T) *Cluster {
+	c, err := clusterInit(json.RawMessage(`{
+		"self": "one",
+		"nodes": [
+			{"name": "one", "addr": "127.0.0.1:0"},
+			{"name": "two", "addr": "127.0.0.1:0"},
+			{"name": "three", "addr": "127.0.0.1:0"}
+		]}`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// connectPeer replaces the node with a connection to a fake peer which records requests
+func connectPeer(t *testing.T, n *ClusterNode) *testClusterRPC {
+	peer := &testClusterRPC{reqs: make(chan *ClusterReq, 8)}
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Cluster", peer); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go srv.Accept(l)
+
+	client, err := rpc.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	n.endpoint = client
+	n.connected = true
+	return peer
+}
+
+// topicAt returns a topic name hosted at the given node
+func topicAt(t *testing.T, c *Cluster, node string) string {
+	for i := 0; i < 1000; i++ {
+		topic := "grp" + strconv.Itoa(i)
+		if c.ring.Get(topic) == node {
+			return topic
+		}
+	}
+	t.Fatalf("no topic is hosted at '%s'", node)
+	return ""
+}
+
+func expectReq(t *testing.T, peer *testClusterRPC) *ClusterReq {
+	select {
+	case req := <-peer.reqs:
+		return req
+	case <-time.After(time.Second):
+		t.Fatal("peer did not receive a request")
+	}
+	return nil
+}
+
+func TestClusterInit(t *testing.T) {
+	if c, err := clusterInit(nil, ""); c != nil || err != nil {
+		t.Errorf("empty config: got %v, %v, want a stand-alone server", c, err)
+	}
+
+	single := json.RawMessage(`{"self": "one", "nodes": [{"name": "one", "addr": "127.0.0.1:0"}]}`)
+	if c, err := clusterInit(single, ""); c != nil || err != nil {
+		t.Errorf("single node: got %v, %v, want a stand-alone server", c, err)
+	}
+
+	c := testCluster(t)
+	if c.thisNodeName != "one" || len(c.nodes) != 2 || len(c.live) != 3 || c.ring.Len() != 3*clusterRingReplicas {
+		t.Errorf("unexpected cluster: self '%s', %d nodes, %d live, ring size %d",
+			c.thisNodeName, len(c.nodes), len(c.live), c.ring.Len())
+	}
+	if c.heartbeat != clusterDefaultHeartbeat || c.failAfter != clusterDefaultFailAfter {
+		t.Errorf("unexpected defaults: heartbeat %s, fail after %d", c.heartbeat, c.failAfter)
+	}
+
+	if _, err := clusterInit(json.RawMessage(`{
+		"self": "four",
+		"nodes": [{"name": "one", "addr": "127.0.0.1:0"}, {"name": "two", "addr": "127.0.0.1:0"}]}`), ""); err == nil {
+		t.Error("expected an error when this node is not in the config")
+	}
+}
+
+func TestNodeForTopic(t *testing.T) {
+	c := testCluster(t)
+
+	// Another node must agree on the placement of topics
+	other, err := clusterInit(json.RawMessage(`{
+		"self": "two",
+		"nodes": [
+			{"name": "three", "addr": "127.0.0.1:0"},
+			{"name": "two", "addr": "127.0.0.1:0"},
+			{"name": "one", "addr": "127.0.0.1:0"}
+		]}`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		topic := "grp" + strconv.Itoa(i)
+		if c.ring.Get(topic) != other.ring.Get(topic) {
+			t.Fatalf("nodes disagree on the owner of '%s'", topic)
+		}
+	}
+
+	local := topicAt(t, c, "one")
+	remote := topicAt(t, c, "two")
+	if !c.isLocal(local) {
+		t.Errorf("'%s' should be local", local)
+	}
+	if n := c.nodeForTopic(remote); n == nil || n.name != "two" {
+		t.Errorf("'%s' should be hosted at 'two', got %v", remote, n)
+	}
+
+	// Topics of a failed node are moved to live nodes, other topics stay
+	delete(c.live, "two")
+	c.rebuildRing()
+	if n := c.nodeForTopic(remote); n != nil && n.name == "two" {
+		t.Errorf("'%s' is still hosted at the failed node", remote)
+	}
+	if !c.isLocal(local) {
+		t.Errorf("'%s' should stay local after an unrelated node failed", local)
+	}
+}
+
+func TestRouteToTopic(t *testing.T) {
+	c := testCluster(t)
+	peer := connectPeer(t, c.nodes["two"])
+	topic := topicAt(t, c, "two")
+
+	sess := &Session{sid: "sid1", uid: types.Uid(1), appid: 1, tag: "phone", send: make(chan []byte, 8)}
+
+	raw := []byte(`{"sub":{"topic":"` + topic + `"}}`)
+	msg := &ClientComMessage{Sub: &MsgClientSub{Topic: topic}}
+	if !c.routeToTopic(sess, msg, raw, "1", topic, topic) {
+		t.Fatal("message for a remote topic was not routed")
+	}
+
+	req := expectReq(t, peer)
+	if req.Node != "one" || req.Sess.Sid != "sid1" || req.Sess.Uid != types.Uid(1) || req.Sess.Tag != "phone" ||
+		string(req.Msg) != string(raw) || req.Gone {
+		t.Errorf("unexpected request %+v", req)
+	}
+	if rs, ok := sess.remoteSubs[topic]; !ok || rs.node != "two" {
+		t.Errorf("remote subscription not recorded: %v", sess.remoteSubs)
+	}
+	if c.remote["sid1"] != sess {
+		t.Error("session is not registered as remote")
+	}
+
+	msg = &ClientComMessage{Leave: &MsgClientLeave{Topic: topic}}
+	c.routeToTopic(sess, msg, []byte(`{"leave":{"topic":"`+topic+`"}}`), "2", topic, topic)
+	expectReq(t, peer)
+	if _, ok := sess.remoteSubs[topic]; ok {
+		t.Error("remote subscription not removed on leave")
+	}
+
+	// Local topics are not routed
+	local := topicAt(t, c, "one")
+	if c.routeToTopic(sess, &ClientComMessage{Sub: &MsgClientSub{Topic: local}}, nil, "3", local, local) {
+		t.Error("message for a local topic was routed")
+	}
+}
+
+func TestRouteToTopicUnreachable(t *testing.T) {
+	c := testCluster(t)
+	topic := topicAt(t, c, "three")
+
+	sess := &Session{sid: "sid1", send: make(chan []byte, 8)}
+	if !c.routeToTopic(sess, &ClientComMessage{Sub: &MsgClientSub{Topic: topic}}, nil, "1", topic, topic) {
+		t.Fatal("message for a remote topic was not routed")
+	}
+
+	var resp ServerComMessage
+	select {
+	case data := <-sess.send:
+		if err := json.Unmarshal(data, &resp); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatal("no error reported to the session")
+	}
+	if resp.Ctrl == nil || resp.Ctrl.Code < 500 {
+		t.Errorf("unexpected response %+v", resp.Ctrl)
+	}
+}
+
+func TestSessionGone(t *testing.T) {
+	c := testCluster(t)
+	peer := connectPeer(t, c.nodes["two"])
+	topic := topicAt(t, c, "two")
+
+	sess := &Session{sid: "sid1", send: make(chan []byte, 8)}
+	c.routeToTopic(sess, &ClientComMessage{Sub: &MsgClientSub{Topic: topic}}, []byte(`{}`), "1", topic, topic)
+	expectReq(t, peer)
+
+	c.sessionGone(sess)
+	if req := expectReq(t, peer); !req.Gone || req.Sess.Sid != "sid1" || req.Node != "one" {
+		t.Errorf("unexpected request %+v", req)
+	}
+	if c.remote["sid1"] != nil || sess.remoteSubs != nil {
+		t.Error("session is still registered as remote")
+	}
+}
+
+// Long polling sessions are not attached to a connection, the other nodes must be told
+// about them when they are deleted or expire
+func TestSessionStoreNotifiesCluster(t *testing.T) {
+	c := testCluster(t)
+	peer := connectPeer(t, c.nodes["two"])
+	topic := topicAt(t, c, "two")
+
+	globals.cluster = c
+	defer func() { globals.cluster = nil }()
+
+	ss := NewSessionStore(time.Hour)
+
+	sess := ss.Create(httptest.NewRecorder(), 1)
+	c.routeToTopic(sess, &ClientComMessage{Sub: &MsgClientSub{Topic: topic}}, []byte(`{}`), "1", topic, topic)
+	expectReq(t, peer)
+
+	if ss.Delete(sess.sid) != sess {
+		t.Fatal("session not found")
+	}
+	if req := expectReq(t, peer); !req.Gone || req.Sess.Sid != sess.sid {
+		t.Errorf("unexpected request %+v", req)
+	}
+
+	// Expired session
+	sess = ss.Create(httptest.NewRecorder(), 1)
+	c.routeToTopic(sess, &ClientComMessage{Sub: &MsgClientSub{Topic: topic}}, []byte(`{}`), "1", topic, topic)
+	expectReq(t, peer)
+
+	ss.rw.Lock()
+	sess.lastTouched = time.Now().Add(-2 * time.Hour)
+	ss.rw.Unlock()
+	ss.Create(httptest.NewRecorder(), 1)
+
+	if req := expectReq(t, peer); !req.Gone || req.Sess.Sid != sess.sid {
+		t.Errorf("unexpected request %+v", req)
+	}
+	if ss.Get(sess.sid) != nil {
+		t.Error("expired session is still in the store")
+	}
+}
+
+func TestProxyGone(t *testing.T) {
+	c := testCluster(t)
+
+	done := make(chan *sessionLeave, 1)
+	sess := &Session{
+		sid:  "sid1",
+		subs: map[string]*Subscription{"grpTest": {done: done}},
+		stop: make(chan []byte, 1)}
+	c.proxied["two-sid1"] = sess
+
+	if err := c.Master(&ClusterReq{Node: "two", Sess: ClusterSess{Sid: "sid1"}, Gone: true}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case leave := <-done:
+		if leave.sess != sess || leave.unsub {
+			t.Errorf("unexpected leave request %+v", leave)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("proxy session was not detached from the topic")
+	}
+	select {
+	case <-sess.stop:
+	default:
+		t.Error("proxy session was not stopped")
+	}
+	if c.proxied["two-sid1"] != nil {
+		t.Error("proxy session is still registered")
+	}
+
+	// Unknown sessions are ignored
+	if err := c.Master(&ClusterReq{Node: "two", Sess: ClusterSess{Sid: "sid2"}, Gone: true}, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestProxyStuckSession(t *testing.T) {
+	c := testCluster(t)
+	sess := &Session{sid: "sid1", send: make(chan []byte, 1)}
+	c.remote["sid1"] = sess
+
+	if err := c.Proxy(&ClusterResp{FromSid: "sid1", Msg: []byte("first")}, nil); err != nil {
+		t.Fatal(err)
+	}
+	// The queue is full, the message is dropped and the sending node is told about it
+	if err := c.Proxy(&ClusterResp{FromSid: "sid1", Msg: []byte("second")}, nil); err == nil {
+		t.Error("message to a stuck session was reported as delivered")
+	}
+	if msg := <-sess.send; string(msg) != "first" {
+		t.Errorf("got message %q, want %q", msg, "first")
+	}
+}
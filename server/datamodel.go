@@ -69,10 +69,20 @@ package main
 		asc bool	// optional - sort results in ascending order by time (desc is the default)
  *		since  *time.Time // optional, return messages newer than this
  *		before *time.Time // optional, return messages older than this
+ *		since_seq int // optional, return messages with sequence IDs greater than this, overrides since/before
+ *		before_seq int // optional, return messages with sequence IDs less than this, overrides since/before
  *		limit  uint       // optional, limit the number of results
  *	  }; // optional, payload for "msg" and "sub" requests, get data between [Since] and [Before],
 		// limit count to [Limit], defaulting to all data updated since last login on this device
  *
+ *  note: client-generated notification for other topic subscribers, not acknowledged
+ *    topic string; // name of the topic
+ *    what string; // required, one of
+ *		"kp" - key press, the user is typing
+ *		"recv" - messages up to seq were received by the client
+ *		"read" - messages up to seq were read by the user
+ *    seq int; // required for "recv" and "read", sequence ID of the message
+ *
  * 	set: request to change topic state
  *    topic string; // name of the topic to update
  * 	  action string; // required, type of data to change, one of
@@ -110,8 +120,15 @@ package main
 		// sub, unsub -- user subscriped or unsubscribed
 		// in, out -- user joined/left topic
 		// upd -- user or topic has upadated description
+		// term -- topic was terminated or moved to another cluster node, resubscribe to continue
  *    who string; // required, user or topic which changed the state
  *
+ *  info: {note} forwarded to other topic subscribers
+ *    topic string; // name of the topic
+ *    from string; // user who sent the note
+ *    what string; // kp, recv, read
+ *    seq int; // sequence ID of the message for recv and read
+ *
  *****************************************************************************/
 
 import (
@@ -134,6 +151,10 @@ type MsgBrowseOpts struct {
 	Since  *time.Time `json:"since,omitempty"`  // Load/count objects newer than this
 	Before *time.Time `json:"before,omitempty"` // Load/count objects older than this
 	Limit  uint       `json:"limit,omitempty"`  // Limit the number of objects loaded or counted
+	// Messages only: load messages with sequence IDs in (SinceId, BeforeId) range. Takes precedence
+	// over Since and Before
+	SinceId  int `json:"since_seq,omitempty"`
+	BeforeId int `json:"before_seq,omitempty"`
 }
 
 // Client to Server (C2S) messages
@@ -160,6 +181,15 @@ type MsgClientLogin struct {
 	Secret   string       `json:"secret"`             // Shared secret
 	ExpireIn JsonDuration `json:"expireIn,omitempty"` // Login expiration time
 	Tag      string       `json:"tag,omitempty"`      // Device Id
+	// Push notification registration of the device identified by Tag
+	Device *MsgDeviceDef `json:"dev,omitempty"`
+}
+
+// MsgDeviceDef registers the device for push notifications. An empty PushKey removes the registration.
+type MsgDeviceDef struct {
+	PushKey  string `json:"push"`               // Push key as issued by the push service
+	Platform string `json:"platform,omitempty"` // Device platform: "ios", "android", "web"
+	Lang     string `json:"lang,omitempty"`     // Language of the device
 }
 
 // Subscription request {sub} message
@@ -209,7 +239,9 @@ func parseMsgClientMeta(params string) int {
 type MsgSetInfo struct {
 	DefaultAcs *MsgDefaultAcsMode `json:"defacs,omitempty"` // Access mode
 	Public     interface{}        `json:"public,omitempty"`
-	Private    interface{}        `json:"private,omitempty"` // Per-subscription private data
+	// Per-subscription private data. Set private.mute to true or to an RFC 3339 timestamp
+	// to stop receiving push notifications from the topic (until the given time)
+	Private interface{} `json:"private,omitempty"`
 }
 
 // MsgSetSub: payload in set.sub request to update current subscription or invite another user, {sub.what} == "sub"
@@ -243,6 +275,15 @@ type MsgClientPub struct {
 	Content interface{} `json:"content"`
 }
 
+// MsgClientNote is a client-generated notification for topic subscribers {note}
+type MsgClientNote struct {
+	Topic string `json:"topic"`
+	// kp (key press), recv (received), read (read)
+	What string `json:"what"`
+	// Sequence ID of the message, recv and read only
+	SeqId int `json:"seq,omitempty"`
+}
+
 //func (msg *MsgClientPub) GetBoolParam(name string) bool {
 //	return modelGetBoolParam(msg.Params, name)
 //}
@@ -285,12 +326,35 @@ type ClientComMessage struct {
 	Get   *MsgClientGet   `json:"get"`
 	Set   *MsgClientSet   `json:"set"`
 	Del   *MsgClientDel   `json:"del"`
+	Note  *MsgClientNote  `json:"note"`
 
 	// from: userid as string
 	from      string
 	timestamp time.Time
 }
 
+// topicAndId returns the id and the name of the topic of a topic-bound message,
+// an empty topic otherwise
+func (msg *ClientComMessage) topicAndId() (string, string) {
+	switch {
+	case msg.Sub != nil:
+		return msg.Sub.Id, msg.Sub.Topic
+	case msg.Leave != nil:
+		return msg.Leave.Id, msg.Leave.Topic
+	case msg.Pub != nil:
+		return msg.Pub.Id, msg.Pub.Topic
+	case msg.Get != nil:
+		return msg.Get.Id, msg.Get.Topic
+	case msg.Set != nil:
+		return msg.Set.Id, msg.Set.Topic
+	case msg.Del != nil:
+		return msg.Del.Id, msg.Del.Topic
+	case msg.Note != nil:
+		return "", msg.Note.Topic
+	}
+	return "", ""
+}
+
 // *********************************************************
 // Server to client messages
 
@@ -307,6 +371,9 @@ type MsgTopicInfo struct {
 	DefaultAcs  *MsgDefaultAcsMode `json:"defacs,omitempty"`
 	Acs         *MsgAccessMode     `json:"acs,omitempty"`     // Actual access mode
 	LastMessage *time.Time         `json:"lastMsg,omitempty"` // time of the last {data} message in the topic
+	SeqId       int                `json:"seq,omitempty"`     // sequence ID of the last {data} message in the topic
+	ReadSeqId   int                `json:"read,omitempty"`    // sequence ID of the last message read by the user
+	RecvSeqId   int                `json:"recv,omitempty"`    // sequence ID of the last message received by the user
 	LastSeen    *MsgLastSeenInfo   `json:"seen,omitempty"`    // user's last access to topic
 	LastSeenTag *time.Time         `json:"seenTag,omitempty"` // user's last access to topic with the given tag (device)
 	Public      interface{}        `json:"public,omitempty"`
@@ -329,6 +396,12 @@ type MsgTopicSub struct {
 	LastMsg     *time.Time       `json:"lastMsg,omitempty"` // last message in a topic, "me' subs only
 	LastSeen    *MsgLastSeenInfo `json:"seen,omitempty"`    // user's last access to topic, 'me' subs only
 	LastSeenTag *time.Time       `json:"seenTag,omitempty"` // user's last access to topic with the given tag (device)
+	// 'me' topic only: sequence ID of the last message in the topic and the count of unread messages
+	SeqId  int `json:"seq,omitempty"`
+	Unread int `json:"unread,omitempty"`
+	// Sequence IDs of the last messages read and received by the user
+	ReadSeqId int `json:"read,omitempty"`
+	RecvSeqId int `json:"recv,omitempty"`
 	// cumulative access mode (mode.Want & mode.Given)
 	AcsMode string      `json:"mode"`
 	Public  interface{} `json:"public,omitempty"`
@@ -364,6 +437,7 @@ type MsgServerData struct {
 
 	From      string    `json:"from,omitempty"` // could be empty if sent by system
 	Timestamp time.Time `json:"ts"`
+	SeqId     int       `json:"seq,omitempty"` // sequence ID of the message in the topic
 
 	Content interface{} `json:"content"`
 }
@@ -375,6 +449,14 @@ type MsgServerPres struct {
 	What string `json:"what"`
 }
 
+// MsgServerInfo is a {note} forwarded to other topic subscribers {info}
+type MsgServerInfo struct {
+	Topic string `json:"topic"`
+	From  string `json:"from"`
+	What  string `json:"what"`
+	SeqId int    `json:"seq,omitempty"`
+}
+
 type MsgServerMeta struct {
 	Id    string `json:"id,omitempty"`
 	Topic string `json:"topic"`
@@ -390,6 +472,7 @@ type ServerComMessage struct {
 	Data *MsgServerData `json:"data,omitempty"`
 	Meta *MsgServerMeta `json:"meta,omitempty"`
 	Pres *MsgServerPres `json:"pres,omitempty"`
+	Info *MsgServerInfo `json:"info,omitempty"`
 
 	// to: topic
 	rcptto string
@@ -401,6 +484,8 @@ type ServerComMessage struct {
 	id string
 	// timestamp for consistency of timestamps in {ctrl} messages
 	timestamp time.Time
+	// originating session which should not receive the broadcast
+	skipSess *Session
 }
 
 // Combined message
@@ -614,3 +699,23 @@ func ErrNotImplemented(id, topic string, ts time.Time) *ServerComMessage {
 		Timestamp: ts}}
 	return msg
 }
+
+func ErrShutdown(id, topic string, ts time.Time) *ServerComMessage {
+	msg := &ServerComMessage{Ctrl: &MsgServerCtrl{
+		Id:        id,
+		Code:      http.StatusServiceUnavailable, // 503
+		Text:      "server shutting down, reconnect later",
+		Topic:     topic,
+		Timestamp: ts}}
+	return msg
+}
+
+func ErrClusterUnreachable(id, topic string, ts time.Time) *ServerComMessage {
+	msg := &ServerComMessage{Ctrl: &MsgServerCtrl{
+		Id:        id,
+		Code:      http.StatusServiceUnavailable, // 503
+		Text:      "cluster node unreachable",
+		Topic:     topic,
+		Timestamp: ts}}
+	return msg
+}
@@ -159,6 +159,12 @@ func (a *RethinkDbAdapter) CreateDb(reset bool) error {
 		}).RunWrite(a.conn); err != nil {
 		return err
 	}
+	if _, err := rdb.DB("tinode").Table("messages").IndexCreateFunc("Topic_SeqId",
+		func(row rdb.Term) interface{} {
+			return []interface{}{row.Field("Topic"), row.Field("SeqId")}
+		}).RunWrite(a.conn); err != nil {
+		return err
+	}
 
 	// Index for unique fields
 	if _, err := rdb.DB("tinode").TableCreate("_uniques").RunWrite(a.conn); err != nil {
@@ -421,6 +427,7 @@ func (a *RethinkDbAdapter) TopicsForUser(appid uint32, uid t.Uid, opts *t.Browse
 			sub = join[top.Name]
 			sub.ObjHeader.MergeTimes(&top.ObjHeader)
 			sub.LastMessageAt = top.LastMessageAt
+			sub.SeqId = top.SeqId
 			if strings.HasPrefix(sub.Topic, "grp") {
 				// all done with a grp topic
 				sub.SetPublic(top.Public)
@@ -525,10 +532,11 @@ func (a *RethinkDbAdapter) TopicDelete(appId uint32, userDbId, topic string) err
 	return errors.New("TopicDelete: not implemented")
 }
 
-func (a *RethinkDbAdapter) TopicUpdateLastMsgTime(appid uint32, topic string, ts time.Time) error {
+func (a *RethinkDbAdapter) TopicUpdateOnMessage(appid uint32, topic string, msg *t.Message) error {
 	update := struct {
 		LastMessageAt *time.Time
-	}{&ts}
+		SeqId         int `gorethink:",omitempty"`
+	}{&msg.CreatedAt, msg.SeqId}
 
 	// Invite - 'me' topic
 	var err error
@@ -671,7 +679,11 @@ func (a *RethinkDbAdapter) MessageGetAll(appId uint32, topic string, opts *t.Bro
 	//log.Println("Loading messages for topic ", topic)
 
 	q := rdb.DB(a.dbName).Table("messages")
-	q = addLimitAndFilter(q, topic, "Topic_CreatedAt", opts)
+	if opts != nil && (opts.SinceId > 0 || opts.BeforeId > 0) {
+		q = addSeqLimitAndFilter(q, topic, opts)
+	} else {
+		q = addLimitAndFilter(q, topic, "Topic_CreatedAt", opts)
+	}
 
 	rows, err := q.Run(a.conn)
 	if err != nil {
@@ -690,6 +702,54 @@ func (a *RethinkDbAdapter) MessageDelete(appId uint32, id t.Uid) error {
 	return errors.New("MessageDelete: not implemented")
 }
 
+// DeviceUpsert adds or replaces the device stored under the tag. Devices are kept in the user record.
+func (a *RethinkDbAdapter) DeviceUpsert(appid uint32, uid t.Uid, tag string, dev *t.DeviceDef) error {
+	update := map[string]interface{}{"Devices": map[string]*t.DeviceDef{tag: dev}}
+	_, err := rdb.DB(a.dbName).Table("users").Get(uid.String()).Update(update).RunWrite(a.conn)
+	return err
+}
+
+func (a *RethinkDbAdapter) DeviceGetAll(appid uint32, uids ...t.Uid) (map[t.Uid][]t.DeviceDef, error) {
+	ids := make([]interface{}, len(uids))
+	for i, id := range uids {
+		ids[i] = id.String()
+	}
+
+	rows, err := rdb.DB(a.dbName).Table("users").GetAll(ids...).Pluck("Id", "Devices").Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var row struct {
+		Id      string
+		Devices map[string]*t.DeviceDef
+	}
+	result := make(map[t.Uid][]t.DeviceDef)
+	for rows.Next(&row) {
+		if len(row.Devices) == 0 {
+			continue
+		}
+		uid := t.ParseUid(row.Id)
+		if uid.IsZero() {
+			continue
+		}
+		for _, dev := range row.Devices {
+			if dev != nil && dev.DeviceId != "" {
+				result[uid] = append(result[uid], *dev)
+			}
+		}
+		row.Devices = nil
+	}
+	return result, rows.Err()
+}
+
+func (a *RethinkDbAdapter) DeviceDelete(appid uint32, uid t.Uid, tag string) error {
+	_, err := rdb.DB(a.dbName).Table("users").Get(uid.String()).
+		Replace(rdb.Row.Without(map[string]interface{}{"Devices": map[string]interface{}{tag: true}})).
+		RunWrite(a.conn)
+	return err
+}
+
 func addLimitAndFilter(q rdb.Term, value string, index string, opts *t.BrowseOpt) rdb.Term {
 	var limit uint = 1024 // TODO(gene): pass into adapter as a config param
 	var lower, upper interface{}
@@ -732,6 +792,41 @@ func addLimitAndFilter(q rdb.Term, value string, index string, opts *t.BrowseOpt
 		OrderBy(rdb.OrderByOpts{Index: order}).Limit(limit)
 }
 
+// addSeqLimitAndFilter selects messages of a topic by a range of sequence IDs:
+// SinceId < SeqId < BeforeId, either bound could be missing
+func addSeqLimitAndFilter(q rdb.Term, topic string, opts *t.BrowseOpt) rdb.Term {
+	var limit uint = 1024 // TODO(gene): pass into adapter as a config param
+	var lower, upper interface{}
+	var order rdb.Term
+
+	// Between includes the lower bound and excludes the upper one
+	if opts.SinceId > 0 {
+		lower = opts.SinceId + 1
+	} else {
+		lower = rdb.MinVal
+	}
+
+	if opts.BeforeId > 0 {
+		upper = opts.BeforeId
+	} else {
+		upper = rdb.MaxVal
+	}
+
+	if opts.Limit > 0 && opts.Limit < limit {
+		limit = opts.Limit
+	}
+
+	if opts.AscOrder {
+		order = rdb.Asc("Topic_SeqId")
+	} else {
+		order = rdb.Desc("Topic_SeqId")
+	}
+
+	return q.Between([]interface{}{topic, lower}, []interface{}{topic, upper},
+		rdb.BetweenOpts{Index: "Topic_SeqId"}).
+		OrderBy(rdb.OrderByOpts{Index: order}).Limit(limit)
+}
+
 /*
 func remapP2PTopic(topic string, user t.Uid) (string, error) {
 	if strings.HasPrefix(topic, "p2p") {
@@ -73,6 +73,14 @@ type topicUnreg struct {
 	topic string
 }
 
+// Request to shut down a topic
+type shutDown struct {
+	// Channel to report completion of the shutdown, could be nil
+	done chan<- bool
+	// Topic is moved to another cluster node rather than the server shutting down
+	moved bool
+}
+
 // Request from !pres to another topic to start/stop receiving presence updates
 type presSubsReq struct {
 	id        types.Uid
@@ -110,6 +118,12 @@ type Hub struct {
 	// process get.info requests for topic not subscribed to
 	meta chan *metaReq
 
+	// cluster membership has changed, shut down topics hosted elsewhere
+	rehash chan bool
+
+	// request to shut down all topics, report completion to the given channel
+	shutdown chan chan<- bool
+
 	// Exported counter of live topics
 	topicsLive *expvar.Int
 }
@@ -139,6 +153,8 @@ func newHub() *Hub {
 		unreg:      make(chan topicUnreg),
 		presence:   make(chan *PresenceRequest),
 		meta:       make(chan *metaReq, 32),
+		rehash:     make(chan bool),
+		shutdown:   make(chan chan<- bool),
 		topicsLive: new(expvar.Int)}
 
 	expvar.Publish("LiveTopics", h.topicsLive)
@@ -185,6 +201,10 @@ func (h *Hub) run() {
 
 				simpleSender(dst.broadcast, msg)
 
+			} else if globals.cluster != nil && globals.cluster.routeToNode(msg) {
+				// Topic is hosted at another node, message forwarded
+				log.Printf("Hub. Topic '%s' is remote, message forwarded", msg.rcptto)
+
 			} else {
 				if msg.Data != nil {
 					// Normally the message is persisted at the topic. If the topic is offline,
@@ -192,15 +212,21 @@ func (h *Hub) run() {
 					// 'me' must receive them, so ignore access sesstings
 					// TODO(gene): save message for later delivery
 
-					if err := store.Messages.Save(msg.appid, &types.Message{
-						ObjHeader: types.ObjHeader{CreatedAt: msg.Data.Timestamp},
-						Topic:     msg.rcptto,
-						From:      types.ParseUserId(msg.Data.From).String(),
-						Content:   msg.Data.Content}); err != nil {
-
+					// Sequence IDs must continue from where the topic stopped
+					lastId, err := loadLastSeqId(msg.appid, msg.rcptto)
+					if err == nil {
+						err = store.Messages.Save(msg.appid, &types.Message{
+							ObjHeader: types.ObjHeader{CreatedAt: msg.Data.Timestamp},
+							SeqId:     lastId + 1,
+							Topic:     msg.rcptto,
+							From:      types.ParseUserId(msg.Data.From).String(),
+							Content:   msg.Data.Content})
+					}
+					if err != nil {
 						simpleByteSender(msg.akn, ErrUnknown(msg.id, msg.Data.Topic, timestamp))
 						return
 					}
+					msg.Data.SeqId = lastId + 1
 
 					// TODO(gene): validate topic name, discarding invalid topics
 					log.Printf("Hub. Topic '%d.%s' is unknown or offline", msg.appid, msg.rcptto)
@@ -237,11 +263,106 @@ func (h *Hub) run() {
 				}
 			}
 
+		case <-h.rehash:
+			// Shut down topics which are now hosted by other nodes
+			for key, t := range h.topics {
+				if !globals.cluster.isLocal(t.name) {
+					log.Printf("hub: topic '%s' moved to another node", t.name)
+					delete(h.topics, key)
+					h.topicsLive.Add(-1)
+					t.exit <- &shutDown{moved: true}
+				}
+			}
+
+		case hubdone := <-h.shutdown:
+			h.shutdownTopics()
+
+			log.Println("Hub shutdown completed")
+			hubdone <- true
+			return
+
 		case <-time.After(IDLETIMEOUT):
 		}
 	}
 }
 
+// shutdownTopics asks all topics to save their state and stop. Topics may be blocked sending to
+// the hub, so hub channels are serviced until every topic has stopped or timed out.
+func (h *Hub) shutdownTopics() {
+	stopped := make(chan bool, len(h.topics))
+	gone := make(map[*Topic]chan bool, len(h.topics))
+	for _, t := range h.topics {
+		gone[t] = make(chan bool)
+		go func(t *Topic, gone <-chan bool) {
+			done := make(chan bool, 1)
+			timeout := time.After(TOPIC_SHUTDOWN_TIMEOUT)
+			select {
+			case t.exit <- &shutDown{done: done}:
+				select {
+				case <-done:
+				case <-gone:
+				case <-timeout:
+					log.Printf("hub: topic '%s' failed to save its state in time", t.name)
+				}
+			case <-gone:
+			case <-timeout:
+				log.Printf("hub: topic '%s' did not accept the shutdown request", t.name)
+			}
+			stopped <- true
+		}(t, gone[t])
+	}
+
+	now := time.Now().UTC().Round(time.Millisecond)
+	for remaining := len(gone); remaining > 0; {
+		select {
+		case <-stopped:
+			remaining--
+
+		case unreg := <-h.unreg:
+			// Topic timed out before it received the shutdown request
+			if t := h.topicGet(unreg.appid, unreg.topic); t != nil {
+				h.topicDel(unreg.appid, unreg.topic)
+				if ch := gone[t]; ch != nil {
+					close(ch)
+				}
+			}
+
+		case msg := <-h.route:
+			// Topics are going away, nothing can be delivered
+			if msg.Data != nil {
+				simpleByteSender(msg.akn, ErrShutdown(msg.id, msg.rcptto, now))
+			}
+
+		case sreg := <-h.reg:
+			simpleByteSender(sreg.sess.send, ErrShutdown(sreg.pkt.Id, sreg.pkt.Topic, now))
+
+		case <-h.meta:
+			// Drop requests for topic info
+
+		case <-h.rehash:
+			// Topics are stopping anyway
+		}
+	}
+}
+
+// loadLastSeqId returns the sequence ID of the last message saved to an offline topic.
+// 'me' topics have no topic record, the ID is taken from the latest message.
+func loadLastSeqId(appid uint32, topic string) (int, error) {
+	if strings.HasPrefix(topic, "usr") {
+		msgs, err := store.Messages.GetAll(appid, topic, &types.BrowseOpt{Limit: 1})
+		if err != nil || len(msgs) == 0 {
+			return 0, err
+		}
+		return msgs[0].SeqId, nil
+	}
+
+	stopic, err := store.Topics.Get(appid, topic)
+	if err != nil || stopic == nil {
+		return 0, err
+	}
+	return stopic.SeqId, nil
+}
+
 // topicInit reads an existing topic from database or creates a new topic
 func topicInit(sreg *sessionJoin, h *Hub) {
 	var t *Topic
@@ -256,6 +377,7 @@ func topicInit(sreg *sessionJoin, h *Hub) {
 		reg:       make(chan *sessionJoin, 32),
 		unreg:     make(chan *sessionLeave, 32),
 		meta:      make(chan *metaReq, 32),
+		exit:      make(chan *shutDown, 1),
 		perUser:   make(map[types.Uid]perUserData),
 	}
 
@@ -291,6 +413,13 @@ func topicInit(sreg *sessionJoin, h *Hub) {
 		t.updated = user.UpdatedAt
 		//t.lastMessage = time.Time{}
 
+		// Invites could have been saved while the topic was offline
+		if t.lastId, err = loadLastSeqId(t.appid, t.name); err != nil {
+			log.Println("hub: cannot load last message for '" + t.name + "' (" + err.Error() + ")")
+			sreg.sess.QueueOut(ErrUnknown(sreg.pkt.Id, t.original, timestamp))
+			return
+		}
+
 		// Request to create a new p2p topic, then attach to it
 	} else if strings.HasPrefix(t.original, "usr") {
 		log.Println("hub: new p2p topic")
@@ -350,13 +479,17 @@ func topicInit(sreg *sessionJoin, h *Hub) {
 		userData.modeWant = user1.ModeWant
 		userData.modeGiven = user1.ModeGiven
 		userData.lastSeenTag = user1.LastSeen
+		userData.readId = user1.ReadSeqId
+		userData.recvId = user1.RecvSeqId
 		t.perUser[userId1] = userData
 
 		t.perUser[userId2] = perUserData{
 			public:      user1.GetPublic(),
 			modeWant:    user2.ModeWant,
 			modeGiven:   user2.ModeGiven,
-			lastSeenTag: user2.LastSeen}
+			lastSeenTag: user2.LastSeen,
+			readId:      user2.ReadSeqId,
+			recvId:      user2.RecvSeqId}
 
 		t.original = t.name
 		sreg.created = true
@@ -403,6 +536,7 @@ func topicInit(sreg *sessionJoin, h *Hub) {
 		if stopic.LastMessageAt != nil {
 			t.lastMessage = *stopic.LastMessageAt
 		}
+		t.lastId = stopic.SeqId
 
 		for i := 0; i < 2; i++ {
 			uid := types.ParseUid(subs[i].User)
@@ -411,6 +545,8 @@ func topicInit(sreg *sessionJoin, h *Hub) {
 				public:      subs[(i+1)%2].GetPublic(),
 				private:     subs[i].Private,
 				lastSeenTag: subs[i].LastSeen,
+				readId:      subs[i].ReadSeqId,
+				recvId:      subs[i].RecvSeqId,
 				modeWant:    subs[i].ModeWant,
 				modeGiven:   subs[i].ModeGiven}
 		}
@@ -514,6 +650,7 @@ func topicInit(sreg *sessionJoin, h *Hub) {
 		if stopic.LastMessageAt != nil {
 			t.lastMessage = *stopic.LastMessageAt
 		}
+		t.lastId = stopic.SeqId
 	}
 
 	log.Println("hub: topic created or loaded: " + t.name)
@@ -539,6 +676,8 @@ func (t *Topic) loadSubscriptions() error {
 		t.perUser[uid] = perUserData{
 			private:     sub.Private,
 			lastSeenTag: sub.LastSeen, // could be nil
+			readId:      sub.ReadSeqId,
+			recvId:      sub.RecvSeqId,
 			modeWant:    sub.ModeWant,
 			modeGiven:   sub.ModeGiven}
 
@@ -568,6 +707,7 @@ func replyTopicInfoBasic(sess *Session, topic string, get *MsgClientGet) {
 			info.CreatedAt = &stopic.CreatedAt
 			info.UpdatedAt = &stopic.UpdatedAt
 			info.LastMessage = stopic.LastMessageAt
+			info.SeqId = stopic.SeqId
 			info.Public = stopic.Public
 		} else {
 			simpleByteSender(sess.send, ErrUnknown(get.Id, get.Topic, now))
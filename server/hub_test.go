@@ -0,0 +1,70 @@
+package main
+
+import (
+	"expvar"
+	"testing"
+	"time"
+)
+
+func testHub() *Hub {
+	return &Hub{
+		topics:     make(map[string]*Topic),
+		route:      make(chan *ServerComMessage),
+		reg:        make(chan *sessionJoin),
+		unreg:      make(chan topicUnreg),
+		meta:       make(chan *metaReq),
+		rehash:     make(chan bool),
+		shutdown:   make(chan chan<- bool),
+		topicsLive: new(expvar.Int)}
+}
+
+// testTopic starts a topic which sends a message to the hub before it gets to the exit request
+func testTopic(h *Hub, name string, busy bool) *Topic {
+	t := &Topic{name: name, appid: 1, exit: make(chan *shutDown, 1)}
+	h.topicPut(t.appid, t.name, t)
+	go func() {
+		if busy {
+			h.route <- &ServerComMessage{Pres: &MsgServerPres{Topic: "me", What: "off"}, rcptto: "usrTest"}
+		}
+		sd := <-t.exit
+		sd.done <- true
+	}()
+	return t
+}
+
+func TestHubShutdown(t *testing.T) {
+	h := testHub()
+	testTopic(h, "grpIdle", false)
+	testTopic(h, "grpBusy", true)
+	go h.run()
+
+	hubdone := make(chan bool, 1)
+	h.shutdown <- hubdone
+	select {
+	case <-hubdone:
+	case <-time.After(TOPIC_SHUTDOWN_TIMEOUT / 2):
+		t.Fatal("hub shutdown is stuck")
+	}
+}
+
+func TestHubShutdownTopicTimedOut(t *testing.T) {
+	h := testHub()
+	stuck := &Topic{name: "grpStuck", appid: 1, exit: make(chan *shutDown, 1)}
+	h.topicPut(stuck.appid, stuck.name, stuck)
+	// The exit request is never read, the topic reports a timeout instead
+	stuck.exit <- &shutDown{moved: true}
+	go h.run()
+
+	hubdone := make(chan bool, 1)
+	h.shutdown <- hubdone
+	h.unreg <- topicUnreg{appid: stuck.appid, topic: stuck.name}
+
+	select {
+	case <-hubdone:
+	case <-time.After(TOPIC_SHUTDOWN_TIMEOUT / 2):
+		t.Fatal("hub shutdown is waiting for a topic which is gone")
+	}
+	if h.topicGet(stuck.appid, stuck.name) != nil {
+		t.Error("timed out topic was not removed")
+	}
+}
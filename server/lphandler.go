@@ -62,7 +62,11 @@ func (sess *Session) writeOnce() {
 	case <-closed:
 		log.Println("conn.writeOnce: connection closed by peer")
 		sess.wrt = nil
-	case <-sess.stop:
+	case msg := <-sess.stop:
+		// shutdown requested, send the final message if any
+		if msg != nil {
+			wrt.Write(msg)
+		}
 		sess.wrt = nil
 	case topic := <-sess.detach:
 		delete(sess.subs, topic)
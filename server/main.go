@@ -32,6 +32,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	_ "expvar"
 	"flag"
@@ -39,10 +40,14 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
 	"time"
 
 	_ "github.com/daodst/chat/server/db/rethinkdb"
+	"github.com/daodst/chat/server/push"
+	_ "github.com/daodst/chat/server/push/gateway"
 	"github.com/daodst/chat/server/store"
 	"github.com/daodst/chat/server/store/types"
 )
@@ -60,13 +65,22 @@ const (
 
 	DEFAULT_AUTH_ACCESS = types.ModePublic
 	DEFAULT_ANON_ACCESS = types.ModeNone
+
+	// Time to wait for topics to save their state on shutdown
+	SHUTDOWN_TIMEOUT_DEFAULT = time.Second * 10
+	// Time to wait for a single topic to accept the shutdown request and save its state
+	TOPIC_SHUTDOWN_TIMEOUT = time.Second * 5
+	// Clients are asked to reconnect after a random delay in this range after shutdown
+	SHUTDOWN_RECONNECT_MIN    = time.Second * 5
+	SHUTDOWN_RECONNECT_JITTER = time.Second * 25
 )
 
 // Build timestamp set by the compiler
 var buildstamp = ""
 
 var globals struct {
-	hub *Hub
+	hub     *Hub
+	cluster *Cluster
 
 	sessionStore *SessionStore
 }
@@ -75,12 +89,20 @@ type configType struct {
 	Listen        string          `json:"listen"`
 	Adapter       string          `json:"db_adapter"`
 	AdapterConfig json.RawMessage `json:"adapter_config"`
+	// Configs for push notification handlers
+	Push json.RawMessage `json:"push"`
+	// Cluster configuration, leave blank to run a stand-alone server
+	Cluster json.RawMessage `json:"cluster"`
+	// Time in seconds to wait for graceful shutdown to complete
+	ShutdownTimeout int `json:"shutdown_timeout,omitempty"`
 }
 
 func main() {
 	var configfile = flag.String("config", "./config", "Path to config file")
 	// Path to static content.
 	var staticPath = flag.String("static_data", "", "path to /static data for the server.")
+	// Name of this node in the cluster
+	var clusterSelf = flag.String("cluster_self", "", "Override the name of the current cluster node")
 	flag.Parse()
 
 	log.Printf("Using config from: '%s'", *configfile)
@@ -100,9 +122,25 @@ func main() {
 	}
 	defer store.Close()
 
+	if err = push.Init(string(config.Push)); err != nil {
+		log.Fatal("failed to initialize push notifications: ", err)
+	}
+	defer push.Stop()
+
+	if globals.cluster, err = clusterInit(config.Cluster, *clusterSelf); err != nil {
+		log.Fatal(err)
+	}
+
 	globals.sessionStore = NewSessionStore(2 * time.Hour)
 	globals.hub = newHub()
 
+	if globals.cluster != nil {
+		if err = globals.cluster.start(); err != nil {
+			log.Fatal("failed to start cluster: ", err)
+		}
+		defer globals.cluster.shutdown()
+	}
+
 	// Serve static content from the directory in -static_data flag if that's
 	// available, if not assume current dir.
 	if *staticPath != "" {
@@ -121,8 +159,52 @@ func main() {
 	// Handle long polling clients
 	http.HandleFunc("/v0/channels/lp", serveLongPoll)
 
-	log.Printf("Listening on [%s]", config.Listen)
-	log.Fatal(http.ListenAndServe(config.Listen, nil))
+	server := &http.Server{Addr: config.Listen}
+	go func() {
+		log.Printf("Listening on [%s]", config.Listen)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// Wait for a termination signal
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-stop
+	log.Printf("Signal received: '%s', shutting down", sig)
+
+	timeout := SHUTDOWN_TIMEOUT_DEFAULT
+	if config.ShutdownTimeout > 0 {
+		timeout = time.Duration(config.ShutdownTimeout) * time.Second
+	}
+	shutdown(server, timeout)
+	// Deferred calls stop the cluster, push notifications and close the DB
+}
+
+// shutdown stops accepting new connections, terminates sessions and waits for topics to save their state
+func shutdown(server *http.Server, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+
+	// Stop accepting new connections. Hijacked websocket connections are not affected.
+	go func() {
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Println("HTTP server shutdown: ", err)
+		}
+	}()
+
+	// Tell clients to reconnect later
+	globals.sessionStore.Shutdown()
+
+	// Persist topics
+	hubdone := make(chan bool, 1)
+	globals.hub.shutdown <- hubdone
+	select {
+	case <-hubdone:
+	case <-time.After(deadline.Sub(time.Now())):
+		log.Println("Hub shutdown timed out")
+	}
 }
 
 func getApiKey(req *http.Request) string {
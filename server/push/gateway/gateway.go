@@ -0,0 +1,224 @@
+// Package gateway implements a push handler which forwards notifications to an HTTP push gateway.
+// The wire format is the same as used by the Matrix push gateway client in internal/pushgateway,
+// so the same gateway deployment can serve both.
+package gateway
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/daodst/chat/server/push"
+	"github.com/daodst/chat/server/store"
+	"github.com/daodst/chat/server/store/types"
+)
+
+const (
+	defaultBuffer  = 1024
+	defaultTimeout = 30 // seconds
+
+	// Type of the notification as reported to the gateway
+	notificationType = "tinode.data"
+)
+
+type configType struct {
+	Enabled bool `json:"enabled"`
+	// URL of the gateway's notify endpoint, i.e. https://push.example.com/_matrix/push/v1/notify
+	Url string `json:"url"`
+	// app_id to report for every device
+	AppId string `json:"app_id"`
+	// Size of the queue of pending notifications
+	Buffer int `json:"buffer,omitempty"`
+	// Timeout of a single HTTP request to the gateway, in seconds
+	Timeout              int  `json:"timeout,omitempty"`
+	DisableTLSValidation bool `json:"disable_tls_validation,omitempty"`
+}
+
+// The following types mirror pushgateway.NotifyRequest and friends
+
+type notifyRequest struct {
+	Notification notification `json:"notification"`
+}
+
+type notifyResponse struct {
+	Rejected []string `json:"rejected"`
+}
+
+type notification struct {
+	Content json.RawMessage `json:"content,omitempty"`
+	Devices []*device       `json:"devices"`
+	Prio    string          `json:"prio,omitempty"`
+	RoomID  string          `json:"room_id,omitempty"`
+	Sender  string          `json:"sender,omitempty"`
+	Type    string          `json:"type,omitempty"`
+}
+
+type device struct {
+	AppID   string                 `json:"app_id"`
+	Data    map[string]interface{} `json:"data"`
+	PushKey string                 `json:"pushkey"`
+}
+
+// GatewayHandler sends notifications to an HTTP push gateway
+type GatewayHandler struct {
+	// 1 when the handler is running. Accessed atomically: it's cleared by the worker
+	// and read by the server goroutines
+	initialized int32
+	input       chan *push.Receipt
+	stop        chan bool
+
+	url   string
+	appId string
+	hc    *http.Client
+}
+
+// Init initializes the handler
+func (gh *GatewayHandler) Init(jsonconf string) error {
+	var config configType
+	if err := json.Unmarshal([]byte(jsonconf), &config); err != nil {
+		return errors.New("push gateway: failed to parse config: " + err.Error())
+	}
+
+	if !config.Enabled {
+		return nil
+	}
+
+	if config.Url == "" {
+		return errors.New("push gateway: missing url")
+	}
+
+	if config.Buffer <= 0 {
+		config.Buffer = defaultBuffer
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultTimeout
+	}
+
+	gh.url = config.Url
+	gh.appId = config.AppId
+	gh.hc = &http.Client{
+		Timeout: time.Duration(config.Timeout) * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: config.DisableTLSValidation,
+			},
+			Proxy: http.ProxyFromEnvironment,
+		},
+	}
+
+	gh.input = make(chan *push.Receipt, config.Buffer)
+	gh.stop = make(chan bool, 1)
+	atomic.StoreInt32(&gh.initialized, 1)
+
+	go gh.run()
+
+	log.Printf("push gateway: sending notifications to '%s'", gh.url)
+	return nil
+}
+
+// IsReady checks if the handler is initialized
+func (gh *GatewayHandler) IsReady() bool {
+	return atomic.LoadInt32(&gh.initialized) == 1
+}
+
+// Push returns a channel that the server will use to send messages to
+func (gh *GatewayHandler) Push() chan<- *push.Receipt {
+	return gh.input
+}
+
+// Stop terminates the handler's worker
+func (gh *GatewayHandler) Stop() {
+	gh.stop <- true
+}
+
+func (gh *GatewayHandler) run() {
+	for {
+		select {
+		case msg := <-gh.input:
+			if err := gh.send(msg); err != nil {
+				log.Println("push gateway: " + err.Error())
+			}
+		case <-gh.stop:
+			atomic.StoreInt32(&gh.initialized, 0)
+			return
+		}
+	}
+}
+
+// send converts a receipt into a single gateway notification with one entry per device
+// the recipients registered for push notifications.
+func (gh *GatewayHandler) send(msg *push.Receipt) error {
+	uids := make([]types.Uid, 0, len(msg.To))
+	for _, to := range msg.To {
+		if uid := types.ParseUserId(to.User); !uid.IsZero() {
+			uids = append(uids, uid)
+		}
+	}
+	devices, err := store.Devices.GetAll(msg.AppId, uids...)
+	if err != nil {
+		return err
+	}
+	if len(devices) == 0 {
+		// None of the recipients registered a device
+		return nil
+	}
+
+	content, err := json.Marshal(msg.Payload.Content)
+	if err != nil {
+		return err
+	}
+
+	req := notifyRequest{Notification: notification{
+		Content: content,
+		Devices: make([]*device, 0, len(devices)),
+		Prio:    "high",
+		RoomID:  msg.Payload.Topic,
+		Sender:  msg.Payload.From,
+		Type:    notificationType}}
+
+	appid := strconv.FormatUint(uint64(msg.AppId), 10)
+	for uid, devs := range devices {
+		for _, dev := range devs {
+			req.Notification.Devices = append(req.Notification.Devices, &device{
+				AppID:   gh.appId,
+				PushKey: dev.DeviceId,
+				Data: map[string]interface{}{"appid": appid, "ts": msg.Payload.Timestamp,
+					"user": uid.UserId(), "platform": dev.Platform}})
+		}
+	}
+
+	body, err := json.Marshal(&req)
+	if err != nil {
+		return err
+	}
+
+	hresp, err := gh.hc.Post(gh.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer hresp.Body.Close()
+
+	if hresp.StatusCode != http.StatusOK {
+		return errors.New("gateway responded with " + hresp.Status)
+	}
+
+	var resp notifyResponse
+	if err = json.NewDecoder(hresp.Body).Decode(&resp); err != nil {
+		return err
+	}
+	for _, key := range resp.Rejected {
+		log.Println("push gateway: rejected push key '" + key + "'")
+	}
+
+	return nil
+}
+
+func init() {
+	push.Register("gateway", &GatewayHandler{})
+}
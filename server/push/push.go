@@ -0,0 +1,135 @@
+// Package push contains the interfaces to be implemented by push notification handlers
+// and the registry of such handlers.
+package push
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+)
+
+// Recipient of a push notification
+type Recipient struct {
+	// UserId of the recipient as usrXXX
+	User string `json:"user"`
+}
+
+// Payload is the content of a push notification
+type Payload struct {
+	// Topic the message was published to, as seen by the recipient
+	Topic string `json:"topic"`
+	// UserId of the sender as usrXXX
+	From string `json:"from"`
+	// Time when the message was published
+	Timestamp time.Time `json:"ts"`
+	// Message content, passed unchanged
+	Content interface{} `json:"content"`
+}
+
+// Receipt is a notification to be delivered to users who are not currently online
+type Receipt struct {
+	// AppID of the topic
+	AppId   uint32      `json:"appid"`
+	To      []Recipient `json:"to"`
+	Payload Payload     `json:"payload"`
+}
+
+// Handler is the interface that must be implemented by a push notification handler.
+type Handler interface {
+	// Init initializes the handler
+	Init(jsonconf string) error
+
+	// IsReady checks if the handler is initialized
+	IsReady() bool
+
+	// Push returns a channel that the server will use to send messages to.
+	// The message will be dropped if the channel blocks.
+	Push() chan<- *Receipt
+
+	// Stop terminates the handler's worker and frees resources
+	Stop()
+}
+
+type configType struct {
+	Name   string          `json:"name"`
+	Config json.RawMessage `json:"config"`
+}
+
+var handlers map[string]Handler
+
+// Register makes a push handler available by the provided name.
+// If Register is called twice with the same name or if the handler is nil,
+// it panics.
+func Register(name string, hnd Handler) {
+	if handlers == nil {
+		handlers = make(map[string]Handler)
+	}
+
+	if hnd == nil {
+		panic("push: Register handler is nil")
+	}
+	if _, dup := handlers[name]; dup {
+		panic("push: Register called twice for handler " + name)
+	}
+	handlers[name] = hnd
+}
+
+// Init initializes registered handlers. Handlers which are not mentioned in the config are left
+// uninitialized and will not receive any notifications. The jsonconf is a JSON array of
+// {"name": ..., "config": ...} objects, one per handler.
+func Init(jsonconf string) error {
+	if jsonconf == "" {
+		return nil
+	}
+
+	var config []configType
+	if err := json.Unmarshal([]byte(jsonconf), &config); err != nil {
+		return errors.New("push: failed to parse config: " + err.Error() + "(" + jsonconf + ")")
+	}
+
+	for _, cc := range config {
+		if hnd := handlers[cc.Name]; hnd != nil {
+			if err := hnd.Init(string(cc.Config)); err != nil {
+				return err
+			}
+		} else {
+			log.Println("push: unknown handler '" + cc.Name + "'")
+		}
+	}
+
+	return nil
+}
+
+// Push a single message to all initialized handlers. The call never blocks: if a handler
+// is not keeping up, the message is dropped for that handler.
+func Push(msg *Receipt) {
+	if handlers == nil || msg == nil || len(msg.To) == 0 {
+		return
+	}
+
+	for name, hnd := range handlers {
+		if !hnd.IsReady() {
+			continue
+		}
+
+		select {
+		case hnd.Push() <- msg:
+		default:
+			log.Println("push: handler '" + name + "' queue is full, message dropped")
+		}
+	}
+}
+
+// Stop all initialized handlers
+func Stop() {
+	if handlers == nil {
+		return
+	}
+
+	for _, hnd := range handlers {
+		if hnd.IsReady() {
+			hnd.Stop()
+		}
+	}
+}
@@ -0,0 +1,83 @@
+// Package ringhash implements consistent hashing of keys (topic names) onto a set of nodes.
+//
+// Each node is placed on the ring several times (replicas) to even out the distribution of keys.
+// When a node is added or removed, only the keys which belong to that node are moved.
+package ringhash
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// Hash is a function which maps data to a position on the ring
+type Hash func(data []byte) uint32
+
+type elem struct {
+	key  string
+	hash uint32
+}
+
+type sortable []elem
+
+func (k sortable) Len() int      { return len(k) }
+func (k sortable) Swap(i, j int) { k[i], k[j] = k[j], k[i] }
+func (k sortable) Less(i, j int) bool {
+	// Weak hash function may cause collisions, use the key to break the tie.
+	if k[i].hash == k[j].hash {
+		return k[i].key < k[j].key
+	}
+	return k[i].hash < k[j].hash
+}
+
+// Ring is a consistent hash ring. It's not safe for concurrent modification.
+type Ring struct {
+	keys     []elem
+	replicas int
+	hashfunc Hash
+}
+
+// New creates an empty ring. If fn is nil, crc32.ChecksumIEEE is used.
+func New(replicas int, fn Hash) *Ring {
+	if replicas <= 0 {
+		replicas = 1
+	}
+	if fn == nil {
+		fn = crc32.ChecksumIEEE
+	}
+	return &Ring{replicas: replicas, hashfunc: fn}
+}
+
+// Len returns the number of positions on the ring, i.e. the number of nodes times replicas.
+func (r *Ring) Len() int {
+	return len(r.keys)
+}
+
+// Add places nodes on the ring.
+func (r *Ring) Add(keys ...string) {
+	for _, key := range keys {
+		for i := 0; i < r.replicas; i++ {
+			r.keys = append(r.keys, elem{key: key, hash: r.hashfunc([]byte(strconv.Itoa(i) + key))})
+		}
+	}
+	sort.Sort(sortable(r.keys))
+}
+
+// Get returns the node which owns the given key or an empty string if the ring is empty.
+func (r *Ring) Get(key string) string {
+	if len(r.keys) == 0 {
+		return ""
+	}
+
+	hash := r.hashfunc([]byte(key))
+
+	// Binary search for the first position at or after the hash
+	idx := sort.Search(len(r.keys), func(i int) bool { return r.keys[i].hash >= hash })
+
+	// Wrap around to the beginning of the ring
+	if idx == len(r.keys) {
+		idx = 0
+	}
+
+	return r.keys[idx].key
+}
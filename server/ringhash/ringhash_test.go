@@ -0,0 +1,119 @@
+package ringhash
+
+import (
+	"strconv"
+	"testing"
+)
+
+func topicNames(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = "grp" + strconv.Itoa(i*7919)
+	}
+	return keys
+}
+
+func TestEmpty(t *testing.T) {
+	r := New(10, nil)
+	if got := r.Get("grpTest"); got != "" {
+		t.Errorf("Get() on an empty ring = %q, want empty string", got)
+	}
+	if r.Len() != 0 {
+		t.Errorf("Len() = %d, want 0", r.Len())
+	}
+}
+
+func TestLen(t *testing.T) {
+	r := New(20, nil)
+	r.Add("one", "two", "three")
+	if r.Len() != 60 {
+		t.Errorf("Len() = %d, want 60", r.Len())
+	}
+}
+
+func TestSameOrderSameResult(t *testing.T) {
+	a := New(20, nil)
+	a.Add("one", "two", "three")
+	b := New(20, nil)
+	b.Add("three")
+	b.Add("one", "two")
+
+	for _, key := range topicNames(1000) {
+		if a.Get(key) != b.Get(key) {
+			t.Fatalf("key %q: rings disagree, %q vs %q", key, a.Get(key), b.Get(key))
+		}
+	}
+}
+
+func TestDistribution(t *testing.T) {
+	nodes := []string{"one", "two", "three", "four"}
+	r := New(20, nil)
+	r.Add(nodes...)
+
+	const count = 10000
+	hits := make(map[string]int)
+	for _, key := range topicNames(count) {
+		hits[r.Get(key)]++
+	}
+
+	if len(hits) != len(nodes) {
+		t.Fatalf("keys are mapped to %d nodes, want %d: %v", len(hits), len(nodes), hits)
+	}
+	// Each node is expected to get 1/4 of the keys. Allow it to be off by half.
+	for node, n := range hits {
+		if n < count/len(nodes)/2 || n > count/len(nodes)*3/2 {
+			t.Errorf("node %q got %d keys out of %d: %v", node, n, count, hits)
+		}
+	}
+}
+
+func TestStability(t *testing.T) {
+	keys := topicNames(10000)
+
+	before := New(20, nil)
+	before.Add("one", "two", "three")
+	owners := make(map[string]string, len(keys))
+	for _, key := range keys {
+		owners[key] = before.Get(key)
+	}
+
+	// Adding a node moves keys only to the new node
+	after := New(20, nil)
+	after.Add("one", "two", "three", "four")
+	var moved int
+	for _, key := range keys {
+		if node := after.Get(key); node != owners[key] {
+			if node != "four" {
+				t.Fatalf("key %q moved from %q to %q, not to the new node", key, owners[key], node)
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved > len(keys)/2 {
+		t.Errorf("%d keys out of %d moved to the new node", moved, len(keys))
+	}
+
+	// Removing a node moves only the keys which belonged to it
+	after = New(20, nil)
+	after.Add("one", "three")
+	for _, key := range keys {
+		node := after.Get(key)
+		if owners[key] != "two" && node != owners[key] {
+			t.Fatalf("key %q moved from %q to %q after an unrelated node was removed", key, owners[key], node)
+		}
+		if node == "two" {
+			t.Fatalf("key %q is mapped to the removed node", key)
+		}
+	}
+}
+
+func TestCustomHash(t *testing.T) {
+	// All positions collide: ties are broken by the node name, so every key goes to the same node
+	r := New(3, func(data []byte) uint32 { return 42 })
+	r.Add("b", "a")
+	for _, key := range topicNames(10) {
+		if got := r.Get(key); got != "a" {
+			t.Errorf("Get(%q) = %q, want %q", key, got, "a")
+		}
+	}
+}
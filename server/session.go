@@ -50,6 +50,7 @@ const (
 	NONE = iota
 	WEBSOCK
 	LPOLL
+	CLUSTER
 
 	TAG_UNDEF = "-"
 )
@@ -68,6 +69,14 @@ type Session struct {
 	// Set only for Long Poll sessions
 	wrt http.ResponseWriter
 
+	// Set only for cluster proxy sessions: node which hosts the original session
+	clnode *ClusterNode
+	// Key of the proxy session in Cluster.proxied
+	proxyKey string
+
+	// Subscriptions to topics hosted at other cluster nodes, indexed by expanded topic name
+	remoteSubs map[string]remoteSub
+
 	// IP address of the client. For long polling this is the IP of the last poll
 	remoteAddr string
 
@@ -86,8 +95,9 @@ type Session struct {
 	// outbound mesages, buffered
 	send chan []byte
 
-	// channel for shutting down the session
-	stop chan bool
+	// channel for shutting down the session, buffered = 1
+	// carries the last message to send before closing, could be nil
+	stop chan []byte
 
 	// detach - channel for detaching session from topic, buffered
 	detach chan string
@@ -146,6 +156,15 @@ func (s *Session) QueueOut(msg *ServerComMessage) {
 	}
 }
 
+// stopSession asks the session to send the final message and shut down. Does not block
+func (s *Session) stopSession(msg *ServerComMessage) {
+	data, _ := json.Marshal(msg)
+	select {
+	case s.stop <- data:
+	default:
+	}
+}
+
 // Message received, dispatch
 func (s *Session) dispatch(raw []byte) {
 	var msg ClientComMessage
@@ -163,6 +182,20 @@ func (s *Session) dispatch(raw []byte) {
 	msg.from = s.uid.UserId()
 	msg.timestamp = timestamp
 
+	// Forward topic-bound messages to the cluster node which hosts the topic
+	if globals.cluster != nil && s.proto != CLUSTER {
+		if id, topic := msg.topicAndId(); topic != "" && topic != "new" {
+			original, expanded, err := s.validateTopicName(id, topic, timestamp)
+			if err != nil {
+				s.QueueOut(err)
+				return
+			}
+			if globals.cluster.routeToTopic(s, &msg, raw, id, original, expanded) {
+				return
+			}
+		}
+	}
+
 	// Locking-unlocking is needed for long polling.
 	// Should not affect performance
 	s.rw.Lock()
@@ -201,6 +234,10 @@ func (s *Session) dispatch(raw []byte) {
 		s.acc(&msg)
 		log.Println("dispatch: Acc done")
 
+	case msg.Note != nil:
+		s.note(&msg)
+		log.Println("dispatch: Note." + msg.Note.What + " done")
+
 	default:
 		// Unknown message
 		s.QueueOut(ErrMalformed("", "", msg.timestamp))
@@ -218,6 +255,12 @@ func (s *Session) subscribe(msg *ClientComMessage) {
 		// Request to create a new named topic
 		topic = msg.Sub.Topic
 		expanded = genTopicName()
+		if globals.cluster != nil {
+			// New topics are hosted by the node where they are created
+			for !globals.cluster.isLocal(expanded) {
+				expanded = genTopicName()
+			}
+		}
 	} else {
 		var err *ServerComMessage
 		topic, expanded, err = s.validateTopicName(msg.Sub.Id, msg.Sub.Topic, msg.timestamp)
@@ -345,6 +388,11 @@ func (s *Session) login(msg *ClientComMessage) {
 		s.tag = TAG_UNDEF
 	}
 
+	// Push notifications are sent per device, the device must be identified by a tag
+	if msg.Login.Device != nil && s.tag != TAG_UNDEF {
+		s.updateDevice(msg.Login.Device)
+	}
+
 	expireIn := time.Duration(msg.Login.ExpireIn)
 	if expireIn <= 0 || expireIn > TOKEN_LIFETIME_MAX {
 		expireIn = TOKEN_LIFETIME_DEFAULT
@@ -368,6 +416,22 @@ func (s *Session) login(msg *ClientComMessage) {
 
 }
 
+// updateDevice registers the session's device for push notifications or removes the registration
+func (s *Session) updateDevice(dev *MsgDeviceDef) {
+	var err error
+	if dev.PushKey == "" {
+		err = store.Devices.Delete(s.appid, s.uid, s.tag)
+	} else {
+		err = store.Devices.Update(s.appid, s.uid, s.tag, &types.DeviceDef{
+			DeviceId: dev.PushKey,
+			Platform: dev.Platform,
+			Lang:     dev.Lang})
+	}
+	if err != nil {
+		log.Println("session: failed to update device:", err)
+	}
+}
+
 // Account creation
 func (s *Session) acc(msg *ClientComMessage) {
 	if msg.Acc.Auth == nil {
@@ -557,6 +621,41 @@ func (s *Session) del(msg *ClientComMessage) {
 	}
 }
 
+// Notify other topic subscribers that the user is typing, received or read messages.
+// Notes are not acknowledged, invalid notes are silently dropped.
+func (s *Session) note(msg *ClientComMessage) {
+	if s.uid.IsZero() || msg.Note.Topic == "" {
+		return
+	}
+
+	original, expanded, err := s.validateTopicName("", msg.Note.Topic, msg.timestamp)
+	if err != nil {
+		return
+	}
+
+	switch msg.Note.What {
+	case "kp":
+		if msg.Note.SeqId != 0 {
+			return
+		}
+	case "recv", "read":
+		if msg.Note.SeqId <= 0 {
+			return
+		}
+	default:
+		return
+	}
+
+	if sub, ok := s.subs[expanded]; ok {
+		sub.broadcast <- &ServerComMessage{Info: &MsgServerInfo{
+			Topic: original,
+			From:  s.uid.UserId(),
+			What:  msg.Note.What,
+			SeqId: msg.Note.SeqId},
+			appid: s.appid, rcptto: expanded, timestamp: msg.timestamp, skipSess: s}
+	}
+}
+
 // validateTopicName expands session specific topic name to global name
 // Returns
 //   topic: session-specific topic name the message recepient should see
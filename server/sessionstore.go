@@ -4,6 +4,8 @@ package main
 
 import (
 	"container/list"
+	"log"
+	"math/rand"
 	"net/http"
 	"sync"
 	"time"
@@ -22,6 +24,9 @@ type SessionStore struct {
 	sessions map[string]*list.Element
 	lru      *list.List
 	lifeTime time.Duration
+
+	// Websocket sessions are not expired, kept here for shutdown only
+	ws map[string]*Session
 }
 
 func (ss *SessionStore) Create(conn interface{}, appid uint32) *Session {
@@ -34,14 +39,17 @@ func (ss *SessionStore) Create(conn interface{}, appid uint32) *Session {
 	case http.ResponseWriter:
 		s.proto = LPOLL
 		s.wrt, _ = conn.(http.ResponseWriter)
+	case *ClusterNode:
+		s.proto = CLUSTER
+		s.clnode, _ = conn.(*ClusterNode)
 	default:
 		s.proto = NONE
 	}
 
 	if s.proto != NONE {
 		s.subs = make(map[string]*Subscription)
-		s.send = make(chan []byte, 64) // buffered
-		s.stop = make(chan bool)
+		s.send = make(chan []byte, 64)   // buffered
+		s.stop = make(chan []byte, 1)    // buffered
 		s.detach = make(chan string, 64) // buffered
 	}
 
@@ -50,24 +58,34 @@ func (ss *SessionStore) Create(conn interface{}, appid uint32) *Session {
 	s.sid = getRandomString()
 	s.uid = types.ZeroUid
 
-	if s.proto != WEBSOCK {
-		// Websocket connections are not managed by SessionStore
+	if s.proto != WEBSOCK && s.proto != CLUSTER {
+		// Websocket connections and cluster proxy sessions are not managed by SessionStore
 		ss.rw.Lock()
 
 		elem := ss.lru.PushFront(&sessionStoreElement{s.sid, &s})
 		ss.sessions[s.sid] = elem
 
 		// Remove expired sessions
+		var expired []*Session
 		expire := s.lastTouched.Add(-ss.lifeTime)
 		for elem = ss.lru.Back(); elem != nil; elem = ss.lru.Back() {
 			if elem.Value.(*sessionStoreElement).val.lastTouched.Before(expire) {
 				ss.lru.Remove(elem)
 				delete(ss.sessions, elem.Value.(*sessionStoreElement).key)
+				expired = append(expired, elem.Value.(*sessionStoreElement).val)
 			} else {
 				break // don't need to traverse further
 			}
 		}
 		ss.rw.Unlock()
+
+		for _, sess := range expired {
+			sessionGone(sess)
+		}
+	} else if s.proto == WEBSOCK {
+		ss.rw.Lock()
+		ss.ws[s.sid] = &s
+		ss.rw.Unlock()
 	}
 
 	return &s
@@ -88,16 +106,54 @@ func (ss *SessionStore) Get(sid string) *Session {
 
 func (ss *SessionStore) Delete(sid string) *Session {
 	ss.rw.Lock()
-	defer ss.rw.Unlock()
-
-	if elem := ss.sessions[sid]; elem != nil {
+	var s *Session
+	if s = ss.ws[sid]; s != nil {
+		delete(ss.ws, sid)
+	} else if elem := ss.sessions[sid]; elem != nil {
 		ss.lru.Remove(elem)
 		delete(ss.sessions, sid)
 
-		return elem.Value.(*sessionStoreElement).val
+		s = elem.Value.(*sessionStoreElement).val
 	}
+	ss.rw.Unlock()
 
-	return nil
+	if s != nil {
+		sessionGone(s)
+	}
+	return s
+}
+
+// sessionGone tells other cluster nodes to release resources held for the session.
+// Must be called without holding ss.rw.
+func sessionGone(s *Session) {
+	if globals.cluster != nil {
+		globals.cluster.sessionGone(s)
+	}
+}
+
+// Shutdown terminates all sessions. Clients are told to reconnect after a random delay
+// so they don't all come back at the same time.
+func (ss *SessionStore) Shutdown() {
+	ss.rw.Lock()
+	defer ss.rw.Unlock()
+
+	now := time.Now().UTC().Round(time.Millisecond)
+	stop := func(s *Session) {
+		msg := ErrShutdown("", "", now)
+		delay := SHUTDOWN_RECONNECT_MIN + time.Duration(rand.Int63n(int64(SHUTDOWN_RECONNECT_JITTER)))
+		// Reconnect delay in milliseconds
+		msg.Ctrl.Params = map[string]interface{}{"reconnect": int64(delay / time.Millisecond)}
+		s.stopSession(msg)
+	}
+
+	for _, elem := range ss.sessions {
+		stop(elem.Value.(*sessionStoreElement).val)
+	}
+	for _, s := range ss.ws {
+		stop(s)
+	}
+
+	log.Printf("SessionStore shut down, %d sessions terminated", len(ss.sessions)+len(ss.ws))
 }
 
 func NewSessionStore(lifetime time.Duration) *SessionStore {
@@ -105,6 +161,7 @@ func NewSessionStore(lifetime time.Duration) *SessionStore {
 		sessions: make(map[string]*list.Element),
 		lru:      list.New(),
 		lifeTime: lifetime,
+		ws:       make(map[string]*Session),
 	}
 
 	return store
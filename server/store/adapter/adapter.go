@@ -40,7 +40,8 @@ type Adapter interface {
 	TopicShare(appid uint32, acl []t.Subscription) (int, error)
 	UpdateLastSeen(appid uint32, topic string, uid t.Uid, tag string, when time.Time) error
 	TopicDelete(appid uint32, userDbId, topic string) error
-	TopicUpdateLastMsgTime(appid uint32, topic string, ts time.Time) error
+	// TopicUpdateOnMessage updates topic's LastMessageAt and SeqId when a new message is saved
+	TopicUpdateOnMessage(appid uint32, topic string, msg *t.Message) error
 	TopicUpdate(appid uint32, topic string, update map[string]interface{}) error
 
 	// SubscriptionGet reads a subscription of a user to a topic
@@ -58,4 +59,12 @@ type Adapter interface {
 	MessageSave(appId uint32, msg *t.Message) error
 	MessageGetAll(appId uint32, topic string, opts *t.BrowseOpt) ([]t.Message, error)
 	MessageDelete(appId uint32, id t.Uid) error
+
+	// Devices (for push notifications)
+	// DeviceUpsert creates or updates a device registered by the user under the given tag
+	DeviceUpsert(appid uint32, uid t.Uid, tag string, dev *t.DeviceDef) error
+	// DeviceGetAll returns devices of the given users
+	DeviceGetAll(appid uint32, uids ...t.Uid) (map[t.Uid][]t.DeviceDef, error)
+	// DeviceDelete removes the device registered under the given tag
+	DeviceDelete(appid uint32, uid t.Uid, tag string) error
 }
@@ -342,6 +342,12 @@ func (SubsObjMapper) Update(appid uint32, topic string, user types.Uid, update m
 	return adaptr.SubsUpdate(appid, topic, user, update)
 }
 
+// UpdateRecvRead saves sequence IDs of the last messages received and read by the user.
+// Unlike Update it does not change UpdatedAt.
+func (SubsObjMapper) UpdateRecvRead(appid uint32, topic string, user types.Uid, recv, read int) error {
+	return adaptr.SubsUpdate(appid, topic, user, map[string]interface{}{"RecvSeqId": recv, "ReadSeqId": read})
+}
+
 // Delete deletes a subscription
 func (SubsObjMapper) Delete(appid uint32, topic string, user types.Uid) error {
 	return adaptr.SubsDelete(appid, topic, user)
@@ -357,7 +363,7 @@ func (MessagesObjMapper) Save(appid uint32, msg *types.Message) error {
 	msg.InitTimes()
 
 	// Need a transaction here, RethinkDB does not support transactions
-	if err := adaptr.TopicUpdateLastMsgTime(appid, msg.Topic, msg.CreatedAt); err != nil {
+	if err := adaptr.TopicUpdateOnMessage(appid, msg.Topic, msg); err != nil {
 		return err
 	}
 
@@ -377,6 +383,28 @@ func (MessagesObjMapper) Delete(appId uint32, uid types.Uid) error {
 	return errors.New("store: not implemented")
 }
 
+// Devices struct to hold methods for persistence mapping for the DeviceDef object.
+type DeviceObjMapper struct{}
+
+var Devices DeviceObjMapper
+
+// Update registers or updates the device the user logged in from. The tag identifies the device
+// across logins.
+func (DeviceObjMapper) Update(appid uint32, uid types.Uid, tag string, dev *types.DeviceDef) error {
+	dev.LastSeen = types.TimeNow()
+	return adaptr.DeviceUpsert(appid, uid, tag, dev)
+}
+
+// GetAll returns devices registered by the given users
+func (DeviceObjMapper) GetAll(appid uint32, uid ...types.Uid) (map[types.Uid][]types.DeviceDef, error) {
+	return adaptr.DeviceGetAll(appid, uid...)
+}
+
+// Delete removes the device registered under the tag
+func (DeviceObjMapper) Delete(appid uint32, uid types.Uid, tag string) error {
+	return adaptr.DeviceDelete(appid, uid, tag)
+}
+
 func ZeroUid() types.Uid {
 	return types.ZeroUid
 }
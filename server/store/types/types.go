@@ -0,0 +1,594 @@
+package types
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Uid is a database-specific record id, suitable to be used as a primary key.
+type Uid uint64
+
+// ZeroUid is a constant representing uninitialized Uid.
+const ZeroUid Uid = 0
+
+// Lengths of various Uid representations
+const (
+	uid_BASE64_UNPADDED = 11
+	uid_BASE64_PADDED   = 12
+
+	p2p_BASE64_UNPADDED = 22
+	p2p_BASE64_PADDED   = 24
+)
+
+// IsZero checks if Uid is uninitialized.
+func (uid Uid) IsZero() bool {
+	return uid == ZeroUid
+}
+
+// Compare returns 0 if uid is equal to u2, 1 if u2 is greater than uid, -1 if u2 is smaller.
+func (uid Uid) Compare(u2 Uid) int {
+	if uid < u2 {
+		return -1
+	} else if uid > u2 {
+		return 1
+	}
+	return 0
+}
+
+// MarshalBinary converts Uid to byte slice.
+func (uid *Uid) MarshalBinary() ([]byte, error) {
+	dst := make([]byte, 8)
+	binary.LittleEndian.PutUint64(dst, uint64(*uid))
+	return dst, nil
+}
+
+// UnmarshalBinary reads Uid from byte slice.
+func (uid *Uid) UnmarshalBinary(b []byte) error {
+	if len(b) < 8 {
+		return errors.New("Uid.UnmarshalBinary: invalid length")
+	}
+	*uid = Uid(binary.LittleEndian.Uint64(b))
+	return nil
+}
+
+// UnmarshalText reads Uid from string represented as byte slice.
+func (uid *Uid) UnmarshalText(src []byte) error {
+	if src == nil {
+		return errors.New("Uid.UnmarshalText: nil reference")
+	}
+	if len(src) != uid_BASE64_UNPADDED {
+		return errors.New("Uid.UnmarshalText: invalid length")
+	}
+	dec := make([]byte, base64.URLEncoding.DecodedLen(uid_BASE64_PADDED))
+	padded := make([]byte, 0, uid_BASE64_PADDED)
+	padded = append(padded, src...)
+	for len(padded) < uid_BASE64_PADDED {
+		padded = append(padded, '=')
+	}
+	count, err := base64.URLEncoding.Decode(dec, padded)
+	if count < 8 {
+		if err != nil {
+			return errors.New("Uid.UnmarshalText: failed to decode " + err.Error())
+		}
+		return errors.New("Uid.UnmarshalText: failed to decode")
+	}
+	*uid = Uid(binary.LittleEndian.Uint64(dec))
+	return nil
+}
+
+// MarshalText converts Uid to string represented as byte slice.
+func (uid *Uid) MarshalText() ([]byte, error) {
+	if *uid == ZeroUid {
+		return []byte{}, nil
+	}
+	src := make([]byte, 8)
+	dst := make([]byte, base64.URLEncoding.EncodedLen(8))
+	binary.LittleEndian.PutUint64(src, uint64(*uid))
+	base64.URLEncoding.Encode(dst, src)
+	return dst[0:uid_BASE64_UNPADDED], nil
+}
+
+// MarshalJSON converts Uid to double quoted ("ajjj") string.
+func (uid *Uid) MarshalJSON() ([]byte, error) {
+	dst, _ := uid.MarshalText()
+	return append(append([]byte{'"'}, dst...), '"'), nil
+}
+
+// UnmarshalJSON reads Uid from a double quoted string.
+func (uid *Uid) UnmarshalJSON(b []byte) error {
+	size := len(b)
+	if size != (uid_BASE64_UNPADDED + 2) {
+		return errors.New("Uid.UnmarshalJSON: invalid length")
+	} else if b[0] != '"' || b[size-1] != '"' {
+		return errors.New("Uid.UnmarshalJSON: unrecognized")
+	}
+	return uid.UnmarshalText(b[1 : size-1])
+}
+
+// String converts Uid to base64 string.
+func (uid Uid) String() string {
+	buf, _ := uid.MarshalText()
+	return string(buf)
+}
+
+// ParseUid parses string NOT prefixed with anything.
+func ParseUid(s string) Uid {
+	var uid Uid
+	uid.UnmarshalText([]byte(s))
+	return uid
+}
+
+// UserId converts Uid to string prefixed with 'usr', like usrXXXXX.
+func (uid Uid) UserId() string {
+	return uid.PrefixId("usr")
+}
+
+// PrefixId converts Uid to string prefixed with the given prefix.
+func (uid Uid) PrefixId(prefix string) string {
+	if uid.IsZero() {
+		return ""
+	}
+	return prefix + uid.String()
+}
+
+// ParseUserId parses user ID of the form "usrXXXXXX".
+func ParseUserId(s string) Uid {
+	var uid Uid
+	if strings.HasPrefix(s, "usr") {
+		(&uid).UnmarshalText([]byte(s)[3:])
+	}
+	return uid
+}
+
+// P2PName takes two Uids and generates a P2P topic name.
+func (uid Uid) P2PName(u2 Uid) string {
+	if !uid.IsZero() && !u2.IsZero() {
+		b1, _ := uid.MarshalBinary()
+		b2, _ := u2.MarshalBinary()
+
+		if uid < u2 {
+			b1 = append(b1, b2...)
+		} else if uid > u2 {
+			b1 = append(b2, b1...)
+		} else {
+			// Explicitly disable P2P with self
+			return ""
+		}
+
+		return "p2p" + base64.URLEncoding.EncodeToString(b1)[:p2p_BASE64_UNPADDED]
+	}
+
+	return ""
+}
+
+// ParseP2P extracts uids from the name of a p2p topic.
+func ParseP2P(p2p string) (uid1, uid2 Uid, err error) {
+	if strings.HasPrefix(p2p, "p2p") {
+		src := []byte(p2p)[3:]
+		if len(src) != p2p_BASE64_UNPADDED {
+			err = errors.New("ParseP2P: invalid length")
+			return
+		}
+		dec := make([]byte, base64.URLEncoding.DecodedLen(p2p_BASE64_PADDED))
+		padded := make([]byte, 0, p2p_BASE64_PADDED)
+		padded = append(padded, src...)
+		for len(padded) < p2p_BASE64_PADDED {
+			padded = append(padded, '=')
+		}
+		var count int
+		count, err = base64.URLEncoding.Decode(dec, padded)
+		if count < 16 {
+			if err == nil {
+				err = errors.New("ParseP2P: failed to decode")
+			}
+			return
+		}
+		uid1 = Uid(binary.LittleEndian.Uint64(dec))
+		uid2 = Uid(binary.LittleEndian.Uint64(dec[8:]))
+	} else {
+		err = errors.New("ParseP2P: missing or invalid prefix")
+	}
+	return
+}
+
+// ObjHeader is the header shared by all stored objects.
+type ObjHeader struct {
+	Id        string // using string to get around rethinkdb's problems with unit64
+	id        Uid
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt *time.Time `json:"DeletedAt,omitempty"`
+}
+
+// Uid assigns Uid header field.
+func (h *ObjHeader) Uid() Uid {
+	if h.id.IsZero() && h.Id != "" {
+		h.id.UnmarshalText([]byte(h.Id))
+	}
+	return h.id
+}
+
+// SetUid assigns given Uid to appropriate header fields.
+func (h *ObjHeader) SetUid(uid Uid) {
+	h.id = uid
+	h.Id = uid.String()
+}
+
+// TimeNow returns current wall time in UTC rounded to milliseconds.
+func TimeNow() time.Time {
+	return time.Now().UTC().Round(time.Millisecond)
+}
+
+// InitTimes initializes time.Time variables in the header to current time.
+func (h *ObjHeader) InitTimes() {
+	if h.CreatedAt.IsZero() {
+		h.CreatedAt = TimeNow()
+	}
+	h.UpdatedAt = h.CreatedAt
+	h.DeletedAt = nil
+}
+
+// MergeTimes intelligently copies time.Time variables from h2 to h.
+func (h *ObjHeader) MergeTimes(h2 *ObjHeader) {
+	// Set the new object creation time to the earliest value
+	if h.CreatedAt.IsZero() || (!h2.CreatedAt.IsZero() && h2.CreatedAt.Before(h.CreatedAt)) {
+		h.CreatedAt = h2.CreatedAt
+	}
+	// Set the new object update time to the latest value
+	if h.UpdatedAt.Before(h2.UpdatedAt) {
+		h.UpdatedAt = h2.UpdatedAt
+	}
+	// Set deleted time to the latest value
+	if h2.DeletedAt != nil && (h.DeletedAt == nil || h.DeletedAt.Before(*h2.DeletedAt)) {
+		h.DeletedAt = h2.DeletedAt
+	}
+}
+
+// IsDeleted returns true if the object is deleted.
+func (h *ObjHeader) IsDeleted() bool {
+	return h.DeletedAt != nil
+}
+
+// User is a representation of a DB-stored user record.
+type User struct {
+	ObjHeader
+	// Currently unused: Unconfirmed, Active, etc.
+	State int
+
+	// Unique username
+	Username string
+	// Password hash
+	Passhash []byte
+
+	// Last time when the user joined 'me' topic
+	LastSeen time.Time
+	// User's status as reported by the user
+	Status interface{}
+
+	// Default access to user for P2P topics (used as default modeGiven)
+	Access DefaultAccess
+
+	// Public is the user's public data, shown in 'me' and p2p topics
+	Public interface{}
+
+	// Devices registered for push notifications, keyed by the device tag used at login
+	Devices map[string]*DeviceDef
+}
+
+// DeviceDef is the data provided by a device for sending push notifications to it.
+type DeviceDef struct {
+	// Device push key as issued by the push service, i.e. an APNS or FCM token
+	DeviceId string
+	// Platform of the device: "ios", "android", "web"
+	Platform string
+	// Last time when the device was registered or updated
+	LastSeen time.Time
+	// Device language, optional
+	Lang string
+}
+
+// AccessMode is a definition of access mode bits.
+type AccessMode uint
+
+// Various access mode constants
+const (
+	ModeSub    AccessMode = 1 << iota // user can Read, i.e. {sub} (R)
+	ModePub                           // user can Write, i.e. {pub} (W)
+	ModePres                          // user can receive presence updates (P)
+	ModeShare                         // user can invite other people to join (S)
+	ModeDelete                        // user can hard-delete messages (D), only owner can completely delete
+	ModeOwner                         // user is the owner (O) - full access
+	ModeBanned                        // user has no access, requests to share/gain access/{sub} are ignored (X)
+
+	ModeNone AccessMode = 0 // No access, requests to gain access are processed normally (N)
+
+	// Normal user's access to a topic
+	ModePublic AccessMode = ModeSub | ModePub | ModePres
+	// User's subscription to 'me' - user can only read and delete incoming invites
+	ModeSelf AccessMode = ModeSub | ModeDelete | ModePres
+	// Owner's subscription to a generic topic
+	ModeFull AccessMode = ModeSub | ModePub | ModePres | ModeShare | ModeDelete | ModeOwner
+	// Default P2P access mode
+	ModeP2P AccessMode = ModeSub | ModePub | ModePres | ModeDelete
+
+	// Invalid mode to indicate an error
+	ModeInvalid AccessMode = 0x100000
+)
+
+// MarshalText converts AccessMode to string as byte slice.
+func (m AccessMode) MarshalText() ([]byte, error) {
+	// Need to distinguish between "not set" and "no access"
+	if m == ModeNone {
+		return []byte{'N'}, nil
+	}
+
+	if m == ModeInvalid {
+		return nil, errors.New("AccessMode invalid")
+	}
+
+	// Banned mode superseeds all other modes
+	if m&ModeBanned != 0 {
+		return []byte{'X'}, nil
+	}
+
+	var res = []byte{}
+	var modes = []byte{'R', 'W', 'P', 'S', 'D', 'O'}
+	for i, chr := range modes {
+		if (m & (1 << uint(i))) != 0 {
+			res = append(res, chr)
+		}
+	}
+	return res, nil
+}
+
+// UnmarshalText parses access mode string as byte slice.
+// Does not change the mode if the string is empty or invalid.
+func (m *AccessMode) UnmarshalText(b []byte) error {
+	var m0 AccessMode
+
+	for i := 0; i < len(b); i++ {
+		switch b[i] {
+		case 'R', 'r':
+			m0 |= ModeSub
+		case 'W', 'w':
+			m0 |= ModePub
+		case 'S', 's':
+			m0 |= ModeShare
+		case 'D', 'd':
+			m0 |= ModeDelete
+		case 'P', 'p':
+			m0 |= ModePres
+		case 'O', 'o':
+			m0 |= ModeOwner
+		case 'X', 'x':
+			m0 |= ModeBanned
+		case 'N', 'n':
+			m0 = 0 // N means explicitly no access, all bits cleared
+		default:
+			return errors.New("AccessMode: invalid character '" + string(b[i]) + "'")
+		}
+	}
+
+	if m0&ModeBanned != 0 {
+		m0 = ModeBanned
+	}
+
+	*m = m0
+	return nil
+}
+
+// String returns string representation of AccessMode.
+func (m AccessMode) String() string {
+	res, err := m.MarshalText()
+	if err != nil {
+		return ""
+	}
+	return string(res)
+}
+
+// MarshalJSON converts AccessMode to quoted string.
+func (m AccessMode) MarshalJSON() ([]byte, error) {
+	res, err := m.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+
+	res = append([]byte{'"'}, res...)
+	return append(res, '"'), nil
+}
+
+// UnmarshalJSON reads AccessMode from a quoted string.
+func (m *AccessMode) UnmarshalJSON(b []byte) error {
+	if b[0] != '"' || b[len(b)-1] != '"' {
+		return errors.New("syntax error")
+	}
+
+	return m.UnmarshalText(b[1 : len(b)-1])
+}
+
+// Check checks if grant mode allows all permissions requested in want mode.
+func (grant AccessMode) Check(want AccessMode) bool {
+	return grant&want == want
+}
+
+// IsBanned checks if the banned flag is set.
+func (m AccessMode) IsBanned() bool {
+	return m&ModeBanned != 0
+}
+
+// IsOwner checks if the owner bit is set.
+func (m AccessMode) IsOwner() bool {
+	return m&ModeOwner != 0
+}
+
+// DefaultAccess is a per-topic default access modes
+type DefaultAccess struct {
+	Auth AccessMode
+	Anon AccessMode
+}
+
+// Subscription to a topic
+type Subscription struct {
+	ObjHeader
+	User  string // User who has relationship with the topic
+	Topic string // Topic subscribed to
+
+	// Sequence IDs of the last messages received and read by the user
+	RecvSeqId int
+	ReadSeqId int
+
+	ModeWant  AccessMode // Access applied for
+	ModeGiven AccessMode // Granted access
+	// Per-device times of the last access to the topic
+	LastSeen map[string]time.Time
+	// User's private data associated with the subscription
+	Private interface{}
+
+	// Deserialized ephemeral values
+
+	// Denormalized values from the topic: time and sequence ID of the last message
+	LastMessageAt *time.Time `gorethink:"-" json:"-"`
+	SeqId         int        `gorethink:"-" json:"-"`
+	// Deserialized public value from topic or user (depends on context)
+	// In case of P2P topics this is the Public value of the other user.
+	public interface{}
+	// P2P only. ID of the other user
+	with string
+}
+
+// SetPublic assigns to public, otherwise not accessible from outside the package.
+func (s *Subscription) SetPublic(pub interface{}) {
+	s.public = pub
+}
+
+// GetPublic reads value of public.
+func (s *Subscription) GetPublic() interface{} {
+	return s.public
+}
+
+// SetWith sets other user for P2P subscriptions.
+func (s *Subscription) SetWith(with string) {
+	s.with = with
+}
+
+// GetWith returns the other user for P2P subscriptions.
+func (s *Subscription) GetWith() string {
+	return s.with
+}
+
+// perUserData is a per-user value of a topic
+type perUserData struct {
+	// Timestamp when the subscription was created
+	//createdAt time.Time
+	// Timestamp when the subscription was last updated
+	//updatedAt time.Time
+	// Timestamp when the subscription was deleted
+	//deletedAt *time.Time
+
+	want  AccessMode
+	given AccessMode
+}
+
+// Topic stored in database
+type Topic struct {
+	ObjHeader
+	State int
+
+	// Name  of the topic; could be not unique
+	Name  string
+	UseBt bool // use bearer token or use ACL
+
+	// Default access to topic
+	Access DefaultAccess
+
+	// Server-issued sequence ID of the last message and the time it was saved
+	SeqId         int
+	LastMessageAt *time.Time
+
+	Public interface{}
+
+	// Deserialized ephemeral params
+	owner   Uid                  // first assigned owner
+	perUser map[Uid]*perUserData // deserialized from Subscription
+}
+
+// GiveAccess updates access mode for the given user.
+func (t *Topic) GiveAccess(uid Uid, want AccessMode, given AccessMode) {
+	if t.perUser == nil {
+		t.perUser = make(map[Uid]*perUserData, 1)
+	}
+
+	pud := t.perUser[uid]
+	if pud == nil {
+		pud = &perUserData{}
+	}
+
+	pud.want = want
+	pud.given = given
+
+	t.perUser[uid] = pud
+	if want&given&ModeOwner != 0 && t.owner.IsZero() {
+		t.owner = uid
+	}
+}
+
+// GetAccess returns the access mode requested by the given user.
+func (t *Topic) GetAccess(uid Uid) AccessMode {
+	if pud := t.perUser[uid]; pud != nil {
+		return pud.want
+	}
+	return ModeNone
+}
+
+// GetOwner returns the first assigned owner of the topic.
+func (t *Topic) GetOwner() Uid {
+	return t.owner
+}
+
+// Message is a stored {data} message
+type Message struct {
+	ObjHeader
+	// Server-issued sequence ID of the message in the topic, starting with 1
+	SeqId   int
+	Topic   string
+	From    string // UID as string of the user who sent the message, could be empty
+	Content interface{}
+}
+
+// InviteAction is the type of an invite
+type InviteAction int
+
+// Invite types
+const (
+	InvJoin InviteAction = iota // an invitation to subscribe
+	InvAppr                     // a request to aprove a subscription
+	InvInfo                     // informational message
+)
+
+// String converts InviteAction to string.
+func (a InviteAction) String() string {
+	switch a {
+	case InvJoin:
+		return "join"
+	case InvAppr:
+		return "appr"
+	case InvInfo:
+		return "info"
+	}
+	return ""
+}
+
+// BrowseOpt is an options for loading lists of objects, such as messages or subscriptions.
+type BrowseOpt struct {
+	Since  time.Time
+	Before time.Time
+	// Messages only: load messages with sequence IDs SinceId < SeqId < BeforeId.
+	// Takes precedence over Since and Before
+	SinceId  int
+	BeforeId int
+	Limit    uint
+	AscOrder bool // true - sort in ascending order by time, otherwise descending (default)
+}
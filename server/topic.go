@@ -34,6 +34,7 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"github.com/daodst/chat/server/push"
 	"github.com/daodst/chat/server/store"
 	"github.com/daodst/chat/server/store/types"
 	"log"
@@ -61,6 +62,9 @@ type Topic struct {
 	// Time of the last message
 	lastMessage time.Time
 
+	// Sequence ID of the last message
+	lastId int
+
 	// User ID of the topic owner/creator
 	owner types.Uid
 
@@ -93,6 +97,9 @@ type Topic struct {
 
 	// Presence subscriptions requests -- Request to start/stop receiving presence updates, buffered = ?
 	pres chan *presSubsReq
+
+	// Request to shut down the topic without unregistering it, the hub has already done so, buffered = 1
+	exit chan *shutDown
 }
 
 type TopicCat int
@@ -110,6 +117,9 @@ type perUserData struct {
 	// cleared     time.Time // time, when the topic was cleared by the user
 	modeWant  types.AccessMode
 	modeGiven types.AccessMode
+	// Sequence IDs of the last messages read and received by the user
+	readId int
+	recvId int
 	// P2p only:
 	public interface{}
 }
@@ -188,55 +198,7 @@ func (t *Topic) run(hub *Hub) {
 
 		case msg := <-t.broadcast:
 			// Message intended for broadcasting to recepients
-
-			log.Printf("topic[%s].run: got message '%v'", t.name, msg)
-
-			// Record last message timestamp
-			if msg.Data != nil {
-				from := types.ParseUserId(msg.Data.From)
-
-				// msg.akn is not nil when the message originated at the client.
-				// for internally generated messages, like invites, the akn is nil
-				if msg.akn != nil {
-					userData := t.perUser[from]
-					if userData.modeWant&userData.modeGiven&types.ModePub == 0 {
-						simpleByteSender(msg.akn, ErrPermissionDenied(msg.id, t.original, msg.timestamp))
-						continue
-					}
-				}
-
-				if err := store.Messages.Save(t.appid, &types.Message{
-					ObjHeader: types.ObjHeader{CreatedAt: msg.Data.Timestamp},
-					Topic:     t.name,
-					From:      from.String(),
-					Content:   msg.Data.Content}); err != nil {
-
-					simpleByteSender(msg.akn, ErrUnknown(msg.id, t.original, msg.timestamp))
-					continue
-				}
-
-				if msg.id != "" {
-					simpleByteSender(msg.akn, NoErrAccepted(msg.id, t.original, msg.timestamp))
-				}
-
-				t.lastMessage = msg.timestamp
-			}
-
-			// Broadcast the message. Only {data} and {pres} are broadcastable.
-			// {meta} and {ctrl} are sent to the session only
-			if msg.Data != nil || msg.Pres != nil {
-				var packet, _ = json.Marshal(msg)
-				for sess := range t.sessions {
-					select {
-					case sess.send <- packet:
-					default:
-						log.Printf("topic[%s].run: connection stuck, detach it", t.name)
-						t.unreg <- &sessionLeave{sess: sess, unsub: false}
-					}
-				}
-			} else {
-				log.Printf("topic[%s].run: wrong message type for broadcasting", t.name)
-			}
+			t.handleBroadcast(msg)
 
 		case meta := <-t.meta:
 			log.Printf("topic[%s].run: got meta message '%v'", t.name, meta)
@@ -269,6 +231,35 @@ func (t *Topic) run(hub *Hub) {
 			// Request to start/stop receiving presence updates from this topic
 			t.presProcReq(hub, req)
 
+		case sd := <-t.exit:
+			// Topic moved to another cluster node or the server is shutting down. Save the state
+			now := time.Now().UTC().Round(time.Millisecond)
+			if sd.moved {
+				log.Println("Topic moved: ", t.name)
+			} else {
+				log.Println("Topic shutdown: ", t.name)
+				// Persist messages which are still queued
+				t.drainBroadcast()
+			}
+
+			term := &ServerComMessage{Pres: &MsgServerPres{Topic: t.original, What: "term"}}
+			for sess := range t.sessions {
+				if err := store.Topics.UpdateLastSeen(t.appid, t.name, sess.uid, sess.tag, now); err != nil {
+					log.Println(err)
+				}
+				if sd.moved {
+					// Tell sessions to resubscribe
+					sess.detach <- t.name
+					simpleByteSender(sess.send, term)
+				}
+			}
+			t.sessions = nil
+
+			if sd.done != nil {
+				sd.done <- true
+			}
+			return
+
 		case <-killTimer.C:
 			log.Println("Topic timeout: ", t.name)
 			// Ensure that the messages are no longer routed to this topic
@@ -280,6 +271,84 @@ func (t *Topic) run(hub *Hub) {
 	}
 }
 
+// handleBroadcast saves {data} messages, processes {note}s and sends the result to attached sessions
+func (t *Topic) handleBroadcast(msg *ServerComMessage) {
+	log.Printf("topic[%s].run: got message '%v'", t.name, msg)
+
+	// Record last message timestamp
+	if msg.Data != nil {
+		from := types.ParseUserId(msg.Data.From)
+
+		// msg.akn is not nil when the message originated at the client.
+		// for internally generated messages, like invites, the akn is nil
+		if msg.akn != nil {
+			userData := t.perUser[from]
+			if userData.modeWant&userData.modeGiven&types.ModePub == 0 {
+				simpleByteSender(msg.akn, ErrPermissionDenied(msg.id, t.original, msg.timestamp))
+				return
+			}
+		}
+
+		if err := store.Messages.Save(t.appid, &types.Message{
+			ObjHeader: types.ObjHeader{CreatedAt: msg.Data.Timestamp},
+			SeqId:     t.lastId + 1,
+			Topic:     t.name,
+			From:      from.String(),
+			Content:   msg.Data.Content}); err != nil {
+
+			simpleByteSender(msg.akn, ErrUnknown(msg.id, t.original, msg.timestamp))
+			return
+		}
+
+		t.lastId++
+		msg.Data.SeqId = t.lastId
+
+		if msg.id != "" {
+			simpleByteSender(msg.akn, NoErrAccepted(msg.id, t.original, msg.timestamp))
+		}
+
+		t.lastMessage = msg.timestamp
+
+		// Notify subscribers who are not attached to the topic
+		t.pushForData(msg.Data)
+	}
+
+	if msg.Info != nil && !t.procNote(msg.Info) {
+		return
+	}
+
+	// Broadcast the message. Only {data}, {pres} and {info} are broadcastable.
+	// {meta} and {ctrl} are sent to the session only
+	if msg.Data != nil || msg.Pres != nil || msg.Info != nil {
+		var packet, _ = json.Marshal(msg)
+		for sess := range t.sessions {
+			if sess == msg.skipSess {
+				continue
+			}
+			select {
+			case sess.send <- packet:
+			default:
+				log.Printf("topic[%s].run: connection stuck, detach it", t.name)
+				t.unreg <- &sessionLeave{sess: sess, unsub: false}
+			}
+		}
+	} else {
+		log.Printf("topic[%s].run: wrong message type for broadcasting", t.name)
+	}
+}
+
+// drainBroadcast processes messages already queued for broadcasting
+func (t *Topic) drainBroadcast() {
+	for {
+		select {
+		case msg := <-t.broadcast:
+			t.handleBroadcast(msg)
+		default:
+			return
+		}
+	}
+}
+
 // Session subscribed to a topic, created == true if topic was just created and {pres} needs to be announced
 func (t *Topic) handleSubscription(h *Hub, sreg *sessionJoin) error {
 
@@ -662,6 +731,10 @@ func (t *Topic) replyGetInfo(sess *Session, id string, created bool) error {
 			info.LastMessage = &t.lastMessage
 		}
 
+		info.SeqId = t.lastId
+		info.ReadSeqId = pud.readId
+		info.RecvSeqId = pud.recvId
+
 		if when, ok := pud.lastSeenTag[sess.tag]; ok {
 			info.LastSeenTag = &when
 		}
@@ -843,6 +916,12 @@ func (t *Topic) replyGetSub(sess *Session, id string) error {
 				mts.Topic = sub.Topic
 				mts.With = sub.GetWith()
 				mts.LastMsg = sub.LastMessageAt
+				mts.SeqId = sub.SeqId
+				mts.ReadSeqId = sub.ReadSeqId
+				mts.RecvSeqId = sub.RecvSeqId
+				if sub.SeqId > sub.ReadSeqId {
+					mts.Unread = sub.SeqId - sub.ReadSeqId
+				}
 				if when, ok := sub.LastSeen[sess.tag]; ok && !when.IsZero() {
 					mts.LastSeenTag = &when
 				}
@@ -854,6 +933,14 @@ func (t *Topic) replyGetSub(sess *Session, id string) error {
 				}
 			} else {
 				mts.User = uid.UserId()
+				// Cached values are more recent than the stored ones
+				if pud, ok := t.perUser[uid]; ok {
+					mts.ReadSeqId = pud.readId
+					mts.RecvSeqId = pud.recvId
+				}
+				if uid == sess.uid && t.lastId > mts.ReadSeqId {
+					mts.Unread = t.lastId - mts.ReadSeqId
+				}
 			}
 			mts.UpdatedAt = sub.UpdatedAt
 			mts.AcsMode = (sub.ModeGiven & sub.ModeWant).String()
@@ -919,6 +1006,7 @@ func (t *Topic) replyGetData(sess *Session, id string, req *MsgBrowseOpts) error
 				Topic:     t.original,
 				From:      from.UserId(),
 				Timestamp: mm.CreatedAt,
+				SeqId:     mm.SeqId,
 				Content:   mm.Content}}
 			simpleByteSender(sess.send, msg)
 		}
@@ -927,6 +1015,60 @@ func (t *Topic) replyGetData(sess *Session, id string, req *MsgBrowseOpts) error
 	return nil
 }
 
+// procNote updates the recv/read sequence IDs of the user who sent the {note}.
+// Returns false if the note is invalid or changes nothing and should not be broadcast.
+func (t *Topic) procNote(info *MsgServerInfo) bool {
+	if t.cat == TopicCat_Me {
+		return false
+	}
+
+	uid := types.ParseUserId(info.From)
+	pud, ok := t.perUser[uid]
+	if !ok || pud.modeGiven.IsBanned() {
+		return false
+	}
+
+	if info.What == "kp" {
+		return true
+	}
+
+	if info.SeqId > t.lastId {
+		log.Printf("topic[%s]: {note} seq %d is ahead of the last message %d", t.name, info.SeqId, t.lastId)
+		return false
+	}
+
+	var changed bool
+	switch info.What {
+	case "read":
+		if info.SeqId > pud.readId {
+			pud.readId = info.SeqId
+			changed = true
+		}
+		// A read message is also received
+		if pud.readId > pud.recvId {
+			pud.recvId = pud.readId
+			changed = true
+		}
+	case "recv":
+		if info.SeqId > pud.recvId {
+			pud.recvId = info.SeqId
+			changed = true
+		}
+	}
+
+	if !changed {
+		return false
+	}
+
+	if err := store.Subs.UpdateRecvRead(t.appid, t.name, uid, pud.recvId, pud.readId); err != nil {
+		log.Println(err)
+		return false
+	}
+	t.perUser[uid] = pud
+
+	return true
+}
+
 func (t *Topic) makeInvite(notify, target, from types.Uid, act types.InviteAction, modeWant,
 	modeGiven types.AccessMode, info interface{}) *ServerComMessage {
 
@@ -1063,15 +1205,95 @@ func (me *Topic) presSnapshot() error {
 	return nil
 }
 
+// pushForData queues a push notification for subscribers who have no session attached to the topic
+func (t *Topic) pushForData(data *MsgServerData) {
+	online := make(map[types.Uid]bool, len(t.sessions))
+	for sess := range t.sessions {
+		online[sess.uid] = true
+	}
+
+	now := time.Now().UTC().Round(time.Millisecond)
+	from := types.ParseUserId(data.From)
+	// Recipients who know the topic by the same name share a receipt
+	receipts := make(map[string]*push.Receipt)
+	for uid, pud := range t.perUser {
+		if uid == from || online[uid] {
+			continue
+		}
+		// Skip pending invites, banned users and muted subscriptions
+		if pud.modeWant == types.ModeNone || pud.modeWant.IsBanned() || pud.modeGiven.IsBanned() ||
+			isMuted(pud.private, now) {
+			continue
+		}
+
+		topic := t.name
+		if t.cat == TopicCat_P2P {
+			// Each party knows a p2p topic by the user ID of the other party
+			topic = t.p2pOtherUser(uid).UserId()
+		}
+		receipt, ok := receipts[topic]
+		if !ok {
+			receipt = &push.Receipt{
+				AppId: t.appid,
+				Payload: push.Payload{
+					Topic:     topic,
+					From:      data.From,
+					Timestamp: data.Timestamp,
+					Content:   data.Content}}
+			receipts[topic] = receipt
+		}
+		receipt.To = append(receipt.To, push.Recipient{User: uid.UserId()})
+	}
+
+	for _, receipt := range receipts {
+		log.Printf("topic[%s]: queueing push notification to %d users", t.name, len(receipt.To))
+		push.Push(receipt)
+	}
+}
+
+// p2pOtherUser returns the other party of a p2p topic
+func (t *Topic) p2pOtherUser(uid types.Uid) types.Uid {
+	for other := range t.perUser {
+		if other != uid {
+			return other
+		}
+	}
+	return types.ZeroUid
+}
+
+// isMuted checks if the subscriber has muted notifications from the topic. The subscription is muted
+// if the private value has a "mute" field set to true or to an RFC 3339 timestamp in the future.
+func isMuted(private interface{}, now time.Time) bool {
+	priv, ok := private.(map[string]interface{})
+	if !ok {
+		return false
+	}
+
+	switch mute := priv["mute"].(type) {
+	case bool:
+		return mute
+	case string:
+		until, err := time.Parse(time.RFC3339, mute)
+		return err == nil && until.After(now)
+	}
+	return false
+}
+
 func msgOpts2storeOpts(req *MsgBrowseOpts, tag string, lastSeen time.Time) *types.BrowseOpt {
 	var opts *types.BrowseOpt
 	if req != nil {
 		opts = &types.BrowseOpt{AscOrder: req.Ascnd, Limit: req.Limit}
-		if req.Since != nil {
-			opts.Since = *req.Since
-		}
-		if req.Before != nil {
-			opts.Before = *req.Before
+		if req.SinceId > 0 || req.BeforeId > 0 {
+			// Sequence IDs are unambiguous, timestamps are ignored
+			opts.SinceId = req.SinceId
+			opts.BeforeId = req.BeforeId
+		} else {
+			if req.Since != nil {
+				opts.Since = *req.Since
+			}
+			if req.Before != nil {
+				opts.Before = *req.Before
+			}
 		}
 	} else if tag != TAG_UNDEF && !lastSeen.IsZero() {
 		opts = &types.BrowseOpt{Since: lastSeen}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/daodst/chat/server/push"
+	"github.com/daodst/chat/server/store/types"
+)
+
+// testPushHandler collects receipts instead of delivering them
+type testPushHandler struct {
+	input chan *push.Receipt
+}
+
+func (h *testPushHandler) Init(jsonconf string) error { return nil }
+func (h *testPushHandler) IsReady() bool              { return true }
+func (h *testPushHandler) Push() chan<- *push.Receipt { return h.input }
+func (h *testPushHandler) Stop()                      {}
+
+var testPush = &testPushHandler{input: make(chan *push.Receipt, 16)}
+
+func init() {
+	push.Register("test", testPush)
+}
+
+func TestIsMuted(t *testing.T) {
+	now := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		private interface{}
+		want    bool
+	}{
+		{"nil", nil, false},
+		{"not a map", "mute", false},
+		{"no mute field", map[string]interface{}{"comment": "x"}, false},
+		{"muted", map[string]interface{}{"mute": true}, true},
+		{"unmuted", map[string]interface{}{"mute": false}, false},
+		{"muted until future", map[string]interface{}{"mute": "2022-05-02T00:00:00Z"}, true},
+		{"muted until past", map[string]interface{}{"mute": "2022-04-30T00:00:00Z"}, false},
+		{"muted until now", map[string]interface{}{"mute": "2022-05-01T12:00:00Z"}, false},
+		{"invalid timestamp", map[string]interface{}{"mute": "tomorrow"}, false},
+		{"unsupported type", map[string]interface{}{"mute": 1}, false},
+	}
+	for _, tt := range tests {
+		if got := isMuted(tt.private, now); got != tt.want {
+			t.Errorf("%s: isMuted() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPushForData(t *testing.T) {
+	sender := types.Uid(1)
+	online := types.Uid(2)
+	offline := types.Uid(3)
+	invited := types.Uid(4)
+	banned := types.Uid(5)
+	muted := types.Uid(6)
+	unmuted := types.Uid(7)
+
+	topic := &Topic{
+		name:     "grpTest",
+		appid:    1,
+		sessions: map[*Session]bool{{uid: online}: true},
+		perUser: map[types.Uid]perUserData{
+			sender:  {modeWant: types.ModePublic, modeGiven: types.ModePublic},
+			online:  {modeWant: types.ModePublic, modeGiven: types.ModePublic},
+			offline: {modeWant: types.ModePublic, modeGiven: types.ModePublic},
+			invited: {modeWant: types.ModeNone, modeGiven: types.ModePublic},
+			banned:  {modeWant: types.ModePublic, modeGiven: types.ModeBanned},
+			muted: {modeWant: types.ModePublic, modeGiven: types.ModePublic,
+				private: map[string]interface{}{"mute": true}},
+			unmuted: {modeWant: types.ModePublic, modeGiven: types.ModePublic,
+				private: map[string]interface{}{"mute": "2000-01-01T00:00:00Z"}},
+		},
+	}
+
+	ts := time.Now().UTC()
+	topic.pushForData(&MsgServerData{Topic: "grpTest", From: sender.UserId(), Timestamp: ts, SeqId: 5,
+		Content: "hello"})
+
+	var receipt *push.Receipt
+	select {
+	case receipt = <-testPush.input:
+	default:
+		t.Fatal("no push notification queued")
+	}
+
+	if receipt.AppId != 1 {
+		t.Errorf("AppId = %d, want 1", receipt.AppId)
+	}
+	if receipt.Payload.Topic != "grpTest" || receipt.Payload.From != sender.UserId() ||
+		!receipt.Payload.Timestamp.Equal(ts) || receipt.Payload.Content != "hello" {
+		t.Errorf("unexpected payload %+v", receipt.Payload)
+	}
+
+	var got []string
+	for _, to := range receipt.To {
+		got = append(got, to.User)
+	}
+	sort.Strings(got)
+	want := []string{offline.UserId(), unmuted.UserId()}
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("recipients = %v, want %v", got, want)
+	}
+}
+
+func TestPushForDataNoRecipients(t *testing.T) {
+	sender := types.Uid(1)
+	online := types.Uid(2)
+
+	topic := &Topic{
+		name:     "grpTest",
+		sessions: map[*Session]bool{{uid: online}: true},
+		perUser: map[types.Uid]perUserData{
+			sender: {modeWant: types.ModePublic, modeGiven: types.ModePublic},
+			online: {modeWant: types.ModePublic, modeGiven: types.ModePublic},
+		},
+	}
+
+	topic.pushForData(&MsgServerData{Topic: "grpTest", From: sender.UserId(), Timestamp: time.Now()})
+
+	select {
+	case receipt := <-testPush.input:
+		t.Errorf("unexpected push notification %+v", receipt)
+	default:
+	}
+}
+
+func TestPushForDataP2P(t *testing.T) {
+	alice := types.Uid(1)
+	bob := types.Uid(2)
+
+	topic := &Topic{
+		name:     "p2pTest",
+		appid:    1,
+		cat:      TopicCat_P2P,
+		sessions: map[*Session]bool{},
+		perUser: map[types.Uid]perUserData{
+			alice: {modeWant: types.ModePublic, modeGiven: types.ModePublic},
+			bob:   {modeWant: types.ModePublic, modeGiven: types.ModePublic},
+		},
+	}
+
+	// Without a sender both parties are notified, each under the name of the other party
+	topic.pushForData(&MsgServerData{Topic: "p2pTest", Timestamp: time.Now(), Content: "hello"})
+
+	got := make(map[string]string)
+	for i := 0; i < 2; i++ {
+		select {
+		case receipt := <-testPush.input:
+			for _, to := range receipt.To {
+				got[to.User] = receipt.Payload.Topic
+			}
+		default:
+			t.Fatalf("got %d push notifications, want 2", i)
+		}
+	}
+	want := map[string]string{alice.UserId(): bob.UserId(), bob.UserId(): alice.UserId()}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("topics by recipient = %v, want %v", got, want)
+	}
+}
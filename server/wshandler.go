@@ -60,7 +60,7 @@ func (sess *Session) readLoop() {
 			// sub.done is the same as topic.unreg
 			sub.done <- &sessionLeave{sess: sess, unsub: false}
 		}
-		sess.stop <- true
+		sess.stop <- nil
 	}()
 
 	sess.ws.SetReadLimit(maxMessageSize)
@@ -101,8 +101,11 @@ func (sess *Session) writeLoop() {
 				log.Println("sess.writeLoop: " + err.Error())
 				return
 			}
-		case <-sess.stop:
-			// shutdown requested
+		case msg := <-sess.stop:
+			// shutdown requested, send the final message if any
+			if msg != nil {
+				ws_write(sess.ws, websocket.TextMessage, msg)
+			}
 			return
 
 		case topic := <-sess.detach:
@@ -322,8 +322,18 @@ func (b *BaseDendrite) KeyServerHTTPClient() keyserverAPI.KeyInternalAPI {
 }
 
 // PushGatewayHTTPClient returns a new client for interacting with (external) Push Gateways.
+// Requests which fail temporarily are retried as configured.
 func (b *BaseDendrite) PushGatewayHTTPClient() pushgateway.Client {
-	return pushgateway.NewHTTPClient(b.Cfg.UserAPI.PushGatewayDisableTLSValidation)
+	cfg := &b.Cfg.UserAPI.PushGateway
+	return pushgateway.NewRetryingClient(
+		pushgateway.NewHTTPClient(b.Cfg.UserAPI.PushGatewayDisableTLSValidation),
+		pushgateway.RetryOptions{
+			MaxAttempts:    cfg.MaxAttempts,
+			InitialBackoff: cfg.InitialBackoff,
+			MaxBackoff:     cfg.MaxBackoff,
+			MetricsAppIDs:  cfg.MetricsAppIDs,
+		},
+	)
 }
 
 // CreateClient creates a new client (normally used for media fetch requests).
@@ -168,6 +168,9 @@ type ThumbnailSize struct {
 	// crop scales to fill the requested dimensions and crops the excess.
 	// scale scales to fit the requested dimensions and one dimension may be smaller than requested.
 	ResizeMethod string `yaml:"method,omitempty"`
+	// Animated also generates an animated thumbnail of animated GIF and WebP images in this size,
+	// which is served to clients requesting animated=true. Otherwise only the first frame is used.
+	Animated bool `yaml:"animated,omitempty"`
 }
 
 // LogrusHook represents a single logrus hook. At this point, only parsing and
@@ -339,6 +342,7 @@ func (c *Dendrite) Wiring() {
 	c.ClientAPI.Derived = &c.Derived
 	c.AppServiceAPI.Derived = &c.Derived
 	c.ClientAPI.MSCs = &c.MSCs
+	c.SyncAPI.MSCs = &c.MSCs
 }
 
 // Error returns a string detailing how many errors were contained within a
@@ -48,6 +48,12 @@ type ClientAPI struct {
 	// Rate-limiting options
 	RateLimiting RateLimiting `yaml:"rate_limiting"`
 
+	// The database is only used for delayed events
+	Database DatabaseOptions `yaml:"database"`
+
+	// Delayed events (MSC4140) options
+	DelayedEvents DelayedEvents `yaml:"delayed_events"`
+
 	MSCs *MSCs `yaml:"mscs"`
 }
 
@@ -64,11 +70,20 @@ func (c *ClientAPI) Defaults(generate bool) {
 	c.RegistrationDisabled = true
 	c.OpenRegistrationWithoutVerificationEnabled = false
 	c.RateLimiting.Defaults()
+	c.DelayedEvents.Defaults()
+	c.Database.Defaults(5)
+	if generate {
+		c.Database.ConnectionString = "file:clientapi.db"
+	}
 }
 
 func (c *ClientAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	c.TURN.Verify(configErrs)
 	c.RateLimiting.Verify(configErrs)
+	c.DelayedEvents.Verify(configErrs)
+	if c.DelayedEvents.Enabled && c.Matrix.DatabaseOptions.ConnectionString == "" {
+		checkNotEmpty(configErrs, "client_api.database", string(c.Database.ConnectionString))
+	}
 	if c.RecaptchaEnabled {
 		checkNotEmpty(configErrs, "client_api.recaptcha_public_key", c.RecaptchaPublicKey)
 		checkNotEmpty(configErrs, "client_api.recaptcha_private_key", c.RecaptchaPrivateKey)
@@ -152,3 +167,30 @@ func (r *RateLimiting) Defaults() {
 	r.Threshold = 5
 	r.CooloffMS = 500
 }
+
+type DelayedEvents struct {
+	// Whether clients can send events after a delay with the org.matrix.msc4140.delay
+	// parameter of /send and /state. default: false
+	Enabled bool `yaml:"enabled"`
+
+	// The longest delay clients may ask for. default: 720h (30 days)
+	MaxDelay time.Duration `yaml:"max_delay"`
+
+	// The maximum number of delayed events per user which weren't sent yet, 0 means
+	// unlimited. default: 100
+	MaxPerUser int64 `yaml:"max_per_user"`
+}
+
+func (d *DelayedEvents) Verify(configErrs *ConfigErrors) {
+	if d.Enabled {
+		checkNotZero(configErrs, "client_api.delayed_events.max_delay", int64(d.MaxDelay))
+		checkPositive(configErrs, "client_api.delayed_events.max_delay", int64(d.MaxDelay))
+		checkPositive(configErrs, "client_api.delayed_events.max_per_user", d.MaxPerUser)
+	}
+}
+
+func (d *DelayedEvents) Defaults() {
+	d.Enabled = false
+	d.MaxDelay = 30 * 24 * time.Hour
+	d.MaxPerUser = 100
+}
@@ -102,6 +102,7 @@ func (c *Global) Defaults(generate bool) {
 	c.ServerNotices.Defaults(generate)
 	c.ReportStats.Defaults()
 	c.Cache.Defaults(generate)
+	c.Presence.Defaults()
 }
 
 func (c *Global) Verify(configErrs *ConfigErrors, isMonolith bool) {
@@ -115,6 +116,7 @@ func (c *Global) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	c.ServerNotices.Verify(configErrs, isMonolith)
 	c.ReportStats.Verify(configErrs, isMonolith)
 	c.Cache.Verify(configErrs, isMonolith)
+	c.Presence.Verify(configErrs)
 }
 
 type OldVerifyKeys struct {
@@ -294,6 +296,19 @@ type PresenceOptions struct {
 	EnableInbound bool `yaml:"enable_inbound"`
 	// Whether outbound presence events are allowed
 	EnableOutbound bool `yaml:"enable_outbound"`
+	// How long after their last activity online users become unavailable.
+	// Clients can report their last activity with last_active_ago when
+	// setting their presence. default: 5m
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+}
+
+func (c *PresenceOptions) Defaults() {
+	c.IdleTimeout = 5 * time.Minute
+}
+
+func (c *PresenceOptions) Verify(configErrs *ConfigErrors) {
+	checkNotZero(configErrs, "global.presence.idle_timeout", int64(c.IdleTimeout))
+	checkPositive(configErrs, "global.presence.idle_timeout", int64(c.IdleTimeout))
 }
 
 type DataUnit int64
@@ -2,6 +2,9 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"strings"
+	"time"
 )
 
 type MediaAPI struct {
@@ -20,6 +23,9 @@ type MediaAPI struct {
 	// The absolute base path to where media files will be stored.
 	AbsBasePath Path `yaml:"-"`
 
+	// Where media files and thumbnails are kept. The base path is still used for temporary files.
+	Storage MediaStorage `yaml:"storage"`
+
 	// The maximum file size in bytes that is allowed to be stored on this server.
 	// Note: if max_file_size_bytes is set to 0, the size is unlimited.
 	// Note: if max_file_size_bytes is not set, it will default to 10485760 (10MB)
@@ -33,6 +39,175 @@ type MediaAPI struct {
 
 	// A list of thumbnail sizes to be pre-generated for downloaded remote / uploaded content
 	ThumbnailSizes []ThumbnailSize `yaml:"thumbnail_sizes"`
+
+	// External tools generating thumbnails of PDFs and videos
+	ExternalThumbnailers ExternalThumbnailers `yaml:"external_thumbnailers"`
+
+	// Configuration for the /preview_url endpoint
+	URLPreviews URLPreviews `yaml:"url_previews"`
+
+	// Configuration for asynchronous uploads, where a media ID is reserved with /create
+	// and the content uploaded later
+	PendingUploads PendingUploads `yaml:"pending_uploads"`
+
+	// Configuration for scanning uploaded and remote media before it is stored or served
+	ContentScanning ContentScanning `yaml:"content_scanning"`
+
+	// Configuration for extracting the size and a blurhash of uploaded images
+	ImageMetadata ImageMetadata `yaml:"image_metadata"`
+
+	// Configuration for limiting the total size of the media each user uploads
+	Quotas MediaQuotas `yaml:"quotas"`
+}
+
+const (
+	// MediaStorageFileSystem keeps media in a directory tree under the base path
+	MediaStorageFileSystem = "filesystem"
+	// MediaStorageS3 keeps media in a bucket of an S3-compatible object store
+	MediaStorageS3 = "s3"
+)
+
+type MediaStorage struct {
+	// The storage backend, either "filesystem" or "s3". default: filesystem
+	Backend string `yaml:"backend"`
+
+	// Options for the S3 backend
+	S3 S3Storage `yaml:"s3"`
+}
+
+type S3Storage struct {
+	// URL of the object store, i.e. https://s3.eu-west-1.amazonaws.com or http://localhost:9000
+	Endpoint string `yaml:"endpoint"`
+
+	// The region of the bucket, may be left empty for most self-hosted stores
+	Region string `yaml:"region"`
+
+	// The bucket to keep media in, it must already exist
+	Bucket string `yaml:"bucket"`
+
+	// Prepended to the key of every object, allows sharing the bucket
+	Prefix string `yaml:"prefix"`
+
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+
+	// Address the bucket in the URL path rather than the host name, as required by most self-hosted stores
+	ForcePathStyle bool `yaml:"force_path_style"`
+}
+
+type URLPreviews struct {
+	// Whether /preview_url is enabled. default: false
+	Enabled bool `yaml:"enabled"`
+
+	// The maximum number of bytes read from a previewed page, the rest is ignored. default: 1048576 (1MB)
+	MaxPageSizeBytes FileSizeBytes `yaml:"max_page_size_bytes"`
+
+	// How long to wait for a page or its preview image to be fetched. default: 10s
+	FetchTimeout time.Duration `yaml:"fetch_timeout"`
+
+	// Previews are cached per URL for time buckets of this length. default: 1h
+	CacheBucket time.Duration `yaml:"cache_bucket"`
+
+	// IP ranges in CIDR notation which must never be fetched. Defaults to loopback,
+	// private and link-local ranges so that previews can't be used to probe the internal network.
+	IPRangeBlacklist []string `yaml:"ip_range_blacklist"`
+
+	// IP ranges in CIDR notation which may be fetched even if they are in the blacklist.
+	IPRangeWhitelist []string `yaml:"ip_range_whitelist"`
+}
+
+type PendingUploads struct {
+	// How long a reserved media ID stays valid if no content is uploaded for it. default: 24h
+	ExpireAfter time.Duration `yaml:"expire_after"`
+
+	// The maximum number of reserved media IDs without content per user, 0 means unlimited. default: 10
+	MaxPerUser int64 `yaml:"max_per_user"`
+
+	// The maximum time a download waits for the content of a reserved media ID, clients
+	// may ask for less with timeout_ms. default: 20s
+	MaxDownloadWait time.Duration `yaml:"max_download_wait"`
+}
+
+const (
+	// ContentScannerClamd sends content to a ClamAV daemon over its Unix socket
+	ContentScannerClamd = "clamd"
+	// ContentScannerCommand runs a command with the content on its standard input
+	ContentScannerCommand = "command"
+)
+
+type ContentScanning struct {
+	// Whether media is scanned. default: false
+	Enabled bool `yaml:"enabled"`
+	// The scanner, either "clamd" or "command". default: clamd
+	Backend string `yaml:"backend"`
+	// The Unix socket of the ClamAV daemon. default: /var/run/clamav/clamd.ctl
+	Socket string `yaml:"socket"`
+	// The command and its arguments, i.e. ["clamdscan", "--no-summary", "-"]. It must exit with
+	// status 0 if the content is clean and 1 if it is infected, anything else is a failure.
+	Command []string `yaml:"command"`
+	// How long scanning a single file may take. default: 60s
+	Timeout time.Duration `yaml:"timeout"`
+	// Whether media is accepted when the scanner can't be reached or fails. Rejecting it
+	// is safer, but uploads fail while the scanner is down. default: false
+	FailOpen bool `yaml:"fail_open"`
+}
+
+// ExternalThumbnailerInput is replaced with the path of the file in the command of an external thumbnailer
+const ExternalThumbnailerInput = "{input}"
+
+type ExternalThumbnailers struct {
+	// The command rendering the first page of a PDF as a PNG or JPEG image on its standard output,
+	// i.e. ["pdftoppm", "-png", "-singlefile", "-scale-to", "1024", "{input}"]. PDFs get no
+	// thumbnails if empty. default: empty
+	PDF []string `yaml:"pdf"`
+	// The command extracting a frame of a video as a PNG or JPEG image on its standard output,
+	// i.e. ["ffmpeg", "-loglevel", "error", "-i", "{input}", "-frames:v", "1", "-f", "image2pipe", "-vcodec", "png", "-"].
+	// Videos get no thumbnails if empty. default: empty
+	Video []string `yaml:"video"`
+	// How long a command may run. default: 30s
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+type ImageMetadata struct {
+	// Whether the size, EXIF orientation and blurhash of uploaded images are extracted. default: true
+	Enabled bool `yaml:"enabled"`
+	// Whether EXIF, XMP and IPTC metadata, such as the GPS location, is removed from uploaded
+	// JPEG images before they are stored. The EXIF orientation is kept. default: false
+	StripEXIF bool `yaml:"strip_exif"`
+	// Images with more pixels are not decoded to compute a blurhash. default: 50000000
+	MaxPixels int64 `yaml:"max_pixels"`
+}
+
+type MediaQuotas struct {
+	// Whether uploads exceeding the quota of the uploader are rejected. default: false
+	Enabled bool `yaml:"enabled"`
+	// The total size of the media a user may upload. default: 1073741824 (1GB)
+	DefaultBytes FileSizeBytes `yaml:"default_bytes"`
+	// Quotas of specific users by their Matrix user ID, replacing the default quota.
+	// Pledge level multipliers don't apply to them, 0 means unlimited.
+	Users map[string]FileSizeBytes `yaml:"users"`
+	// In chain mode the default quota is multiplied with the multiplier of the pledge
+	// level of the uploader. Levels without a multiplier keep the default quota.
+	PledgeLevelMultipliers map[int64]float64 `yaml:"pledge_level_multipliers"`
+}
+
+// DefaultURLPreviewIPRangeBlacklist lists the IP ranges which are not reachable by /preview_url by default
+var DefaultURLPreviewIPRangeBlacklist = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
 }
 
 // DefaultMaxFileSizeBytes defines the default file size allowed in transfers
@@ -44,6 +219,21 @@ func (c *MediaAPI) Defaults(generate bool) {
 	c.ExternalAPI.Listen = "http://[::]:8074"
 	c.MaxFileSizeBytes = DefaultMaxFileSizeBytes
 	c.MaxThumbnailGenerators = 10
+	c.Storage.Backend = MediaStorageFileSystem
+	c.URLPreviews.MaxPageSizeBytes = 1048576
+	c.URLPreviews.FetchTimeout = 10 * time.Second
+	c.URLPreviews.CacheBucket = time.Hour
+	c.URLPreviews.IPRangeBlacklist = DefaultURLPreviewIPRangeBlacklist
+	c.PendingUploads.ExpireAfter = 24 * time.Hour
+	c.PendingUploads.MaxPerUser = 10
+	c.PendingUploads.MaxDownloadWait = 20 * time.Second
+	c.ContentScanning.Backend = ContentScannerClamd
+	c.ContentScanning.Socket = "/var/run/clamav/clamd.ctl"
+	c.ContentScanning.Timeout = 60 * time.Second
+	c.ExternalThumbnailers.Timeout = 30 * time.Second
+	c.ImageMetadata.Enabled = true
+	c.ImageMetadata.MaxPixels = 50000000
+	c.Quotas.DefaultBytes = 1073741824
 	c.Database.Defaults(5)
 	if generate {
 		c.Database.ConnectionString = "file:mediaapi.db"
@@ -56,6 +246,14 @@ func (c *MediaAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 		checkNotEmpty(configErrs, "media_api.database.connection_string", string(c.Database.ConnectionString))
 	}
 	checkNotEmpty(configErrs, "media_api.base_path", string(c.BasePath))
+	switch c.Storage.Backend {
+	case MediaStorageFileSystem:
+	case MediaStorageS3:
+		checkURL(configErrs, "media_api.storage.s3.endpoint", c.Storage.S3.Endpoint)
+		checkNotEmpty(configErrs, "media_api.storage.s3.bucket", c.Storage.S3.Bucket)
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "media_api.storage.backend", c.Storage.Backend))
+	}
 	checkPositive(configErrs, "media_api.max_file_size_bytes", int64(c.MaxFileSizeBytes))
 	checkPositive(configErrs, "media_api.max_thumbnail_generators", int64(c.MaxThumbnailGenerators))
 
@@ -63,6 +261,71 @@ func (c *MediaAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 		checkPositive(configErrs, fmt.Sprintf("media_api.thumbnail_sizes[%d].width", i), int64(size.Width))
 		checkPositive(configErrs, fmt.Sprintf("media_api.thumbnail_sizes[%d].height", i), int64(size.Height))
 	}
+	if c.URLPreviews.Enabled {
+		checkPositive(configErrs, "media_api.url_previews.max_page_size_bytes", int64(c.URLPreviews.MaxPageSizeBytes))
+		checkPositive(configErrs, "media_api.url_previews.fetch_timeout", int64(c.URLPreviews.FetchTimeout))
+		checkNotZero(configErrs, "media_api.url_previews.cache_bucket", int64(c.URLPreviews.CacheBucket))
+		if c.URLPreviews.CacheBucket != 0 && c.URLPreviews.CacheBucket < time.Millisecond {
+			// Previews are bucketed by millisecond timestamps
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "media_api.url_previews.cache_bucket", c.URLPreviews.CacheBucket))
+		}
+		for i, cidr := range c.URLPreviews.IPRangeBlacklist {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", fmt.Sprintf("media_api.url_previews.ip_range_blacklist[%d]", i), err))
+			}
+		}
+		for i, cidr := range c.URLPreviews.IPRangeWhitelist {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", fmt.Sprintf("media_api.url_previews.ip_range_whitelist[%d]", i), err))
+			}
+		}
+	}
+	checkNotZero(configErrs, "media_api.pending_uploads.expire_after", int64(c.PendingUploads.ExpireAfter))
+	checkPositive(configErrs, "media_api.pending_uploads.expire_after", int64(c.PendingUploads.ExpireAfter))
+	checkPositive(configErrs, "media_api.pending_uploads.max_per_user", c.PendingUploads.MaxPerUser)
+	checkPositive(configErrs, "media_api.pending_uploads.max_download_wait", int64(c.PendingUploads.MaxDownloadWait))
+	if c.ContentScanning.Enabled {
+		switch c.ContentScanning.Backend {
+		case ContentScannerClamd:
+			checkNotEmpty(configErrs, "media_api.content_scanning.socket", c.ContentScanning.Socket)
+		case ContentScannerCommand:
+			if len(c.ContentScanning.Command) == 0 {
+				checkNotEmpty(configErrs, "media_api.content_scanning.command", "")
+			}
+		default:
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "media_api.content_scanning.backend", c.ContentScanning.Backend))
+		}
+		checkNotZero(configErrs, "media_api.content_scanning.timeout", int64(c.ContentScanning.Timeout))
+		checkPositive(configErrs, "media_api.content_scanning.timeout", int64(c.ContentScanning.Timeout))
+	}
+	for _, command := range []struct {
+		key  string
+		args []string
+	}{
+		{"media_api.external_thumbnailers.pdf", c.ExternalThumbnailers.PDF},
+		{"media_api.external_thumbnailers.video", c.ExternalThumbnailers.Video},
+	} {
+		if len(command.args) > 0 && !strings.Contains(strings.Join(command.args, " "), ExternalThumbnailerInput) {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: command must contain %s", command.key, ExternalThumbnailerInput))
+		}
+	}
+	if len(c.ExternalThumbnailers.PDF) > 0 || len(c.ExternalThumbnailers.Video) > 0 {
+		checkNotZero(configErrs, "media_api.external_thumbnailers.timeout", int64(c.ExternalThumbnailers.Timeout))
+	}
+	checkPositive(configErrs, "media_api.external_thumbnailers.timeout", int64(c.ExternalThumbnailers.Timeout))
+	checkPositive(configErrs, "media_api.image_metadata.max_pixels", c.ImageMetadata.MaxPixels)
+	if c.Quotas.Enabled {
+		checkNotZero(configErrs, "media_api.quotas.default_bytes", int64(c.Quotas.DefaultBytes))
+		checkPositive(configErrs, "media_api.quotas.default_bytes", int64(c.Quotas.DefaultBytes))
+		for userID, quota := range c.Quotas.Users {
+			checkPositive(configErrs, fmt.Sprintf("media_api.quotas.users[%s]", userID), int64(quota))
+		}
+		for level, multiplier := range c.Quotas.PledgeLevelMultipliers {
+			if multiplier <= 0 {
+				configErrs.Add(fmt.Sprintf("invalid value for config key %q: %g", fmt.Sprintf("media_api.quotas.pledge_level_multipliers[%d]", level), multiplier))
+			}
+		}
+	}
 	if isMonolith { // polylith required configs below
 		return
 	}
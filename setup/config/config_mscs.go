@@ -8,6 +8,7 @@ type MSCs struct {
 	// 'msc2753': Peeking via /sync - https://github.com/matrix-org/matrix-doc/pull/2753
 	// 'msc2836': Threading - https://github.com/matrix-org/matrix-doc/pull/2836
 	// 'msc2946': Spaces Summary - https://github.com/matrix-org/matrix-doc/pull/2946
+	// 'msc3575': Sliding sync - https://github.com/matrix-org/matrix-spec-proposals/pull/3575
 	MSCs []string `yaml:"mscs"`
 
 	Database DatabaseOptions `yaml:"database"`
@@ -1,5 +1,7 @@
 package config
 
+import "time"
+
 type SyncAPI struct {
 	Matrix *Global `yaml:"-"`
 
@@ -9,6 +11,35 @@ type SyncAPI struct {
 	Database DatabaseOptions `yaml:"database"`
 
 	RealIPHeader string `yaml:"real_ip_header"`
+
+	// Configuration for the full-text search of messages with /search
+	Search Search `yaml:"search"`
+
+	// Configuration for the edit and redaction history of events available to room moderators
+	EventHistory EventHistory `yaml:"event_history"`
+
+	MSCs *MSCs `yaml:"mscs"`
+}
+
+type Search struct {
+	// Whether message bodies are indexed and /search is available. Enabling it later
+	// indexes the messages still kept in the room server output stream. default: true
+	Enabled bool `yaml:"enabled"`
+}
+
+// DefaultEventHistoryPowerLevelKey is the key in the events of m.room.power_levels which
+// holds the power level needed to look at the history of events
+const DefaultEventHistoryPowerLevelKey = "org.matrix.dendrite.event_history"
+
+type EventHistory struct {
+	// Whether the original content of redacted events is kept and room moderators can look
+	// at the edit and redaction history of events. default: false
+	Enabled bool `yaml:"enabled"`
+	// How long the original content of redacted events is kept. default: 720h (30 days)
+	RedactedRetention time.Duration `yaml:"redacted_retention"`
+	// The key in the events of m.room.power_levels holding the power level needed to look at
+	// the history. Rooms without the key use their redact level. default: org.matrix.dendrite.event_history
+	PowerLevelKey string `yaml:"power_level_key"`
 }
 
 func (c *SyncAPI) Defaults(generate bool) {
@@ -16,6 +47,9 @@ func (c *SyncAPI) Defaults(generate bool) {
 	c.InternalAPI.Connect = "http://localhost:7773"
 	c.ExternalAPI.Listen = "http://localhost:8073"
 	c.Database.Defaults(10)
+	c.Search.Enabled = true
+	c.EventHistory.RedactedRetention = 30 * 24 * time.Hour
+	c.EventHistory.PowerLevelKey = DefaultEventHistoryPowerLevelKey
 	if generate {
 		c.Database.ConnectionString = "file:syncapi.db"
 	}
@@ -25,6 +59,11 @@ func (c *SyncAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	if c.Matrix.DatabaseOptions.ConnectionString == "" {
 		checkNotEmpty(configErrs, "sync_api.database", string(c.Database.ConnectionString))
 	}
+	if c.EventHistory.Enabled {
+		checkNotZero(configErrs, "sync_api.event_history.redacted_retention", int64(c.EventHistory.RedactedRetention))
+		checkPositive(configErrs, "sync_api.event_history.redacted_retention", int64(c.EventHistory.RedactedRetention))
+		checkNotEmpty(configErrs, "sync_api.event_history.power_level_key", c.EventHistory.PowerLevelKey)
+	}
 	if isMonolith { // polylith required configs below
 		return
 	}
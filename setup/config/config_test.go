@@ -95,6 +95,10 @@ client_api:
     turn_shared_secret: ""
     turn_username: ""
     turn_password: ""
+  delayed_events:
+    enabled: false
+    max_delay: 720h
+    max_per_user: 100
 current_state_server:
   internal_api:
     listen: http://localhost:7782
@@ -131,6 +135,8 @@ media_api:
     max_idle_conns: 2
     conn_max_lifetime: -1
   base_path: ./media_store
+  storage:
+    backend: filesystem
   max_file_size_bytes: 10485760
   dynamic_thumbnails: false
   max_thumbnail_generators: 10
@@ -144,6 +150,35 @@ media_api:
   - width: 640
     height: 480
     method: scale
+    animated: true
+  external_thumbnailers:
+    pdf: []
+    video: []
+    timeout: 30s
+  url_previews:
+    enabled: false
+    max_page_size_bytes: 1048576
+    fetch_timeout: 10s
+    cache_bucket: 1h
+  pending_uploads:
+    expire_after: 24h
+    max_per_user: 10
+    max_download_wait: 20s
+  content_scanning:
+    enabled: false
+    backend: clamd
+    socket: /var/run/clamav/clamd.ctl
+    timeout: 60s
+    fail_open: false
+  image_metadata:
+    enabled: true
+    strip_exif: false
+    max_pixels: 50000000
+  quotas:
+    enabled: false
+    default_bytes: 1073741824
+    users: {}
+    pledge_level_multipliers: {}
 room_server:
   internal_api:
     listen: http://localhost:7770
@@ -178,6 +213,12 @@ sync_api:
     max_open_conns: 100
     max_idle_conns: 2
     conn_max_lifetime: -1
+  search:
+    enabled: true
+  event_history:
+    enabled: false
+    redacted_retention: 720h
+    power_level_key: org.matrix.dendrite.event_history
 user_api:
   internal_api:
     listen: http://localhost:7781
@@ -187,6 +228,14 @@ user_api:
     max_open_conns: 100
     max_idle_conns: 2
     conn_max_lifetime: -1
+  push_gateway:
+    max_attempts: 5
+    initial_backoff: 1s
+    max_backoff: 30s
+    batch_devices: false
+    max_permanent_failures: 10
+    metrics_app_ids: []
+    loopback: false
   pusher_database:
     connection_string: file:pushserver.db
     max_open_conns: 100
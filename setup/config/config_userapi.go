@@ -1,6 +1,10 @@
 package config
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
 
 type UserAPI struct {
 	Matrix *Global `yaml:"-"`
@@ -16,6 +20,9 @@ type UserAPI struct {
 	// Disable TLS validation on HTTPS calls to push gatways. NOT RECOMMENDED!
 	PushGatewayDisableTLSValidation bool `yaml:"push_gateway_disable_tls_validation"`
 
+	// How notifications are delivered to push gateways.
+	PushGateway PushGatewayOptions `yaml:"push_gateway"`
+
 	// The Account database stores the login details and account information
 	// for local users. It is accessed by the UserAPI.
 	AccountDatabase DatabaseOptions `yaml:"account_database"`
@@ -29,6 +36,7 @@ func (c *UserAPI) Defaults(generate bool) {
 	c.BCryptCost = bcrypt.DefaultCost
 	c.OpenIDTokenLifetimeMS = DefaultOpenIDTokenLifetimeMS
 	c.AccountDatabase.Defaults(10)
+	c.PushGateway.Defaults()
 	if generate {
 		c.AccountDatabase.ConnectionString = "file:userapi_accounts.db"
 	}
@@ -36,6 +44,7 @@ func (c *UserAPI) Defaults(generate bool) {
 
 func (c *UserAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	checkPositive(configErrs, "user_api.openid_token_lifetime_ms", c.OpenIDTokenLifetimeMS)
+	c.PushGateway.Verify(configErrs)
 	if c.Matrix.DatabaseOptions.ConnectionString == "" {
 		checkNotEmpty(configErrs, "user_api.account_database.connection_string", string(c.AccountDatabase.ConnectionString))
 	}
@@ -45,3 +54,55 @@ func (c *UserAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	checkURL(configErrs, "user_api.internal_api.listen", string(c.InternalAPI.Listen))
 	checkURL(configErrs, "user_api.internal_api.connect", string(c.InternalAPI.Connect))
 }
+
+type PushGatewayOptions struct {
+	// How many times a notification is sent to a push gateway which fails
+	// temporarily, i.e. with a 5xx status. default: 5
+	MaxAttempts int `yaml:"max_attempts"`
+
+	// How long to wait before sending a failed notification again. The
+	// backoff doubles after every attempt up to max_backoff. default: 1s
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+
+	// default: 30s
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+
+	// Send a notification for all devices of a user with the same push
+	// gateway in one request instead of one request per device. Sytest
+	// expects one request per device. default: false
+	BatchDevices bool `yaml:"batch_devices"`
+
+	// Delete a pusher once its gateway refused this many notifications in
+	// a row with a permanent error, i.e. a 4xx status. Push keys which the
+	// gateway rejects are always deleted right away. 0 never deletes pushers
+	// because of errors. default: 10
+	MaxPermanentFailures int `yaml:"max_permanent_failures"`
+
+	// The app IDs of pushers whose notifications are counted separately in the
+	// dendrite_pushgateway_notifications_total metric. Pushers are registered by
+	// clients, so all other app IDs are counted together as "other". default: []
+	MetricsAppIDs []string `yaml:"metrics_app_ids"`
+
+	// Serve a push gateway at /_dendrite/pushgateway/notify which only records
+	// the notifications it receives. GET on the same path returns them and
+	// DELETE clears them. Only meant for integration tests. default: false
+	Loopback bool `yaml:"loopback"`
+}
+
+func (c *PushGatewayOptions) Defaults() {
+	c.MaxAttempts = 5
+	c.InitialBackoff = time.Second
+	c.MaxBackoff = 30 * time.Second
+	c.BatchDevices = false
+	c.MaxPermanentFailures = 10
+	c.MetricsAppIDs = []string{}
+	c.Loopback = false
+}
+
+func (c *PushGatewayOptions) Verify(configErrs *ConfigErrors) {
+	checkNotZero(configErrs, "user_api.push_gateway.max_attempts", int64(c.MaxAttempts))
+	checkPositive(configErrs, "user_api.push_gateway.max_attempts", int64(c.MaxAttempts))
+	checkPositive(configErrs, "user_api.push_gateway.initial_backoff", int64(c.InitialBackoff))
+	checkPositive(configErrs, "user_api.push_gateway.max_backoff", int64(c.MaxBackoff))
+	checkPositive(configErrs, "user_api.push_gateway.max_permanent_failures", int64(c.MaxPermanentFailures))
+}
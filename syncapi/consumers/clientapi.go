@@ -30,6 +30,7 @@ import (
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/setup/jetstream"
 	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/dendrite/syncapi/internal"
 	"github.com/matrix-org/dendrite/syncapi/notifier"
 	"github.com/matrix-org/dendrite/syncapi/producers"
 	"github.com/matrix-org/dendrite/syncapi/storage"
@@ -47,6 +48,7 @@ type OutputClientDataConsumer struct {
 	notifier   *notifier.Notifier
 	serverName gomatrixserverlib.ServerName
 	producer   *producers.UserAPIReadProducer
+	visibility *internal.PresenceVisibility
 }
 
 // NewOutputClientDataConsumer creates a new OutputClientData consumer. Call Start() to begin consuming from room servers.
@@ -58,6 +60,7 @@ func NewOutputClientDataConsumer(
 	notifier *notifier.Notifier,
 	stream types.StreamProvider,
 	producer *producers.UserAPIReadProducer,
+	visibility *internal.PresenceVisibility,
 ) *OutputClientDataConsumer {
 	return &OutputClientDataConsumer{
 		ctx:        process.Context(),
@@ -69,6 +72,7 @@ func NewOutputClientDataConsumer(
 		stream:     stream,
 		serverName: cfg.Matrix.ServerName,
 		producer:   producer,
+		visibility: visibility,
 	}
 }
 
@@ -121,6 +125,10 @@ func (s *OutputClientDataConsumer) onMessage(ctx context.Context, msg *nats.Msg)
 		return false
 	}
 
+	if output.RoomID == "" && output.Type == types.PresencePrivacyAccountDataType {
+		s.visibility.Invalidate(userID)
+	}
+
 	if output.IgnoredUsers != nil {
 		if err := s.db.UpdateIgnoresForUser(ctx, userID, output.IgnoredUsers); err != nil {
 			log.WithError(err).WithFields(logrus.Fields{
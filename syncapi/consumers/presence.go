@@ -21,6 +21,7 @@ import (
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/setup/jetstream"
 	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/dendrite/syncapi/internal"
 	"github.com/matrix-org/dendrite/syncapi/notifier"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/types"
@@ -42,6 +43,7 @@ type PresenceConsumer struct {
 	stream        types.StreamProvider
 	notifier      *notifier.Notifier
 	deviceAPI     api.SyncUserAPI
+	visibility    *internal.PresenceVisibility
 	cfg           *config.SyncAPI
 }
 
@@ -56,6 +58,7 @@ func NewPresenceConsumer(
 	notifier *notifier.Notifier,
 	stream types.StreamProvider,
 	deviceAPI api.SyncUserAPI,
+	visibility *internal.PresenceVisibility,
 ) *PresenceConsumer {
 	return &PresenceConsumer{
 		ctx:           process.Context(),
@@ -68,6 +71,7 @@ func NewPresenceConsumer(
 		notifier:      notifier,
 		stream:        stream,
 		deviceAPI:     deviceAPI,
+		visibility:    visibility,
 		cfg:           cfg,
 	}
 }
@@ -77,10 +81,30 @@ func (s *PresenceConsumer) Start() error {
 	// Normal NATS subscription, used by Request/Reply
 	_, err := s.nats.Subscribe(s.requestTopic, func(msg *nats.Msg) {
 		userID := msg.Header.Get(jetstream.UserID)
-		presence, err := s.db.GetPresence(context.Background(), userID)
 		m := &nats.Msg{
 			Header: nats.Header{},
 		}
+		// The user whose presence is requested may not want the requester to
+		// see it, in which case they appear offline.
+		if viewerID := msg.Header.Get("viewer"); viewerID != "" {
+			visible, err := s.visibility.Visible(s.ctx, viewerID, userID)
+			if err != nil {
+				m.Header.Set("error", err.Error())
+				if err = msg.RespondMsg(m); err != nil {
+					logrus.WithError(err).Error("Unable to respond to messages")
+				}
+				return
+			}
+			if !visible {
+				m.Header.Set(jetstream.UserID, userID)
+				m.Header.Set("presence", types.PresenceOffline.String())
+				if err = msg.RespondMsg(m); err != nil {
+					logrus.WithError(err).Error("Unable to respond to messages")
+				}
+				return
+			}
+		}
+		presence, err := s.db.GetPresence(context.Background(), userID)
 		if err != nil {
 			m.Header.Set("error", err.Error())
 			if err = msg.RespondMsg(m); err != nil {
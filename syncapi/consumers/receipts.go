@@ -36,15 +36,16 @@ import (
 
 // OutputReceiptEventConsumer consumes events that originated in the EDU server.
 type OutputReceiptEventConsumer struct {
-	ctx        context.Context
-	jetstream  nats.JetStreamContext
-	durable    string
-	topic      string
-	db         storage.Database
-	stream     types.StreamProvider
-	notifier   *notifier.Notifier
-	serverName gomatrixserverlib.ServerName
-	producer   *producers.UserAPIReadProducer
+	ctx                    context.Context
+	jetstream              nats.JetStreamContext
+	durable                string
+	topic                  string
+	db                     storage.Database
+	stream                 types.StreamProvider
+	notificationDataStream types.StreamProvider
+	notifier               *notifier.Notifier
+	serverName             gomatrixserverlib.ServerName
+	producer               *producers.UserAPIReadProducer
 }
 
 // NewOutputReceiptEventConsumer creates a new OutputReceiptEventConsumer.
@@ -56,18 +57,20 @@ func NewOutputReceiptEventConsumer(
 	store storage.Database,
 	notifier *notifier.Notifier,
 	stream types.StreamProvider,
+	notificationDataStream types.StreamProvider,
 	producer *producers.UserAPIReadProducer,
 ) *OutputReceiptEventConsumer {
 	return &OutputReceiptEventConsumer{
-		ctx:        process.Context(),
-		jetstream:  js,
-		topic:      cfg.Matrix.JetStream.Prefixed(jetstream.OutputReceiptEvent),
-		durable:    cfg.Matrix.JetStream.Durable("SyncAPIReceiptConsumer"),
-		db:         store,
-		notifier:   notifier,
-		stream:     stream,
-		serverName: cfg.Matrix.ServerName,
-		producer:   producer,
+		ctx:                    process.Context(),
+		jetstream:              js,
+		topic:                  cfg.Matrix.JetStream.Prefixed(jetstream.OutputReceiptEvent),
+		durable:                cfg.Matrix.JetStream.Durable("SyncAPIReceiptConsumer"),
+		db:                     store,
+		notifier:               notifier,
+		stream:                 stream,
+		notificationDataStream: notificationDataStream,
+		serverName:             cfg.Matrix.ServerName,
+		producer:               producer,
 	}
 }
 
@@ -119,12 +122,45 @@ func (s *OutputReceiptEventConsumer) onMessage(ctx context.Context, msg *nats.Ms
 		return false
 	}
 
+	if err = s.updateUnreadCounts(ctx, output); err != nil {
+		log.WithError(err).WithFields(logrus.Fields{
+			"user_id": output.UserID,
+			"room_id": output.RoomID,
+		}).Errorf("Failed to update unread counts")
+		sentry.CaptureException(err)
+		return false
+	}
+
 	s.stream.Advance(streamPos)
 	s.notifier.OnNewReceipt(output.RoomID, types.StreamingToken{ReceiptPosition: streamPos})
 
 	return true
 }
 
+// updateUnreadCounts marks the unread counts of local users as read up to the event
+// of their read receipt.
+func (s *OutputReceiptEventConsumer) updateUnreadCounts(ctx context.Context, output types.OutputReceiptEvent) error {
+	if output.Type != "m.read" || output.EventID == "" {
+		return nil
+	}
+	_, serverName, err := gomatrixserverlib.SplitID('@', output.UserID)
+	if err != nil {
+		return fmt.Errorf("gomatrixserverlib.SplitID: %w", err)
+	}
+	if serverName != s.serverName {
+		return nil
+	}
+	pos, err := s.db.MarkUnreadCountsRead(ctx, output.UserID, output.RoomID, output.EventID)
+	if err != nil {
+		return fmt.Errorf("s.db.MarkUnreadCountsRead: %w", err)
+	}
+	if pos > 0 {
+		s.notificationDataStream.Advance(pos)
+		s.notifier.OnNewNotificationData(output.UserID, types.StreamingToken{NotificationDataPosition: pos})
+	}
+	return nil
+}
+
 func (s *OutputReceiptEventConsumer) sendReadUpdate(ctx context.Context, output types.OutputReceiptEvent) error {
 	if output.Type != "m.read" {
 		return nil
@@ -36,17 +36,18 @@ import (
 
 // OutputRoomEventConsumer consumes events that originated in the room server.
 type OutputRoomEventConsumer struct {
-	ctx          context.Context
-	cfg          *config.SyncAPI
-	rsAPI        api.SyncRoomserverAPI
-	jetstream    nats.JetStreamContext
-	durable      string
-	topic        string
-	db           storage.Database
-	pduStream    types.StreamProvider
-	inviteStream types.StreamProvider
-	notifier     *notifier.Notifier
-	producer     *producers.UserAPIStreamEventProducer
+	ctx                    context.Context
+	cfg                    *config.SyncAPI
+	rsAPI                  api.SyncRoomserverAPI
+	jetstream              nats.JetStreamContext
+	durable                string
+	topic                  string
+	db                     storage.Database
+	pduStream              types.StreamProvider
+	inviteStream           types.StreamProvider
+	notificationDataStream types.StreamProvider
+	notifier               *notifier.Notifier
+	producer               *producers.UserAPIStreamEventProducer
 }
 
 // NewOutputRoomEventConsumer creates a new OutputRoomEventConsumer. Call Start() to begin consuming from room servers.
@@ -58,21 +59,23 @@ func NewOutputRoomEventConsumer(
 	notifier *notifier.Notifier,
 	pduStream types.StreamProvider,
 	inviteStream types.StreamProvider,
+	notificationDataStream types.StreamProvider,
 	rsAPI api.SyncRoomserverAPI,
 	producer *producers.UserAPIStreamEventProducer,
 ) *OutputRoomEventConsumer {
 	return &OutputRoomEventConsumer{
-		ctx:          process.Context(),
-		cfg:          cfg,
-		jetstream:    js,
-		topic:        cfg.Matrix.JetStream.Prefixed(jetstream.OutputRoomEvent),
-		durable:      cfg.Matrix.JetStream.Durable("SyncAPIRoomServerConsumer"),
-		db:           store,
-		notifier:     notifier,
-		pduStream:    pduStream,
-		inviteStream: inviteStream,
-		rsAPI:        rsAPI,
-		producer:     producer,
+		ctx:                    process.Context(),
+		cfg:                    cfg,
+		jetstream:              js,
+		topic:                  cfg.Matrix.JetStream.Prefixed(jetstream.OutputRoomEvent),
+		durable:                cfg.Matrix.JetStream.Durable("SyncAPIRoomServerConsumer"),
+		db:                     store,
+		notifier:               notifier,
+		pduStream:              pduStream,
+		inviteStream:           inviteStream,
+		notificationDataStream: notificationDataStream,
+		rsAPI:                  rsAPI,
+		producer:               producer,
 	}
 }
 
@@ -138,7 +141,7 @@ func (s *OutputRoomEventConsumer) onMessage(ctx context.Context, msg *nats.Msg)
 func (s *OutputRoomEventConsumer) onRedactEvent(
 	ctx context.Context, msg api.OutputRedactedEvent,
 ) error {
-	err := s.db.RedactEvent(ctx, msg.RedactedEventID, msg.RedactedBecause)
+	err := s.db.RedactEvent(ctx, msg.RedactedEventID, msg.RedactedBecause, s.cfg.EventHistory.Enabled)
 	if err != nil {
 		log.WithError(err).Error("RedactEvent error'd")
 		return err
@@ -254,6 +257,12 @@ func (s *OutputRoomEventConsumer) onNewRoomEvent(
 		return nil
 	}
 
+	if err = s.updateUnreadCounts(ctx, ev, pduPos); err != nil {
+		log.WithError(err).Errorf("Failed to update unread counts for event %s", ev.EventID())
+		sentry.CaptureException(err)
+		return err
+	}
+
 	if err = s.producer.SendStreamEvent(ev.RoomID(), ev, pduPos); err != nil {
 		log.WithError(err).Errorf("Failed to send stream output event for event %s", ev.EventID())
 		sentry.CaptureException(err)
@@ -314,6 +323,35 @@ func (s *OutputRoomEventConsumer) onOldRoomEvent(
 	return nil
 }
 
+// updateUnreadCounts counts the new event as unread for the local users in the room.
+func (s *OutputRoomEventConsumer) updateUnreadCounts(ctx context.Context, ev *gomatrixserverlib.HeaderedEvent, pduPos types.StreamPosition) error {
+	joined, err := s.db.AllJoinedUsersInRoom(ctx, []string{ev.RoomID()})
+	if err != nil {
+		return fmt.Errorf("s.db.AllJoinedUsersInRoom: %w", err)
+	}
+	var localUsers []string
+	for _, userID := range joined[ev.RoomID()] {
+		if _, domain, err := gomatrixserverlib.SplitID('@', userID); err == nil && domain == s.cfg.Matrix.ServerName {
+			localUsers = append(localUsers, userID)
+		}
+	}
+	if len(localUsers) == 0 {
+		return nil
+	}
+	pos, err := s.db.UpdateUnreadCountsForEvent(ctx, ev, pduPos, localUsers)
+	if err != nil {
+		return fmt.Errorf("s.db.UpdateUnreadCountsForEvent: %w", err)
+	}
+	if pos == 0 {
+		return nil
+	}
+	s.notificationDataStream.Advance(pos)
+	for _, userID := range localUsers {
+		s.notifier.OnNewNotificationData(userID, types.StreamingToken{NotificationDataPosition: pos})
+	}
+	return nil
+}
+
 func (s *OutputRoomEventConsumer) notifyJoinedPeeks(ctx context.Context, ev *gomatrixserverlib.HeaderedEvent, sp types.StreamPosition) (types.StreamPosition, error) {
 	if ev.Type() != gomatrixserverlib.MRoomMember {
 		return sp, nil
@@ -0,0 +1,108 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+)
+
+// OutputRoomEventSearchConsumer indexes the bodies of messages from the room server
+// output log for /search. It has a durable of its own, so it catches up on the
+// messages still in the stream when search is first enabled, and indexing never
+// holds up /sync.
+type OutputRoomEventSearchConsumer struct {
+	ctx       context.Context
+	jetstream nats.JetStreamContext
+	durable   string
+	topic     string
+	db        storage.Database
+}
+
+// NewOutputRoomEventSearchConsumer creates a new OutputRoomEventSearchConsumer.
+// Call Start() to begin consuming from room servers.
+func NewOutputRoomEventSearchConsumer(
+	process *process.ProcessContext,
+	cfg *config.SyncAPI,
+	js nats.JetStreamContext,
+	store storage.Database,
+) *OutputRoomEventSearchConsumer {
+	return &OutputRoomEventSearchConsumer{
+		ctx:       process.Context(),
+		jetstream: js,
+		topic:     cfg.Matrix.JetStream.Prefixed(jetstream.OutputRoomEvent),
+		durable:   cfg.Matrix.JetStream.Durable("SyncAPISearchConsumer"),
+		db:        store,
+	}
+}
+
+// Start consuming from room servers
+func (s *OutputRoomEventSearchConsumer) Start() error {
+	return jetstream.JetStreamConsumer(
+		s.ctx, s.jetstream, s.topic, s.durable, s.onMessage,
+		nats.DeliverAll(), nats.ManualAck(),
+	)
+}
+
+func (s *OutputRoomEventSearchConsumer) onMessage(ctx context.Context, msg *nats.Msg) bool {
+	var output api.OutputEvent
+	if err := json.Unmarshal(msg.Data, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("roomserver output log: message parse failure")
+		return true
+	}
+
+	var err error
+	switch output.Type {
+	case api.OutputTypeNewRoomEvent:
+		err = s.indexEvent(ctx, output.NewRoomEvent.Event, output.NewRoomEvent.HistoryVisibility)
+	case api.OutputTypeOldRoomEvent:
+		err = s.indexEvent(ctx, output.OldRoomEvent.Event, output.OldRoomEvent.HistoryVisibility)
+	case api.OutputTypeRedactedEvent:
+		err = s.db.RemoveEventFromSearch(ctx, output.RedactedEvent.RedactedEventID)
+	}
+	if err != nil {
+		log.WithError(err).Error("roomserver output log: failed to index event for search")
+		sentry.CaptureException(err)
+		return false
+	}
+	return true
+}
+
+// indexEvent adds the body of a message to the index, other events are ignored.
+func (s *OutputRoomEventSearchConsumer) indexEvent(
+	ctx context.Context, ev *gomatrixserverlib.HeaderedEvent, historyVisibility gomatrixserverlib.HistoryVisibility,
+) error {
+	if ev == nil || ev.Type() != "m.room.message" || ev.StateKey() != nil {
+		return nil
+	}
+	body := gjson.GetBytes(ev.Content(), "body")
+	if body.Type != gjson.String || strings.TrimSpace(body.Str) == "" {
+		return nil
+	}
+	return s.db.IndexEventForSearch(ctx, ev, historyVisibility, body.Str)
+}
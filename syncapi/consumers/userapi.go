@@ -97,6 +97,22 @@ func (s *OutputNotificationDataConsumer) onMessage(ctx context.Context, msg *nat
 		return false
 	}
 
+	// If the user was notified about an event, count it in its thread too.
+	if data.EventID != "" {
+		pos, err := s.db.UpdateUnreadNotificationCountsForEvent(ctx, userID, data.EventID, data.Highlight)
+		if err != nil {
+			sentry.CaptureException(err)
+			log.WithFields(log.Fields{
+				"user_id":  userID,
+				"event_id": data.EventID,
+			}).WithError(err).Error("Could not save thread notification counts")
+			return false
+		}
+		if pos > streamPos {
+			streamPos = pos
+		}
+	}
+
 	s.stream.Advance(streamPos)
 	s.notifier.OnNewNotificationData(userID, types.StreamingToken{NotificationDataPosition: streamPos})
 
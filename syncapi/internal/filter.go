@@ -0,0 +1,168 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+// The storage layer applies filters in SQL wherever it can. The functions here
+// cover the remaining cases, for data which doesn't come out of a table the filter
+// can be pushed into (e.g. typing notifications) and for the event_fields projection.
+
+// matchesPattern returns whether the value matches a filter pattern, in
+// which a "*" matches any sequence of characters.
+func matchesPattern(pattern, value string) bool {
+	if !strings.Contains(pattern, "*") {
+		return pattern == value
+	}
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(value, parts[0]) {
+		return false
+	}
+	value = value[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(value, part)
+		if i < 0 {
+			return false
+		}
+		value = value[i+len(part):]
+	}
+	return strings.HasSuffix(value, parts[len(parts)-1])
+}
+
+// allowed applies an include and an exclude list to the value. A nil include list
+// allows everything, and exclusions always take precedence over inclusions.
+func allowed(include, exclude *[]string, value string, wildcards bool) bool {
+	matches := func(list []string) bool {
+		for _, pattern := range list {
+			if (wildcards && matchesPattern(pattern, value)) || pattern == value {
+				return true
+			}
+		}
+		return false
+	}
+	if exclude != nil && matches(*exclude) {
+		return false
+	}
+	return include == nil || matches(*include)
+}
+
+// RoomAllowed returns whether the room passes the rooms and not_rooms of a filter.
+func RoomAllowed(rooms, notRooms *[]string, roomID string) bool {
+	return allowed(rooms, notRooms, roomID, false)
+}
+
+// TypeAllowed returns whether the event type passes the types and not_types of a filter.
+func TypeAllowed(evTypes, notTypes *[]string, evType string) bool {
+	return allowed(evTypes, notTypes, evType, true)
+}
+
+// SenderAllowed returns whether the sender passes the senders and not_senders of a filter.
+func SenderAllowed(senders, notSenders *[]string, sender string) bool {
+	return allowed(senders, notSenders, sender, false)
+}
+
+// EventAllowed returns whether an event passes a filter for events which aren't
+// tied to a room, i.e. presence and global account data.
+func EventAllowed(filter *gomatrixserverlib.EventFilter, sender, evType string) bool {
+	return SenderAllowed(filter.Senders, filter.NotSenders, sender) &&
+		TypeAllowed(filter.Types, filter.NotTypes, evType)
+}
+
+// RoomEventAllowed returns whether an event in the given room passes a room event filter.
+func RoomEventAllowed(filter *gomatrixserverlib.RoomEventFilter, roomID string, ev *gomatrixserverlib.ClientEvent) bool {
+	if !RoomAllowed(filter.Rooms, filter.NotRooms, roomID) {
+		return false
+	}
+	if !SenderAllowed(filter.Senders, filter.NotSenders, ev.Sender) || !TypeAllowed(filter.Types, filter.NotTypes, ev.Type) {
+		return false
+	}
+	if filter.ContainsURL != nil {
+		hasURL := gjson.GetBytes(ev.Content, "url").Type == gjson.String
+		if hasURL != *filter.ContainsURL {
+			return false
+		}
+	}
+	return true
+}
+
+// ApplyEventFields reduces the event to the fields listed in event_fields. Fields are
+// dot-separated paths, in which a literal dot is escaped with a backslash. Nothing is
+// removed when no fields are given.
+func ApplyEventFields(fields []string, ev gomatrixserverlib.ClientEvent) gomatrixserverlib.ClientEvent {
+	if len(fields) == 0 {
+		return ev
+	}
+	raw, err := json.Marshal(ev)
+	if err != nil {
+		return ev
+	}
+	projected := []byte("{}")
+	for _, field := range fields {
+		value := gjson.GetBytes(raw, field)
+		if !value.Exists() {
+			continue
+		}
+		if projected, err = sjson.SetRawBytes(projected, field, []byte(value.Raw)); err != nil {
+			return ev
+		}
+	}
+	var res gomatrixserverlib.ClientEvent
+	if err = json.Unmarshal(projected, &res); err != nil {
+		return ev
+	}
+	if len(res.Content) == 0 {
+		res.Content = gomatrixserverlib.RawJSON("{}")
+	}
+	return res
+}
+
+// ApplyEventFieldsToResponse applies the event_fields projection to every
+// event in the sync response.
+func ApplyEventFieldsToResponse(fields []string, res *types.Response) {
+	if len(fields) == 0 {
+		return
+	}
+	project := func(events []gomatrixserverlib.ClientEvent) []gomatrixserverlib.ClientEvent {
+		for i := range events {
+			events[i] = ApplyEventFields(fields, events[i])
+		}
+		return events
+	}
+	res.AccountData.Events = project(res.AccountData.Events)
+	res.Presence.Events = project(res.Presence.Events)
+	for _, rooms := range []map[string]types.JoinResponse{res.Rooms.Join, res.Rooms.Peek} {
+		for roomID, jr := range rooms {
+			jr.State.Events = project(jr.State.Events)
+			jr.Timeline.Events = project(jr.Timeline.Events)
+			jr.Ephemeral.Events = project(jr.Ephemeral.Events)
+			jr.AccountData.Events = project(jr.AccountData.Events)
+			rooms[roomID] = jr
+		}
+	}
+	for roomID, lr := range res.Rooms.Leave {
+		lr.State.Events = project(lr.State.Events)
+		lr.Timeline.Events = project(lr.Timeline.Events)
+		res.Rooms.Leave[roomID] = lr
+	}
+}
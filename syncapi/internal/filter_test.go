@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func strs(s ...string) *[]string {
+	return &s
+}
+
+func TestRoomEventAllowed(t *testing.T) {
+	yes, no := true, false
+	ev := &gomatrixserverlib.ClientEvent{
+		Sender:  "@alice:localhost",
+		Type:    "m.room.message",
+		Content: gomatrixserverlib.RawJSON(`{"msgtype":"m.image","url":"mxc://localhost/abc"}`),
+	}
+	roomID := "!room:localhost"
+	testCases := []struct {
+		name   string
+		filter gomatrixserverlib.RoomEventFilter
+		want   bool
+	}{
+		{name: "empty filter", want: true},
+		{name: "senders includes", filter: gomatrixserverlib.RoomEventFilter{Senders: strs("@alice:localhost")}, want: true},
+		{name: "senders excludes", filter: gomatrixserverlib.RoomEventFilter{Senders: strs("@bob:localhost")}, want: false},
+		{name: "empty senders", filter: gomatrixserverlib.RoomEventFilter{Senders: strs()}, want: false},
+		{name: "not_senders", filter: gomatrixserverlib.RoomEventFilter{NotSenders: strs("@alice:localhost")}, want: false},
+		{name: "not_senders wins", filter: gomatrixserverlib.RoomEventFilter{Senders: strs("@alice:localhost"), NotSenders: strs("@alice:localhost")}, want: false},
+		{name: "senders are not wildcards", filter: gomatrixserverlib.RoomEventFilter{Senders: strs("@alice:*")}, want: false},
+		{name: "types includes", filter: gomatrixserverlib.RoomEventFilter{Types: strs("m.room.message")}, want: true},
+		{name: "types excludes", filter: gomatrixserverlib.RoomEventFilter{Types: strs("m.room.member")}, want: false},
+		{name: "types wildcard", filter: gomatrixserverlib.RoomEventFilter{Types: strs("m.room.*")}, want: true},
+		{name: "types wildcard in middle", filter: gomatrixserverlib.RoomEventFilter{Types: strs("m.*.message")}, want: true},
+		{name: "types wildcard mismatch", filter: gomatrixserverlib.RoomEventFilter{Types: strs("m.call.*")}, want: false},
+		{name: "not_types", filter: gomatrixserverlib.RoomEventFilter{NotTypes: strs("m.room.message")}, want: false},
+		{name: "not_types wildcard", filter: gomatrixserverlib.RoomEventFilter{NotTypes: strs("*")}, want: false},
+		{name: "not_types wins", filter: gomatrixserverlib.RoomEventFilter{Types: strs("m.*"), NotTypes: strs("m.room.*")}, want: false},
+		{name: "rooms includes", filter: gomatrixserverlib.RoomEventFilter{Rooms: strs(roomID)}, want: true},
+		{name: "rooms excludes", filter: gomatrixserverlib.RoomEventFilter{Rooms: strs("!other:localhost")}, want: false},
+		{name: "not_rooms", filter: gomatrixserverlib.RoomEventFilter{NotRooms: strs(roomID)}, want: false},
+		{name: "contains_url true", filter: gomatrixserverlib.RoomEventFilter{ContainsURL: &yes}, want: true},
+		{name: "contains_url false", filter: gomatrixserverlib.RoomEventFilter{ContainsURL: &no}, want: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := RoomEventAllowed(&tc.filter, roomID, ev); got != tc.want {
+				t.Fatalf("RoomEventAllowed: got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRoomEventAllowedContainsURL(t *testing.T) {
+	no := false
+	filter := gomatrixserverlib.RoomEventFilter{ContainsURL: &no}
+	for content, want := range map[string]bool{
+		`{"body":"hello"}`:  true,
+		`{"url":{}}`:        true,
+		`{"url":"mxc://a"}`: false,
+	} {
+		ev := &gomatrixserverlib.ClientEvent{Type: "m.room.message", Content: gomatrixserverlib.RawJSON(content)}
+		if got := RoomEventAllowed(&filter, "!room:localhost", ev); got != want {
+			t.Errorf("RoomEventAllowed(%s): got %v, want %v", content, got, want)
+		}
+	}
+}
+
+func TestEventAllowed(t *testing.T) {
+	filter := gomatrixserverlib.EventFilter{
+		Senders:  strs("@alice:localhost", "@bob:localhost"),
+		NotTypes: strs("m.presence"),
+	}
+	testCases := []struct {
+		sender, evType string
+		want           bool
+	}{
+		{"@alice:localhost", "m.push_rules", true},
+		{"@charlie:localhost", "m.push_rules", false},
+		{"@bob:localhost", "m.presence", false},
+	}
+	for _, tc := range testCases {
+		if got := EventAllowed(&filter, tc.sender, tc.evType); got != tc.want {
+			t.Errorf("EventAllowed(%s, %s): got %v, want %v", tc.sender, tc.evType, got, tc.want)
+		}
+	}
+}
+
+func TestApplyEventFields(t *testing.T) {
+	ev := gomatrixserverlib.ClientEvent{
+		EventID: "$event",
+		Sender:  "@alice:localhost",
+		Type:    "m.room.message",
+		Content: gomatrixserverlib.RawJSON(`{"body":"hello","msgtype":"m.text","m.relates_to":{"rel_type":"m.thread"}}`),
+	}
+	testCases := []struct {
+		name   string
+		fields []string
+		want   string
+	}{
+		{
+			name:   "no fields",
+			fields: nil,
+			want:   `{"body":"hello","msgtype":"m.text","m.relates_to":{"rel_type":"m.thread"}}`,
+		},
+		{
+			name:   "top-level fields",
+			fields: []string{"type", "sender"},
+			want:   `{}`,
+		},
+		{
+			name:   "nested field",
+			fields: []string{"content.body"},
+			want:   `{"body":"hello"}`,
+		},
+		{
+			name:   "escaped dot",
+			fields: []string{`content.m\.relates_to.rel_type`},
+			want:   `{"m.relates_to":{"rel_type":"m.thread"}}`,
+		},
+		{
+			name:   "missing field",
+			fields: []string{"content.nope"},
+			want:   `{}`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := ApplyEventFields(tc.fields, ev)
+			var gotContent, wantContent interface{}
+			if err := json.Unmarshal(got.Content, &gotContent); err != nil {
+				t.Fatalf("failed to unmarshal content: %s", err)
+			}
+			if err := json.Unmarshal([]byte(tc.want), &wantContent); err != nil {
+				t.Fatalf("failed to unmarshal expected content: %s", err)
+			}
+			if !reflect.DeepEqual(gotContent, wantContent) {
+				t.Fatalf("content: got %s, want %s", got.Content, tc.want)
+			}
+		})
+	}
+
+	got := ApplyEventFields([]string{"type", "sender"}, ev)
+	if got.Type != ev.Type || got.Sender != ev.Sender || got.EventID != "" {
+		t.Fatalf("unexpected projection: %+v", got)
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// presenceVisibilityCacheTime is how long the privacy setting of a user is cached.
+const presenceVisibilityCacheTime = time.Minute
+
+// PresenceVisibility decides whose presence users may see, according to the
+// presence privacy settings of local users. The settings are needed for every
+// presence update in every sync, so they are cached for a short time. The
+// contacts of users are not cached: the user API changes address books
+// without telling the sync API, and a removed contact must stop seeing the
+// presence of the user right away.
+type PresenceVisibility struct {
+	userAPI    userapi.SyncUserAPI
+	serverName gomatrixserverlib.ServerName
+	cache      sync.Map // user ID -> *presencePrivacy
+}
+
+type presencePrivacy struct {
+	privacy types.PresencePrivacy
+	expires time.Time
+}
+
+func NewPresenceVisibility(userAPI userapi.SyncUserAPI, serverName gomatrixserverlib.ServerName) *PresenceVisibility {
+	return &PresenceVisibility{
+		userAPI:    userAPI,
+		serverName: serverName,
+	}
+}
+
+// Visible returns whether the viewer may see the presence of the user. Users
+// can always see their own presence. The presence of remote users is already
+// restricted by their servers, so it is always visible.
+func (v *PresenceVisibility) Visible(ctx context.Context, viewerID, userID string) (bool, error) {
+	if viewerID == userID {
+		return true, nil
+	}
+	localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return false, err
+	}
+	if domain != v.serverName {
+		return true, nil
+	}
+	p, err := v.privacy(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	switch p.privacy {
+	case types.PresencePrivacyNobody:
+		return false, nil
+	case types.PresencePrivacyContacts:
+		viewerLocalpart, viewerDomain, err := gomatrixserverlib.SplitID('@', viewerID)
+		if err != nil || viewerDomain != v.serverName {
+			return false, err
+		}
+		return v.isContact(ctx, localpart, viewerLocalpart)
+	default:
+		return true, nil
+	}
+}
+
+// Privacy returns the presence privacy setting of a local user.
+func (v *PresenceVisibility) Privacy(ctx context.Context, userID string) (types.PresencePrivacy, error) {
+	p, err := v.privacy(ctx, userID)
+	if err != nil {
+		return types.PresencePrivacyEveryone, err
+	}
+	return p.privacy, nil
+}
+
+// Invalidate forgets the cached privacy setting of the user, i.e. because it changed.
+func (v *PresenceVisibility) Invalidate(userID string) {
+	v.cache.Delete(userID)
+}
+
+func (v *PresenceVisibility) privacy(ctx context.Context, userID string) (*presencePrivacy, error) {
+	if cached, ok := v.cache.Load(userID); ok {
+		if p := cached.(*presencePrivacy); time.Now().Before(p.expires) {
+			return p, nil
+		}
+	}
+
+	var res userapi.QueryAccountDataResponse
+	if err := v.userAPI.QueryAccountData(ctx, &userapi.QueryAccountDataRequest{
+		UserID:   userID,
+		DataType: types.PresencePrivacyAccountDataType,
+	}, &res); err != nil {
+		return nil, err
+	}
+	p := &presencePrivacy{
+		privacy: types.PresencePrivacyFromAccountData(res.GlobalAccountData[types.PresencePrivacyAccountDataType]),
+		expires: time.Now().Add(presenceVisibilityCacheTime),
+	}
+	v.cache.Store(userID, p)
+	return p, nil
+}
+
+// isContact returns whether the contact is in the address book of the local user.
+func (v *PresenceVisibility) isContact(ctx context.Context, localpart, contactLocalpart string) (bool, error) {
+	info, err := v.userAPI.SelectChainData(ctx, localpart)
+	if err != nil || info == nil {
+		return false, err
+	}
+	for _, contact := range info.AddressBook {
+		if contact == contactLocalpart {
+			return true, nil
+		}
+	}
+	return false, nil
+}
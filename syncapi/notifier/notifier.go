@@ -185,7 +185,9 @@ func (n *Notifier) OnNewSendToDevice(
 	n._wakeupUserDevice(userID, deviceIDs, n.currPos)
 }
 
-// OnNewReceipt updates the current position
+// OnNewTyping updates the current position and queues the room on the
+// device streams of its joined users, so that their sync requests only need
+// to look at the ephemeral events of that room.
 func (n *Notifier) OnNewTyping(
 	roomID string,
 	posUpdate types.StreamingToken,
@@ -194,10 +196,11 @@ func (n *Notifier) OnNewTyping(
 	defer n.lock.Unlock()
 
 	n.currPos.ApplyUpdates(posUpdate)
-	n._wakeupUsers(n._joinedUsers(roomID), nil, n.currPos)
+	n._wakeupUsersEphemeral(n._joinedUsers(roomID), roomID, n.currPos)
 }
 
-// OnNewReceipt updates the current position
+// OnNewReceipt updates the current position and queues the room on the
+// device streams of its joined users, like OnNewTyping.
 func (n *Notifier) OnNewReceipt(
 	roomID string,
 	posUpdate types.StreamingToken,
@@ -206,7 +209,7 @@ func (n *Notifier) OnNewReceipt(
 	defer n.lock.Unlock()
 
 	n.currPos.ApplyUpdates(posUpdate)
-	n._wakeupUsers(n._joinedUsers(roomID), nil, n.currPos)
+	n._wakeupUsersEphemeral(n._joinedUsers(roomID), roomID, n.currPos)
 }
 
 func (n *Notifier) OnNewKeyChange(
@@ -406,6 +409,17 @@ func (n *Notifier) _wakeupUsers(userIDs []string, peekingDevices []types.Peeking
 	}
 }
 
+// _wakeupUsersEphemeral will wake up the sync streams for all of the devices for all
+// of the specified user IDs, queueing the room as only having new ephemeral events.
+// Unlike _wakeupUsers, this doesn't allocate and never creates streams.
+func (n *Notifier) _wakeupUsersEphemeral(userIDs []string, roomID string, newPos types.StreamingToken) {
+	for _, userID := range userIDs {
+		for _, stream := range n.userDeviceStreams[userID] {
+			stream.BroadcastEphemeral(newPos, roomID) // wake up all goroutines Wait()ing on this stream
+		}
+	}
+}
+
 // _wakeupUserDevice will wake up the sync stream for a specific user device. Other
 // device streams will be left alone.
 // nolint:unused
@@ -333,6 +333,81 @@ func TestNewEventAndWasPreviouslyJoinedToRoom(t *testing.T) {
 	time.Sleep(1 * time.Millisecond)
 }
 
+// Test that typing notifications and receipts are queued per room, until
+// there is another update for the device.
+func TestEphemeralWakeup(t *testing.T) {
+	n := NewNotifier()
+	n.SetCurrentPosition(syncPositionBefore)
+	n.setUsersJoinedToRooms(map[string][]string{
+		roomID: {alice, bob},
+	})
+
+	listener := n.GetListener(newTestSyncRequest(bob, bobDev, syncPositionBefore))
+	defer listener.Close()
+
+	n.OnNewTyping(roomID, types.StreamingToken{TypingPosition: 1})
+	roomIDs, ok := listener.GetEphemeralRooms(syncPositionBefore)
+	if !ok || len(roomIDs) != 1 || roomIDs[0] != roomID {
+		t.Fatalf("TestEphemeralWakeup want [%s], got %v (ok=%v)", roomID, roomIDs, ok)
+	}
+	// A sync request that already has the typing notification has nothing to sync
+	if _, ok = listener.GetEphemeralRooms(n.CurrentPosition()); ok {
+		t.Fatalf("TestEphemeralWakeup want no rooms after the typing position")
+	}
+
+	// Any other update means all streams have to be synced
+	n.OnNewEvent(&randomMessageEvent, "", nil, syncPositionAfter)
+	if _, ok = listener.GetEphemeralRooms(syncPositionBefore); ok {
+		t.Fatalf("TestEphemeralWakeup want no rooms after a new event")
+	}
+
+	since := n.CurrentPosition()
+	n.OnNewReceipt(roomID, types.StreamingToken{ReceiptPosition: 1})
+	roomIDs, ok = listener.GetEphemeralRooms(since)
+	if !ok || len(roomIDs) != 1 || roomIDs[0] != roomID {
+		t.Fatalf("TestEphemeralWakeup want [%s], got %v (ok=%v)", roomID, roomIDs, ok)
+	}
+	mustEqualPositions(t, listener.GetSyncPosition(), n.CurrentPosition())
+}
+
+// newBenchmarkNotifier returns a notifier with a room of the given number of
+// members, each of which has a device waiting for updates.
+func newBenchmarkNotifier(b *testing.B, members int) *Notifier {
+	n := NewNotifier()
+	n.SetCurrentPosition(syncPositionBefore)
+	userIDs := make([]string, 0, members)
+	for i := 0; i < members; i++ {
+		userID := fmt.Sprintf("@user%d:localhost", i)
+		userIDs = append(userIDs, userID)
+		listener := n.GetListener(newTestSyncRequest(userID, "device", syncPositionBefore))
+		b.Cleanup(listener.Close)
+	}
+	n.setUsersJoinedToRooms(map[string][]string{
+		roomID: userIDs,
+	})
+	return n
+}
+
+// BenchmarkOnNewRoomEvent600Members wakes up every member for all streams,
+// which is what typing notifications used to do.
+func BenchmarkOnNewRoomEvent600Members(b *testing.B) {
+	n := newBenchmarkNotifier(b, 600)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n.OnNewEvent(nil, roomID, nil, types.StreamingToken{PDUPosition: syncPositionBefore.PDUPosition + types.StreamPosition(i)})
+	}
+}
+
+func BenchmarkOnNewTyping600Members(b *testing.B) {
+	n := newBenchmarkNotifier(b, 600)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n.OnNewTyping(roomID, types.StreamingToken{TypingPosition: types.StreamPosition(i)})
+	}
+}
+
 func waitForEvents(n *Notifier, req types.SyncRequest) (types.StreamingToken, error) {
 	listener := n.GetListener(req)
 	defer listener.Close()
@@ -36,6 +36,12 @@ type UserDeviceStream struct {
 	signalChannel chan struct{}
 	// The last sync position that there may have been an update for the user
 	pos types.StreamingToken
+	// The last sync position that there may have been an update other than
+	// typing notifications or receipts for the user
+	fullPos types.StreamingToken
+	// A map of room ID => sync position of the rooms that only had typing
+	// notifications or receipts since fullPos
+	ephemeralRooms map[string]types.StreamingToken
 	// The last time when we had some listeners waiting
 	timeOfLastChannel time.Time
 	// The number of listeners waiting
@@ -57,6 +63,8 @@ func NewUserDeviceStream(userID, deviceID string, currPos types.StreamingToken)
 		DeviceID:          deviceID,
 		timeOfLastChannel: time.Now(),
 		pos:               currPos,
+		fullPos:           currPos,
+		ephemeralRooms:    make(map[string]types.StreamingToken),
 		signalChannel:     make(chan struct{}),
 	}
 }
@@ -90,6 +98,26 @@ func (s *UserDeviceStream) Broadcast(pos types.StreamingToken) {
 	defer s.lock.Unlock()
 
 	s.pos = pos
+	s.fullPos = pos
+	// Sync requests from before this position sync all streams anyway, so
+	// the queued rooms are only needed for updates after it.
+	for roomID := range s.ephemeralRooms {
+		delete(s.ephemeralRooms, roomID)
+	}
+
+	close(s.signalChannel)
+
+	s.signalChannel = make(chan struct{})
+}
+
+// BroadcastEphemeral broadcasts a new sync position for this user that only
+// has new typing notifications or receipts in the given room.
+func (s *UserDeviceStream) BroadcastEphemeral(pos types.StreamingToken, roomID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.pos = pos
+	s.ephemeralRooms[roomID] = pos
 
 	close(s.signalChannel)
 
@@ -154,6 +182,28 @@ func (s *UserDeviceStreamListener) GetNotifyChannel(sincePos types.StreamingToke
 	return s.userStream.signalChannel
 }
 
+// GetEphemeralRooms returns the rooms with new typing notifications or receipts
+// after sincePos. If there may have been any other updates for the user after
+// sincePos, ok is false and the sync request has to look at all streams.
+func (s *UserDeviceStreamListener) GetEphemeralRooms(sincePos types.StreamingToken) (roomIDs []string, ok bool) {
+	s.userStream.lock.Lock()
+	defer s.userStream.lock.Unlock()
+
+	fullPos := s.userStream.fullPos
+	fullPos.TypingPosition = sincePos.TypingPosition
+	fullPos.ReceiptPosition = sincePos.ReceiptPosition
+	if fullPos.IsAfter(sincePos) {
+		return nil, false
+	}
+
+	for roomID, pos := range s.userStream.ephemeralRooms {
+		if pos.TypingPosition > sincePos.TypingPosition || pos.ReceiptPosition > sincePos.ReceiptPosition {
+			roomIDs = append(roomIDs, roomID)
+		}
+	}
+	return roomIDs, len(roomIDs) > 0
+}
+
 // Close cleans up resources used
 func (s *UserDeviceStreamListener) Close() {
 	s.userStream.lock.Lock()
@@ -15,10 +15,12 @@
 package producers
 
 import (
+	"context"
 	"strconv"
 	"time"
 
 	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/syncapi/internal"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/nats-io/nats.go"
@@ -28,6 +30,8 @@ import (
 type FederationAPIPresenceProducer struct {
 	Topic     string
 	JetStream nats.JetStreamContext
+	// Visibility tells the federation API whether the presence may be sent to other servers
+	Visibility *internal.PresenceVisibility
 }
 
 func (f *FederationAPIPresenceProducer) SendPresence(
@@ -42,6 +46,13 @@ func (f *FederationAPIPresenceProducer) SendPresence(
 	if statusMsg != nil {
 		msg.Header.Set("status_msg", *statusMsg)
 	}
+	if f.Visibility != nil {
+		privacy, err := f.Visibility.Privacy(context.Background(), userID)
+		if err != nil {
+			return err
+		}
+		msg.Header.Set("privacy", privacy.String())
+	}
 
 	_, err := f.JetStream.PublishMsg(msg)
 	return err
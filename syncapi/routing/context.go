@@ -137,6 +137,12 @@ func Context(
 		return jsonerror.InternalServerError()
 	}
 
+	bundled := append([]*gomatrixserverlib.HeaderedEvent{&requestedEvent}, eventsBefore...)
+	if err = syncDB.BundleAggregations(ctx, device.UserID, append(bundled, eventsAfter...)); err != nil {
+		logrus.WithError(err).Error("unable to bundle aggregations")
+		return jsonerror.InternalServerError()
+	}
+
 	eventsBeforeClient := gomatrixserverlib.HeaderedToClientEvents(eventsBefore, gomatrixserverlib.FormatAll)
 	eventsAfterClient := gomatrixserverlib.HeaderedToClientEvents(eventsAfter, gomatrixserverlib.FormatAll)
 	newState := applyLazyLoadMembers(device, filter, eventsAfterClient, eventsBeforeClient, state, lazyLoadCache)
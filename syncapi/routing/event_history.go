@@ -0,0 +1,278 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	roomserver "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// eventHistoryMaxEdits is the highest number of edits of an event which are returned
+	eventHistoryMaxEdits = 100
+	// How often the original versions of redacted events past the retention period are removed
+	redactedEventsPurgeInterval = time.Hour
+
+	defaultEventHistoryAuditLimit = 100
+	maxEventHistoryAuditLimit     = 1000
+)
+
+type eventHistoryRedaction struct {
+	RedactedBy string                      `json:"redacted_by"`
+	Redacter   string                      `json:"redacter"`
+	RedactedTS gomatrixserverlib.Timestamp `json:"redacted_ts"`
+}
+
+type eventHistoryEntry struct {
+	Event     gomatrixserverlib.ClientEvent `json:"event"`
+	Redaction *eventHistoryRedaction        `json:"redaction,omitempty"`
+}
+
+type eventHistoryResponse struct {
+	// The event as clients see it now
+	Event gomatrixserverlib.ClientEvent `json:"event"`
+	// The original version of the event, if it was redacted within the retention period
+	Original *eventHistoryEntry `json:"original,omitempty"`
+	// The edits of the event, including redacted ones within the retention period, oldest first
+	Edits []eventHistoryEntry `json:"edits"`
+}
+
+type eventHistoryAuditEntry struct {
+	UserID    string                      `json:"user_id"`
+	EventID   string                      `json:"event_id"`
+	Timestamp gomatrixserverlib.Timestamp `json:"ts"`
+}
+
+type eventHistoryAuditResponse struct {
+	Entries []eventHistoryAuditEntry `json:"entries"`
+}
+
+// EventHistory implements GET /unstable/org.matrix.dendrite.event_history/rooms/{roomId}/history/{eventId}
+// Returns the edits of the event and, if it was redacted, its original version to room moderators.
+// Every request is recorded in the history audit log of the room.
+func EventHistory(
+	req *http.Request, device *userapi.Device,
+	syncDB storage.Database, rsAPI roomserver.SyncRoomserverAPI, cfg *config.SyncAPI,
+	roomID, eventID string,
+) util.JSONResponse {
+	ctx := req.Context()
+	if resErr := checkEventHistoryAllowed(ctx, syncDB, rsAPI, cfg, roomID, device.UserID); resErr != nil {
+		return *resErr
+	}
+	events, err := syncDB.Events(ctx, []string{eventID})
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("failed to get event")
+		return jsonerror.InternalServerError()
+	}
+	if len(events) == 0 || events[0].RoomID() != roomID {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Event not found"),
+		}
+	}
+
+	res := eventHistoryResponse{
+		Event: gomatrixserverlib.HeaderedToClientEvent(events[0], gomatrixserverlib.FormatAll),
+		Edits: []eventHistoryEntry{},
+	}
+	// Original versions which are past the retention period but not yet purged are left out.
+	keptSince := gomatrixserverlib.AsTimestamp(time.Now().Add(-cfg.EventHistory.RedactedRetention))
+	original, err := syncDB.RedactedEvent(ctx, eventID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("failed to get redacted event")
+		return jsonerror.InternalServerError()
+	}
+	if original != nil && original.RedactedTS >= keptSince {
+		res.Original = redactedHistoryEntry(original)
+	}
+
+	edits, _, err := syncDB.RelationsFor(ctx, roomID, eventID, "m.replace", "", 0, 0, false, eventHistoryMaxEdits)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("failed to get edits")
+		return jsonerror.InternalServerError()
+	}
+	for _, edit := range syncDB.StreamEventsToEvents(device, edits) {
+		res.Edits = append(res.Edits, eventHistoryEntry{
+			Event: gomatrixserverlib.HeaderedToClientEvent(edit, gomatrixserverlib.FormatAll),
+		})
+	}
+	redactedEdits, err := syncDB.RedactedEditsFor(ctx, roomID, eventID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("failed to get redacted edits")
+		return jsonerror.InternalServerError()
+	}
+	for _, edit := range redactedEdits {
+		if edit.RedactedTS >= keptSince {
+			res.Edits = append(res.Edits, *redactedHistoryEntry(edit))
+		}
+	}
+	sort.SliceStable(res.Edits, func(i, j int) bool {
+		return res.Edits[i].Event.OriginServerTS < res.Edits[j].Event.OriginServerTS
+	})
+
+	// The history is only returned if looking at it could be recorded.
+	entry := &types.EventHistoryAuditEntry{
+		UserID:    device.UserID,
+		RoomID:    roomID,
+		EventID:   eventID,
+		Timestamp: gomatrixserverlib.AsTimestamp(time.Now()),
+	}
+	if err = syncDB.StoreEventHistoryAudit(ctx, entry); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("failed to record event history audit entry")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// EventHistoryAudit implements GET /unstable/org.matrix.dendrite.event_history/rooms/{roomId}/audit
+// Returns who looked at the history of events in the room, newest first.
+func EventHistoryAudit(
+	req *http.Request, device *userapi.Device,
+	syncDB storage.Database, rsAPI roomserver.SyncRoomserverAPI, cfg *config.SyncAPI,
+	roomID string,
+) util.JSONResponse {
+	ctx := req.Context()
+	limit := defaultEventHistoryAuditLimit
+	if l := req.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("limit must be a positive integer"),
+			}
+		}
+		if limit > maxEventHistoryAuditLimit {
+			limit = maxEventHistoryAuditLimit
+		}
+	}
+	if resErr := checkEventHistoryAllowed(ctx, syncDB, rsAPI, cfg, roomID, device.UserID); resErr != nil {
+		return *resErr
+	}
+	entries, err := syncDB.EventHistoryAuditFor(ctx, roomID, limit)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("failed to get event history audit log")
+		return jsonerror.InternalServerError()
+	}
+	res := eventHistoryAuditResponse{
+		Entries: make([]eventHistoryAuditEntry, 0, len(entries)),
+	}
+	for _, entry := range entries {
+		res.Entries = append(res.Entries, eventHistoryAuditEntry{
+			UserID:    entry.UserID,
+			EventID:   entry.EventID,
+			Timestamp: entry.Timestamp,
+		})
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// checkEventHistoryAllowed returns an error response unless the user is joined to the room and
+// has the power level of the configured key in the room, or the redact level if it isn't set.
+func checkEventHistoryAllowed(
+	ctx context.Context, syncDB storage.Database, rsAPI roomserver.SyncRoomserverAPI, cfg *config.SyncAPI,
+	roomID, userID string,
+) *util.JSONResponse {
+	membershipRes := roomserver.QueryMembershipForUserResponse{}
+	membershipReq := roomserver.QueryMembershipForUserRequest{UserID: userID, RoomID: roomID}
+	if err := rsAPI.QueryMembershipForUser(ctx, &membershipReq, &membershipRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("unable to query membership")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if !membershipRes.RoomExists || membershipRes.Membership != gomatrixserverlib.Join {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You aren't a member of the room"),
+		}
+	}
+	plEvent, err := syncDB.GetStateEvent(ctx, roomID, gomatrixserverlib.MRoomPowerLevels, "")
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("unable to get power levels")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if plEvent == nil {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You don't have permission to look at the history, no power_levels event in this room."),
+		}
+	}
+	pl, err := plEvent.PowerLevels()
+	if err != nil {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You don't have permission to look at the history, the power_levels event for this room is malformed."),
+		}
+	}
+	required := pl.Redact
+	if level, ok := pl.Events[cfg.EventHistory.PowerLevelKey]; ok {
+		required = level
+	}
+	if pl.UserLevel(userID) < required {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You don't have permission to look at the history, power level too low."),
+		}
+	}
+	return nil
+}
+
+func redactedHistoryEntry(ev *types.RedactedEvent) *eventHistoryEntry {
+	return &eventHistoryEntry{
+		Event: gomatrixserverlib.HeaderedToClientEvent(ev.Event, gomatrixserverlib.FormatAll),
+		Redaction: &eventHistoryRedaction{
+			RedactedBy: ev.RedactedBy,
+			Redacter:   ev.Redacter,
+			RedactedTS: ev.RedactedTS,
+		},
+	}
+}
+
+// purgeRedactedEvents periodically forgets the original versions of events which were
+// redacted longer ago than the retention period. A zero retention forgets all of them.
+func purgeRedactedEvents(syncDB storage.Database, retention time.Duration) {
+	ticker := time.NewTicker(redactedEventsPurgeInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		before := gomatrixserverlib.AsTimestamp(time.Now().Add(-retention))
+		count, err := syncDB.PurgeRedactedEvents(context.Background(), before)
+		if err != nil {
+			log.WithError(err).Error("Failed to purge the original versions of redacted events")
+			continue
+		}
+		if count > 0 {
+			log.WithField("count", count).Info("Purged the original versions of redacted events")
+		}
+	}
+}
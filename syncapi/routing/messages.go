@@ -341,6 +341,10 @@ func (r *messagesReq) retrieveEvents() (
 	if len(events) == 0 {
 		return []gomatrixserverlib.ClientEvent{}, *r.from, *r.to, nil
 	}
+	if bundleErr := r.db.BundleAggregations(r.ctx, r.device.UserID, events); bundleErr != nil {
+		err = fmt.Errorf("BundleAggregations: %w", bundleErr)
+		return
+	}
 
 	// Convert all of the events into client events.
 	clientEvents = gomatrixserverlib.HeaderedToClientEvents(events, gomatrixserverlib.FormatAll)
@@ -0,0 +1,260 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	roomserver "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const (
+	// relationsDefaultLimit is the number of events returned if the request doesn't set a limit
+	relationsDefaultLimit = 5
+	// relationsMaxLimit is the highest number of events returned at once
+	relationsMaxLimit = 100
+)
+
+type relationsResponse struct {
+	Chunk     []gomatrixserverlib.ClientEvent `json:"chunk"`
+	NextBatch string                          `json:"next_batch,omitempty"`
+	PrevBatch string                          `json:"prev_batch,omitempty"`
+}
+
+type threadsResponse struct {
+	Chunk     []gomatrixserverlib.ClientEvent `json:"chunk"`
+	NextBatch string                          `json:"next_batch,omitempty"`
+}
+
+// Relations implements GET /rooms/{roomId}/relations/{eventId}[/{relType}[/{eventType}]]
+// https://spec.matrix.org/v1.4/client-server-api/#get_matrixclientv1roomsroomidrelationseventid
+func Relations(
+	req *http.Request, device *userapi.Device,
+	syncDB storage.Database, rsAPI roomserver.SyncRoomserverAPI,
+	roomID, eventID, relType, eventType string,
+) util.JSONResponse {
+	ctx := req.Context()
+	query := req.URL.Query()
+
+	var from, to types.StreamPosition
+	var err error
+	if from, err = parseRelationsToken(query.Get("from")); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Invalid from parameter: " + err.Error()),
+		}
+	}
+	if to, err = parseRelationsToken(query.Get("to")); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Invalid to parameter: " + err.Error()),
+		}
+	}
+	backwards := true
+	switch query.Get("dir") {
+	case "", "b":
+	case "f":
+		backwards = false
+	default:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Bad dir query parameter (should be either 'b' or 'f')"),
+		}
+	}
+	limit, resErr := parseRelationsLimit(query.Get("limit"))
+	if resErr != nil {
+		return *resErr
+	}
+
+	if resErr = checkRoomHistoryVisible(ctx, syncDB, rsAPI, roomID, device.UserID); resErr != nil {
+		return *resErr
+	}
+	events, err := syncDB.Events(ctx, []string{eventID})
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("failed to get event")
+		return jsonerror.InternalServerError()
+	}
+	if len(events) == 0 || events[0].RoomID() != roomID {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Event not found"),
+		}
+	}
+
+	streamEvents, next, err := syncDB.RelationsFor(ctx, roomID, eventID, relType, eventType, from, to, backwards, limit)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("failed to get relations")
+		return jsonerror.InternalServerError()
+	}
+	res := relationsResponse{
+		PrevBatch: query.Get("from"),
+	}
+	if res.Chunk, err = clientEventsWithAggregations(ctx, syncDB, device, streamEvents); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("failed to bundle aggregations")
+		return jsonerror.InternalServerError()
+	}
+	if next > 0 {
+		res.NextBatch = strconv.FormatInt(int64(next), 10)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// Threads implements GET /rooms/{roomId}/threads
+// https://spec.matrix.org/v1.4/client-server-api/#get_matrixclientv1roomsroomidthreads
+func Threads(
+	req *http.Request, device *userapi.Device,
+	syncDB storage.Database, rsAPI roomserver.SyncRoomserverAPI,
+	roomID string,
+) util.JSONResponse {
+	ctx := req.Context()
+	query := req.URL.Query()
+
+	from, err := parseRelationsToken(query.Get("from"))
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Invalid from parameter: " + err.Error()),
+		}
+	}
+	var participant string
+	switch query.Get("include") {
+	case "", "all":
+	case "participated":
+		participant = device.UserID
+	default:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Bad include query parameter (should be either 'all' or 'participated')"),
+		}
+	}
+	limit, resErr := parseRelationsLimit(query.Get("limit"))
+	if resErr != nil {
+		return *resErr
+	}
+
+	if resErr = checkRoomHistoryVisible(ctx, syncDB, rsAPI, roomID, device.UserID); resErr != nil {
+		return *resErr
+	}
+	streamEvents, next, err := syncDB.ThreadsFor(ctx, roomID, participant, from, limit)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("failed to get threads")
+		return jsonerror.InternalServerError()
+	}
+	res := threadsResponse{}
+	if res.Chunk, err = clientEventsWithAggregations(ctx, syncDB, device, streamEvents); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("failed to bundle aggregations")
+		return jsonerror.InternalServerError()
+	}
+	if next > 0 {
+		res.NextBatch = strconv.FormatInt(int64(next), 10)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// parseRelationsToken parses a pagination token of the relations endpoints, which is the
+// stream position of an event. Sync tokens are accepted too, so that clients can paginate
+// from a /sync response.
+func parseRelationsToken(token string) (types.StreamPosition, error) {
+	if token == "" {
+		return 0, nil
+	}
+	if pos, err := strconv.ParseInt(token, 10, 64); err == nil && pos >= 0 {
+		return types.StreamPosition(pos), nil
+	}
+	streamToken, err := types.NewStreamTokenFromString(token)
+	if err != nil {
+		return 0, err
+	}
+	return streamToken.PDUPosition, nil
+}
+
+func parseRelationsLimit(limit string) (int, *util.JSONResponse) {
+	if limit == "" {
+		return relationsDefaultLimit, nil
+	}
+	l, err := strconv.Atoi(limit)
+	if err != nil || l <= 0 {
+		return 0, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("limit must be a positive integer"),
+		}
+	}
+	if l > relationsMaxLimit {
+		l = relationsMaxLimit
+	}
+	return l, nil
+}
+
+// checkRoomHistoryVisible returns an error response unless the user is joined to the room or
+// its history is world readable.
+func checkRoomHistoryVisible(
+	ctx context.Context, syncDB storage.Database, rsAPI roomserver.SyncRoomserverAPI, roomID, userID string,
+) *util.JSONResponse {
+	membershipRes := roomserver.QueryMembershipForUserResponse{}
+	membershipReq := roomserver.QueryMembershipForUserRequest{UserID: userID, RoomID: roomID}
+	if err := rsAPI.QueryMembershipForUser(ctx, &membershipReq, &membershipRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("unable to query membership")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if !membershipRes.RoomExists {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("room does not exist"),
+		}
+	}
+	if membershipRes.Membership == gomatrixserverlib.Join {
+		return nil
+	}
+	historyVisibility, err := syncDB.GetStateEvent(ctx, roomID, gomatrixserverlib.MRoomHistoryVisibility, "")
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("unable to get history visibility")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if historyVisibility != nil {
+		if visibility, err := historyVisibility.HistoryVisibility(); err == nil && visibility == gomatrixserverlib.WorldReadable {
+			return nil
+		}
+	}
+	return &util.JSONResponse{
+		Code: http.StatusForbidden,
+		JSON: jsonerror.Forbidden("You aren't a member of the room and its history isn't world readable"),
+	}
+}
+
+func clientEventsWithAggregations(
+	ctx context.Context, syncDB storage.Database, device *userapi.Device, streamEvents []types.StreamEvent,
+) ([]gomatrixserverlib.ClientEvent, error) {
+	events := syncDB.StreamEventsToEvents(device, streamEvents)
+	if err := syncDB.BundleAggregations(ctx, device.UserID, events); err != nil {
+		return nil, err
+	}
+	return gomatrixserverlib.HeaderedToClientEvents(events, gomatrixserverlib.FormatAll), nil
+}
@@ -16,6 +16,7 @@ package routing
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/internal/caching"
@@ -42,12 +43,20 @@ func Setup(
 	lazyLoadCache caching.LazyLoadCache,
 ) {
 	v3mux := csMux.PathPrefix("/{apiversion:(?:r0|v3)}/").Subrouter()
+	v1mux := csMux.PathPrefix("/v1/").Subrouter()
+	unstableMux := csMux.PathPrefix("/unstable").Subrouter()
 
 	// TODO: Add AS support for all handlers below.  
 	v3mux.Handle("/sync", httputil.MakeAuthAPI("sync", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 		return srp.OnIncomingSyncRequest(req, device)
 	})).Methods(http.MethodGet, http.MethodOptions)
 
+	if cfg.MSCs != nil && cfg.MSCs.Enabled("msc3575") {
+		unstableMux.Handle("/org.matrix.msc3575/sync", httputil.MakeAuthAPI("sliding_sync", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return srp.OnIncomingSlidingSyncRequest(req, device)
+		})).Methods(http.MethodPost, http.MethodOptions)
+	}
+
 	v3mux.Handle("/rooms/{roomID}/messages", httputil.MakeAuthAPI("room_messages", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 		if err != nil {
@@ -99,4 +108,65 @@ func Setup(
 			)
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
+
+	relationsHandler := httputil.MakeAuthAPI("relations", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+		if err != nil {
+			return util.ErrorResponse(err)
+		}
+		return Relations(
+			req, device, syncDB, rsAPI,
+			vars["roomId"], vars["eventId"], vars["relType"], vars["eventType"],
+		)
+	})
+	v1mux.Handle("/rooms/{roomId}/relations/{eventId}", relationsHandler).Methods(http.MethodGet, http.MethodOptions)
+	v1mux.Handle("/rooms/{roomId}/relations/{eventId}/{relType}", relationsHandler).Methods(http.MethodGet, http.MethodOptions)
+	v1mux.Handle("/rooms/{roomId}/relations/{eventId}/{relType}/{eventType}", relationsHandler).Methods(http.MethodGet, http.MethodOptions)
+
+	v1mux.Handle("/rooms/{roomId}/threads",
+		httputil.MakeAuthAPI("threads", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return Threads(req, device, syncDB, rsAPI, vars["roomId"])
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	if cfg.Search.Enabled {
+		v3mux.Handle("/search",
+			httputil.MakeAuthAPI("search", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+				return Search(req, device, syncDB, rsAPI)
+			}),
+		).Methods(http.MethodPost, http.MethodOptions)
+	}
+
+	// Originals kept while the event history was enabled are purged even if it
+	// has been disabled since, in which case none of them are kept any longer.
+	var redactedRetention time.Duration
+	if cfg.EventHistory.Enabled {
+		redactedRetention = cfg.EventHistory.RedactedRetention
+	}
+	go purgeRedactedEvents(syncDB, redactedRetention)
+
+	if cfg.EventHistory.Enabled {
+		unstableMux.Handle("/org.matrix.dendrite.event_history/rooms/{roomId}/history/{eventId}",
+			httputil.MakeAuthAPI("event_history", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+				vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+				if err != nil {
+					return util.ErrorResponse(err)
+				}
+				return EventHistory(req, device, syncDB, rsAPI, cfg, vars["roomId"], vars["eventId"])
+			}),
+		).Methods(http.MethodGet, http.MethodOptions)
+		unstableMux.Handle("/org.matrix.dendrite.event_history/rooms/{roomId}/audit",
+			httputil.MakeAuthAPI("event_history_audit", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+				vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+				if err != nil {
+					return util.ErrorResponse(err)
+				}
+				return EventHistoryAudit(req, device, syncDB, rsAPI, cfg, vars["roomId"])
+			}),
+		).Methods(http.MethodGet, http.MethodOptions)
+	}
 }
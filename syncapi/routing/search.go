@@ -0,0 +1,475 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/fulltext"
+	roomserver "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	// searchDefaultLimit is the number of results returned if the filter doesn't set a limit
+	searchDefaultLimit = 10
+	// searchMaxLimit is the highest number of results returned at once
+	searchMaxLimit = 50
+	// searchDefaultContextLimit is the number of events before and after each result if
+	// the event context doesn't set a limit
+	searchDefaultContextLimit = 5
+	// searchMaxContextLimit is the highest number of events before and after each result
+	searchMaxContextLimit = 20
+)
+
+// searchRequest is the body of POST /search
+// https://spec.matrix.org/v1.3/client-server-api/#post_matrixclientv3search
+type searchRequest struct {
+	SearchCategories struct {
+		RoomEvents *roomEventsCriteria `json:"room_events"`
+	} `json:"search_categories"`
+}
+
+type roomEventsCriteria struct {
+	SearchTerm   string                            `json:"search_term"`
+	Keys         []string                          `json:"keys"`
+	Filter       gomatrixserverlib.RoomEventFilter `json:"filter"`
+	OrderBy      string                            `json:"order_by"`
+	EventContext *searchEventContext               `json:"event_context"`
+	IncludeState bool                              `json:"include_state"`
+	Groupings    struct {
+		GroupBy []struct {
+			Key string `json:"key"`
+		} `json:"group_by"`
+	} `json:"groupings"`
+}
+
+type searchEventContext struct {
+	BeforeLimit    *int `json:"before_limit"`
+	AfterLimit     *int `json:"after_limit"`
+	IncludeProfile bool `json:"include_profile"`
+}
+
+type searchResponse struct {
+	SearchCategories struct {
+		RoomEvents *roomEventsResults `json:"room_events,omitempty"`
+	} `json:"search_categories"`
+}
+
+type roomEventsResults struct {
+	Count      int                                        `json:"count"`
+	Groups     map[string]map[string]*searchGroup         `json:"groups,omitempty"`
+	Highlights []string                                   `json:"highlights"`
+	NextBatch  string                                     `json:"next_batch,omitempty"`
+	Results    []searchResult                             `json:"results"`
+	State      map[string][]gomatrixserverlib.ClientEvent `json:"state,omitempty"`
+}
+
+type searchResult struct {
+	Context *searchResultContext          `json:"context,omitempty"`
+	Rank    float64                       `json:"rank"`
+	Result  gomatrixserverlib.ClientEvent `json:"result"`
+}
+
+type searchResultContext struct {
+	End          string                          `json:"end,omitempty"`
+	EventsAfter  []gomatrixserverlib.ClientEvent `json:"events_after"`
+	EventsBefore []gomatrixserverlib.ClientEvent `json:"events_before"`
+	ProfileInfo  map[string]searchProfile        `json:"profile_info,omitempty"`
+	Start        string                          `json:"start,omitempty"`
+}
+
+type searchProfile struct {
+	AvatarURL   string `json:"avatar_url,omitempty"`
+	DisplayName string `json:"displayname,omitempty"`
+}
+
+type searchGroup struct {
+	Order   int      `json:"order"`
+	Results []string `json:"results"`
+}
+
+// Search implements POST /search for the room_events category. Only the bodies of
+// m.room.message events in rooms the user is joined to are searched. The next_batch
+// token is the number of matching events skipped so far. Results the user isn't
+// allowed to see are left out after the index was queried, so a page may have
+// fewer results than the limit even if there are more.
+func Search(
+	req *http.Request, device *userapi.Device,
+	syncDB storage.Database, rsAPI roomserver.SyncRoomserverAPI,
+) util.JSONResponse {
+	ctx := req.Context()
+	logger := util.GetLogger(ctx)
+
+	defer req.Body.Close() // nolint:errcheck
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be read. " + err.Error()),
+		}
+	}
+	var searchReq searchRequest
+	if err = json.Unmarshal(body, &searchReq); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+
+	var offset int
+	if nextBatch := req.URL.Query().Get("next_batch"); nextBatch != "" {
+		if offset, err = strconv.Atoi(nextBatch); err != nil || offset < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("next_batch is not a valid batch token"),
+			}
+		}
+	}
+
+	res := searchResponse{}
+	criteria := searchReq.SearchCategories.RoomEvents
+	if criteria == nil {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: res,
+		}
+	}
+	if criteria.SearchTerm == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingParam("search_term must not be empty"),
+		}
+	}
+	orderByRank := true
+	switch criteria.OrderBy {
+	case "", "rank":
+	case "recent":
+		orderByRank = false
+	default:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("order_by must be rank or recent"),
+		}
+	}
+	for _, group := range criteria.Groupings.GroupBy {
+		if group.Key != "room_id" && group.Key != "sender" {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam("groupings can only group by room_id or sender"),
+			}
+		}
+	}
+
+	phrases := fulltext.ParseQuery(criteria.SearchTerm)
+	results := &roomEventsResults{
+		Highlights: fulltext.Highlights(phrases),
+		Results:    []searchResult{},
+	}
+	if results.Highlights == nil {
+		results.Highlights = []string{}
+	}
+	res.SearchCategories.RoomEvents = results
+	if !searchesBody(criteria.Keys) {
+		// only the bodies of messages are indexed
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: res,
+		}
+	}
+
+	roomIDs, err := syncDB.RoomIDsWithMembership(ctx, device.UserID, gomatrixserverlib.Join)
+	if err != nil {
+		logger.WithError(err).Error("failed to get joined rooms")
+		return jsonerror.InternalServerError()
+	}
+	roomIDs = filterSearchRooms(roomIDs, &criteria.Filter)
+
+	limit := criteria.Filter.Limit
+	if limit <= 0 {
+		limit = searchDefaultLimit
+	}
+	if limit > searchMaxLimit {
+		limit = searchMaxLimit
+	}
+	matches, count, err := syncDB.SearchEvents(ctx, phrases, roomIDs, &criteria.Filter, orderByRank, limit, offset)
+	if err != nil {
+		logger.WithError(err).Error("failed to search events")
+		return jsonerror.InternalServerError()
+	}
+	results.Count = count
+	if offset+len(matches) < count {
+		results.NextBatch = strconv.Itoa(offset + len(matches))
+	}
+
+	eventIDs := make([]string, len(matches))
+	for i := range matches {
+		eventIDs[i] = matches[i].EventID
+	}
+	events, err := syncDB.Events(ctx, eventIDs)
+	if err != nil {
+		logger.WithError(err).Error("failed to get events")
+		return jsonerror.InternalServerError()
+	}
+	eventsByID := make(map[string]*gomatrixserverlib.HeaderedEvent, len(events))
+	for _, ev := range events {
+		eventsByID[ev.EventID()] = ev
+	}
+
+	visibility := newSearchVisibility(ctx, rsAPI, device.UserID)
+	rooms := map[string]bool{}
+	for _, match := range matches {
+		ev, ok := eventsByID[match.EventID]
+		if !ok || isRedacted(ev) || !visibility.allowed(ev, match.HistoryVisibility) {
+			// not stored yet, redacted since it was indexed or sent while the user couldn't see it
+			continue
+		}
+		result := searchResult{
+			Rank:   match.Rank,
+			Result: gomatrixserverlib.HeaderedToClientEvent(ev, gomatrixserverlib.FormatAll),
+		}
+		if criteria.EventContext != nil {
+			if result.Context, err = searchContext(ctx, syncDB, visibility, ev, criteria.EventContext); err != nil {
+				logger.WithError(err).WithField("event_id", ev.EventID()).Error("failed to get search result context")
+				return jsonerror.InternalServerError()
+			}
+		}
+		results.Results = append(results.Results, result)
+		rooms[ev.RoomID()] = true
+
+		for _, group := range criteria.Groupings.GroupBy {
+			value := ev.RoomID()
+			if group.Key == "sender" {
+				value = ev.Sender()
+			}
+			if results.Groups == nil {
+				results.Groups = map[string]map[string]*searchGroup{}
+			}
+			if results.Groups[group.Key] == nil {
+				results.Groups[group.Key] = map[string]*searchGroup{}
+			}
+			g, ok := results.Groups[group.Key][value]
+			if !ok {
+				g = &searchGroup{Order: len(results.Groups[group.Key]) + 1}
+				results.Groups[group.Key][value] = g
+			}
+			g.Results = append(g.Results, ev.EventID())
+		}
+	}
+
+	if criteria.IncludeState {
+		results.State = make(map[string][]gomatrixserverlib.ClientEvent, len(rooms))
+		stateFilter := gomatrixserverlib.DefaultStateFilter()
+		for roomID := range rooms {
+			state, err := syncDB.CurrentState(ctx, roomID, &stateFilter, nil)
+			if err != nil {
+				logger.WithError(err).WithField("room_id", roomID).Error("failed to get current state")
+				return jsonerror.InternalServerError()
+			}
+			results.State[roomID] = gomatrixserverlib.HeaderedToClientEvents(state, gomatrixserverlib.FormatAll)
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// searchesBody reports whether the keys include the body of messages, which are
+// the only ones in the index. All keys are searched if none are given.
+func searchesBody(keys []string) bool {
+	if len(keys) == 0 {
+		return true
+	}
+	for _, key := range keys {
+		if key == "content.body" {
+			return true
+		}
+	}
+	return false
+}
+
+// filterSearchRooms applies the rooms and not_rooms of the filter to the joined rooms.
+func filterSearchRooms(roomIDs []string, filter *gomatrixserverlib.RoomEventFilter) []string {
+	exclude := map[string]bool{}
+	if filter.NotRooms != nil {
+		for _, roomID := range *filter.NotRooms {
+			exclude[roomID] = true
+		}
+	}
+	var include map[string]bool
+	if filter.Rooms != nil {
+		include = map[string]bool{}
+		for _, roomID := range *filter.Rooms {
+			include[roomID] = true
+		}
+	}
+	filtered := make([]string, 0, len(roomIDs))
+	for _, roomID := range roomIDs {
+		if exclude[roomID] || (include != nil && !include[roomID]) {
+			continue
+		}
+		filtered = append(filtered, roomID)
+	}
+	return filtered
+}
+
+// isRedacted reports whether the event was redacted, which removes its body.
+func isRedacted(ev *gomatrixserverlib.HeaderedEvent) bool {
+	return gjson.GetBytes(ev.Unsigned(), "redacted_because").Exists() || !gjson.GetBytes(ev.Content(), "body").Exists()
+}
+
+// searchVisibility decides whether the user may see events according to the history
+// visibility of the room when they were sent. The user is joined to all searched rooms,
+// so they may see shared and world readable history. For joined and invited history
+// their membership before the event is looked up, and remembered per event.
+type searchVisibility struct {
+	ctx    context.Context
+	rsAPI  roomserver.SyncRoomserverAPI
+	userID string
+	cache  map[string]bool
+}
+
+func newSearchVisibility(ctx context.Context, rsAPI roomserver.SyncRoomserverAPI, userID string) *searchVisibility {
+	return &searchVisibility{
+		ctx:    ctx,
+		rsAPI:  rsAPI,
+		userID: userID,
+		cache:  map[string]bool{},
+	}
+}
+
+func (v *searchVisibility) allowed(ev *gomatrixserverlib.HeaderedEvent, historyVisibility gomatrixserverlib.HistoryVisibility) bool {
+	switch historyVisibility {
+	case gomatrixserverlib.HistoryVisibilityJoined, gomatrixserverlib.HistoryVisibilityInvited:
+	default:
+		return true
+	}
+	if ev.Sender() == v.userID {
+		return true
+	}
+	if allowed, ok := v.cache[ev.EventID()]; ok {
+		return allowed
+	}
+	var queryRes roomserver.QueryStateAfterEventsResponse
+	err := v.rsAPI.QueryStateAfterEvents(v.ctx, &roomserver.QueryStateAfterEventsRequest{
+		RoomID:       ev.RoomID(),
+		PrevEventIDs: ev.PrevEventIDs(),
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: gomatrixserverlib.MRoomMember, StateKey: v.userID},
+		},
+	}, &queryRes)
+	allowed := false
+	if err == nil && len(queryRes.StateEvents) > 0 {
+		membership, _ := queryRes.StateEvents[0].Membership()
+		allowed = membership == gomatrixserverlib.Join ||
+			(membership == gomatrixserverlib.Invite && historyVisibility == gomatrixserverlib.HistoryVisibilityInvited)
+	}
+	v.cache[ev.EventID()] = allowed
+	return allowed
+}
+
+// searchContext returns the events around a search result which the user may see,
+// and the profiles of their senders if requested.
+func searchContext(
+	ctx context.Context, syncDB storage.Database, visibility *searchVisibility,
+	ev *gomatrixserverlib.HeaderedEvent, criteria *searchEventContext,
+) (*searchResultContext, error) {
+	beforeLimit, afterLimit := searchDefaultContextLimit, searchDefaultContextLimit
+	if criteria.BeforeLimit != nil {
+		beforeLimit = *criteria.BeforeLimit
+	}
+	if criteria.AfterLimit != nil {
+		afterLimit = *criteria.AfterLimit
+	}
+	clamp := func(limit int) int {
+		if limit < 0 {
+			return 0
+		}
+		if limit > searchMaxContextLimit {
+			return searchMaxContextLimit
+		}
+		return limit
+	}
+
+	id, _, err := syncDB.SelectContextEvent(ctx, ev.RoomID(), ev.EventID())
+	if err != nil {
+		return nil, err
+	}
+	var eventsBefore, eventsAfter []*gomatrixserverlib.HeaderedEvent
+	if limit := clamp(beforeLimit); limit > 0 {
+		eventsBefore, err = syncDB.SelectContextBeforeEvent(ctx, id, ev.RoomID(), &gomatrixserverlib.RoomEventFilter{Limit: limit})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if limit := clamp(afterLimit); limit > 0 {
+		_, eventsAfter, err = syncDB.SelectContextAfterEvent(ctx, id, ev.RoomID(), &gomatrixserverlib.RoomEventFilter{Limit: limit})
+		if err != nil {
+			return nil, err
+		}
+	}
+	visible := func(events []*gomatrixserverlib.HeaderedEvent) []*gomatrixserverlib.HeaderedEvent {
+		filtered := make([]*gomatrixserverlib.HeaderedEvent, 0, len(events))
+		for _, e := range events {
+			if visibility.allowed(e, e.Visibility) {
+				filtered = append(filtered, e)
+			}
+		}
+		return filtered
+	}
+	eventsBefore, eventsAfter = visible(eventsBefore), visible(eventsAfter)
+
+	res := &searchResultContext{
+		EventsBefore: gomatrixserverlib.HeaderedToClientEvents(eventsBefore, gomatrixserverlib.FormatAll),
+		EventsAfter:  gomatrixserverlib.HeaderedToClientEvents(eventsAfter, gomatrixserverlib.FormatAll),
+	}
+	var start, end types.TopologyToken
+	if start, end, err = getStartEnd(ctx, syncDB, eventsBefore, eventsAfter); err == nil {
+		res.Start, res.End = start.String(), end.String()
+	}
+
+	if criteria.IncludeProfile {
+		res.ProfileInfo = map[string]searchProfile{}
+		for _, e := range append(append([]*gomatrixserverlib.HeaderedEvent{ev}, eventsBefore...), eventsAfter...) {
+			if _, ok := res.ProfileInfo[e.Sender()]; ok {
+				continue
+			}
+			member, err := syncDB.GetStateEvent(ctx, ev.RoomID(), gomatrixserverlib.MRoomMember, e.Sender())
+			if err != nil {
+				return nil, err
+			}
+			var profile searchProfile
+			if member != nil {
+				if err = json.Unmarshal(member.Content(), &profile); err != nil {
+					profile = searchProfile{}
+				}
+			}
+			res.ProfileInfo[e.Sender()] = profile
+		}
+	}
+	return res, nil
+}
@@ -18,6 +18,7 @@ import (
 	"context"
 
 	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/internal/fulltext"
 
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/syncapi/types"
@@ -28,6 +29,9 @@ import (
 type Database interface {
 	Presence
 	SharedUsers
+	Search
+	Relations
+	EventHistory
 
 	MaxStreamPositionForPDUs(ctx context.Context) (types.StreamPosition, error)
 	MaxStreamPositionForReceipts(ctx context.Context) (types.StreamPosition, error)
@@ -35,6 +39,9 @@ type Database interface {
 	MaxStreamPositionForAccountData(ctx context.Context) (types.StreamPosition, error)
 	MaxStreamPositionForSendToDeviceMessages(ctx context.Context) (types.StreamPosition, error)
 	MaxStreamPositionForNotificationData(ctx context.Context) (types.StreamPosition, error)
+	// MaxStreamPositionsForRooms returns the stream position of the latest event in each of the rooms.
+	// Rooms without events are left out.
+	MaxStreamPositionsForRooms(ctx context.Context, roomIDs []string) (map[string]types.StreamPosition, error)
 
 	CurrentState(ctx context.Context, roomID string, stateFilterPart *gomatrixserverlib.StateFilter, excludeEventIDs []string) ([]*gomatrixserverlib.HeaderedEvent, error)
 	GetStateDeltasForFullStateSync(ctx context.Context, device *userapi.Device, r types.Range, userID string, stateFilter *gomatrixserverlib.StateFilter) ([]types.StateDelta, []string, error)
@@ -88,7 +95,8 @@ type Database interface {
 	// Returns a map following the format data[roomID] = []dataTypes
 	// If no data is retrieved, returns an empty map
 	// If there was an issue with the retrieval, returns an error
-	GetAccountDataInRange(ctx context.Context, userID string, r types.Range, accountDataFilterPart *gomatrixserverlib.EventFilter) (map[string][]string, types.StreamPosition, error)
+	// The first filter applies to global account data, the second one to room account data.
+	GetAccountDataInRange(ctx context.Context, userID string, r types.Range, accountDataFilterPart *gomatrixserverlib.EventFilter, roomAccountDataFilterPart *gomatrixserverlib.RoomEventFilter) (map[string][]string, types.StreamPosition, error)
 	// UpsertAccountData keeps track of new or updated account data, by saving the type
 	// of the new/updated data, and the user ID and room ID the data is related to (empty)
 	// room ID means the data isn't specific to any room)
@@ -135,13 +143,14 @@ type Database interface {
 	// GetFilter looks up the filter associated with a given local user and filter ID
 	// and populates the target filter. Otherwise returns an error if no such filter exists
 	// or if there was an error talking to the database.
-	GetFilter(ctx context.Context, target *gomatrixserverlib.Filter, localpart string, filterID string) error
+	GetFilter(ctx context.Context, target *types.Filter, localpart string, filterID string) error
 	// PutFilter puts the passed filter into the database.
 	// Returns the filterID as a string. Otherwise returns an error if something
 	// goes wrong.
-	PutFilter(ctx context.Context, localpart string, filter *gomatrixserverlib.Filter) (string, error)
-	// RedactEvent wipes an event in the database and sets the unsigned.redacted_because key to the redaction event
-	RedactEvent(ctx context.Context, redactedEventID string, redactedBecause *gomatrixserverlib.HeaderedEvent) error
+	PutFilter(ctx context.Context, localpart string, filter *types.Filter) (string, error)
+	// RedactEvent wipes an event in the database and sets the unsigned.redacted_because key to the redaction event.
+	// If keepOriginal is set, the original version of the event is kept for room moderators.
+	RedactEvent(ctx context.Context, redactedEventID string, redactedBecause *gomatrixserverlib.HeaderedEvent, keepOriginal bool) error
 	// StoreReceipt stores new receipt events
 	StoreReceipt(ctx context.Context, roomId, receiptType, userId, eventId string, timestamp gomatrixserverlib.Timestamp) (pos types.StreamPosition, err error)
 	// GetRoomReceipts gets all receipts for a given roomID
@@ -153,6 +162,19 @@ type Database interface {
 	// GetUserUnreadNotificationCounts returns statistics per room a user is interested in.
 	GetUserUnreadNotificationCounts(ctx context.Context, userID string, from, to types.StreamPosition) (map[string]*eventutil.NotificationData, error)
 
+	// UpdateUnreadCountsForEvent counts a new event as unread for the given users, and clears the
+	// counts of its thread for the sender. Returns the latest stream position, or zero if nothing changed.
+	UpdateUnreadCountsForEvent(ctx context.Context, ev *gomatrixserverlib.HeaderedEvent, pos types.StreamPosition, userIDs []string) (types.StreamPosition, error)
+	// UpdateUnreadNotificationCountsForEvent counts an event the user was notified about in the
+	// notification counts of its thread. Returns zero if the event isn't known.
+	UpdateUnreadNotificationCountsForEvent(ctx context.Context, userID, eventID string, highlight bool) (types.StreamPosition, error)
+	// MarkUnreadCountsRead updates the unread counts of the user in the room for a read receipt
+	// for the event. Returns the latest stream position, or zero if nothing changed.
+	MarkUnreadCountsRead(ctx context.Context, userID, roomID, eventID string) (types.StreamPosition, error)
+	// GetUserUnreadCounts returns the per-thread unread counts of the user which aren't zero or
+	// which changed after the position.
+	GetUserUnreadCounts(ctx context.Context, userID string, after types.StreamPosition) ([]types.UnreadCounts, error)
+
 	SelectContextEvent(ctx context.Context, roomID, eventID string) (int, gomatrixserverlib.HeaderedEvent, error)
 	SelectContextBeforeEvent(ctx context.Context, id int, roomID string, filter *gomatrixserverlib.RoomEventFilter) ([]*gomatrixserverlib.HeaderedEvent, error)
 	SelectContextAfterEvent(ctx context.Context, id int, roomID string, filter *gomatrixserverlib.RoomEventFilter) (int, []*gomatrixserverlib.HeaderedEvent, error)
@@ -170,6 +192,47 @@ type Presence interface {
 	MaxStreamPositionForPresence(ctx context.Context) (types.StreamPosition, error)
 }
 
+type Search interface {
+	// IndexEventForSearch adds the text of the event to the full-text index, along with the
+	// history visibility of the room when it was sent.
+	IndexEventForSearch(ctx context.Context, event *gomatrixserverlib.HeaderedEvent, historyVisibility gomatrixserverlib.HistoryVisibility, text string) error
+	// RemoveEventFromSearch removes the event from the full-text index, i.e. because it was redacted.
+	RemoveEventFromSearch(ctx context.Context, eventID string) error
+	// SearchEvents returns up to limit events in the rooms containing all the phrases, skipping the
+	// first offset ones, and the total number of matching events.
+	SearchEvents(ctx context.Context, phrases []fulltext.Phrase, roomIDs []string, filter *gomatrixserverlib.RoomEventFilter, orderByRank bool, limit, offset int) ([]types.SearchResult, int, error)
+}
+
+type Relations interface {
+	// RelationsFor returns up to limit events relating to the event, after the from position and before
+	// the to position in the given direction. Both positions are exclusive, and 0 means the start or end of
+	// the room. The relation type and event type are only matched if not empty. The position of the last
+	// event is returned if there may be more events, 0 otherwise.
+	RelationsFor(ctx context.Context, roomID, eventID, relType, eventType string, from, to types.StreamPosition, backwards bool, limit int) ([]types.StreamEvent, types.StreamPosition, error)
+	// ThreadsFor returns up to limit root events of threads in the room, most recently active first, whose
+	// latest reply is before the from position (exclusive, 0 means the end of the room). If participant isn't
+	// empty only threads they started or replied to are returned. The position of the latest reply to the last
+	// thread is returned if there may be more threads, 0 otherwise.
+	ThreadsFor(ctx context.Context, roomID, participant string, from types.StreamPosition, limit int) ([]types.StreamEvent, types.StreamPosition, error)
+	// BundleAggregations adds the aggregated relations to the events to their unsigned m.relations field.
+	// The thread summaries are made for userID.
+	BundleAggregations(ctx context.Context, userID string, events []*gomatrixserverlib.HeaderedEvent) error
+}
+
+type EventHistory interface {
+	// RedactedEvent returns the original version of the redacted event, or nil if it isn't kept.
+	RedactedEvent(ctx context.Context, eventID string) (*types.RedactedEvent, error)
+	// RedactedEditsFor returns the original versions of the redacted edits of the event which are kept.
+	RedactedEditsFor(ctx context.Context, roomID, eventID string) ([]*types.RedactedEvent, error)
+	// PurgeRedactedEvents forgets the original versions of the events redacted before the time
+	// and returns how many were forgotten.
+	PurgeRedactedEvents(ctx context.Context, before gomatrixserverlib.Timestamp) (int64, error)
+	// StoreEventHistoryAudit records that a user looked at the history of an event.
+	StoreEventHistoryAudit(ctx context.Context, entry *types.EventHistoryAuditEntry) error
+	// EventHistoryAuditFor returns up to limit entries of the history audit log of the room, newest first.
+	EventHistoryAuditFor(ctx context.Context, roomID string, limit int) ([]types.EventHistoryAuditEntry, error)
+}
+
 type SharedUsers interface {
 	// SharedUsers returns a subset of otherUserIDs that share a room with userID.
 	SharedUsers(ctx context.Context, userID string, otherUserIDs []string) ([]string, error)
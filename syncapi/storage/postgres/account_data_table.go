@@ -56,12 +56,22 @@ const insertAccountDataSQL = "" +
 	" DO UPDATE SET id = nextval('syncapi_stream_id')" +
 	" RETURNING id"
 
+// The global account data filter applies to rows without a room ID,
+// the room account data filter to all others.
 const selectAccountDataInRangeSQL = "" +
 	"SELECT id, room_id, type FROM syncapi_account_data_type" +
 	" WHERE user_id = $1 AND id > $2 AND id <= $3" +
-	" AND ( $4::text[] IS NULL OR     type LIKE ANY($4)  )" +
-	" AND ( $5::text[] IS NULL OR NOT(type LIKE ANY($5)) )" +
-	" ORDER BY id ASC LIMIT $6"
+	" AND ( room_id <> '' OR (" +
+	"   ( $4::text[] IS NULL OR     type LIKE ANY($4)  ) AND" +
+	"   ( $5::text[] IS NULL OR NOT(type LIKE ANY($5)) )" +
+	" ) )" +
+	" AND ( room_id = '' OR (" +
+	"   ( $6::text[] IS NULL OR     type LIKE ANY($6)  ) AND" +
+	"   ( $7::text[] IS NULL OR NOT(type LIKE ANY($7)) ) AND" +
+	"   ( $8::text[] IS NULL OR     room_id = ANY($8)  ) AND" +
+	"   ( $9::text[] IS NULL OR NOT(room_id = ANY($9)) )" +
+	" ) )" +
+	" ORDER BY id ASC LIMIT $10"
 
 const selectMaxAccountDataIDSQL = "" +
 	"SELECT MAX(id) FROM syncapi_account_data_type"
@@ -103,33 +113,47 @@ func (s *accountDataStatements) SelectAccountDataInRange(
 	userID string,
 	r types.Range,
 	accountDataEventFilter *gomatrixserverlib.EventFilter,
+	roomAccountDataEventFilter *gomatrixserverlib.RoomEventFilter,
 ) (data map[string][]string, pos types.StreamPosition, err error) {
-	data = make(map[string][]string)
-
 	rows, err := s.selectAccountDataInRangeStmt.QueryContext(ctx, userID, r.Low(), r.High(),
 		pq.StringArray(filterConvertTypeWildcardToSQL(accountDataEventFilter.Types)),
 		pq.StringArray(filterConvertTypeWildcardToSQL(accountDataEventFilter.NotTypes)),
-		accountDataEventFilter.Limit,
+		pq.StringArray(filterConvertTypeWildcardToSQL(roomAccountDataEventFilter.Types)),
+		pq.StringArray(filterConvertTypeWildcardToSQL(roomAccountDataEventFilter.NotTypes)),
+		pq.StringArray(filterValuesToSQL(roomAccountDataEventFilter.Rooms)),
+		pq.StringArray(filterValuesToSQL(roomAccountDataEventFilter.NotRooms)),
+		int64(accountDataEventFilter.Limit)+int64(roomAccountDataEventFilter.Limit),
 	)
 	if err != nil {
 		return
 	}
 	defer internal.CloseAndLogIfError(ctx, rows, "selectAccountDataInRange: rows.close() failed")
 
+	data = make(map[string][]string)
 	var dataType string
 	var roomID string
 	var id types.StreamPosition
+	var globalCount, roomCount int
 
 	for rows.Next() {
 		if err = rows.Scan(&id, &roomID, &dataType); err != nil {
 			return
 		}
-
-		if len(data[roomID]) > 0 {
-			data[roomID] = append(data[roomID], dataType)
+		// Each section has its own limit. Stop at the first row which doesn't
+		// fit, so that it and everything after it is sent in the next sync.
+		if roomID == "" {
+			globalCount++
 		} else {
-			data[roomID] = []string{dataType}
+			roomCount++
+		}
+		if globalCount > accountDataEventFilter.Limit || roomCount > roomAccountDataEventFilter.Limit {
+			if pos == 0 {
+				pos = r.Low()
+			}
+			return data, pos, nil
 		}
+
+		data[roomID] = append(data[roomID], dataType)
 		if id > pos {
 			pos = id
 		}
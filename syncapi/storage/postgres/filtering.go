@@ -38,6 +38,15 @@ func filterConvertTypeWildcardToSQL(values *[]string) []string {
 	return ret
 }
 
+// filterValuesToSQL returns the values of a filter list, or nil if the list
+// is absent so that IS NULL matches in the query.
+func filterValuesToSQL(values *[]string) []string {
+	if values == nil {
+		return nil
+	}
+	return *values
+}
+
 // TODO: Replace when Dendrite uses Go 1.18
 func getSendersRoomEventFilter(filter *gomatrixserverlib.RoomEventFilter) (senders []string, notSenders []string) {
 	if filter.Senders != nil {
@@ -105,7 +105,8 @@ const selectRecentEventsSQL = "" +
 	" AND ( $5::text[] IS NULL OR NOT(sender  = ANY($5)) )" +
 	" AND ( $6::text[] IS NULL OR     type LIKE ANY($6)  )" +
 	" AND ( $7::text[] IS NULL OR NOT(type LIKE ANY($7)) )" +
-	" ORDER BY id DESC LIMIT $8"
+	" AND ( $8::bool IS NULL   OR     contains_url = $8  )" +
+	" ORDER BY id DESC LIMIT $9"
 
 const selectRecentEventsForSyncSQL = "" +
 	"SELECT event_id, id, headered_event_json, session_id, exclude_from_sync, transaction_id, history_visibility FROM syncapi_output_room_events" +
@@ -114,7 +115,8 @@ const selectRecentEventsForSyncSQL = "" +
 	" AND ( $5::text[] IS NULL OR NOT(sender  = ANY($5)) )" +
 	" AND ( $6::text[] IS NULL OR     type LIKE ANY($6)  )" +
 	" AND ( $7::text[] IS NULL OR NOT(type LIKE ANY($7)) )" +
-	" ORDER BY id DESC LIMIT $8"
+	" AND ( $8::bool IS NULL   OR     contains_url = $8  )" +
+	" ORDER BY id DESC LIMIT $9"
 
 const selectEarlyEventsSQL = "" +
 	"SELECT event_id, id, headered_event_json, session_id, exclude_from_sync, transaction_id, history_visibility FROM syncapi_output_room_events" +
@@ -123,11 +125,17 @@ const selectEarlyEventsSQL = "" +
 	" AND ( $5::text[] IS NULL OR NOT(sender  = ANY($5)) )" +
 	" AND ( $6::text[] IS NULL OR     type LIKE ANY($6)  )" +
 	" AND ( $7::text[] IS NULL OR NOT(type LIKE ANY($7)) )" +
-	" ORDER BY id ASC LIMIT $8"
+	" AND ( $8::bool IS NULL   OR     contains_url = $8  )" +
+	" ORDER BY id ASC LIMIT $9"
 
 const selectMaxEventIDSQL = "" +
 	"SELECT MAX(id) FROM syncapi_output_room_events"
 
+const selectMaxEventIDsForRoomsSQL = "" +
+	"SELECT room_id, MAX(id) FROM syncapi_output_room_events" +
+	" WHERE room_id = ANY($1) AND exclude_from_sync = FALSE" +
+	" GROUP BY room_id"
+
 const updateEventJSONSQL = "" +
 	"UPDATE syncapi_output_room_events SET headered_event_json=$1 WHERE event_id=$2"
 
@@ -172,6 +180,7 @@ type outputRoomEventsStatements struct {
 	selectEventsStmt              *sql.Stmt
 	selectEventsWitFilterStmt     *sql.Stmt
 	selectMaxEventIDStmt          *sql.Stmt
+	selectMaxEventIDsForRoomsStmt *sql.Stmt
 	selectRecentEventsStmt        *sql.Stmt
 	selectRecentEventsForSyncStmt *sql.Stmt
 	selectEarlyEventsStmt         *sql.Stmt
@@ -205,6 +214,7 @@ func NewPostgresEventsTable(db *sql.DB) (tables.Events, error) {
 		{&s.selectEventsStmt, selectEventsSQL},
 		{&s.selectEventsWitFilterStmt, selectEventsWithFilterSQL},
 		{&s.selectMaxEventIDStmt, selectMaxEventIDSQL},
+		{&s.selectMaxEventIDsForRoomsStmt, selectMaxEventIDsForRoomsSQL},
 		{&s.selectRecentEventsStmt, selectRecentEventsSQL},
 		{&s.selectRecentEventsForSyncStmt, selectRecentEventsForSyncSQL},
 		{&s.selectEarlyEventsStmt, selectEarlyEventsSQL},
@@ -325,6 +335,28 @@ func (s *outputRoomEventsStatements) SelectMaxEventID(
 	return
 }
 
+// SelectMaxEventIDsForRooms returns the position of the latest event in each of the rooms
+// which is not excluded from sync. Rooms without such events are left out.
+func (s *outputRoomEventsStatements) SelectMaxEventIDsForRooms(
+	ctx context.Context, txn *sql.Tx, roomIDs []string,
+) (map[string]types.StreamPosition, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectMaxEventIDsForRoomsStmt).QueryContext(ctx, pq.StringArray(roomIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectMaxEventIDsForRooms: rows.close() failed")
+	positions := make(map[string]types.StreamPosition, len(roomIDs))
+	for rows.Next() {
+		var roomID string
+		var pos types.StreamPosition
+		if err = rows.Scan(&roomID, &pos); err != nil {
+			return nil, err
+		}
+		positions[roomID] = pos
+	}
+	return positions, rows.Err()
+}
+
 // InsertEvent into the output_room_events table. addState and removeState are an optional list of state event IDs. Returns the position
 // of the inserted event.
 func (s *outputRoomEventsStatements) InsertEvent(
@@ -393,6 +425,7 @@ func (s *outputRoomEventsStatements) SelectRecentEvents(
 		pq.StringArray(notSenders),
 		pq.StringArray(filterConvertTypeWildcardToSQL(eventFilter.Types)),
 		pq.StringArray(filterConvertTypeWildcardToSQL(eventFilter.NotTypes)),
+		eventFilter.ContainsURL,
 		eventFilter.Limit+1,
 	)
 	if err != nil {
@@ -440,6 +473,7 @@ func (s *outputRoomEventsStatements) SelectEarlyEvents(
 		pq.StringArray(notSenders),
 		pq.StringArray(filterConvertTypeWildcardToSQL(eventFilter.Types)),
 		pq.StringArray(filterConvertTypeWildcardToSQL(eventFilter.NotTypes)),
+		eventFilter.ContainsURL,
 		eventFilter.Limit,
 	)
 	if err != nil {
@@ -19,6 +19,7 @@ import (
 	"database/sql"
 	"time"
 
+	"github.com/lib/pq"
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/syncapi/types"
@@ -74,7 +75,9 @@ const selectPresenceAfter = "" +
 	" SELECT id, user_id, presence, status_msg, last_active_ts" +
 	" FROM syncapi_presence" +
 	" WHERE id > $1 AND last_active_ts >= $2" +
-	" ORDER BY id ASC LIMIT $3"
+	" AND ( $3::text[] IS NULL OR user_id = ANY($3) )" +
+	" AND ( $4::text[] IS NULL OR NOT(user_id = ANY($4)) )" +
+	" ORDER BY id ASC LIMIT $5"
 
 type presenceStatements struct {
 	upsertPresenceStmt         *sql.Stmt
@@ -151,7 +154,12 @@ func (p *presenceStatements) GetPresenceAfter(
 	presences = make(map[string]*types.PresenceInternal)
 	stmt := sqlutil.TxStmt(txn, p.selectPresenceAfterStmt)
 	afterTS := gomatrixserverlib.AsTimestamp(time.Now().Add(time.Minute * -5))
-	rows, err := stmt.QueryContext(ctx, after, afterTS, filter.Limit)
+	rows, err := stmt.QueryContext(
+		ctx, after, afterTS,
+		pq.StringArray(filterValuesToSQL(filter.Senders)),
+		pq.StringArray(filterValuesToSQL(filter.NotSenders)),
+		filter.Limit,
+	)
 	if err != nil {
 		return nil, err
 	}
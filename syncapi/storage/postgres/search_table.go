@@ -0,0 +1,165 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/fulltext"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const searchSchema = `
+-- The full-text index of message bodies. The text is split into tokens by the
+-- server, the 'simple' configuration only lower-cases them.
+CREATE TABLE IF NOT EXISTS syncapi_search (
+	id BIGSERIAL PRIMARY KEY,
+	event_id TEXT NOT NULL UNIQUE,
+	room_id TEXT NOT NULL,
+	sender TEXT NOT NULL,
+	origin_server_ts BIGINT NOT NULL,
+	-- The history visibility of the room when the event was sent
+	history_visibility SMALLINT NOT NULL DEFAULT 2,
+	content TSVECTOR NOT NULL
+);
+CREATE INDEX IF NOT EXISTS syncapi_search_room_id_idx ON syncapi_search(room_id);
+CREATE INDEX IF NOT EXISTS syncapi_search_content_idx ON syncapi_search USING GIN(content);
+`
+
+const insertSearchEventSQL = "" +
+	"INSERT INTO syncapi_search (event_id, room_id, sender, origin_server_ts, history_visibility, content)" +
+	" VALUES ($1, $2, $3, $4, $5, to_tsvector('simple', $6))" +
+	" ON CONFLICT (event_id) DO NOTHING"
+
+const deleteSearchEventSQL = "" +
+	"DELETE FROM syncapi_search WHERE event_id = $1"
+
+const searchConditionsSQL = "" +
+	" WHERE content @@ query AND room_id = ANY($2)" +
+	" AND ( $3::text[] IS NULL OR     sender = ANY($3)  )" +
+	" AND ( $4::text[] IS NULL OR NOT(sender = ANY($4)) )"
+
+const selectSearchByRankSQL = "" +
+	"SELECT event_id, room_id, history_visibility, ts_rank(content, query) AS rank" +
+	" FROM syncapi_search, to_tsquery('simple', $1) query" + searchConditionsSQL +
+	" ORDER BY rank DESC, origin_server_ts DESC LIMIT $5 OFFSET $6"
+
+const selectSearchByRecentSQL = "" +
+	"SELECT event_id, room_id, history_visibility, ts_rank(content, query) AS rank" +
+	" FROM syncapi_search, to_tsquery('simple', $1) query" + searchConditionsSQL +
+	" ORDER BY origin_server_ts DESC, id DESC LIMIT $5 OFFSET $6"
+
+const selectSearchCountSQL = "" +
+	"SELECT COUNT(*) FROM syncapi_search, to_tsquery('simple', $1) query" + searchConditionsSQL
+
+type searchStatements struct {
+	insertSearchEventStmt    *sql.Stmt
+	deleteSearchEventStmt    *sql.Stmt
+	selectSearchByRankStmt   *sql.Stmt
+	selectSearchByRecentStmt *sql.Stmt
+	selectSearchCountStmt    *sql.Stmt
+}
+
+func NewPostgresSearchTable(db *sql.DB) (tables.Search, error) {
+	_, err := db.Exec(searchSchema)
+	if err != nil {
+		return nil, err
+	}
+	s := &searchStatements{}
+	return s, sqlutil.StatementList{
+		{&s.insertSearchEventStmt, insertSearchEventSQL},
+		{&s.deleteSearchEventStmt, deleteSearchEventSQL},
+		{&s.selectSearchByRankStmt, selectSearchByRankSQL},
+		{&s.selectSearchByRecentStmt, selectSearchByRecentSQL},
+		{&s.selectSearchCountStmt, selectSearchCountSQL},
+	}.Prepare(db)
+}
+
+func (s *searchStatements) InsertSearchEvent(
+	ctx context.Context, txn *sql.Tx, eventID, roomID, sender string, ts gomatrixserverlib.Timestamp,
+	historyVisibility gomatrixserverlib.HistoryVisibility, text string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.insertSearchEventStmt).ExecContext(
+		ctx, eventID, roomID, sender, ts, historyVisibility, fulltext.Document(text),
+	)
+	return err
+}
+
+func (s *searchStatements) DeleteSearchEvent(
+	ctx context.Context, txn *sql.Tx, eventID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteSearchEventStmt).ExecContext(ctx, eventID)
+	return err
+}
+
+func (s *searchStatements) SelectSearch(
+	ctx context.Context, txn *sql.Tx, phrases []fulltext.Phrase, roomIDs []string,
+	filter *gomatrixserverlib.RoomEventFilter, orderByRank bool, limit, offset int,
+) ([]types.SearchResult, int, error) {
+	if len(phrases) == 0 || len(roomIDs) == 0 {
+		return nil, 0, nil
+	}
+	query := tsQuery(phrases)
+	senders, notSenders := getSendersRoomEventFilter(filter)
+	var count int
+	err := sqlutil.TxStmt(txn, s.selectSearchCountStmt).QueryRowContext(
+		ctx, query, pq.StringArray(roomIDs), pq.StringArray(senders), pq.StringArray(notSenders),
+	).Scan(&count)
+	if err != nil || count == 0 {
+		return nil, 0, err
+	}
+
+	stmt := s.selectSearchByRecentStmt
+	if orderByRank {
+		stmt = s.selectSearchByRankStmt
+	}
+	rows, err := sqlutil.TxStmt(txn, stmt).QueryContext(
+		ctx, query, pq.StringArray(roomIDs), pq.StringArray(senders), pq.StringArray(notSenders), limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectSearch: rows.close() failed")
+	var results []types.SearchResult
+	for rows.Next() {
+		var result types.SearchResult
+		if err = rows.Scan(&result.EventID, &result.RoomID, &result.HistoryVisibility, &result.Rank); err != nil {
+			return nil, 0, err
+		}
+		results = append(results, result)
+	}
+	return results, count, rows.Err()
+}
+
+// tsQuery returns the text search query matching events which contain all phrases.
+// The tokens only consist of letters and digits, so they need no escaping.
+func tsQuery(phrases []fulltext.Phrase) string {
+	parts := make([]string, len(phrases))
+	for i, phrase := range phrases {
+		tokens := make([]string, len(phrase))
+		for j, token := range phrase {
+			tokens[j] = "'" + token + "'"
+		}
+		parts[i] = "(" + strings.Join(tokens, " <-> ") + ")"
+	}
+	return strings.Join(parts, " & ")
+}
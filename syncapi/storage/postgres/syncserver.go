@@ -89,10 +89,30 @@ func NewDatabase(base *base.BaseDendrite, dbProperties *config.DatabaseOptions)
 	if err != nil {
 		return nil, err
 	}
+	unreadCounts, err := NewPostgresUnreadCountsTable(d.db)
+	if err != nil {
+		return nil, err
+	}
 	ignores, err := NewPostgresIgnoresTable(d.db)
 	if err != nil {
 		return nil, err
 	}
+	search, err := NewPostgresSearchTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	relations, err := NewPostgresRelationsTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	redactedEvents, err := NewPostgresRedactedEventsTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	eventHistoryAudit, err := NewPostgresEventHistoryAuditTable(d.db)
+	if err != nil {
+		return nil, err
+	}
 	presence, err := NewPostgresPresenceTable(d.db)
 	if err != nil {
 		return nil, err
@@ -112,8 +132,13 @@ func NewDatabase(base *base.BaseDendrite, dbProperties *config.DatabaseOptions)
 		Receipts:            receipts,
 		Memberships:         memberships,
 		NotificationData:    notificationData,
+		UnreadCounts:        unreadCounts,
 		Ignores:             ignores,
 		Presence:            presence,
+		Search:              search,
+		Relations:           relations,
+		RedactedEvents:      redactedEvents,
+		EventHistoryAudit:   eventHistoryAudit,
 	}
 	return &d, nil
 }
@@ -0,0 +1,164 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+// The stream positions come from the notification data sequence, so
+// this schema must be created after syncapi_notification_data.
+const unreadCountsSchema = `
+-- Stores the unread counts of users for each thread of a room.
+CREATE TABLE IF NOT EXISTS syncapi_unread_counts (
+	-- The stream position of the latest change
+	id BIGINT NOT NULL,
+	user_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	-- The root event of the thread, empty for the main timeline
+	thread_id TEXT NOT NULL DEFAULT '',
+	-- The number of unread messages (MSC2654)
+	unread_count BIGINT NOT NULL DEFAULT 0,
+	notification_count BIGINT NOT NULL DEFAULT 0,
+	highlight_count BIGINT NOT NULL DEFAULT 0,
+	-- The stream position of the latest event which was counted
+	latest_event_id BIGINT NOT NULL DEFAULT 0,
+	CONSTRAINT syncapi_unread_counts_unique UNIQUE (user_id, room_id, thread_id)
+);
+CREATE INDEX IF NOT EXISTS syncapi_unread_counts_user_id_idx ON syncapi_unread_counts(user_id, id);
+`
+
+const upsertUnreadCountsSQL = "" +
+	"WITH pos AS (SELECT nextval('syncapi_notification_data_id_seq') AS id)" +
+	" INSERT INTO syncapi_unread_counts (id, user_id, room_id, thread_id, latest_event_id, unread_count, notification_count, highlight_count)" +
+	" SELECT pos.id, user_id, $2, $3, $4::BIGINT, $5::BIGINT, $6::BIGINT, $7::BIGINT FROM pos, UNNEST($1::TEXT[]) AS user_id WHERE TRUE" +
+	" ON CONFLICT (user_id, room_id, thread_id) DO UPDATE SET" +
+	" id = EXCLUDED.id," +
+	" latest_event_id = GREATEST(syncapi_unread_counts.latest_event_id, EXCLUDED.latest_event_id)," +
+	" unread_count = syncapi_unread_counts.unread_count + EXCLUDED.unread_count," +
+	" notification_count = syncapi_unread_counts.notification_count + EXCLUDED.notification_count," +
+	" highlight_count = syncapi_unread_counts.highlight_count + EXCLUDED.highlight_count" +
+	" RETURNING id"
+
+const updateUnreadCountsSQL = "" +
+	"UPDATE syncapi_unread_counts SET id = nextval('syncapi_notification_data_id_seq')," +
+	" unread_count = $4, notification_count = $5, highlight_count = $6" +
+	" WHERE user_id = $1 AND room_id = $2 AND thread_id = $3" +
+	" AND ( unread_count <> $4 OR notification_count <> $5 OR highlight_count <> $6 )" +
+	" RETURNING id"
+
+const selectRoomUnreadCountsSQL = "" +
+	"SELECT id, room_id, thread_id, latest_event_id, unread_count, notification_count, highlight_count" +
+	" FROM syncapi_unread_counts WHERE user_id = $1 AND room_id = $2"
+
+const selectUserUnreadCountsSQL = "" +
+	"SELECT id, room_id, thread_id, latest_event_id, unread_count, notification_count, highlight_count" +
+	" FROM syncapi_unread_counts WHERE user_id = $1" +
+	" AND ( unread_count > 0 OR notification_count > 0 OR highlight_count > 0 OR id > $2 )"
+
+const selectMaxUnreadCountsIDSQL = "" +
+	"SELECT COALESCE(MAX(id), 0) FROM syncapi_unread_counts"
+
+type unreadCountsStatements struct {
+	upsertUnreadCountsStmt      *sql.Stmt
+	updateUnreadCountsStmt      *sql.Stmt
+	selectRoomUnreadCountsStmt  *sql.Stmt
+	selectUserUnreadCountsStmt  *sql.Stmt
+	selectMaxUnreadCountsIDStmt *sql.Stmt
+}
+
+func NewPostgresUnreadCountsTable(db *sql.DB) (tables.UnreadCounts, error) {
+	_, err := db.Exec(unreadCountsSchema)
+	if err != nil {
+		return nil, err
+	}
+	s := &unreadCountsStatements{}
+	return s, sqlutil.StatementList{
+		{&s.upsertUnreadCountsStmt, upsertUnreadCountsSQL},
+		{&s.updateUnreadCountsStmt, updateUnreadCountsSQL},
+		{&s.selectRoomUnreadCountsStmt, selectRoomUnreadCountsSQL},
+		{&s.selectUserUnreadCountsStmt, selectUserUnreadCountsSQL},
+		{&s.selectMaxUnreadCountsIDStmt, selectMaxUnreadCountsIDSQL},
+	}.Prepare(db)
+}
+
+func (s *unreadCountsStatements) UpsertUnreadCounts(
+	ctx context.Context, txn *sql.Tx, userIDs []string, roomID, threadID string,
+	eventPos types.StreamPosition, unread, notifications, highlights int,
+) (pos types.StreamPosition, err error) {
+	// Every row gets the same position, so any of them will do.
+	err = sqlutil.TxStmt(txn, s.upsertUnreadCountsStmt).QueryRowContext(
+		ctx, pq.StringArray(userIDs), roomID, threadID, eventPos, unread, notifications, highlights,
+	).Scan(&pos)
+	return
+}
+
+func (s *unreadCountsStatements) UpdateUnreadCounts(
+	ctx context.Context, txn *sql.Tx, userID, roomID, threadID string,
+	unread, notifications, highlights int,
+) (pos types.StreamPosition, err error) {
+	err = sqlutil.TxStmt(txn, s.updateUnreadCountsStmt).QueryRowContext(
+		ctx, userID, roomID, threadID, unread, notifications, highlights,
+	).Scan(&pos)
+	return
+}
+
+func (s *unreadCountsStatements) SelectRoomUnreadCounts(
+	ctx context.Context, txn *sql.Tx, userID, roomID string,
+) ([]types.UnreadCounts, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectRoomUnreadCountsStmt).QueryContext(ctx, userID, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectRoomUnreadCounts: rows.close() failed")
+	return rowsToUnreadCounts(rows)
+}
+
+func (s *unreadCountsStatements) SelectUserUnreadCounts(
+	ctx context.Context, txn *sql.Tx, userID string, after types.StreamPosition,
+) ([]types.UnreadCounts, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectUserUnreadCountsStmt).QueryContext(ctx, userID, after)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectUserUnreadCounts: rows.close() failed")
+	return rowsToUnreadCounts(rows)
+}
+
+func (s *unreadCountsStatements) SelectMaxUnreadCountsID(
+	ctx context.Context, txn *sql.Tx,
+) (id types.StreamPosition, err error) {
+	err = sqlutil.TxStmt(txn, s.selectMaxUnreadCountsIDStmt).QueryRowContext(ctx).Scan(&id)
+	return
+}
+
+func rowsToUnreadCounts(rows *sql.Rows) ([]types.UnreadCounts, error) {
+	var counts []types.UnreadCounts
+	for rows.Next() {
+		var c types.UnreadCounts
+		if err := rows.Scan(&c.StreamPos, &c.RoomID, &c.ThreadID, &c.LatestPosition, &c.UnreadCount, &c.NotificationCount, &c.HighlightCount); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
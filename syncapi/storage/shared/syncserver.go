@@ -19,16 +19,20 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"math"
+	"time"
 
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 
 	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/internal/fulltext"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/syncapi/storage/tables"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
 )
 
 // Database is a temporary struct until we have made syncserver.go the same for both pq/sqlite
@@ -48,8 +52,13 @@ type Database struct {
 	Receipts            tables.Receipts
 	Memberships         tables.Memberships
 	NotificationData    tables.NotificationData
+	UnreadCounts        tables.UnreadCounts
 	Ignores             tables.Ignores
 	Presence            tables.Presence
+	Search              tables.Search
+	Relations           tables.Relations
+	RedactedEvents      tables.RedactedEvents
+	EventHistoryAudit   tables.EventHistoryAudit
 }
 
 func (d *Database) readOnlySnapshot(ctx context.Context) (*sql.Tx, error) {
@@ -109,9 +118,25 @@ func (d *Database) MaxStreamPositionForNotificationData(ctx context.Context) (ty
 	if err != nil {
 		return 0, fmt.Errorf("d.NotificationData.SelectMaxID: %w", err)
 	}
+	// The unread counts share the stream positions of the notification data.
+	countsID, err := d.UnreadCounts.SelectMaxUnreadCountsID(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("d.UnreadCounts.SelectMaxUnreadCountsID: %w", err)
+	}
+	if countsID > types.StreamPosition(id) {
+		return countsID, nil
+	}
 	return types.StreamPosition(id), nil
 }
 
+func (d *Database) MaxStreamPositionsForRooms(ctx context.Context, roomIDs []string) (map[string]types.StreamPosition, error) {
+	positions, err := d.OutputEvents.SelectMaxEventIDsForRooms(ctx, nil, roomIDs)
+	if err != nil {
+		return nil, fmt.Errorf("d.OutputEvents.SelectMaxEventIDsForRooms: %w", err)
+	}
+	return positions, nil
+}
+
 func (d *Database) CurrentState(ctx context.Context, roomID string, stateFilterPart *gomatrixserverlib.StateFilter, excludeEventIDs []string) ([]*gomatrixserverlib.HeaderedEvent, error) {
 	return d.CurrentRoomState.SelectCurrentState(ctx, nil, roomID, stateFilterPart, excludeEventIDs)
 }
@@ -273,8 +298,9 @@ func (d *Database) DeletePeeks(
 func (d *Database) GetAccountDataInRange(
 	ctx context.Context, userID string, r types.Range,
 	accountDataFilterPart *gomatrixserverlib.EventFilter,
+	roomAccountDataFilterPart *gomatrixserverlib.RoomEventFilter,
 ) (map[string][]string, types.StreamPosition, error) {
-	return d.AccountData.SelectAccountDataInRange(ctx, userID, r, accountDataFilterPart)
+	return d.AccountData.SelectAccountDataInRange(ctx, userID, r, accountDataFilterPart, roomAccountDataFilterPart)
 }
 
 // UpsertAccountData keeps track of new or updated account data, by saving the type
@@ -388,6 +414,10 @@ func (d *Database) WriteEvent(
 			return fmt.Errorf("d.handleBackwardExtremities: %w", err)
 		}
 
+		if err = d.insertRelation(ctx, txn, ev, pos); err != nil {
+			return fmt.Errorf("d.insertRelation: %w", err)
+		}
+
 		if len(addStateEvents) == 0 && len(removeStateEventIDs) == 0 {
 			// Nothing to do, the event may have just been a message event.
 			return nil
@@ -401,6 +431,20 @@ func (d *Database) WriteEvent(
 	return pduPosition, returnErr
 }
 
+// insertRelation records the relation of the event to another event, if its content has an
+// m.relates_to with a rel_type. Replies only have an m.in_reply_to, so they aren't recorded.
+// This function should always be called within a sqlutil.Writer for safety in SQLite.
+func (d *Database) insertRelation(ctx context.Context, txn *sql.Tx, ev *gomatrixserverlib.HeaderedEvent, pos types.StreamPosition) error {
+	relatesTo := gjson.GetBytes(ev.Content(), `m\.relates_to`)
+	relType, eventID := relatesTo.Get("rel_type").Str, relatesTo.Get("event_id").Str
+	if relType == "" || eventID == "" {
+		return nil
+	}
+	return d.Relations.InsertRelation(
+		ctx, txn, pos, ev.RoomID(), eventID, ev.EventID(), ev.Type(), relType, ev.Sender(), relatesTo.Get("key").Str,
+	)
+}
+
 // This function should always be called within a sqlutil.Writer for safety in SQLite.
 func (d *Database) updateRoomState(
 	ctx context.Context, txn *sql.Tx,
@@ -524,13 +568,13 @@ func (d *Database) StreamToTopologicalPosition(
 }
 
 func (d *Database) GetFilter(
-	ctx context.Context, target *gomatrixserverlib.Filter, localpart string, filterID string,
+	ctx context.Context, target *types.Filter, localpart string, filterID string,
 ) error {
 	return d.Filter.SelectFilter(ctx, target, localpart, filterID)
 }
 
 func (d *Database) PutFilter(
-	ctx context.Context, localpart string, filter *gomatrixserverlib.Filter,
+	ctx context.Context, localpart string, filter *types.Filter,
 ) (string, error) {
 	var filterID string
 	var err error
@@ -541,7 +585,7 @@ func (d *Database) PutFilter(
 	return filterID, err
 }
 
-func (d *Database) RedactEvent(ctx context.Context, redactedEventID string, redactedBecause *gomatrixserverlib.HeaderedEvent) error {
+func (d *Database) RedactEvent(ctx context.Context, redactedEventID string, redactedBecause *gomatrixserverlib.HeaderedEvent, keepOriginal bool) error {
 	redactedEvents, err := d.Events(ctx, []string{redactedEventID})
 	if err != nil {
 		return err
@@ -550,6 +594,12 @@ func (d *Database) RedactEvent(ctx context.Context, redactedEventID string, reda
 		logrus.WithField("event_id", redactedEventID).WithField("redaction_event", redactedBecause.EventID()).Warnf("missing redacted event for redaction")
 		return nil
 	}
+	var original *types.RedactedEvent
+	if keepOriginal && !gjson.GetBytes(redactedEvents[0].Unsigned(), "redacted_because").Exists() {
+		if original, err = originalOfRedactedEvent(redactedEvents[0], redactedBecause); err != nil {
+			return fmt.Errorf("originalOfRedactedEvent: %w", err)
+		}
+	}
 	eventToRedact := redactedEvents[0].Unwrap()
 	redactionEvent := redactedBecause.Unwrap()
 	if err = eventutil.RedactEvent(redactionEvent, eventToRedact); err != nil {
@@ -558,11 +608,74 @@ func (d *Database) RedactEvent(ctx context.Context, redactedEventID string, reda
 
 	newEvent := eventToRedact.Headered(redactedBecause.RoomVersion)
 	err = d.Writer.Do(nil, nil, func(txn *sql.Tx) error {
+		// the redaction removes m.relates_to, so the event doesn't relate to anything anymore
+		if err = d.Relations.DeleteRelation(ctx, txn, newEvent.RoomID(), newEvent.EventID()); err != nil {
+			return fmt.Errorf("d.Relations.DeleteRelation: %w", err)
+		}
+		if original != nil {
+			if err = d.RedactedEvents.InsertRedactedEvent(ctx, txn, original); err != nil {
+				return fmt.Errorf("d.RedactedEvents.InsertRedactedEvent: %w", err)
+			}
+		}
 		return d.OutputEvents.UpdateEventJSON(ctx, newEvent)
 	})
 	return err
 }
 
+// originalOfRedactedEvent copies the event before it is redacted, as the redaction
+// happens in place.
+func originalOfRedactedEvent(ev, redactedBecause *gomatrixserverlib.HeaderedEvent) (*types.RedactedEvent, error) {
+	eventJSON, err := json.Marshal(ev)
+	if err != nil {
+		return nil, err
+	}
+	original := &types.RedactedEvent{
+		Event:      &gomatrixserverlib.HeaderedEvent{},
+		RedactedBy: redactedBecause.EventID(),
+		Redacter:   redactedBecause.Sender(),
+		RedactedTS: gomatrixserverlib.AsTimestamp(time.Now()),
+	}
+	if err = json.Unmarshal(eventJSON, original.Event); err != nil {
+		return nil, err
+	}
+	relatesTo := gjson.GetBytes(ev.Content(), `m\.relates_to`)
+	if relatesTo.Get("rel_type").Str == "m.replace" {
+		original.ReplacesEventID = relatesTo.Get("event_id").Str
+	}
+	return original, nil
+}
+
+// RedactedEvent returns the original version of the redacted event, or nil if it isn't kept.
+func (d *Database) RedactedEvent(ctx context.Context, eventID string) (*types.RedactedEvent, error) {
+	return d.RedactedEvents.SelectRedactedEvent(ctx, nil, eventID)
+}
+
+// RedactedEditsFor returns the original versions of the redacted edits of the event which are kept.
+func (d *Database) RedactedEditsFor(ctx context.Context, roomID, eventID string) ([]*types.RedactedEvent, error) {
+	return d.RedactedEvents.SelectRedactedEdits(ctx, nil, roomID, eventID)
+}
+
+// PurgeRedactedEvents forgets the original versions of the events redacted before the time.
+func (d *Database) PurgeRedactedEvents(ctx context.Context, before gomatrixserverlib.Timestamp) (purged int64, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		purged, err = d.RedactedEvents.DeleteRedactedEventsBefore(ctx, txn, before)
+		return err
+	})
+	return
+}
+
+// StoreEventHistoryAudit records that a user looked at the history of an event.
+func (d *Database) StoreEventHistoryAudit(ctx context.Context, entry *types.EventHistoryAuditEntry) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.EventHistoryAudit.InsertEventHistoryAudit(ctx, txn, entry)
+	})
+}
+
+// EventHistoryAuditFor returns up to limit entries of the history audit log of the room, newest first.
+func (d *Database) EventHistoryAuditFor(ctx context.Context, roomID string, limit int) ([]types.EventHistoryAuditEntry, error) {
+	return d.EventHistoryAudit.SelectEventHistoryAudit(ctx, nil, roomID, limit)
+}
+
 // Retrieve the backward topology position, i.e. the position of the
 // oldest event in the room's topology.
 func (d *Database) GetBackwardTopologyPos(
@@ -1039,6 +1152,209 @@ func (d *Database) GetUserUnreadNotificationCounts(ctx context.Context, userID s
 	return d.NotificationData.SelectUserUnreadCounts(ctx, userID, from, to)
 }
 
+// maxUnreadRecount is the number of events after a read receipt which are looked at
+// to recount the unread messages. Beyond that the counts are left as they are.
+const maxUnreadRecount = 1000
+
+// unreadThreadID returns the root event of the thread the event is in, or an empty
+// string for the main timeline.
+func unreadThreadID(ev *gomatrixserverlib.HeaderedEvent) string {
+	relatesTo := gjson.GetBytes(ev.Content(), `m\.relates_to`)
+	if relatesTo.Get("rel_type").Str != "m.thread" {
+		return ""
+	}
+	return relatesTo.Get("event_id").Str
+}
+
+// countsAsUnread returns whether the event is an unread message for users other than
+// its sender. Following MSC2654 these are messages, encrypted events and stickers, but
+// not notices, edits or state events.
+func countsAsUnread(ev *gomatrixserverlib.HeaderedEvent) bool {
+	if ev.StateKey() != nil {
+		return false
+	}
+	switch ev.Type() {
+	case "m.room.message":
+		if gjson.GetBytes(ev.Content(), "msgtype").Str == "m.notice" {
+			return false
+		}
+	case "m.room.encrypted", "m.sticker":
+	default:
+		return false
+	}
+	return gjson.GetBytes(ev.Content(), `m\.relates_to.rel_type`).Str != "m.replace"
+}
+
+// UpdateUnreadCountsForEvent counts the new event as unread for the users. The sender,
+// who has implicitly read it, has the counts of its thread cleared instead. Returns the
+// latest stream position of the changes, or zero if nothing changed.
+func (d *Database) UpdateUnreadCountsForEvent(
+	ctx context.Context, ev *gomatrixserverlib.HeaderedEvent, pos types.StreamPosition, userIDs []string,
+) (latest types.StreamPosition, err error) {
+	threadID := unreadThreadID(ev)
+	senderIsUser := false
+	var unreadFor []string
+	seen := make(map[string]struct{}, len(userIDs))
+	for _, userID := range userIDs {
+		if _, ok := seen[userID]; ok {
+			continue
+		}
+		seen[userID] = struct{}{}
+		if userID == ev.Sender() {
+			senderIsUser = true
+		} else {
+			unreadFor = append(unreadFor, userID)
+		}
+	}
+	if !countsAsUnread(ev) {
+		unreadFor = nil
+	}
+	if !senderIsUser && len(unreadFor) == 0 {
+		return 0, nil
+	}
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		if senderIsUser {
+			changed, err := d.UnreadCounts.UpdateUnreadCounts(ctx, txn, ev.Sender(), ev.RoomID(), threadID, 0, 0, 0)
+			if err != nil && err != sql.ErrNoRows {
+				return fmt.Errorf("d.UnreadCounts.UpdateUnreadCounts: %w", err)
+			}
+			latest = changed
+		}
+		if len(unreadFor) > 0 {
+			changed, err := d.UnreadCounts.UpsertUnreadCounts(ctx, txn, unreadFor, ev.RoomID(), threadID, pos, 1, 0, 0)
+			if err != nil {
+				return fmt.Errorf("d.UnreadCounts.UpsertUnreadCounts: %w", err)
+			}
+			if changed > latest {
+				latest = changed
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// UpdateUnreadNotificationCountsForEvent counts the event, which the push rules of the user
+// notified them about, in the notification counts of its thread. Returns zero if the event
+// isn't known.
+func (d *Database) UpdateUnreadNotificationCountsForEvent(
+	ctx context.Context, userID, eventID string, highlight bool,
+) (pos types.StreamPosition, err error) {
+	events, err := d.OutputEvents.SelectEvents(ctx, nil, []string{eventID}, nil, false)
+	if err != nil {
+		return 0, fmt.Errorf("d.OutputEvents.SelectEvents: %w", err)
+	}
+	if len(events) == 0 {
+		return 0, nil
+	}
+	ev := events[0]
+	highlights := 0
+	if highlight {
+		highlights = 1
+	}
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		pos, err = d.UnreadCounts.UpsertUnreadCounts(
+			ctx, txn, []string{userID}, ev.RoomID(), unreadThreadID(ev.HeaderedEvent), ev.StreamPosition, 0, 1, highlights,
+		)
+		return err
+	})
+	return
+}
+
+// MarkUnreadCountsRead clears the unread counts of the user in the room up to the event
+// they sent a read receipt for. Threads with later events have their unread messages
+// recounted, but keep their notification counts since the push rules aren't known here.
+// Returns the latest stream position of the changes, or zero if nothing changed.
+func (d *Database) MarkUnreadCountsRead(
+	ctx context.Context, userID, roomID, eventID string,
+) (latest types.StreamPosition, err error) {
+	events, err := d.OutputEvents.SelectEvents(ctx, nil, []string{eventID}, nil, false)
+	if err != nil {
+		return 0, fmt.Errorf("d.OutputEvents.SelectEvents: %w", err)
+	}
+	if len(events) == 0 {
+		return 0, nil
+	}
+	readPos := events[0].StreamPosition
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		counts, err := d.UnreadCounts.SelectRoomUnreadCounts(ctx, txn, userID, roomID)
+		if err != nil {
+			return fmt.Errorf("d.UnreadCounts.SelectRoomUnreadCounts: %w", err)
+		}
+		var unread map[string]int
+		for _, c := range counts {
+			var changed types.StreamPosition
+			if c.LatestPosition <= readPos {
+				changed, err = d.UnreadCounts.UpdateUnreadCounts(ctx, txn, userID, roomID, c.ThreadID, 0, 0, 0)
+			} else {
+				if unread == nil {
+					if unread, err = d.recountUnread(ctx, txn, userID, roomID, readPos, counts); err != nil {
+						return fmt.Errorf("d.recountUnread: %w", err)
+					}
+				}
+				count, ok := unread[c.ThreadID]
+				if !ok {
+					continue
+				}
+				changed, err = d.UnreadCounts.UpdateUnreadCounts(ctx, txn, userID, roomID, c.ThreadID, count, c.NotificationCount, c.HighlightCount)
+			}
+			if err == sql.ErrNoRows {
+				continue
+			} else if err != nil {
+				return fmt.Errorf("d.UnreadCounts.UpdateUnreadCounts: %w", err)
+			}
+			if changed > latest {
+				latest = changed
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// recountUnread counts the unread messages of the user in each thread of the room
+// after the position, up to the latest counted event. Threads are missing from the
+// result if there were too many events to count.
+func (d *Database) recountUnread(
+	ctx context.Context, txn *sql.Tx, userID, roomID string,
+	after types.StreamPosition, counts []types.UnreadCounts,
+) (map[string]int, error) {
+	r := types.Range{From: after}
+	for _, c := range counts {
+		if c.LatestPosition > r.To {
+			r.To = c.LatestPosition
+		}
+	}
+	filter := gomatrixserverlib.RoomEventFilter{Limit: maxUnreadRecount}
+	events, limited, err := d.OutputEvents.SelectRecentEvents(ctx, txn, roomID, r, &filter, true, false)
+	if err != nil {
+		return nil, err
+	}
+	unread := map[string]int{}
+	if limited {
+		return unread, nil
+	}
+	for _, c := range counts {
+		unread[c.ThreadID] = 0
+	}
+	for _, ev := range events {
+		threadID := unreadThreadID(ev.HeaderedEvent)
+		switch {
+		case ev.Sender() == userID:
+			unread[threadID] = 0
+		case countsAsUnread(ev.HeaderedEvent):
+			unread[threadID]++
+		}
+	}
+	return unread, nil
+}
+
+// GetUserUnreadCounts returns the unread counts of the user which aren't zero or
+// which changed after the position.
+func (d *Database) GetUserUnreadCounts(ctx context.Context, userID string, after types.StreamPosition) ([]types.UnreadCounts, error) {
+	return d.UnreadCounts.SelectUserUnreadCounts(ctx, nil, userID, after)
+}
+
 func (s *Database) SelectContextEvent(ctx context.Context, roomID, eventID string) (int, gomatrixserverlib.HeaderedEvent, error) {
 	return s.OutputEvents.SelectContextEvent(ctx, nil, roomID, eventID)
 }
@@ -1058,6 +1374,29 @@ func (s *Database) UpdateIgnoresForUser(ctx context.Context, userID string, igno
 	return s.Ignores.UpsertIgnores(ctx, userID, ignores)
 }
 
+func (s *Database) IndexEventForSearch(
+	ctx context.Context, event *gomatrixserverlib.HeaderedEvent, historyVisibility gomatrixserverlib.HistoryVisibility, text string,
+) error {
+	return s.Writer.Do(s.DB, nil, func(txn *sql.Tx) error {
+		return s.Search.InsertSearchEvent(
+			ctx, txn, event.EventID(), event.RoomID(), event.Sender(), event.OriginServerTS(), historyVisibility, text,
+		)
+	})
+}
+
+func (s *Database) RemoveEventFromSearch(ctx context.Context, eventID string) error {
+	return s.Writer.Do(s.DB, nil, func(txn *sql.Tx) error {
+		return s.Search.DeleteSearchEvent(ctx, txn, eventID)
+	})
+}
+
+func (s *Database) SearchEvents(
+	ctx context.Context, phrases []fulltext.Phrase, roomIDs []string, filter *gomatrixserverlib.RoomEventFilter,
+	orderByRank bool, limit, offset int,
+) ([]types.SearchResult, int, error) {
+	return s.Search.SelectSearch(ctx, nil, phrases, roomIDs, filter, orderByRank, limit, offset)
+}
+
 func (s *Database) UpdatePresence(ctx context.Context, userID string, presence types.Presence, statusMsg *string, lastActiveTS gomatrixserverlib.Timestamp, fromSync bool) (types.StreamPosition, error) {
 	return s.Presence.UpsertPresence(ctx, nil, userID, statusMsg, presence, lastActiveTS, fromSync)
 }
@@ -1073,3 +1412,181 @@ func (s *Database) PresenceAfter(ctx context.Context, after types.StreamPosition
 func (s *Database) MaxStreamPositionForPresence(ctx context.Context) (types.StreamPosition, error) {
 	return s.Presence.GetMaxPresenceID(ctx, nil)
 }
+
+func (s *Database) RelationsFor(
+	ctx context.Context, roomID, eventID, relType, eventType string,
+	from, to types.StreamPosition, backwards bool, limit int,
+) ([]types.StreamEvent, types.StreamPosition, error) {
+	// The high end of a range is inclusive, whereas both positions are exclusive here.
+	r := types.Range{From: from, To: to, Backwards: backwards}
+	if backwards {
+		if r.From == 0 {
+			r.From = math.MaxInt64
+		}
+		r.From--
+	} else {
+		if r.To == 0 {
+			r.To = math.MaxInt64
+		}
+		r.To--
+	}
+	entries, err := s.Relations.SelectRelationsInRange(ctx, nil, roomID, eventID, relType, eventType, r, limit)
+	if err != nil {
+		return nil, 0, fmt.Errorf("s.Relations.SelectRelationsInRange: %w", err)
+	}
+	if len(entries) == 0 {
+		return nil, 0, nil
+	}
+	eventIDs := make([]string, len(entries))
+	for i := range entries {
+		eventIDs[i] = entries[i].ChildEventID
+	}
+	events, err := s.OutputEvents.SelectEvents(ctx, nil, eventIDs, &gomatrixserverlib.RoomEventFilter{Limit: len(eventIDs)}, true)
+	if err != nil {
+		return nil, 0, fmt.Errorf("s.OutputEvents.SelectEvents: %w", err)
+	}
+	var next types.StreamPosition
+	if len(entries) == limit {
+		next = entries[len(entries)-1].Position
+	}
+	return events, next, nil
+}
+
+func (s *Database) ThreadsFor(
+	ctx context.Context, roomID, participant string, from types.StreamPosition, limit int,
+) ([]types.StreamEvent, types.StreamPosition, error) {
+	if from == 0 {
+		from = math.MaxInt64
+	}
+	threads, err := s.Relations.SelectThreads(ctx, nil, roomID, participant, from, limit)
+	if err != nil {
+		return nil, 0, fmt.Errorf("s.Relations.SelectThreads: %w", err)
+	}
+	if len(threads) == 0 {
+		return nil, 0, nil
+	}
+	eventIDs := make([]string, len(threads))
+	for i := range threads {
+		eventIDs[i] = threads[i].RootEventID
+	}
+	events, err := s.OutputEvents.SelectEvents(ctx, nil, eventIDs, &gomatrixserverlib.RoomEventFilter{Limit: len(eventIDs)}, true)
+	if err != nil {
+		return nil, 0, fmt.Errorf("s.OutputEvents.SelectEvents: %w", err)
+	}
+	var next types.StreamPosition
+	if len(threads) == limit {
+		next = threads[len(threads)-1].LatestPosition
+	}
+	return events, next, nil
+}
+
+// BundleAggregations adds the counts of annotations, the latest edit by the sender of the
+// event and a summary of the thread rooted at the event to unsigned m.relations.
+func (s *Database) BundleAggregations(
+	ctx context.Context, userID string, events []*gomatrixserverlib.HeaderedEvent,
+) error {
+	if len(events) == 0 {
+		return nil
+	}
+	eventIDs := map[string][]string{} // room ID -> event IDs
+	senders := make(map[string]string, len(events))
+	for _, ev := range events {
+		eventIDs[ev.RoomID()] = append(eventIDs[ev.RoomID()], ev.EventID())
+		senders[ev.EventID()] = ev.Sender()
+	}
+
+	aggregations := map[string]*types.Aggregations{}
+	aggregationsFor := func(eventID string) *types.Aggregations {
+		if _, ok := aggregations[eventID]; !ok {
+			aggregations[eventID] = &types.Aggregations{}
+		}
+		return aggregations[eventID]
+	}
+	edits := map[string]string{}         // event ID -> latest edit
+	latestReplies := map[string]string{} // event ID -> latest reply in the thread
+	for roomID, ids := range eventIDs {
+		counts, err := s.Relations.SelectAnnotationCounts(ctx, nil, roomID, ids)
+		if err != nil {
+			return fmt.Errorf("s.Relations.SelectAnnotationCounts: %w", err)
+		}
+		for _, count := range counts {
+			aggregation := aggregationsFor(count.EventID)
+			if aggregation.Annotation == nil {
+				aggregation.Annotation = &types.AnnotationAggregation{}
+			}
+			aggregation.Annotation.Chunk = append(aggregation.Annotation.Chunk, types.AnnotationAggregationEntry{
+				Type:  count.Type,
+				Key:   count.Key,
+				Count: count.Count,
+			})
+		}
+
+		replacements, err := s.Relations.SelectRelationsOfType(ctx, nil, roomID, ids, "m.replace")
+		if err != nil {
+			return fmt.Errorf("s.Relations.SelectRelationsOfType: %w", err)
+		}
+		for _, replacement := range replacements {
+			// Only the sender may edit an event. The replacements are oldest first,
+			// so the latest one wins.
+			if replacement.Sender == senders[replacement.EventID] {
+				edits[replacement.EventID] = replacement.ChildEventID
+			}
+		}
+
+		summaries, err := s.Relations.SelectThreadSummaries(ctx, nil, roomID, ids, userID)
+		if err != nil {
+			return fmt.Errorf("s.Relations.SelectThreadSummaries: %w", err)
+		}
+		for _, summary := range summaries {
+			aggregationsFor(summary.RootEventID).Thread = &types.ThreadAggregation{
+				Count:                   summary.Count,
+				CurrentUserParticipated: summary.Participated || senders[summary.RootEventID] == userID,
+			}
+			latestReplies[summary.RootEventID] = summary.LatestEventID
+		}
+	}
+
+	relatedIDs := make([]string, 0, len(edits)+len(latestReplies))
+	for _, eventID := range edits {
+		relatedIDs = append(relatedIDs, eventID)
+	}
+	for _, eventID := range latestReplies {
+		relatedIDs = append(relatedIDs, eventID)
+	}
+	if len(relatedIDs) > 0 {
+		related, err := s.OutputEvents.SelectEvents(ctx, nil, relatedIDs, &gomatrixserverlib.RoomEventFilter{Limit: len(relatedIDs)}, false)
+		if err != nil {
+			return fmt.Errorf("s.OutputEvents.SelectEvents: %w", err)
+		}
+		relatedByID := make(map[string]*gomatrixserverlib.HeaderedEvent, len(related))
+		for i := range related {
+			relatedByID[related[i].EventID()] = related[i].HeaderedEvent
+		}
+		for eventID, editID := range edits {
+			if edit, ok := relatedByID[editID]; ok {
+				clientEvent := gomatrixserverlib.HeaderedToClientEvent(edit, gomatrixserverlib.FormatAll)
+				aggregationsFor(eventID).Replace = &clientEvent
+			}
+		}
+		for eventID, replyID := range latestReplies {
+			if reply, ok := relatedByID[replyID]; ok {
+				aggregations[eventID].Thread.LatestEvent = gomatrixserverlib.HeaderedToClientEvent(reply, gomatrixserverlib.FormatAll)
+			} else {
+				// the summary isn't valid without the latest event
+				aggregations[eventID].Thread = nil
+			}
+		}
+	}
+
+	for _, ev := range events {
+		aggregation, ok := aggregations[ev.EventID()]
+		if !ok || (aggregation.Annotation == nil && aggregation.Replace == nil && aggregation.Thread == nil) {
+			continue
+		}
+		// The field is set by path, so the dot in m.relations must be escaped.
+		if err := ev.SetUnsignedField(`m\.relations`, aggregation); err != nil {
+			return fmt.Errorf("ev.SetUnsignedField: %w", err)
+		}
+	}
+	return nil
+}
@@ -18,6 +18,7 @@ package sqlite3
 import (
 	"context"
 	"database/sql"
+	"fmt"
 
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
@@ -41,7 +42,7 @@ const insertAccountDataSQL = "" +
 	" ON CONFLICT (user_id, room_id, type) DO UPDATE" +
 	" SET id = $5"
 
-// further parameters are added by prepareWithFilters
+// further conditions are added by SelectAccountDataInRange
 const selectAccountDataInRangeSQL = "" +
 	"SELECT id, room_id, type FROM syncapi_account_data_type" +
 	" WHERE user_id = $1 AND id > $2 AND id <= $3"
@@ -95,37 +96,62 @@ func (s *accountDataStatements) SelectAccountDataInRange(
 	userID string,
 	r types.Range,
 	filter *gomatrixserverlib.EventFilter,
+	roomFilter *gomatrixserverlib.RoomEventFilter,
 ) (data map[string][]string, pos types.StreamPosition, err error) {
-	data = make(map[string][]string)
-	stmt, params, err := prepareWithFilters(
-		s.db, nil, selectAccountDataInRangeSQL,
-		[]interface{}{
-			userID, r.Low(), r.High(),
-		},
-		filter.Senders, filter.NotSenders,
-		filter.Types, filter.NotTypes,
-		[]string{}, nil, filter.Limit, FilterOrderAsc)
-
-	rows, err := stmt.QueryContext(ctx, params...)
+	// The global account data filter applies to rows without a room ID,
+	// the room account data filter to all others.
+	params := []interface{}{userID, r.Low(), r.High()}
+	offset := len(params)
+	var clause, globalClauses, roomClauses string
+	clause, params, offset = filterClause("type", filter.Types, false, true, params, offset)
+	globalClauses += clause
+	clause, params, offset = filterClause("type", filter.NotTypes, true, true, params, offset)
+	globalClauses += clause
+	clause, params, offset = filterClause("type", roomFilter.Types, false, true, params, offset)
+	roomClauses += clause
+	clause, params, offset = filterClause("type", roomFilter.NotTypes, true, true, params, offset)
+	roomClauses += clause
+	clause, params, offset = filterClause("room_id", roomFilter.Rooms, false, false, params, offset)
+	roomClauses += clause
+	clause, params, offset = filterClause("room_id", roomFilter.NotRooms, true, false, params, offset)
+	roomClauses += clause
+	query := selectAccountDataInRangeSQL +
+		" AND (room_id <> '' OR (1 = 1" + globalClauses + "))" +
+		" AND (room_id = '' OR (1 = 1" + roomClauses + "))" +
+		fmt.Sprintf(" ORDER BY id ASC LIMIT $%d", offset+1)
+	params = append(params, int64(filter.Limit)+int64(roomFilter.Limit))
+
+	rows, err := s.db.QueryContext(ctx, query, params...)
 	if err != nil {
 		return
 	}
 	defer internal.CloseAndLogIfError(ctx, rows, "selectAccountDataInRange: rows.close() failed")
 
+	data = make(map[string][]string)
 	var dataType string
 	var roomID string
 	var id types.StreamPosition
+	var globalCount, roomCount int
 
 	for rows.Next() {
 		if err = rows.Scan(&id, &roomID, &dataType); err != nil {
 			return
 		}
-
-		if len(data[roomID]) > 0 {
-			data[roomID] = append(data[roomID], dataType)
+		// Each section has its own limit. Stop at the first row which doesn't
+		// fit, so that it and everything after it is sent in the next sync.
+		if roomID == "" {
+			globalCount++
 		} else {
-			data[roomID] = []string{dataType}
+			roomCount++
 		}
+		if globalCount > filter.Limit || roomCount > roomFilter.Limit {
+			if pos == 0 {
+				pos = r.Low()
+			}
+			return data, pos, nil
+		}
+
+		data[roomID] = append(data[roomID], dataType)
 		if id > pos {
 			pos = id
 		}
@@ -133,7 +159,7 @@ func (s *accountDataStatements) SelectAccountDataInRange(
 	if pos == 0 {
 		pos = r.High()
 	}
-	return data, pos, nil
+	return data, pos, rows.Err()
 }
 
 func (s *accountDataStatements) SelectMaxAccountDataID(
@@ -0,0 +1,90 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+const eventHistoryAuditSchema = `
+-- Records which users looked at the edit and redaction history of events.
+CREATE TABLE IF NOT EXISTS syncapi_event_history_audit (
+	audit_id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	event_id TEXT NOT NULL,
+	-- When the history was looked at, in milliseconds
+	audit_ts BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS syncapi_event_history_audit_room_id_idx ON syncapi_event_history_audit(room_id, audit_id);
+`
+
+const insertEventHistoryAuditSQL = "" +
+	"INSERT INTO syncapi_event_history_audit (user_id, room_id, event_id, audit_ts) VALUES ($1, $2, $3, $4)"
+
+const selectEventHistoryAuditSQL = "" +
+	"SELECT user_id, room_id, event_id, audit_ts FROM syncapi_event_history_audit" +
+	" WHERE room_id = $1 ORDER BY audit_id DESC LIMIT $2"
+
+type eventHistoryAuditStatements struct {
+	insertEventHistoryAuditStmt *sql.Stmt
+	selectEventHistoryAuditStmt *sql.Stmt
+}
+
+func NewSqliteEventHistoryAuditTable(db *sql.DB) (tables.EventHistoryAudit, error) {
+	_, err := db.Exec(eventHistoryAuditSchema)
+	if err != nil {
+		return nil, err
+	}
+	s := &eventHistoryAuditStatements{}
+	return s, sqlutil.StatementList{
+		{&s.insertEventHistoryAuditStmt, insertEventHistoryAuditSQL},
+		{&s.selectEventHistoryAuditStmt, selectEventHistoryAuditSQL},
+	}.Prepare(db)
+}
+
+func (s *eventHistoryAuditStatements) InsertEventHistoryAudit(
+	ctx context.Context, txn *sql.Tx, entry *types.EventHistoryAuditEntry,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.insertEventHistoryAuditStmt).ExecContext(
+		ctx, entry.UserID, entry.RoomID, entry.EventID, entry.Timestamp,
+	)
+	return err
+}
+
+func (s *eventHistoryAuditStatements) SelectEventHistoryAudit(
+	ctx context.Context, txn *sql.Tx, roomID string, limit int,
+) ([]types.EventHistoryAuditEntry, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectEventHistoryAuditStmt).QueryContext(ctx, roomID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectEventHistoryAudit: rows.close() failed")
+	var entries []types.EventHistoryAuditEntry
+	for rows.Next() {
+		var entry types.EventHistoryAuditEntry
+		if err = rows.Scan(&entry.UserID, &entry.RoomID, &entry.EventID, &entry.Timestamp); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
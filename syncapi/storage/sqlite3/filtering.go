@@ -3,6 +3,7 @@ package sqlite3
 import (
 	"database/sql"
 	"fmt"
+	"strings"
 
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 )
@@ -29,46 +30,15 @@ func prepareWithFilters(
 	containsURL *bool, limit int, order FilterOrder,
 ) (*sql.Stmt, []interface{}, error) {
 	offset := len(params)
-	if senders != nil {
-		if count := len(*senders); count > 0 {
-			query += " AND sender IN " + sqlutil.QueryVariadicOffset(count, offset)
-			for _, v := range *senders {
-				params, offset = append(params, v), offset+1
-			}
-		} else {
-			query += ` AND sender = ""`
-		}
-	}
-	if notsenders != nil {
-		if count := len(*notsenders); count > 0 {
-			query += " AND sender NOT IN " + sqlutil.QueryVariadicOffset(count, offset)
-			for _, v := range *notsenders {
-				params, offset = append(params, v), offset+1
-			}
-		} else {
-			query += ` AND sender NOT = ""`
-		}
-	}
-	if types != nil {
-		if count := len(*types); count > 0 {
-			query += " AND type IN " + sqlutil.QueryVariadicOffset(count, offset)
-			for _, v := range *types {
-				params, offset = append(params, v), offset+1
-			}
-		} else {
-			query += ` AND type = ""`
-		}
-	}
-	if nottypes != nil {
-		if count := len(*nottypes); count > 0 {
-			query += " AND type NOT IN " + sqlutil.QueryVariadicOffset(count, offset)
-			for _, v := range *nottypes {
-				params, offset = append(params, v), offset+1
-			}
-		} else {
-			query += ` AND type NOT = ""`
-		}
-	}
+	var clause string
+	clause, params, offset = filterClause("sender", senders, false, false, params, offset)
+	query += clause
+	clause, params, offset = filterClause("sender", notsenders, true, false, params, offset)
+	query += clause
+	clause, params, offset = filterClause("type", types, false, true, params, offset)
+	query += clause
+	clause, params, offset = filterClause("type", nottypes, true, true, params, offset)
+	query += clause
 	if containsURL != nil {
 		query += fmt.Sprintf(" AND contains_url = %v", *containsURL)
 	}
@@ -99,3 +69,46 @@ func prepareWithFilters(
 	}
 	return stmt, params, nil
 }
+
+// filterClause returns the condition, starting with AND, which matches the column
+// against the values of a filter, along with the updated parameters and offset. If
+// wildcards is set, values containing "*" are matched as LIKE patterns, like
+// Postgres does for event types. An empty list matches nothing, so excluding
+// it matches everything.
+func filterClause(
+	column string, values *[]string, negate, wildcards bool,
+	params []interface{}, offset int,
+) (string, []interface{}, int) {
+	if values == nil {
+		return "", params, offset
+	}
+	var exact, patterns []string
+	for _, v := range *values {
+		if wildcards && strings.Contains(v, "*") {
+			patterns = append(patterns, strings.ReplaceAll(v, "*", "%"))
+		} else {
+			exact = append(exact, v)
+		}
+	}
+	conditions := make([]string, 0, len(patterns)+1)
+	if len(exact) > 0 {
+		conditions = append(conditions, column+" IN "+sqlutil.QueryVariadicOffset(len(exact), offset))
+		for _, v := range exact {
+			params, offset = append(params, v), offset+1
+		}
+	}
+	for _, pattern := range patterns {
+		params, offset = append(params, pattern), offset+1
+		conditions = append(conditions, fmt.Sprintf("%s LIKE $%d", column, offset))
+	}
+	switch {
+	case len(conditions) == 0 && negate:
+		return "", params, offset
+	case len(conditions) == 0:
+		return fmt.Sprintf(` AND %s = ""`, column), params, offset
+	case negate:
+		return " AND NOT (" + strings.Join(conditions, " OR ") + ")", params, offset
+	default:
+		return " AND (" + strings.Join(conditions, " OR ") + ")", params, offset
+	}
+}
@@ -88,6 +88,11 @@ const selectEarlyEventsSQL = "" +
 const selectMaxEventIDSQL = "" +
 	"SELECT MAX(id) FROM syncapi_output_room_events"
 
+const selectMaxEventIDsForRoomsSQL = "" +
+	"SELECT room_id, MAX(id) FROM syncapi_output_room_events" +
+	" WHERE room_id IN ($1) AND exclude_from_sync = FALSE" +
+	" GROUP BY room_id"
+
 const updateEventJSONSQL = "" +
 	"UPDATE syncapi_output_room_events SET headered_event_json=$1 WHERE event_id=$2"
 
@@ -280,6 +285,42 @@ func (s *outputRoomEventsStatements) SelectMaxEventID(
 	return
 }
 
+// SelectMaxEventIDsForRooms returns the position of the latest event in each of the rooms
+// which is not excluded from sync. Rooms without such events are left out.
+func (s *outputRoomEventsStatements) SelectMaxEventIDsForRooms(
+	ctx context.Context, txn *sql.Tx, roomIDs []string,
+) (map[string]types.StreamPosition, error) {
+	positions := make(map[string]types.StreamPosition, len(roomIDs))
+	if len(roomIDs) == 0 {
+		return positions, nil
+	}
+	query := strings.Replace(selectMaxEventIDsForRoomsSQL, "($1)", sqlutil.QueryVariadic(len(roomIDs)), 1)
+	params := make([]interface{}, len(roomIDs))
+	for i := range roomIDs {
+		params[i] = roomIDs[i]
+	}
+	var rows *sql.Rows
+	var err error
+	if txn != nil {
+		rows, err = txn.QueryContext(ctx, query, params...)
+	} else {
+		rows, err = s.db.QueryContext(ctx, query, params...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectMaxEventIDsForRooms: rows.close() failed")
+	for rows.Next() {
+		var roomID string
+		var pos types.StreamPosition
+		if err = rows.Scan(&roomID, &pos); err != nil {
+			return nil, err
+		}
+		positions[roomID] = pos
+	}
+	return positions, rows.Err()
+}
+
 // InsertEvent into the output_room_events table. addState and removeState are an optional list of state event IDs. Returns the position
 // of the inserted event.
 func (s *outputRoomEventsStatements) InsertEvent(
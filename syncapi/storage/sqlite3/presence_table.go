@@ -17,6 +17,7 @@ package sqlite3
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"time"
 
 	"github.com/matrix-org/dendrite/internal"
@@ -72,8 +73,7 @@ const selectMaxPresenceSQL = "" +
 const selectPresenceAfter = "" +
 	" SELECT id, user_id, presence, status_msg, last_active_ts" +
 	" FROM syncapi_presence" +
-	" WHERE id > $1 AND last_active_ts >= $2" +
-	" ORDER BY id ASC LIMIT $3"
+	" WHERE id > $1 AND last_active_ts >= $2"
 
 type presenceStatements struct {
 	db                         *sql.DB
@@ -82,7 +82,6 @@ type presenceStatements struct {
 	upsertPresenceFromSyncStmt *sql.Stmt
 	selectPresenceForUsersStmt *sql.Stmt
 	selectMaxPresenceStmt      *sql.Stmt
-	selectPresenceAfterStmt    *sql.Stmt
 }
 
 func NewSqlitePresenceTable(db *sql.DB, streamID *StreamIDStatements) (*presenceStatements, error) {
@@ -99,7 +98,6 @@ func NewSqlitePresenceTable(db *sql.DB, streamID *StreamIDStatements) (*presence
 		{&s.upsertPresenceFromSyncStmt, upsertPresenceFromSyncSQL},
 		{&s.selectPresenceForUsersStmt, selectPresenceForUserSQL},
 		{&s.selectMaxPresenceStmt, selectMaxPresenceSQL},
-		{&s.selectPresenceAfterStmt, selectPresenceAfter},
 	}.Prepare(db)
 }
 
@@ -163,9 +161,23 @@ func (p *presenceStatements) GetPresenceAfter(
 	after types.StreamPosition, filter gomatrixserverlib.EventFilter,
 ) (presences map[string]*types.PresenceInternal, err error) {
 	presences = make(map[string]*types.PresenceInternal)
-	stmt := sqlutil.TxStmt(txn, p.selectPresenceAfterStmt)
 	afterTS := gomatrixserverlib.AsTimestamp(time.Now().Add(time.Minute * -5))
-	rows, err := stmt.QueryContext(ctx, after, afterTS, filter.Limit)
+	query := selectPresenceAfter
+	params := []interface{}{after, afterTS}
+	offset := len(params)
+	var clause string
+	clause, params, offset = filterClause("user_id", filter.Senders, false, false, params, offset)
+	query += clause
+	clause, params, offset = filterClause("user_id", filter.NotSenders, true, false, params, offset)
+	query += clause
+	query += fmt.Sprintf(" ORDER BY id ASC LIMIT $%d", offset+1)
+	params = append(params, filter.Limit)
+	var rows *sql.Rows
+	if txn != nil {
+		rows, err = txn.QueryContext(ctx, query, params...)
+	} else {
+		rows, err = p.db.QueryContext(ctx, query, params...)
+	}
 	if err != nil {
 		return nil, err
 	}
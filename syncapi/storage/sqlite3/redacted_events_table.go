@@ -0,0 +1,150 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const redactedEventsSchema = `
+-- Stores the original versions of redacted events for room moderators.
+CREATE TABLE IF NOT EXISTS syncapi_redacted_events (
+	event_id TEXT NOT NULL PRIMARY KEY,
+	room_id TEXT NOT NULL,
+	-- The event which the redacted event replaced, if it was an edit
+	replaces_event_id TEXT NOT NULL DEFAULT '',
+	-- The redaction event and its sender
+	redacted_by TEXT NOT NULL,
+	redacter TEXT NOT NULL,
+	-- When the event was redacted on this server, in milliseconds
+	redacted_ts BIGINT NOT NULL,
+	-- The original event JSON
+	headered_event_json TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS syncapi_redacted_events_replaces_idx ON syncapi_redacted_events(room_id, replaces_event_id);
+CREATE INDEX IF NOT EXISTS syncapi_redacted_events_ts_idx ON syncapi_redacted_events(redacted_ts);
+`
+
+const insertRedactedEventSQL = "" +
+	"INSERT INTO syncapi_redacted_events (event_id, room_id, replaces_event_id, redacted_by, redacter, redacted_ts, headered_event_json)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7)" +
+	" ON CONFLICT DO NOTHING"
+
+const selectRedactedEventSQL = "" +
+	"SELECT replaces_event_id, redacted_by, redacter, redacted_ts, headered_event_json" +
+	" FROM syncapi_redacted_events WHERE event_id = $1"
+
+const selectRedactedEditsSQL = "" +
+	"SELECT replaces_event_id, redacted_by, redacter, redacted_ts, headered_event_json" +
+	" FROM syncapi_redacted_events WHERE room_id = $1 AND replaces_event_id = $2" +
+	" ORDER BY redacted_ts ASC"
+
+const deleteRedactedEventsBeforeSQL = "" +
+	"DELETE FROM syncapi_redacted_events WHERE redacted_ts < $1"
+
+type redactedEventsStatements struct {
+	insertRedactedEventStmt        *sql.Stmt
+	selectRedactedEventStmt        *sql.Stmt
+	selectRedactedEditsStmt        *sql.Stmt
+	deleteRedactedEventsBeforeStmt *sql.Stmt
+}
+
+func NewSqliteRedactedEventsTable(db *sql.DB) (tables.RedactedEvents, error) {
+	_, err := db.Exec(redactedEventsSchema)
+	if err != nil {
+		return nil, err
+	}
+	s := &redactedEventsStatements{}
+	return s, sqlutil.StatementList{
+		{&s.insertRedactedEventStmt, insertRedactedEventSQL},
+		{&s.selectRedactedEventStmt, selectRedactedEventSQL},
+		{&s.selectRedactedEditsStmt, selectRedactedEditsSQL},
+		{&s.deleteRedactedEventsBeforeStmt, deleteRedactedEventsBeforeSQL},
+	}.Prepare(db)
+}
+
+func (s *redactedEventsStatements) InsertRedactedEvent(
+	ctx context.Context, txn *sql.Tx, event *types.RedactedEvent,
+) error {
+	headeredJSON, err := json.Marshal(event.Event)
+	if err != nil {
+		return err
+	}
+	_, err = sqlutil.TxStmt(txn, s.insertRedactedEventStmt).ExecContext(
+		ctx, event.Event.EventID(), event.Event.RoomID(), event.ReplacesEventID,
+		event.RedactedBy, event.Redacter, event.RedactedTS, headeredJSON,
+	)
+	return err
+}
+
+func (s *redactedEventsStatements) SelectRedactedEvent(
+	ctx context.Context, txn *sql.Tx, eventID string,
+) (*types.RedactedEvent, error) {
+	event, err := scanRedactedEvent(sqlutil.TxStmt(txn, s.selectRedactedEventStmt).QueryRowContext(ctx, eventID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return event, err
+}
+
+func (s *redactedEventsStatements) SelectRedactedEdits(
+	ctx context.Context, txn *sql.Tx, roomID, eventID string,
+) ([]*types.RedactedEvent, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectRedactedEditsStmt).QueryContext(ctx, roomID, eventID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectRedactedEdits: rows.close() failed")
+	var events []*types.RedactedEvent
+	for rows.Next() {
+		var event *types.RedactedEvent
+		if event, err = scanRedactedEvent(rows); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func (s *redactedEventsStatements) DeleteRedactedEventsBefore(
+	ctx context.Context, txn *sql.Tx, before gomatrixserverlib.Timestamp,
+) (int64, error) {
+	res, err := sqlutil.TxStmt(txn, s.deleteRedactedEventsBeforeStmt).ExecContext(ctx, before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func scanRedactedEvent(row interface{ Scan(...interface{}) error }) (*types.RedactedEvent, error) {
+	var headeredJSON []byte
+	event := &types.RedactedEvent{}
+	if err := row.Scan(&event.ReplacesEventID, &event.RedactedBy, &event.Redacter, &event.RedactedTS, &headeredJSON); err != nil {
+		return nil, err
+	}
+	event.Event = &gomatrixserverlib.HeaderedEvent{}
+	if err := json.Unmarshal(headeredJSON, event.Event); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
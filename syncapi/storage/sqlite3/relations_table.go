@@ -0,0 +1,272 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+const relationsSchema = `
+-- Stores which events relate to other events through m.relates_to.
+CREATE TABLE IF NOT EXISTS syncapi_relations (
+	-- The stream position of the relating event
+	id INTEGER PRIMARY KEY,
+	room_id TEXT NOT NULL,
+	-- The event being related to
+	event_id TEXT NOT NULL,
+	-- The relating event, its type and sender
+	child_event_id TEXT NOT NULL UNIQUE,
+	child_event_type TEXT NOT NULL,
+	sender TEXT NOT NULL,
+	-- The rel_type of the relation, e.g. m.annotation
+	rel_type TEXT NOT NULL,
+	-- The key of annotations, empty for other relations
+	annotation_key TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS syncapi_relations_event_id_idx ON syncapi_relations(room_id, event_id, rel_type, id);
+`
+
+const insertRelationSQL = "" +
+	"INSERT INTO syncapi_relations (id, room_id, event_id, child_event_id, child_event_type, rel_type, sender, annotation_key)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8)" +
+	" ON CONFLICT DO NOTHING"
+
+const deleteRelationSQL = "" +
+	"DELETE FROM syncapi_relations WHERE room_id = $1 AND child_event_id = $2"
+
+const selectRelationsInRangeAscSQL = "" +
+	"SELECT id, event_id, child_event_id, sender FROM syncapi_relations" +
+	" WHERE room_id = $1 AND event_id = $2" +
+	" AND ( $3 = '' OR rel_type = $3 )" +
+	" AND ( $4 = '' OR child_event_type = $4 )" +
+	" AND id > $5 AND id <= $6" +
+	" ORDER BY id ASC LIMIT $7"
+
+const selectRelationsInRangeDescSQL = "" +
+	"SELECT id, event_id, child_event_id, sender FROM syncapi_relations" +
+	" WHERE room_id = $1 AND event_id = $2" +
+	" AND ( $3 = '' OR rel_type = $3 )" +
+	" AND ( $4 = '' OR child_event_type = $4 )" +
+	" AND id > $5 AND id <= $6" +
+	" ORDER BY id DESC LIMIT $7"
+
+// The event IDs of the queries below are expanded into ($3), so they come last.
+
+const selectRelationsOfTypeSQL = "" +
+	"SELECT id, event_id, child_event_id, sender FROM syncapi_relations" +
+	" WHERE room_id = $1 AND rel_type = $2 AND event_id IN ($3)" +
+	" ORDER BY id ASC"
+
+const selectAnnotationCountsSQL = "" +
+	"SELECT event_id, child_event_type, annotation_key, COUNT(*) AS count FROM syncapi_relations" +
+	" WHERE room_id = $1 AND rel_type = $2 AND event_id IN ($3)" +
+	" GROUP BY event_id, child_event_type, annotation_key" +
+	" ORDER BY count DESC, MIN(id) ASC"
+
+const selectThreadSummariesSQL = "" +
+	"SELECT event_id, COUNT(*), MAX(id), MAX(CASE WHEN sender = $1 THEN 1 ELSE 0 END)," +
+	" (SELECT child_event_id FROM syncapi_relations l WHERE l.room_id = r.room_id AND l.event_id = r.event_id" +
+	" AND l.rel_type = 'm.thread' ORDER BY l.id DESC LIMIT 1)" +
+	" FROM syncapi_relations r" +
+	" WHERE room_id = $2 AND rel_type = 'm.thread' AND event_id IN ($3)" +
+	" GROUP BY room_id, event_id"
+
+const selectThreadsSQL = "" +
+	"SELECT event_id, MAX(id) AS latest FROM syncapi_relations" +
+	" WHERE room_id = $1 AND rel_type = 'm.thread'" +
+	" AND ( $2 = '' OR event_id IN (" +
+	"  SELECT event_id FROM syncapi_relations WHERE room_id = $1 AND rel_type = 'm.thread' AND sender = $2" +
+	"  UNION SELECT event_id FROM syncapi_output_room_events WHERE room_id = $1 AND sender = $2" +
+	" ) )" +
+	" GROUP BY event_id HAVING MAX(id) < $3" +
+	" ORDER BY latest DESC LIMIT $4"
+
+type relationsStatements struct {
+	db                             *sql.DB
+	insertRelationStmt             *sql.Stmt
+	deleteRelationStmt             *sql.Stmt
+	selectRelationsInRangeAscStmt  *sql.Stmt
+	selectRelationsInRangeDescStmt *sql.Stmt
+	selectThreadsStmt              *sql.Stmt
+}
+
+func NewSqliteRelationsTable(db *sql.DB) (tables.Relations, error) {
+	_, err := db.Exec(relationsSchema)
+	if err != nil {
+		return nil, err
+	}
+	s := &relationsStatements{
+		db: db,
+	}
+	return s, sqlutil.StatementList{
+		{&s.insertRelationStmt, insertRelationSQL},
+		{&s.deleteRelationStmt, deleteRelationSQL},
+		{&s.selectRelationsInRangeAscStmt, selectRelationsInRangeAscSQL},
+		{&s.selectRelationsInRangeDescStmt, selectRelationsInRangeDescSQL},
+		{&s.selectThreadsStmt, selectThreadsSQL},
+	}.Prepare(db)
+}
+
+func (s *relationsStatements) InsertRelation(
+	ctx context.Context, txn *sql.Tx, pos types.StreamPosition,
+	roomID, eventID, childEventID, childEventType, relType, sender, key string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.insertRelationStmt).ExecContext(
+		ctx, pos, roomID, eventID, childEventID, childEventType, relType, sender, key,
+	)
+	return err
+}
+
+func (s *relationsStatements) DeleteRelation(
+	ctx context.Context, txn *sql.Tx, roomID, childEventID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteRelationStmt).ExecContext(ctx, roomID, childEventID)
+	return err
+}
+
+func (s *relationsStatements) SelectRelationsInRange(
+	ctx context.Context, txn *sql.Tx, roomID, eventID, relType, eventType string,
+	r types.Range, limit int,
+) ([]types.RelationEntry, error) {
+	stmt := s.selectRelationsInRangeAscStmt
+	if r.Backwards {
+		stmt = s.selectRelationsInRangeDescStmt
+	}
+	rows, err := sqlutil.TxStmt(txn, stmt).QueryContext(
+		ctx, roomID, eventID, relType, eventType, r.Low(), r.High(), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectRelationsInRange: rows.close() failed")
+	return rowsToRelationEntries(rows)
+}
+
+func (s *relationsStatements) SelectRelationsOfType(
+	ctx context.Context, txn *sql.Tx, roomID string, eventIDs []string, relType string,
+) ([]types.RelationEntry, error) {
+	if len(eventIDs) == 0 {
+		return nil, nil
+	}
+	rows, err := s.queryForEvents(ctx, txn, selectRelationsOfTypeSQL, eventIDs, roomID, relType)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectRelationsOfType: rows.close() failed")
+	return rowsToRelationEntries(rows)
+}
+
+func (s *relationsStatements) SelectAnnotationCounts(
+	ctx context.Context, txn *sql.Tx, roomID string, eventIDs []string,
+) ([]types.AnnotationCount, error) {
+	if len(eventIDs) == 0 {
+		return nil, nil
+	}
+	rows, err := s.queryForEvents(ctx, txn, selectAnnotationCountsSQL, eventIDs, roomID, "m.annotation")
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectAnnotationCounts: rows.close() failed")
+	var counts []types.AnnotationCount
+	for rows.Next() {
+		var count types.AnnotationCount
+		if err = rows.Scan(&count.EventID, &count.Type, &count.Key, &count.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, count)
+	}
+	return counts, rows.Err()
+}
+
+func (s *relationsStatements) SelectThreadSummaries(
+	ctx context.Context, txn *sql.Tx, roomID string, eventIDs []string, userID string,
+) ([]types.ThreadSummary, error) {
+	if len(eventIDs) == 0 {
+		return nil, nil
+	}
+	rows, err := s.queryForEvents(ctx, txn, selectThreadSummariesSQL, eventIDs, userID, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectThreadSummaries: rows.close() failed")
+	var summaries []types.ThreadSummary
+	for rows.Next() {
+		var summary types.ThreadSummary
+		var participated int
+		if err = rows.Scan(
+			&summary.RootEventID, &summary.Count, &summary.LatestPosition, &participated, &summary.LatestEventID,
+		); err != nil {
+			return nil, err
+		}
+		summary.Participated = participated == 1
+		summaries = append(summaries, summary)
+	}
+	return summaries, rows.Err()
+}
+
+func (s *relationsStatements) SelectThreads(
+	ctx context.Context, txn *sql.Tx, roomID, participant string, before types.StreamPosition, limit int,
+) ([]types.ThreadSummary, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectThreadsStmt).QueryContext(
+		ctx, roomID, participant, before, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectThreads: rows.close() failed")
+	var threads []types.ThreadSummary
+	for rows.Next() {
+		var thread types.ThreadSummary
+		if err = rows.Scan(&thread.RootEventID, &thread.LatestPosition); err != nil {
+			return nil, err
+		}
+		threads = append(threads, thread)
+	}
+	return threads, rows.Err()
+}
+
+// queryForEvents runs the query with the event IDs expanded into ($3), after
+// the two other parameters.
+func (s *relationsStatements) queryForEvents(
+	ctx context.Context, txn *sql.Tx, query string, eventIDs []string, params ...interface{},
+) (*sql.Rows, error) {
+	query = strings.Replace(query, "($3)", sqlutil.QueryVariadicOffset(len(eventIDs), len(params)), 1)
+	for _, eventID := range eventIDs {
+		params = append(params, eventID)
+	}
+	if txn != nil {
+		return txn.QueryContext(ctx, query, params...)
+	}
+	return s.db.QueryContext(ctx, query, params...)
+}
+
+func rowsToRelationEntries(rows *sql.Rows) ([]types.RelationEntry, error) {
+	var entries []types.RelationEntry
+	for rows.Next() {
+		var entry types.RelationEntry
+		if err := rows.Scan(&entry.Position, &entry.EventID, &entry.ChildEventID, &entry.Sender); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,215 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/fulltext"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const searchSchema = `
+-- The events in the full-text index, the text itself is kept in syncapi_search_content.
+CREATE TABLE IF NOT EXISTS syncapi_search (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	event_id TEXT NOT NULL UNIQUE,
+	room_id TEXT NOT NULL,
+	sender TEXT NOT NULL,
+	origin_server_ts BIGINT NOT NULL,
+	-- The history visibility of the room when the event was sent
+	history_visibility SMALLINT NOT NULL DEFAULT 2
+);
+CREATE INDEX IF NOT EXISTS syncapi_search_room_id_idx ON syncapi_search(room_id);
+-- The text of the events by their id in syncapi_search. The text is split into tokens
+-- by the server, the simple tokenizer only lower-cases them. FTS4 is used because,
+-- unlike FTS5, it is built into SQLite without extra build tags.
+CREATE VIRTUAL TABLE IF NOT EXISTS syncapi_search_content USING fts4(content);
+`
+
+const insertSearchEventSQL = "" +
+	"INSERT INTO syncapi_search (event_id, room_id, sender, origin_server_ts, history_visibility)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT (event_id) DO NOTHING"
+
+const insertSearchContentSQL = "" +
+	"INSERT INTO syncapi_search_content (docid, content) VALUES ($1, $2)"
+
+const deleteSearchContentSQL = "" +
+	"DELETE FROM syncapi_search_content WHERE docid IN (SELECT id FROM syncapi_search WHERE event_id = $1)"
+
+const deleteSearchEventSQL = "" +
+	"DELETE FROM syncapi_search WHERE event_id = $1"
+
+// searchRankSQL counts the matched tokens, as FTS4 has no ranking function of its
+// own. offsets() returns four numbers separated by spaces for every match.
+const searchRankSQL = "" +
+	"(length(offsets(syncapi_search_content)) - length(replace(offsets(syncapi_search_content), ' ', '')) + 1) / 4"
+
+const selectSearchSQL = "" +
+	"SELECT event_id, room_id, history_visibility, " + searchRankSQL + " AS rank" +
+	" FROM syncapi_search_content JOIN syncapi_search ON syncapi_search.id = syncapi_search_content.docid" +
+	" WHERE syncapi_search_content MATCH $1 AND room_id IN ($2)"
+
+const selectSearchCountSQL = "" +
+	"SELECT COUNT(*)" +
+	" FROM syncapi_search_content JOIN syncapi_search ON syncapi_search.id = syncapi_search_content.docid" +
+	" WHERE syncapi_search_content MATCH $1 AND room_id IN ($2)"
+
+type searchStatements struct {
+	db                      *sql.DB
+	insertSearchEventStmt   *sql.Stmt
+	insertSearchContentStmt *sql.Stmt
+	deleteSearchContentStmt *sql.Stmt
+	deleteSearchEventStmt   *sql.Stmt
+}
+
+func NewSqliteSearchTable(db *sql.DB) (tables.Search, error) {
+	_, err := db.Exec(searchSchema)
+	if err != nil {
+		return nil, err
+	}
+	s := &searchStatements{
+		db: db,
+	}
+	return s, sqlutil.StatementList{
+		{&s.insertSearchEventStmt, insertSearchEventSQL},
+		{&s.insertSearchContentStmt, insertSearchContentSQL},
+		{&s.deleteSearchContentStmt, deleteSearchContentSQL},
+		{&s.deleteSearchEventStmt, deleteSearchEventSQL},
+	}.Prepare(db)
+}
+
+func (s *searchStatements) InsertSearchEvent(
+	ctx context.Context, txn *sql.Tx, eventID, roomID, sender string, ts gomatrixserverlib.Timestamp,
+	historyVisibility gomatrixserverlib.HistoryVisibility, text string,
+) error {
+	res, err := sqlutil.TxStmt(txn, s.insertSearchEventStmt).ExecContext(
+		ctx, eventID, roomID, sender, ts, historyVisibility,
+	)
+	if err != nil {
+		return err
+	}
+	if inserted, err := res.RowsAffected(); err != nil || inserted == 0 {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	_, err = sqlutil.TxStmt(txn, s.insertSearchContentStmt).ExecContext(ctx, id, fulltext.Document(text))
+	return err
+}
+
+func (s *searchStatements) DeleteSearchEvent(
+	ctx context.Context, txn *sql.Tx, eventID string,
+) error {
+	if _, err := sqlutil.TxStmt(txn, s.deleteSearchContentStmt).ExecContext(ctx, eventID); err != nil {
+		return err
+	}
+	_, err := sqlutil.TxStmt(txn, s.deleteSearchEventStmt).ExecContext(ctx, eventID)
+	return err
+}
+
+func (s *searchStatements) SelectSearch(
+	ctx context.Context, txn *sql.Tx, phrases []fulltext.Phrase, roomIDs []string,
+	filter *gomatrixserverlib.RoomEventFilter, orderByRank bool, limit, offset int,
+) ([]types.SearchResult, int, error) {
+	if len(phrases) == 0 || len(roomIDs) == 0 {
+		return nil, 0, nil
+	}
+	params := []interface{}{matchQuery(phrases)}
+	for _, roomID := range roomIDs {
+		params = append(params, roomID)
+	}
+	conditions := ""
+	if filter != nil && filter.Senders != nil {
+		if len(*filter.Senders) == 0 {
+			return nil, 0, nil
+		}
+		conditions += " AND sender IN " + sqlutil.QueryVariadicOffset(len(*filter.Senders), len(params))
+		for _, sender := range *filter.Senders {
+			params = append(params, sender)
+		}
+	}
+	if filter != nil && filter.NotSenders != nil && len(*filter.NotSenders) > 0 {
+		conditions += " AND sender NOT IN " + sqlutil.QueryVariadicOffset(len(*filter.NotSenders), len(params))
+		for _, sender := range *filter.NotSenders {
+			params = append(params, sender)
+		}
+	}
+	rooms := sqlutil.QueryVariadicOffset(len(roomIDs), 1)
+
+	var count int
+	countSQL := strings.Replace(selectSearchCountSQL, "($2)", rooms, 1) + conditions
+	if err := s.queryRow(ctx, txn, countSQL, params...).Scan(&count); err != nil || count == 0 {
+		return nil, 0, err
+	}
+
+	selectSQL := strings.Replace(selectSearchSQL, "($2)", rooms, 1) + conditions
+	if orderByRank {
+		selectSQL += " ORDER BY rank DESC, origin_server_ts DESC"
+	} else {
+		selectSQL += " ORDER BY origin_server_ts DESC, syncapi_search.id DESC"
+	}
+	selectSQL += fmt.Sprintf(" LIMIT $%d OFFSET $%d", len(params)+1, len(params)+2)
+	params = append(params, limit, offset)
+	rows, err := s.query(ctx, txn, selectSQL, params...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectSearch: rows.close() failed")
+	var results []types.SearchResult
+	for rows.Next() {
+		var result types.SearchResult
+		if err = rows.Scan(&result.EventID, &result.RoomID, &result.HistoryVisibility, &result.Rank); err != nil {
+			return nil, 0, err
+		}
+		results = append(results, result)
+	}
+	return results, count, rows.Err()
+}
+
+func (s *searchStatements) query(ctx context.Context, txn *sql.Tx, query string, params ...interface{}) (*sql.Rows, error) {
+	if txn != nil {
+		return txn.QueryContext(ctx, query, params...)
+	}
+	return s.db.QueryContext(ctx, query, params...)
+}
+
+func (s *searchStatements) queryRow(ctx context.Context, txn *sql.Tx, query string, params ...interface{}) *sql.Row {
+	if txn != nil {
+		return txn.QueryRowContext(ctx, query, params...)
+	}
+	return s.db.QueryRowContext(ctx, query, params...)
+}
+
+// matchQuery returns the full-text query matching events which contain all phrases.
+// Every phrase is quoted, so that words like "and" aren't taken as operators. The
+// tokens only consist of letters and digits, so they need no escaping.
+func matchQuery(phrases []fulltext.Phrase) string {
+	parts := make([]string, len(phrases))
+	for i, phrase := range phrases {
+		parts[i] = `"` + strings.Join(phrase, " ") + `"`
+	}
+	return strings.Join(parts, " ")
+}
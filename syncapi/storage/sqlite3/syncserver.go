@@ -99,10 +99,30 @@ func (d *SyncServerDatasource) prepare() (err error) {
 	if err != nil {
 		return err
 	}
+	unreadCounts, err := NewSqliteUnreadCountsTable(d.db, &d.streamID)
+	if err != nil {
+		return err
+	}
 	ignores, err := NewSqliteIgnoresTable(d.db)
 	if err != nil {
 		return err
 	}
+	search, err := NewSqliteSearchTable(d.db)
+	if err != nil {
+		return err
+	}
+	relations, err := NewSqliteRelationsTable(d.db)
+	if err != nil {
+		return err
+	}
+	redactedEvents, err := NewSqliteRedactedEventsTable(d.db)
+	if err != nil {
+		return err
+	}
+	eventHistoryAudit, err := NewSqliteEventHistoryAuditTable(d.db)
+	if err != nil {
+		return err
+	}
 	presence, err := NewSqlitePresenceTable(d.db, &d.streamID)
 	if err != nil {
 		return err
@@ -122,8 +142,13 @@ func (d *SyncServerDatasource) prepare() (err error) {
 		Receipts:            receipts,
 		Memberships:         memberships,
 		NotificationData:    notificationData,
+		UnreadCounts:        unreadCounts,
 		Ignores:             ignores,
 		Presence:            presence,
+		Search:              search,
+		Relations:           relations,
+		RedactedEvents:      redactedEvents,
+		EventHistoryAudit:   eventHistoryAudit,
 	}
 	return nil
 }
@@ -0,0 +1,198 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+const unreadCountsSchema = `
+-- Stores the unread counts of users for each thread of a room.
+CREATE TABLE IF NOT EXISTS syncapi_unread_counts (
+	-- The stream position of the latest change
+	id INTEGER NOT NULL,
+	user_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	-- The root event of the thread, empty for the main timeline
+	thread_id TEXT NOT NULL DEFAULT '',
+	-- The number of unread messages (MSC2654)
+	unread_count BIGINT NOT NULL DEFAULT 0,
+	notification_count BIGINT NOT NULL DEFAULT 0,
+	highlight_count BIGINT NOT NULL DEFAULT 0,
+	-- The stream position of the latest event which was counted
+	latest_event_id BIGINT NOT NULL DEFAULT 0,
+	UNIQUE (user_id, room_id, thread_id)
+);
+CREATE INDEX IF NOT EXISTS syncapi_unread_counts_user_id_idx ON syncapi_unread_counts(user_id, id);
+`
+
+// The row of each user is added to the VALUES.
+const upsertUnreadCountsSQL = "" +
+	"INSERT INTO syncapi_unread_counts (id, room_id, thread_id, latest_event_id, unread_count, notification_count, highlight_count, user_id)" +
+	" VALUES %s" +
+	" ON CONFLICT (user_id, room_id, thread_id) DO UPDATE SET" +
+	" id = excluded.id," +
+	" latest_event_id = MAX(latest_event_id, excluded.latest_event_id)," +
+	" unread_count = unread_count + excluded.unread_count," +
+	" notification_count = notification_count + excluded.notification_count," +
+	" highlight_count = highlight_count + excluded.highlight_count"
+
+const updateUnreadCountsSQL = "" +
+	"UPDATE syncapi_unread_counts SET id = $1, unread_count = $2, notification_count = $3, highlight_count = $4" +
+	" WHERE user_id = $5 AND room_id = $6 AND thread_id = $7" +
+	" AND ( unread_count <> $2 OR notification_count <> $3 OR highlight_count <> $4 )"
+
+const selectRoomUnreadCountsSQL = "" +
+	"SELECT id, room_id, thread_id, latest_event_id, unread_count, notification_count, highlight_count" +
+	" FROM syncapi_unread_counts WHERE user_id = $1 AND room_id = $2"
+
+const selectUserUnreadCountsSQL = "" +
+	"SELECT id, room_id, thread_id, latest_event_id, unread_count, notification_count, highlight_count" +
+	" FROM syncapi_unread_counts WHERE user_id = $1" +
+	" AND ( unread_count > 0 OR notification_count > 0 OR highlight_count > 0 OR id > $2 )"
+
+const selectMaxUnreadCountsIDSQL = "" +
+	"SELECT COALESCE(MAX(id), 0) FROM syncapi_unread_counts"
+
+type unreadCountsStatements struct {
+	db                          *sql.DB
+	streamIDStatements          *StreamIDStatements
+	updateUnreadCountsStmt      *sql.Stmt
+	selectRoomUnreadCountsStmt  *sql.Stmt
+	selectUserUnreadCountsStmt  *sql.Stmt
+	selectMaxUnreadCountsIDStmt *sql.Stmt
+}
+
+func NewSqliteUnreadCountsTable(db *sql.DB, streamID *StreamIDStatements) (tables.UnreadCounts, error) {
+	_, err := db.Exec(unreadCountsSchema)
+	if err != nil {
+		return nil, err
+	}
+	s := &unreadCountsStatements{
+		db:                 db,
+		streamIDStatements: streamID,
+	}
+	return s, sqlutil.StatementList{
+		{&s.updateUnreadCountsStmt, updateUnreadCountsSQL},
+		{&s.selectRoomUnreadCountsStmt, selectRoomUnreadCountsSQL},
+		{&s.selectUserUnreadCountsStmt, selectUserUnreadCountsSQL},
+		{&s.selectMaxUnreadCountsIDStmt, selectMaxUnreadCountsIDSQL},
+	}.Prepare(db)
+}
+
+func (s *unreadCountsStatements) UpsertUnreadCounts(
+	ctx context.Context, txn *sql.Tx, userIDs []string, roomID, threadID string,
+	eventPos types.StreamPosition, unread, notifications, highlights int,
+) (pos types.StreamPosition, err error) {
+	pos, err = s.streamIDStatements.nextNotificationID(ctx, txn)
+	if err != nil {
+		return
+	}
+	const batchSize = sqlutil.SQLite3MaxVariables - 7
+	for len(userIDs) > 0 {
+		batch := userIDs
+		if len(batch) > batchSize {
+			batch = batch[:batchSize]
+		}
+		userIDs = userIDs[len(batch):]
+		params := []interface{}{pos, roomID, threadID, eventPos, unread, notifications, highlights}
+		values := make([]string, 0, len(batch))
+		for _, userID := range batch {
+			params = append(params, userID)
+			values = append(values, fmt.Sprintf("($1, $2, $3, $4, $5, $6, $7, $%d)", len(params)))
+		}
+		query := fmt.Sprintf(upsertUnreadCountsSQL, strings.Join(values, ", "))
+		if txn != nil {
+			_, err = txn.ExecContext(ctx, query, params...)
+		} else {
+			_, err = s.db.ExecContext(ctx, query, params...)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return pos, nil
+}
+
+func (s *unreadCountsStatements) UpdateUnreadCounts(
+	ctx context.Context, txn *sql.Tx, userID, roomID, threadID string,
+	unread, notifications, highlights int,
+) (pos types.StreamPosition, err error) {
+	pos, err = s.streamIDStatements.nextNotificationID(ctx, txn)
+	if err != nil {
+		return
+	}
+	res, err := sqlutil.TxStmt(txn, s.updateUnreadCountsStmt).ExecContext(
+		ctx, pos, unread, notifications, highlights, userID, roomID, threadID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return 0, err
+	} else if n == 0 {
+		return 0, sql.ErrNoRows
+	}
+	return pos, nil
+}
+
+func (s *unreadCountsStatements) SelectRoomUnreadCounts(
+	ctx context.Context, txn *sql.Tx, userID, roomID string,
+) ([]types.UnreadCounts, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectRoomUnreadCountsStmt).QueryContext(ctx, userID, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectRoomUnreadCounts: rows.close() failed")
+	return rowsToUnreadCounts(rows)
+}
+
+func (s *unreadCountsStatements) SelectUserUnreadCounts(
+	ctx context.Context, txn *sql.Tx, userID string, after types.StreamPosition,
+) ([]types.UnreadCounts, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectUserUnreadCountsStmt).QueryContext(ctx, userID, after)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectUserUnreadCounts: rows.close() failed")
+	return rowsToUnreadCounts(rows)
+}
+
+func (s *unreadCountsStatements) SelectMaxUnreadCountsID(
+	ctx context.Context, txn *sql.Tx,
+) (id types.StreamPosition, err error) {
+	err = sqlutil.TxStmt(txn, s.selectMaxUnreadCountsIDStmt).QueryRowContext(ctx).Scan(&id)
+	return
+}
+
+func rowsToUnreadCounts(rows *sql.Rows) ([]types.UnreadCounts, error) {
+	var counts []types.UnreadCounts
+	for rows.Next() {
+		var c types.UnreadCounts
+		if err := rows.Scan(&c.StreamPos, &c.RoomID, &c.ThreadID, &c.LatestPosition, &c.UnreadCount, &c.NotificationCount, &c.HighlightCount); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
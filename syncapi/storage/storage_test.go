@@ -7,12 +7,15 @@ import (
 	"fmt"
 	"reflect"
 	"testing"
+	"time"
 
+	"github.com/matrix-org/dendrite/internal/fulltext"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/dendrite/test"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
 )
 
 var ctx = context.Background()
@@ -160,6 +163,237 @@ func TestRecentEventsPDU(t *testing.T) {
 	})
 }
 
+func TestRecentEventsFilters(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := MustCreateDatabase(t, dbType)
+		defer close()
+		alice := test.NewUser(t)
+		bob := test.NewUser(t)
+		r := test.NewRoom(t, alice)
+		image := r.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "cat.png", "url": "mxc://localhost/cat"})
+		text := r.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "hi"})
+		custom := r.CreateAndInsert(t, alice, "org.example.custom", map[string]interface{}{"url": "mxc://localhost/custom"})
+		reply := r.CreateAndInsert(t, bob, "m.room.message", map[string]interface{}{"body": "hello"})
+		MustWriteEvents(t, db, r.Events())
+
+		latest, err := db.MaxStreamPositionForPDUs(ctx)
+		if err != nil {
+			t.Fatalf("failed to get MaxStreamPositionForPDUs: %s", err)
+		}
+		yes, no := true, false
+		testCases := []struct {
+			Name   string
+			Filter gomatrixserverlib.RoomEventFilter
+			Want   []*gomatrixserverlib.HeaderedEvent
+		}{
+			{
+				Name:   "wildcard types",
+				Filter: gomatrixserverlib.RoomEventFilter{Types: &[]string{"m.room.mess*", "org.*"}},
+				Want:   []*gomatrixserverlib.HeaderedEvent{image, text, custom, reply},
+			},
+			{
+				Name:   "wildcard not_types",
+				Filter: gomatrixserverlib.RoomEventFilter{Types: &[]string{"*"}, NotTypes: &[]string{"m.room.*"}},
+				Want:   []*gomatrixserverlib.HeaderedEvent{custom},
+			},
+			{
+				Name:   "contains_url",
+				Filter: gomatrixserverlib.RoomEventFilter{Types: &[]string{"m.room.message", "org.example.custom"}, ContainsURL: &yes},
+				Want:   []*gomatrixserverlib.HeaderedEvent{image, custom},
+			},
+			{
+				Name:   "not contains_url",
+				Filter: gomatrixserverlib.RoomEventFilter{Types: &[]string{"m.room.message"}, ContainsURL: &no},
+				Want:   []*gomatrixserverlib.HeaderedEvent{text, reply},
+			},
+			{
+				Name:   "empty types",
+				Filter: gomatrixserverlib.RoomEventFilter{Types: &[]string{}},
+			},
+			{
+				Name:   "senders",
+				Filter: gomatrixserverlib.RoomEventFilter{Senders: &[]string{bob.ID}},
+				Want:   []*gomatrixserverlib.HeaderedEvent{reply},
+			},
+			{
+				Name:   "not_senders",
+				Filter: gomatrixserverlib.RoomEventFilter{Types: &[]string{"m.room.message"}, NotSenders: &[]string{bob.ID}},
+				Want:   []*gomatrixserverlib.HeaderedEvent{image, text},
+			},
+			// not_senders takes precedence over senders
+			{
+				Name:   "senders and not_senders",
+				Filter: gomatrixserverlib.RoomEventFilter{Senders: &[]string{alice.ID, bob.ID}, NotSenders: &[]string{alice.ID}},
+				Want:   []*gomatrixserverlib.HeaderedEvent{reply},
+			},
+			{
+				Name:   "empty senders",
+				Filter: gomatrixserverlib.RoomEventFilter{Senders: &[]string{}},
+			},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.Name, func(t *testing.T) {
+				tc.Filter.Limit = 100
+				gotEvents, _, err := db.RecentEvents(ctx, r.ID, types.Range{From: 0, To: latest}, &tc.Filter, true, true)
+				if err != nil {
+					t.Fatalf("RecentEvents returned an error: %s", err)
+				}
+				if len(gotEvents) != len(tc.Want) {
+					t.Fatalf("got %d events, want %d", len(gotEvents), len(tc.Want))
+				}
+				for i := range gotEvents {
+					if gotEvents[i].EventID() != tc.Want[i].EventID() {
+						t.Errorf("event %d: got %s want %s", i, gotEvents[i].EventID(), tc.Want[i].EventID())
+					}
+				}
+			})
+		}
+	})
+}
+
+func TestPresenceAfterFilters(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := MustCreateDatabase(t, dbType)
+		defer close()
+		alice := test.NewUser(t)
+		bob := test.NewUser(t)
+		charlie := test.NewUser(t)
+		for _, user := range []*test.User{alice, bob, charlie} {
+			if _, err := db.UpdatePresence(ctx, user.ID, types.PresenceOnline, nil, gomatrixserverlib.AsTimestamp(time.Now()), false); err != nil {
+				t.Fatalf("UpdatePresence returned an error: %s", err)
+			}
+		}
+
+		testCases := []struct {
+			Name   string
+			Filter gomatrixserverlib.EventFilter
+			Want   []string
+		}{
+			{
+				Name:   "everyone",
+				Filter: gomatrixserverlib.EventFilter{Limit: 10},
+				Want:   []string{alice.ID, bob.ID, charlie.ID},
+			},
+			{
+				Name:   "senders",
+				Filter: gomatrixserverlib.EventFilter{Limit: 10, Senders: &[]string{alice.ID, bob.ID}},
+				Want:   []string{alice.ID, bob.ID},
+			},
+			{
+				Name:   "not_senders",
+				Filter: gomatrixserverlib.EventFilter{Limit: 10, NotSenders: &[]string{alice.ID}},
+				Want:   []string{bob.ID, charlie.ID},
+			},
+			{
+				Name:   "senders and not_senders",
+				Filter: gomatrixserverlib.EventFilter{Limit: 10, Senders: &[]string{alice.ID, bob.ID}, NotSenders: &[]string{bob.ID}},
+				Want:   []string{alice.ID},
+			},
+			{
+				Name:   "empty senders",
+				Filter: gomatrixserverlib.EventFilter{Limit: 10, Senders: &[]string{}},
+				Want:   []string{},
+			},
+			{
+				Name:   "limit",
+				Filter: gomatrixserverlib.EventFilter{Limit: 1, NotSenders: &[]string{alice.ID}},
+				Want:   []string{bob.ID},
+			},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.Name, func(t *testing.T) {
+				presences, err := db.PresenceAfter(ctx, 0, tc.Filter)
+				if err != nil {
+					t.Fatalf("PresenceAfter returned an error: %s", err)
+				}
+				got := make([]string, 0, len(presences))
+				for _, user := range tc.Want {
+					if _, ok := presences[user]; ok {
+						got = append(got, user)
+					}
+				}
+				if len(presences) != len(tc.Want) || !reflect.DeepEqual(got, tc.Want) {
+					t.Fatalf("got presence of %v, want %v", presences, tc.Want)
+				}
+			})
+		}
+	})
+}
+
+func TestGetAccountDataInRangeFilters(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := MustCreateDatabase(t, dbType)
+		defer close()
+		alice := test.NewUser(t)
+		roomA, roomB := "!a:localhost", "!b:localhost"
+		var latest types.StreamPosition
+		for _, data := range []struct{ roomID, dataType string }{
+			{"", "m.push_rules"},
+			{"", "im.vector.setting"},
+			{roomA, "m.tag"},
+			{roomA, "m.fully_read"},
+			{roomB, "m.tag"},
+		} {
+			pos, err := db.UpsertAccountData(ctx, alice.ID, data.roomID, data.dataType)
+			if err != nil {
+				t.Fatalf("UpsertAccountData returned an error: %s", err)
+			}
+			latest = pos
+		}
+
+		testCases := []struct {
+			Name       string
+			Global     gomatrixserverlib.EventFilter
+			Room       gomatrixserverlib.RoomEventFilter
+			Want       map[string][]string
+			WantLatest bool
+		}{
+			{
+				Name:       "everything",
+				Global:     gomatrixserverlib.EventFilter{Limit: 10},
+				Room:       gomatrixserverlib.RoomEventFilter{Limit: 10},
+				Want:       map[string][]string{"": {"m.push_rules", "im.vector.setting"}, roomA: {"m.tag", "m.fully_read"}, roomB: {"m.tag"}},
+				WantLatest: true,
+			},
+			{
+				Name:       "types",
+				Global:     gomatrixserverlib.EventFilter{Limit: 10, Types: &[]string{"m.*"}},
+				Room:       gomatrixserverlib.RoomEventFilter{Limit: 10, NotTypes: &[]string{"m.fully_read"}},
+				Want:       map[string][]string{"": {"m.push_rules"}, roomA: {"m.tag"}, roomB: {"m.tag"}},
+				WantLatest: true,
+			},
+			{
+				Name:       "rooms",
+				Global:     gomatrixserverlib.EventFilter{Limit: 10, Types: &[]string{}},
+				Room:       gomatrixserverlib.RoomEventFilter{Limit: 10, Rooms: &[]string{roomB}},
+				Want:       map[string][]string{roomB: {"m.tag"}},
+				WantLatest: true,
+			},
+			// the second global row doesn't fit, so it and everything after it waits for the next sync
+			{
+				Name:   "limits",
+				Global: gomatrixserverlib.EventFilter{Limit: 1},
+				Room:   gomatrixserverlib.RoomEventFilter{Limit: 1},
+				Want:   map[string][]string{"": {"m.push_rules"}},
+			},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.Name, func(t *testing.T) {
+				got, pos, err := db.GetAccountDataInRange(ctx, alice.ID, types.Range{From: 0, To: latest}, &tc.Global, &tc.Room)
+				if err != nil {
+					t.Fatalf("GetAccountDataInRange returned an error: %s", err)
+				}
+				if !reflect.DeepEqual(got, tc.Want) {
+					t.Fatalf("got %v, want %v", got, tc.Want)
+				}
+				if (pos == latest) != tc.WantLatest {
+					t.Fatalf("got position %d, latest is %d", pos, latest)
+				}
+			})
+		}
+	})
+}
+
 // The purpose of this test is to ensure that backfill does indeed go backwards, using a topology token
 func TestGetEventsInRangeWithTopologyToken(t *testing.T) {
 	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
@@ -192,6 +426,334 @@ func TestGetEventsInRangeWithTopologyToken(t *testing.T) {
 	})
 }
 
+func TestSearchEvents(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := MustCreateDatabase(t, dbType)
+		defer close()
+		alice := test.NewUser(t)
+		bob := test.NewUser(t)
+		r := test.NewRoom(t, alice)
+		other := test.NewRoom(t, alice)
+
+		bodies := []string{"the quick brown fox", "a brown dog", "quick quick brown", "nothing to see"}
+		var events []*gomatrixserverlib.HeaderedEvent
+		for i, body := range bodies {
+			sender := alice
+			if i == 1 {
+				sender = bob
+			}
+			ev := r.CreateAndInsert(t, sender, "m.room.message", map[string]interface{}{"body": body})
+			events = append(events, ev)
+			if err := db.IndexEventForSearch(ctx, ev, gomatrixserverlib.HistoryVisibilityShared, body); err != nil {
+				t.Fatalf("IndexEventForSearch returned an error: %s", err)
+			}
+		}
+		otherEv := other.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "brown bear"})
+		if err := db.IndexEventForSearch(ctx, otherEv, gomatrixserverlib.HistoryVisibilityJoined, "brown bear"); err != nil {
+			t.Fatalf("IndexEventForSearch returned an error: %s", err)
+		}
+
+		search := func(query string, roomIDs []string, filter *gomatrixserverlib.RoomEventFilter, orderByRank bool, limit, offset int) ([]types.SearchResult, int) {
+			t.Helper()
+			res, count, err := db.SearchEvents(ctx, fulltext.ParseQuery(query), roomIDs, filter, orderByRank, limit, offset)
+			if err != nil {
+				t.Fatalf("SearchEvents returned an error: %s", err)
+			}
+			return res, count
+		}
+		eventIDs := func(res []types.SearchResult) []string {
+			ids := make([]string, len(res))
+			for i := range res {
+				ids[i] = res[i].EventID
+			}
+			return ids
+		}
+		filter := &gomatrixserverlib.RoomEventFilter{}
+
+		// most recent first, only in the given rooms
+		res, count := search("brown", []string{r.ID}, filter, false, 10, 0)
+		if want := []string{events[2].EventID(), events[1].EventID(), events[0].EventID()}; !reflect.DeepEqual(eventIDs(res), want) || count != 3 {
+			t.Fatalf("got %v (count %d), want %v", eventIDs(res), count, want)
+		}
+		res, count = search("BROWN", []string{r.ID, other.ID}, filter, false, 10, 0)
+		if count != 4 || res[0].EventID != otherEv.EventID() || res[0].HistoryVisibility != gomatrixserverlib.HistoryVisibilityJoined {
+			t.Fatalf("got %+v (count %d), want the event in the other room first", res, count)
+		}
+
+		// the event mentioning quick twice ranks highest
+		res, _ = search("quick", []string{r.ID}, filter, true, 10, 0)
+		if len(res) != 2 || res[0].EventID != events[2].EventID() || res[0].Rank <= res[1].Rank {
+			t.Fatalf("got %+v, want %s ranked first", res, events[2].EventID())
+		}
+
+		// phrases must match in order, terms anywhere
+		res, _ = search(`"brown fox"`, []string{r.ID}, filter, false, 10, 0)
+		if want := []string{events[0].EventID()}; !reflect.DeepEqual(eventIDs(res), want) {
+			t.Fatalf("got %v, want %v", eventIDs(res), want)
+		}
+		res, _ = search("brown quick", []string{r.ID}, filter, false, 10, 0)
+		if want := []string{events[2].EventID(), events[0].EventID()}; !reflect.DeepEqual(eventIDs(res), want) {
+			t.Fatalf("got %v, want %v", eventIDs(res), want)
+		}
+
+		// paging and sender filters
+		res, count = search("brown", []string{r.ID}, filter, false, 1, 1)
+		if want := []string{events[1].EventID()}; !reflect.DeepEqual(eventIDs(res), want) || count != 3 {
+			t.Fatalf("got %v (count %d), want %v", eventIDs(res), count, want)
+		}
+		res, _ = search("brown", []string{r.ID}, &gomatrixserverlib.RoomEventFilter{Senders: &[]string{bob.ID}}, false, 10, 0)
+		if want := []string{events[1].EventID()}; !reflect.DeepEqual(eventIDs(res), want) {
+			t.Fatalf("got %v, want %v", eventIDs(res), want)
+		}
+		res, _ = search("brown", []string{r.ID}, &gomatrixserverlib.RoomEventFilter{NotSenders: &[]string{bob.ID}}, false, 10, 0)
+		if want := []string{events[2].EventID(), events[0].EventID()}; !reflect.DeepEqual(eventIDs(res), want) {
+			t.Fatalf("got %v, want %v", eventIDs(res), want)
+		}
+
+		// removed events aren't found anymore
+		if err := db.RemoveEventFromSearch(ctx, events[2].EventID()); err != nil {
+			t.Fatalf("RemoveEventFromSearch returned an error: %s", err)
+		}
+		res, count = search("quick", []string{r.ID}, filter, true, 10, 0)
+		if want := []string{events[0].EventID()}; !reflect.DeepEqual(eventIDs(res), want) || count != 1 {
+			t.Fatalf("got %v (count %d), want %v", eventIDs(res), count, want)
+		}
+	})
+}
+
+func TestRelations(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := MustCreateDatabase(t, dbType)
+		defer close()
+		alice := test.NewUser(t)
+		bob := test.NewUser(t)
+		charlie := test.NewUser(t)
+		r := test.NewRoom(t, alice)
+
+		relatesTo := func(relType, eventID string, extra map[string]interface{}) map[string]interface{} {
+			content := map[string]interface{}{
+				"m.relates_to": map[string]interface{}{"rel_type": relType, "event_id": eventID},
+			}
+			for k, v := range extra {
+				content[k] = v
+			}
+			return content
+		}
+		annotation := func(eventID, key string) map[string]interface{} {
+			return map[string]interface{}{
+				"m.relates_to": map[string]interface{}{"rel_type": "m.annotation", "event_id": eventID, "key": key},
+			}
+		}
+
+		root := r.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "root"})
+		other := r.CreateAndInsert(t, bob, "m.room.message", map[string]interface{}{"body": "other"})
+		reaction1 := r.CreateAndInsert(t, bob, "m.reaction", annotation(root.EventID(), "+1"))
+		reaction2 := r.CreateAndInsert(t, alice, "m.reaction", annotation(root.EventID(), "+1"))
+		reaction3 := r.CreateAndInsert(t, bob, "m.reaction", annotation(root.EventID(), "x"))
+		edit := r.CreateAndInsert(t, alice, "m.room.message", relatesTo("m.replace", root.EventID(), map[string]interface{}{"body": "* root"}))
+		// only the sender may edit an event, so this isn't the latest edit
+		_ = r.CreateAndInsert(t, bob, "m.room.message", relatesTo("m.replace", root.EventID(), map[string]interface{}{"body": "* hacked"}))
+		reply1 := r.CreateAndInsert(t, bob, "m.room.message", relatesTo("m.thread", root.EventID(), map[string]interface{}{"body": "reply 1"}))
+		reply2 := r.CreateAndInsert(t, bob, "m.room.message", relatesTo("m.thread", root.EventID(), map[string]interface{}{"body": "reply 2"}))
+		otherReply := r.CreateAndInsert(t, charlie, "m.room.message", relatesTo("m.thread", other.EventID(), map[string]interface{}{"body": "reply"}))
+		// replies without a rel_type aren't relations
+		_ = r.CreateAndInsert(t, charlie, "m.room.message", map[string]interface{}{
+			"body":         "in reply",
+			"m.relates_to": map[string]interface{}{"m.in_reply_to": map[string]interface{}{"event_id": root.EventID()}},
+		})
+		MustWriteEvents(t, db, r.Events())
+
+		eventIDs := func(events []types.StreamEvent) []string {
+			ids := make([]string, len(events))
+			for i := range events {
+				ids[i] = events[i].EventID()
+			}
+			return ids
+		}
+
+		// all relations, paginating backwards
+		events, next, err := db.RelationsFor(ctx, r.ID, root.EventID(), "", "", 0, 0, true, 5)
+		if err != nil {
+			t.Fatalf("RelationsFor returned an error: %s", err)
+		}
+		if len(events) != 5 || events[0].EventID() != reply2.EventID() || next == 0 {
+			t.Fatalf("got %v (next %d), want 5 relations starting with the latest reply", eventIDs(events), next)
+		}
+		events, next, err = db.RelationsFor(ctx, r.ID, root.EventID(), "", "", next, 0, true, 5)
+		if err != nil {
+			t.Fatalf("RelationsFor returned an error: %s", err)
+		}
+		if want := []string{reaction2.EventID(), reaction1.EventID()}; !reflect.DeepEqual(eventIDs(events), want) || next != 0 {
+			t.Fatalf("got %v (next %d), want %v", eventIDs(events), next, want)
+		}
+
+		// filtered by relation and event type, forwards
+		events, _, err = db.RelationsFor(ctx, r.ID, root.EventID(), "m.annotation", "m.reaction", 0, 0, false, 10)
+		if err != nil {
+			t.Fatalf("RelationsFor returned an error: %s", err)
+		}
+		if want := []string{reaction1.EventID(), reaction2.EventID(), reaction3.EventID()}; !reflect.DeepEqual(eventIDs(events), want) {
+			t.Fatalf("got %v, want %v", eventIDs(events), want)
+		}
+
+		// aggregations
+		bundled := []*gomatrixserverlib.HeaderedEvent{root, other}
+		if err = db.BundleAggregations(ctx, alice.ID, bundled); err != nil {
+			t.Fatalf("BundleAggregations returned an error: %s", err)
+		}
+		var aggregations types.Aggregations
+		if err = json.Unmarshal([]byte(gjson.GetBytes(root.Unsigned(), `m\.relations`).Raw), &aggregations); err != nil {
+			t.Fatalf("failed to unmarshal aggregations: %s", err)
+		}
+		wantAnnotations := []types.AnnotationAggregationEntry{
+			{Type: "m.reaction", Key: "+1", Count: 2},
+			{Type: "m.reaction", Key: "x", Count: 1},
+		}
+		if aggregations.Annotation == nil || !reflect.DeepEqual(aggregations.Annotation.Chunk, wantAnnotations) {
+			t.Fatalf("got annotations %+v, want %+v", aggregations.Annotation, wantAnnotations)
+		}
+		if aggregations.Replace == nil || aggregations.Replace.EventID != edit.EventID() {
+			t.Fatalf("got edit %+v, want %s", aggregations.Replace, edit.EventID())
+		}
+		if thread := aggregations.Thread; thread == nil || thread.Count != 2 || thread.LatestEvent.EventID != reply2.EventID() || !thread.CurrentUserParticipated {
+			t.Fatalf("got thread %+v, want 2 replies ending with %s", thread, reply2.EventID())
+		}
+		otherThread := gjson.GetBytes(other.Unsigned(), `m\.relations.m\.thread`)
+		if otherThread.Get("latest_event.event_id").Str != otherReply.EventID() || otherThread.Get("current_user_participated").Bool() {
+			t.Fatalf("got thread %s, want %s as the latest event without participation", otherThread.Raw, otherReply.EventID())
+		}
+
+		// threads, most recently active first
+		events, next, err = db.ThreadsFor(ctx, r.ID, "", 0, 1)
+		if err != nil {
+			t.Fatalf("ThreadsFor returned an error: %s", err)
+		}
+		if want := []string{other.EventID()}; !reflect.DeepEqual(eventIDs(events), want) || next == 0 {
+			t.Fatalf("got %v (next %d), want %v", eventIDs(events), next, want)
+		}
+		events, _, err = db.ThreadsFor(ctx, r.ID, "", next, 1)
+		if err != nil {
+			t.Fatalf("ThreadsFor returned an error: %s", err)
+		}
+		if want := []string{root.EventID()}; !reflect.DeepEqual(eventIDs(events), want) {
+			t.Fatalf("got %v, want %v", eventIDs(events), want)
+		}
+		for participant, want := range map[string][]string{
+			alice.ID:   {root.EventID()},
+			bob.ID:     {other.EventID(), root.EventID()},
+			charlie.ID: {other.EventID()},
+		} {
+			events, _, err = db.ThreadsFor(ctx, r.ID, participant, 0, 10)
+			if err != nil {
+				t.Fatalf("ThreadsFor returned an error: %s", err)
+			}
+			if !reflect.DeepEqual(eventIDs(events), want) {
+				t.Fatalf("%s: got %v, want %v", participant, eventIDs(events), want)
+			}
+		}
+	})
+}
+
+func TestUnreadCounts(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := MustCreateDatabase(t, dbType)
+		defer close()
+		alice := test.NewUser(t)
+		bob := test.NewUser(t)
+		r := test.NewRoom(t, alice)
+		MustWriteEvents(t, db, r.Events())
+		users := []string{alice.ID, bob.ID}
+
+		send := func(sender *test.User, content map[string]interface{}) *gomatrixserverlib.HeaderedEvent {
+			t.Helper()
+			ev := r.CreateAndInsert(t, sender, "m.room.message", content)
+			pos := MustWriteEvents(t, db, []*gomatrixserverlib.HeaderedEvent{ev})[0]
+			if _, err := db.UpdateUnreadCountsForEvent(ctx, ev, pos, users); err != nil {
+				t.Fatalf("UpdateUnreadCountsForEvent returned an error: %s", err)
+			}
+			return ev
+		}
+		// returns the counts by thread as [unread, notifications, highlights]
+		counts := func(userID string, after types.StreamPosition) map[string][3]int {
+			t.Helper()
+			res, err := db.GetUserUnreadCounts(ctx, userID, after)
+			if err != nil {
+				t.Fatalf("GetUserUnreadCounts returned an error: %s", err)
+			}
+			got := map[string][3]int{}
+			for _, c := range res {
+				if c.RoomID != r.ID {
+					t.Fatalf("got counts for room %s, want %s", c.RoomID, r.ID)
+				}
+				got[c.ThreadID] = [3]int{c.UnreadCount, c.NotificationCount, c.HighlightCount}
+			}
+			return got
+		}
+		assertCounts := func(userID string, after types.StreamPosition, want map[string][3]int) {
+			t.Helper()
+			if got := counts(userID, after); !reflect.DeepEqual(got, want) {
+				t.Fatalf("got counts %v, want %v", got, want)
+			}
+		}
+
+		root := send(alice, map[string]interface{}{"msgtype": "m.text", "body": "root"})
+		send(alice, map[string]interface{}{"msgtype": "m.notice", "body": "notices don't count"})
+		reply := send(alice, map[string]interface{}{"msgtype": "m.text", "body": "reply", "m.relates_to": map[string]interface{}{
+			"rel_type": "m.thread", "event_id": root.EventID(),
+		}})
+		send(alice, map[string]interface{}{"msgtype": "m.text", "body": "* edits don't count", "m.relates_to": map[string]interface{}{
+			"rel_type": "m.replace", "event_id": root.EventID(),
+		}})
+		if _, err := db.UpdateUnreadNotificationCountsForEvent(ctx, bob.ID, reply.EventID(), true); err != nil {
+			t.Fatalf("UpdateUnreadNotificationCountsForEvent returned an error: %s", err)
+		}
+		latest := send(alice, map[string]interface{}{"msgtype": "m.text", "body": "latest"})
+
+		// the sender doesn't have unread messages
+		assertCounts(alice.ID, 0, map[string][3]int{})
+		assertCounts(bob.ID, 0, map[string][3]int{
+			"":             {2, 0, 0},
+			root.EventID(): {1, 1, 1},
+		})
+
+		// reading the root leaves the later messages unread
+		if _, err := db.MarkUnreadCountsRead(ctx, bob.ID, r.ID, root.EventID()); err != nil {
+			t.Fatalf("MarkUnreadCountsRead returned an error: %s", err)
+		}
+		assertCounts(bob.ID, 0, map[string][3]int{
+			"":             {1, 0, 0},
+			root.EventID(): {1, 1, 1},
+		})
+
+		// reading the latest event clears everything
+		pos, err := db.MarkUnreadCountsRead(ctx, bob.ID, r.ID, latest.EventID())
+		if err != nil {
+			t.Fatalf("MarkUnreadCountsRead returned an error: %s", err)
+		}
+		if pos == 0 {
+			t.Fatalf("MarkUnreadCountsRead didn't change anything")
+		}
+		assertCounts(bob.ID, 0, map[string][3]int{
+			"":             {0, 0, 0},
+			root.EventID(): {0, 0, 0},
+		})
+		// cleared counts are only returned if they changed after the position
+		assertCounts(bob.ID, pos, map[string][3]int{})
+
+		// sending a message in the thread reads it
+		send(alice, map[string]interface{}{"msgtype": "m.text", "body": "reply 2", "m.relates_to": map[string]interface{}{
+			"rel_type": "m.thread", "event_id": root.EventID(),
+		}})
+		assertCounts(bob.ID, pos, map[string][3]int{root.EventID(): {1, 0, 0}})
+		send(bob, map[string]interface{}{"msgtype": "m.text", "body": "reply 3", "m.relates_to": map[string]interface{}{
+			"rel_type": "m.thread", "event_id": root.EventID(),
+		}})
+		if got := counts(bob.ID, 0)[root.EventID()]; got != [3]int{} {
+			t.Fatalf("got thread counts %v after replying, want none", got)
+		}
+	})
+}
+
 /*
 // The purpose of this test is to make sure that backpagination returns all events, even if some events have the same depth.
 // For cases where events have the same depth, the streaming token should be used to tie break so events written via WriteEvent
@@ -204,6 +766,102 @@ func TestGetEventsInRangeWithTopologyToken(t *testing.T) {
 // With a total depth of 4. It tests that:
 // - Backpagination over the whole fork should include all messages and not leave any out.
 // - Backpagination from the middle of the fork should not return duplicates (things later than the token).
+func TestEventHistory(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := MustCreateDatabase(t, dbType)
+		defer close()
+		alice := test.NewUser(t)
+		bob := test.NewUser(t)
+		r := test.NewRoom(t, alice)
+
+		root := r.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "root"})
+		edit := r.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{
+			"body":         "* edited",
+			"m.relates_to": map[string]interface{}{"rel_type": "m.replace", "event_id": root.EventID()},
+		})
+		other := r.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "other"})
+		MustWriteEvents(t, db, r.Events())
+
+		redact := func(ev *gomatrixserverlib.HeaderedEvent, keepOriginal bool) *gomatrixserverlib.HeaderedEvent {
+			redaction := r.CreateEvent(t, bob, "m.room.redaction", map[string]interface{}{"redacts": ev.EventID()})
+			if err := db.RedactEvent(ctx, ev.EventID(), redaction, keepOriginal); err != nil {
+				t.Fatalf("RedactEvent returned an error: %s", err)
+			}
+			return redaction
+		}
+		editRedaction := redact(edit, true)
+		redact(other, false)
+
+		original, err := db.RedactedEvent(ctx, edit.EventID())
+		if err != nil {
+			t.Fatalf("RedactedEvent returned an error: %s", err)
+		}
+		if original == nil {
+			t.Fatalf("the original version of the redacted edit wasn't kept")
+		}
+		if body := gjson.GetBytes(original.Event.Content(), "body").Str; body != "* edited" {
+			t.Fatalf("got original body %q, want %q", body, "* edited")
+		}
+		if original.ReplacesEventID != root.EventID() || original.RedactedBy != editRedaction.EventID() || original.Redacter != bob.ID {
+			t.Fatalf("unexpected redaction details %+v", original)
+		}
+		// a second redaction doesn't replace the original version
+		redact(edit, true)
+		if original, err = db.RedactedEvent(ctx, edit.EventID()); err != nil || original == nil || original.RedactedBy != editRedaction.EventID() {
+			t.Fatalf("got %+v (err %v), want the original version of the first redaction", original, err)
+		}
+		if original, err = db.RedactedEvent(ctx, other.EventID()); err != nil || original != nil {
+			t.Fatalf("got %+v (err %v), want no original version of an event redacted without keeping it", original, err)
+		}
+
+		edits, err := db.RedactedEditsFor(ctx, r.ID, root.EventID())
+		if err != nil {
+			t.Fatalf("RedactedEditsFor returned an error: %s", err)
+		}
+		if len(edits) != 1 || edits[0].Event.EventID() != edit.EventID() {
+			t.Fatalf("got %d redacted edits, want the redacted edit", len(edits))
+		}
+
+		purged, err := db.PurgeRedactedEvents(ctx, gomatrixserverlib.AsTimestamp(time.Now().Add(-time.Hour)))
+		if err != nil || purged != 0 {
+			t.Fatalf("got %d purged events (err %v), want none redacted an hour ago", purged, err)
+		}
+		purged, err = db.PurgeRedactedEvents(ctx, gomatrixserverlib.AsTimestamp(time.Now().Add(time.Minute)))
+		if err != nil || purged != 1 {
+			t.Fatalf("got %d purged events (err %v), want 1", purged, err)
+		}
+		if original, err = db.RedactedEvent(ctx, edit.EventID()); err != nil || original != nil {
+			t.Fatalf("got %+v (err %v), want the purged original version to be gone", original, err)
+		}
+
+		for i, eventID := range []string{root.EventID(), edit.EventID()} {
+			entry := &types.EventHistoryAuditEntry{
+				UserID:    alice.ID,
+				RoomID:    r.ID,
+				EventID:   eventID,
+				Timestamp: gomatrixserverlib.Timestamp(i + 1),
+			}
+			if err = db.StoreEventHistoryAudit(ctx, entry); err != nil {
+				t.Fatalf("StoreEventHistoryAudit returned an error: %s", err)
+			}
+		}
+		entries, err := db.EventHistoryAuditFor(ctx, r.ID, 10)
+		if err != nil {
+			t.Fatalf("EventHistoryAuditFor returned an error: %s", err)
+		}
+		want := []types.EventHistoryAuditEntry{
+			{UserID: alice.ID, RoomID: r.ID, EventID: edit.EventID(), Timestamp: 2},
+			{UserID: alice.ID, RoomID: r.ID, EventID: root.EventID(), Timestamp: 1},
+		}
+		if !reflect.DeepEqual(entries, want) {
+			t.Fatalf("got audit log %+v, want %+v", entries, want)
+		}
+		if entries, err = db.EventHistoryAuditFor(ctx, "!other:server", 10); err != nil || len(entries) != 0 {
+			t.Fatalf("got %d audit entries (err %v) of another room, want none", len(entries), err)
+		}
+	})
+}
+
 func TestGetEventsInRangeWithEventsSameDepth(t *testing.T) {
 	t.Parallel()
 	db := MustCreateDatabase(t)
@@ -21,14 +21,16 @@ import (
 	"github.com/matrix-org/gomatrixserverlib"
 
 	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/internal/fulltext"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/syncapi/types"
 )
 
 type AccountData interface {
 	InsertAccountData(ctx context.Context, txn *sql.Tx, userID, roomID, dataType string) (pos types.StreamPosition, err error)
-	// SelectAccountDataInRange returns a map of room ID to a list of `dataType`.
-	SelectAccountDataInRange(ctx context.Context, userID string, r types.Range, accountDataEventFilter *gomatrixserverlib.EventFilter) (data map[string][]string, pos types.StreamPosition, err error)
+	// SelectAccountDataInRange returns a map of room ID to a list of `dataType`. The event filter applies
+	// to global account data, the room event filter to room account data.
+	SelectAccountDataInRange(ctx context.Context, userID string, r types.Range, accountDataEventFilter *gomatrixserverlib.EventFilter, roomAccountDataEventFilter *gomatrixserverlib.RoomEventFilter) (data map[string][]string, pos types.StreamPosition, err error)
 	SelectMaxAccountDataID(ctx context.Context, txn *sql.Tx) (id int64, err error)
 }
 
@@ -53,6 +55,8 @@ type Peeks interface {
 type Events interface {
 	SelectStateInRange(ctx context.Context, txn *sql.Tx, r types.Range, stateFilter *gomatrixserverlib.StateFilter, roomIDs []string) (map[string]map[string]bool, map[string]types.StreamEvent, error)
 	SelectMaxEventID(ctx context.Context, txn *sql.Tx) (id int64, err error)
+	// SelectMaxEventIDsForRooms returns the stream position of the latest event in each room which isn't excluded from sync.
+	SelectMaxEventIDsForRooms(ctx context.Context, txn *sql.Tx, roomIDs []string) (map[string]types.StreamPosition, error)
 	InsertEvent(
 		ctx context.Context, txn *sql.Tx,
 		event *gomatrixserverlib.HeaderedEvent,
@@ -171,8 +175,8 @@ type SendToDevice interface {
 }
 
 type Filter interface {
-	SelectFilter(ctx context.Context, target *gomatrixserverlib.Filter, localpart string, filterID string) error
-	InsertFilter(ctx context.Context, filter *gomatrixserverlib.Filter, localpart string) (filterID string, err error)
+	SelectFilter(ctx context.Context, target *types.Filter, localpart string, filterID string) error
+	InsertFilter(ctx context.Context, filter *types.Filter, localpart string) (filterID string, err error)
 }
 
 type Receipts interface {
@@ -198,6 +202,84 @@ type Ignores interface {
 	UpsertIgnores(ctx context.Context, userID string, ignores *types.IgnoredUsers) error
 }
 
+// Search is the full-text index of message bodies. Only the position of an event
+// is kept, the event itself is looked up in the events table when it is found.
+type Search interface {
+	// InsertSearchEvent adds the text of the event to the index. Events which are
+	// already indexed are left alone.
+	InsertSearchEvent(ctx context.Context, txn *sql.Tx, eventID, roomID, sender string, ts gomatrixserverlib.Timestamp, historyVisibility gomatrixserverlib.HistoryVisibility, text string) error
+	// DeleteSearchEvent removes the event from the index, i.e. because it was redacted.
+	DeleteSearchEvent(ctx context.Context, txn *sql.Tx, eventID string) error
+	// SelectSearch returns up to limit events in the rooms which contain all the phrases,
+	// skipping the first offset ones, along with the total number of matching events.
+	// The best matching events come first if orderByRank is set, the most recent ones otherwise.
+	SelectSearch(ctx context.Context, txn *sql.Tx, phrases []fulltext.Phrase, roomIDs []string, filter *gomatrixserverlib.RoomEventFilter, orderByRank bool, limit, offset int) ([]types.SearchResult, int, error)
+}
+
+// Relations records which events relate to other events through m.relates_to. Relations
+// are keyed by the stream position of the relating (child) event.
+type Relations interface {
+	// InsertRelation stores that the child event relates to the event. Relations which
+	// are already stored are left alone.
+	InsertRelation(ctx context.Context, txn *sql.Tx, pos types.StreamPosition, roomID, eventID, childEventID, childEventType, relType, sender, key string) error
+	// DeleteRelation removes the relation of the child event, i.e. because it was redacted.
+	DeleteRelation(ctx context.Context, txn *sql.Tx, roomID, childEventID string) error
+	// SelectRelationsInRange returns up to limit relations to the event in the range, in the
+	// direction of the range. The relation type and child event type are only matched if not empty.
+	SelectRelationsInRange(ctx context.Context, txn *sql.Tx, roomID, eventID, relType, eventType string, r types.Range, limit int) ([]types.RelationEntry, error)
+	// SelectRelationsOfType returns all relations of the type to the events, oldest first.
+	SelectRelationsOfType(ctx context.Context, txn *sql.Tx, roomID string, eventIDs []string, relType string) ([]types.RelationEntry, error)
+	// SelectAnnotationCounts counts the annotations on the events by type and key, most used first.
+	SelectAnnotationCounts(ctx context.Context, txn *sql.Tx, roomID string, eventIDs []string) ([]types.AnnotationCount, error)
+	// SelectThreadSummaries returns the summaries of the threads rooted at the events.
+	// Participated is set if userID replied in the thread.
+	SelectThreadSummaries(ctx context.Context, txn *sql.Tx, roomID string, eventIDs []string, userID string) ([]types.ThreadSummary, error)
+	// SelectThreads returns up to limit threads in the room whose latest reply is before the
+	// position, most recently active first. Only the root event ID and latest position are set.
+	// If participant isn't empty only threads they started or replied to are returned.
+	SelectThreads(ctx context.Context, txn *sql.Tx, roomID, participant string, before types.StreamPosition, limit int) ([]types.ThreadSummary, error)
+}
+
+// UnreadCounts keeps the unread counts of users for each thread of a room. Changes take
+// their stream positions from the notification data, so that they wake up syncs.
+type UnreadCounts interface {
+	// UpsertUnreadCounts adds to the counts of the thread for each of the users, which are
+	// created if needed, and records the position of the event which was counted. The user
+	// IDs must be distinct. All of the changes get the same stream position.
+	UpsertUnreadCounts(ctx context.Context, txn *sql.Tx, userIDs []string, roomID, threadID string, eventPos types.StreamPosition, unread, notifications, highlights int) (types.StreamPosition, error)
+	// UpdateUnreadCounts replaces the counts of the thread. Returns sql.ErrNoRows if there
+	// are no counts for the thread or they already have these values.
+	UpdateUnreadCounts(ctx context.Context, txn *sql.Tx, userID, roomID, threadID string, unread, notifications, highlights int) (types.StreamPosition, error)
+	// SelectRoomUnreadCounts returns the counts of every thread of the room.
+	SelectRoomUnreadCounts(ctx context.Context, txn *sql.Tx, userID, roomID string) ([]types.UnreadCounts, error)
+	// SelectUserUnreadCounts returns the counts of the user which aren't zero or which
+	// changed after the position.
+	SelectUserUnreadCounts(ctx context.Context, txn *sql.Tx, userID string, after types.StreamPosition) ([]types.UnreadCounts, error)
+	SelectMaxUnreadCountsID(ctx context.Context, txn *sql.Tx) (types.StreamPosition, error)
+}
+
+// RedactedEvents keeps the original versions of redacted events for a while, so that
+// room moderators can look at them.
+type RedactedEvents interface {
+	// InsertRedactedEvent stores the original version of the event. Events which are already
+	// stored are left alone, so that a second redaction doesn't replace the original.
+	InsertRedactedEvent(ctx context.Context, txn *sql.Tx, event *types.RedactedEvent) error
+	// SelectRedactedEvent returns the original version of the event, or nil if it isn't kept.
+	SelectRedactedEvent(ctx context.Context, txn *sql.Tx, eventID string) (*types.RedactedEvent, error)
+	// SelectRedactedEdits returns the original versions of the redacted edits of the event.
+	SelectRedactedEdits(ctx context.Context, txn *sql.Tx, roomID, eventID string) ([]*types.RedactedEvent, error)
+	// DeleteRedactedEventsBefore removes the events which were redacted before the time and
+	// returns how many were removed.
+	DeleteRedactedEventsBefore(ctx context.Context, txn *sql.Tx, before gomatrixserverlib.Timestamp) (int64, error)
+}
+
+// EventHistoryAudit records which users looked at the history of events.
+type EventHistoryAudit interface {
+	InsertEventHistoryAudit(ctx context.Context, txn *sql.Tx, entry *types.EventHistoryAuditEntry) error
+	// SelectEventHistoryAudit returns up to limit entries of the room, newest first.
+	SelectEventHistoryAudit(ctx context.Context, txn *sql.Tx, roomID string, limit int) ([]types.EventHistoryAuditEntry, error)
+}
+
 type Presence interface {
 	UpsertPresence(ctx context.Context, txn *sql.Tx, userID string, statusMsg *string, presence types.Presence, lastActiveTS gomatrixserverlib.Timestamp, fromSync bool) (pos types.StreamPosition, err error)
 	GetPresenceForUser(ctx context.Context, txn *sql.Tx, userID string) (presence *types.PresenceInternal, err error)
@@ -3,6 +3,7 @@ package streams
 import (
 	"context"
 
+	"github.com/matrix-org/dendrite/syncapi/internal"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -44,7 +45,7 @@ func (p *AccountDataStreamProvider) IncrementalSync(
 	}
 
 	dataTypes, pos, err := p.DB.GetAccountDataInRange(
-		ctx, req.Device.UserID, r, &req.Filter.AccountData,
+		ctx, req.Device.UserID, r, &req.Filter.AccountData, &req.Filter.Room.AccountData,
 	)
 	if err != nil {
 		req.Log.WithError(err).Error("p.DB.GetAccountDataInRange failed")
@@ -58,6 +59,9 @@ func (p *AccountDataStreamProvider) IncrementalSync(
 		if from == 0 && roomID != "" && !req.IsRoomPresent(roomID) {
 			continue
 		}
+		if roomID != "" && !internal.RoomAllowed(req.Filter.Room.Rooms, req.Filter.Room.NotRooms, roomID) {
+			continue
+		}
 
 		// Request the missing data from the database
 		for _, dataType := range dataTypes {
@@ -7,6 +7,7 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/matrix-org/dendrite/syncapi/internal"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -58,11 +59,17 @@ func (p *InviteStreamProvider) IncrementalSync(
 		if _, ok := req.IgnoredUsers.List[inviteEvent.Sender()]; ok {
 			continue
 		}
+		if !internal.RoomAllowed(req.Filter.Room.Rooms, req.Filter.Room.NotRooms, roomID) {
+			continue
+		}
 		ir := types.NewInviteResponse(inviteEvent)
 		req.Response.Rooms.Invite[roomID] = *ir
 	}
 
 	for roomID := range retiredInvites {
+		if !internal.RoomAllowed(req.Filter.Room.Rooms, req.Filter.Room.NotRooms, roomID) {
+			continue
+		}
 		if _, ok := req.Response.Rooms.Join[roomID]; !ok {
 			lr := types.NewLeaveResponse()
 			h := sha256.Sum256(append([]byte(roomID), []byte(strconv.FormatInt(int64(to), 10))...))
@@ -4,6 +4,7 @@ import (
 	"context"
 
 	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 type NotificationDataStreamProvider struct {
@@ -39,16 +40,61 @@ func (p *NotificationDataStreamProvider) IncrementalSync(
 		return from
 	}
 
+	unreadCounts, err := p.DB.GetUserUnreadCounts(ctx, req.Device.UserID, from)
+	if err != nil {
+		req.Log.WithError(err).Error("GetUserUnreadCounts failed")
+		return from
+	}
+
+	// Joined rooms whose unread counts changed are added even if nothing
+	// else happened in them, so that clients see the counts being cleared.
+	threadCounts := make(map[string][]types.UnreadCounts)
+	for _, counts := range unreadCounts {
+		threadCounts[counts.RoomID] = append(threadCounts[counts.RoomID], counts)
+		if counts.StreamPos <= from || counts.StreamPos > to || req.Rooms[counts.RoomID] != gomatrixserverlib.Join {
+			continue
+		}
+		if _, ok := req.Response.Rooms.Join[counts.RoomID]; !ok {
+			req.Response.Rooms.Join[counts.RoomID] = *types.NewJoinResponse()
+		}
+	}
+
 	// We're merely decorating existing rooms. Note that the Join map
 	// values are not pointers.
 	for roomID, jr := range req.Response.Rooms.Join {
-		counts := countsByRoom[roomID]
-		if counts == nil {
-			continue
+		if counts := countsByRoom[roomID]; counts != nil {
+			jr.UnreadNotifications.HighlightCount = counts.UnreadHighlightCount
+			jr.UnreadNotifications.NotificationCount = counts.UnreadNotificationCount
 		}
 
-		jr.UnreadNotifications.HighlightCount = counts.UnreadHighlightCount
-		jr.UnreadNotifications.NotificationCount = counts.UnreadNotificationCount
+		jr.UnreadCount = 0
+		for _, counts := range threadCounts[roomID] {
+			jr.UnreadCount += counts.UnreadCount
+			if !req.UnreadThreadNotifications || counts.ThreadID == "" {
+				continue
+			}
+			// Threads which were read are only sent when they change, to clear them.
+			if counts.NotificationCount == 0 && counts.HighlightCount == 0 && (from == 0 || counts.StreamPos <= from) {
+				continue
+			}
+			if jr.UnreadThreadNotifications == nil {
+				jr.UnreadThreadNotifications = make(map[string]types.UnreadNotifications)
+			}
+			jr.UnreadThreadNotifications[counts.ThreadID] = types.UnreadNotifications{
+				HighlightCount:    counts.HighlightCount,
+				NotificationCount: counts.NotificationCount,
+			}
+			// The room counts from the user API include the threads, which
+			// are left out of them once they are sent separately.
+			jr.UnreadNotifications.HighlightCount -= counts.HighlightCount
+			jr.UnreadNotifications.NotificationCount -= counts.NotificationCount
+		}
+		if jr.UnreadNotifications.HighlightCount < 0 {
+			jr.UnreadNotifications.HighlightCount = 0
+		}
+		if jr.UnreadNotifications.NotificationCount < 0 {
+			jr.UnreadNotifications.NotificationCount = 0
+		}
 		req.Response.Rooms.Join[roomID] = jr
 	}
 	return to
@@ -10,6 +10,7 @@ import (
 
 	"github.com/matrix-org/dendrite/internal/caching"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/internal"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 
@@ -96,9 +97,9 @@ func (p *PDUStreamProvider) CompleteSync(
 		req.Log.WithError(err).Error("p.DB.RoomIDsWithMembership failed")
 		return from
 	}
+	joinedRoomIDs = filterRoomIDs(&req.Filter.Room, joinedRoomIDs)
 
-	stateFilter := req.Filter.Room.State
-	eventFilter := req.Filter.Room.Timeline
+	stateFilter, eventFilter := roomFilters(&req.Filter.Room)
 
 	if err = p.addIgnoredUsersToFilter(ctx, req, &eventFilter); err != nil {
 		req.Log.WithError(err).Error("unable to update event filter with ignored users")
@@ -146,7 +147,7 @@ func (p *PDUStreamProvider) CompleteSync(
 		return from
 	}
 	for _, peek := range peeks {
-		if !peek.Deleted {
+		if !peek.Deleted && internal.RoomAllowed(req.Filter.Room.Rooms, req.Filter.Room.NotRooms, peek.RoomID) {
 			var jr *types.JoinResponse
 			jr, err = p.getJoinResponseForCompleteSync(
 				ctx, peek.RoomID, r, &stateFilter, &eventFilter, req.WantFullState, req.Device,
@@ -177,8 +178,7 @@ func (p *PDUStreamProvider) IncrementalSync(
 	var stateDeltas []types.StateDelta
 	var joinedRooms []string
 
-	stateFilter := req.Filter.Room.State
-	eventFilter := req.Filter.Room.Timeline
+	stateFilter, eventFilter := roomFilters(&req.Filter.Room)
 
 	if req.WantFullState {
 		if stateDeltas, joinedRooms, err = p.DB.GetStateDeltasForFullStateSync(ctx, req.Device, r, req.Device.UserID, &stateFilter); err != nil {
@@ -192,9 +192,18 @@ func (p *PDUStreamProvider) IncrementalSync(
 		}
 	}
 
+	// Rooms excluded by the filter are left out of every section of the response.
+	joinedRooms = filterRoomIDs(&req.Filter.Room, joinedRooms)
 	for _, roomID := range joinedRooms {
 		req.Rooms[roomID] = gomatrixserverlib.Join
 	}
+	allowedDeltas := stateDeltas[:0]
+	for _, delta := range stateDeltas {
+		if internal.RoomAllowed(req.Filter.Room.Rooms, req.Filter.Room.NotRooms, delta.RoomID) {
+			allowedDeltas = append(allowedDeltas, delta)
+		}
+	}
+	stateDeltas = allowedDeltas
 
 	if len(stateDeltas) == 0 {
 		return to
@@ -241,7 +250,7 @@ func (p *PDUStreamProvider) addRoomDeltaToResponse(
 		// This is all "okay" assuming history_visibility == "shared" which it is by default.
 		r.To = delta.MembershipPos
 	}
-	recentStreamEvents, limited, err := p.DB.RecentEvents(
+	recentStreamEvents, limited, err := p.recentEvents(
 		ctx, delta.RoomID, r,
 		eventFilter, true, true,
 	)
@@ -251,8 +260,14 @@ func (p *PDUStreamProvider) addRoomDeltaToResponse(
 		}
 		return r.From, fmt.Errorf("p.DB.RecentEvents: %w", err)
 	}
+	if !internal.RoomAllowed(stateFilter.Rooms, stateFilter.NotRooms, delta.RoomID) {
+		delta.StateEvents = nil
+	}
 	recentEvents := p.DB.StreamEventsToEvents(device, recentStreamEvents)
 	delta.StateEvents = removeDuplicates(delta.StateEvents, recentEvents) // roll back
+	if err = p.DB.BundleAggregations(ctx, device.UserID, recentEvents); err != nil {
+		return r.From, fmt.Errorf("p.DB.BundleAggregations: %w", err)
+	}
 	prevBatch, err := p.DB.GetBackwardTopologyPos(ctx, recentStreamEvents)
 	if err != nil {
 		return r.From, fmt.Errorf("p.DB.GetBackwardTopologyPos: %w", err)
@@ -343,6 +358,22 @@ func (p *PDUStreamProvider) addRoomDeltaToResponse(
 	return latestPosition, nil
 }
 
+// RoomResponse implements types.RoomStreamProvider.
+func (p *PDUStreamProvider) RoomResponse(
+	ctx context.Context,
+	req *types.SyncRequest,
+	roomID string,
+	r types.Range,
+	stateFilter *gomatrixserverlib.StateFilter,
+	eventFilter *gomatrixserverlib.RoomEventFilter,
+) (*types.JoinResponse, error) {
+	filter := *eventFilter
+	if err := p.addIgnoredUsersToFilter(ctx, req, &filter); err != nil {
+		req.Log.WithError(err).Error("unable to update event filter with ignored users")
+	}
+	return p.getJoinResponseForCompleteSync(ctx, roomID, r, stateFilter, &filter, req.WantFullState, req.Device)
+}
+
 func (p *PDUStreamProvider) addRoomSummary(ctx context.Context, jr *types.JoinResponse, roomID, userID string, latestPosition types.StreamPosition) {
 	// Work out how many members are in the room.
 	joinedCount, _ := p.DB.MembershipCount(ctx, roomID, gomatrixserverlib.Join, latestPosition)
@@ -394,7 +425,7 @@ func (p *PDUStreamProvider) getJoinResponseForCompleteSync(
 	jr = types.NewJoinResponse()
 	// TODO: When filters are added, we may need to call this multiple times to get enough events.
 	//       See: https://github.com/matrix-org/synapse/blob/v0.19.3/synapse/handlers/sync.py#L316
-	recentStreamEvents, limited, err := p.DB.RecentEvents(
+	recentStreamEvents, limited, err := p.recentEvents(
 		ctx, roomID, r, eventFilter, true, true,
 	)
 	if err != nil {
@@ -445,9 +476,12 @@ func (p *PDUStreamProvider) getJoinResponseForCompleteSync(
 		}
 	}
 
-	stateEvents, err := p.DB.CurrentState(ctx, roomID, stateFilter, excludingEventIDs)
-	if err != nil {
-		return
+	var stateEvents []*gomatrixserverlib.HeaderedEvent
+	if internal.RoomAllowed(stateFilter.Rooms, stateFilter.NotRooms, roomID) {
+		stateEvents, err = p.DB.CurrentState(ctx, roomID, stateFilter, excludingEventIDs)
+		if err != nil {
+			return
+		}
 	}
 
 	// Retrieve the backward topology position, i.e. the position of the
@@ -473,6 +507,9 @@ func (p *PDUStreamProvider) getJoinResponseForCompleteSync(
 	// "Can sync a room with a message with a transaction id" - which does a complete sync to check.
 	recentEvents := p.DB.StreamEventsToEvents(device, recentStreamEvents)
 	stateEvents = removeDuplicates(stateEvents, recentEvents)
+	if err = p.DB.BundleAggregations(ctx, device.UserID, recentEvents); err != nil {
+		return
+	}
 
 	if stateFilter.LazyLoadMembers {
 		if err != nil {
@@ -557,6 +594,44 @@ func (p *PDUStreamProvider) lazyLoadMembers(
 	return stateEvents, nil
 }
 
+// recentEvents returns the timeline events of the room, or nothing if the
+// room is excluded by the rooms or not_rooms of the timeline filter.
+func (p *PDUStreamProvider) recentEvents(
+	ctx context.Context, roomID string, r types.Range,
+	eventFilter *gomatrixserverlib.RoomEventFilter, chronologicalOrder bool, onlySyncEvents bool,
+) ([]types.StreamEvent, bool, error) {
+	if !internal.RoomAllowed(eventFilter.Rooms, eventFilter.NotRooms, roomID) {
+		return nil, false, nil
+	}
+	return p.DB.RecentEvents(ctx, roomID, r, eventFilter, chronologicalOrder, onlySyncEvents)
+}
+
+// roomFilters returns copies of the state and timeline filters of the room filter.
+// Lazy loading belongs to the state filter, but it is honoured on the timeline
+// filter too as some clients set it there.
+func roomFilters(filter *gomatrixserverlib.RoomFilter) (gomatrixserverlib.StateFilter, gomatrixserverlib.RoomEventFilter) {
+	stateFilter, eventFilter := filter.State, filter.Timeline
+	if eventFilter.LazyLoadMembers {
+		stateFilter.LazyLoadMembers = true
+		stateFilter.IncludeRedundantMembers = stateFilter.IncludeRedundantMembers || eventFilter.IncludeRedundantMembers
+	}
+	return stateFilter, eventFilter
+}
+
+// filterRoomIDs removes the rooms excluded by the rooms and not_rooms of the room filter.
+func filterRoomIDs(filter *gomatrixserverlib.RoomFilter, roomIDs []string) []string {
+	if filter.Rooms == nil && filter.NotRooms == nil {
+		return roomIDs
+	}
+	res := make([]string, 0, len(roomIDs))
+	for _, roomID := range roomIDs {
+		if internal.RoomAllowed(filter.Rooms, filter.NotRooms, roomID) {
+			res = append(res, roomID)
+		}
+	}
+	return res
+}
+
 // addIgnoredUsersToFilter adds ignored users to the eventfilter and
 // the syncreq itself for further use in streams.
 func (p *PDUStreamProvider) addIgnoredUsersToFilter(ctx context.Context, req *types.SyncRequest, eventFilter *gomatrixserverlib.RoomEventFilter) error {
@@ -19,6 +19,7 @@ import (
 	"encoding/json"
 	"sync"
 
+	"github.com/matrix-org/dendrite/syncapi/internal"
 	"github.com/matrix-org/dendrite/syncapi/notifier"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -27,8 +28,9 @@ import (
 type PresenceStreamProvider struct {
 	StreamProvider
 	// cache contains previously sent presence updates to avoid unneeded updates
-	cache    sync.Map
-	notifier *notifier.Notifier
+	cache      sync.Map
+	notifier   *notifier.Notifier
+	visibility *internal.PresenceVisibility
 }
 
 func (p *PresenceStreamProvider) Setup() {
@@ -53,8 +55,17 @@ func (p *PresenceStreamProvider) IncrementalSync(
 	req *types.SyncRequest,
 	from, to types.StreamPosition,
 ) types.StreamPosition {
+	filter := &req.Filter.Presence
+	if !internal.TypeAllowed(filter.Types, filter.NotTypes, gomatrixserverlib.MPresence) {
+		return to
+	}
+
 	// We pull out a larger number than the filter asks for, since we're filtering out events later
-	presences, err := p.DB.PresenceAfter(ctx, from, gomatrixserverlib.EventFilter{Limit: 1000})
+	presences, err := p.DB.PresenceAfter(ctx, from, gomatrixserverlib.EventFilter{
+		Limit:      1000,
+		Senders:    filter.Senders,
+		NotSenders: filter.NotSenders,
+	})
 	if err != nil {
 		req.Log.WithError(err).Error("p.DB.PresenceAfter failed")
 		return from
@@ -80,6 +91,9 @@ func (p *PresenceStreamProvider) IncrementalSync(
 				if _, ok := presences[roomUsers[i]]; ok {
 					continue
 				}
+				if !internal.SenderAllowed(filter.Senders, filter.NotSenders, roomUsers[i]) {
+					continue
+				}
 				// Bear in mind that this might return nil, but at least populating
 				// a nil means that there's a map entry so we won't repeat this call.
 				presences[roomUsers[i]], err = p.DB.GetPresence(ctx, roomUsers[i])
@@ -87,7 +101,7 @@ func (p *PresenceStreamProvider) IncrementalSync(
 					req.Log.WithError(err).Error("unable to query presence for user")
 					return from
 				}
-				if len(presences) > req.Filter.Presence.Limit {
+				if len(presences) > filter.Limit {
 					break NewlyJoinedLoop
 				}
 			}
@@ -103,27 +117,44 @@ func (p *PresenceStreamProvider) IncrementalSync(
 		if req.Device.UserID != presence.UserID && !p.notifier.IsSharedUser(req.Device.UserID, presence.UserID) {
 			continue
 		}
+		visible, err := p.visibility.Visible(ctx, req.Device.UserID, presence.UserID)
+		if err != nil {
+			req.Log.WithError(err).Error("unable to check presence privacy")
+			return from
+		}
+		if !visible {
+			// The user doesn't want us to see their presence (any more), so
+			// they appear offline without any details.
+			presence = &types.PresenceInternal{
+				ClientFields: types.PresenceClientResponse{
+					Presence: types.PresenceOffline.String(),
+				},
+				StreamPos: presence.StreamPos,
+				UserID:    presence.UserID,
+				Presence:  types.PresenceOffline,
+			}
+		}
 		cacheKey := req.Device.UserID + req.Device.ID + presence.UserID
 		pres, ok := p.cache.Load(cacheKey)
 		if ok {
 			// skip already sent presence
 			prevPresence := pres.(*types.PresenceInternal)
 			currentlyActive := prevPresence.CurrentlyActive()
-			skip := prevPresence.Equals(presence) && currentlyActive && req.Device.UserID != presence.UserID
+			skip := prevPresence.Equals(presence) && (currentlyActive || !visible) && req.Device.UserID != presence.UserID
 			if skip {
 				req.Log.Tracef("Skipping presence, no change (%s)", presence.UserID)
 				continue
 			}
 		}
 
-		if _, known := types.PresenceFromString(presence.ClientFields.Presence); known {
+		if _, known := types.PresenceFromString(presence.ClientFields.Presence); !known {
+			presence.ClientFields.Presence = "offline"
+		} else if visible {
 			presence.ClientFields.LastActiveAgo = presence.LastActiveAgo()
 			if presence.ClientFields.Presence == "online" {
 				currentlyActive := presence.CurrentlyActive()
 				presence.ClientFields.CurrentlyActive = &currentlyActive
 			}
-		} else {
-			presence.ClientFields.Presence = "offline"
 		}
 
 		content, err := json.Marshal(presence.ClientFields)
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 
+	"github.com/matrix-org/dendrite/syncapi/internal"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -34,9 +35,13 @@ func (p *ReceiptStreamProvider) IncrementalSync(
 	req *types.SyncRequest,
 	from, to types.StreamPosition,
 ) types.StreamPosition {
+	ephemeralFilter := &req.Filter.Room.Ephemeral
+	if !internal.TypeAllowed(ephemeralFilter.Types, ephemeralFilter.NotTypes, gomatrixserverlib.MReceipt) {
+		return to
+	}
 	var joinedRooms []string
 	for roomID, membership := range req.Rooms {
-		if membership == gomatrixserverlib.Join {
+		if membership == gomatrixserverlib.Join && internal.RoomAllowed(ephemeralFilter.Rooms, ephemeralFilter.NotRooms, roomID) {
 			joinedRooms = append(joinedRooms, roomID)
 		}
 	}
@@ -58,6 +63,9 @@ func (p *ReceiptStreamProvider) IncrementalSync(
 		if _, ok := req.IgnoredUsers.List[receipt.UserID]; ok {
 			continue
 		}
+		if !internal.SenderAllowed(ephemeralFilter.Senders, ephemeralFilter.NotSenders, receipt.UserID) {
+			continue
+		}
 		receiptsByRoom[receipt.RoomID] = append(receiptsByRoom[receipt.RoomID], receipt)
 	}
 
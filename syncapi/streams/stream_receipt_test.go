@@ -0,0 +1,119 @@
+package streams
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+func TestReceiptIncrementalSyncFilter(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		connStr, close := test.PrepareDBConnectionString(t, dbType)
+		defer close()
+		db, err := storage.NewSyncServerDatasource(nil, &config.DatabaseOptions{
+			ConnectionString: config.DataSource(connStr),
+		})
+		if err != nil {
+			t.Fatalf("NewSyncServerDatasource returned %s", err)
+		}
+
+		ctx := context.Background()
+		alice, bob := "@alice:localhost", "@bob:localhost"
+		roomA, roomB := "!a:localhost", "!b:localhost"
+		var to types.StreamPosition
+		for _, receipt := range []struct{ roomID, userID string }{
+			{roomA, alice},
+			{roomA, bob},
+			{roomB, bob},
+		} {
+			to, err = db.StoreReceipt(ctx, receipt.roomID, "m.read", receipt.userID, "$event", gomatrixserverlib.AsTimestamp(time.Now()))
+			if err != nil {
+				t.Fatalf("StoreReceipt returned %s", err)
+			}
+		}
+		p := &ReceiptStreamProvider{StreamProvider: StreamProvider{DB: db}}
+
+		testCases := []struct {
+			name   string
+			filter gomatrixserverlib.RoomEventFilter
+			want   map[string][]string
+		}{
+			{
+				name: "no filter",
+				want: map[string][]string{roomA: {alice, bob}, roomB: {bob}},
+			},
+			{
+				name:   "types",
+				filter: gomatrixserverlib.RoomEventFilter{Types: &[]string{gomatrixserverlib.MTyping}},
+				want:   map[string][]string{},
+			},
+			{
+				name:   "not_types",
+				filter: gomatrixserverlib.RoomEventFilter{NotTypes: &[]string{"m.*"}},
+				want:   map[string][]string{},
+			},
+			{
+				name:   "rooms",
+				filter: gomatrixserverlib.RoomEventFilter{Rooms: &[]string{roomB}},
+				want:   map[string][]string{roomB: {bob}},
+			},
+			{
+				name:   "not_rooms",
+				filter: gomatrixserverlib.RoomEventFilter{NotRooms: &[]string{roomB}},
+				want:   map[string][]string{roomA: {alice, bob}},
+			},
+			{
+				name:   "senders",
+				filter: gomatrixserverlib.RoomEventFilter{Senders: &[]string{alice}},
+				want:   map[string][]string{roomA: {alice}},
+			},
+			{
+				name:   "not_senders",
+				filter: gomatrixserverlib.RoomEventFilter{NotSenders: &[]string{alice}},
+				want:   map[string][]string{roomA: {bob}, roomB: {bob}},
+			},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				req := &types.SyncRequest{
+					Context:  ctx,
+					Log:      logrus.NewEntry(logrus.StandardLogger()),
+					Response: types.NewResponse(),
+					Filter:   gomatrixserverlib.DefaultFilter(),
+					Rooms:    map[string]string{roomA: gomatrixserverlib.Join, roomB: gomatrixserverlib.Join},
+				}
+				req.Filter.Room.Ephemeral = tc.filter
+				p.IncrementalSync(ctx, req, 0, to)
+
+				got := make(map[string][]string)
+				for roomID, jr := range req.Response.Rooms.Join {
+					for _, ev := range jr.Ephemeral.Events {
+						var content map[string]ReceiptMRead
+						if err := json.Unmarshal(ev.Content, &content); err != nil {
+							t.Fatal(err)
+						}
+						for _, read := range content {
+							for userID := range read.User {
+								got[roomID] = append(got[roomID], userID)
+							}
+						}
+						sort.Strings(got[roomID])
+					}
+				}
+				if !reflect.DeepEqual(got, tc.want) {
+					t.Errorf("got receipts from %v, want %v", got, tc.want)
+				}
+			})
+		}
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 
 	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/dendrite/syncapi/internal"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -27,10 +28,17 @@ func (p *TypingStreamProvider) IncrementalSync(
 	from, to types.StreamPosition,
 ) types.StreamPosition {
 	var err error
+	ephemeralFilter := &req.Filter.Room.Ephemeral
+	if !internal.TypeAllowed(ephemeralFilter.Types, ephemeralFilter.NotTypes, gomatrixserverlib.MTyping) {
+		return to
+	}
 	for roomID, membership := range req.Rooms {
 		if membership != gomatrixserverlib.Join {
 			continue
 		}
+		if !internal.RoomAllowed(ephemeralFilter.Rooms, ephemeralFilter.NotRooms, roomID) {
+			continue
+		}
 
 		jr := *types.NewJoinResponse()
 		if existing, ok := req.Response.Rooms.Join[roomID]; ok {
@@ -43,7 +51,10 @@ func (p *TypingStreamProvider) IncrementalSync(
 			typingUsers := make([]string, 0, len(users))
 			for i := range users {
 				// skip ignored user events
-				if _, ok := req.IgnoredUsers.List[users[i]]; !ok {
+				if _, ok := req.IgnoredUsers.List[users[i]]; ok {
+					continue
+				}
+				if internal.SenderAllowed(ephemeralFilter.Senders, ephemeralFilter.NotSenders, users[i]) {
 					typingUsers = append(typingUsers, users[i])
 				}
 			}
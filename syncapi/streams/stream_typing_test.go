@@ -0,0 +1,138 @@
+package streams
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// benchmarkTypingIncrementalSync syncs a typing notification in one room for
+// a user who is joined to the given number of rooms, with either all of those
+// rooms or only the room queued by the notifier in the sync request.
+func benchmarkTypingIncrementalSync(b *testing.B, joinedRooms int, onlyQueuedRoom bool) {
+	p := &TypingStreamProvider{EDUCache: caching.NewTypingCache()}
+	roomIDs := make([]string, 0, joinedRooms)
+	for i := 0; i < joinedRooms; i++ {
+		roomIDs = append(roomIDs, fmt.Sprintf("!room%d:localhost", i))
+	}
+	typingRoomID := roomIDs[0]
+	to := types.StreamPosition(p.EDUCache.AddTypingUser("@alice:localhost", typingRoomID, nil))
+	if onlyQueuedRoom {
+		roomIDs = roomIDs[:1]
+	}
+
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := &types.SyncRequest{
+			Context:  ctx,
+			Log:      logrus.NewEntry(logrus.StandardLogger()),
+			Response: types.NewResponse(),
+			Rooms:    make(map[string]string, len(roomIDs)),
+		}
+		for _, roomID := range roomIDs {
+			req.Rooms[roomID] = gomatrixserverlib.Join
+		}
+		p.IncrementalSync(ctx, req, to-1, to)
+		if _, ok := req.Response.Rooms.Join[typingRoomID]; !ok {
+			b.Fatalf("expected typing notification in %s", typingRoomID)
+		}
+	}
+}
+
+func BenchmarkTypingIncrementalSyncAllRooms(b *testing.B) {
+	benchmarkTypingIncrementalSync(b, 500, false)
+}
+
+func BenchmarkTypingIncrementalSyncQueuedRoom(b *testing.B) {
+	benchmarkTypingIncrementalSync(b, 500, true)
+}
+
+func TestTypingIncrementalSyncFilter(t *testing.T) {
+	alice, bob := "@alice:localhost", "@bob:localhost"
+	roomA, roomB := "!a:localhost", "!b:localhost"
+	p := &TypingStreamProvider{EDUCache: caching.NewTypingCache()}
+	p.EDUCache.AddTypingUser(alice, roomA, nil)
+	p.EDUCache.AddTypingUser(bob, roomA, nil)
+	to := types.StreamPosition(p.EDUCache.AddTypingUser(bob, roomB, nil))
+
+	testCases := []struct {
+		name   string
+		filter gomatrixserverlib.RoomEventFilter
+		want   map[string][]string
+	}{
+		{
+			name: "no filter",
+			want: map[string][]string{roomA: {alice, bob}, roomB: {bob}},
+		},
+		{
+			name:   "types",
+			filter: gomatrixserverlib.RoomEventFilter{Types: &[]string{gomatrixserverlib.MReceipt}},
+			want:   map[string][]string{},
+		},
+		{
+			name:   "not_types",
+			filter: gomatrixserverlib.RoomEventFilter{NotTypes: &[]string{"m.*"}},
+			want:   map[string][]string{},
+		},
+		{
+			name:   "rooms",
+			filter: gomatrixserverlib.RoomEventFilter{Rooms: &[]string{roomB}},
+			want:   map[string][]string{roomB: {bob}},
+		},
+		{
+			name:   "not_rooms",
+			filter: gomatrixserverlib.RoomEventFilter{NotRooms: &[]string{roomB}},
+			want:   map[string][]string{roomA: {alice, bob}},
+		},
+		{
+			name:   "senders",
+			filter: gomatrixserverlib.RoomEventFilter{Senders: &[]string{alice}},
+			want:   map[string][]string{roomA: {alice}, roomB: {}},
+		},
+		{
+			name:   "not_senders",
+			filter: gomatrixserverlib.RoomEventFilter{NotSenders: &[]string{alice}},
+			want:   map[string][]string{roomA: {bob}, roomB: {bob}},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := &types.SyncRequest{
+				Context:  context.Background(),
+				Log:      logrus.NewEntry(logrus.StandardLogger()),
+				Response: types.NewResponse(),
+				Filter:   gomatrixserverlib.DefaultFilter(),
+				Rooms:    map[string]string{roomA: gomatrixserverlib.Join, roomB: gomatrixserverlib.Join},
+			}
+			req.Filter.Room.Ephemeral = tc.filter
+			p.IncrementalSync(req.Context, req, 0, to)
+
+			got := make(map[string][]string)
+			for roomID, jr := range req.Response.Rooms.Join {
+				for _, ev := range jr.Ephemeral.Events {
+					var content struct {
+						UserIDs []string `json:"user_ids"`
+					}
+					if err := json.Unmarshal(ev.Content, &content); err != nil {
+						t.Fatal(err)
+					}
+					sort.Strings(content.UserIDs)
+					got[roomID] = content.UserIDs
+				}
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got typing users %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
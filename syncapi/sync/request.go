@@ -46,8 +46,7 @@ func newSyncRequest(req *http.Request, device userapi.Device, syncDB storage.Dat
 			return nil, err
 		}
 	}
-	// TODO: read from stored filters too
-	filter := gomatrixserverlib.DefaultFilter()
+	filter := types.NewFilter()
 	if since.IsEmpty() {
 		// Send as much account data down for complete syncs as possible
 		// by default, otherwise clients do weird things while waiting
@@ -85,15 +84,16 @@ func newSyncRequest(req *http.Request, device userapi.Device, syncDB storage.Dat
 	})
 
 	return &types.SyncRequest{
-		Context:       req.Context(),           
-		Log:           logger,                  
-		Device:        &device,                 
-		Response:      types.NewResponse(),     // Populated by all streams
-		Filter:        filter,                  
-		Since:         since,                   
-		Timeout:       timeout,                 
-		Rooms:         make(map[string]string), // Populated by the PDU stream
-		WantFullState: wantFullState,           
+		Context:                   req.Context(),
+		Log:                       logger,
+		Device:                    &device,
+		Response:                  types.NewResponse(), // Populated by all streams
+		Filter:                    filter.Filter,
+		Since:                     since,
+		Timeout:                   timeout,
+		Rooms:                     make(map[string]string), // Populated by the PDU stream
+		WantFullState:             wantFullState,
+		UnreadThreadNotifications: filter.UnreadThreadNotifications,
 	}, nil
 }
 
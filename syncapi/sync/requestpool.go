@@ -59,6 +59,8 @@ type RequestPool struct {
 	Notifier *notifier.Notifier
 	producer PresencePublisher
 	consumer PresenceConsumer
+	// user|device|conn_id -> *slidingSyncConn
+	slidingConns *sync.Map
 }
 
 type PresencePublisher interface {
@@ -79,7 +81,7 @@ func NewRequestPool(
 ) *RequestPool {
 	if enableMetrics {
 		prometheus.MustRegister(
-			activeSyncRequests, waitingSyncRequests,
+			activeSyncRequests, waitingSyncRequests, ephemeralSyncRequests,
 		)
 	}
 	rp := &RequestPool{
@@ -94,9 +96,14 @@ func NewRequestPool(
 		Notifier: notifier,
 		producer: producer,
 		consumer: consumer,
+
+		slidingConns: &sync.Map{},
 	}
 	go rp.cleanLastSeen()
-	go rp.cleanPresence(db, time.Minute*5) 
+	if cfg.MSCs != nil && cfg.MSCs.Enabled("msc3575") {
+		go rp.cleanSlidingSyncConns()
+	}
+	go rp.cleanPresence(db, cfg.Matrix.Presence.IdleTimeout)
 	return rp
 }
 
@@ -121,6 +128,10 @@ func (rp *RequestPool) cleanPresence(db storage.Presence, cleanupTime time.Durat
 		case <-timer1.C:
 			rp.presence.Range(func(key interface{}, v interface{}) bool {
 				p := v.(types.PresenceInternal)
+				// Busy and do not disturb stay until the user changes them
+				if p.Presence.SetByUser() {
+					return true
+				}
 				if time.Since(p.LastActiveTS.Time()) > cleanupTime {
 					rp.updatePresence(db, types.PresenceUnavailable.String(), p.UserID)
 					rp.presence.Delete(key)
@@ -150,7 +161,8 @@ func (rp *RequestPool) updatePresence(db storage.Presence, presence string, user
 	if !rp.cfg.Matrix.Presence.EnableOutbound {
 		return
 	}
-	if presence == "" {
+	setPresence := presence != ""
+	if !setPresence {
 		presence = types.PresenceOnline.String()
 	}
 
@@ -159,17 +171,21 @@ func (rp *RequestPool) updatePresence(db storage.Presence, presence string, user
 		return
 	}
 
-	newPresence := types.PresenceInternal{
-		Presence:     presenceID,
-		UserID:       userID,
-		LastActiveTS: gomatrixserverlib.AsTimestamp(time.Now()),
-	}
-
 	// ensure we also send the current status_msg to federated servers and not nil
 	dbPresence, err := db.GetPresence(context.Background(), userID)
 	if err != nil && err != sql.ErrNoRows {
 		return
 	}
+	// syncing without set_presence doesn't end busy or do not disturb
+	if !setPresence && dbPresence != nil && dbPresence.Presence.SetByUser() {
+		presenceID = dbPresence.Presence
+	}
+
+	newPresence := types.PresenceInternal{
+		Presence:     presenceID,
+		UserID:       userID,
+		LastActiveTS: gomatrixserverlib.AsTimestamp(time.Now()),
+	}
 	if dbPresence != nil {
 		newPresence.ClientFields = dbPresence.ClientFields
 	}
@@ -237,6 +253,15 @@ var activeSyncRequests = prometheus.NewGauge(
 	},
 )
 
+var ephemeralSyncRequests = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "syncapi",
+		Name:      "ephemeral_sync_requests",
+		Help:      "The number of sync requests that only synced typing notifications and receipts",
+	},
+)
+
 var waitingSyncRequests = prometheus.NewGauge(
 	prometheus.GaugeOpts{
 		Namespace: "dendrite",
@@ -285,6 +310,9 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 	for {
 		startTime := time.Now()
 		currentPos := rp.Notifier.CurrentPosition()
+		// Rooms with new typing notifications or receipts, if they are the
+		// only updates for this device since the since token
+		var ephemeralRooms []string
 
 		// if the since token matches the current positions, wait via the notifier
 		if !rp.shouldReturnImmediately(syncReq, currentPos) {
@@ -307,6 +335,7 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 						syncReq.Log.WithError(err).Warn("failed to get OTK counts")
 					}
 				}
+				internal.ApplyEventFieldsToResponse(syncReq.Filter.EventFields, syncReq.Response)
 				return util.JSONResponse{
 					Code: http.StatusOK,
 					JSON: syncReq.Response,
@@ -323,6 +352,9 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 			case <-userStreamListener.GetNotifyChannel(syncReq.Since):
 				syncReq.Log.Debugln("Responding to sync after wake-up")
 				currentPos.ApplyUpdates(userStreamListener.GetSyncPosition())
+				// This must happen after GetSyncPosition, so that any other
+				// update after currentPos is picked up by the next sync
+				ephemeralRooms, _ = userStreamListener.GetEphemeralRooms(syncReq.Since)
 			}
 		} else {
 			syncReq.Log.WithField("currentPos", currentPos).Debugln("Responding to sync immediately")
@@ -359,6 +391,20 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 					syncReq.Context, syncReq,
 				),
 			}
+		} else if len(ephemeralRooms) > 0 {
+			ephemeralSyncRequests.Inc()
+			syncReq.Response.NextBatch = rp.ephemeralSync(syncReq, currentPos, ephemeralRooms)
+			if !syncReq.Response.HasUpdates() {
+				// e.g. typing notifications from ignored users, so wait again
+				syncReq.Since = syncReq.Response.NextBatch
+				if syncReq.Timeout > 0 {
+					syncReq.Timeout = syncReq.Timeout - time.Since(startTime)
+					if syncReq.Timeout < 0 {
+						syncReq.Timeout = 0
+					}
+					continue
+				}
+			}
 		} else {
 			// Incremental sync  
 			syncReq.Response.NextBatch = types.StreamingToken{ // s353_8_28_14_347_355_29_69_0，position
@@ -427,6 +473,7 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 			}
 		}
 
+		internal.ApplyEventFieldsToResponse(syncReq.Filter.EventFields, syncReq.Response)
 		return util.JSONResponse{
 			Code: http.StatusOK,
 			JSON: syncReq.Response,
@@ -434,6 +481,44 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 	}
 }
 
+// ephemeralSync only syncs the typing notifications and receipts of the given
+// rooms, for sync requests that were woken up with no other updates since their
+// since token. It doesn't touch the PDU, account data or any other streams.
+func (rp *RequestPool) ephemeralSync(
+	syncReq *types.SyncRequest, currentPos types.StreamingToken, roomIDs []string,
+) types.StreamingToken {
+	ignores, err := rp.db.IgnoresForUser(syncReq.Context, syncReq.Device.UserID)
+	if err != nil && err != sql.ErrNoRows {
+		syncReq.Log.WithError(err).Error("rp.db.IgnoresForUser failed")
+	}
+	if ignores != nil {
+		syncReq.IgnoredUsers = *ignores
+	}
+	// The notifier only queues rooms the user is joined to.
+	for _, roomID := range roomIDs {
+		if internal.RoomAllowed(syncReq.Filter.Room.Rooms, syncReq.Filter.Room.NotRooms, roomID) {
+			syncReq.Rooms[roomID] = gomatrixserverlib.Join
+		}
+	}
+
+	// There were no other updates for this device up to currentPos.
+	nextBatch := currentPos
+	nextBatch.TypingPosition = rp.streams.TypingStreamProvider.IncrementalSync(
+		syncReq.Context, syncReq,
+		syncReq.Since.TypingPosition, currentPos.TypingPosition,
+	)
+	nextBatch.ReceiptPosition = rp.streams.ReceiptStreamProvider.IncrementalSync(
+		syncReq.Context, syncReq,
+		syncReq.Since.ReceiptPosition, currentPos.ReceiptPosition,
+	)
+
+	err = internal.DeviceOTKCounts(syncReq.Context, rp.keyAPI, syncReq.Device.UserID, syncReq.Device.ID, syncReq.Response)
+	if err != nil && err != context.Canceled {
+		syncReq.Log.WithError(err).Warn("failed to get OTK counts")
+	}
+	return nextBatch
+}
+
 func (rp *RequestPool) OnIncomingKeyChangeRequest(req *http.Request, device *userapi.Device) util.JSONResponse {
 	from := req.URL.Query().Get("from")
 	to := req.URL.Query().Get("to")
@@ -0,0 +1,1041 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/syncapi/internal"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+const (
+	// slidingSyncConnTimeout is how long an unused sliding sync connection is kept
+	// before the client has to start again from scratch.
+	slidingSyncConnTimeout = time.Minute * 30
+	// slidingSyncMaxTimelineLimit caps the timeline_limit which clients may ask for.
+	slidingSyncMaxTimelineLimit = 100
+)
+
+// The sort orders which can be requested for a sliding sync list.
+const (
+	slidingSyncSortByRecency           = "by_recency"
+	slidingSyncSortByName              = "by_name"
+	slidingSyncSortByNotificationLevel = "by_notification_level"
+)
+
+// The names of the supported sliding sync extensions.
+const (
+	slidingSyncExtToDevice    = "to_device"
+	slidingSyncExtE2EE        = "e2ee"
+	slidingSyncExtAccountData = "account_data"
+	slidingSyncExtReceipts    = "receipts"
+	slidingSyncExtTyping      = "typing"
+)
+
+type slidingSyncRequest struct {
+	ConnID            string                           `json:"conn_id"`
+	Lists             map[string]slidingSyncList       `json:"lists"`
+	RoomSubscriptions map[string]slidingSyncRoomParams `json:"room_subscriptions"`
+	UnsubscribeRooms  []string                         `json:"unsubscribe_rooms"`
+	Extensions        map[string]slidingSyncExtension  `json:"extensions"`
+}
+
+// slidingSyncRoomParams describe which data is sent for a room, either for all
+// rooms in the ranges of a list or for a single room subscription.
+type slidingSyncRoomParams struct {
+	RequiredState [][2]string `json:"required_state,omitempty"`
+	TimelineLimit *int        `json:"timeline_limit,omitempty"`
+}
+
+type slidingSyncList struct {
+	slidingSyncRoomParams
+	Ranges  [][2]int64          `json:"ranges,omitempty"`
+	Sort    []string            `json:"sort,omitempty"`
+	Filters *slidingSyncFilters `json:"filters,omitempty"`
+}
+
+type slidingSyncFilters struct {
+	IsInvite     *bool  `json:"is_invite,omitempty"`
+	RoomNameLike string `json:"room_name_like,omitempty"`
+}
+
+type slidingSyncExtension struct {
+	Enabled *bool `json:"enabled,omitempty"`
+}
+
+type slidingSyncResponse struct {
+	Pos        string                             `json:"pos"`
+	Lists      map[string]slidingSyncListResponse `json:"lists"`
+	Rooms      map[string]*slidingSyncRoom        `json:"rooms"`
+	Extensions slidingSyncExtensionsResponse      `json:"extensions"`
+}
+
+type slidingSyncListResponse struct {
+	Count int             `json:"count"`
+	Ops   []slidingSyncOp `json:"ops,omitempty"`
+}
+
+type slidingSyncOp struct {
+	Op      string   `json:"op"`
+	Range   [2]int64 `json:"range"`
+	RoomIDs []string `json:"room_ids,omitempty"`
+}
+
+type slidingSyncRoom struct {
+	Name              string                          `json:"name,omitempty"`
+	RequiredState     []gomatrixserverlib.ClientEvent `json:"required_state,omitempty"`
+	Timeline          []gomatrixserverlib.ClientEvent `json:"timeline,omitempty"`
+	PrevBatch         *types.TopologyToken            `json:"prev_batch,omitempty"`
+	Limited           bool                            `json:"limited,omitempty"`
+	Initial           bool                            `json:"initial,omitempty"`
+	InviteState       []json.RawMessage               `json:"invite_state,omitempty"`
+	JoinedCount       *int                            `json:"joined_count,omitempty"`
+	InvitedCount      *int                            `json:"invited_count,omitempty"`
+	NotificationCount int                             `json:"notification_count"`
+	HighlightCount    int                             `json:"highlight_count"`
+}
+
+type slidingSyncExtensionsResponse struct {
+	ToDevice    *slidingSyncToDeviceResponse    `json:"to_device,omitempty"`
+	E2EE        *slidingSyncE2EEResponse        `json:"e2ee,omitempty"`
+	AccountData *slidingSyncAccountDataResponse `json:"account_data,omitempty"`
+	Receipts    *slidingSyncEphemeralResponse   `json:"receipts,omitempty"`
+	Typing      *slidingSyncEphemeralResponse   `json:"typing,omitempty"`
+}
+
+type slidingSyncToDeviceResponse struct {
+	NextBatch string                                `json:"next_batch"`
+	Events    []gomatrixserverlib.SendToDeviceEvent `json:"events"`
+}
+
+type slidingSyncE2EEResponse struct {
+	DeviceLists struct {
+		Changed []string `json:"changed,omitempty"`
+		Left    []string `json:"left,omitempty"`
+	} `json:"device_lists"`
+	DeviceListsOTKCount map[string]int `json:"device_one_time_keys_count"`
+}
+
+type slidingSyncAccountDataResponse struct {
+	Global []gomatrixserverlib.ClientEvent            `json:"global"`
+	Rooms  map[string][]gomatrixserverlib.ClientEvent `json:"rooms"`
+}
+
+type slidingSyncEphemeralResponse struct {
+	Rooms map[string]gomatrixserverlib.ClientEvent `json:"rooms"`
+}
+
+// slidingSyncConn is the state the server keeps for a sliding sync connection,
+// i.e. what it has already sent to the client. The sticky request parameters
+// are remembered here too, so that clients don't have to repeat them.
+type slidingSyncConn struct {
+	sync.Mutex
+	slidingSyncConnState
+	// The state the last response was built from. A client which didn't get the
+	// last response retries with the previous position, which is answered from here.
+	prev *slidingSyncConnState
+	// The room names looked up for the lists, by room ID
+	names    map[string]slidingSyncRoomName
+	lastUsed time.Time
+}
+
+type slidingSyncConnState struct {
+	pos           int64
+	token         types.StreamingToken
+	lists         map[string]*slidingSyncListState
+	rooms         map[string]slidingSyncSentRoom
+	subscriptions map[string]slidingSyncRoomParams
+	extensions    map[string]bool
+	extensionPos  map[string]types.StreamPosition
+}
+
+// slidingSyncRoomName is a room name together with the position of the latest event
+// in the room when it was looked up. Any newer event may have changed the name.
+type slidingSyncRoomName struct {
+	name     string
+	position types.StreamPosition
+}
+
+type slidingSyncListState struct {
+	params slidingSyncList
+	count  int
+	sent   map[[2]int64][]string
+}
+
+type slidingSyncSentRoom struct {
+	position          types.StreamPosition
+	invite            bool
+	notificationCount int
+	highlightCount    int
+}
+
+// slidingSyncRoomInfo is what's needed to filter and sort a room into the lists.
+type slidingSyncRoomInfo struct {
+	roomID            string
+	invite            *gomatrixserverlib.HeaderedEvent
+	name              string
+	nameLoaded        bool
+	position          types.StreamPosition
+	notificationCount int
+	highlightCount    int
+}
+
+func newSlidingSyncConn() *slidingSyncConn {
+	return &slidingSyncConn{
+		slidingSyncConnState: slidingSyncConnState{
+			lists:         make(map[string]*slidingSyncListState),
+			rooms:         make(map[string]slidingSyncSentRoom),
+			subscriptions: make(map[string]slidingSyncRoomParams),
+			extensions:    make(map[string]bool),
+			extensionPos:  make(map[string]types.StreamPosition),
+		},
+		names: make(map[string]slidingSyncRoomName),
+	}
+}
+
+// clone returns a copy of the state which isn't changed by building later responses.
+func (s *slidingSyncConnState) clone() *slidingSyncConnState {
+	c := &slidingSyncConnState{
+		pos:           s.pos,
+		token:         s.token,
+		lists:         make(map[string]*slidingSyncListState, len(s.lists)),
+		rooms:         make(map[string]slidingSyncSentRoom, len(s.rooms)),
+		subscriptions: make(map[string]slidingSyncRoomParams, len(s.subscriptions)),
+		extensions:    make(map[string]bool, len(s.extensions)),
+		extensionPos:  make(map[string]types.StreamPosition, len(s.extensionPos)),
+	}
+	for name, list := range s.lists {
+		// the windows are replaced rather than modified, so they can be shared
+		sent := make(map[[2]int64][]string, len(list.sent))
+		for r, window := range list.sent {
+			sent[r] = window
+		}
+		c.lists[name] = &slidingSyncListState{params: list.params, count: list.count, sent: sent}
+	}
+	for roomID, room := range s.rooms {
+		c.rooms[roomID] = room
+	}
+	for roomID, params := range s.subscriptions {
+		c.subscriptions[roomID] = params
+	}
+	for name, enabled := range s.extensions {
+		c.extensions[name] = enabled
+	}
+	for name, pos := range s.extensionPos {
+		c.extensionPos[name] = pos
+	}
+	return c
+}
+
+// applyRequest merges the parameters of the request into the sticky
+// parameters of the connection.
+func (c *slidingSyncConn) applyRequest(req *slidingSyncRequest) {
+	for name, list := range req.Lists {
+		state, ok := c.lists[name]
+		if !ok {
+			state = &slidingSyncListState{sent: make(map[[2]int64][]string)}
+			c.lists[name] = state
+		}
+		state.params = list.withStickyParams(state.params)
+	}
+	for roomID, params := range req.RoomSubscriptions {
+		c.subscriptions[roomID] = params
+	}
+	for _, roomID := range req.UnsubscribeRooms {
+		delete(c.subscriptions, roomID)
+	}
+	for name, ext := range req.Extensions {
+		if ext.Enabled != nil {
+			c.extensions[name] = *ext.Enabled
+		}
+	}
+}
+
+// withStickyParams returns the list with every parameter which wasn't
+// given in this request taken from the previous request.
+func (l slidingSyncList) withStickyParams(prev slidingSyncList) slidingSyncList {
+	if l.Ranges == nil {
+		l.Ranges = prev.Ranges
+	}
+	if l.Sort == nil {
+		l.Sort = prev.Sort
+	}
+	if l.Filters == nil {
+		l.Filters = prev.Filters
+	}
+	if l.RequiredState == nil {
+		l.RequiredState = prev.RequiredState
+	}
+	if l.TimelineLimit == nil {
+		l.TimelineLimit = prev.TimelineLimit
+	}
+	return l
+}
+
+// update works out the ops needed to bring the client's view of the list in line
+// with the given sorted rooms. Ranges are resent whenever any room in them changed
+// and ranges which the client no longer asks for are invalidated.
+func (l *slidingSyncListState) update(roomIDs []string) (res slidingSyncListResponse, changed bool) {
+	res.Count = len(roomIDs)
+	changed = l.count != res.Count
+	l.count = res.Count
+	sent := make(map[[2]int64][]string, len(l.params.Ranges))
+	for _, r := range l.params.Ranges {
+		window := slidingSyncWindow(roomIDs, r)
+		sent[r] = window
+		if prev, ok := l.sent[r]; ok && equalRoomIDs(prev, window) {
+			continue
+		}
+		res.Ops = append(res.Ops, slidingSyncOp{Op: "SYNC", Range: r, RoomIDs: window})
+	}
+	for r := range l.sent {
+		if _, ok := sent[r]; !ok {
+			res.Ops = append(res.Ops, slidingSyncOp{Op: "INVALIDATE", Range: r})
+		}
+	}
+	l.sent = sent
+	return res, changed || len(res.Ops) > 0
+}
+
+// slidingSyncWindow returns the rooms within the inclusive range.
+func slidingSyncWindow(roomIDs []string, r [2]int64) []string {
+	start, end := r[0], r[1]
+	if start < 0 {
+		start = 0
+	}
+	if end >= int64(len(roomIDs)) {
+		end = int64(len(roomIDs)) - 1
+	}
+	if start > end {
+		return []string{}
+	}
+	return roomIDs[start : end+1]
+}
+
+func equalRoomIDs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeSlidingSyncRoomParams combines the parameters of all lists and subscriptions
+// a room appears in, so that the room is sent with the most data any of them asked for.
+func mergeSlidingSyncRoomParams(a, b slidingSyncRoomParams) slidingSyncRoomParams {
+	res := slidingSyncRoomParams{
+		RequiredState: append(append([][2]string{}, a.RequiredState...), b.RequiredState...),
+		TimelineLimit: a.TimelineLimit,
+	}
+	if res.TimelineLimit == nil || (b.TimelineLimit != nil && *b.TimelineLimit > *res.TimelineLimit) {
+		res.TimelineLimit = b.TimelineLimit
+	}
+	return res
+}
+
+func (p slidingSyncRoomParams) timelineLimit() int {
+	if p.TimelineLimit == nil || *p.TimelineLimit < 0 {
+		return 0
+	}
+	if *p.TimelineLimit > slidingSyncMaxTimelineLimit {
+		return slidingSyncMaxTimelineLimit
+	}
+	return *p.TimelineLimit
+}
+
+// stateFilter returns a filter for the event types in required_state. Matching
+// on state keys happens afterwards in filterRequiredState.
+func (p slidingSyncRoomParams) stateFilter() gomatrixserverlib.StateFilter {
+	filter := gomatrixserverlib.StateFilter{Limit: math.MaxInt32}
+	seen := make(map[string]struct{}, len(p.RequiredState))
+	evTypes := make([]string, 0, len(p.RequiredState))
+	for _, tuple := range p.RequiredState {
+		if tuple[0] == "*" {
+			return filter
+		}
+		if _, ok := seen[tuple[0]]; !ok {
+			seen[tuple[0]] = struct{}{}
+			evTypes = append(evTypes, tuple[0])
+		}
+	}
+	filter.Types = &evTypes
+	return filter
+}
+
+// filterRequiredState picks the state events matching required_state. "*" matches
+// any type or state key, "$ME" the syncing user and "$LAZY" the members who sent
+// any of the timeline events.
+func filterRequiredState(
+	required [][2]string, userID string, state, timeline []gomatrixserverlib.ClientEvent,
+) []gomatrixserverlib.ClientEvent {
+	senders := map[string]struct{}{userID: {}}
+	for _, ev := range timeline {
+		senders[ev.Sender] = struct{}{}
+	}
+	res := make([]gomatrixserverlib.ClientEvent, 0, len(state))
+	for _, ev := range state {
+		if ev.StateKey == nil {
+			continue
+		}
+		for _, tuple := range required {
+			if tuple[0] != "*" && tuple[0] != ev.Type {
+				continue
+			}
+			wanted := false
+			switch tuple[1] {
+			case "*", *ev.StateKey:
+				wanted = true
+			case "$ME":
+				wanted = *ev.StateKey == userID
+			case "$LAZY":
+				_, wanted = senders[*ev.StateKey]
+				wanted = wanted && ev.Type == gomatrixserverlib.MRoomMember
+			}
+			if wanted {
+				res = append(res, ev)
+				break
+			}
+		}
+	}
+	return res
+}
+
+// sortSlidingSyncRooms sorts the rooms by the given orders, falling back to the
+// room ID so that the order is stable between requests.
+func sortSlidingSyncRooms(rooms []*slidingSyncRoomInfo, orders []string) {
+	sort.SliceStable(rooms, func(i, j int) bool {
+		a, b := rooms[i], rooms[j]
+		for _, order := range orders {
+			switch order {
+			case slidingSyncSortByRecency:
+				if a.position != b.position {
+					return a.position > b.position
+				}
+			case slidingSyncSortByName:
+				an, bn := strings.ToLower(a.sortName()), strings.ToLower(b.sortName())
+				if an != bn {
+					return an < bn
+				}
+			case slidingSyncSortByNotificationLevel:
+				if a.highlightCount != b.highlightCount {
+					return a.highlightCount > b.highlightCount
+				}
+				if a.notificationCount != b.notificationCount {
+					return a.notificationCount > b.notificationCount
+				}
+			}
+		}
+		return a.roomID < b.roomID
+	})
+}
+
+func (r *slidingSyncRoomInfo) sortName() string {
+	if r.name != "" {
+		return r.name
+	}
+	return r.roomID
+}
+
+// OnIncomingSlidingSyncRequest is called when a client makes a sliding sync request
+// (MSC3575). Like OnIncomingSyncRequest this blocks until there is something new to
+// send for the connection, or the timeout is reached.
+func (rp *RequestPool) OnIncomingSlidingSyncRequest(req *http.Request, device *userapi.Device) util.JSONResponse {
+	defer req.Body.Close() // nolint:errcheck
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be read. " + err.Error()),
+		}
+	}
+	var slidingReq slidingSyncRequest
+	if err = json.Unmarshal(body, &slidingReq); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+	for name, list := range slidingReq.Lists {
+		for _, r := range list.Ranges {
+			if r[0] < 0 || r[1] < r[0] {
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: jsonerror.InvalidArgumentValue("invalid range in list " + name),
+				}
+			}
+		}
+	}
+
+	pos := req.URL.Query().Get("pos")
+	connKey := device.UserID + "|" + device.ID + "|" + slidingReq.ConnID
+	var conn *slidingSyncConn
+	if pos == "" {
+		conn = newSlidingSyncConn()
+		rp.slidingConns.Store(connKey, conn)
+	} else if existing, ok := rp.slidingConns.Load(connKey); ok {
+		conn = existing.(*slidingSyncConn)
+	} else {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.UnknownPos("Unknown position, start a new connection"),
+		}
+	}
+
+	conn.Lock()
+	defer conn.Unlock()
+	switch {
+	case pos == "" || pos == strconv.FormatInt(conn.pos, 10):
+	case conn.prev != nil && pos == strconv.FormatInt(conn.prev.pos, 10):
+		// The client didn't get the last response, build it again from the same state.
+		conn.slidingSyncConnState = *conn.prev.clone()
+	default:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.UnknownPos("Unknown position, start a new connection"),
+		}
+	}
+	conn.prev = conn.slidingSyncConnState.clone()
+	conn.lastUsed = time.Now()
+	conn.applyRequest(&slidingReq)
+
+	activeSyncRequests.Inc()
+	defer activeSyncRequests.Dec()
+
+	onlineDevices.Store(device.ID, time.Now())
+	rp.updateLastSeen(req, device)
+
+	syncReq := &types.SyncRequest{
+		Context: req.Context(),
+		Log: util.GetLogger(req.Context()).WithFields(logrus.Fields{
+			"user_id":   device.UserID,
+			"device_id": device.ID,
+			"conn_id":   slidingReq.ConnID,
+			"pos":       pos,
+		}),
+		Device:   device,
+		Response: types.NewResponse(),
+		Filter:   gomatrixserverlib.DefaultFilter(),
+		Since:    conn.token,
+		Timeout:  getTimeout(req.URL.Query().Get("timeout")),
+		Rooms:    make(map[string]string),
+	}
+
+	// Clean up the send-to-device messages which the client acknowledged by
+	// coming back with this position.
+	if toDevicePos, ok := conn.extensionPos[slidingSyncExtToDevice]; ok {
+		if err = rp.db.CleanSendToDeviceUpdates(syncReq.Context, device.UserID, device.ID, toDevicePos); err != nil {
+			syncReq.Log.WithError(err).Error("p.DB.CleanSendToDeviceUpdates failed")
+		}
+	}
+
+	waitingSyncRequests.Inc()
+	defer waitingSyncRequests.Dec()
+
+	for {
+		startTime := time.Now()
+		currentPos := rp.Notifier.CurrentPosition()
+
+		res, hasUpdates, err := rp.slidingSyncResponse(syncReq, conn, currentPos)
+		if err != nil {
+			syncReq.Log.WithError(err).Error("rp.slidingSyncResponse failed")
+			return jsonerror.InternalServerError()
+		}
+
+		// Return straight away for a new connection, otherwise wait for
+		// something the client hasn't seen yet.
+		if hasUpdates || pos == "" || syncReq.Timeout <= 0 {
+			return rp.slidingSyncDone(conn, res)
+		}
+
+		timer := time.NewTimer(syncReq.Timeout)
+		userStreamListener := rp.Notifier.GetListener(*syncReq)
+		select {
+		case <-syncReq.Context.Done(): // Caller gave up
+			timer.Stop()
+			userStreamListener.Close()
+			return rp.slidingSyncDone(conn, res)
+		case <-timer.C: // Timeout reached
+			userStreamListener.Close()
+			return rp.slidingSyncDone(conn, res)
+		case <-userStreamListener.GetNotifyChannel(conn.token):
+			timer.Stop()
+			userStreamListener.Close()
+		}
+		syncReq.Timeout -= time.Since(startTime)
+	}
+}
+
+func (rp *RequestPool) slidingSyncDone(conn *slidingSyncConn, res *slidingSyncResponse) util.JSONResponse {
+	conn.pos++
+	res.Pos = strconv.FormatInt(conn.pos, 10)
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// slidingSyncResponse builds the response for everything that changed since the
+// last response on the connection, updating the connection to match.
+// nolint:gocyclo
+func (rp *RequestPool) slidingSyncResponse(
+	syncReq *types.SyncRequest, conn *slidingSyncConn, currentPos types.StreamingToken,
+) (*slidingSyncResponse, bool, error) {
+	ctx := syncReq.Context
+	userID := syncReq.Device.UserID
+
+	ignores, err := rp.db.IgnoresForUser(ctx, userID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, false, err
+	}
+	if ignores != nil {
+		syncReq.IgnoredUsers = *ignores
+	}
+
+	joinedRoomIDs, err := rp.db.RoomIDsWithMembership(ctx, userID, gomatrixserverlib.Join)
+	if err != nil {
+		return nil, false, err
+	}
+	invites, _, err := rp.db.InviteEventsInRange(ctx, userID, types.Range{From: 0, To: currentPos.InvitePosition})
+	if err != nil {
+		return nil, false, err
+	}
+	rooms := make(map[string]*slidingSyncRoomInfo, len(joinedRoomIDs)+len(invites))
+	roomIDs := make([]string, 0, len(joinedRoomIDs)+len(invites))
+	for _, roomID := range joinedRoomIDs {
+		rooms[roomID] = &slidingSyncRoomInfo{roomID: roomID}
+		roomIDs = append(roomIDs, roomID)
+	}
+	for roomID, inviteEvent := range invites {
+		if _, ok := rooms[roomID]; ok {
+			continue
+		}
+		if _, ok := syncReq.IgnoredUsers.List[inviteEvent.Sender()]; ok {
+			continue
+		}
+		rooms[roomID] = &slidingSyncRoomInfo{roomID: roomID, invite: inviteEvent}
+		roomIDs = append(roomIDs, roomID)
+	}
+
+	positions, err := rp.db.MaxStreamPositionsForRooms(ctx, roomIDs)
+	if err != nil {
+		return nil, false, err
+	}
+	counts, err := rp.db.GetUserUnreadNotificationCounts(ctx, userID, 0, currentPos.NotificationDataPosition)
+	if err != nil {
+		return nil, false, err
+	}
+	for roomID, room := range rooms {
+		room.position = positions[roomID]
+		if c := counts[roomID]; c != nil {
+			room.notificationCount = c.UnreadNotificationCount
+			room.highlightCount = c.UnreadHighlightCount
+		}
+	}
+	for roomID := range conn.names {
+		if room, ok := rooms[roomID]; !ok || room.invite != nil {
+			delete(conn.names, roomID)
+		}
+	}
+
+	res := &slidingSyncResponse{
+		Lists: make(map[string]slidingSyncListResponse, len(conn.lists)),
+		Rooms: make(map[string]*slidingSyncRoom),
+	}
+	hasUpdates := false
+
+	// Sort every list and work out which rooms are in the requested ranges.
+	wanted := make(map[string]slidingSyncRoomParams)
+	for name, list := range conn.lists {
+		listRooms := make([]*slidingSyncRoomInfo, 0, len(rooms))
+		for _, roomID := range roomIDs {
+			room := rooms[roomID]
+			if !rp.slidingSyncListIncludes(ctx, conn, list.params.Filters, room) {
+				continue
+			}
+			listRooms = append(listRooms, room)
+		}
+		orders := list.params.Sort
+		if len(orders) == 0 {
+			orders = []string{slidingSyncSortByRecency, slidingSyncSortByName}
+		}
+		for _, order := range orders {
+			if order == slidingSyncSortByName {
+				for _, room := range listRooms {
+					rp.loadSlidingSyncRoomName(ctx, conn, room)
+				}
+			}
+		}
+		sortSlidingSyncRooms(listRooms, orders)
+		listRoomIDs := make([]string, len(listRooms))
+		for i, room := range listRooms {
+			listRoomIDs[i] = room.roomID
+		}
+
+		listRes, changed := list.update(listRoomIDs)
+		res.Lists[name] = listRes
+		hasUpdates = hasUpdates || changed
+		for _, window := range list.sent {
+			for _, roomID := range window {
+				wanted[roomID] = mergeSlidingSyncRoomParams(wanted[roomID], list.params.slidingSyncRoomParams)
+			}
+		}
+	}
+	for roomID, params := range conn.subscriptions {
+		if _, ok := rooms[roomID]; ok {
+			wanted[roomID] = mergeSlidingSyncRoomParams(wanted[roomID], params)
+		}
+	}
+
+	// Rooms which left all windows are sent from scratch if they come back.
+	for roomID := range conn.rooms {
+		if _, ok := wanted[roomID]; !ok {
+			delete(conn.rooms, roomID)
+		}
+	}
+
+	for roomID, params := range wanted {
+		room := rooms[roomID]
+		sent, ok := conn.rooms[roomID]
+		var roomRes *slidingSyncRoom
+		switch {
+		case room.invite != nil:
+			if ok && sent.invite {
+				continue
+			}
+			roomRes = &slidingSyncRoom{
+				Initial:     true,
+				InviteState: types.NewInviteResponse(room.invite).InviteState.Events,
+			}
+		case !ok || sent.invite:
+			if roomRes, err = rp.slidingSyncInitialRoom(syncReq, roomID, params, currentPos); err != nil {
+				return nil, false, err
+			}
+		case room.position > sent.position:
+			if roomRes, err = rp.slidingSyncRoomDelta(syncReq, roomID, params, sent.position, room.position); err != nil {
+				return nil, false, err
+			}
+		case room.notificationCount != sent.notificationCount || room.highlightCount != sent.highlightCount:
+			roomRes = &slidingSyncRoom{}
+		default:
+			continue
+		}
+		if roomRes.Initial {
+			rp.loadSlidingSyncRoomName(ctx, conn, room)
+			roomRes.Name = room.name
+		}
+		roomRes.NotificationCount = room.notificationCount
+		roomRes.HighlightCount = room.highlightCount
+		res.Rooms[roomID] = roomRes
+		conn.rooms[roomID] = slidingSyncSentRoom{
+			position:          room.position,
+			invite:            room.invite != nil,
+			notificationCount: room.notificationCount,
+			highlightCount:    room.highlightCount,
+		}
+	}
+	hasUpdates = hasUpdates || len(res.Rooms) > 0
+
+	// Extensions only apply to the joined rooms which the client is looking at.
+	for roomID := range conn.rooms {
+		if rooms[roomID].invite == nil {
+			syncReq.Rooms[roomID] = gomatrixserverlib.Join
+		}
+	}
+	if rp.slidingSyncExtensions(syncReq, conn, currentPos, &res.Extensions) {
+		hasUpdates = true
+	}
+
+	conn.token = currentPos
+	syncReq.Since = currentPos
+	return res, hasUpdates, nil
+}
+
+func (rp *RequestPool) slidingSyncListIncludes(ctx context.Context, conn *slidingSyncConn, filters *slidingSyncFilters, room *slidingSyncRoomInfo) bool {
+	if filters == nil {
+		return true
+	}
+	if filters.IsInvite != nil && *filters.IsInvite != (room.invite != nil) {
+		return false
+	}
+	if filters.RoomNameLike != "" {
+		rp.loadSlidingSyncRoomName(ctx, conn, room)
+		if !strings.Contains(strings.ToLower(room.name), strings.ToLower(filters.RoomNameLike)) {
+			return false
+		}
+	}
+	return true
+}
+
+// loadSlidingSyncRoomName fills in the room name from the m.room.name or
+// m.room.canonical_alias events. For invites the stripped state is used. Names
+// of joined rooms are kept on the connection until there are new events in the room.
+func (rp *RequestPool) loadSlidingSyncRoomName(ctx context.Context, conn *slidingSyncConn, room *slidingSyncRoomInfo) {
+	if room.nameLoaded {
+		return
+	}
+	room.nameLoaded = true
+	if room.invite != nil {
+		stripped := gjson.GetBytes(room.invite.Unsigned(), "invite_room_state").Array()
+		for _, evType := range []string{gomatrixserverlib.MRoomName, gomatrixserverlib.MRoomCanonicalAlias} {
+			for _, ev := range stripped {
+				if ev.Get("type").Str != evType {
+					continue
+				}
+				if name := ev.Get("content.name").Str + ev.Get("content.alias").Str; name != "" {
+					room.name = name
+					return
+				}
+			}
+		}
+		return
+	}
+	if cached, ok := conn.names[room.roomID]; ok && cached.position == room.position {
+		room.name = cached.name
+		return
+	}
+	defer func() {
+		conn.names[room.roomID] = slidingSyncRoomName{name: room.name, position: room.position}
+	}()
+	for _, evType := range []string{gomatrixserverlib.MRoomName, gomatrixserverlib.MRoomCanonicalAlias} {
+		ev, err := rp.db.GetStateEvent(ctx, room.roomID, evType, "")
+		if err != nil || ev == nil {
+			continue
+		}
+		content := gjson.ParseBytes(ev.Content())
+		if name := content.Get("name").Str + content.Get("alias").Str; name != "" {
+			room.name = name
+			return
+		}
+	}
+}
+
+// slidingSyncInitialRoom returns a room the client hasn't seen on this connection,
+// using the PDU stream to build the timeline and state like a complete sync does.
+func (rp *RequestPool) slidingSyncInitialRoom(
+	syncReq *types.SyncRequest, roomID string, params slidingSyncRoomParams, currentPos types.StreamingToken,
+) (*slidingSyncRoom, error) {
+	provider, ok := rp.streams.PDUStreamProvider.(types.RoomStreamProvider)
+	if !ok {
+		return &slidingSyncRoom{Initial: true}, nil
+	}
+	limit := params.timelineLimit()
+	stateFilter := params.stateFilter()
+	eventFilter := gomatrixserverlib.RoomEventFilter{Limit: limit}
+	if eventFilter.Limit == 0 {
+		eventFilter.Limit = 1
+	}
+	r := types.Range{
+		From:      currentPos.PDUPosition,
+		To:        0,
+		Backwards: true,
+	}
+	jr, err := provider.RoomResponse(syncReq.Context, syncReq, roomID, r, &stateFilter, &eventFilter)
+	if err != nil {
+		return nil, err
+	}
+	res := &slidingSyncRoom{
+		Initial:       true,
+		RequiredState: filterRequiredState(params.RequiredState, syncReq.Device.UserID, jr.State.Events, jr.Timeline.Events),
+		Timeline:      jr.Timeline.Events,
+		PrevBatch:     jr.Timeline.PrevBatch,
+		Limited:       jr.Timeline.Limited,
+		JoinedCount:   jr.Summary.JoinedMemberCount,
+		InvitedCount:  jr.Summary.InvitedMemberCount,
+	}
+	if limit == 0 {
+		res.Limited = res.Limited || len(res.Timeline) > 0
+		res.Timeline = nil
+		res.PrevBatch = nil
+	}
+	return res, nil
+}
+
+// slidingSyncRoomDelta returns the new timeline events of a room which the client
+// has already seen on this connection.
+func (rp *RequestPool) slidingSyncRoomDelta(
+	syncReq *types.SyncRequest, roomID string, params slidingSyncRoomParams, from, to types.StreamPosition,
+) (*slidingSyncRoom, error) {
+	ctx := syncReq.Context
+	limit := params.timelineLimit()
+	if limit == 0 {
+		return &slidingSyncRoom{Limited: true}, nil
+	}
+	eventFilter := gomatrixserverlib.RoomEventFilter{Limit: limit}
+	if len(syncReq.IgnoredUsers.List) > 0 {
+		notSenders := make([]string, 0, len(syncReq.IgnoredUsers.List))
+		for userID := range syncReq.IgnoredUsers.List {
+			notSenders = append(notSenders, userID)
+		}
+		eventFilter.NotSenders = &notSenders
+	}
+	r := types.Range{From: from, To: to}
+	recentStreamEvents, limited, err := rp.db.RecentEvents(ctx, roomID, r, &eventFilter, true, true)
+	if err != nil {
+		return nil, err
+	}
+	recentEvents := rp.db.StreamEventsToEvents(syncReq.Device, recentStreamEvents)
+	if err = rp.db.BundleAggregations(ctx, syncReq.Device.UserID, recentEvents); err != nil {
+		return nil, err
+	}
+	res := &slidingSyncRoom{
+		Timeline: gomatrixserverlib.HeaderedToClientEvents(recentEvents, gomatrixserverlib.FormatSync),
+		Limited:  limited,
+	}
+	if limited && len(recentStreamEvents) > 0 {
+		prevBatch, err := rp.db.GetBackwardTopologyPos(ctx, recentStreamEvents)
+		if err != nil {
+			return nil, err
+		}
+		res.PrevBatch = &prevBatch
+	}
+	return res, nil
+}
+
+// slidingSyncExtensions runs the stream providers for the enabled extensions and
+// maps their output into the extension responses. Extensions which weren't sent
+// on this connection before get a complete sync. Returns whether there was anything
+// new to send.
+func (rp *RequestPool) slidingSyncExtensions(
+	syncReq *types.SyncRequest, conn *slidingSyncConn, currentPos types.StreamingToken,
+	res *slidingSyncExtensionsResponse,
+) bool {
+	ctx := syncReq.Context
+	syncReq.Response = types.NewResponse()
+	syncReq.Filter.AccountData.Limit = math.MaxInt32
+	syncReq.Filter.Room.AccountData.Limit = math.MaxInt32
+
+	providers := map[string]struct {
+		provider types.StreamProvider
+		to       types.StreamPosition
+	}{
+		slidingSyncExtToDevice:    {rp.streams.SendToDeviceStreamProvider, currentPos.SendToDevicePosition},
+		slidingSyncExtE2EE:        {rp.streams.DeviceListStreamProvider, currentPos.DeviceListPosition},
+		slidingSyncExtAccountData: {rp.streams.AccountDataStreamProvider, currentPos.AccountDataPosition},
+		slidingSyncExtReceipts:    {rp.streams.ReceiptStreamProvider, currentPos.ReceiptPosition},
+		slidingSyncExtTyping:      {rp.streams.TypingStreamProvider, currentPos.TypingPosition},
+	}
+	for name, p := range providers {
+		if !conn.extensions[name] {
+			delete(conn.extensionPos, name)
+			continue
+		}
+		if from, ok := conn.extensionPos[name]; ok {
+			conn.extensionPos[name] = p.provider.IncrementalSync(ctx, syncReq, from, p.to)
+		} else {
+			conn.extensionPos[name] = p.provider.CompleteSync(ctx, syncReq)
+		}
+	}
+
+	hasUpdates := false
+	if pos, ok := conn.extensionPos[slidingSyncExtToDevice]; ok {
+		res.ToDevice = &slidingSyncToDeviceResponse{
+			NextBatch: strconv.FormatInt(int64(pos), 10),
+			Events:    syncReq.Response.ToDevice.Events,
+		}
+		if res.ToDevice.Events == nil {
+			res.ToDevice.Events = []gomatrixserverlib.SendToDeviceEvent{}
+		}
+		hasUpdates = hasUpdates || len(res.ToDevice.Events) > 0
+	}
+	if _, ok := conn.extensionPos[slidingSyncExtE2EE]; ok {
+		// The device list stream only fills in the key counts for incremental syncs.
+		if syncReq.Response.DeviceListsOTKCount == nil {
+			if err := internal.DeviceOTKCounts(ctx, rp.keyAPI, syncReq.Device.UserID, syncReq.Device.ID, syncReq.Response); err != nil {
+				syncReq.Log.WithError(err).Warn("failed to get OTK counts")
+			}
+		}
+		res.E2EE = &slidingSyncE2EEResponse{
+			DeviceListsOTKCount: syncReq.Response.DeviceListsOTKCount,
+		}
+		res.E2EE.DeviceLists.Changed = syncReq.Response.DeviceLists.Changed
+		res.E2EE.DeviceLists.Left = syncReq.Response.DeviceLists.Left
+		hasUpdates = hasUpdates || len(res.E2EE.DeviceLists.Changed) > 0 || len(res.E2EE.DeviceLists.Left) > 0
+	}
+	if _, ok := conn.extensionPos[slidingSyncExtAccountData]; ok {
+		res.AccountData = &slidingSyncAccountDataResponse{
+			Global: syncReq.Response.AccountData.Events,
+			Rooms:  make(map[string][]gomatrixserverlib.ClientEvent),
+		}
+		if res.AccountData.Global == nil {
+			res.AccountData.Global = []gomatrixserverlib.ClientEvent{}
+		}
+		for roomID, jr := range syncReq.Response.Rooms.Join {
+			if len(jr.AccountData.Events) > 0 {
+				res.AccountData.Rooms[roomID] = jr.AccountData.Events
+			}
+		}
+		hasUpdates = hasUpdates || len(res.AccountData.Global) > 0 || len(res.AccountData.Rooms) > 0
+	}
+	ephemeral := func(name, evType string) *slidingSyncEphemeralResponse {
+		if _, ok := conn.extensionPos[name]; !ok {
+			return nil
+		}
+		ephemeralRes := &slidingSyncEphemeralResponse{
+			Rooms: make(map[string]gomatrixserverlib.ClientEvent),
+		}
+		for roomID, jr := range syncReq.Response.Rooms.Join {
+			for _, ev := range jr.Ephemeral.Events {
+				if ev.Type == evType {
+					ephemeralRes.Rooms[roomID] = ev
+				}
+			}
+		}
+		hasUpdates = hasUpdates || len(ephemeralRes.Rooms) > 0
+		return ephemeralRes
+	}
+	res.Receipts = ephemeral(slidingSyncExtReceipts, gomatrixserverlib.MReceipt)
+	res.Typing = ephemeral(slidingSyncExtTyping, gomatrixserverlib.MTyping)
+	return hasUpdates
+}
+
+// cleanSlidingSyncConns forgets sliding sync connections which haven't been used
+// for a while, so that their state doesn't pile up.
+func (rp *RequestPool) cleanSlidingSyncConns() {
+	for {
+		time.Sleep(time.Minute)
+		rp.slidingConns.Range(func(key, value interface{}) bool {
+			conn := value.(*slidingSyncConn)
+			conn.Lock()
+			expired := time.Since(conn.lastUsed) > slidingSyncConnTimeout
+			conn.Unlock()
+			if expired {
+				rp.slidingConns.Delete(key)
+			}
+			return true
+		})
+	}
+}
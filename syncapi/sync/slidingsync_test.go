@@ -0,0 +1,103 @@
+package sync
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestSlidingSyncListUpdate(t *testing.T) {
+	list := &slidingSyncListState{
+		params: slidingSyncList{Ranges: [][2]int64{{0, 1}, {3, 10}}},
+	}
+
+	res, changed := list.update([]string{"!a", "!b", "!c", "!d"})
+	if !changed {
+		t.Fatalf("expected the first update to have changes")
+	}
+	wantOps := []slidingSyncOp{
+		{Op: "SYNC", Range: [2]int64{0, 1}, RoomIDs: []string{"!a", "!b"}},
+		{Op: "SYNC", Range: [2]int64{3, 10}, RoomIDs: []string{"!d"}},
+	}
+	if res.Count != 4 || !reflect.DeepEqual(res.Ops, wantOps) {
+		t.Fatalf("unexpected response: %+v", res)
+	}
+
+	// Nothing moved inside the windows, so there is nothing to send.
+	if res, changed = list.update([]string{"!a", "!b", "!c", "!d"}); changed || len(res.Ops) != 0 {
+		t.Fatalf("expected no changes, got %+v", res)
+	}
+
+	// A room moving into the first window only resends that window.
+	res, changed = list.update([]string{"!c", "!a", "!b", "!d"})
+	if !changed || len(res.Ops) != 1 || !reflect.DeepEqual(res.Ops[0].RoomIDs, []string{"!c", "!a"}) {
+		t.Fatalf("unexpected response: %+v", res)
+	}
+
+	// Ranges which are no longer requested are invalidated.
+	list.params.Ranges = [][2]int64{{0, 1}}
+	res, _ = list.update([]string{"!c", "!a", "!b", "!d"})
+	wantOps = []slidingSyncOp{{Op: "INVALIDATE", Range: [2]int64{3, 10}}}
+	if !reflect.DeepEqual(res.Ops, wantOps) {
+		t.Fatalf("unexpected ops: %+v", res.Ops)
+	}
+}
+
+func TestSortSlidingSyncRooms(t *testing.T) {
+	rooms := []*slidingSyncRoomInfo{
+		{roomID: "!a", name: "Zebra", position: 5},
+		{roomID: "!b", name: "apple", position: 5, highlightCount: 1},
+		{roomID: "!c", position: 9},
+		{roomID: "!d", name: "Mango", position: 1, notificationCount: 3},
+	}
+	tests := []struct {
+		orders []string
+		want   []string
+	}{
+		{orders: []string{slidingSyncSortByRecency, slidingSyncSortByName}, want: []string{"!c", "!b", "!a", "!d"}},
+		{orders: []string{slidingSyncSortByName}, want: []string{"!c", "!b", "!d", "!a"}},
+		{orders: []string{slidingSyncSortByNotificationLevel, slidingSyncSortByRecency}, want: []string{"!b", "!d", "!c", "!a"}},
+	}
+	for _, tc := range tests {
+		sortSlidingSyncRooms(rooms, tc.orders)
+		got := make([]string, len(rooms))
+		for i, room := range rooms {
+			got[i] = room.roomID
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("sort %v: got %v want %v", tc.orders, got, tc.want)
+		}
+	}
+}
+
+func TestFilterRequiredState(t *testing.T) {
+	stateKey := func(s string) *string { return &s }
+	state := []gomatrixserverlib.ClientEvent{
+		{Type: gomatrixserverlib.MRoomName, StateKey: stateKey("")},
+		{Type: "m.room.topic", StateKey: stateKey("")},
+		{Type: gomatrixserverlib.MRoomMember, StateKey: stateKey("@alice:test")},
+		{Type: gomatrixserverlib.MRoomMember, StateKey: stateKey("@bob:test")},
+		{Type: gomatrixserverlib.MRoomMember, StateKey: stateKey("@charlie:test")},
+	}
+	timeline := []gomatrixserverlib.ClientEvent{
+		{Type: "m.room.message", Sender: "@bob:test"},
+	}
+	required := [][2]string{
+		{gomatrixserverlib.MRoomName, ""},
+		{gomatrixserverlib.MRoomMember, "$LAZY"},
+	}
+	got := filterRequiredState(required, "@alice:test", state, timeline)
+	var gotKeys []string
+	for _, ev := range got {
+		gotKeys = append(gotKeys, ev.Type+"|"+*ev.StateKey)
+	}
+	want := []string{"m.room.name|", "m.room.member|@alice:test", "m.room.member|@bob:test"}
+	if !reflect.DeepEqual(gotKeys, want) {
+		t.Fatalf("got %v want %v", gotKeys, want)
+	}
+
+	if got = filterRequiredState([][2]string{{"*", "*"}}, "@alice:test", state, nil); len(got) != len(state) {
+		t.Fatalf("expected all state for wildcards, got %d events", len(got))
+	}
+}
@@ -314,6 +314,126 @@ func testSyncAPIUpdatePresenceImmediately(t *testing.T, dbType test.DBType) {
 
 }
 
+func TestSyncAPIFilters(t *testing.T) {
+	test.WithAllDatabases(t, testSyncAPIFilters)
+}
+
+func testSyncAPIFilters(t *testing.T, dbType test.DBType) {
+	user := test.NewUser(t)
+	bob := test.NewUser(t)
+	charlie := test.NewUser(t)
+	room := test.NewRoom(t, user)
+	room.CreateAndInsert(t, charlie, gomatrixserverlib.MRoomMember, map[string]interface{}{"membership": "join"}, test.WithStateKey(charlie.ID))
+	room.CreateAndInsert(t, bob, gomatrixserverlib.MRoomMember, map[string]interface{}{"membership": "join"}, test.WithStateKey(bob.ID))
+	room.CreateAndInsert(t, user, "m.room.message", map[string]interface{}{"body": "hello"})
+	room.CreateAndInsert(t, bob, "m.room.message", map[string]interface{}{"body": "hi"})
+	other := test.NewRoom(t, user)
+	alice := userapi.Device{
+		ID:          "ALICEID",
+		UserID:      user.ID,
+		AccessToken: "ALICE_BEARER_TOKEN",
+		DisplayName: "Alice",
+		AccountType: userapi.AccountTypeUser,
+	}
+
+	base, close := testrig.CreateBaseDendrite(t, dbType)
+	base.Cfg.Global.Presence.EnableOutbound = true
+	base.Cfg.Global.Presence.EnableInbound = true
+	defer close()
+
+	jsctx, _ := base.NATS.Prepare(base.ProcessContext, &base.Cfg.Global.JetStream)
+	defer jetstream.DeleteAllStreams(jsctx, &base.Cfg.Global.JetStream)
+	msgs := append(toNATSMsgs(t, base, room.Events()), toNATSMsgs(t, base, other.Events())...)
+	AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{alice}}, &syncRoomserverAPI{rooms: []*test.Room{room, other}}, &syncKeyAPI{})
+	testrig.MustPublishMsgs(t, jsctx, msgs...)
+	time.Sleep(500 * time.Millisecond)
+
+	syncWithFilter := func(name, filter string) types.Response {
+		t.Helper()
+		w := httptest.NewRecorder()
+		base.PublicClientAPIMux.ServeHTTP(w, test.NewRequest(t, "GET", "/_matrix/client/v3/sync", test.WithQueryParams(map[string]string{
+			"access_token": alice.AccessToken,
+			"timeout":      "0",
+			"set_presence": "online",
+			"filter":       filter,
+		})))
+		if w.Code != 200 {
+			t.Fatalf("%s: got HTTP %d want 200", name, w.Code)
+		}
+		var res types.Response
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+			t.Fatalf("%s: failed to decode response body: %s", name, err)
+		}
+		return res
+	}
+	hasMember := func(events []gomatrixserverlib.ClientEvent, userID string) bool {
+		for _, ev := range events {
+			if ev.Type == gomatrixserverlib.MRoomMember && ev.StateKey != nil && *ev.StateKey == userID {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Rooms in not_rooms are left out of the response
+	res := syncWithFilter("not_rooms", fmt.Sprintf(`{"room":{"not_rooms":[%q]}}`, other.ID))
+	if _, ok := res.Rooms.Join[other.ID]; ok || len(res.Rooms.Join) != 1 {
+		t.Errorf("not_rooms: got joined rooms %v, want only %s", res.Rooms.Join, room.ID)
+	}
+
+	// Only timeline events of the senders, and never of the not_senders
+	for name, filter := range map[string]string{
+		"senders":     fmt.Sprintf(`{"room":{"timeline":{"senders":[%q]}}}`, bob.ID),
+		"not_senders": fmt.Sprintf(`{"room":{"timeline":{"not_senders":[%q, %q]}}}`, user.ID, charlie.ID),
+	} {
+		res = syncWithFilter(name, filter)
+		timeline := res.Rooms.Join[room.ID].Timeline.Events
+		if len(timeline) != 2 {
+			t.Errorf("%s: got %d timeline events, want 2", name, len(timeline))
+		}
+		for _, ev := range timeline {
+			if ev.Sender != bob.ID {
+				t.Errorf("%s: got timeline event from %s", name, ev.Sender)
+			}
+		}
+	}
+
+	// Without lazy loading, the state has the memberships of users who aren't in the timeline
+	res = syncWithFilter("no lazy loading", `{"room":{"timeline":{"limit":1}}}`)
+	if state := res.Rooms.Join[room.ID].State.Events; !hasMember(state, charlie.ID) {
+		t.Errorf("no lazy loading: the state has no membership of %s", charlie.ID)
+	}
+	// With lazy loading, only the memberships of the syncing user and the timeline senders are in the state,
+	// whether lazy_load_members is in the state filter or in the timeline filter
+	for name, filter := range map[string]string{
+		"lazy_load_members in state":    `{"room":{"timeline":{"limit":1},"state":{"lazy_load_members":true,"include_redundant_members":true}}}`,
+		"lazy_load_members in timeline": `{"room":{"timeline":{"limit":1,"lazy_load_members":true,"include_redundant_members":true}}}`,
+	} {
+		res = syncWithFilter(name, filter)
+		state := res.Rooms.Join[room.ID].State.Events
+		if hasMember(state, charlie.ID) {
+			t.Errorf("%s: the state has the membership of %s who is not in the timeline", name, charlie.ID)
+		}
+		if !hasMember(state, user.ID) || !hasMember(state, bob.ID) {
+			t.Errorf("%s: the state is missing the membership of %s or %s", name, user.ID, bob.ID)
+		}
+	}
+
+	// Presence is filtered by senders and types
+	for name, filter := range map[string]string{
+		"presence not_senders": fmt.Sprintf(`{"presence":{"not_senders":[%q]}}`, user.ID),
+		"presence types":       `{"presence":{"types":["m.typing"]}}`,
+	} {
+		if res = syncWithFilter(name, filter); len(res.Presence.Events) != 0 {
+			t.Errorf("%s: got presence events %+v, want none", name, res.Presence.Events)
+		}
+	}
+	res = syncWithFilter("presence senders", fmt.Sprintf(`{"presence":{"senders":[%q]}}`, user.ID))
+	if len(res.Presence.Events) != 1 || res.Presence.Events[0].Sender != user.ID {
+		t.Errorf("presence senders: got presence events %+v, want one of %s", res.Presence.Events, user.ID)
+	}
+}
+
 func TestSendToDevice(t *testing.T) {
 	test.WithAllDatabases(t, testSendToDevice)
 }
@@ -447,6 +567,155 @@ func testSendToDevice(t *testing.T, dbType test.DBType) {
 	}
 }
 
+func TestSlidingSync(t *testing.T) {
+	test.WithAllDatabases(t, testSlidingSync)
+}
+
+func testSlidingSync(t *testing.T, dbType test.DBType) {
+	user := test.NewUser(t)
+	alpha := test.NewRoom(t, user)
+	alpha.CreateAndInsert(t, user, gomatrixserverlib.MRoomName, map[string]interface{}{"name": "Alpha"}, test.WithStateKey(""))
+	beta := test.NewRoom(t, user)
+	beta.CreateAndInsert(t, user, gomatrixserverlib.MRoomName, map[string]interface{}{"name": "Beta"}, test.WithStateKey(""))
+	alice := userapi.Device{
+		ID:          "ALICEID",
+		UserID:      user.ID,
+		AccessToken: "ALICE_BEARER_TOKEN",
+		DisplayName: "Alice",
+		AccountType: userapi.AccountTypeUser,
+	}
+
+	base, close := testrig.CreateBaseDendrite(t, dbType)
+	defer close()
+	base.Cfg.MSCs.MSCs = []string{"msc3575"}
+
+	jsctx, _ := base.NATS.Prepare(base.ProcessContext, &base.Cfg.Global.JetStream)
+	defer jetstream.DeleteAllStreams(jsctx, &base.Cfg.Global.JetStream)
+	msgs := append(toNATSMsgs(t, base, alpha.Events()), toNATSMsgs(t, base, beta.Events())...)
+	AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{alice}}, &syncRoomserverAPI{rooms: []*test.Room{alpha, beta}}, &syncKeyAPI{})
+	testrig.MustPublishMsgs(t, jsctx, msgs...)
+	time.Sleep(500 * time.Millisecond)
+
+	producer := producers.SyncAPIProducer{
+		TopicSendToDeviceEvent: base.Cfg.Global.JetStream.Prefixed(jetstream.OutputSendToDeviceEvent),
+		JetStream:              jsctx,
+	}
+
+	slidingSync := func(name, pos string, body map[string]interface{}, wantCode int) gjson.Result {
+		t.Helper()
+		w := httptest.NewRecorder()
+		base.PublicClientAPIMux.ServeHTTP(w, test.NewRequest(t, "POST", "/_matrix/client/unstable/org.matrix.msc3575/sync",
+			test.WithQueryParams(map[string]string{
+				"access_token": alice.AccessToken,
+				"timeout":      "0",
+				"pos":          pos,
+			}),
+			test.WithJSONBody(t, body),
+		))
+		if w.Code != wantCode {
+			t.Fatalf("%s: got HTTP %d want %d: %s", name, w.Code, wantCode, w.Body.String())
+		}
+		return gjson.Parse(w.Body.String())
+	}
+	roomIDs := func(res gjson.Result, path string) []string {
+		var ids []string
+		for _, id := range res.Get(path).Array() {
+			ids = append(ids, id.Str)
+		}
+		return ids
+	}
+
+	// The list only covers the first room by name
+	res := slidingSync("list ranges", "", map[string]interface{}{
+		"lists": map[string]interface{}{
+			"all": map[string]interface{}{
+				"ranges":         [][2]int{{0, 0}},
+				"sort":           []string{"by_name"},
+				"timeline_limit": 1,
+				"required_state": [][2]string{{gomatrixserverlib.MRoomName, ""}},
+			},
+		},
+	}, http.StatusOK)
+	if got := res.Get("lists.all.count").Int(); got != 2 {
+		t.Fatalf("list ranges: got count %d want 2", got)
+	}
+	if got := roomIDs(res, "lists.all.ops.0.room_ids"); !reflect.DeepEqual(got, []string{alpha.ID}) {
+		t.Fatalf("list ranges: got rooms %v want %v", got, []string{alpha.ID})
+	}
+	if got := res.Get("rooms").Map(); len(got) != 1 {
+		t.Fatalf("list ranges: got %d rooms want 1", len(got))
+	}
+	room := res.Get("rooms").Map()[alpha.ID]
+	if room.Get("name").Str != "Alpha" || !room.Get("initial").Bool() ||
+		len(room.Get("timeline").Array()) != 1 || len(room.Get("required_state").Array()) != 1 {
+		t.Fatalf("list ranges: unexpected room %s", room.Raw)
+	}
+	if pos := res.Get("pos").Str; pos != "1" {
+		t.Fatalf("list ranges: got pos %q want 1", pos)
+	}
+
+	// Subscribing to the other room sends it without touching the list
+	res = slidingSync("room subscriptions", "1", map[string]interface{}{
+		"room_subscriptions": map[string]interface{}{
+			beta.ID: map[string]interface{}{"timeline_limit": 0},
+		},
+	}, http.StatusOK)
+	if res.Get("lists.all.ops").Exists() {
+		t.Fatalf("room subscriptions: unexpected list ops %s", res.Get("lists.all.ops").Raw)
+	}
+	room = res.Get("rooms").Map()[beta.ID]
+	if room.Get("name").Str != "Beta" || !room.Get("initial").Bool() || room.Get("timeline").Exists() {
+		t.Fatalf("room subscriptions: unexpected room %s", room.Raw)
+	}
+	if res.Get("rooms").Map()[alpha.ID].Exists() {
+		t.Fatalf("room subscriptions: unchanged room was sent again")
+	}
+
+	// Enabling an extension sends what is pending for it
+	if err := producer.SendToDevice(context.Background(), user.ID, user.ID, alice.ID, "m.dendrite.test", map[string]string{"dummy": "message 1"}); err != nil {
+		t.Fatalf("unable to send to device message: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	extensions := map[string]interface{}{
+		"extensions": map[string]interface{}{
+			"to_device": map[string]interface{}{"enabled": true},
+		},
+	}
+	res = slidingSync("extensions", "2", extensions, http.StatusOK)
+	if got := res.Get("extensions.to_device.events.#.content.dummy").Raw; got != `["message 1"]` {
+		t.Fatalf("extensions: got to-device messages %s", got)
+	}
+	if pos := res.Get("pos").Str; pos != "3" {
+		t.Fatalf("extensions: got pos %q want 3", pos)
+	}
+
+	// A client which didn't get the last response can retry it, but can't go back further
+	res = slidingSync("retried pos", "2", extensions, http.StatusOK)
+	if got := res.Get("extensions.to_device.events.#.content.dummy").Raw; got != `["message 1"]` {
+		t.Fatalf("retried pos: got to-device messages %s", got)
+	}
+	if pos := res.Get("pos").Str; pos != "3" {
+		t.Fatalf("retried pos: got pos %q want 3", pos)
+	}
+	res = slidingSync("old pos", "1", nil, http.StatusBadRequest)
+	if errcode := res.Get("errcode").Str; errcode != "M_UNKNOWN_POS" {
+		t.Fatalf("old pos: got errcode %q want M_UNKNOWN_POS", errcode)
+	}
+	slidingSync("unknown connection", "3", map[string]interface{}{"conn_id": "other"}, http.StatusBadRequest)
+
+	// Renaming a room moves it within the list
+	ev := beta.CreateAndInsert(t, user, gomatrixserverlib.MRoomName, map[string]interface{}{"name": "Aardvark"}, test.WithStateKey(""))
+	testrig.MustPublishMsgs(t, jsctx, toNATSMsgs(t, base, []*gomatrixserverlib.HeaderedEvent{ev})...)
+	time.Sleep(100 * time.Millisecond)
+	res = slidingSync("renamed room", "3", nil, http.StatusOK)
+	if got := roomIDs(res, "lists.all.ops.0.room_ids"); !reflect.DeepEqual(got, []string{beta.ID}) {
+		t.Fatalf("renamed room: got rooms %v want %v", got, []string{beta.ID})
+	}
+	if res.Get("extensions.to_device.events.#").Int() != 0 {
+		t.Fatalf("renamed room: acknowledged to-device messages were sent again")
+	}
+}
+
 func toNATSMsgs(t *testing.T, base *base.BaseDendrite, input []*gomatrixserverlib.HeaderedEvent) []*nats.Msg {
 	result := make([]*nats.Msg, len(input))
 	for i, ev := range input {
@@ -15,6 +15,7 @@
 package types
 
 import (
+	"encoding/json"
 	"strings"
 	"time"
 
@@ -24,10 +25,12 @@ import (
 type Presence uint8
 
 const (
-	PresenceUnknown     Presence = iota
-	PresenceUnavailable          // unavailable
-	PresenceOnline               // online
-	PresenceOffline              // offline
+	PresenceUnknown      Presence = iota
+	PresenceUnavailable           // unavailable
+	PresenceOnline                // online
+	PresenceOffline               // offline
+	PresenceBusy                  // busy
+	PresenceDoNotDisturb          // dnd
 )
 
 func (p Presence) String() string {
@@ -38,11 +41,33 @@ func (p Presence) String() string {
 		return "online"
 	case PresenceOffline:
 		return "offline"
+	case PresenceBusy:
+		return "busy"
+	case PresenceDoNotDisturb:
+		return "dnd"
 	default:
 		return "unknown"
 	}
 }
 
+// FederationString returns the presence as sent to other servers. The
+// specification only knows online, unavailable and offline, so busy and
+// do not disturb are sent as unavailable.
+func (p Presence) FederationString() string {
+	switch p {
+	case PresenceBusy, PresenceDoNotDisturb:
+		return PresenceUnavailable.String()
+	default:
+		return p.String()
+	}
+}
+
+// SetByUser returns true for the presences which only change when the user
+// sets them, rather than following the user's activity.
+func (p Presence) SetByUser() bool {
+	return p == PresenceBusy || p == PresenceDoNotDisturb
+}
+
 // PresenceFromString returns the integer representation of the given input presence.
 // Returns false for ok, if input is not a valid presence value.
 func PresenceFromString(input string) (Presence, bool) {
@@ -53,11 +78,71 @@ func PresenceFromString(input string) (Presence, bool) {
 		return PresenceOnline, true
 	case "offline":
 		return PresenceOffline, true
+	case "busy", "org.matrix.msc3026.busy":
+		return PresenceBusy, true
+	case "dnd":
+		return PresenceDoNotDisturb, true
 	default:
 		return PresenceUnknown, false
 	}
 }
 
+// PresencePrivacyAccountDataType is the global account data type in which
+// users store who may see their presence, i.e. {"privacy": "contacts"}.
+const PresencePrivacyAccountDataType = "org.matrix.dendrite.presence_privacy"
+
+// PresencePrivacy limits who can see the presence of a local user.
+type PresencePrivacy uint8
+
+const (
+	// Everyone sharing a room with the user, and other servers
+	PresencePrivacyEveryone PresencePrivacy = iota
+	// Only local users in the user's address book
+	PresencePrivacyContacts
+	// Only the user themselves
+	PresencePrivacyNobody
+)
+
+func (p PresencePrivacy) String() string {
+	switch p {
+	case PresencePrivacyContacts:
+		return "contacts"
+	case PresencePrivacyNobody:
+		return "nobody"
+	default:
+		return "everyone"
+	}
+}
+
+// PresencePrivacyFromString returns the privacy setting for the given input.
+// Returns false for ok, if input is not a valid privacy setting.
+func PresencePrivacyFromString(input string) (PresencePrivacy, bool) {
+	switch strings.ToLower(input) {
+	case "everyone":
+		return PresencePrivacyEveryone, true
+	case "contacts":
+		return PresencePrivacyContacts, true
+	case "nobody":
+		return PresencePrivacyNobody, true
+	default:
+		return PresencePrivacyEveryone, false
+	}
+}
+
+// PresencePrivacyFromAccountData returns the privacy setting stored in the
+// account data of type PresencePrivacyAccountDataType. Missing or invalid
+// settings mean everyone may see the presence.
+func PresencePrivacyFromAccountData(data json.RawMessage) PresencePrivacy {
+	var content struct {
+		Privacy string `json:"privacy"`
+	}
+	if len(data) == 0 || json.Unmarshal(data, &content) != nil {
+		return PresencePrivacyEveryone
+	}
+	privacy, _ := PresencePrivacyFromString(content.Privacy)
+	return privacy
+}
+
 type PresenceInternal struct {
 	ClientFields PresenceClientResponse
 	StreamPos    StreamPosition              `json:"-"`
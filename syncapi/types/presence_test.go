@@ -0,0 +1,61 @@
+package types
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestPresenceFromString(t *testing.T) {
+	tests := map[string]Presence{
+		"online":                  PresenceOnline,
+		"unavailable":             PresenceUnavailable,
+		"offline":                 PresenceOffline,
+		"busy":                    PresenceBusy,
+		"org.matrix.msc3026.busy": PresenceBusy,
+		"dnd":                     PresenceDoNotDisturb,
+	}
+	for input, want := range tests {
+		got, ok := PresenceFromString(input)
+		if !ok {
+			t.Errorf("expected %q to be a valid presence", input)
+		}
+		if got != want {
+			t.Errorf("expected %q to be %s, got %s", input, want, got)
+		}
+	}
+	if _, ok := PresenceFromString("away"); ok {
+		t.Errorf("expected %q to be an invalid presence", "away")
+	}
+}
+
+func TestPresenceFederationString(t *testing.T) {
+	tests := map[Presence]string{
+		PresenceOnline:       "online",
+		PresenceUnavailable:  "unavailable",
+		PresenceOffline:      "offline",
+		PresenceBusy:         "unavailable",
+		PresenceDoNotDisturb: "unavailable",
+	}
+	for presence, want := range tests {
+		if got := presence.FederationString(); got != want {
+			t.Errorf("expected %s to be sent over federation as %q, got %q", presence, want, got)
+		}
+	}
+}
+
+func TestPresencePrivacyFromAccountData(t *testing.T) {
+	tests := map[string]PresencePrivacy{
+		``:                       PresencePrivacyEveryone,
+		`{}`:                     PresencePrivacyEveryone,
+		`not json`:               PresencePrivacyEveryone,
+		`{"privacy":"unknown"}`:  PresencePrivacyEveryone,
+		`{"privacy":"everyone"}`: PresencePrivacyEveryone,
+		`{"privacy":"contacts"}`: PresencePrivacyContacts,
+		`{"privacy":"nobody"}`:   PresencePrivacyNobody,
+	}
+	for input, want := range tests {
+		if got := PresencePrivacyFromAccountData(json.RawMessage(input)); got != want {
+			t.Errorf("expected %q to be %s, got %s", input, want, got)
+		}
+	}
+}
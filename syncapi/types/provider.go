@@ -18,6 +18,8 @@ type SyncRequest struct {
 	Since         StreamingToken
 	Timeout       time.Duration
 	WantFullState bool
+	// Whether the filter asked for unread_thread_notifications (MSC3773).
+	UnreadThreadNotifications bool
 
 	// Updated by the PDU stream.
 	Rooms map[string]string
@@ -61,3 +63,14 @@ type StreamProvider interface {
 	// LatestPosition returns the latest stream position for this stream.
 	LatestPosition(ctx context.Context) StreamPosition
 }
+
+// RoomStreamProvider is implemented by stream providers which can build the
+// response for a single room on demand, e.g. for sliding sync.
+type RoomStreamProvider interface {
+	// RoomResponse returns the timeline within the range and the current state of
+	// the given room, as they would be returned by a complete sync.
+	RoomResponse(
+		ctx context.Context, req *SyncRequest, roomID string, r Range,
+		stateFilter *gomatrixserverlib.StateFilter, eventFilter *gomatrixserverlib.RoomEventFilter,
+	) (*JoinResponse, error)
+}
@@ -23,6 +23,7 @@ import (
 
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
 
 	"github.com/matrix-org/dendrite/roomserver/api"
 )
@@ -326,6 +327,37 @@ type PrevEventRef struct {
 	PrevSender    string          `json:"prev_sender"`
 }
 
+// Filter is a sync filter. gomatrixserverlib.Filter doesn't know about the
+// unread_thread_notifications option of the timeline filter (MSC3773), so it
+// is kept next to it and written to and read from the same JSON.
+type Filter struct {
+	gomatrixserverlib.Filter
+	UnreadThreadNotifications bool
+}
+
+// NewFilter returns a filter with the default values.
+func NewFilter() Filter {
+	return Filter{Filter: gomatrixserverlib.DefaultFilter()}
+}
+
+func (f Filter) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(f.Filter)
+	if err != nil || !f.UnreadThreadNotifications {
+		return data, err
+	}
+	return sjson.SetBytes(data, "room.timeline.unread_thread_notifications", true)
+}
+
+func (f *Filter) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &f.Filter); err != nil {
+		return err
+	}
+	timeline := gjson.GetBytes(data, "room.timeline")
+	f.UnreadThreadNotifications = timeline.Get("unread_thread_notifications").Bool() ||
+		timeline.Get(`org\.matrix\.msc3773\.unread_thread_notifications`).Bool()
+	return nil
+}
+
 // Response represents a /sync API response. See https://matrix.org/docs/spec/client_server/r0.2.0.html#get-matrix-client-r0-sync
 type Response struct {
 	NextBatch   StreamingToken `json:"next_batch"`
@@ -418,10 +450,18 @@ type JoinResponse struct {
 	AccountData struct {
 		Events []gomatrixserverlib.ClientEvent `json:"events"`
 	} `json:"account_data"`
-	UnreadNotifications struct {
-		HighlightCount    int `json:"highlight_count"`
-		NotificationCount int `json:"notification_count"`
-	} `json:"unread_notifications"`
+	UnreadNotifications UnreadNotifications `json:"unread_notifications"`
+	// The counts of threads, which are then left out of unread_notifications,
+	// if the filter asked for them (MSC3773).
+	UnreadThreadNotifications map[string]UnreadNotifications `json:"unread_thread_notifications,omitempty"`
+	// The number of unread messages, regardless of push rules (MSC2654).
+	UnreadCount int `json:"unread_count"`
+}
+
+// UnreadNotifications are the unread notification counts of a room or thread.
+type UnreadNotifications struct {
+	HighlightCount    int `json:"highlight_count"`
+	NotificationCount int `json:"notification_count"`
 }
 
 // NewJoinResponse creates an empty response with initialised arrays.
@@ -536,3 +576,99 @@ type OutputSendToDeviceEvent struct {
 type IgnoredUsers struct {
 	List map[string]interface{} `json:"ignored_users"`
 }
+
+// SearchResult is an event which matched a full-text search
+type SearchResult struct {
+	EventID string
+	RoomID  string
+	// How well the event matched, higher is better
+	Rank float64
+	// The history visibility of the room when the event was sent
+	HistoryVisibility gomatrixserverlib.HistoryVisibility
+}
+
+// RelationEntry is an event which relates to another event through m.relates_to
+type RelationEntry struct {
+	// The stream position of the relating event
+	Position StreamPosition
+	// The event being related to
+	EventID      string
+	ChildEventID string
+	Sender       string
+}
+
+// AnnotationCount is the number of annotations with the same type and key on an event
+type AnnotationCount struct {
+	EventID string
+	Type    string
+	Key     string
+	Count   int
+}
+
+// ThreadSummary describes the replies to the root event of a thread
+type ThreadSummary struct {
+	RootEventID string
+	Count       int
+	// The stream position and event ID of the latest reply
+	LatestPosition StreamPosition
+	LatestEventID  string
+	// Whether the user the summary was made for replied in the thread
+	Participated bool
+}
+
+// UnreadCounts are the unread counts of a user in a thread of a room. The
+// thread ID is empty for the main timeline.
+type UnreadCounts struct {
+	RoomID    string
+	ThreadID  string
+	StreamPos StreamPosition
+	// The stream position of the latest event which was counted
+	LatestPosition    StreamPosition
+	UnreadCount       int
+	NotificationCount int
+	HighlightCount    int
+}
+
+// RedactedEvent is the original version of an event from before it was redacted
+type RedactedEvent struct {
+	Event *gomatrixserverlib.HeaderedEvent
+	// The event it replaced, if it was an edit
+	ReplacesEventID string
+	// The redaction event and its sender
+	RedactedBy string
+	Redacter   string
+	// When the event was redacted on this server
+	RedactedTS gomatrixserverlib.Timestamp
+}
+
+// EventHistoryAuditEntry records that a user looked at the history of an event
+type EventHistoryAuditEntry struct {
+	UserID    string
+	RoomID    string
+	EventID   string
+	Timestamp gomatrixserverlib.Timestamp
+}
+
+// Aggregations are the relations to an event which are bundled into
+// its unsigned m.relations field.
+type Aggregations struct {
+	Annotation *AnnotationAggregation         `json:"m.annotation,omitempty"`
+	Replace    *gomatrixserverlib.ClientEvent `json:"m.replace,omitempty"`
+	Thread     *ThreadAggregation             `json:"m.thread,omitempty"`
+}
+
+type AnnotationAggregation struct {
+	Chunk []AnnotationAggregationEntry `json:"chunk"`
+}
+
+type AnnotationAggregationEntry struct {
+	Type  string `json:"type"`
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+type ThreadAggregation struct {
+	LatestEvent             gomatrixserverlib.ClientEvent `json:"latest_event"`
+	Count                   int                           `json:"count"`
+	CurrentUserParticipated bool                          `json:"current_user_participated"`
+}
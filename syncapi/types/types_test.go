@@ -63,3 +63,39 @@ func TestNewInviteResponse(t *testing.T) {
 		t.Fatalf("Invite response didn't contain correct info")
 	}
 }
+
+func TestFilterUnreadThreadNotifications(t *testing.T) {
+	for _, data := range []string{
+		`{"room":{"timeline":{"limit":5,"unread_thread_notifications":true}}}`,
+		`{"room":{"timeline":{"limit":5,"org.matrix.msc3773.unread_thread_notifications":true}}}`,
+	} {
+		filter := NewFilter()
+		if err := json.Unmarshal([]byte(data), &filter); err != nil {
+			t.Fatal(err)
+		}
+		if !filter.UnreadThreadNotifications || filter.Room.Timeline.Limit != 5 {
+			t.Fatalf("%s: got unread_thread_notifications %v and limit %d", data, filter.UnreadThreadNotifications, filter.Room.Timeline.Limit)
+		}
+
+		// The option must survive storing the filter
+		j, err := json.Marshal(filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored := NewFilter()
+		if err = json.Unmarshal(j, &stored); err != nil {
+			t.Fatal(err)
+		}
+		if !stored.UnreadThreadNotifications || stored.Room.Timeline.Limit != 5 {
+			t.Fatalf("%s: stored filter %s lost the options", data, j)
+		}
+	}
+
+	filter := NewFilter()
+	if err := json.Unmarshal([]byte(`{"room":{"timeline":{"limit":5}}}`), &filter); err != nil {
+		t.Fatal(err)
+	}
+	if filter.UnreadThreadNotifications {
+		t.Fatal("unread_thread_notifications is enabled by default")
+	}
+}
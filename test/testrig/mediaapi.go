@@ -0,0 +1,39 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testrig
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// CreateMediaAPIDatabase opens a SQLite media API database in a temporary directory
+// which is removed when the test finishes.
+func CreateMediaAPIDatabase(t *testing.T) storage.Database {
+	t.Helper()
+	db, err := storage.NewMediaAPIDatasource(nil, &config.DatabaseOptions{
+		ConnectionString:       config.DataSource("file:" + filepath.Join(t.TempDir(), "mediaapi.db")),
+		MaxOpenConnections:     1,
+		MaxIdleConnections:     1,
+		ConnMaxLifetimeSeconds: -1,
+	})
+	if err != nil {
+		t.Fatalf("error opening mediaapi database: %v", err)
+	}
+	return db
+}
@@ -73,6 +73,7 @@ type SyncUserAPI interface {
 	PerformDeviceUpdate(ctx context.Context, req *PerformDeviceUpdateRequest, res *PerformDeviceUpdateResponse) error
 	QueryDevices(ctx context.Context, req *QueryDevicesRequest, res *QueryDevicesResponse) error
 	QueryDeviceInfos(ctx context.Context, req *QueryDeviceInfosRequest, res *QueryDeviceInfosResponse) error
+	SelectChainData(ctx context.Context, localpart string) (*types2.UserChainInfo, error)
 }
 
 // api functions required by the client api
@@ -4,7 +4,6 @@ import (
 	"context"
 	"encoding/json"
 
-	"github.com/matrix-org/dendrite/internal/pushgateway"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/setup/jetstream"
 	"github.com/matrix-org/dendrite/setup/process"
@@ -24,7 +23,7 @@ type OutputReadUpdateConsumer struct {
 	jetstream    nats.JetStreamContext
 	durable      string
 	db           storage.Database
-	pgClient     pushgateway.Client
+	pushSender   *util.PushSender
 	ServerName   gomatrixserverlib.ServerName
 	topic        string
 	userAPI      uapi.UserInternalAPI
@@ -36,7 +35,7 @@ func NewOutputReadUpdateConsumer(
 	cfg *config.UserAPI,
 	js nats.JetStreamContext,
 	store storage.Database,
-	pgClient pushgateway.Client,
+	pushSender *util.PushSender,
 	userAPI uapi.UserInternalAPI,
 	syncProducer *producers.SyncAPI,
 ) *OutputReadUpdateConsumer {
@@ -48,7 +47,7 @@ func NewOutputReadUpdateConsumer(
 		ServerName:   cfg.Matrix.ServerName,
 		durable:      cfg.Matrix.JetStream.Durable("UserAPISyncAPIReadUpdateConsumer"),
 		topic:        cfg.Matrix.JetStream.Prefixed(jetstream.OutputReadUpdate),
-		pgClient:     pgClient,
+		pushSender:   pushSender,
 		userAPI:      userAPI,
 		syncProducer: syncProducer,
 	}
@@ -105,7 +104,7 @@ func (s *OutputReadUpdateConsumer) onMessage(ctx context.Context, msg *nats.Msg)
 				log.WithError(err).Error("userapi EDU consumer: GetAndSendNotificationData failed")
 				return false
 			}
-			if err = util.NotifyUserCountsAsync(ctx, s.pgClient, localpart, s.db); err != nil {
+			if err = util.NotifyUserCountsAsync(ctx, s.pushSender, localpart, s.db); err != nil {
 				log.WithError(err).Error("userapi EDU consumer: NotifyUserCounts failed")
 				return false
 			}
@@ -120,7 +119,7 @@ func (s *OutputReadUpdateConsumer) onMessage(ctx context.Context, msg *nats.Msg)
 		}
 
 		if deleted {
-			if err := util.NotifyUserCountsAsync(ctx, s.pgClient, localpart, s.db); err != nil {
+			if err := util.NotifyUserCountsAsync(ctx, s.pushSender, localpart, s.db); err != nil {
 				log.WithError(err).Error("userapi clientapi consumer: NotifyUserCounts failed")
 				return false
 			}
@@ -34,7 +34,7 @@ type OutputStreamEventConsumer struct {
 	durable      string
 	db           storage.Database
 	topic        string
-	pgClient     pushgateway.Client
+	pushSender   *util.PushSender
 	syncProducer *producers.SyncAPI
 }
 
@@ -43,7 +43,7 @@ func NewOutputStreamEventConsumer(
 	cfg *config.UserAPI,
 	js nats.JetStreamContext,
 	store storage.Database,
-	pgClient pushgateway.Client,
+	pushSender *util.PushSender,
 	userAPI api.UserInternalAPI,
 	rsAPI rsapi.UserRoomserverAPI,
 	syncProducer *producers.SyncAPI,
@@ -55,7 +55,7 @@ func NewOutputStreamEventConsumer(
 		db:           store,
 		durable:      cfg.Matrix.JetStream.Durable("UserAPISyncAPIStreamEventConsumer"),
 		topic:        cfg.Matrix.JetStream.Prefixed(jetstream.OutputStreamEvent),
-		pgClient:     pgClient,
+		pushSender:   pushSender,
 		userAPI:      userAPI,
 		rsAPI:        rsAPI,
 		syncProducer: syncProducer,
@@ -330,7 +330,10 @@ func (s *OutputStreamEventConsumer) notifyLocal(ctx context.Context, event *goma
 		return err
 	}
 
-	if err = s.syncProducer.GetAndSendNotificationData(ctx, mem.UserID, event.RoomID()); err != nil {
+	// The highlight tweak means true if it has no value.
+	_, highlight := tweaks[string(pushrules.HighlightTweak)]
+	highlight = highlight && pushrules.BoolTweakOr(tweaks, pushrules.HighlightTweak, true)
+	if err = s.syncProducer.GetAndSendEventNotificationData(ctx, mem.UserID, event.RoomID(), event.EventID(), highlight); err != nil {
 		return err
 	}
 
@@ -349,48 +352,41 @@ func (s *OutputStreamEventConsumer) notifyLocal(ctx context.Context, event *goma
 	}).Tracef("Notifying single member")
 
 	// Push gateways are out of our control, and we cannot risk
-	// looking up the server on a misbehaving push gateway. Each user
-	// receives a goroutine now that all internal API calls have been
-	// made.
+	// looking up the server on a misbehaving push gateway. Each push
+	// gateway of the user receives a goroutine with its own deadline now
+	// that all internal API calls have been made, so that a slow gateway
+	// doesn't use up the time of the others.
 	
 	// TODO: think about bounding this to one per user, and what
 	// ordering guarantees we must provide.
-	go func() {
-		// This background processing cannot be tied to a request.
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-		defer cancel()
+	for url, fmts := range devicesByURLAndFormat {
+		// TODO: support "email".
+		if !strings.HasPrefix(url, "http") {
+			continue
+		}
 
-		var rejected []*pushgateway.Device
-		for url, fmts := range devicesByURLAndFormat {
-			for format, devices := range fmts {
-				// TODO: support "email".
-				if !strings.HasPrefix(url, "http") {
-					continue
-				}
+		go func(url string, fmts map[string][]*pushgateway.Device) {
+			// This background processing cannot be tied to a request.
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
 
+			for format, devices := range fmts {
 				// UNSPEC: the specification suggests there can be
 				// more than one device per request. There is at least
 				// one Sytest that expects one HTTP request per
-				// device, rather than per URL. For now, we must
-				// notify each one separately.
-				for _, dev := range devices {
-					rej, err := s.notifyHTTP(ctx, event, url, format, []*pushgateway.Device{dev}, mem.Localpart, roomName, int(userNumUnreadNotifs))
-					if err != nil {
+				// device, rather than per URL, so batching devices
+				// is off unless configured.
+				for _, batch := range s.pushSender.Batches(devices) {
+					if err := s.notifyHTTP(ctx, event, url, format, batch, mem.Localpart, roomName, int(userNumUnreadNotifs)); err != nil {
 						log.WithFields(log.Fields{
 							"event_id":  event.EventID(),
 							"localpart": mem.Localpart,
 						}).WithError(err).Errorf("Unable to notify HTTP pusher")
-						continue
 					}
-					rejected = append(rejected, rej...)
 				}
 			}
-		}
-
-		if len(rejected) > 0 {
-			s.deleteRejectedPushers(ctx, rejected, mem.Localpart)
-		}
-	}()
+		}(url, fmts)
+	}
 
 	return nil
 }
@@ -516,7 +512,7 @@ func (s *OutputStreamEventConsumer) localPushDevices(ctx context.Context, localp
 }
 
 // notifyHTTP performs a notificatation to a Push Gateway.
-func (s *OutputStreamEventConsumer) notifyHTTP(ctx context.Context, event *gomatrixserverlib.HeaderedEvent, url, format string, devices []*pushgateway.Device, localpart, roomName string, userNumUnreadNotifs int) ([]*pushgateway.Device, error) {
+func (s *OutputStreamEventConsumer) notifyHTTP(ctx context.Context, event *gomatrixserverlib.HeaderedEvent, url, format string, devices []*pushgateway.Device, localpart, roomName string, userNumUnreadNotifs int) error {
 	logger := log.WithFields(log.Fields{
 		"event_id":    event.EventID(),
 		"url":         url,
@@ -561,45 +557,9 @@ func (s *OutputStreamEventConsumer) notifyHTTP(ctx context.Context, event *gomat
 	}
 
 	logger.Debugf("Notifying push gateway %s", url)
-	var res pushgateway.NotifyResponse
-	if err := s.pgClient.Notify(ctx, url, &req, &res); err != nil {
+	if err := s.pushSender.Notify(ctx, localpart, url, &req); err != nil {
 		logger.WithError(err).Errorf("Failed to notify push gateway %s", url)
-		return nil, err
-	}
-	logger.WithField("num_rejected", len(res.Rejected)).Tracef("Push gateway result")
-
-	if len(res.Rejected) == 0 {
-		return nil, nil
-	}
-
-	devMap := make(map[string]*pushgateway.Device, len(devices))
-	for _, d := range devices {
-		devMap[d.PushKey] = d
-	}
-	rejected := make([]*pushgateway.Device, 0, len(res.Rejected))
-	for _, pushKey := range res.Rejected {
-		d := devMap[pushKey]
-		if d != nil {
-			rejected = append(rejected, d)
-		}
-	}
-
-	return rejected, nil
-}
-
-// deleteRejectedPushers deletes the pushers associated with the given devices.
-func (s *OutputStreamEventConsumer) deleteRejectedPushers(ctx context.Context, devices []*pushgateway.Device, localpart string) {
-	log.WithFields(log.Fields{
-		"localpart":   localpart,
-		"app_id0":     devices[0].AppID,
-		"num_devices": len(devices),
-	}).Warnf("Deleting pushers rejected by the HTTP push gateway")
-
-	for _, d := range devices {
-		if err := s.db.RemovePusher(ctx, d.AppID, d.PushKey, localpart); err != nil {
-			log.WithFields(log.Fields{
-				"localpart": localpart,
-			}).WithError(err).Errorf("Unable to delete rejected pusher")
-		}
+		return err
 	}
+	return nil
 }
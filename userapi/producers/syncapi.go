@@ -60,21 +60,36 @@ func (p *SyncAPI) SendAccountData(userID string, data eventutil.AccountData) err
 // GetAndSendNotificationData reads the database and sends data about unread
 // notifications to the Sync API server.
 func (p *SyncAPI) GetAndSendNotificationData(ctx context.Context, userID, roomID string) error {
+	return p.getAndSendNotificationData(ctx, userID, &eventutil.NotificationData{
+		RoomID: roomID,
+	})
+}
+
+// GetAndSendEventNotificationData is like GetAndSendNotificationData, but
+// also tells the Sync API server which event the user was notified about,
+// so that it can count the notification in the thread of the event.
+func (p *SyncAPI) GetAndSendEventNotificationData(ctx context.Context, userID, roomID, eventID string, highlight bool) error {
+	return p.getAndSendNotificationData(ctx, userID, &eventutil.NotificationData{
+		RoomID:    roomID,
+		EventID:   eventID,
+		Highlight: highlight,
+	})
+}
+
+func (p *SyncAPI) getAndSendNotificationData(ctx context.Context, userID string, data *eventutil.NotificationData) error {
 	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
 	if err != nil {
 		return err
 	}
 
-	ntotal, nhighlight, err := p.db.GetRoomNotificationCounts(ctx, localpart, roomID)
+	ntotal, nhighlight, err := p.db.GetRoomNotificationCounts(ctx, localpart, data.RoomID)
 	if err != nil {
 		return err
 	}
 
-	return p.sendNotificationData(userID, &eventutil.NotificationData{
-		RoomID:                  roomID,
-		UnreadHighlightCount:    int(nhighlight),
-		UnreadNotificationCount: int(ntotal),
-	})
+	data.UnreadHighlightCount = int(nhighlight)
+	data.UnreadNotificationCount = int(ntotal)
+	return p.sendNotificationData(userID, data)
 }
 
 // sendNotificationData sends data about unread notifications to the Sync API server.
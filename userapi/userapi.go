@@ -15,6 +15,7 @@
 package userapi
 
 import (
+	"net/http"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -82,15 +83,22 @@ func NewInternalAPI(
 		DisableTLSValidation: cfg.PushGatewayDisableTLSValidation,
 	}
 
+	if cfg.PushGateway.Loopback {
+		logrus.Warn("Serving the loopback push gateway, which is only meant for tests")
+		base.DendriteAdminMux.Handle("/pushgateway/notify", pushgateway.NewLoopback()).
+			Methods(http.MethodGet, http.MethodPost, http.MethodDelete)
+	}
+	pushSender := util.NewPushSender(pgClient, db, &cfg.PushGateway)
+
 	readConsumer := consumers.NewOutputReadUpdateConsumer(
-		base.ProcessContext, cfg, js, db, pgClient, userAPI, syncProducer,
+		base.ProcessContext, cfg, js, db, pushSender, userAPI, syncProducer,
 	)
 	if err := readConsumer.Start(); err != nil {
 		logrus.WithError(err).Panic("failed to start user API read update consumer")
 	}
 
 	eventConsumer := consumers.NewOutputStreamEventConsumer(
-		base.ProcessContext, cfg, js, db, pgClient, userAPI, rsAPI, syncProducer,
+		base.ProcessContext, cfg, js, db, pushSender, userAPI, rsAPI, syncProducer,
 	)
 	if err := eventConsumer.Start(); err != nil {
 		logrus.WithError(err).Panic("failed to start user API streamed event consumer")
@@ -13,10 +13,10 @@ import (
 
 // NotifyUserCountsAsync sends notifications to a local user's
 // notification destinations. Database lookups run synchronously, but
-// a single goroutine is started when talking to the Push
-// gateways. There is no way to know when the background goroutine has
-// finished.
-func NotifyUserCountsAsync(ctx context.Context, pgClient pushgateway.Client, localpart string, db storage.Database) error {
+// a goroutine with its own deadline is started per Push gateway, so
+// that a slow gateway doesn't hold up the others. There is no way to
+// know when the background goroutines have finished.
+func NotifyUserCountsAsync(ctx context.Context, pushSender *PushSender, localpart string, db storage.Database) error {
 	pusherDevices, err := GetPushDevices(ctx, localpart, nil, db)
 	if err != nil {
 		return err
@@ -39,38 +39,40 @@ func NotifyUserCountsAsync(ctx context.Context, pgClient pushgateway.Client, loc
 
 	// TODO: think about bounding this to one per user, and what
 	// ordering guarantees we must provide.
-	go func() {
-		// This background processing cannot be tied to a request.
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-		defer cancel()
+	devicesByURL := make(map[string][]*pushgateway.Device, len(pusherDevices))
+	for _, pusherDevice := range pusherDevices {
+		// TODO: support "email".
+		if !strings.HasPrefix(pusherDevice.URL, "http") {
+			continue
+		}
+		devicesByURL[pusherDevice.URL] = append(devicesByURL[pusherDevice.URL], &pusherDevice.Device)
+	}
 
-		// TODO: we could batch all devices with the same URL, but
-		// Sytest requires consumers/roomserver.go to do it
-		// one-by-one, so we do the same here.
-		for _, pusherDevice := range pusherDevices {
-			// TODO: support "email".
-			if !strings.HasPrefix(pusherDevice.URL, "http") {
-				continue
-			}
+	for url, devices := range devicesByURL {
+		go func(url string, devices []*pushgateway.Device) {
+			// This background processing cannot be tied to a request.
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
 
-			req := pushgateway.NotifyRequest{
-				Notification: pushgateway.Notification{
-					Counts: &pushgateway.Counts{
-						Unread: int(userNumUnreadNotifs),
+			for _, batch := range pushSender.Batches(devices) {
+				req := pushgateway.NotifyRequest{
+					Notification: pushgateway.Notification{
+						Counts: &pushgateway.Counts{
+							Unread: int(userNumUnreadNotifs),
+						},
+						Devices: batch,
 					},
-					Devices: []*pushgateway.Device{&pusherDevice.Device},
-				},
+				}
+				if err := pushSender.Notify(ctx, localpart, url, &req); err != nil {
+					log.WithFields(log.Fields{
+						"localpart": localpart,
+						"app_id0":   batch[0].AppID,
+						"pushkey":   batch[0].PushKey,
+					}).WithError(err).Error("HTTP push gateway request failed")
+				}
 			}
-			if err := pgClient.Notify(ctx, pusherDevice.URL, &req, &pushgateway.NotifyResponse{}); err != nil {
-				log.WithFields(log.Fields{
-					"localpart": localpart,
-					"app_id0":   pusherDevice.Device.AppID,
-					"pushkey":   pusherDevice.Device.PushKey,
-				}).WithError(err).Error("HTTP push gateway request failed")
-				return
-			}
-		}
-	}()
+		}(url, devices)
+	}
 
 	return nil
 }
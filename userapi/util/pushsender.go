@@ -0,0 +1,134 @@
+package util
+
+import (
+	"context"
+	"sync"
+
+	"github.com/matrix-org/dendrite/internal/pushgateway"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// PushSender sends notifications to push gateways and deletes the
+// pushers which the gateways don't accept any more.
+type PushSender struct {
+	client pushgateway.Client
+	db     storage.Database
+	cfg    *config.PushGatewayOptions
+
+	mu sync.Mutex
+	// The number of permanent failures in a row per pusher
+	failures map[pusherKey]int
+}
+
+type pusherKey struct {
+	localpart, appID, pushKey string
+}
+
+func NewPushSender(client pushgateway.Client, db storage.Database, cfg *config.PushGatewayOptions) *PushSender {
+	return &PushSender{
+		client:   client,
+		db:       db,
+		cfg:      cfg,
+		failures: map[pusherKey]int{},
+	}
+}
+
+// Batches splits the devices with the same push gateway URL and format
+// into the groups which are notified with one request each.
+func (p *PushSender) Batches(devices []*pushgateway.Device) [][]*pushgateway.Device {
+	if p.cfg.BatchDevices {
+		return [][]*pushgateway.Device{devices}
+	}
+	batches := make([][]*pushgateway.Device, 0, len(devices))
+	for _, d := range devices {
+		batches = append(batches, []*pushgateway.Device{d})
+	}
+	return batches
+}
+
+// Notify sends the notification to the push gateway at the URL. The
+// pushers of devices whose push key the gateway rejected are deleted, as
+// are those which failed permanently too many times in a row.
+func (p *PushSender) Notify(ctx context.Context, localpart, url string, req *pushgateway.NotifyRequest) error {
+	devices := req.Notification.Devices
+	var res pushgateway.NotifyResponse
+	err := p.client.Notify(ctx, url, req, &res)
+	switch {
+	case err == nil:
+		p.resetFailures(localpart, devices)
+		if rejected := rejectedDevices(devices, res.Rejected); len(rejected) > 0 {
+			p.deletePushers(ctx, localpart, rejected, "Deleting pushers rejected by the HTTP push gateway")
+		}
+		return nil
+	case pushgateway.IsPermanent(err):
+		if failed := p.countFailures(localpart, devices); len(failed) > 0 {
+			p.deletePushers(ctx, localpart, failed, "Deleting pushers which failed permanently too often")
+		}
+	}
+	return err
+}
+
+// countFailures counts a permanent failure for the pushers of the devices
+// and returns the devices whose pushers reached the maximum.
+func (p *PushSender) countFailures(localpart string, devices []*pushgateway.Device) []*pushgateway.Device {
+	if p.cfg.MaxPermanentFailures == 0 {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var failed []*pushgateway.Device
+	for _, d := range devices {
+		key := pusherKey{localpart, d.AppID, d.PushKey}
+		p.failures[key]++
+		if p.failures[key] >= p.cfg.MaxPermanentFailures {
+			delete(p.failures, key)
+			failed = append(failed, d)
+		}
+	}
+	return failed
+}
+
+func (p *PushSender) resetFailures(localpart string, devices []*pushgateway.Device) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, d := range devices {
+		delete(p.failures, pusherKey{localpart, d.AppID, d.PushKey})
+	}
+}
+
+// deletePushers deletes the pushers associated with the given devices.
+func (p *PushSender) deletePushers(ctx context.Context, localpart string, devices []*pushgateway.Device, reason string) {
+	log.WithFields(log.Fields{
+		"localpart":   localpart,
+		"app_id0":     devices[0].AppID,
+		"num_devices": len(devices),
+	}).Warn(reason)
+
+	for _, d := range devices {
+		if err := p.db.RemovePusher(ctx, d.AppID, d.PushKey, localpart); err != nil {
+			log.WithFields(log.Fields{
+				"localpart": localpart,
+			}).WithError(err).Errorf("Unable to delete pusher")
+		}
+	}
+}
+
+// rejectedDevices returns the devices with the rejected push keys.
+func rejectedDevices(devices []*pushgateway.Device, pushKeys []string) []*pushgateway.Device {
+	if len(pushKeys) == 0 {
+		return nil
+	}
+	devMap := make(map[string]*pushgateway.Device, len(devices))
+	for _, d := range devices {
+		devMap[d.PushKey] = d
+	}
+	rejected := make([]*pushgateway.Device, 0, len(pushKeys))
+	for _, pushKey := range pushKeys {
+		if d := devMap[pushKey]; d != nil {
+			rejected = append(rejected, d)
+		}
+	}
+	return rejected
+}